@@ -11,8 +11,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/majewsky/portunus/internal/grammars"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 )
@@ -26,37 +30,119 @@ var (
 	userOrGroupPattern = `^[a-z_][a-z0-9_-]*\$?$`
 	envDefaults        = map[string]string{
 		//empty value = not optional
-		"PORTUNUS_DEBUG":              "false",
-		"PORTUNUS_GROUP_NAME_REGEX":   userOrGroupPattern,
-		"PORTUNUS_LDAP_SUFFIX":        "",
-		"PORTUNUS_SERVER_BINARY":      "portunus-server",
-		"PORTUNUS_SERVER_GROUP":       "portunus",
-		"PORTUNUS_SERVER_HTTP_LISTEN": "127.0.0.1:8080",
-		"PORTUNUS_SERVER_HTTP_SECURE": "true",
-		"PORTUNUS_SERVER_STATE_DIR":   "/var/lib/portunus",
-		"PORTUNUS_SERVER_USER":        "portunus",
-		"PORTUNUS_SLAPD_BINARY":       "slapd",
-		"PORTUNUS_SLAPD_GROUP":        "ldap",
-		"PORTUNUS_SLAPD_SCHEMA_DIR":   "/etc/openldap/schema",
-		"PORTUNUS_SLAPD_STATE_DIR":    "/var/run/portunus-slapd",
-		"PORTUNUS_SLAPD_USER":         "ldap",
-		"PORTUNUS_USER_NAME_REGEX":    userOrGroupPattern,
+		"PORTUNUS_DEBUG":                              "false",
+		"PORTUNUS_GROUP_NAME_REGEX":                   userOrGroupPattern,
+		"PORTUNUS_GROUP_REQUIRE_OWNERS":               "false",
+		"PORTUNUS_LDAP_GROUPS_OU":                     "groups",
+		"PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS":           "false",
+		"PORTUNUS_LDAP_SHADOW_MODE":                   "false",
+		"PORTUNUS_LDAP_SUFFIX":                        "",
+		"PORTUNUS_LDAP_USERS_OU":                      "users",
+		"PORTUNUS_LDAP_USER_LAYOUT":                   "flat",
+		"PORTUNUS_LOG_FORMAT":                         "text",
+		"PORTUNUS_PASSWORD_HASH_SCHEME":               "default",
+		"PORTUNUS_POSIX_HOME_TEMPLATE":                "/home/{{.LoginName}}",
+		"PORTUNUS_SERVER_ACCESS_LOG":                  "true",
+		"PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC":   "false",
+		"PORTUNUS_SERVER_ACTIVITY_LOG_SIZE":           "100",
+		"PORTUNUS_SERVER_BINARY":                      "portunus-server",
+		"PORTUNUS_SERVER_DELETED_USER_RETENTION":      "720h",
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW":          "true",
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION": "15m",
+		"PORTUNUS_SERVER_DEVICE_CONFIRMATION":         "false",
+		"PORTUNUS_SERVER_DEVICE_RETENTION":            "2160h",
+		"PORTUNUS_SERVER_GROUP":                       "portunus",
+		"PORTUNUS_SERVER_HTTP_LISTEN":                 "127.0.0.1:8080",
+		"PORTUNUS_SERVER_HTTP_SECURE":                 "true",
+		"PORTUNUS_SERVER_INVITATION_LIFETIME":         "168h",
+		"PORTUNUS_SERVER_LOCALE":                      "en",
+		"PORTUNUS_SERVER_PHOTO_MAX_SIZE":              "1048576",
+		"PORTUNUS_SERVER_READ_ONLY":                   "false",
+		"PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD":        "5",
+		"PORTUNUS_SERVER_SEED_FIGHT_WINDOW":           "1h",
+		"PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT":        "2h",
+		"PORTUNUS_SERVER_SESSION_LIFETIME":            "24h",
+		"PORTUNUS_SERVER_STATE_DIR":                   "/var/lib/portunus",
+		"PORTUNUS_SERVER_STORE":                       "json",
+		"PORTUNUS_SERVER_UNDO_WINDOW":                 "10m",
+		"PORTUNUS_SERVER_USER":                        "portunus",
+		"PORTUNUS_SHARED_NAMESPACE":                   "false",
+		"PORTUNUS_SLAPD_BINARY":                       "slapd",
+		"PORTUNUS_SLAPD_CONFIG_STYLE":                 "slapd.conf",
+		"PORTUNUS_SLAPD_GROUP":                        "ldap",
+		"PORTUNUS_SLAPD_MAX_RESTARTS":                 "5",
+		"PORTUNUS_SLAPD_SCHEMA_DIR":                   "/etc/openldap/schema",
+		"PORTUNUS_SLAPD_SIZE_LIMIT":                   "unlimited",
+		"PORTUNUS_SLAPD_STATE_DIR":                    "/var/run/portunus-slapd",
+		"PORTUNUS_SLAPD_TLS_CIPHER_SUITES":            defaultCipherSuites,
+		"PORTUNUS_SLAPD_USER":                         "ldap",
+		"PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME":       "false",
+		"PORTUNUS_USER_NAME_REGEX":                    userOrGroupPattern,
+		"PORTUNUS_USER_REQUIRE_GROUP":                 "false",
 	}
 
 	strictBoolCheck    = valueCheck{isStrictBool, `either "true" or "false"`}
 	ldapSuffixCheck    = valueCheck{grammars.IsLDAPSuffix, `an RDN with only dc= components`}
+	ouNameCheck        = valueCheck{grammars.IsOUName, `an OU name like "users" (only letters, digits, "-" and "_")`}
 	listenAddressCheck = valueCheck{grammars.IsListenAddress, `a listen address like "1.2.3.4:80" or "[::1]:8080"`}
 	posixAcctNameCheck = valueCheck{grammars.IsPOSIXAccountName, "a POSIX account name (see `man 8 useradd` for format description)"}
+	durationCheck      = valueCheck{isPositiveDuration, `a positive duration like "8h" or "30m"`}
+	positiveIntCheck   = valueCheck{isPositiveInteger, `a positive integer`}
+	configStyleCheck   = valueCheck{isSlapdConfigStyle, `either "slapd.conf" or "olc"`}
+	cipherSuitesCheck  = valueCheck{isCipherSuiteList, `a cipher list like "ECDHE-RSA-AES128-GCM-SHA256:ECDHE-RSA-AES256-GCM-SHA384"`}
+	logFormatCheck     = valueCheck{logging.IsValidFormat, `either "text" or "json"`}
+	storeKindCheck     = valueCheck{isStoreKind, `either "json" or "sqlite"`}
+	hashSchemeCheck    = valueCheck{isPasswordHashScheme, `a password hash scheme like "default", "sha512crypt:rounds=656000", "bcrypt:cost=12" or "argon2"`}
+	sizeLimitCheck     = valueCheck{isSizeLimit, `either "unlimited" or a positive integer`}
+	userLayoutCheck    = valueCheck{isUserLayout, `either "flat" or "department"`}
 
 	envFormats = map[string]valueCheck{
-		"PORTUNUS_DEBUG":              strictBoolCheck,
-		"PORTUNUS_LDAP_SUFFIX":        ldapSuffixCheck,
-		"PORTUNUS_SERVER_GROUP":       posixAcctNameCheck,
-		"PORTUNUS_SERVER_HTTP_LISTEN": listenAddressCheck,
-		"PORTUNUS_SERVER_HTTP_SECURE": strictBoolCheck,
-		"PORTUNUS_SERVER_USER":        posixAcctNameCheck,
-		"PORTUNUS_SLAPD_GROUP":        posixAcctNameCheck,
-		"PORTUNUS_SLAPD_USER":         posixAcctNameCheck,
+		"PORTUNUS_DEBUG":                                     strictBoolCheck,
+		"PORTUNUS_GROUP_REQUIRE_OWNERS":                      strictBoolCheck,
+		"PORTUNUS_LDAP_GROUPS_OU":                            ouNameCheck,
+		"PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS":                  strictBoolCheck,
+		"PORTUNUS_LDAP_SHADOW_MODE":                          strictBoolCheck,
+		"PORTUNUS_LDAP_SUFFIX":                               ldapSuffixCheck,
+		"PORTUNUS_LDAP_USERS_OU":                             ouNameCheck,
+		"PORTUNUS_LDAP_USER_LAYOUT":                          userLayoutCheck,
+		"PORTUNUS_LOG_FORMAT":                                logFormatCheck,
+		"PORTUNUS_PASSWORD_HASH_SCHEME":                      hashSchemeCheck,
+		"PORTUNUS_SERVER_ACCESS_LOG":                         strictBoolCheck,
+		"PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC":          strictBoolCheck,
+		"PORTUNUS_SERVER_ACTIVITY_LOG_SIZE":                  positiveIntCheck,
+		"PORTUNUS_SERVER_DELETED_USER_RETENTION":             durationCheck,
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW":                 strictBoolCheck,
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION":        durationCheck,
+		"PORTUNUS_SERVER_DEVICE_CONFIRMATION":                strictBoolCheck,
+		"PORTUNUS_SERVER_DEVICE_RETENTION":                   durationCheck,
+		"PORTUNUS_SERVER_FEED_DRY_RUN":                       strictBoolCheck,
+		"PORTUNUS_SERVER_FEED_INTERVAL":                      durationCheck,
+		"PORTUNUS_SERVER_FEED_MAX_SIZE":                      positiveIntCheck,
+		"PORTUNUS_SERVER_FEED_TIMEOUT":                       durationCheck,
+		"PORTUNUS_SERVER_GROUP":                              posixAcctNameCheck,
+		"PORTUNUS_SERVER_HTTP_LISTEN":                        listenAddressCheck,
+		"PORTUNUS_SERVER_HTTP_SECURE":                        strictBoolCheck,
+		"PORTUNUS_SERVER_INVITATION_LIFETIME":                durationCheck,
+		"PORTUNUS_SERVER_PHOTO_MAX_SIZE":                     positiveIntCheck,
+		"PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK": strictBoolCheck,
+		"PORTUNUS_SERVER_READ_ONLY":                          strictBoolCheck,
+		"PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD":               positiveIntCheck,
+		"PORTUNUS_SERVER_SEED_FIGHT_WINDOW":                  durationCheck,
+		"PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT":               durationCheck,
+		"PORTUNUS_SERVER_SMTP_PORT":                          positiveIntCheck,
+		"PORTUNUS_SERVER_SESSION_LIFETIME":                   durationCheck,
+		"PORTUNUS_SERVER_STORE":                              storeKindCheck,
+		"PORTUNUS_SERVER_UNDO_WINDOW":                        durationCheck,
+		"PORTUNUS_SERVER_USER":                               posixAcctNameCheck,
+		"PORTUNUS_SHARED_NAMESPACE":                          strictBoolCheck,
+		"PORTUNUS_SLAPD_CONFIG_STYLE":                        configStyleCheck,
+		"PORTUNUS_SLAPD_GROUP":                               posixAcctNameCheck,
+		"PORTUNUS_SLAPD_MAX_RESTARTS":                        positiveIntCheck,
+		"PORTUNUS_SLAPD_SIZE_LIMIT":                          sizeLimitCheck,
+		"PORTUNUS_SLAPD_TLS_CIPHER_SUITES":                   cipherSuitesCheck,
+		"PORTUNUS_SLAPD_USER":                                posixAcctNameCheck,
+		"PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME":              strictBoolCheck,
+		"PORTUNUS_USER_REQUIRE_GROUP":                        strictBoolCheck,
 	}
 )
 
@@ -64,6 +150,38 @@ func isStrictBool(input string) bool {
 	return input == "true" || input == "false"
 }
 
+func isSlapdConfigStyle(input string) bool {
+	return input == "slapd.conf" || input == "olc"
+}
+
+func isStoreKind(input string) bool {
+	return input == "json" || input == "sqlite"
+}
+
+func isSizeLimit(input string) bool {
+	return input == "unlimited" || isPositiveInteger(input)
+}
+
+func isUserLayout(input string) bool {
+	_, err := ldap.ParseUserLayout(input)
+	return err == nil
+}
+
+func isPasswordHashScheme(input string) bool {
+	_, err := crypt.ParseScheme(input)
+	return err == nil
+}
+
+func isPositiveDuration(input string) bool {
+	d, err := time.ParseDuration(input)
+	return err == nil && d > 0
+}
+
+func isPositiveInteger(input string) bool {
+	value, err := strconv.ParseUint(input, 10, 31)
+	return err == nil && value > 0
+}
+
 func readConfig() (environment map[string]string, ids map[string]int) {
 	//last-minute initializations in envDefaults
 	if os.Getenv("PORTUNUS_SLAPD_TLS_CERTIFICATE") != "" {
@@ -72,6 +190,45 @@ func readConfig() (environment map[string]string, ids map[string]int) {
 		envDefaults["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"] = ""
 		envDefaults["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"] = ""
 	}
+	if scheme, err := crypt.ParseScheme(os.Getenv("PORTUNUS_PASSWORD_HASH_SCHEME")); err == nil && scheme.SlapdModule() != "" {
+		envDefaults["PORTUNUS_SLAPD_MODULE_DIR"] = "/usr/lib/openldap"
+	}
+	if os.Getenv("PORTUNUS_SERVER_FEED_URL") != "" {
+		envDefaults["PORTUNUS_SERVER_FEED_DRY_RUN"] = "false"
+		envDefaults["PORTUNUS_SERVER_FEED_INTERVAL"] = "24h"
+		envDefaults["PORTUNUS_SERVER_FEED_MAPPING"] = ""
+		envDefaults["PORTUNUS_SERVER_FEED_MAX_SIZE"] = "10485760"
+		envDefaults["PORTUNUS_SERVER_FEED_TIMEOUT"] = "1m"
+		envDefaults["PORTUNUS_SERVER_FEED_URL"] = ""
+	}
+	if os.Getenv("PORTUNUS_SERVER_OIDC_ISSUER") != "" {
+		envDefaults["PORTUNUS_SERVER_OIDC_CLIENTS"] = ""
+		envDefaults["PORTUNUS_SERVER_OIDC_ISSUER"] = ""
+	}
+	if os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_HEADER") != "" {
+		envDefaults["PORTUNUS_SERVER_PROXY_AUTH_HEADER"] = ""
+		envDefaults["PORTUNUS_SERVER_PROXY_AUTH_SECRET"] = ""
+		envDefaults["PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK"] = "false"
+		envDefaults["PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS"] = ""
+	}
+	if os.Getenv("PORTUNUS_SERVER_SMTP_HOST") != "" {
+		envDefaults["PORTUNUS_SERVER_NOTIFICATION_EVENTS"] = "password_changed,ssh_key_added,new_device,elevation,seed_fight"
+		envDefaults["PORTUNUS_SERVER_SMTP_FROM"] = ""
+		envDefaults["PORTUNUS_SERVER_SMTP_HOST"] = ""
+		envDefaults["PORTUNUS_SERVER_SMTP_PORT"] = "587"
+	}
+	if os.Getenv("PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER") != "" {
+		envDefaults["PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER"] = ""
+	}
+	if os.Getenv("PORTUNUS_SERVER_TRUSTED_PROXIES") != "" {
+		envDefaults["PORTUNUS_SERVER_TRUSTED_PROXIES"] = ""
+	}
+	if os.Getenv("PORTUNUS_USER_DEFAULT_GROUP") != "" {
+		envDefaults["PORTUNUS_USER_DEFAULT_GROUP"] = ""
+	}
+	if os.Getenv("PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX") != "" {
+		envDefaults["PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX"] = ""
+	}
 
 	//read and validate all relevant environment variables
 	environment = make(map[string]string)
@@ -9,61 +9,24 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/logging"
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/must"
 )
 
-// Notes on these configuration templates:
-//   - Only Portunus' own technical user has any sort of write access.
-//   - The cn=portunus-viewers virtual group corresponds to Portunus' `LDAP.CanRead` permission.
-//   - Users can read their own object, so that applications not using a service
-//     user can discover group memberships of a logged-in user.
-//   - TLSProtocolMin 3.3 means "TLS 1.2 or higher". (TODO select cipher suites according to recommendations)
-//
-// TODO when TLS is configured, also listen on ldap:///, but require StartTLS through `security minssf=256`.
-//
-// For what the format directives refer to, compare the fmt.Sprintf() call down below.
-const configTemplateGeneral = `
-include %[1]s/core.schema
-include %[1]s/cosine.schema
-include %[1]s/inetorgperson.schema
-include %[1]s/nis.schema
-
-include %[2]s/portunus.schema
-
-access to dn.base="" by * read
-access to dn.base="cn=Subschema" by * read
-
-access to *
-	by dn.base="cn=portunus,%[3]s" write
-	by group.exact="cn=portunus-viewers,%[3]s" read
-	by self read
-	by anonymous auth
-`
-const configTemplateTLS = `
-TLSCACertificateFile  "%[2]s/ca.pem"
-TLSCertificateFile    "%[2]s/cert.pem"
-TLSCertificateKeyFile "%[2]s/key.pem"
-TLSProtocolMin 3.3
-`
-const configTemplateDatabase = `
-database   mdb
-maxsize    1073741824
-suffix     "%[3]s"
-rootdn     "cn=portunus,%[3]s"
-rootpw     "%[4]s"
-directory  "%[2]s/data"
-
-index objectClass eq
-`
-
 // We do not use the OLC machinery for the memberOf attribute because
 // portunus-server itself can do it much more easily. But that means we have to
 // define the memberOf attribute on the schema level.
@@ -72,45 +35,98 @@ index objectClass eq
 // standard attribute name `memberOf`, but `isMemberOf` instead. (Some OpenLDAPs
 // define the `memberOf` attribute even if you don't enable the memberof
 // overlay.)
-var customSchema = `
-	attributetype ( 9999.1.1 NAME 'isMemberOf'
-		DESC 'back-reference to groups this user is a member of'
-		SUP distinguishedName )
-
-	attributetype ( 9999.1.2 NAME 'sshPublicKey'
-		DESC 'SSH public key used by this user'
-		SUP name )
-
-	objectclass ( 9999.2.1 NAME 'portunusPerson'
-		DESC 'addon to objectClass person that adds Portunus-specific attributes'
-		SUP top AUXILIARY
-		MAY ( isMemberOf $ sshPublicKey ) )
+//
+// These definitions are rendered into either a schema file or an LDIF entry,
+// depending on PORTUNUS_SLAPD_CONFIG_STYLE.
+var (
+	customSchemaAttributeTypes = []string{
+		`( 9999.1.1 NAME 'isMemberOf' DESC 'back-reference to groups this user is a member of' SUP distinguishedName )`,
+		`( 9999.1.2 NAME 'sshPublicKey' DESC 'SSH public key used by this user' SUP name )`,
+		`( 9999.1.3 NAME 'portunusTimezone' DESC 'IANA time zone name preferred by this user' SUP name SINGLE-VALUE )`,
+	}
+	customSchemaObjectClasses = []string{
+		`( 9999.2.1 NAME 'portunusPerson' DESC 'addon to objectClass person that adds Portunus-specific attributes' SUP top AUXILIARY MAY ( isMemberOf $ sshPublicKey $ portunusTimezone ) )`,
+	}
+)
 
-`
+func renderCustomSchema() []byte {
+	var lines []string
+	for _, def := range customSchemaAttributeTypes {
+		lines = append(lines, "attributetype "+def)
+	}
+	for _, def := range customSchemaObjectClasses {
+		lines = append(lines, "objectclass "+def)
+	}
+	//The trailing empty line is important, otherwise slapd cannot correctly
+	//parse this file. ikr?
+	return []byte(strings.Join(lines, "\n\n") + "\n\n")
+}
 
-//^ The trailing empty line is important, otherwise slapd cannot correctly
-//parse this file. ikr?
+func renderCustomSchemaLDIF() string {
+	lines := []string{
+		"dn: cn=portunus,cn=schema,cn=config",
+		"objectClass: olcSchemaConfig",
+		"cn: portunus",
+	}
+	for _, def := range customSchemaAttributeTypes {
+		lines = append(lines, "olcAttributeTypes: "+def)
+	}
+	for _, def := range customSchemaObjectClasses {
+		lines = append(lines, "olcObjectClasses: "+def)
+	}
+	return strings.Join(lines, "\n")
+}
 
-func renderSlapdConfig(environment map[string]string, hasher crypt.PasswordHasher) []byte {
+// Generates the password for Portunus' own technical user, and builds the
+// slapd configuration that allows this user to bind.
+func prepareSlapdConfig(environment map[string]string, hasher crypt.PasswordHasher) slapdConfig {
 	password := generateServiceUserPassword()
 	logg.Debug("password for cn=portunus,%s is %s",
 		environment["PORTUNUS_LDAP_SUFFIX"], password)
 	environment["PORTUNUS_LDAP_PASSWORD"] = password
 	environment["PORTUNUS_LDAP_PASSWORD_HASH"] = hasher.HashPassword(password)
+	return buildSlapdConfig(environment, environment["PORTUNUS_LDAP_PASSWORD_HASH"])
+}
 
-	configTemplates := []string{strings.TrimSpace(configTemplateGeneral)}
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
-		configTemplates = append(configTemplates, strings.TrimSpace(configTemplateTLS))
+// Checks that slapd will be able to load the module that it needs to verify
+// password hashes generated with the given scheme. Without this check, slapd
+// would only fail when the first user tries to log in.
+func checkSlapdModule(environment map[string]string, scheme crypt.Scheme) error {
+	module := scheme.SlapdModule()
+	if module == "" {
+		return nil
+	}
+	moduleDir := environment["PORTUNUS_SLAPD_MODULE_DIR"]
+	for _, ext := range []string{".so", ".la"} {
+		_, err := os.Stat(filepath.Join(moduleDir, module+ext))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
-	configTemplates = append(configTemplates, strings.TrimSpace(configTemplateDatabase))
+	return fmt.Errorf("PORTUNUS_PASSWORD_HASH_SCHEME=%s is not supported by this slapd: cannot find module %q in PORTUNUS_SLAPD_MODULE_DIR=%s",
+		scheme, module, moduleDir)
+}
 
-	return []byte(fmt.Sprintf(
-		strings.Join(configTemplates, "\n\n")+"\n",
-		environment["PORTUNUS_SLAPD_SCHEMA_DIR"],
-		environment["PORTUNUS_SLAPD_STATE_DIR"],
-		environment["PORTUNUS_LDAP_SUFFIX"],
-		environment["PORTUNUS_LDAP_PASSWORD_HASH"],
-	))
+// Loads the LDIF rendered by slapdConfig.Render() into the cn=config directory
+// at `configDirPath`. This is what slapadd(8) does, but we invoke it through
+// the slapd binary (which behaves like slapadd when given `-T add`) to avoid
+// having to locate yet another binary.
+func loadSlapdConfigLDIF(environment map[string]string, ldifPath, configDirPath string) error {
+	cmd := exec.Command(environment["PORTUNUS_SLAPD_BINARY"],
+		"-T", "add",
+		"-n", "0",
+		"-F", configDirPath,
+		"-l", ldifPath,
+	)
+	cmd.Stdin = nil
+	err := runWithSlapdOutput(cmd, environment)
+	if err != nil {
+		return fmt.Errorf("cannot load %s into %s: %w", ldifPath, configDirPath, err)
+	}
+	return nil
 }
 
 func generateServiceUserPassword() string {
@@ -122,8 +138,140 @@ func generateServiceUserPassword() string {
 	return hex.EncodeToString(buf[:])
 }
 
-// Does not return. Call with `go`.
-func runLDAPServer(environment map[string]string) {
+// How long to wait before restarting slapd after it exited unexpectedly. The
+// delay doubles with each consecutive failure, up to the maximum.
+const (
+	slapdRestartInitialDelay = time.Second
+	slapdRestartMaxDelay     = time.Minute
+)
+
+// When slapd has been running for this long before exiting, the exit is not
+// counted as a consecutive failure of the previous ones.
+const slapdStableRunDuration = 10 * time.Minute
+
+// slapdStatus is reported to slapdServer.onRestart, and written into
+// slapd-status.json for monitoring.
+type slapdStatus struct {
+	//how often slapd was restarted after exiting unexpectedly (restarts that we
+	//asked for, e.g. to reload the TLS certificate, are not counted)
+	RestartCount   int       `json:"restart_count"`
+	LastExitStatus string    `json:"last_exit_status,omitempty"`
+	LastExitAt     time.Time `json:"last_exit_at,omitempty"`
+}
+
+// slapdServer supervises the slapd process. When slapd exits unexpectedly, it
+// is restarted with exponential backoff. It can also be restarted on purpose
+// while running, e.g. to pick up a renewed TLS certificate.
+type slapdServer struct {
+	environment map[string]string
+	//how many consecutive unexpected exits are tolerated before giving up
+	maxRestarts int
+	//these can be shortened in tests
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	//if not nil, called whenever slapd was started again after a restart
+	onRestart func(slapdStatus)
+	stopChan  chan struct{}
+	//The mutex guards access to all fields listed below it.
+	mutex      sync.Mutex
+	cmd        *exec.Cmd //nil while slapd is not running
+	restarting bool
+	stopping   bool
+	status     slapdStatus
+}
+
+func newSlapdServer(environment map[string]string) *slapdServer {
+	return &slapdServer{
+		environment:  environment,
+		maxRestarts:  must.Return(strconv.Atoi(environment["PORTUNUS_SLAPD_MAX_RESTARTS"])),
+		initialDelay: slapdRestartInitialDelay,
+		maxDelay:     slapdRestartMaxDelay,
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// Run starts slapd and restarts it whenever it exits, until Stop() is called.
+// Returns an error if slapd exits unexpectedly too often in a row. Call with `go`.
+func (s *slapdServer) Run() error {
+	args := s.buildArgs()
+	consecutiveFailures := 0
+	delay := s.initialDelay
+	isRestart := false
+
+	for {
+		logg.Info("starting LDAP server")
+		cmd := exec.Command(s.environment["PORTUNUS_SLAPD_BINARY"], args...)
+		cmd.Stdin = nil
+		startedAt := time.Now()
+
+		s.mutex.Lock()
+		if s.stopping {
+			s.mutex.Unlock()
+			return nil
+		}
+		wait, err := startWithSlapdOutput(cmd, s.environment)
+		if err == nil {
+			s.cmd = cmd
+		}
+		status := s.status
+		s.mutex.Unlock()
+		if err == nil {
+			if isRestart && s.onRestart != nil {
+				go s.onRestart(status)
+			}
+			err = wait()
+		}
+
+		s.mutex.Lock()
+		s.cmd = nil
+		restarting := s.restarting
+		stopping := s.stopping
+		s.restarting = false
+		s.mutex.Unlock()
+		isRestart = true
+
+		//when we asked slapd to shut down, the exit status does not matter
+		if stopping {
+			logg.Info("LDAP server has shut down")
+			return nil
+		}
+		if restarting {
+			continue
+		}
+
+		exitStatus := "exit status 0" //slapd is not supposed to exit by itself, even when successful
+		if err != nil {
+			exitStatus = err.Error()
+		}
+		if time.Since(startedAt) >= slapdStableRunDuration {
+			consecutiveFailures = 0
+			delay = s.initialDelay
+		}
+		consecutiveFailures++
+		if consecutiveFailures > s.maxRestarts {
+			logg.Info("Since slapd logs to syslog only, check there for more information.")
+			return fmt.Errorf("slapd exited unexpectedly (%s) %d times in a row, giving up", exitStatus, consecutiveFailures)
+		}
+
+		s.mutex.Lock()
+		s.status.RestartCount++
+		s.status.LastExitStatus = exitStatus
+		s.status.LastExitAt = time.Now()
+		restartCount := s.status.RestartCount
+		s.mutex.Unlock()
+		logg.Error("slapd exited unexpectedly (%s), restarting in %s (restart #%d, attempt %d of %d)",
+			exitStatus, delay, restartCount, consecutiveFailures, s.maxRestarts)
+
+		select {
+		case <-s.stopChan:
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, s.maxDelay)
+	}
+}
+
+func (s *slapdServer) buildArgs() []string {
 	debugLogFlags := uint64(0)
 	if logg.ShowDebug {
 		//with PORTUNUS_DEBUG=true, turn on all debug logging except for package
@@ -133,28 +281,107 @@ func runLDAPServer(environment map[string]string) {
 	}
 
 	bindURL := "ldap:///"
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
+	if s.environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
 		bindURL = "ldaps:///"
 	}
 
-	logg.Info("starting LDAP server")
-	//run slapd
-	cmd := exec.Command(environment["PORTUNUS_SLAPD_BINARY"],
-		"-u", environment["PORTUNUS_SLAPD_USER"],
-		"-g", environment["PORTUNUS_SLAPD_GROUP"],
+	configArgs := []string{"-f", filepath.Join(s.environment["PORTUNUS_SLAPD_STATE_DIR"], "slapd.conf")}
+	if s.environment["PORTUNUS_SLAPD_CONFIG_STYLE"] == "olc" {
+		configArgs = []string{"-F", filepath.Join(s.environment["PORTUNUS_SLAPD_STATE_DIR"], "slapd.d")}
+	}
+
+	args := []string{
+		"-u", s.environment["PORTUNUS_SLAPD_USER"],
+		"-g", s.environment["PORTUNUS_SLAPD_GROUP"],
 		"-h", bindURL,
-		"-f", filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], "slapd.conf"),
+	}
+	args = append(args, configArgs...)
+	return append(args,
 		//even for debugLogFlags == 0, giving `-d` is still important because its
 		//presence keeps slapd from daemonizing)
 		"-d", strconv.FormatUint(debugLogFlags, 10),
 	)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+}
+
+// Restart asks slapd to shut down, and then starts it again with the same
+// configuration. The LDAP database is not touched, so this does not cause the
+// directory contents to be rebuilt.
+func (s *slapdServer) Restart() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cmd == nil || s.stopping {
+		//slapd is just starting up and will read the current config anyway
+		return
+	}
+	logg.Info("restarting LDAP server")
+	err := s.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		logg.Error("cannot send SIGTERM to slapd: " + err.Error())
+		return
+	}
+	s.restarting = true
+}
+
+// Stop asks slapd to shut down, and keeps it from being restarted. Run()
+// returns once slapd has exited.
+func (s *slapdServer) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopping {
+		return
+	}
+	s.stopping = true
+	close(s.stopChan)
+	if s.cmd == nil {
+		return
+	}
+	logg.Info("stopping LDAP server")
+	err := s.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		logg.Error("cannot send SIGTERM to slapd: " + err.Error())
+	}
+}
+
+// Runs a slapd command. With PORTUNUS_LOG_FORMAT=json, its output is captured
+// line by line and wrapped into our own log format. Otherwise, it is passed
+// through unchanged.
+func runWithSlapdOutput(cmd *exec.Cmd, environment map[string]string) error {
+	wait, err := startWithSlapdOutput(cmd, environment)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// Like runWithSlapdOutput, but returns after starting the command. The
+// returned function waits for the command to exit.
+func startWithSlapdOutput(cmd *exec.Cmd, environment map[string]string) (wait func() error, err error) {
+	if environment["PORTUNUS_LOG_FORMAT"] != "json" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Wait, cmd.Start()
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		logging.ForwardLines(pipeReader, logging.Fields{"source": "slapd"})
+		close(done)
+	}()
+
+	cmd.Stdout = pipeWriter
+	cmd.Stderr = pipeWriter
+	wait = func() error {
+		err := cmd.Wait()
+		pipeWriter.Close()
+		<-done //make sure that all output is logged before our caller reports the error
+		return err
+	}
+	err = cmd.Start()
 	if err != nil {
-		logg.Error("error encountered while running slapd: " + err.Error())
-		logg.Info("Since slapd logs to syslog only, check there for more information.")
-		os.Exit(1)
+		pipeWriter.Close()
+		<-done
+		return nil, err
 	}
+	return wait, nil
 }
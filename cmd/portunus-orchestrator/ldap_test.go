@@ -0,0 +1,102 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+// Builds a slapdServer that runs the given shell script instead of slapd.
+func newSlapdServerForTests(t *testing.T, script string) *slapdServer {
+	path := filepath.Join(t.TempDir(), "fake-slapd")
+	must.Succeed(os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700))
+	s := newSlapdServer(map[string]string{
+		"PORTUNUS_SLAPD_BINARY":       path,
+		"PORTUNUS_SLAPD_MAX_RESTARTS": "2",
+	})
+	s.initialDelay = time.Millisecond
+	s.maxDelay = 2 * time.Millisecond
+	return s
+}
+
+func TestSlapdSupervisorGivesUp(t *testing.T) {
+	s := newSlapdServerForTests(t, "exit 3")
+	var mutex sync.Mutex
+	var statuses []slapdStatus
+	done := make(chan struct{})
+	s.onRestart = func(status slapdStatus) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		statuses = append(statuses, status)
+		if len(statuses) == 2 {
+			close(done)
+		}
+	}
+
+	err := s.Run()
+	if err == nil {
+		t.Fatal("expected Run() to give up, but it returned without error")
+	}
+	assert.DeepEqual(t, "error message", err.Error(), "slapd exited unexpectedly (exit status 3) 3 times in a row, giving up")
+
+	//onRestart runs asynchronously
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for onRestart")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for idx, status := range statuses {
+		assert.DeepEqual(t, "restart count", status.RestartCount, idx+1)
+		assert.DeepEqual(t, "last exit status", status.LastExitStatus, "exit status 3")
+	}
+}
+
+func TestSlapdSupervisorStop(t *testing.T) {
+	s := newSlapdServerForTests(t, "exec sleep 60")
+	s.onRestart = func(status slapdStatus) {
+		t.Errorf("unexpected restart: %#v", status)
+	}
+	runResult := make(chan error, 1)
+	go func() {
+		runResult <- s.Run()
+	}()
+
+	//wait for the fake slapd to start
+	for attempt := 0; ; attempt++ {
+		s.mutex.Lock()
+		isRunning := s.cmd != nil
+		s.mutex.Unlock()
+		if isRunning {
+			break
+		}
+		if attempt > 500 {
+			t.Fatal("timeout while waiting for fake slapd to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//a clean shutdown terminates slapd, and does not restart it
+	s.Stop()
+	select {
+	case err := <-runResult:
+		if err != nil {
+			t.Errorf("expected Run() to return without error, but got: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for Run() to return")
+	}
+	assert.DeepEqual(t, "restart count", s.status.RestartCount, 0)
+}
@@ -7,20 +7,53 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/logging"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 )
 
 func main() {
 	environment, ids := readConfig()
+	logging.Setup(environment["PORTUNUS_LOG_FORMAT"])
 	logg.ShowDebug = environment["PORTUNUS_DEBUG"] == "true"
-	hasher := must.Return(crypt.NewPasswordHasher())
+
+	//with --check-seed, portunus-server only inspects the database and the seed,
+	//so neither slapd nor the state directories need to be set up
+	if len(os.Args) == 2 && os.Args[1] == "--check-seed" {
+		cmd := exec.Command(environment["PORTUNUS_SERVER_BINARY"], "--check-seed")
+		cmd.Stdin = nil
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = buildServerEnvironment(environment, ids)
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		if err != nil {
+			logg.Fatal("error encountered while running portunus-server: " + err.Error())
+		}
+		return
+	}
+
+	scheme := must.Return(crypt.ParseScheme(environment["PORTUNUS_PASSWORD_HASH_SCHEME"]))
+	must.Succeed(checkSlapdModule(environment, scheme))
+	hasher := must.Return(crypt.NewPasswordHasher(scheme))
 
 	//delete leftovers from previous runs
 	slapdStatePath := environment["PORTUNUS_SLAPD_STATE_DIR"]
@@ -34,24 +67,36 @@ func main() {
 	must.Succeed(os.Mkdir(slapdDataPath, 0770))
 	must.Succeed(os.Chown(slapdDataPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
 
-	customSchemaPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], "portunus.schema")
-	must.Succeed(os.WriteFile(customSchemaPath, []byte(customSchema), 0444))
+	slapdConfig := prepareSlapdConfig(environment, hasher)
+	if environment["PORTUNUS_SLAPD_CONFIG_STYLE"] == "olc" {
+		//render the config as LDIF and load it into a cn=config directory
+		slapdConfigLDIFPath := filepath.Join(slapdStatePath, "slapd.ldif")
+		must.Succeed(os.WriteFile(slapdConfigLDIFPath, slapdConfig.Render(), 0400))
+		slapdConfigDirPath := filepath.Join(slapdStatePath, "slapd.d")
+		must.Succeed(os.Mkdir(slapdConfigDirPath, 0700))
+		must.Succeed(loadSlapdConfigLDIF(environment, slapdConfigLDIFPath, slapdConfigDirPath))
+		must.Succeed(os.Remove(slapdConfigLDIFPath)) //contains the password hash, so do not leave it lying around
 
-	slapdConfigPath := filepath.Join(slapdStatePath, "slapd.conf")
-	must.Succeed(os.WriteFile(slapdConfigPath, renderSlapdConfig(environment, hasher), 0444))
+		//slapadd ran as root, but slapd needs to be able to write into its config
+		must.Succeed(filepath.WalkDir(slapdConfigDirPath, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chown(path, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"])
+		}))
+		must.Succeed(slapdConfig.RecordFiles(slapdConfigDirPath))
+	} else {
+		customSchemaPath := slapdConfig.CustomSchema.Path
+		must.Succeed(os.WriteFile(customSchemaPath, renderCustomSchema(), 0444))
 
-	//copy TLS cert and private key into a location where slapd can definitely read it
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
-		copyTLSFile := func(destName, srcPath string) {
-			destPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], destName)
-			buf := must.Return(os.ReadFile(srcPath))
-			must.Succeed(os.WriteFile(destPath, buf, 0400))
-			must.Succeed(os.Chown(destPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
-		}
+		slapdConfigPath := filepath.Join(slapdStatePath, "slapd.conf")
+		must.Succeed(os.WriteFile(slapdConfigPath, slapdConfig.Render(), 0444))
+		must.Succeed(slapdConfig.RecordFiles(slapdConfigPath, customSchemaPath))
+	}
 
-		copyTLSFile("cert.pem", environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"])
-		copyTLSFile("key.pem", environment["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"])
-		copyTLSFile("ca.pem", environment["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"])
+	hasTLS := environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != ""
+	if hasTLS {
+		must.Return(copyTLSFiles(environment, ids))
 	}
 
 	//setup our state directory with the correct permissions
@@ -59,28 +104,191 @@ func main() {
 	must.Succeed(os.MkdirAll(statePath, 0770))
 	must.Succeed(os.Chown(statePath, ids["PORTUNUS_SERVER_UID"], ids["PORTUNUS_SERVER_GID"]))
 
-	go runLDAPServer(environment)
+	//describe the slapd config for admins (portunus-server cannot read it
+	//directly since it belongs to slapd's user)
+	slapdConfigJSONPath := filepath.Join(statePath, "slapd-config.json")
+	must.Succeed(os.WriteFile(slapdConfigJSONPath, slapdConfig.RenderJSON(), 0400))
+	must.Succeed(os.Chown(slapdConfigJSONPath, ids["PORTUNUS_SERVER_UID"], ids["PORTUNUS_SERVER_GID"]))
+
+	//after slapd was restarted, portunus-server shall restore its contents right
+	//away, and the restart count is recorded for monitoring
+	slapd := newSlapdServer(environment)
+	slapdStatusPath := filepath.Join(statePath, "slapd-status.json")
+	controlSocketPath := filepath.Join(statePath, "control.sock")
+	slapd.onRestart = func(status slapdStatus) {
+		err := writeSlapdStatus(slapdStatusPath, status, ids)
+		if err != nil {
+			logg.Error("cannot write %s: %s", slapdStatusPath, err.Error())
+		}
+		err = requestLDAPResync(controlSocketPath)
+		if err != nil {
+			logg.Error("cannot ask portunus-server to resync the LDAP database: %s", err.Error())
+		}
+	}
+	must.Succeed(writeSlapdStatus(slapdStatusPath, slapdStatus{}, ids))
 
-	//run portunus-server (thus blocking this goroutine)
+	slapdDone := make(chan error, 1)
+	go func() {
+		slapdDone <- slapd.Run()
+	}()
+	if hasTLS {
+		go watchTLSFiles(environment, ids, slapd)
+	}
+
+	//on SIGINT or SIGTERM, shut down portunus-server and slapd, but do not restart slapd
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	//run portunus-server
 	cmd := exec.Command(environment["PORTUNUS_SERVER_BINARY"])
 	cmd.Stdin = nil
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(),
+	cmd.Env = buildServerEnvironment(environment, ids)
+	err := cmd.Start()
+	if err != nil {
+		slapd.Stop()
+		<-slapdDone
+		logg.Fatal("cannot start portunus-server: " + err.Error())
+	}
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- cmd.Wait()
+	}()
+
+	select {
+	case sig := <-signals:
+		logg.Info("received %s, shutting down", sig)
+		stopServer(cmd, serverDone)
+		slapd.Stop()
+		<-slapdDone
+	case err := <-slapdDone:
+		//slapd exited unexpectedly too often
+		stopServer(cmd, serverDone)
+		logg.Fatal(err.Error())
+	case err := <-serverDone:
+		slapd.Stop()
+		<-slapdDone
+		if err != nil {
+			logg.Fatal("error encountered while running portunus-server: " + err.Error())
+		}
+	}
+}
+
+// Asks portunus-server to shut down, and waits until it has exited.
+func stopServer(cmd *exec.Cmd, serverDone <-chan error) {
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		logg.Error("cannot send SIGTERM to portunus-server: " + err.Error())
+	}
+	<-serverDone
+}
+
+// Writes slapd-status.json into the state directory of portunus-server. Like
+// slapd-config.json, this file is intended for admins and monitoring.
+func writeSlapdStatus(path string, status slapdStatus, ids map[string]int) error {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, append(buf, '\n'), 0444)
+	if err != nil {
+		return err
+	}
+	err = os.Chown(tmpPath, ids["PORTUNUS_SERVER_UID"], ids["PORTUNUS_SERVER_GID"])
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Asks portunus-server through its control API to bring the LDAP database back
+// in sync after slapd was restarted.
+func requestLDAPResync(socketPath string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	//the host name is irrelevant since we always dial the Unix socket
+	resp, err := client.Post("http://portunus/v1/ldap/resync", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("expected 202 Accepted, but got %s", resp.Status)
+	}
+	return nil
+}
+
+func buildServerEnvironment(environment map[string]string, ids map[string]int) []string {
+	return append(os.Environ(),
 		fmt.Sprintf("PORTUNUS_SERVER_UID=%d", ids["PORTUNUS_SERVER_UID"]),
 		fmt.Sprintf("PORTUNUS_SERVER_GID=%d", ids["PORTUNUS_SERVER_GID"]),
 		"PORTUNUS_DEBUG="+environment["PORTUNUS_DEBUG"],
 		"PORTUNUS_GROUP_NAME_REGEX="+environment["PORTUNUS_GROUP_NAME_REGEX"],
+		"PORTUNUS_GROUP_REQUIRE_OWNERS="+environment["PORTUNUS_GROUP_REQUIRE_OWNERS"],
+		"PORTUNUS_LDAP_GROUPS_OU="+environment["PORTUNUS_LDAP_GROUPS_OU"],
+		"PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS="+environment["PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS"],
+		"PORTUNUS_LDAP_SHADOW_MODE="+environment["PORTUNUS_LDAP_SHADOW_MODE"],
 		"PORTUNUS_LDAP_SUFFIX="+environment["PORTUNUS_LDAP_SUFFIX"],
+		"PORTUNUS_LDAP_USERS_OU="+environment["PORTUNUS_LDAP_USERS_OU"],
+		"PORTUNUS_LDAP_USER_LAYOUT="+environment["PORTUNUS_LDAP_USER_LAYOUT"],
 		"PORTUNUS_LDAP_PASSWORD="+environment["PORTUNUS_LDAP_PASSWORD"],
+		"PORTUNUS_LOG_FORMAT="+environment["PORTUNUS_LOG_FORMAT"],
+		"PORTUNUS_PASSWORD_HASH_SCHEME="+environment["PORTUNUS_PASSWORD_HASH_SCHEME"],
+		"PORTUNUS_POSIX_HOME_TEMPLATE="+environment["PORTUNUS_POSIX_HOME_TEMPLATE"],
+		"PORTUNUS_SERVER_ACCESS_LOG="+environment["PORTUNUS_SERVER_ACCESS_LOG"],
+		"PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC="+environment["PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC"],
+		"PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER="+environment["PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER"],
+		"PORTUNUS_SERVER_ACTIVITY_LOG_SIZE="+environment["PORTUNUS_SERVER_ACTIVITY_LOG_SIZE"],
+		"PORTUNUS_SERVER_DELETED_USER_RETENTION="+environment["PORTUNUS_SERVER_DELETED_USER_RETENTION"],
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW="+environment["PORTUNUS_SERVER_DESTRUCTIVE_WINDOW"],
+		"PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION="+environment["PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION"],
+		"PORTUNUS_SERVER_DEVICE_CONFIRMATION="+environment["PORTUNUS_SERVER_DEVICE_CONFIRMATION"],
+		"PORTUNUS_SERVER_DEVICE_RETENTION="+environment["PORTUNUS_SERVER_DEVICE_RETENTION"],
+		"PORTUNUS_SERVER_FEED_DRY_RUN="+environment["PORTUNUS_SERVER_FEED_DRY_RUN"],
+		"PORTUNUS_SERVER_FEED_INTERVAL="+environment["PORTUNUS_SERVER_FEED_INTERVAL"],
+		"PORTUNUS_SERVER_FEED_MAPPING="+environment["PORTUNUS_SERVER_FEED_MAPPING"],
+		"PORTUNUS_SERVER_FEED_MAX_SIZE="+environment["PORTUNUS_SERVER_FEED_MAX_SIZE"],
+		"PORTUNUS_SERVER_FEED_TIMEOUT="+environment["PORTUNUS_SERVER_FEED_TIMEOUT"],
+		"PORTUNUS_SERVER_FEED_URL="+environment["PORTUNUS_SERVER_FEED_URL"],
 		"PORTUNUS_SERVER_HTTP_LISTEN="+environment["PORTUNUS_SERVER_HTTP_LISTEN"],
 		"PORTUNUS_SERVER_HTTP_SECURE="+environment["PORTUNUS_SERVER_HTTP_SECURE"],
+		"PORTUNUS_SERVER_INVITATION_LIFETIME="+environment["PORTUNUS_SERVER_INVITATION_LIFETIME"],
+		"PORTUNUS_SERVER_LOCALE="+environment["PORTUNUS_SERVER_LOCALE"],
+		"PORTUNUS_SERVER_NOTIFICATION_EVENTS="+environment["PORTUNUS_SERVER_NOTIFICATION_EVENTS"],
+		"PORTUNUS_SERVER_OIDC_CLIENTS="+environment["PORTUNUS_SERVER_OIDC_CLIENTS"],
+		"PORTUNUS_SERVER_OIDC_ISSUER="+environment["PORTUNUS_SERVER_OIDC_ISSUER"],
+		"PORTUNUS_SERVER_PHOTO_MAX_SIZE="+environment["PORTUNUS_SERVER_PHOTO_MAX_SIZE"],
+		"PORTUNUS_SERVER_PROXY_AUTH_HEADER="+environment["PORTUNUS_SERVER_PROXY_AUTH_HEADER"],
+		"PORTUNUS_SERVER_PROXY_AUTH_SECRET="+environment["PORTUNUS_SERVER_PROXY_AUTH_SECRET"],
+		"PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK="+environment["PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK"],
+		"PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS="+environment["PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS"],
+		"PORTUNUS_SERVER_READ_ONLY="+environment["PORTUNUS_SERVER_READ_ONLY"],
+		"PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD="+environment["PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD"],
+		"PORTUNUS_SERVER_SEED_FIGHT_WINDOW="+environment["PORTUNUS_SERVER_SEED_FIGHT_WINDOW"],
+		"PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT="+environment["PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT"],
+		"PORTUNUS_SERVER_SESSION_LIFETIME="+environment["PORTUNUS_SERVER_SESSION_LIFETIME"],
+		"PORTUNUS_SERVER_SMTP_FROM="+environment["PORTUNUS_SERVER_SMTP_FROM"],
+		"PORTUNUS_SERVER_SMTP_HOST="+environment["PORTUNUS_SERVER_SMTP_HOST"],
+		"PORTUNUS_SERVER_SMTP_PORT="+environment["PORTUNUS_SERVER_SMTP_PORT"],
 		"PORTUNUS_SERVER_STATE_DIR="+environment["PORTUNUS_SERVER_STATE_DIR"],
+		"PORTUNUS_SERVER_STORE="+environment["PORTUNUS_SERVER_STORE"],
+		"PORTUNUS_SERVER_TRUSTED_PROXIES="+environment["PORTUNUS_SERVER_TRUSTED_PROXIES"],
+		"PORTUNUS_SERVER_UNDO_WINDOW="+environment["PORTUNUS_SERVER_UNDO_WINDOW"],
+		"PORTUNUS_SHARED_NAMESPACE="+environment["PORTUNUS_SHARED_NAMESPACE"],
 		"PORTUNUS_SLAPD_TLS_DOMAIN_NAME="+environment["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"],
+		"PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME="+environment["PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME"],
+		"PORTUNUS_USER_DEFAULT_GROUP="+environment["PORTUNUS_USER_DEFAULT_GROUP"],
 		"PORTUNUS_USER_NAME_REGEX="+environment["PORTUNUS_USER_NAME_REGEX"],
+		"PORTUNUS_USER_REQUIRE_GROUP="+environment["PORTUNUS_USER_REQUIRE_GROUP"],
+		"PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX="+environment["PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX"],
 	)
-	err := cmd.Run()
-	if err != nil {
-		logg.Fatal("error encountered while running portunus-server: " + err.Error())
-	}
 }
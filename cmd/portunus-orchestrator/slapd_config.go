@@ -0,0 +1,379 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/sapcc/go-bits/must"
+)
+
+// slapdConfig is a structured representation of the configuration for slapd.
+// The actual configuration (either slapd.conf or LDIF for cn=config) is
+// rendered from it, and so is the JSON description that portunus-server shows
+// to admins, so that both cannot drift apart.
+type slapdConfig struct {
+	Style        string            `json:"style"`
+	Modules      *slapdModules     `json:"modules,omitempty"`
+	SchemaFiles  []string          `json:"schema_files"`
+	CustomSchema slapdCustomSchema `json:"custom_schema"`
+	AccessRules  []slapdAccessRule `json:"access_rules"`
+	Database     slapdDatabase     `json:"database"`
+	TLS          *slapdTLSConfig   `json:"tls,omitempty"`
+	//filled by RecordFiles() after the rendered configuration was written
+	Files []slapdConfigFile `json:"files"`
+}
+
+type slapdModules struct {
+	Path string   `json:"path"`
+	Load []string `json:"load"`
+}
+
+type slapdCustomSchema struct {
+	//only set for PORTUNUS_SLAPD_CONFIG_STYLE=slapd.conf; with olc, the custom
+	//schema is part of the LDIF
+	Path           string   `json:"path,omitempty"`
+	AttributeTypes []string `json:"attribute_types"`
+	ObjectClasses  []string `json:"object_classes"`
+}
+
+type slapdAccessRule struct {
+	To string   `json:"to"`
+	By []string `json:"by"`
+}
+
+type slapdDatabase struct {
+	Type             string   `json:"type"`
+	MaxSize          uint64   `json:"max_size"`
+	Suffix           string   `json:"suffix"`
+	RootDN           string   `json:"root_dn"`
+	RootPasswordHash string   `json:"-"` //never shown, not even to admins
+	Directory        string   `json:"directory"`
+	Limits           []string `json:"limits"`
+	Indexes          []string `json:"indexes"`
+}
+
+type slapdTLSConfig struct {
+	CACertificateFile  string `json:"ca_certificate_file"`
+	CertificateFile    string `json:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file"`
+	ProtocolMin        string `json:"protocol_min"`
+	CipherSuite        string `json:"cipher_suite"`
+}
+
+type slapdConfigFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Builds the slapd configuration for the given environment.
+//
+// Notes on this configuration:
+//   - Only Portunus' own technical user has any sort of write access.
+//   - The cn=portunus-viewers virtual group corresponds to Portunus' `LDAP.CanRead` permission.
+//   - Users can read their own object, so that applications not using a service
+//     user can discover group memberships of a logged-in user.
+//   - Portunus' own technical user and cn=portunus-viewers are exempt from
+//     slapd's default size limit of 500 entries (or get the limit from
+//     PORTUNUS_SLAPD_SIZE_LIMIT), so that they can enumerate large directories.
+//     The technical user is the rootdn and thus not subject to limits anyway,
+//     but listing it explicitly makes the JSON description less surprising.
+//   - TLSProtocolMin 3.3 means "TLS 1.2 or higher". For the default TLSCipherSuite, see defaultCipherSuites.
+//
+// TODO when TLS is configured, also listen on ldap:///, but require StartTLS through `security minssf=256`.
+func buildSlapdConfig(environment map[string]string, rootPasswordHash string) slapdConfig {
+	schemaDir := environment["PORTUNUS_SLAPD_SCHEMA_DIR"]
+	stateDir := environment["PORTUNUS_SLAPD_STATE_DIR"]
+	suffix := environment["PORTUNUS_LDAP_SUFFIX"]
+	sizeLimit := environment["PORTUNUS_SLAPD_SIZE_LIMIT"]
+
+	cfg := slapdConfig{
+		Style: environment["PORTUNUS_SLAPD_CONFIG_STYLE"],
+		CustomSchema: slapdCustomSchema{
+			AttributeTypes: customSchemaAttributeTypes,
+			ObjectClasses:  customSchemaObjectClasses,
+		},
+		AccessRules: []slapdAccessRule{
+			{To: `dn.base=""`, By: []string{"* read"}},
+			{To: `dn.base="cn=Subschema"`, By: []string{"* read"}},
+			{To: "*", By: []string{
+				fmt.Sprintf(`dn.base="cn=portunus,%s" write`, suffix),
+				fmt.Sprintf(`group.exact="cn=portunus-viewers,%s" read`, suffix),
+				"self read",
+				"anonymous auth",
+			}},
+		},
+		Database: slapdDatabase{
+			Type:             "mdb",
+			MaxSize:          1073741824,
+			Suffix:           suffix,
+			RootDN:           "cn=portunus," + suffix,
+			RootPasswordHash: rootPasswordHash,
+			Directory:        filepath.Join(stateDir, "data"),
+			Indexes:          []string{"objectClass eq"},
+			Limits: []string{
+				fmt.Sprintf(`dn.exact="cn=portunus,%s" size=%s`, suffix, sizeLimit),
+				fmt.Sprintf(`group="cn=portunus-viewers,%s" size=%s`, suffix, sizeLimit),
+			},
+		},
+		Files: []slapdConfigFile{},
+	}
+
+	schemaFileExt := ".schema"
+	if cfg.Style == "olc" {
+		schemaFileExt = ".ldif"
+	} else {
+		cfg.CustomSchema.Path = filepath.Join(stateDir, "portunus.schema")
+	}
+	for _, name := range []string{"core", "cosine", "inetorgperson", "nis"} {
+		cfg.SchemaFiles = append(cfg.SchemaFiles, filepath.Join(schemaDir, name+schemaFileExt))
+	}
+
+	scheme := must.Return(crypt.ParseScheme(environment["PORTUNUS_PASSWORD_HASH_SCHEME"]))
+	if module := scheme.SlapdModule(); module != "" {
+		cfg.Modules = &slapdModules{
+			Path: environment["PORTUNUS_SLAPD_MODULE_DIR"],
+			Load: []string{module},
+		}
+	}
+
+	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
+		cfg.TLS = &slapdTLSConfig{
+			CACertificateFile:  filepath.Join(stateDir, "ca.pem"),
+			CertificateFile:    filepath.Join(stateDir, "cert.pem"),
+			CertificateKeyFile: filepath.Join(stateDir, "key.pem"),
+			ProtocolMin:        "3.3",
+			CipherSuite:        environment["PORTUNUS_SLAPD_TLS_CIPHER_SUITES"],
+		}
+	}
+
+	return cfg
+}
+
+// Render renders the configuration in the format selected by
+// PORTUNUS_SLAPD_CONFIG_STYLE.
+func (c slapdConfig) Render() []byte {
+	if c.Style == "olc" {
+		return c.renderLDIF()
+	}
+	return c.renderSlapdConf()
+}
+
+// Renders the configuration as slapd.conf.
+func (c slapdConfig) renderSlapdConf() []byte {
+	var includes []string
+	for _, path := range c.SchemaFiles {
+		includes = append(includes, "include "+path)
+	}
+
+	var access []string
+	for _, rule := range c.AccessRules {
+		if len(rule.By) == 1 {
+			access = append(access, fmt.Sprintf("access to %s by %s", rule.To, rule.By[0]))
+			continue
+		}
+		//rules with multiple clauses are spread over multiple lines, and set
+		//apart from the other rules for readability
+		if len(access) > 0 {
+			access = append(access, "")
+		}
+		access = append(access, "access to "+rule.To)
+		for _, by := range rule.By {
+			access = append(access, "\tby "+by)
+		}
+	}
+
+	var sections []string
+	if c.Modules != nil {
+		modules := []string{fmt.Sprintf(`modulepath "%s"`, c.Modules.Path)}
+		for _, module := range c.Modules.Load {
+			modules = append(modules, "moduleload "+module)
+		}
+		sections = append(sections, strings.Join(modules, "\n"))
+	}
+	sections = append(sections,
+		strings.Join(includes, "\n"),
+		"include "+c.CustomSchema.Path,
+		strings.Join(access, "\n"),
+	)
+
+	//in slapd.conf, the TLS settings must come before the first `database` directive
+	if c.TLS != nil {
+		sections = append(sections, strings.Join([]string{
+			fmt.Sprintf(`TLSCACertificateFile  "%s"`, c.TLS.CACertificateFile),
+			fmt.Sprintf(`TLSCertificateFile    "%s"`, c.TLS.CertificateFile),
+			fmt.Sprintf(`TLSCertificateKeyFile "%s"`, c.TLS.CertificateKeyFile),
+			"TLSProtocolMin " + c.TLS.ProtocolMin,
+			"TLSCipherSuite " + c.TLS.CipherSuite,
+		}, "\n"))
+	}
+
+	db := c.Database
+	sections = append(sections, strings.Join([]string{
+		"database   " + db.Type,
+		fmt.Sprintf("maxsize    %d", db.MaxSize),
+		fmt.Sprintf(`suffix     "%s"`, db.Suffix),
+		fmt.Sprintf(`rootdn     "%s"`, db.RootDN),
+		fmt.Sprintf(`rootpw     "%s"`, db.RootPasswordHash),
+		fmt.Sprintf(`directory  "%s"`, db.Directory),
+	}, "\n"))
+
+	var limits []string
+	for _, limit := range db.Limits {
+		limits = append(limits, "limits "+limit)
+	}
+	sections = append(sections, strings.Join(limits, "\n"))
+
+	var indexes []string
+	for _, index := range db.Indexes {
+		indexes = append(indexes, "index "+index)
+	}
+	sections = append(sections, strings.Join(indexes, "\n"))
+
+	return []byte(strings.Join(sections, "\n\n") + "\n")
+}
+
+// Renders the configuration as LDIF for loading into cn=config.
+//
+// Notes on this format:
+//   - The access rules are attached to the frontend database because, in
+//     slapd.conf, access rules before the first `database` directive apply
+//     to all databases.
+//   - In LDIF, the TLS attributes must be part of the cn=config entry.
+func (c slapdConfig) renderLDIF() []byte {
+	general := []string{
+		"dn: cn=config",
+		"objectClass: olcGlobal",
+		"cn: config",
+	}
+	if c.TLS != nil {
+		general = append(general,
+			"olcTLSCACertificateFile: "+c.TLS.CACertificateFile,
+			"olcTLSCertificateFile: "+c.TLS.CertificateFile,
+			"olcTLSCertificateKeyFile: "+c.TLS.CertificateKeyFile,
+			"olcTLSProtocolMin: "+c.TLS.ProtocolMin,
+			"olcTLSCipherSuite: "+c.TLS.CipherSuite,
+		)
+	}
+
+	var modules []string
+	if c.Modules != nil {
+		modules = []string{
+			"dn: cn=module{0},cn=config",
+			"objectClass: olcModuleList",
+			"cn: module{0}",
+			"olcModulePath: " + c.Modules.Path,
+		}
+		for idx, module := range c.Modules.Load {
+			modules = append(modules, fmt.Sprintf("olcModuleLoad: {%d}%s", idx, module))
+		}
+	}
+
+	schema := []string{strings.Join([]string{
+		"dn: cn=schema,cn=config",
+		"objectClass: olcSchemaConfig",
+		"cn: schema",
+	}, "\n")}
+	for _, path := range c.SchemaFiles {
+		schema = append(schema, "include: file://"+path)
+	}
+
+	frontend := []string{
+		"dn: olcDatabase={-1}frontend,cn=config",
+		"objectClass: olcDatabaseConfig",
+		"objectClass: olcFrontendConfig",
+		"olcDatabase: {-1}frontend",
+	}
+	for idx, rule := range c.AccessRules {
+		frontend = append(frontend, fmt.Sprintf("olcAccess: {%d}to %s by %s", idx, rule.To, strings.Join(rule.By, " by ")))
+	}
+
+	//nobody gets to see or change cn=config through LDAP
+	config := []string{
+		"dn: olcDatabase={0}config,cn=config",
+		"objectClass: olcDatabaseConfig",
+		"olcDatabase: {0}config",
+		"olcAccess: {0}to * by * none",
+	}
+
+	db := c.Database
+	database := []string{
+		"dn: olcDatabase={1}" + db.Type + ",cn=config",
+		"objectClass: olcDatabaseConfig",
+		"objectClass: olcMdbConfig",
+		"olcDatabase: {1}" + db.Type,
+		fmt.Sprintf("olcDbMaxSize: %d", db.MaxSize),
+		"olcSuffix: " + db.Suffix,
+		"olcRootDN: " + db.RootDN,
+		"olcRootPW: " + db.RootPasswordHash,
+		"olcDbDirectory: " + db.Directory,
+	}
+	for idx, limit := range db.Limits {
+		database = append(database, fmt.Sprintf("olcLimits: {%d}%s", idx, limit))
+	}
+	for _, index := range db.Indexes {
+		database = append(database, "olcDbIndex: "+index)
+	}
+
+	entries := []string{strings.Join(general, "\n")}
+	if len(modules) > 0 {
+		entries = append(entries, strings.Join(modules, "\n"))
+	}
+	entries = append(entries,
+		strings.Join(schema, "\n\n"),
+		renderCustomSchemaLDIF(),
+		strings.Join(frontend, "\n"),
+		strings.Join(config, "\n"),
+		strings.Join(database, "\n"),
+	)
+	return []byte(strings.Join(entries, "\n\n") + "\n")
+}
+
+// RecordFiles computes checksums of the configuration files that slapd reads,
+// so that operators can detect whether they were changed after the fact.
+// Directories (like the cn=config directory with PORTUNUS_SLAPD_CONFIG_STYLE=olc)
+// are searched recursively.
+func (c *slapdConfig) RecordFiles(paths ...string) error {
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(buf)
+			c.Files = append(c.Files, slapdConfigFile{Path: path, SHA256: hex.EncodeToString(sum[:])})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Path < c.Files[j].Path })
+	return nil
+}
+
+// RenderJSON renders the description of this configuration that is shown to
+// admins by portunus-server.
+func (c slapdConfig) RenderJSON() []byte {
+	buf, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		panic(err.Error()) //cannot happen for this type
+	}
+	return append(buf, '\n')
+}
@@ -0,0 +1,287 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestSlapdConfigDescriptionMatchesRenderedConfig(t *testing.T) {
+	for _, style := range []string{"slapd.conf", "olc"} {
+		for _, hasTLS := range []bool{false, true} {
+			environment := map[string]string{
+				"PORTUNUS_LDAP_SUFFIX":             "dc=example,dc=org",
+				"PORTUNUS_SLAPD_CONFIG_STYLE":      style,
+				"PORTUNUS_SLAPD_SCHEMA_DIR":        "/etc/openldap/schema",
+				"PORTUNUS_SLAPD_SIZE_LIMIT":        "unlimited",
+				"PORTUNUS_SLAPD_STATE_DIR":         "/var/run/portunus-slapd",
+				"PORTUNUS_SLAPD_TLS_CIPHER_SUITES": defaultCipherSuites,
+			}
+			if hasTLS {
+				environment["PORTUNUS_LDAP_SUFFIX"] = "dc=example,dc=com"
+				environment["PORTUNUS_PASSWORD_HASH_SCHEME"] = "argon2"
+				environment["PORTUNUS_SLAPD_MODULE_DIR"] = "/usr/lib/openldap"
+				environment["PORTUNUS_SLAPD_SIZE_LIMIT"] = "10000"
+				environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] = "/etc/ssl/ldap.pem"
+				environment["PORTUNUS_SLAPD_TLS_CIPHER_SUITES"] = "ECDHE-RSA-AES128-GCM-SHA256"
+			}
+			desc := style + " with TLS and modules = " + strconv.FormatBool(hasTLS)
+
+			cfg := prepareSlapdConfig(environment, &core.NoopHasher{})
+			passwordHash := environment["PORTUNUS_LDAP_PASSWORD_HASH"]
+
+			//the JSON description must not reveal the password hash
+			buf := cfg.RenderJSON()
+			if strings.Contains(string(buf), passwordHash) {
+				t.Errorf("JSON description for %s contains the password hash", desc)
+			}
+			var described slapdConfig
+			must.Succeed(json.Unmarshal(buf, &described))
+
+			//parse the actual configuration back into the structured representation
+			var rendered slapdConfig
+			if style == "olc" {
+				rendered = parseSlapdConfigLDIF(t, string(cfg.Render()))
+			} else {
+				rendered = parseSlapdConf(t, string(cfg.Render()))
+				parseCustomSchema(t, string(renderCustomSchema()), &rendered.CustomSchema)
+			}
+			rendered.Style = style
+			rendered.Files = []slapdConfigFile{}
+			assert.DeepEqual(t, "password hash in "+desc, rendered.Database.RootPasswordHash, passwordHash)
+			rendered.Database.RootPasswordHash = ""
+
+			assert.DeepEqual(t, "config for "+desc, rendered, described)
+		}
+	}
+}
+
+func TestSlapdConfigRecordFiles(t *testing.T) {
+	dirPath := t.TempDir()
+	must.Succeed(os.WriteFile(filepath.Join(dirPath, "slapd.conf"), []byte("hello\n"), 0666))
+	must.Succeed(os.Mkdir(filepath.Join(dirPath, "slapd.d"), 0777))
+	must.Succeed(os.WriteFile(filepath.Join(dirPath, "slapd.d", "cn=config.ldif"), []byte("world\n"), 0666))
+
+	var cfg slapdConfig
+	must.Succeed(cfg.RecordFiles(filepath.Join(dirPath, "slapd.d"), filepath.Join(dirPath, "slapd.conf")))
+	assert.DeepEqual(t, "files", cfg.Files, []slapdConfigFile{
+		{Path: filepath.Join(dirPath, "slapd.conf"), SHA256: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+		{Path: filepath.Join(dirPath, "slapd.d", "cn=config.ldif"), SHA256: "e258d248fda94c63753607f7c4494ee0fcbe92f1a76bfdac795c9d84101eb317"},
+	})
+}
+
+// Parses a slapd.conf rendered by slapdConfig.Render(). This deliberately
+// does not share any code with the renderer.
+func parseSlapdConf(t *testing.T, input string) (cfg slapdConfig) {
+	t.Helper()
+	for _, line := range strings.Split(input, "\n") {
+		if strings.HasPrefix(line, "\tby ") {
+			rule := &cfg.AccessRules[len(cfg.AccessRules)-1]
+			rule.By = append(rule.By, strings.TrimPrefix(line, "\tby "))
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, fields[0])), `"`)
+
+		switch fields[0] {
+		case "modulepath":
+			ensureModules(&cfg).Path = value
+		case "moduleload":
+			ensureModules(&cfg).Load = append(ensureModules(&cfg).Load, value)
+		case "include":
+			if strings.HasSuffix(value, "/portunus.schema") {
+				cfg.CustomSchema.Path = value
+			} else {
+				cfg.SchemaFiles = append(cfg.SchemaFiles, value)
+			}
+		case "access":
+			to, by, hasBy := strings.Cut(strings.TrimPrefix(value, "to "), " by ")
+			rule := slapdAccessRule{To: to}
+			if hasBy {
+				rule.By = strings.Split(by, " by ")
+			}
+			cfg.AccessRules = append(cfg.AccessRules, rule)
+		case "TLSCACertificateFile":
+			ensureTLS(&cfg).CACertificateFile = value
+		case "TLSCertificateFile":
+			ensureTLS(&cfg).CertificateFile = value
+		case "TLSCertificateKeyFile":
+			ensureTLS(&cfg).CertificateKeyFile = value
+		case "TLSProtocolMin":
+			ensureTLS(&cfg).ProtocolMin = value
+		case "TLSCipherSuite":
+			ensureTLS(&cfg).CipherSuite = value
+		case "database":
+			cfg.Database.Type = value
+		case "maxsize":
+			cfg.Database.MaxSize = must.Return(strconv.ParseUint(value, 10, 64))
+		case "suffix":
+			cfg.Database.Suffix = value
+		case "rootdn":
+			cfg.Database.RootDN = value
+		case "rootpw":
+			cfg.Database.RootPasswordHash = value
+		case "directory":
+			cfg.Database.Directory = value
+		case "limits":
+			cfg.Database.Limits = append(cfg.Database.Limits, value)
+		case "index":
+			cfg.Database.Indexes = append(cfg.Database.Indexes, value)
+		default:
+			t.Errorf("unexpected line in slapd.conf: %q", line)
+		}
+	}
+	return cfg
+}
+
+// Parses the schema file rendered by renderCustomSchema().
+func parseCustomSchema(t *testing.T, input string, schema *slapdCustomSchema) {
+	t.Helper()
+	for _, line := range strings.Split(input, "\n") {
+		switch keyword, def, _ := strings.Cut(line, " "); keyword {
+		case "":
+			continue
+		case "attributetype":
+			schema.AttributeTypes = append(schema.AttributeTypes, def)
+		case "objectclass":
+			schema.ObjectClasses = append(schema.ObjectClasses, def)
+		default:
+			t.Errorf("unexpected line in portunus.schema: %q", line)
+		}
+	}
+}
+
+// Parses a LDIF rendered by slapdConfig.Render(). This deliberately does not
+// share any code with the renderer.
+func parseSlapdConfigLDIF(t *testing.T, input string) (cfg slapdConfig) {
+	t.Helper()
+	currentDN := ""
+	for _, line := range strings.Split(input, "\n") {
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Errorf("unexpected line in LDIF: %q", line)
+			continue
+		}
+
+		switch key {
+		case "dn":
+			currentDN = value
+		case "objectClass", "cn":
+			continue
+		case "olcModulePath":
+			ensureModules(&cfg).Path = value
+		case "olcModuleLoad":
+			prefix := "{" + strconv.Itoa(len(ensureModules(&cfg).Load)) + "}"
+			if !strings.HasPrefix(value, prefix) {
+				t.Errorf("module out of order: %q", value)
+			}
+			cfg.Modules.Load = append(cfg.Modules.Load, strings.TrimPrefix(value, prefix))
+		case "include":
+			cfg.SchemaFiles = append(cfg.SchemaFiles, strings.TrimPrefix(value, "file://"))
+		case "olcAttributeTypes":
+			cfg.CustomSchema.AttributeTypes = append(cfg.CustomSchema.AttributeTypes, value)
+		case "olcObjectClasses":
+			cfg.CustomSchema.ObjectClasses = append(cfg.CustomSchema.ObjectClasses, value)
+		case "olcAccess":
+			//the config database is never accessible, regardless of configuration
+			if currentDN == "olcDatabase={0}config,cn=config" {
+				assert.DeepEqual(t, "access rule for cn=config", value, "{0}to * by * none")
+				continue
+			}
+			prefix := "{" + strconv.Itoa(len(cfg.AccessRules)) + "}to "
+			if !strings.HasPrefix(value, prefix) {
+				t.Errorf("access rule out of order: %q", value)
+			}
+			to, by, _ := strings.Cut(strings.TrimPrefix(value, prefix), " by ")
+			cfg.AccessRules = append(cfg.AccessRules, slapdAccessRule{To: to, By: strings.Split(by, " by ")})
+		case "olcTLSCACertificateFile":
+			ensureTLS(&cfg).CACertificateFile = value
+		case "olcTLSCertificateFile":
+			ensureTLS(&cfg).CertificateFile = value
+		case "olcTLSCertificateKeyFile":
+			ensureTLS(&cfg).CertificateKeyFile = value
+		case "olcTLSProtocolMin":
+			ensureTLS(&cfg).ProtocolMin = value
+		case "olcTLSCipherSuite":
+			ensureTLS(&cfg).CipherSuite = value
+		case "olcDatabase":
+			if currentDN == "olcDatabase="+value+",cn=config" && strings.HasPrefix(value, "{1}") {
+				cfg.Database.Type = strings.TrimPrefix(value, "{1}")
+			}
+		case "olcDbMaxSize":
+			cfg.Database.MaxSize = must.Return(strconv.ParseUint(value, 10, 64))
+		case "olcSuffix":
+			cfg.Database.Suffix = value
+		case "olcRootDN":
+			cfg.Database.RootDN = value
+		case "olcRootPW":
+			cfg.Database.RootPasswordHash = value
+		case "olcDbDirectory":
+			cfg.Database.Directory = value
+		case "olcLimits":
+			prefix := "{" + strconv.Itoa(len(cfg.Database.Limits)) + "}"
+			if !strings.HasPrefix(value, prefix) {
+				t.Errorf("limit out of order: %q", value)
+			}
+			cfg.Database.Limits = append(cfg.Database.Limits, strings.TrimPrefix(value, prefix))
+		case "olcDbIndex":
+			cfg.Database.Indexes = append(cfg.Database.Indexes, value)
+		default:
+			t.Errorf("unexpected line in LDIF: %q", line)
+		}
+	}
+	return cfg
+}
+
+func ensureTLS(cfg *slapdConfig) *slapdTLSConfig {
+	if cfg.TLS == nil {
+		cfg.TLS = &slapdTLSConfig{}
+	}
+	return cfg.TLS
+}
+
+func ensureModules(cfg *slapdConfig) *slapdModules {
+	if cfg.Modules == nil {
+		cfg.Modules = &slapdModules{}
+	}
+	return cfg.Modules
+}
+
+func TestCheckSlapdModule(t *testing.T) {
+	moduleDir := t.TempDir()
+	environment := map[string]string{"PORTUNUS_SLAPD_MODULE_DIR": moduleDir}
+	scheme := must.Return(crypt.ParseScheme("argon2"))
+
+	//schemes that do not need a module are always fine
+	must.Succeed(checkSlapdModule(environment, must.Return(crypt.ParseScheme("bcrypt"))))
+
+	err := checkSlapdModule(environment, scheme)
+	if err == nil {
+		t.Fatal("expected error for missing argon2 module, but got none")
+	}
+	assert.DeepEqual(t, "error for missing module", err.Error(),
+		`PORTUNUS_PASSWORD_HASH_SCHEME=argon2 is not supported by this slapd: cannot find module "argon2" in PORTUNUS_SLAPD_MODULE_DIR=`+moduleDir)
+
+	must.Succeed(os.WriteFile(filepath.Join(moduleDir, "argon2.so"), nil, 0666))
+	must.Succeed(checkSlapdModule(environment, scheme))
+}
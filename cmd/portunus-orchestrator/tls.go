@@ -0,0 +1,167 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Certificate renewal tools usually write the certificate, the key and the
+// CA chain one after the other. We only reload once things have calmed down
+// for this long, to avoid restarting slapd with a half-written set of files.
+const tlsReloadDelay = 5 * time.Second
+
+// The default for PORTUNUS_SLAPD_TLS_CIPHER_SUITES. This is the "intermediate"
+// recommendation from <https://wiki.mozilla.org/Security/Server_Side_TLS> in
+// the OpenSSL cipher list format. (TLS 1.3 ciphers are not affected by this
+// setting, since all of them are considered secure.)
+const defaultCipherSuites = "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384"
+
+// This is deliberately strict, since the value ends up in slapd's config
+// without any quoting.
+var cipherSuitesRx = regexp.MustCompile(`^[A-Za-z0-9_+!@=.:-]+$`)
+
+func isCipherSuiteList(input string) bool {
+	return cipherSuitesRx.MatchString(input)
+}
+
+// Returns the TLS files that slapd reads from its state directory, mapped to
+// the paths that the user configured for them.
+func tlsFilePaths(environment map[string]string) map[string]string {
+	return map[string]string{
+		"cert.pem": environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"],
+		"key.pem":  environment["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"],
+		"ca.pem":   environment["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"],
+	}
+}
+
+// Checks that the private key belongs to the certificate, and that the
+// certificate is valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME. If we gave slapd a
+// certificate that fails these checks, it would start up just fine, and only
+// portunus-server would fail later on when connecting to it.
+func checkTLSCertificate(certPEM, keyPEM []byte, domainName string, now time.Time) (warning string, err error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return "", err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return ldap.CheckServerCertificate(leaf, domainName, now)
+}
+
+// Copies the TLS cert and private key into a location where slapd can
+// definitely read it. Returns whether any of the files changed.
+//
+// The files are only written if they pass checkTLSCertificate(), so that
+// slapd does not end up with an unusable configuration.
+func copyTLSFiles(environment map[string]string, ids map[string]int) (changed bool, err error) {
+	contents := make(map[string][]byte)
+	for destName, srcPath := range tlsFilePaths(environment) {
+		contents[destName], err = os.ReadFile(srcPath)
+		if err != nil {
+			return false, err
+		}
+	}
+	warning, err := checkTLSCertificate(contents["cert.pem"], contents["key.pem"], environment["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"], time.Now())
+	if err != nil {
+		return false, fmt.Errorf("cannot use TLS certificate %s: %w",
+			environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"], err)
+	}
+	if warning != "" {
+		logg.Other("WARNING", "TLS certificate %s: %s", environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"], warning)
+	}
+
+	for destName, buf := range contents {
+		destPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], destName)
+		oldBuf, err := os.ReadFile(destPath)
+		if err == nil && bytes.Equal(oldBuf, buf) {
+			continue
+		}
+		//the old file is read-only, so it cannot be overwritten in place
+		err = os.Remove(destPath)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		err = os.WriteFile(destPath, buf, 0400)
+		if err != nil {
+			return changed, err
+		}
+		err = os.Chown(destPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"])
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// Watches the configured TLS files for changes, and restarts slapd to pick up
+// a renewed certificate. Does not return. Call with `go`.
+//
+// We watch the directories containing the files instead of the files
+// themselves: Renewal tools tend to replace files (or symlinks pointing to
+// them) instead of writing into them, which an inotify watch on the old file
+// would not notice.
+func watchTLSFiles(environment map[string]string, ids map[string]int, slapd *slapdServer) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logg.Error("cannot watch TLS certificate for changes: cannot initialize filesystem watcher: %s", err.Error())
+		return
+	}
+	defer watcher.Close()
+
+	watchedDirs := make(map[string]bool)
+	for _, srcPath := range tlsFilePaths(environment) {
+		dirPath := filepath.Dir(srcPath)
+		if watchedDirs[dirPath] {
+			continue
+		}
+		err := watcher.Add(dirPath)
+		if err != nil {
+			logg.Error("cannot watch TLS certificate for changes: cannot setup filesystem watcher on %s: %s", dirPath, err.Error())
+			return
+		}
+		watchedDirs[dirPath] = true
+	}
+
+	var reloadTimer <-chan time.Time
+	for {
+		select {
+		case <-watcher.Events:
+			//Since not every event in these directories concerns our files, the
+			//reload compares contents and only restarts slapd if needed.
+			reloadTimer = time.After(tlsReloadDelay)
+		case err := <-watcher.Errors:
+			logg.Error("while watching TLS certificate for changes: %s", err.Error())
+		case <-reloadTimer:
+			reloadTimer = nil
+			changed, err := copyTLSFiles(environment, ids)
+			if err != nil {
+				logg.Error("not reloading TLS certificate: %s", err.Error())
+				logg.Info("will try again when the TLS certificate changes")
+				continue
+			}
+			if changed {
+				logg.Info("TLS certificate has changed")
+				slapd.Restart()
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestCheckTLSCertificate(t *testing.T) {
+	now := time.Now()
+	cert := test.GenerateCertificate(t, []string{"*.example.org"}, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	otherCert := test.GenerateCertificate(t, []string{"*.example.org"}, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	//a matching certificate passes
+	warning, err := checkTLSCertificate(cert.CertPEM, cert.KeyPEM, "ldap.example.org", now)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "warning", warning, "")
+
+	//the private key must belong to the certificate
+	_, err = checkTLSCertificate(cert.CertPEM, otherCert.KeyPEM, "ldap.example.org", now)
+	if err == nil {
+		t.Error("expected error for mismatched private key, but got none")
+	}
+
+	//the domain name must be covered by the certificate; the error quotes what the certificate covers instead
+	_, err = checkTLSCertificate(cert.CertPEM, cert.KeyPEM, "ldap.example.com", now)
+	if err == nil {
+		t.Fatal("expected error for mismatched domain name, but got none")
+	}
+	assert.DeepEqual(t, "error for mismatched domain name", err.Error(),
+		`certificate is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME "ldap.example.com", only for DNS:*.example.org`)
+
+	//shortly before expiry, the certificate is still accepted, but with a warning
+	warning, err = checkTLSCertificate(cert.CertPEM, cert.KeyPEM, "ldap.example.org", now.Add(80*24*time.Hour))
+	test.ExpectNoError(t, err)
+	if warning == "" {
+		t.Error("expected warning for certificate that expires soon, but got none")
+	}
+}
@@ -0,0 +1,65 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/must"
+)
+
+// Implements `portunus-server --check-seed`: Shows which changes the seed
+// would make to the current database, without touching the database or
+// the LDAP server. Returns the exit code: 0 if there are no changes, 1 if
+// there are changes or if the result would not be valid.
+func checkSeed() int {
+	vcfg := must.Return(core.ReadValidationConfigFromEnvironment())
+	seed, errs := core.ReadDatabaseSeedFromEnvironment(vcfg)
+	errs.LogFatalIfError()
+	if seed == nil {
+		logg.Fatal("cannot check seed: PORTUNUS_SEED_PATH is not set")
+	}
+	hasher := must.Return(crypt.NewPasswordHasher(must.Return(crypt.ReadSchemeFromEnvironment())))
+
+	oldDB, err := store.ReadDatabaseFromEnvironment()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logg.Fatal("while loading database from store: %s", err.Error())
+		}
+		//on first startup, the seed gets applied to an empty database
+		logg.Info("the database does not exist yet, so all seeded objects will be created")
+		oldDB = core.Database{}
+	}
+
+	//this is the same sequence of steps that the nexus performs on startup
+	oldDB.Normalize()
+	newDB := oldDB.Cloned()
+	seed.ApplyTo(&newDB, hasher)
+	errs = newDB.Validate(vcfg)
+	for _, err := range errs {
+		logg.Error("database would not be valid after applying the seed: %s", err.Error())
+	}
+
+	changes := core.DiffDatabases(oldDB, newDB)
+	if len(changes) == 0 {
+		fmt.Println("The seed would not make any changes to the database.")
+		if !errs.IsEmpty() {
+			return 1
+		}
+		return 0
+	}
+	for _, change := range changes {
+		fmt.Println(change.String())
+	}
+	return 1
+}
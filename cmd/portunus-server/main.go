@@ -8,16 +8,23 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/majewsky/portunus/internal/frontend"
 	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/majewsky/portunus/internal/notify"
+	"github.com/majewsky/portunus/internal/oidc"
 	"github.com/majewsky/portunus/internal/store"
 	_ "github.com/majewsky/xyrillian.css"
 	"github.com/sapcc/go-bits/logg"
@@ -26,7 +33,11 @@ import (
 )
 
 func main() {
+	logging.Setup(os.Getenv("PORTUNUS_LOG_FORMAT"))
 	logg.ShowDebug = os.Getenv("PORTUNUS_DEBUG") == "true"
+	if len(os.Args) == 2 && os.Args[1] == "--check-seed" {
+		os.Exit(checkSeed())
+	}
 	dropPrivileges()
 
 	vcfg := must.Return(core.ReadValidationConfigFromEnvironment())
@@ -34,27 +45,136 @@ func main() {
 	errs.LogFatalIfError()
 
 	ctx := context.TODO()
-	hasher := must.Return(crypt.NewPasswordHasher())
+	hasher := must.Return(crypt.NewPasswordHasher(must.Return(crypt.ReadSchemeFromEnvironment())))
 	nexus := core.NewNexus(seed, vcfg, hasher)
+	if state := core.ReadOnlyStateFromEnvironment(); state != nil {
+		nexus.SetReadOnly(state)
+		logg.Info("starting in read-only mode because PORTUNUS_SERVER_READ_ONLY is set")
+	}
+
+	activityLogSize := must.Return(strconv.Atoi(osext.GetenvOrDefault("PORTUNUS_SERVER_ACTIVITY_LOG_SIZE", "100")))
+	activityLogPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "activity.json")
+	activityLog := must.Return(store.NewActivityLog(activityLogPath, activityLogSize))
+	nexus.AddActivityListener(ctx, activityLog.Record)
+
+	deviceRetention := must.Return(time.ParseDuration(osext.GetenvOrDefault("PORTUNUS_SERVER_DEVICE_RETENTION", "2160h")))
+	devicesPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "devices.json")
+	deviceStore := must.Return(store.NewDeviceStore(devicesPath, deviceRetention))
+
+	var notifier *notify.Notifier
+	notifyConfig := must.Return(notify.ReadConfigFromEnvironment())
+	if notifyConfig != nil {
+		notifier = notify.NewNotifier(*notifyConfig)
+		go notifier.Run(ctx, nexus)
+	}
+
+	elevationsPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "elevations.json")
+	elevations := core.NewElevationManager(nexus, must.Return(store.NewElevationStore(elevationsPath)))
+	if notifier != nil {
+		elevations.OnEvent = notifier.NotifyElevation
+	}
+	go elevations.Run(ctx)
+
+	var seedCorrections *core.SeedCorrectionTracker
+	if seed != nil {
+		seedFightThreshold := must.Return(strconv.Atoi(osext.GetenvOrDefault("PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD", "5")))
+		seedFightWindow := must.Return(time.ParseDuration(osext.GetenvOrDefault("PORTUNUS_SERVER_SEED_FIGHT_WINDOW", "1h")))
+		seedCorrections = core.NewSeedCorrectionTracker(seedFightThreshold, seedFightWindow)
+		if notifier != nil {
+			seedCorrections.OnFight = notifier.NotifySeedFight
+		}
+		seedCorrections.Register(ctx, nexus)
+	}
+
+	var feedSync *core.FeedSync
+	feedConfig := must.Return(core.ReadFeedConfigFromEnvironment())
+	if feedConfig != nil {
+		feedSyncPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "feed-sync.json")
+		feedSync = core.NewFeedSync(*feedConfig, nexus, must.Return(store.NewFeedSyncStore(feedSyncPath)))
+		go feedSync.Run(ctx)
+	}
 
-	storePath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "database.json")
-	storeAdapter := store.NewAdapter(nexus, storePath)
+	//this needs to be checked before the store creates an empty database
+	ldapOUNames := must.Return(ldap.ReadOUNamesFromEnvironment())
+	storedDB, err := store.ReadDatabaseFromEnvironment()
+	isExistingDatabase := !errors.Is(err, os.ErrNotExist)
+	ouNamesPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "ldap-ou-names.json")
+	must.Return(ldap.CheckOUNames(ouNamesPath, ldapOUNames, isExistingDatabase))
+	//the nexus is only filled once the store adapter runs, so the default group
+	//is checked against the stored database directly
+	must.Succeed(vcfg.CheckDefaultGroup(storedDB, seed, hasher))
+
+	storeAdapter := store.NewAdapter(nexus, must.Return(store.NewStoreFromEnvironment()))
 	go func() {
 		must.Succeed(storeAdapter.Run(ctx))
 	}()
 
+	var ldapCertStatus *ldap.CertificateStatus
+	if os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME") != "" {
+		ldapCertStatus = &ldap.CertificateStatus{}
+	}
 	ldapConn := must.Return(ldap.Connect(ldap.ConnectionOptions{
-		DNSuffix:      osext.MustGetenv("PORTUNUS_LDAP_SUFFIX"),
-		Password:      osext.MustGetenv("PORTUNUS_LDAP_PASSWORD"),
-		TLSDomainName: os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME"),
+		DNSuffix:          osext.MustGetenv("PORTUNUS_LDAP_SUFFIX"),
+		Password:          osext.MustGetenv("PORTUNUS_LDAP_PASSWORD"),
+		TLSDomainName:     os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME"),
+		CertificateStatus: ldapCertStatus,
 	}))
 	ldapAdapter := ldap.NewAdapter(nexus, ldapConn)
+	ldapAdapter.HideTemporaryPasswords = os.Getenv("PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS") == "true"
+	ldapAdapter.OUNames = ldapOUNames
+	ldapAdapter.SetUserLayout(must.Return(ldap.ParseUserLayout(os.Getenv("PORTUNUS_LDAP_USER_LAYOUT"))))
+	if os.Getenv("PORTUNUS_LDAP_SHADOW_MODE") == "true" {
+		ldapAdapter.EnableShadowMode()
+	}
 	go func() {
 		must.Succeed(ldapAdapter.Run(ctx))
 	}()
 
-	handler := frontend.HTTPHandler(nexus, os.Getenv("PORTUNUS_SERVER_HTTP_SECURE") == "true")
-	logg.Fatal(http.ListenAndServe(os.Getenv("PORTUNUS_SERVER_HTTP_LISTEN"), handler).Error())
+	healthChecks := map[string]core.HealthCheck{
+		"ldap":  ldapAdapter,
+		"store": storeAdapter,
+	}
+	destructiveWindow := must.Return(core.ReadDestructiveWindowFromEnvironment())
+	controlSocketPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "control.sock")
+	controlListener := must.Return(listenOnControlSocket(controlSocketPath))
+	go func() {
+		logg.Fatal(http.Serve(controlListener, frontend.ControlHandler(nexus, ldapAdapter, destructiveWindow)).Error())
+	}()
+
+	//login sessions are handed over from the previous process, so that restarts do not log out all users
+	sessionsPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "sessions.json")
+	frontend.RestoreSessions(sessionsPath)
+
+	var oidcProvider *oidc.Provider
+	oidcConfig := must.Return(oidc.ReadConfigFromEnvironment())
+	if oidcConfig != nil {
+		oidcKeyPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "oidc-signing-key.pem")
+		oidcProvider = oidc.NewProvider(*oidcConfig, must.Return(oidc.LoadOrGenerateSigningKey(oidcKeyPath)), nexus)
+	}
+
+	handler := frontend.HTTPHandler(nexus, os.Getenv("PORTUNUS_SERVER_HTTP_SECURE") == "true", healthChecks, activityLog, storeAdapter.MergeConflicts(), deviceStore, notifier, elevations, ldapCertStatus, seedCorrections, oidcProvider, feedSync, destructiveWindow, ldapAdapter)
+	server := &http.Server{Addr: os.Getenv("PORTUNUS_SERVER_HTTP_LISTEN"), Handler: handler}
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.ListenAndServe()
+	}()
+
+	//on SIGINT or SIGTERM (which is what portunus-orchestrator sends), finish
+	//the requests in flight and then hand over the sessions to the next process
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverDone:
+		logg.Fatal(err.Error())
+	case <-shutdownCtx.Done():
+	}
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(timeoutCtx)
+	if err != nil {
+		logg.Error("while shutting down HTTP server: %s", err.Error())
+	}
+	frontend.SaveSessions(sessionsPath)
 }
 
 func dropPrivileges() {
@@ -78,3 +198,24 @@ func dropPrivileges() {
 		logg.Fatal("change UID failed: " + err.Error())
 	}
 }
+
+// Opens the Unix socket for the control API used by portunusctl. Since the
+// control API does not do any authentication by itself, the socket is only
+// accessible to our own user (and to root).
+func listenOnControlSocket(path string) (net.Listener, error) {
+	//a socket file left behind by a previous run would make Listen() fail
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
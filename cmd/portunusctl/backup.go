@@ -0,0 +1,234 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Backups are encrypted on the client side, so the unencrypted database
+// (which contains password hashes) never touches the disk.
+
+func runBackup(c client, format string, args []string) error {
+	fs := flag.NewFlagSet("portunusctl backup", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	outputPath := fs.String("output", "", "")
+	var recipientStrings stringListFlag
+	fs.Var(&recipientStrings, "recipient", "")
+	recipientsFile := fs.String("recipients-file", "", "")
+	passphraseFile := fs.String("passphrase-file", "", "")
+	_ = fs.Parse(args) //cannot fail because of flag.ExitOnError
+	expectArgs(fs.Args())
+	if *outputPath == "" {
+		usageError("missing --output for \"backup\"")
+	}
+
+	var recipients []age.Recipient
+	switch {
+	case *passphraseFile != "" && (len(recipientStrings) > 0 || *recipientsFile != ""):
+		usageError("--passphrase-file cannot be combined with --recipient or --recipients-file")
+	case *passphraseFile != "":
+		passphrase, err := readPassphraseFile(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, r)
+	case len(recipientStrings) > 0 || *recipientsFile != "":
+		for _, input := range recipientStrings {
+			r, err := age.ParseX25519Recipient(input)
+			if err != nil {
+				return err
+			}
+			recipients = append(recipients, r)
+		}
+		if *recipientsFile != "" {
+			buf, err := os.ReadFile(*recipientsFile)
+			if err != nil {
+				return err
+			}
+			parsed, err := age.ParseRecipients(bytes.NewReader(buf))
+			if err != nil {
+				return fmt.Errorf("cannot parse %s: %w", *recipientsFile, err)
+			}
+			recipients = append(recipients, parsed...)
+		}
+	default:
+		usageError("\"backup\" needs --recipient, --recipients-file or --passphrase-file")
+	}
+
+	var buf []byte
+	err := c.do("GET", "/v1/database", nil, &buf)
+	if err != nil {
+		return err
+	}
+	var encrypted bytes.Buffer
+	w, err := age.Encrypt(&encrypted, recipients...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if *outputPath == "-" {
+		_, err = os.Stdout.Write(encrypted.Bytes())
+		return err
+	}
+	err = writeFileAtomically(*outputPath, encrypted.Bytes())
+	if err != nil {
+		return err
+	}
+	return printConfirmation(format, "Wrote encrypted backup to %s.", *outputPath)
+}
+
+func runRestore(c client, format string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		usageError("missing file name for \"restore\"")
+	}
+	path := args[0]
+
+	fs := flag.NewFlagSet("portunusctl restore", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	identityFile := fs.String("identity-file", "", "")
+	passphraseFile := fs.String("passphrase-file", "", "")
+	forceSeedOverride := fs.Bool("force-seed-override", false, "")
+	_ = fs.Parse(args[1:]) //cannot fail because of flag.ExitOnError
+	expectArgs(fs.Args())
+
+	var identities []age.Identity
+	switch {
+	case *identityFile != "" && *passphraseFile != "":
+		usageError("--identity-file and --passphrase-file cannot be combined")
+	case *identityFile != "":
+		buf, err := os.ReadFile(*identityFile)
+		if err != nil {
+			return err
+		}
+		identities, err = age.ParseIdentities(bytes.NewReader(buf))
+		if err != nil {
+			return fmt.Errorf("cannot parse %s: %w", *identityFile, err)
+		}
+	case *passphraseFile != "":
+		passphrase, err := readPassphraseFile(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		i, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, i)
+	default:
+		usageError("\"restore\" needs --identity-file or --passphrase-file")
+	}
+
+	var (
+		encrypted []byte
+		err       error
+	)
+	if path == "-" {
+		encrypted, err = io.ReadAll(os.Stdin)
+	} else {
+		encrypted, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	r, err := age.Decrypt(bytes.NewReader(encrypted), identities...)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt %s: %w", path, err)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt %s: %w", path, err)
+	}
+
+	//the server validates the backup in the same way as the database file
+	apiPath := "/v1/database"
+	if *forceSeedOverride {
+		apiPath += "?force_seed_override=true"
+	}
+	err = c.do("PUT", apiPath, buf, nil)
+	if err != nil {
+		return err
+	}
+	return printConfirmation(format, "Restored database from %s.", path)
+}
+
+// The passphrase is read from a file instead of from the command line, so that
+// it does not show up in the process list.
+func readPassphraseFile(path string) (string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(buf), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("%s does not contain a passphrase", path)
+	}
+	return passphrase, nil
+}
+
+// Writes the file under a temporary name first, so that an interrupted backup
+// does not replace the previous backup with a truncated file.
+func writeFileAtomically(path string, contents []byte) (err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	_, err = tmpFile.Write(contents)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// stringListFlag is a flag.Value for flags that can be given multiple times.
+type stringListFlag []string
+
+// String implements the flag.Value interface.
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements the flag.Value interface.
+func (f *stringListFlag) Set(value string) error {
+	if value == "" {
+		return errors.New("value may not be empty")
+	}
+	*f = append(*f, value)
+	return nil
+}
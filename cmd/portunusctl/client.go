@@ -0,0 +1,136 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// client talks to the control API of portunus-server through its Unix socket.
+type client struct {
+	http *http.Client
+}
+
+func newClient() client {
+	stateDir := osext.GetenvOrDefault("PORTUNUS_SERVER_STATE_DIR", "/var/lib/portunus")
+	socketPath := filepath.Join(stateDir, "control.sock")
+	return client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Performs a request against the control API. If `body` is not nil, it is
+// encoded as JSON, unless it already is a []byte. If `result` is not nil, the
+// response body is decoded into it. Errors reported by the server are
+// returned as type *apiError.
+func (c client) do(method, path string, body, result any) error {
+	var reqBody io.Reader
+	switch body := body.(type) {
+	case nil:
+		reqBody = nil
+	case []byte:
+		reqBody = bytes.NewReader(body)
+	default:
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	//the host name is irrelevant since we always dial the Unix socket
+	req, err := http.NewRequest(method, "http://portunus"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach portunus-server (is it running, and are you running as root?): %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		var errResp control.ErrorResponse
+		err := json.Unmarshal(respBody, &errResp)
+		if err != nil || len(errResp.Errors) == 0 {
+			return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(respBody))
+		}
+		return &apiError{errResp}
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*result = respBody
+		return nil
+	default:
+		return json.Unmarshal(respBody, result)
+	}
+}
+
+// Escapes a user or group name for use in a URL path.
+func pathElem(name string) string {
+	return url.PathEscape(name)
+}
+
+// apiError is an error response from the control API.
+type apiError struct {
+	Response control.ErrorResponse
+}
+
+// Error implements the builtin/error interface.
+func (e *apiError) Error() string {
+	msg := e.Response.Errors[0].Message
+	if len(e.Response.Errors) > 1 {
+		msg += fmt.Sprintf(" (and %d more errors)", len(e.Response.Errors)-1)
+	}
+	return msg
+}
+
+// Prints the given error and exits.
+func failWith(err error, format string) {
+	apiErr, ok := err.(*apiError)
+	switch {
+	case ok && format == "json":
+		buf, _ := json.MarshalIndent(apiErr.Response, "", "  ")
+		fmt.Fprintln(os.Stderr, string(buf))
+	case ok:
+		for _, e := range apiErr.Response.Errors {
+			fmt.Fprintln(os.Stderr, "error: "+e.Message)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+	}
+	os.Exit(1)
+}
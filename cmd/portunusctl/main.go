@@ -0,0 +1,525 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+const usage = `Usage: portunusctl [--format=table|json] <command> [<args>...]
+
+Commands:
+  user list
+  user show <login-name>
+  user create <login-name> --given-name=<name> [--family-name=<name>] [--email=<address>] [--valid-until=<YYYY-MM-DD>]
+              [--posix-uid=<id> --posix-gid=<id> [--posix-home=<path>] [--posix-shell=<path>]]
+              [--groups=<name>,...]       (default: the group from PORTUNUS_USER_DEFAULT_GROUP, if any)
+  user delete <login-name>
+  user set-password <login-name>          (reads the password from stdin)
+  user offboard <login-name> [--retain-groups=<name>,...]
+                                          (disables the user and revokes all their access)
+  group list
+  group show <group-name>
+  group add-member <group-name> <login-name>
+  group remove-member <group-name> <login-name>
+  show <ref>                              (shows the user or group with this name)
+  export                                  (prints the entire database to stdout)
+  export-ldif [--include-passwords]       (prints all LDAP entries as LDIF to stdout)
+  import <file>                           (replaces the entire database; use "-" for stdin)
+  backup --output=<file> (--recipient=<age1...> | --recipients-file=<path> | --passphrase-file=<path>)
+                                          (writes an age-encrypted export; --recipient can be repeated)
+  restore <file> (--identity-file=<path> | --passphrase-file=<path>) [--force-seed-override]
+                                          (replaces the entire database with an encrypted backup)
+
+portunusctl talks to portunus-server through the Unix socket "control.sock" in
+$PORTUNUS_SERVER_STATE_DIR (default: /var/lib/portunus). It usually needs to
+run as root to access that socket.
+
+Since a user and a group can have the same name, names of users and groups can
+be given as "user/<login-name>" or "group/<group-name>". For <ref>, a bare name
+is only accepted if it does not belong to both a user and a group.
+
+Backups can be decrypted with the age tool from <https://age-encryption.org>.
+"import" and "restore" need an open destructive operations window, and refuse
+to proceed if the database conflicts with the seed. With --force-seed-override,
+the seed takes precedence instead.
+`
+
+func main() {
+	fs := flag.NewFlagSet("portunusctl", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	format := fs.String("format", "table", "output format (table or json)")
+	_ = fs.Parse(os.Args[1:]) //cannot fail because of flag.ExitOnError
+	if *format != "table" && *format != "json" {
+		usageError(`--format must be "table" or "json"`)
+	}
+
+	args := fs.Args()
+	if len(args) == 0 {
+		usageError("no command given")
+	}
+	c := newClient()
+	var err error
+	switch args[0] {
+	case "user":
+		err = runUserCommand(c, *format, args[1:])
+	case "group":
+		err = runGroupCommand(c, *format, args[1:])
+	case "show":
+		expectArgs(args[1:], "ref")
+		err = runShow(c, *format, args[1])
+	case "export":
+		expectArgs(args[1:])
+		err = runExport(c)
+	case "export-ldif":
+		err = runExportLDIF(c, args[1:])
+	case "import":
+		expectArgs(args[1:], "file")
+		err = runImport(c, args[1])
+	case "backup":
+		err = runBackup(c, *format, args[1:])
+	case "restore":
+		err = runRestore(c, *format, args[1:])
+	default:
+		usageError(fmt.Sprintf("unknown command: %q", args[0]))
+	}
+	if err != nil {
+		failWith(err, *format)
+	}
+}
+
+func usageError(msg string) {
+	fmt.Fprintf(os.Stderr, "error: %s\n\n%s", msg, usage)
+	os.Exit(2)
+}
+
+func expectArgs(args []string, names ...string) {
+	if len(args) != len(names) {
+		usageError(fmt.Sprintf("expected %d argument(s), but got %d", len(names), len(args)))
+	}
+}
+
+// Takes a user or group name from the command line. Since the command
+// determines whether a user or a group is expected, a bare name is always
+// unambiguous. A name with a type prefix (e.g. "group/admins") is only
+// accepted if it has the expected type.
+func nameArg(arg, objectType string) string {
+	ref := core.ParseObjectRef(arg)
+	if ref.Type != "" && ref.Type != objectType {
+		usageError(fmt.Sprintf("expected a %s, but %q refers to a %s", objectType, arg, ref.Type))
+	}
+	return ref.Name
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// user commands
+
+func runUserCommand(c client, format string, args []string) error {
+	if len(args) == 0 {
+		usageError("no subcommand given for \"user\"")
+	}
+	switch args[0] {
+	case "list":
+		expectArgs(args[1:])
+		var users []core.User
+		err := c.do("GET", "/v1/users", nil, &users)
+		if err != nil {
+			return err
+		}
+		return printUserList(format, users)
+	case "show":
+		expectArgs(args[1:], "login-name")
+		var user core.User
+		err := c.do("GET", "/v1/users/"+pathElem(nameArg(args[1], "user")), nil, &user)
+		if err != nil {
+			return err
+		}
+		return printUser(format, user)
+	case "create":
+		return runUserCreate(c, format, args[1:])
+	case "delete":
+		expectArgs(args[1:], "login-name")
+		loginName := nameArg(args[1], "user")
+		err := c.do("DELETE", "/v1/users/"+pathElem(loginName), nil, nil)
+		if err != nil {
+			return err
+		}
+		return printConfirmation(format, "Deleted user %q.", loginName)
+	case "set-password":
+		expectArgs(args[1:], "login-name")
+		loginName := nameArg(args[1], "user")
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req := control.PasswordRequest{Password: password}
+		err = c.do("PUT", "/v1/users/"+pathElem(loginName)+"/password", req, nil)
+		if err != nil {
+			return err
+		}
+		return printConfirmation(format, "Updated password of user %q.", loginName)
+	case "offboard":
+		return runUserOffboard(c, format, args[1:])
+	default:
+		usageError(fmt.Sprintf("unknown subcommand: \"user %s\"", args[0]))
+		return nil
+	}
+}
+
+func runUserCreate(c client, format string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		usageError("missing login name for \"user create\"")
+	}
+	user := core.User{LoginName: nameArg(args[0], "user")}
+
+	fs := flag.NewFlagSet("portunusctl user create", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	fs.StringVar(&user.GivenName, "given-name", "", "")
+	fs.StringVar(&user.FamilyName, "family-name", "", "")
+	fs.StringVar(&user.EMailAddress, "email", "", "")
+	validUntil := fs.String("valid-until", "", "")
+	var posix core.UserPosixAttributes
+	posixUID := fs.String("posix-uid", "", "")
+	posixGID := fs.String("posix-gid", "", "")
+	fs.StringVar(&posix.HomeDirectory, "posix-home", "", "")
+	fs.StringVar(&posix.LoginShell, "posix-shell", "", "")
+	groups := fs.String("groups", "", "")
+	_ = fs.Parse(args[1:]) //cannot fail because of flag.ExitOnError
+	expectArgs(fs.Args())
+
+	var err error
+	user.ValidUntil, err = core.ParseValidUntilDate(*validUntil, user.Ref().Field("valid_until"))
+	if err != nil {
+		return err
+	}
+
+	//an incomplete set of POSIX attributes is rejected by the server's validation
+	if *posixUID != "" || *posixGID != "" || posix.HomeDirectory != "" || posix.LoginShell != "" {
+		posix.UID, err = core.ParsePosixID(*posixUID, user.Ref().Field("posix_uid"))
+		if err != nil {
+			return err
+		}
+		posix.GID, err = core.ParsePosixID(*posixGID, user.Ref().Field("posix_gid"))
+		if err != nil {
+			return err
+		}
+		user.POSIX = &posix
+	}
+
+	path := "/v1/users"
+	isFlagSet := false
+	fs.Visit(func(f *flag.Flag) { isFlagSet = isFlagSet || f.Name == "groups" })
+	if isFlagSet {
+		var groupNames []string
+		for _, groupName := range strings.Split(*groups, ",") {
+			if groupName = strings.TrimSpace(groupName); groupName != "" {
+				groupNames = append(groupNames, nameArg(groupName, "group"))
+			}
+		}
+		path += "?groups=" + url.QueryEscape(strings.Join(groupNames, ","))
+	}
+	err = c.do("POST", path, user, nil)
+	if err != nil {
+		return err
+	}
+	return printConfirmation(format, "Created user %q. Use \"portunusctl user set-password\" to set their password.", user.LoginName)
+}
+
+func runUserOffboard(c client, format string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		usageError("missing login name for \"user offboard\"")
+	}
+	loginName := nameArg(args[0], "user")
+
+	fs := flag.NewFlagSet("portunusctl user offboard", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	retainGroups := fs.String("retain-groups", "", "")
+	_ = fs.Parse(args[1:]) //cannot fail because of flag.ExitOnError
+	expectArgs(fs.Args())
+
+	opts := core.DefaultOffboardingOptions()
+	for _, groupName := range strings.Split(*retainGroups, ",") {
+		if groupName = strings.TrimSpace(groupName); groupName != "" {
+			opts.RetainGroupNames = append(opts.RetainGroupNames, nameArg(groupName, "group"))
+		}
+	}
+	var report core.OffboardingReport
+	err := c.do("POST", "/v1/users/"+pathElem(loginName)+"/offboard", opts, &report)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(report)
+	}
+	tw := newTableWriter()
+	fmt.Fprintf(tw, "Offboarded user:\t%s\n", report.LoginName)
+	if report.DisabledAt != nil {
+		fmt.Fprintf(tw, "Disabled at:\t%s\n", report.DisabledAt.Format("2006-01-02 15:04:05 MST"))
+	}
+	fmt.Fprintf(tw, "Removed SSH public keys:\t%d\n", report.RemovedSSHKeyCount)
+	fmt.Fprintf(tw, "Removed from groups:\t%s\n", orDash(strings.Join(report.RemovedFromGroups, ", ")))
+	fmt.Fprintf(tw, "Retained groups:\t%s\n", orDash(strings.Join(report.RetainedGroups, ", ")))
+	fmt.Fprintf(tw, "Ended sessions:\t%d\n", report.EndedSessionCount)
+	fmt.Fprintf(tw, "Forgotten devices:\t%d\n", report.ForgottenDevices)
+	fmt.Fprintf(tw, "Ended elevations:\t%d\n", report.EndedElevations)
+	return tw.Flush()
+}
+
+// Reads a password from the first line of the given input.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password given on stdin")
+	}
+	return password, nil
+}
+
+func printUserList(format string, users []core.User) error {
+	if format == "json" {
+		return printJSON(users)
+	}
+	tw := newTableWriter()
+	fmt.Fprintln(tw, "LOGIN NAME\tFULL NAME\tEMAIL\tPOSIX UID")
+	for _, u := range users {
+		uid := "-"
+		if u.POSIX != nil {
+			uid = u.POSIX.UID.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.LoginName, u.FullName(), orDash(u.EMailAddress), uid)
+	}
+	return tw.Flush()
+}
+
+func printUser(format string, u core.User) error {
+	if format == "json" {
+		return printJSON(u)
+	}
+	tw := newTableWriter()
+	fmt.Fprintf(tw, "Login name:\t%s\n", u.LoginName)
+	fmt.Fprintf(tw, "Full name:\t%s\n", u.FullName())
+	fmt.Fprintf(tw, "Email:\t%s\n", orDash(u.EMailAddress))
+	fmt.Fprintf(tw, "SSH public keys:\t%d\n", len(u.SSHPublicKeys))
+	if u.ValidUntil != nil {
+		fmt.Fprintf(tw, "Valid until:\t%s\n", core.FormatValidUntilDate(*u.ValidUntil))
+	}
+	if u.Invitation != nil {
+		fmt.Fprintf(tw, "Invitation:\tpending until %s\n", u.Invitation.ExpiresAt.Format("2006-01-02 15:04:05 MST"))
+	}
+	if u.POSIX != nil {
+		fmt.Fprintf(tw, "POSIX UID:\t%s\n", u.POSIX.UID)
+		fmt.Fprintf(tw, "POSIX GID:\t%s\n", u.POSIX.GID)
+		fmt.Fprintf(tw, "Home directory:\t%s\n", u.POSIX.HomeDirectory)
+		fmt.Fprintf(tw, "Login shell:\t%s\n", orDash(u.POSIX.LoginShell))
+	}
+	return tw.Flush()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// group commands
+
+func runGroupCommand(c client, format string, args []string) error {
+	if len(args) == 0 {
+		usageError("no subcommand given for \"group\"")
+	}
+	switch args[0] {
+	case "list":
+		expectArgs(args[1:])
+		var groups []core.Group
+		err := c.do("GET", "/v1/groups", nil, &groups)
+		if err != nil {
+			return err
+		}
+		return printGroupList(format, groups)
+	case "show":
+		expectArgs(args[1:], "group-name")
+		var group core.Group
+		err := c.do("GET", "/v1/groups/"+pathElem(nameArg(args[1], "group")), nil, &group)
+		if err != nil {
+			return err
+		}
+		return printGroup(format, group)
+	case "add-member":
+		expectArgs(args[1:], "group-name", "login-name")
+		groupName, loginName := nameArg(args[1], "group"), nameArg(args[2], "user")
+		err := c.do("PUT", "/v1/groups/"+pathElem(groupName)+"/members/"+pathElem(loginName), nil, nil)
+		if err != nil {
+			return err
+		}
+		return printConfirmation(format, "Added user %q to group %q.", loginName, groupName)
+	case "remove-member":
+		expectArgs(args[1:], "group-name", "login-name")
+		groupName, loginName := nameArg(args[1], "group"), nameArg(args[2], "user")
+		err := c.do("DELETE", "/v1/groups/"+pathElem(groupName)+"/members/"+pathElem(loginName), nil, nil)
+		if err != nil {
+			return err
+		}
+		return printConfirmation(format, "Removed user %q from group %q.", loginName, groupName)
+	default:
+		usageError(fmt.Sprintf("unknown subcommand: \"group %s\"", args[0]))
+		return nil
+	}
+}
+
+func printGroupList(format string, groups []core.Group) error {
+	if format == "json" {
+		return printJSON(groups)
+	}
+	tw := newTableWriter()
+	fmt.Fprintln(tw, "NAME\tLONG NAME\tPOSIX GID\tMEMBERS")
+	for _, g := range groups {
+		gid := "-"
+		if g.PosixGID != nil {
+			gid = g.PosixGID.String()
+		}
+		var members []string
+		for loginName, isMember := range g.MemberLoginNames {
+			if isMember {
+				members = append(members, loginName)
+			}
+		}
+		sort.Strings(members)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Name, g.LongName, gid, orDash(strings.Join(members, ",")))
+	}
+	return tw.Flush()
+}
+
+func printGroup(format string, g core.Group) error {
+	if format == "json" {
+		return printJSON(g)
+	}
+	var members []string
+	for loginName, isMember := range g.MemberLoginNames {
+		if isMember {
+			members = append(members, loginName)
+		}
+	}
+	sort.Strings(members)
+	tw := newTableWriter()
+	fmt.Fprintf(tw, "Name:\t%s\n", g.Name)
+	fmt.Fprintf(tw, "Long name:\t%s\n", g.LongName)
+	if g.PosixGID != nil {
+		fmt.Fprintf(tw, "POSIX GID:\t%s\n", g.PosixGID)
+	}
+	fmt.Fprintf(tw, "Members:\t%s\n", orDash(strings.Join(members, ", ")))
+	return tw.Flush()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// show
+
+// Shows a user or group that is referenced as "user/<login-name>",
+// "group/<group-name>" or by an unambiguous bare name.
+func runShow(c client, format, arg string) error {
+	var ref control.ObjectRef
+	err := c.do("GET", "/v1/objects/"+pathElem(arg), nil, &ref)
+	if err != nil {
+		return err
+	}
+	if ref.Type == "group" {
+		return runGroupCommand(c, format, []string{"show", "group/" + ref.Name})
+	}
+	return runUserCommand(c, format, []string{"show", "user/" + ref.Name})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// export and import
+
+func runExport(c client) error {
+	var buf []byte
+	err := c.do("GET", "/v1/database", nil, &buf)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func runExportLDIF(c client, args []string) error {
+	fs := flag.NewFlagSet("portunusctl export-ldif", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	includePasswords := fs.Bool("include-passwords", false, "")
+	_ = fs.Parse(args) //cannot fail because of flag.ExitOnError
+	expectArgs(fs.Args())
+
+	path := "/v1/export.ldif"
+	if *includePasswords {
+		path += "?include-passwords=true"
+	}
+	var buf []byte
+	err := c.do("GET", path, nil, &buf)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func runImport(c client, path string) error {
+	var (
+		buf []byte
+		err error
+	)
+	if path == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	return c.do("PUT", "/v1/database", buf, nil)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// output helpers
+
+func newTableWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func printJSON(data any) error {
+	buf, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(buf))
+	return err
+}
+
+// In JSON mode, successful mutations do not print anything, so that scripts
+// only need to check the exit code.
+func printConfirmation(format, msg string, args ...any) error {
+	if format == "json" {
+		return nil
+	}
+	_, err := fmt.Printf(msg+"\n", args...)
+	return err
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
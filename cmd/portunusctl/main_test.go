@@ -0,0 +1,264 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/frontend"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/must"
+)
+
+// Since usage errors and failures end the process with os.Exit(), each
+// portunusctl invocation runs in a subprocess. If this variable is set, the
+// test binary behaves like portunusctl instead of running the tests.
+const runMainEnvVar = "PORTUNUSCTL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnvVar) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type ctlResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+type ctlTestSetup struct {
+	t        *testing.T
+	nexus    core.Nexus
+	stateDir string
+}
+
+// Starts the control API of a fresh nexus on a Unix socket, at the place where
+// portunusctl looks for it.
+func setupCtlTest(t *testing.T) ctlTestSetup {
+	t.Helper()
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", EMailAddress: "jane@example.org"}}
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	stateDir := t.TempDir()
+	listener, err := net.Listen("unix", filepath.Join(stateDir, "control.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(frontend.ControlHandler(nexus, nil, nil))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return ctlTestSetup{t, nexus, stateDir}
+}
+
+// Runs portunusctl with the given arguments and stdin.
+func (s ctlTestSetup) run(stdin string, args ...string) ctlResult {
+	s.t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnvVar+"=1", "PORTUNUS_SERVER_STATE_DIR="+s.stateDir)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	result := ctlResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		s.t.Fatal(err)
+	}
+	return result
+}
+
+func TestArgumentParsing(t *testing.T) {
+	s := setupCtlTest(t)
+
+	//usage errors exit with status 2, before anything is sent to the server
+	testCases := []struct {
+		Args          []string
+		ExpectedError string
+	}{
+		{nil, "error: no command given"},
+		{[]string{"frobnicate"}, `error: unknown command: "frobnicate"`},
+		{[]string{"--format=yaml", "user", "list"}, `error: --format must be "table" or "json"`},
+		{[]string{"user"}, `error: no subcommand given for "user"`},
+		{[]string{"user", "frobnicate"}, `error: unknown subcommand: "user frobnicate"`},
+		{[]string{"group", "frobnicate"}, `error: unknown subcommand: "group frobnicate"`},
+		{[]string{"user", "list", "extra"}, "error: expected 0 argument(s), but got 1"},
+		{[]string{"user", "show"}, "error: expected 1 argument(s), but got 0"},
+		{[]string{"group", "add-member", "admins"}, "error: expected 2 argument(s), but got 1"},
+		{[]string{"import", "a.json", "b.json"}, "error: expected 1 argument(s), but got 2"},
+		{[]string{"user", "show", "group/admins"}, `error: expected a user, but "group/admins" refers to a group`},
+		{[]string{"group", "remove-member", "user/jane", "jane"}, `error: expected a group, but "user/jane" refers to a user`},
+		{[]string{"user", "create", "--given-name=Bob"}, `error: missing login name for "user create"`},
+		{[]string{"user", "create", "bob", "extra"}, "error: expected 0 argument(s), but got 1"},
+		{[]string{"user", "offboard"}, `error: missing login name for "user offboard"`},
+		{[]string{"user", "offboard", "jane", "--given-name=Jane"}, "flag provided but not defined: -given-name"},
+		{[]string{"export-ldif", "extra"}, "error: expected 0 argument(s), but got 1"},
+	}
+	for _, tc := range testCases {
+		cmdline := strings.Join(tc.Args, " ")
+		result := s.run("", tc.Args...)
+		assert.DeepEqual(t, "exit code for "+cmdline, result.ExitCode, 2)
+		assert.DeepEqual(t, "stdout for "+cmdline, result.Stdout, "")
+		if !strings.Contains(result.Stderr, tc.ExpectedError) {
+			t.Errorf("expected %q on stderr for %q, but got %q", tc.ExpectedError, cmdline, result.Stderr)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s := setupCtlTest(t)
+
+	//successful commands print tables, or JSON on request
+	result := s.run("", "user", "list")
+	assert.DeepEqual(t, "exit code for user list", result.ExitCode, 0)
+	assert.DeepEqual(t, "stdout for user list", result.Stdout,
+		"LOGIN NAME  FULL NAME  EMAIL             POSIX UID\n"+
+			"jane        Jane Doe   jane@example.org  -\n",
+	)
+	result = s.run("", "--format=json", "show", "jane")
+	assert.DeepEqual(t, "exit code for show", result.ExitCode, 0)
+	var user core.User
+	err := json.Unmarshal([]byte(result.Stdout), &user)
+	if err != nil {
+		t.Fatalf("cannot decode output of show: %s (output was %q)", err.Error(), result.Stdout)
+	}
+	assert.DeepEqual(t, "login name from show", user.LoginName, "jane")
+
+	//changes arrive in the nexus
+	result = s.run("", "user", "create", "bob", "--given-name=Bob", "--family-name=Bobson")
+	assert.DeepEqual(t, "exit code for user create", result.ExitCode, 0)
+	assert.DeepEqual(t, "stdout for user create", result.Stdout,
+		"Created user \"bob\". Use \"portunusctl user set-password\" to set their password.\n")
+	result = s.run("swordfish\n", "user", "set-password", "bob")
+	assert.DeepEqual(t, "exit code for user set-password", result.ExitCode, 0)
+	bob, exists := s.nexus.FindUser(func(u core.User) bool { return u.LoginName == "bob" })
+	assert.DeepEqual(t, "bob exists", exists, true)
+	assert.DeepEqual(t, "password hash of bob", bob.PasswordHash, "{PLAINTEXT}swordfish")
+
+	//new users can be put into groups right away
+	result = s.run("", "user", "create", "carol", "--given-name=Carol", "--family-name=Carlsen", "--groups=admins")
+	assert.DeepEqual(t, "exit code for user create with groups", result.ExitCode, 0)
+	carol, exists := s.nexus.FindUser(func(u core.User) bool { return u.LoginName == "carol" })
+	assert.DeepEqual(t, "carol exists", exists, true)
+	assert.DeepEqual(t, "carol is admin", carol.Perms.Includes(core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}}), true)
+	result = s.run("", "user", "create", "dave", "--given-name=Dave", "--family-name=Davis", "--groups=nonexistent")
+	assert.DeepEqual(t, "exit code for user create with unknown group", result.ExitCode, 1)
+	assert.DeepEqual(t, "stderr for user create with unknown group", result.Stderr, "error: group \"nonexistent\" does not exist\n")
+
+	//errors from the client are printed as they are
+	result = s.run("", "user", "set-password", "bob")
+	assert.DeepEqual(t, "exit code without password", result.ExitCode, 1)
+	assert.DeepEqual(t, "stderr without password", result.Stderr, "error: no password given on stdin\n")
+
+	//errors from the server are printed one per line, or as the original JSON
+	result = s.run("", "user", "show", "nobody")
+	assert.DeepEqual(t, "exit code for unknown user", result.ExitCode, 1)
+	assert.DeepEqual(t, "stderr for unknown user", result.Stderr, "error: user \"nobody\" does not exist\n")
+	result = s.run("", "--format=json", "user", "show", "nobody")
+	assert.DeepEqual(t, "exit code for unknown user in JSON", result.ExitCode, 1)
+	var errResp control.ErrorResponse
+	err = json.Unmarshal([]byte(result.Stderr), &errResp)
+	if err != nil {
+		t.Fatalf("cannot decode error output: %s (output was %q)", err.Error(), result.Stderr)
+	}
+	assert.DeepEqual(t, "error response for unknown user", errResp, control.ErrorResponse{
+		Errors: []control.Error{{Message: `user "nobody" does not exist`}},
+	})
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	s := setupCtlTest(t)
+	dir := t.TempDir()
+	passphrasePath := filepath.Join(dir, "passphrase")
+	must.Succeed(os.WriteFile(passphrasePath, []byte("correct horse battery staple\n"), 0600))
+	identity := must.Return(age.GenerateX25519Identity())
+	identityPath := filepath.Join(dir, "identity.txt")
+	must.Succeed(os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600))
+	setGivenName := func(givenName string) {
+		t.Helper()
+		errs := s.nexus.Update(func(db *core.Database) errext.ErrorSet {
+			db.Users[0].GivenName = givenName
+			return nil
+		}, nil)
+		if !errs.IsEmpty() {
+			t.Fatal(errs.Join(", "))
+		}
+	}
+	expectGivenName := func(desc, expected string) {
+		t.Helper()
+		jane, _ := s.nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+		assert.DeepEqual(t, "given name "+desc, jane.GivenName, expected)
+	}
+
+	testCases := []struct {
+		Desc        string
+		BackupArgs  []string
+		RestoreArgs []string
+	}{
+		{"with passphrase", []string{"--passphrase-file=" + passphrasePath}, []string{"--passphrase-file=" + passphrasePath}},
+		{"with key", []string{"--recipient=" + identity.Recipient().String()}, []string{"--identity-file=" + identityPath}},
+	}
+	for _, tc := range testCases {
+		backupPath := filepath.Join(dir, "backup.json.age")
+		result := s.run("", append([]string{"backup", "--output=" + backupPath}, tc.BackupArgs...)...)
+		assert.DeepEqual(t, "exit code for backup "+tc.Desc, result.ExitCode, 0)
+		assert.DeepEqual(t, "stdout for backup "+tc.Desc, result.Stdout, "Wrote encrypted backup to "+backupPath+".\n")
+
+		//the backup is a regular age file, so it can be decrypted without portunusctl
+		encrypted := must.Return(os.ReadFile(backupPath))
+		assert.DeepEqual(t, "header of backup "+tc.Desc, strings.HasPrefix(string(encrypted), "age-encryption.org/v1\n"), true)
+		assert.DeepEqual(t, "backup "+tc.Desc+" contains plain text", strings.Contains(string(encrypted), "jane"), false)
+
+		setGivenName("Janet")
+		result = s.run("", append([]string{"restore", backupPath}, tc.RestoreArgs...)...)
+		assert.DeepEqual(t, "exit code for restore "+tc.Desc, result.ExitCode, 0)
+		assert.DeepEqual(t, "stdout for restore "+tc.Desc, result.Stdout, "Restored database from "+backupPath+".\n")
+		expectGivenName("after restore "+tc.Desc, "Jane")
+	}
+
+	//with the wrong key, nothing is restored
+	backupPath := filepath.Join(dir, "backup.json.age")
+	setGivenName("Janet")
+	result := s.run("", "restore", backupPath, "--passphrase-file="+passphrasePath)
+	assert.DeepEqual(t, "exit code for restore with wrong key", result.ExitCode, 1)
+	if !strings.HasPrefix(result.Stderr, "error: cannot decrypt "+backupPath+": ") {
+		t.Errorf("unexpected stderr for restore with wrong key: %q", result.Stderr)
+	}
+	expectGivenName("after failed restore", "Janet")
+}
@@ -0,0 +1,59 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package control contains the types that appear in the control API, which is
+// served by portunus-server on a Unix socket and used by portunusctl.
+package control
+
+import "time"
+
+// ErrorResponse is the response body for failed requests to the control API.
+type ErrorResponse struct {
+	Errors []Error `json:"errors"`
+}
+
+// Error appears in type ErrorResponse. For validation errors, the affected
+// object and field are reported separately. Some errors carry a Code that
+// clients can check for instead of parsing the Message.
+type Error struct {
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	ObjectType string `json:"object_type,omitempty"`
+	ObjectName string `json:"object_name,omitempty"`
+	Field      string `json:"field,omitempty"`
+}
+
+// PasswordRequest is the request body for setting a user's password.
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// ObjectRef is the response body for resolving a reference to a user or
+// group. Type is either "user" or "group".
+type ObjectRef struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// ErrorCodeDestructiveWindowClosed appears in Error.Code when a destructive
+// operation was refused because no destructive operations window is open.
+const ErrorCodeDestructiveWindowClosed = "destructive_window_closed"
+
+// ErrorCodeReadOnly appears in Error.Code when a change was refused because
+// Portunus is in read-only mode. Such responses have status 503.
+const ErrorCodeReadOnly = "read_only"
+
+// DestructiveWindow is the response body for GET /v1/destructive-window. If
+// Enabled is false, destructive operations are always allowed. Otherwise, they
+// are only allowed while IsOpen is true.
+type DestructiveWindow struct {
+	Enabled   bool       `json:"enabled"`
+	IsOpen    bool       `json:"is_open"`
+	OpenedBy  string     `json:"opened_by,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,81 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// MembershipChangeKind appears in type MembershipChange.
+type MembershipChangeKind string
+
+const (
+	// MemberAdded is the MembershipChangeKind for users that were added to a group.
+	MemberAdded MembershipChangeKind = "added"
+	// MemberRemoved is the MembershipChangeKind for users that were removed from a group.
+	MemberRemoved MembershipChangeKind = "removed"
+)
+
+// MembershipChange records that a user was added to or removed from a group.
+type MembershipChange struct {
+	GroupName string               `json:"group"`
+	LoginName string               `json:"user"`
+	Kind      MembershipChangeKind `json:"kind"`
+	//The login name of the user who made the change through the web GUI. This
+	//is empty if the change came from the seed or from an edit of the database file.
+	Actor string `json:"actor,omitempty"`
+	//If not empty, explains why the change was made (see UpdateOptions.Reason).
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// ActivityLog stores MembershipChanges for display in the UI.
+type ActivityLog interface {
+	// ListForGroup returns the recorded changes for the given group, newest first.
+	ListForGroup(groupName string) []MembershipChange
+}
+
+// DiffMemberships returns all group memberships that differ between the two
+// given Databases. When a group is created or deleted, all its members are
+// reported as added or removed, respectively. The Actor, Reason and Time fields
+// of the result are not filled.
+func DiffMemberships(oldDB, newDB Database) (result []MembershipChange) {
+	oldMembers := collectMemberships(oldDB)
+	newMembers := collectMemberships(newDB)
+	for key := range oldMembers {
+		if !newMembers[key] {
+			result = append(result, MembershipChange{GroupName: key[0], LoginName: key[1], Kind: MemberRemoved})
+		}
+	}
+	for key := range newMembers {
+		if !oldMembers[key] {
+			result = append(result, MembershipChange{GroupName: key[0], LoginName: key[1], Kind: MemberAdded})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		lhs, rhs := result[i], result[j]
+		if lhs.GroupName != rhs.GroupName {
+			return lhs.GroupName < rhs.GroupName
+		}
+		return lhs.LoginName < rhs.LoginName
+	})
+	return result
+}
+
+func collectMemberships(db Database) map[[2]string]bool {
+	result := make(map[[2]string]bool)
+	for _, group := range db.Groups {
+		for loginName, isMember := range group.MemberLoginNames {
+			if isMember {
+				result[[2]string{group.Name, loginName}] = true
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Collation sorts names in the order that speakers of a specific language
+// expect. For example, German speakers expect "Ärztin" to sort right next to
+// "Arzt", whereas Swedish speakers expect it after "Zimmer".
+//
+// Collation is safe for concurrent use.
+type Collation struct {
+	//The mutex is required because collate.Collator is not safe for concurrent use.
+	mutex    sync.Mutex
+	collator *collate.Collator
+}
+
+var (
+	collationCache      = make(map[string]*Collation)
+	collationCacheMutex sync.Mutex
+)
+
+// CollationFor returns the Collation for the given language. Since
+// constructing a collator is somewhat expensive, instances are cached.
+func CollationFor(tag language.Tag) *Collation {
+	collationCacheMutex.Lock()
+	defer collationCacheMutex.Unlock()
+
+	key := tag.String()
+	c, exists := collationCache[key]
+	if !exists {
+		c = &Collation{collator: collate.New(tag)}
+		collationCache[key] = c
+	}
+	return c
+}
+
+// CompareStrings returns -1, 0 or +1 depending on whether `lhs` sorts before,
+// equal to or after `rhs`.
+func (c *Collation) CompareStrings(lhs, rhs string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.collator.CompareString(lhs, rhs)
+}
+
+// SortStrings sorts the given list in place.
+func (c *Collation) SortStrings(values []string) {
+	sort.SliceStable(values, func(i, j int) bool {
+		return c.CompareStrings(values[i], values[j]) < 0
+	})
+}
+
+// SortUsers sorts the given list of users in place by family name, then by
+// given name. Users with identical names are ordered by login name. Users
+// without a family name are sorted by their given name instead.
+func (c *Collation) SortUsers(users []User) {
+	sortName := func(u User) string {
+		if u.FamilyName == "" {
+			return u.GivenName
+		}
+		return u.FamilyName
+	}
+	sort.Slice(users, func(i, j int) bool {
+		lhs, rhs := users[i], users[j]
+		if cmp := c.CompareStrings(sortName(lhs), sortName(rhs)); cmp != 0 {
+			return cmp < 0
+		}
+		if cmp := c.CompareStrings(lhs.GivenName, rhs.GivenName); cmp != 0 {
+			return cmp < 0
+		}
+		return lhs.LoginName < rhs.LoginName
+	})
+}
+
+// SortGroups sorts the given list of groups in place by long name. Groups with
+// identical long names are ordered by name.
+func (c *Collation) SortGroups(groups []Group) {
+	sort.Slice(groups, func(i, j int) bool {
+		lhs, rhs := groups[i], groups[j]
+		if cmp := c.CompareStrings(lhs.LongName, rhs.LongName); cmp != 0 {
+			return cmp < 0
+		}
+		return lhs.Name < rhs.Name
+	})
+}
@@ -0,0 +1,66 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"golang.org/x/text/language"
+)
+
+func TestCollationOfStrings(t *testing.T) {
+	input := []string{"Zimmer", "Ärztin", "Arzt", "Öztürk", "Ostermann", "Bäcker", "Baum"}
+
+	values := append([]string(nil), input...)
+	CollationFor(language.German).SortStrings(values)
+	assert.DeepEqual(t, "German order", values,
+		[]string{"Arzt", "Ärztin", "Bäcker", "Baum", "Ostermann", "Öztürk", "Zimmer"})
+
+	//in Swedish, "Ä" and "Ö" are separate letters that sort after "Z"
+	values = append([]string(nil), input...)
+	CollationFor(language.Swedish).SortStrings(values)
+	assert.DeepEqual(t, "Swedish order", values,
+		[]string{"Arzt", "Baum", "Bäcker", "Ostermann", "Zimmer", "Ärztin", "Öztürk"})
+
+	//mixed scripts: Latin sorts before Greek before Cyrillic
+	values = []string{"Иванов", "Zeus", "Αθηνά", "adams", "Борис", "Ωμέγα"}
+	CollationFor(language.English).SortStrings(values)
+	assert.DeepEqual(t, "mixed-script order", values,
+		[]string{"adams", "Zeus", "Αθηνά", "Ωμέγα", "Борис", "Иванов"})
+}
+
+func TestCollationOfUsersAndGroups(t *testing.T) {
+	users := []User{
+		{LoginName: "zimmer", GivenName: "Anna", FamilyName: "Zimmer"},
+		{LoginName: "aerztin2", GivenName: "Berta", FamilyName: "Ärztin"},
+		{LoginName: "aerztin1", GivenName: "Berta", FamilyName: "Ärztin"},
+		{LoginName: "aerztin3", GivenName: "Anton", FamilyName: "Ärztin"},
+		{LoginName: "arzt", GivenName: "Carl", FamilyName: "Arzt"},
+	}
+	CollationFor(language.German).SortUsers(users)
+	var loginNames []string
+	for _, u := range users {
+		loginNames = append(loginNames, u.LoginName)
+	}
+	assert.DeepEqual(t, "user order", loginNames,
+		[]string{"arzt", "aerztin3", "aerztin1", "aerztin2", "zimmer"})
+
+	groups := []Group{
+		{Name: "zz", LongName: "Öffentlichkeitsarbeit"},
+		{Name: "ops2", LongName: "Operations"},
+		{Name: "ops1", LongName: "Operations"},
+		{Name: "admins", LongName: "Administratoren"},
+	}
+	CollationFor(language.Swedish).SortGroups(groups)
+	var groupNames []string
+	for _, g := range groups {
+		groupNames = append(groupNames, g.Name)
+	}
+	assert.DeepEqual(t, "group order", groupNames,
+		[]string{"admins", "ops1", "ops2", "zz"})
+}
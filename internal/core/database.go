@@ -7,29 +7,61 @@
 package core
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
+	"slices"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/sapcc/go-bits/errext"
 )
 
 // Database contains the contents of Portunus' database.
 type Database struct {
-	Users  ObjectList[User]
-	Groups ObjectList[Group]
+	Users        ObjectList[User]
+	Groups       ObjectList[Group]
+	ServiceUsers ObjectList[ServiceUser]
+	//Tombstones of deleted users, see Database.DeleteUser().
+	DeletedUsers []DeletedUser
+	//Revision is incremented by Nexus.Update() whenever the contents of the
+	//database change, and UpdatedAt is set to the time of that change. This
+	//allows to correlate log messages from the various listeners.
+	Revision  uint64
+	UpdatedAt time.Time
 }
 
 // Cloned returns a deep copy of this database.
 func (d Database) Cloned() Database {
-	return Database{
-		Users:  d.Users.Cloned(),
-		Groups: d.Groups.Cloned(),
+	result := Database{
+		Users:        d.Users.Cloned(),
+		Groups:       d.Groups.Cloned(),
+		ServiceUsers: d.ServiceUsers.Cloned(),
+		Revision:     d.Revision,
+		UpdatedAt:    d.UpdatedAt,
 	}
+	if d.DeletedUsers != nil {
+		result.DeletedUsers = make([]DeletedUser, len(d.DeletedUsers))
+		for idx, tombstone := range d.DeletedUsers {
+			result.DeletedUsers[idx] = tombstone.Cloned()
+		}
+	}
+	return result
+}
+
+// HasSameContentsAs returns whether both databases contain the same objects,
+// regardless of their Revision and UpdatedAt.
+func (d Database) HasSameContentsAs(other Database) bool {
+	d.Revision, other.Revision = 0, 0
+	d.UpdatedAt, other.UpdatedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(d, other)
 }
 
 // IsEmpty returns whether this Database is zero-initialized.
 func (d Database) IsEmpty() bool {
-	return len(d.Users) == 0 && len(d.Groups) == 0
+	return len(d.Users) == 0 && len(d.Groups) == 0 && len(d.ServiceUsers) == 0
 }
 
 // collectUserPermissions assembles a UserWithPerms for the given User.
@@ -45,15 +77,90 @@ func (d Database) collectUserPermissions(user User) UserWithPerms {
 	return result
 }
 
+// Returns whether at least one user has admin access to Portunus.
+func (d Database) hasAdmins() bool {
+	for _, user := range d.Users {
+		for _, group := range d.Groups {
+			if group.Permissions.Portunus.IsAdmin && group.ContainsUser(user) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GroupDeletionImpact describes the consequences of deleting a group.
+// It is returned by Database.ImpactOfGroupDeletion().
+type GroupDeletionImpact struct {
+	//Login names of the members who would lose the respective permission,
+	//because no other group grants it to them.
+	LosingAdminAccess []string
+	LosingLDAPAccess  []string
+	//Whether any user would still have admin access afterwards.
+	AdminsRemain bool
+}
+
+// LocksOutAllAdmins returns whether the deletion would leave no user with
+// admin access to Portunus.
+func (i GroupDeletionImpact) LocksOutAllAdmins() bool {
+	return len(i.LosingAdminAccess) > 0 && !i.AdminsRemain
+}
+
+// ImpactOfGroupDeletion computes which permissions would be lost if the given
+// group was deleted.
+func (d Database) ImpactOfGroupDeletion(groupName string) (result GroupDeletionImpact) {
+	for _, user := range d.Users {
+		var before, after Permissions
+		for _, group := range d.Groups {
+			if !group.ContainsUser(user) {
+				continue
+			}
+			before = before.Union(group.Permissions)
+			if group.Name != groupName {
+				after = after.Union(group.Permissions)
+			}
+		}
+
+		if before.Portunus.IsAdmin && !after.Portunus.IsAdmin {
+			result.LosingAdminAccess = append(result.LosingAdminAccess, user.LoginName)
+		}
+		if before.LDAP.CanRead && !after.LDAP.CanRead {
+			result.LosingLDAPAccess = append(result.LosingLDAPAccess, user.LoginName)
+		}
+		if after.Portunus.IsAdmin {
+			result.AdminsRemain = true
+		}
+	}
+	return result
+}
+
+// GroupsSolelyOwnedBy returns the names of all groups that would be left
+// without owners if the given user was deleted.
+func (d Database) GroupsSolelyOwnedBy(loginName string) (result []string) {
+	for _, group := range d.Groups {
+		if len(group.Owners) == 1 && group.Owners[0] == loginName {
+			result = append(result, group.Name)
+		}
+	}
+	return result
+}
+
 // Normalize applies idempotent transformations to this database to ensure
 // stable comparison and serialization.
 func (d *Database) Normalize() {
-	for _, g := range d.Groups {
+	for idx, g := range d.Groups {
 		for name, isMember := range g.MemberLoginNames {
 			if !isMember {
 				delete(g.MemberLoginNames, name)
 			}
 		}
+		//the order of owners has no meaning
+		if len(g.Owners) == 0 {
+			d.Groups[idx].Owners = nil
+		} else {
+			sort.Strings(g.Owners)
+			d.Groups[idx].Owners = slices.Compact(g.Owners)
+		}
 	}
 
 	sort.Slice(d.Groups, func(i, j int) bool {
@@ -62,15 +169,52 @@ func (d *Database) Normalize() {
 	sort.Slice(d.Users, func(i, j int) bool {
 		return d.Users[i].LoginName < d.Users[j].LoginName
 	})
+	for idx, u := range d.Users {
+		//phone numbers are commonly copy-pasted with stray whitespace
+		d.Users[idx].Phone = strings.TrimSpace(u.Phone)
+		d.Users[idx].MobilePhone = strings.TrimSpace(u.MobilePhone)
+	}
+	sort.Slice(d.ServiceUsers, func(i, j int) bool {
+		return d.ServiceUsers[i].Name < d.ServiceUsers[j].Name
+	})
+	d.purgeDeletedUsers(time.Now())
+	d.purgeFormerLoginNames(time.Now())
+}
+
+// Part of Nexus.Update(): Makes sure that each user has an ID (see User.ID).
+// Since most edits build the user object from scratch, a user without ID takes
+// over the ID of the user with the same login name from the previous
+// database. Only users that did not exist before get a new ID.
+func (d *Database) assignUserIDs(oldDB Database) {
+	oldIDs := make(map[string]string, len(oldDB.Users))
+	for _, u := range oldDB.Users {
+		oldIDs[u.LoginName] = u.ID
+	}
+	for idx, u := range d.Users {
+		if u.ID != "" {
+			continue
+		}
+		if id := oldIDs[u.LoginName]; id != "" {
+			d.Users[idx].ID = id
+		} else {
+			d.Users[idx].ID = hex.EncodeToString(GenerateRandomKey(16))
+		}
+	}
 }
 
-// Validate checks all users and groups in this Database for validity.
+// Validate checks all users, groups and service users in this Database for validity.
 func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 	//check user attributes
 	userCount := make(map[string]uint)
+	userCountIgnoringCase := make(map[string]uint)
+	idCount := make(map[string]uint)
 	for _, u := range d.Users {
 		errs.Append(u.validateLocal(cfg))
 		userCount[u.LoginName]++
+		userCountIgnoringCase[strings.ToLower(u.LoginName)]++
+		if u.ID != "" {
+			idCount[u.ID]++
+		}
 	}
 
 	//check group attributes and membership
@@ -85,6 +229,26 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 				errs.Add(ValidationError{g.Ref().Field("members"), err})
 			}
 		}
+		for _, loginName := range g.Owners {
+			if userCount[loginName] == 0 {
+				err := fmt.Errorf("contains unknown user with login name %q", loginName)
+				errs.Add(ValidationError{g.Ref().Field("owners"), err})
+			}
+		}
+	}
+
+	//check that elevation policies refer to existing groups
+	for _, g := range d.Groups {
+		if g.Elevation == nil {
+			continue
+		}
+		ref := g.Ref().Field("elevation_approver_group")
+		switch {
+		case g.Elevation.ApproverGroupName == g.Name:
+			errs.Add(ref.Wrap(errors.New("must be a different group")))
+		case groupCount[g.Elevation.ApproverGroupName] == 0:
+			errs.Add(ref.Wrap(fmt.Errorf("refers to unknown group %q", g.Elevation.ApproverGroupName)))
+		}
 	}
 
 	//check user name uniqueness
@@ -94,6 +258,19 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 			errs.Add(ref.Wrap(errIsDuplicate))
 		}
 	}
+	//logins match login names case-insensitively (see MatchUserIdent), so
+	//login names must also be unique in that sense
+	for _, u := range d.Users {
+		if userCount[u.LoginName] == 1 && userCountIgnoringCase[strings.ToLower(u.LoginName)] > 1 {
+			errs.Add(u.Ref().Field("login_name").Wrap(errIsDuplicateIgnoringCase))
+		}
+	}
+	//IDs are generated, so duplicates can only come from imports or manual edits
+	for _, u := range d.Users {
+		if u.ID != "" && idCount[u.ID] > 1 {
+			errs.Add(u.Ref().Field("id").Wrap(errIsDuplicate))
+		}
+	}
 
 	//check group name uniqueness
 	for name, count := range groupCount {
@@ -103,5 +280,19 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		}
 	}
 
+	//check service users (their names live in a separate namespace from user
+	//login names since they are stored below a different LDAP OU)
+	serviceUserCount := make(map[string]uint)
+	for _, s := range d.ServiceUsers {
+		errs.Append(s.validateLocal(cfg))
+		serviceUserCount[s.Name]++
+	}
+	for name, count := range serviceUserCount {
+		if count > 1 {
+			ref := ServiceUser{Name: name}.Ref().Field("name")
+			errs.Add(ref.Wrap(errIsDuplicate))
+		}
+	}
+
 	return
 }
@@ -0,0 +1,189 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// DeletedUser is a tombstone for a deleted user. Deleted users are not visible
+// in LDAP anymore, but they are kept in Database.DeletedUsers until PurgeAt,
+// so that a deletion made by mistake can be undone.
+type DeletedUser struct {
+	ID        string    `json:"id"`
+	User      User      `json:"user"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"` //login name of the admin, or empty if not known
+	PurgeAt   time.Time `json:"purge_at"`
+	//The groups that the user was a member of when it was deleted.
+	GroupNames []string `json:"group_names,omitempty"`
+	//The groups that the user was an owner of when it was deleted.
+	OwnedGroupNames []string `json:"owned_group_names,omitempty"`
+}
+
+// Cloned returns a deep copy of this tombstone.
+func (d DeletedUser) Cloned() DeletedUser {
+	d.User = d.User.Cloned()
+	if d.GroupNames != nil {
+		d.GroupNames = append([]string(nil), d.GroupNames...)
+	}
+	if d.OwnedGroupNames != nil {
+		d.OwnedGroupNames = append([]string(nil), d.OwnedGroupNames...)
+	}
+	return d
+}
+
+// DeleteUser removes the user with the given login name from this database
+// and from all groups, including their owner lists. A tombstone for the user is kept in d.DeletedUsers
+// until the given retention period has passed.
+func (d *Database) DeleteUser(loginName, actor string, now time.Time, retention time.Duration) error {
+	user, exists := d.Users.Find(func(u User) bool { return u.LoginName == loginName })
+	if !exists {
+		return errNoSuchObject
+	}
+	err := d.Users.Delete(loginName)
+	if err != nil {
+		return err
+	}
+
+	tombstone := DeletedUser{
+		ID:        hex.EncodeToString(GenerateRandomKey(12)),
+		User:      user,
+		DeletedAt: now,
+		DeletedBy: actor,
+		PurgeAt:   now.Add(retention),
+	}
+	for idx, group := range d.Groups {
+		if group.MemberLoginNames[loginName] {
+			tombstone.GroupNames = append(tombstone.GroupNames, group.Name)
+			group.MemberLoginNames[loginName] = false
+		}
+		if group.IsOwnedBy(loginName) {
+			tombstone.OwnedGroupNames = append(tombstone.OwnedGroupNames, group.Name)
+			d.Groups[idx].Owners = slices.DeleteFunc(slices.Clone(group.Owners), func(owner string) bool { return owner == loginName })
+		}
+	}
+	d.DeletedUsers = append(d.DeletedUsers, tombstone)
+	return nil
+}
+
+var (
+	errIsUsedByAnotherUser = errors.New("is already in use by another user that was created after the deletion")
+	// ErrNoSuchDeletedUser is returned by Database.RestoreDeletedUser() if the
+	// tombstone does not exist (anymore).
+	ErrNoSuchDeletedUser = errors.New("no such deleted user (it may have been purged already)")
+)
+
+// RestoreDeletedUser moves the user from the tombstone with the given ID back
+// into d.Users, and adds it back to those of its former groups that still
+// exist (both as a member and as an owner). If another user with the same
+// login name or POSIX UID was created in the meantime, nothing is restored and
+// validation errors are returned.
+func (d *Database) RestoreDeletedUser(id string) (errs errext.ErrorSet) {
+	idx := -1
+	for i, tombstone := range d.DeletedUsers {
+		if tombstone.ID == id {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		errs.Add(ErrNoSuchDeletedUser)
+		return errs
+	}
+	tombstone := d.DeletedUsers[idx]
+	user := tombstone.User
+
+	ref := user.Ref()
+	for _, other := range d.Users {
+		if strings.EqualFold(other.LoginName, user.LoginName) {
+			errs.Add(ref.Field("login_name").Wrap(errIsUsedByAnotherUser))
+		}
+		if user.POSIX != nil && other.POSIX != nil && user.POSIX.UID == other.POSIX.UID {
+			err := fmt.Errorf("%w (%q)", errIsUsedByAnotherUser, other.LoginName)
+			errs.Add(ref.Field("posix_uid").Wrap(err))
+		}
+	}
+	if !errs.IsEmpty() {
+		return errs
+	}
+
+	d.Users = append(d.Users, user)
+	for _, groupName := range tombstone.GroupNames {
+		for groupIdx, group := range d.Groups {
+			if group.Name == groupName {
+				if group.MemberLoginNames == nil {
+					d.Groups[groupIdx].MemberLoginNames = make(GroupMemberNames)
+				}
+				d.Groups[groupIdx].MemberLoginNames[user.LoginName] = true
+			}
+		}
+	}
+	for _, groupName := range tombstone.OwnedGroupNames {
+		for groupIdx, group := range d.Groups {
+			if group.Name == groupName && !group.IsOwnedBy(user.LoginName) {
+				d.Groups[groupIdx].Owners = append(group.Owners, user.LoginName)
+			}
+		}
+	}
+	d.DeletedUsers = append(d.DeletedUsers[:idx:idx], d.DeletedUsers[idx+1:]...)
+	return nil
+}
+
+// Part of Database.Normalize(): Drops tombstones whose retention period has
+// passed, and sorts the rest with the most recent deletion first.
+func (d *Database) purgeDeletedUsers(now time.Time) {
+	kept := d.DeletedUsers[:0]
+	for _, tombstone := range d.DeletedUsers {
+		if now.Before(tombstone.PurgeAt) {
+			kept = append(kept, tombstone)
+		}
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].DeletedAt.Equal(kept[j].DeletedAt) {
+			return kept[i].ID < kept[j].ID
+		}
+		return kept[i].DeletedAt.After(kept[j].DeletedAt)
+	})
+	d.DeletedUsers = kept
+}
+
+// Part of MergeDatabases(): Tombstones are never modified, only created and
+// dropped, so they can be merged like a set.
+func mergeDeletedUsers(base, ours, theirs []DeletedUser) (result []DeletedUser) {
+	contains := func(list []DeletedUser, id string) bool {
+		for _, tombstone := range list {
+			if tombstone.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tombstone := range ours {
+		//keep unless it was dropped on their side (e.g. because it was restored)
+		if contains(theirs, tombstone.ID) || !contains(base, tombstone.ID) {
+			result = append(result, tombstone)
+		}
+	}
+	for _, tombstone := range theirs {
+		//created only on their side?
+		if !contains(base, tombstone.ID) && !contains(ours, tombstone.ID) {
+			result = append(result, tombstone)
+		}
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestDeleteAndRestoreUser(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison", POSIX: &UserPosixAttributes{UID: 1001, GID: 100, HomeDirectory: "/home/alice"}},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Administrators", MemberLoginNames: GroupMemberNames{"bob": true}},
+			{Name: "developers", LongName: "Developers", MemberLoginNames: GroupMemberNames{"alice": true, "bob": true}},
+			{Name: "testers", LongName: "Testers", MemberLoginNames: GroupMemberNames{"alice": true}},
+		}
+		return nil
+	}, nil))
+
+	//deletion removes the user from the users list and from all groups, but keeps a tombstone
+	deletedAt := time.Now()
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteUser("alice", "bob", deletedAt, time.Hour))
+		return
+	}, nil))
+	_, exists := nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice exists after deletion", exists, false)
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "developers" })
+	assert.DeepEqual(t, "developers after deletion", group.MemberLoginNames, GroupMemberNames{"bob": true})
+
+	tombstones := nexus.ListDeletedUsers()
+	if len(tombstones) != 1 {
+		t.Fatalf("expected 1 tombstone, but got %d", len(tombstones))
+	}
+	tombstone := tombstones[0]
+	assert.DeepEqual(t, "tombstone.User.LoginName", tombstone.User.LoginName, "alice")
+	assert.DeepEqual(t, "tombstone.DeletedBy", tombstone.DeletedBy, "bob")
+	assert.DeepEqual(t, "tombstone.GroupNames", tombstone.GroupNames, []string{"developers", "testers"})
+	assert.DeepEqual(t, "tombstone.PurgeAt", tombstone.PurgeAt, deletedAt.Add(time.Hour))
+
+	//restoring fails if the login name or UID was taken in the meantime
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			User{LoginName: "alice", GivenName: "Alice", FamilyName: "Anderson"},
+			User{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson", POSIX: &UserPosixAttributes{UID: 1001, GID: 100, HomeDirectory: "/home/carol"}},
+		)
+		return nil
+	}, nil))
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		return db.RestoreDeletedUser(tombstone.ID)
+	}, nil),
+		`field "login_name" in user "alice" is already in use by another user that was created after the deletion`,
+		`field "posix_uid" in user "alice" is already in use by another user that was created after the deletion ("carol")`,
+	)
+
+	//after the collisions are resolved, the user comes back with its former
+	//group memberships (except for groups that were deleted in the meantime)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = db.Users[1:2] //only keep "bob"
+		db.Groups = db.Groups[:2]
+		return nil
+	}, nil))
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		return db.RestoreDeletedUser(tombstone.ID)
+	}, nil))
+	user, exists := nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice exists after restore", exists, true)
+	assert.DeepEqual(t, "groups of alice after restore", len(user.GroupMemberships), 1)
+	assert.DeepEqual(t, "tombstones after restore", len(nexus.ListDeletedUsers()), 0)
+
+	//a tombstone can only be restored once
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		return db.RestoreDeletedUser(tombstone.ID)
+	}, nil),
+		`no such deleted user (it may have been purged already)`,
+	)
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	now := time.Now()
+	db := Database{
+		DeletedUsers: []DeletedUser{
+			{ID: "a", User: User{LoginName: "alice"}, DeletedAt: now.Add(-2 * time.Hour), PurgeAt: now.Add(-time.Hour)},
+			{ID: "b", User: User{LoginName: "bob"}, DeletedAt: now.Add(-2 * time.Hour), PurgeAt: now.Add(time.Hour)},
+			{ID: "c", User: User{LoginName: "carol"}, DeletedAt: now.Add(-time.Hour), PurgeAt: now.Add(2 * time.Hour)},
+		},
+	}
+	db.Normalize()
+
+	var ids []string
+	for _, tombstone := range db.DeletedUsers {
+		ids = append(ids, tombstone.ID)
+	}
+	//expired tombstones are dropped, and the most recent deletion comes first
+	assert.DeepEqual(t, "remaining tombstones", ids, []string{"c", "b"})
+}
+
+func TestMergeDeletedUsers(t *testing.T) {
+	tombstones := make(map[string]DeletedUser)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		tombstones[id] = DeletedUser{ID: id}
+	}
+	list := func(ids ...string) (result []DeletedUser) {
+		for _, id := range ids {
+			result = append(result, tombstones[id])
+		}
+		return result
+	}
+
+	//"a" is unchanged, "b" was restored on our side, "c" was restored on their
+	//side, "d" was created on our side, "e" was created on their side
+	result := mergeDeletedUsers(list("a", "b", "c"), list("a", "c", "d"), list("a", "b", "e"))
+	assert.DeepEqual(t, "merged tombstones", result, list("a", "d", "e"))
+}
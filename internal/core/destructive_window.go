@@ -0,0 +1,141 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// ErrDestructiveWindowClosed is returned by DestructiveWindow.Check() if no
+// destructive operations window is open.
+var ErrDestructiveWindowClosed = errors.New("destructive operations are only allowed while an admin has opened a destructive operations window in the web GUI")
+
+// DestructiveWindowState describes an open destructive operations window.
+type DestructiveWindowState struct {
+	OpenedBy  string //login name of the admin who opened the window
+	Reason    string
+	OpenedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// DestructiveWindow is a safety switch for destructive operations in the
+// control API (e.g. deleting users or replacing the entire database). These
+// operations are only allowed while a window is open. Windows are opened by an
+// admin in the web GUI and close automatically after a fixed duration.
+// Opening and closing of windows is logged.
+type DestructiveWindow struct {
+	Duration time.Duration //how long a window stays open
+	mutex    sync.Mutex
+	current  *DestructiveWindowState
+	now      func() time.Time //can be swapped in tests
+}
+
+// NewDestructiveWindow initializes a DestructiveWindow that is closed.
+func NewDestructiveWindow(duration time.Duration) *DestructiveWindow {
+	return &DestructiveWindow{Duration: duration, now: time.Now}
+}
+
+// ReadDestructiveWindowFromEnvironment builds a DestructiveWindow from the
+// PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_* environment variables. If the feature
+// is disabled, nil is returned. All destructive operations are then allowed.
+func ReadDestructiveWindowFromEnvironment() (*DestructiveWindow, error) {
+	if os.Getenv("PORTUNUS_SERVER_DESTRUCTIVE_WINDOW") == "false" {
+		return nil, nil
+	}
+	duration, err := time.ParseDuration(osext.GetenvOrDefault("PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION", "15m"))
+	if err != nil || duration <= 0 {
+		return nil, errors.New("malformed value for PORTUNUS_SERVER_DESTRUCTIVE_WINDOW_DURATION (expected a positive duration like \"15m\")")
+	}
+	return NewDestructiveWindow(duration), nil
+}
+
+// Open opens a new window, or replaces the currently open window. Only admins
+// can do this, and they need to give a reason.
+func (w *DestructiveWindow) Open(actor UserWithPerms, reason string) (DestructiveWindowState, error) {
+	if !actor.Perms.Portunus.IsAdmin {
+		return DestructiveWindowState{}, errors.New("only admins can open a destructive operations window")
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return DestructiveWindowState{}, errors.New("a reason is required for opening a destructive operations window")
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := w.now()
+	state := DestructiveWindowState{
+		OpenedBy:  actor.LoginName,
+		Reason:    reason,
+		OpenedAt:  now,
+		ExpiresAt: now.Add(w.Duration),
+	}
+	w.current = &state
+	logging.Info(logging.Fields{
+		"event":      "destructive_window_opened",
+		"actor":      actor.LoginName,
+		"reason":     reason,
+		"expires_at": state.ExpiresAt.UTC().Format(time.RFC3339),
+	}, "destructive operations window opened by %s until %s", actor.LoginName, state.ExpiresAt.UTC().Format(time.RFC3339))
+	return state, nil
+}
+
+// Close closes the current window ahead of time. Returns false if no window
+// was open.
+func (w *DestructiveWindow) Close(actor string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.currentLocked() == nil {
+		return false
+	}
+	w.closeLocked("closed by " + actor)
+	return true
+}
+
+// Current returns the window that is currently open, if any.
+func (w *DestructiveWindow) Current() (DestructiveWindowState, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	state := w.currentLocked()
+	if state == nil {
+		return DestructiveWindowState{}, false
+	}
+	return *state, true
+}
+
+// Check returns ErrDestructiveWindowClosed unless a window is currently open.
+func (w *DestructiveWindow) Check() error {
+	_, isOpen := w.Current()
+	if !isOpen {
+		return ErrDestructiveWindowClosed
+	}
+	return nil
+}
+
+// Returns the current window, or nil if there is none. Windows are closed
+// lazily when their expiry is noticed.
+func (w *DestructiveWindow) currentLocked() *DestructiveWindowState {
+	if w.current != nil && !w.now().Before(w.current.ExpiresAt) {
+		w.closeLocked("expired")
+	}
+	return w.current
+}
+
+func (w *DestructiveWindow) closeLocked(reason string) {
+	logging.Info(logging.Fields{
+		"event":     "destructive_window_closed",
+		"opened_by": w.current.OpenedBy,
+		"reason":    reason,
+	}, "destructive operations window opened by %s was %s", w.current.OpenedBy, reason)
+	w.current = nil
+}
@@ -0,0 +1,74 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestDestructiveWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	w := NewDestructiveWindow(15 * time.Minute)
+	w.now = func() time.Time { return now }
+
+	admin := UserWithPerms{User: User{LoginName: "alice"}}
+	admin.Perms.Portunus.IsAdmin = true
+	viewer := UserWithPerms{User: User{LoginName: "bob"}}
+	viewer.Perms.Portunus.CanView = true
+
+	check := func(expectedErr error) {
+		t.Helper()
+		err := w.Check()
+		if !errors.Is(err, expectedErr) {
+			t.Errorf("expected Check() to return %v, but got %v", expectedErr, err)
+		}
+	}
+
+	//windows start closed
+	check(ErrDestructiveWindowClosed)
+
+	//only admins can open a window, and they need to give a reason
+	_, err := w.Open(viewer, "cleanup")
+	assert.DeepEqual(t, "error for viewer", err.Error(), "only admins can open a destructive operations window")
+	_, err = w.Open(admin, "  ")
+	assert.DeepEqual(t, "error for missing reason", err.Error(), "a reason is required for opening a destructive operations window")
+	check(ErrDestructiveWindowClosed)
+
+	state, err := w.Open(admin, "cleanup after migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "window state", state, DestructiveWindowState{
+		OpenedBy:  "alice",
+		Reason:    "cleanup after migration",
+		OpenedAt:  now,
+		ExpiresAt: now.Add(15 * time.Minute),
+	})
+
+	//the window expires in the middle of a series of requests
+	check(nil)
+	now = now.Add(10 * time.Minute)
+	check(nil)
+	now = now.Add(5 * time.Minute)
+	check(ErrDestructiveWindowClosed)
+	_, isOpen := w.Current()
+	assert.DeepEqual(t, "window is open after expiry", isOpen, false)
+
+	//windows can be closed ahead of time
+	_, err = w.Open(admin, "another cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+	assert.DeepEqual(t, "first Close()", w.Close("alice"), true)
+	check(ErrDestructiveWindowClosed)
+	assert.DeepEqual(t, "second Close()", w.Close("alice"), false)
+}
@@ -0,0 +1,52 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import "time"
+
+// Device is a browser that a user has logged in with. Browsers are recognized
+// by a long-lived cookie holding a random value. Only the hash of that value
+// is stored as the device ID, so that the device cookie cannot be forged by
+// someone who can read the device store.
+type Device struct {
+	ID         string    `json:"id"`
+	LoginName  string    `json:"login_name"`
+	Name       string    `json:"name"` //derived from the user agent, e.g. "Firefox on Linux"
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	//only set while the device awaits confirmation (see PORTUNUS_SERVER_DEVICE_CONFIRMATION)
+	ConfirmationTokenHash string `json:"confirmation_token_hash,omitempty"`
+}
+
+// IsConfirmed returns false if the device still awaits confirmation by email.
+func (d Device) IsConfirmed() bool {
+	return d.ConfirmationTokenHash == ""
+}
+
+// DeviceStore remembers the devices that users have logged in with, so that
+// users can be notified when their account is used from a new device.
+type DeviceStore interface {
+	// RecordLogin records a login of the given user on the given device, and
+	// returns whether this device was not known for this user before.
+	RecordLogin(loginName, deviceID, name string) (isNew bool)
+	// RequireConfirmation marks the given device as unconfirmed, and returns
+	// the token that confirms it.
+	RequireConfirmation(loginName, deviceID string) (token string)
+	// ConfirmDevice confirms the device that the given token belongs to. If the
+	// token does not belong to any device, false is returned.
+	ConfirmDevice(token string) (Device, bool)
+	// FindDevice returns the given device of the given user.
+	FindDevice(loginName, deviceID string) (Device, bool)
+	// ListDevicesOfUser returns all devices of the given user, most recently used first.
+	ListDevicesOfUser(loginName string) []Device
+	// DeleteDevice forgets the given device of the given user. When the user
+	// logs in on this device again, it will be treated as a new device.
+	DeleteDevice(loginName, deviceID string)
+	// DeleteDevicesOfUnknownUsers forgets all devices of users that are not in
+	// the given set.
+	DeleteDevicesOfUnknownUsers(knownLoginNames map[string]bool)
+}
@@ -0,0 +1,190 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeKind appears in type ObjectChange.
+type ChangeKind string
+
+const (
+	// ObjectCreated is the ChangeKind for objects that only exist in the new Database.
+	ObjectCreated ChangeKind = "created"
+	// ObjectModified is the ChangeKind for objects that exist in both Databases, but differ.
+	ObjectModified ChangeKind = "modified"
+	// ObjectDeleted is the ChangeKind for objects that only exist in the old Database.
+	ObjectDeleted ChangeKind = "deleted"
+)
+
+// ObjectChange describes how a single user, group or service user differs
+// between two versions of a Database.
+type ObjectChange struct {
+	Type string //either "user", "group" or "service user"
+	Key  string //the login name, group name or service user name
+	Kind ChangeKind
+	//For created and deleted objects, this lists all fields of the object.
+	//For modified objects, this lists only those fields that changed.
+	Fields []FieldChange
+}
+
+// FieldChange appears in type ObjectChange.
+//
+// Fields are identified by the path to them in the JSON representation of the
+// object, e.g. "posix.uid" or "permissions.ldap.can_read". Values are also given in their
+// JSON representation. A field that does not exist in one of the versions has
+// an empty value there. Password hashes are redacted.
+type FieldChange struct {
+	Path     string
+	OldValue string
+	NewValue string
+}
+
+// String returns a human-readable representation of this change.
+func (c ObjectChange) String() string {
+	lines := []string{fmt.Sprintf("%s %s %q:", c.Kind, c.Type, c.Key)}
+	for _, f := range c.Fields {
+		switch c.Kind {
+		case ObjectCreated:
+			lines = append(lines, fmt.Sprintf("  %s = %s", f.Path, f.NewValue))
+		case ObjectDeleted:
+			lines = append(lines, fmt.Sprintf("  %s = %s", f.Path, f.OldValue))
+		default:
+			lines = append(lines, fmt.Sprintf("  %s: %s -> %s", f.Path, displayFieldValue(f.OldValue), displayFieldValue(f.NewValue)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func displayFieldValue(value string) string {
+	if value == "" {
+		return "(unset)"
+	}
+	return value
+}
+
+// DiffDatabases returns all differences between the two given Databases.
+// Groups are listed before users, then service users, and each list is sorted
+// by key.
+func DiffDatabases(oldDB, newDB Database) []ObjectChange {
+	result := diffObjectLists("group", oldDB.Groups, newDB.Groups)
+	result = append(result, diffObjectLists("user", oldDB.Users, newDB.Users)...)
+	return append(result, diffObjectLists("service user", oldDB.ServiceUsers, newDB.ServiceUsers)...)
+}
+
+func diffObjectLists[T Object[T]](typeName string, oldList, newList ObjectList[T]) (result []ObjectChange) {
+	oldFields := make(map[string]map[string]string, len(oldList))
+	for _, obj := range oldList {
+		oldFields[obj.Key()] = flattenObject(obj)
+	}
+	newFields := make(map[string]map[string]string, len(newList))
+	for _, obj := range newList {
+		newFields[obj.Key()] = flattenObject(obj)
+	}
+
+	keys := make(map[string]bool, len(oldFields)+len(newFields))
+	for key := range oldFields {
+		keys[key] = true
+	}
+	for key := range newFields {
+		keys[key] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	for _, key := range sortedKeys {
+		oldObj, existedBefore := oldFields[key]
+		newObj, existsAfter := newFields[key]
+		change := ObjectChange{Type: typeName, Key: key, Fields: diffFields(oldObj, newObj)}
+		switch {
+		case !existedBefore:
+			change.Kind = ObjectCreated
+		case !existsAfter:
+			change.Kind = ObjectDeleted
+		default:
+			change.Kind = ObjectModified
+		}
+		if len(change.Fields) > 0 || change.Kind != ObjectModified {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+func diffFields(oldObj, newObj map[string]string) (result []FieldChange) {
+	paths := make(map[string]bool, len(oldObj)+len(newObj))
+	for path := range oldObj {
+		paths[path] = true
+	}
+	for path := range newObj {
+		paths[path] = true
+	}
+
+	for path := range paths {
+		oldValue, newValue := oldObj[path], newObj[path]
+		if oldValue == newValue {
+			continue
+		}
+		//we want to show that the password changed, but not to what
+		if path == "password" {
+			oldValue, newValue = redactPasswordHash(oldValue), redactPasswordHash(newValue)
+		}
+		result = append(result, FieldChange{Path: path, OldValue: oldValue, NewValue: newValue})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+func redactPasswordHash(value string) string {
+	if value == "" || value == `""` {
+		return value
+	}
+	return RedactedValue
+}
+
+// Converts an object into a flat map of field paths to JSON-encoded values.
+// Nested objects are flattened, but lists are kept as a single value.
+func flattenObject(obj any) map[string]string {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		//cannot happen for our own types
+		panic(err.Error())
+	}
+	var data map[string]any
+	err = json.Unmarshal(buf, &data)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	result := make(map[string]string)
+	flattenInto(result, "", data)
+	return result
+}
+
+func flattenInto(result map[string]string, prefix string, data map[string]any) {
+	for key, value := range data {
+		path := prefix + key
+		if nested, ok := value.(map[string]any); ok {
+			flattenInto(result, path+".", nested)
+			continue
+		}
+		buf, err := json.Marshal(value)
+		if err != nil {
+			panic(err.Error())
+		}
+		result[path] = string(buf)
+	}
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestDiffDatabases(t *testing.T) {
+	oldDB := Database{
+		Groups: []Group{
+			{Name: "admins", LongName: "Administrators", MemberLoginNames: GroupMemberNames{"jane": true}},
+			{Name: "obsolete", LongName: "Obsolete", MemberLoginNames: GroupMemberNames{}},
+		},
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "{SHA}old"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", PasswordHash: "{SHA}same"},
+		},
+	}
+	newDB := oldDB.Cloned()
+	newDB.Groups[0].MemberLoginNames["john"] = true
+	newDB.Groups[0].Permissions.Portunus.IsAdmin = true
+	newDB.Groups = newDB.Groups[:1]
+	newDB.Users[0].PasswordHash = "{SHA}new"
+	newDB.Users[0].POSIX = &UserPosixAttributes{UID: 1000, GID: 100, HomeDirectory: "/home/jane"}
+	newDB.Users = append(newDB.Users, User{LoginName: "max", GivenName: "Max", FamilyName: "Mustermann"})
+
+	//DiffDatabases() must not report anything for identical databases...
+	assert.DeepEqual(t, "diff with itself", len(DiffDatabases(oldDB, oldDB)), 0)
+
+	//...and otherwise report all changes, with password hashes redacted
+	actual := DiffDatabases(oldDB, newDB)
+	expected := []ObjectChange{
+		{Type: "group", Key: "admins", Kind: ObjectModified, Fields: []FieldChange{
+			{Path: "members", OldValue: `["jane"]`, NewValue: `["jane","john"]`},
+			{Path: "permissions.portunus.is_admin", OldValue: "false", NewValue: "true"},
+		}},
+		{Type: "group", Key: "obsolete", Kind: ObjectDeleted, Fields: []FieldChange{
+			{Path: "long_name", OldValue: `"Obsolete"`},
+			{Path: "members", OldValue: `[]`},
+			{Path: "name", OldValue: `"obsolete"`},
+			{Path: "permissions.ldap.can_read", OldValue: "false"},
+			{Path: "permissions.portunus.is_admin", OldValue: "false"},
+		}},
+		{Type: "user", Key: "jane", Kind: ObjectModified, Fields: []FieldChange{
+			{Path: "password", OldValue: "(redacted)", NewValue: "(redacted)"},
+			{Path: "posix.gecos", OldValue: "", NewValue: `""`},
+			{Path: "posix.gid", OldValue: "", NewValue: "100"},
+			{Path: "posix.home", OldValue: "", NewValue: `"/home/jane"`},
+			{Path: "posix.shell", OldValue: "", NewValue: `""`},
+			{Path: "posix.uid", OldValue: "", NewValue: "1000"},
+		}},
+		{Type: "user", Key: "max", Kind: ObjectCreated, Fields: []FieldChange{
+			{Path: "family_name", NewValue: `"Mustermann"`},
+			{Path: "given_name", NewValue: `"Max"`},
+			{Path: "login_name", NewValue: `"max"`},
+			{Path: "password", NewValue: `""`},
+		}},
+	}
+	assert.DeepEqual(t, "diff", actual, expected)
+
+	assert.DeepEqual(t, "human-readable diff", actual[0].String(),
+		"modified group \"admins\":\n  members: [\"jane\"] -> [\"jane\",\"john\"]\n  permissions.portunus.is_admin: false -> true")
+}
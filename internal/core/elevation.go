@@ -0,0 +1,638 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// ElevationState appears in type Elevation.
+type ElevationState string
+
+const (
+	// ElevationPending is the ElevationState of requests that still need approval.
+	ElevationPending ElevationState = "pending"
+	// ElevationActive is the ElevationState of elevations that are currently in effect.
+	ElevationActive ElevationState = "active"
+	// ElevationEnded is the ElevationState of requests that were denied,
+	// withdrawn or superseded, and of elevations that expired or were revoked.
+	ElevationEnded ElevationState = "ended"
+)
+
+// Elevation is a temporary membership of a user in a group that has an
+// ElevationPolicy. Elevations start out as pending requests, and are only
+// turned into actual group memberships once enough approvers agreed.
+//
+// Ended elevations are kept around as an audit trail.
+type Elevation struct {
+	ID            string         `json:"id"`
+	LoginName     string         `json:"user"`
+	GroupName     string         `json:"group"`
+	Hours         uint           `json:"hours"`
+	Justification string         `json:"justification"`
+	RequestedBy   string         `json:"requested_by"`
+	RequestedAt   time.Time      `json:"requested_at"`
+	ApprovedBy    []string       `json:"approved_by,omitempty"`
+	State         ElevationState `json:"state"`
+	//For requests to extend an active elevation: the ID of that elevation.
+	//When such a request is approved, the extended elevation ends and this one
+	//becomes active in its place.
+	ExtendsID string `json:"extends,omitempty"`
+	//Only filled once the elevation is active.
+	ExpiresAt time.Time `json:"expires_at"`
+	//Only filled once the elevation has ended.
+	EndedAt   time.Time `json:"ended_at"`
+	EndReason string    `json:"end_reason,omitempty"`
+}
+
+// ElevationStore persists Elevations.
+type ElevationStore interface {
+	// ListElevations returns all stored elevations, including ended ones.
+	ListElevations() []Elevation
+	// UpdateElevations invokes the action with all stored elevations, and
+	// stores the list returned by it unless an error is returned. Concurrent
+	// calls are serialized.
+	UpdateElevations(action func([]Elevation) ([]Elevation, error)) error
+}
+
+// ElevationEventKind appears in type ElevationEvent.
+type ElevationEventKind string
+
+const (
+	// ElevationRequested is the ElevationEventKind for new requests, including
+	// requests for extending an active elevation.
+	ElevationRequested ElevationEventKind = "requested"
+	// ElevationApproved is the ElevationEventKind for requests that received
+	// enough approvals and are now active.
+	ElevationApproved ElevationEventKind = "approved"
+	// ElevationDenied is the ElevationEventKind for requests that were denied,
+	// withdrawn or not decided on in time.
+	ElevationDenied ElevationEventKind = "denied"
+	// ElevationCompleted is the ElevationEventKind for active elevations that
+	// expired or were revoked, i.e. whose group membership was removed.
+	ElevationCompleted ElevationEventKind = "completed"
+)
+
+// ElevationEvent describes a change to an Elevation that all involved users
+// are notified about.
+type ElevationEvent struct {
+	Kind      ElevationEventKind
+	Elevation Elevation
+	//The user who caused this event, or "" for events caused by the expiry sweep.
+	Actor string
+	//The elevated user, the requester and all members of the approver group.
+	//For new requests, also the owners of the group.
+	Recipients []User
+}
+
+// How long requests can wait for approval before they are dropped.
+const elevationRequestLifetime = 7 * 24 * time.Hour
+
+// How often ElevationManager.Run() looks for expired elevations.
+const elevationSweepInterval = time.Minute
+
+// ElevationManager implements the workflow for temporary group memberships.
+// Every state transition is logged, recorded in the ElevationStore, and
+// reported to the OnEvent callback.
+type ElevationManager struct {
+	nexus Nexus
+	store ElevationStore
+	//If not nil, this is called for each state transition, e.g. to send notifications.
+	OnEvent func(ElevationEvent)
+	now     func() time.Time //can be swapped in tests
+}
+
+// NewElevationManager initializes an ElevationManager.
+func NewElevationManager(nexus Nexus, store ElevationStore) *ElevationManager {
+	return &ElevationManager{nexus: nexus, store: store, now: time.Now}
+}
+
+// List returns all elevations that are pending or active.
+func (m *ElevationManager) List() []Elevation {
+	var result []Elevation
+	for _, e := range m.store.ListElevations() {
+		if e.State != ElevationEnded {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Find returns the elevation with the given ID, including ended ones.
+func (m *ElevationManager) Find(id string) (Elevation, bool) {
+	for _, e := range m.store.ListElevations() {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Elevation{}, false
+}
+
+// CanApprove returns whether the given user can approve or deny the given request.
+func (m *ElevationManager) CanApprove(actor UserWithPerms, e Elevation) bool {
+	if e.State != ElevationPending || actor.LoginName == e.LoginName || actor.LoginName == e.RequestedBy {
+		return false
+	}
+	_, policy, err := m.findPolicy(e.GroupName)
+	if err != nil {
+		return false
+	}
+	approvers, exists := m.nexus.FindGroup(func(g Group) bool { return g.Name == policy.ApproverGroupName })
+	return exists && approvers.ContainsUser(actor.User)
+}
+
+// Request creates a request for the given user to become a member of the
+// given group for the given number of hours. Users can only make requests for
+// themselves, except for admins, who can make requests on behalf of others.
+func (m *ElevationManager) Request(actor UserWithPerms, loginName, groupName string, hours uint, justification string) (Elevation, error) {
+	if actor.LoginName != loginName && !actor.Perms.Portunus.IsAdmin {
+		return Elevation{}, errors.New("only admins can request elevation on behalf of other users")
+	}
+	group, policy, err := m.findPolicy(groupName)
+	if err != nil {
+		return Elevation{}, err
+	}
+	err = checkElevationRequest(policy, hours, justification)
+	if err != nil {
+		return Elevation{}, err
+	}
+	if _, exists := m.nexus.FindUser(func(u User) bool { return u.LoginName == loginName }); !exists {
+		return Elevation{}, fmt.Errorf("user %q does not exist", loginName)
+	}
+	if group.MemberLoginNames[loginName] {
+		return Elevation{}, fmt.Errorf("user %q is already a member of group %q", loginName, groupName)
+	}
+
+	e := Elevation{
+		ID:            hex.EncodeToString(GenerateRandomKey(12)),
+		LoginName:     loginName,
+		GroupName:     groupName,
+		Hours:         hours,
+		Justification: justification,
+		RequestedBy:   actor.LoginName,
+		RequestedAt:   m.now(),
+		State:         ElevationPending,
+	}
+	err = m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		for _, other := range elevations {
+			if other.State != ElevationEnded && other.LoginName == loginName && other.GroupName == groupName {
+				return nil, fmt.Errorf("user %q already has a %s elevation into group %q", loginName, other.State, groupName)
+			}
+		}
+		return append(elevations, e), nil
+	})
+	if err != nil {
+		return Elevation{}, err
+	}
+	m.report(ElevationRequested, e, actor.LoginName, "requested elevation for %d hour(s)", hours)
+	return e, nil
+}
+
+// Extend creates a request for extending the given active elevation by the
+// given number of hours. This needs to be approved like the original request.
+func (m *ElevationManager) Extend(actor UserWithPerms, id string, hours uint, justification string) (Elevation, error) {
+	var extension Elevation
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		idx := findElevation(elevations, id)
+		if idx < 0 || elevations[idx].State != ElevationActive {
+			return nil, errors.New("only active elevations can be extended")
+		}
+		target := elevations[idx]
+		if actor.LoginName != target.LoginName && !actor.Perms.Portunus.IsAdmin {
+			return nil, errors.New("only admins can request extensions on behalf of other users")
+		}
+		for _, other := range elevations {
+			if other.State == ElevationPending && other.ExtendsID == id {
+				return nil, errors.New("an extension of this elevation is already waiting for approval")
+			}
+		}
+		_, policy, err := m.findPolicy(target.GroupName)
+		if err != nil {
+			return nil, err
+		}
+		err = checkElevationRequest(policy, hours, justification)
+		if err != nil {
+			return nil, err
+		}
+
+		extension = Elevation{
+			ID:            hex.EncodeToString(GenerateRandomKey(12)),
+			LoginName:     target.LoginName,
+			GroupName:     target.GroupName,
+			Hours:         hours,
+			Justification: justification,
+			RequestedBy:   actor.LoginName,
+			RequestedAt:   m.now(),
+			State:         ElevationPending,
+			ExtendsID:     id,
+		}
+		return append(elevations, extension), nil
+	})
+	if err != nil {
+		return Elevation{}, err
+	}
+	m.report(ElevationRequested, extension, actor.LoginName, "requested extension of elevation %s by %d hour(s)", id, hours)
+	return extension, nil
+}
+
+// Approve records the approval of the given request by the given user. Once
+// enough approvals have been collected, the user is added to the group.
+func (m *ElevationManager) Approve(actor UserWithPerms, id string) (Elevation, error) {
+	var (
+		result     Elevation
+		isApproved bool
+	)
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		idx := findElevation(elevations, id)
+		if idx < 0 || !m.CanApprove(actor, elevations[idx]) {
+			return nil, errors.New("you cannot approve this request")
+		}
+		e := &elevations[idx]
+		for _, approver := range e.ApprovedBy {
+			if approver == actor.LoginName {
+				return nil, errors.New("you have already approved this request")
+			}
+		}
+		e.ApprovedBy = append(e.ApprovedBy, actor.LoginName)
+		group, policy, err := m.findPolicy(e.GroupName)
+		if err != nil {
+			return nil, err
+		}
+		//the membership will be removed again when the elevation ends, so we
+		//cannot allow an elevation to take over a regular membership
+		if e.ExtendsID == "" && group.MemberLoginNames[e.LoginName] {
+			return nil, fmt.Errorf("user %q has become a member of group %q in the meantime", e.LoginName, e.GroupName)
+		}
+		if uint(len(e.ApprovedBy)) < policy.RequiredApprovals {
+			result = *e
+			return elevations, nil
+		}
+
+		//enough approvals -> activate the elevation
+		now := m.now()
+		e.State = ElevationActive
+		e.ExpiresAt = now.Add(time.Duration(e.Hours) * time.Hour)
+		if e.ExtendsID == "" {
+			err := m.updateMembership(e.LoginName, e.GroupName, true, &UpdateOptions{
+				ConflictWithSeedIsError: true,
+				Actor:                   actor.LoginName,
+				Reason:                  "temporary elevation until " + e.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"),
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			//the extended elevation ends, and this one takes its place
+			targetIdx := findElevation(elevations, e.ExtendsID)
+			if targetIdx < 0 || elevations[targetIdx].State != ElevationActive {
+				return nil, errors.New("the elevation to be extended is not active anymore")
+			}
+			target := &elevations[targetIdx]
+			e.ExpiresAt = target.ExpiresAt.Add(time.Duration(e.Hours) * time.Hour)
+			target.State = ElevationEnded
+			target.EndedAt = now
+			target.EndReason = "extended by " + e.ID
+		}
+		result = *e
+		isApproved = true
+		return elevations, nil
+	})
+	if err != nil {
+		return Elevation{}, err
+	}
+	if isApproved {
+		m.report(ElevationApproved, result, actor.LoginName, "approved elevation, expires at %s", result.ExpiresAt.UTC().Format(time.RFC3339))
+	} else {
+		logging.Info(m.logFields(result, actor.LoginName), "approved elevation, %d of %d approvals collected", len(result.ApprovedBy), m.requiredApprovals(result))
+	}
+	return result, nil
+}
+
+// Deny rejects the given request. This can be done by any approver.
+func (m *ElevationManager) Deny(actor UserWithPerms, id string) (Elevation, error) {
+	var result Elevation
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		idx := findElevation(elevations, id)
+		if idx < 0 || !m.CanApprove(actor, elevations[idx]) {
+			return nil, errors.New("you cannot deny this request")
+		}
+		m.end(&elevations[idx], "denied by "+actor.LoginName)
+		result = elevations[idx]
+		return elevations, nil
+	})
+	if err != nil {
+		return Elevation{}, err
+	}
+	m.report(ElevationDenied, result, actor.LoginName, "denied elevation")
+	return result, nil
+}
+
+// Revoke ends the given elevation early, or withdraws the given request. This
+// can be done by admins, by the elevated user and by the requester.
+func (m *ElevationManager) Revoke(actor UserWithPerms, id string) (Elevation, error) {
+	var (
+		result    Elevation
+		wasActive bool
+	)
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		idx := findElevation(elevations, id)
+		if idx < 0 || elevations[idx].State == ElevationEnded {
+			return nil, errors.New("this elevation has ended already")
+		}
+		e := &elevations[idx]
+		if actor.LoginName != e.LoginName && actor.LoginName != e.RequestedBy && !actor.Perms.Portunus.IsAdmin {
+			return nil, errors.New("you cannot revoke this elevation")
+		}
+		wasActive = e.State == ElevationActive
+		if wasActive {
+			err := m.updateMembership(e.LoginName, e.GroupName, false, &UpdateOptions{
+				Actor:  actor.LoginName,
+				Reason: "temporary elevation revoked",
+			})
+			if err != nil {
+				return nil, err
+			}
+			m.end(e, "revoked by "+actor.LoginName)
+		} else {
+			m.end(e, "withdrawn by "+actor.LoginName)
+		}
+		result = *e
+		return elevations, nil
+	})
+	if err != nil {
+		return Elevation{}, err
+	}
+	if wasActive {
+		m.report(ElevationCompleted, result, actor.LoginName, "revoked elevation")
+	} else {
+		m.report(ElevationDenied, result, actor.LoginName, "withdrew elevation request")
+	}
+	return result, nil
+}
+
+// EndElevationsOfUser withdraws all pending requests of the given user, and
+// ends all of their active elevations. This is used when the user is
+// offboarded (see Database.Offboard). The actor may be empty if the
+// offboarding was not started by a user. Returns how many elevations were ended.
+func (m *ElevationManager) EndElevationsOfUser(actor, loginName string) (int, error) {
+	reasonSuffix := " during offboarding"
+	if actor != "" {
+		reasonSuffix = " by " + actor + reasonSuffix
+	}
+	var events []ElevationEvent
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		events = nil
+		for idx := range elevations {
+			e := &elevations[idx]
+			if e.LoginName != loginName {
+				continue
+			}
+			switch e.State {
+			case ElevationActive:
+				err := m.updateMembership(e.LoginName, e.GroupName, false, &UpdateOptions{
+					Actor:  actor,
+					Reason: "user offboarded",
+				})
+				if err != nil {
+					return nil, err
+				}
+				m.end(e, "revoked"+reasonSuffix)
+				events = append(events, ElevationEvent{Kind: ElevationCompleted, Elevation: *e})
+			case ElevationPending:
+				m.end(e, "withdrawn"+reasonSuffix)
+				events = append(events, ElevationEvent{Kind: ElevationDenied, Elevation: *e})
+			}
+		}
+		return elevations, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, event := range events {
+		m.report(event.Kind, event.Elevation, actor, "ended elevation: %s", event.Elevation.EndReason)
+	}
+	return len(events), nil
+}
+
+// Sweep removes the group memberships of all elevations that have expired,
+// and drops requests that cannot be approved anymore. Since this does not
+// need anyone to be around, elevations end on time even when no approver is
+// available.
+func (m *ElevationManager) Sweep() {
+	var events []ElevationEvent
+	err := m.store.UpdateElevations(func(elevations []Elevation) ([]Elevation, error) {
+		events = nil
+		now := m.now()
+		for idx := range elevations {
+			e := &elevations[idx]
+			switch e.State {
+			case ElevationActive:
+				if now.Before(e.ExpiresAt) {
+					continue
+				}
+				//access must end on time even in read-only mode
+				err := m.updateMembership(e.LoginName, e.GroupName, false, &UpdateOptions{
+					Reason:         "temporary elevation expired",
+					SystemInternal: true,
+				})
+				if err != nil {
+					//try again during the next sweep
+					logging.Error(m.logFields(*e, ""), "cannot remove expired elevation: %s", err.Error())
+					continue
+				}
+				m.end(e, "expired")
+				events = append(events, ElevationEvent{Kind: ElevationCompleted, Elevation: *e})
+			case ElevationPending:
+				reason := m.reasonForDroppingRequest(elevations, *e, now)
+				if reason != "" {
+					m.end(e, reason)
+					events = append(events, ElevationEvent{Kind: ElevationDenied, Elevation: *e})
+				}
+			}
+		}
+		return elevations, nil
+	})
+	if err != nil {
+		logging.Error(nil, "cannot sweep elevations: %s", err.Error())
+		return
+	}
+	for _, event := range events {
+		m.report(event.Kind, event.Elevation, "", "ended elevation: %s", event.Elevation.EndReason)
+	}
+}
+
+// Run calls Sweep() periodically until `ctx` expires.
+func (m *ElevationManager) Run(ctx context.Context) {
+	//before the database is loaded, all elevations would look like they refer
+	//to deleted users and groups
+	isLoaded := make(chan struct{})
+	var once sync.Once
+	m.nexus.AddListener(ctx, func(Database) {
+		once.Do(func() { close(isLoaded) })
+	})
+	select {
+	case <-ctx.Done():
+		return
+	case <-isLoaded:
+	}
+
+	ticker := time.NewTicker(elevationSweepInterval)
+	defer ticker.Stop()
+	for {
+		m.Sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns a non-empty reason if the given pending request shall be dropped.
+func (m *ElevationManager) reasonForDroppingRequest(elevations []Elevation, e Elevation, now time.Time) string {
+	if now.Sub(e.RequestedAt) > elevationRequestLifetime {
+		return "not approved in time"
+	}
+	if e.ExtendsID != "" {
+		targetIdx := findElevation(elevations, e.ExtendsID)
+		if targetIdx < 0 || elevations[targetIdx].State != ElevationActive {
+			return "elevation ended before the extension was approved"
+		}
+	}
+	if _, _, err := m.findPolicy(e.GroupName); err != nil {
+		return "group does not allow temporary elevation anymore"
+	}
+	if _, exists := m.nexus.FindUser(func(u User) bool { return u.LoginName == e.LoginName }); !exists {
+		return "user was deleted"
+	}
+	return ""
+}
+
+func (m *ElevationManager) findPolicy(groupName string) (Group, ElevationPolicy, error) {
+	group, exists := m.nexus.FindGroup(func(g Group) bool { return g.Name == groupName })
+	if !exists || group.Elevation == nil {
+		return Group{}, ElevationPolicy{}, fmt.Errorf("group %q does not allow temporary elevation", groupName)
+	}
+	policy := *group.Elevation
+	//the validation already ensures this, but we double-check since this is
+	//the only thing that keeps a single approver from handing out admin access
+	if group.Permissions.Portunus.IsAdmin && policy.RequiredApprovals < minApprovalsForAdminElevation {
+		return Group{}, ElevationPolicy{}, fmt.Errorf("group %q grants admin access and thus requires at least %d approvals", groupName, minApprovalsForAdminElevation)
+	}
+	return group, policy, nil
+}
+
+func (m *ElevationManager) requiredApprovals(e Elevation) uint {
+	_, policy, err := m.findPolicy(e.GroupName)
+	if err != nil {
+		return 0
+	}
+	return policy.RequiredApprovals
+}
+
+func checkElevationRequest(policy ElevationPolicy, hours uint, justification string) error {
+	if hours == 0 || hours > policy.MaxHours {
+		return fmt.Errorf("duration must be between 1 and %d hour(s)", policy.MaxHours)
+	}
+	if strings.TrimSpace(justification) == "" {
+		return errors.New("justification must not be empty")
+	}
+	return nil
+}
+
+func (m *ElevationManager) end(e *Elevation, reason string) {
+	e.State = ElevationEnded
+	e.EndedAt = m.now()
+	e.EndReason = reason
+}
+
+// Adds or removes the given user to or from the given group. If the user or
+// group does not exist anymore, there is nothing to remove.
+func (m *ElevationManager) updateMembership(loginName, groupName string, isMember bool, opts *UpdateOptions) error {
+	errs := m.nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		for idx, group := range db.Groups {
+			if group.Name != groupName {
+				continue
+			}
+			if isMember {
+				db.Groups[idx].MemberLoginNames[loginName] = true
+			} else {
+				delete(db.Groups[idx].MemberLoginNames, loginName)
+			}
+			return nil
+		}
+		if isMember {
+			errs.Addf("group %q does not exist", groupName)
+		}
+		return errs
+	}, opts)
+	if !errs.IsEmpty() {
+		return errors.New(errs.Join(", "))
+	}
+	return nil
+}
+
+func (m *ElevationManager) logFields(e Elevation, actor string) logging.Fields {
+	fields := logging.Fields{"elevation": e.ID, "login_name": e.LoginName, "group": e.GroupName}
+	if actor != "" {
+		fields["actor"] = actor
+	}
+	return fields
+}
+
+// Logs the given state transition, and reports it to the OnEvent callback.
+func (m *ElevationManager) report(kind ElevationEventKind, e Elevation, actor, msg string, args ...any) {
+	logging.Info(m.logFields(e, actor), msg, args...)
+	if m.OnEvent == nil {
+		return
+	}
+
+	isRecipient := map[string]bool{e.LoginName: true, e.RequestedBy: true}
+	if group, exists := m.nexus.FindGroup(func(g Group) bool { return g.Name == e.GroupName }); exists && group.Elevation != nil {
+		approvers, _ := m.nexus.FindGroup(func(g Group) bool { return g.Name == group.Elevation.ApproverGroupName })
+		for loginName, isMember := range approvers.MemberLoginNames {
+			isRecipient[loginName] = isRecipient[loginName] || isMember
+		}
+		//owners are the contacts for people who want to join the group, so they
+		//hear about new requests, but not about how each request plays out
+		if kind == ElevationRequested {
+			for _, loginName := range group.Owners {
+				isRecipient[loginName] = true
+			}
+		}
+	}
+	//ApprovedBy is included for when the approver group changed in the meantime
+	for _, loginName := range e.ApprovedBy {
+		isRecipient[loginName] = true
+	}
+
+	event := ElevationEvent{Kind: kind, Elevation: e, Actor: actor}
+	for _, user := range m.nexus.ListUsers() {
+		if isRecipient[user.LoginName] {
+			event.Recipients = append(event.Recipients, user)
+		}
+	}
+	m.OnEvent(event)
+}
+
+func findElevation(elevations []Elevation, id string) int {
+	for idx, e := range elevations {
+		if e.ID == id {
+			return idx
+		}
+	}
+	return -1
+}
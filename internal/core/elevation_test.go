@@ -0,0 +1,292 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/must"
+)
+
+// An ElevationStore that only lives in memory. The actual implementation is
+// in package store, which we cannot import here.
+type memoryElevationStore struct {
+	mutex      sync.Mutex
+	elevations []Elevation
+}
+
+func (s *memoryElevationStore) ListElevations() []Elevation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Elevation(nil), s.elevations...)
+}
+
+func (s *memoryElevationStore) UpdateElevations(action func([]Elevation) ([]Elevation, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elevations, err := action(append([]Elevation(nil), s.elevations...))
+	if err == nil {
+		s.elevations = elevations
+	}
+	return err
+}
+
+func setupElevationTest(t *testing.T) (Nexus, *ElevationManager, *[]ElevationEvent, *[]MembershipChange) {
+	t.Helper()
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "admin", GivenName: "Ad", FamilyName: "Min"},
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Approver"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Approver"},
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+		}
+		db.Groups = []Group{
+			{
+				Name:             "admins",
+				LongName:         "Admins",
+				MemberLoginNames: GroupMemberNames{"admin": true},
+				Permissions:      Permissions{Portunus: PortunusPermissions{IsAdmin: true}},
+				Elevation:        &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 4, RequiredApprovals: 2},
+			},
+			{
+				Name:             "approvers",
+				LongName:         "Approvers",
+				MemberLoginNames: GroupMemberNames{"alice": true, "bob": true},
+			},
+			{
+				Name:             "oncall",
+				LongName:         "On-call engineers",
+				MemberLoginNames: GroupMemberNames{},
+				Elevation:        &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 8, RequiredApprovals: 1},
+			},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	var (
+		events  []ElevationEvent
+		changes []MembershipChange
+	)
+	nexus.AddActivityListener(context.Background(), func(c []MembershipChange) {
+		changes = append(changes, c...)
+	})
+	m := NewElevationManager(nexus, &memoryElevationStore{})
+	m.OnEvent = func(event ElevationEvent) {
+		events = append(events, event)
+	}
+	return nexus, m, &events, &changes
+}
+
+func findUserForTests(t *testing.T, nexus Nexus, loginName string) UserWithPerms {
+	t.Helper()
+	user, exists := nexus.FindUser(func(u User) bool { return u.LoginName == loginName })
+	if !exists {
+		t.Fatalf("user %q does not exist", loginName)
+	}
+	return user
+}
+
+func isMemberForTests(nexus Nexus, loginName, groupName string) bool {
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == groupName })
+	return group.MemberLoginNames[loginName]
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected error %q, but got no error", expected)
+	} else {
+		assert.DeepEqual(t, "error message", err.Error(), expected)
+	}
+}
+
+func TestElevationLifecycle(t *testing.T) {
+	nexus, m, events, changes := setupElevationTest(t)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	jane := findUserForTests(t, nexus, "jane")
+	alice := findUserForTests(t, nexus, "alice")
+
+	//requests are checked against the policy
+	_, err := m.Request(jane, "jane", "oncall", 9, "incident #42")
+	expectError(t, err, "duration must be between 1 and 8 hour(s)")
+	_, err = m.Request(jane, "jane", "oncall", 8, "  ")
+	expectError(t, err, "justification must not be empty")
+	_, err = m.Request(jane, "jane", "approvers", 1, "incident #42")
+	expectError(t, err, `group "approvers" does not allow temporary elevation`)
+	_, err = m.Request(jane, "alice", "oncall", 1, "incident #42")
+	expectError(t, err, "only admins can request elevation on behalf of other users")
+
+	e := must.Return(m.Request(jane, "jane", "oncall", 8, "incident #42"))
+	assert.DeepEqual(t, "state after request", e.State, ElevationPending)
+	assert.DeepEqual(t, "event kind after request", (*events)[0].Kind, ElevationRequested)
+	assert.DeepEqual(t, "recipients after request", loginNamesOf((*events)[0].Recipients), []string{"alice", "bob", "jane"})
+	_, err = m.Request(jane, "jane", "oncall", 1, "incident #43")
+	expectError(t, err, `user "jane" already has a pending elevation into group "oncall"`)
+
+	//users cannot approve their own requests
+	assert.DeepEqual(t, "jane can approve", m.CanApprove(jane, e), false)
+	_, err = m.Approve(jane, e.ID)
+	expectError(t, err, "you cannot approve this request")
+	assert.DeepEqual(t, "jane is member before approval", isMemberForTests(nexus, "jane", "oncall"), false)
+
+	//one approval is enough for this group
+	now = now.Add(10 * time.Minute)
+	e = must.Return(m.Approve(alice, e.ID))
+	assert.DeepEqual(t, "state after approval", e.State, ElevationActive)
+	assert.DeepEqual(t, "expiry after approval", e.ExpiresAt, now.Add(8*time.Hour))
+	assert.DeepEqual(t, "jane is member after approval", isMemberForTests(nexus, "jane", "oncall"), true)
+	assert.DeepEqual(t, "event kind after approval", (*events)[1].Kind, ElevationApproved)
+	assert.DeepEqual(t, "membership change after approval", (*changes)[0].Actor, "alice")
+	assert.DeepEqual(t, "membership change after approval", (*changes)[0].Reason, "temporary elevation until 2024-01-02 11:14 UTC")
+
+	//extensions need to be approved again
+	extension := must.Return(m.Extend(jane, e.ID, 2, "incident #42 is still going on"))
+	assert.DeepEqual(t, "state of extension", extension.State, ElevationPending)
+	_, err = m.Extend(jane, e.ID, 2, "really")
+	expectError(t, err, "an extension of this elevation is already waiting for approval")
+	now = now.Add(time.Hour)
+	extension = must.Return(m.Approve(alice, extension.ID))
+	assert.DeepEqual(t, "state of extension after approval", extension.State, ElevationActive)
+	assert.DeepEqual(t, "expiry after extension", extension.ExpiresAt, e.ExpiresAt.Add(2*time.Hour))
+	extended, _ := m.Find(e.ID)
+	assert.DeepEqual(t, "state of extended elevation", extended.State, ElevationEnded)
+	assert.DeepEqual(t, "end reason of extended elevation", extended.EndReason, "extended by "+extension.ID)
+	assert.DeepEqual(t, "number of active elevations", len(m.List()), 1)
+
+	//another extension request is not decided on before the elevation expires,
+	//e.g. because all approvers are out of office
+	secondExtension := must.Return(m.Extend(jane, extension.ID, 8, "incident #42 is still going on"))
+	now = now.Add(8 * time.Hour)
+	m.Sweep()
+	assert.DeepEqual(t, "jane is member before expiry", isMemberForTests(nexus, "jane", "oncall"), true)
+	now = now.Add(2 * time.Hour)
+	m.Sweep()
+	assert.DeepEqual(t, "jane is member after expiry", isMemberForTests(nexus, "jane", "oncall"), false)
+	extension, _ = m.Find(extension.ID)
+	assert.DeepEqual(t, "end reason after expiry", extension.EndReason, "expired")
+	secondExtension, _ = m.Find(secondExtension.ID)
+	assert.DeepEqual(t, "end reason of unapproved extension", secondExtension.EndReason, "elevation ended before the extension was approved")
+	assert.DeepEqual(t, "number of active elevations", len(m.List()), 0)
+
+	//the expiry is recorded without an actor, but with a reason
+	lastChange := (*changes)[len(*changes)-1]
+	assert.DeepEqual(t, "membership change after expiry", lastChange.Kind, MemberRemoved)
+	assert.DeepEqual(t, "membership change after expiry", lastChange.Actor, "")
+	assert.DeepEqual(t, "membership change after expiry", lastChange.Reason, "temporary elevation expired")
+
+	var kinds []ElevationEventKind
+	for _, event := range *events {
+		kinds = append(kinds, event.Kind)
+	}
+	assert.DeepEqual(t, "event kinds", kinds, []ElevationEventKind{
+		ElevationRequested, ElevationApproved, //initial request
+		ElevationRequested, ElevationApproved, //first extension
+		ElevationRequested,                  //second extension
+		ElevationCompleted, ElevationDenied, //expiry
+	})
+
+	//the approval of a late approver does not revive anything
+	_, err = m.Approve(alice, secondExtension.ID)
+	expectError(t, err, "you cannot approve this request")
+}
+
+func TestElevationIntoAdminGroup(t *testing.T) {
+	nexus, m, _, _ := setupElevationTest(t)
+	admin := findUserForTests(t, nexus, "admin")
+	alice := findUserForTests(t, nexus, "alice")
+	bob := findUserForTests(t, nexus, "bob")
+
+	//admin access requires two distinct approvers
+	e := must.Return(m.Request(admin, "jane", "admins", 1, "audit"))
+	e = must.Return(m.Approve(alice, e.ID))
+	assert.DeepEqual(t, "state after first approval", e.State, ElevationPending)
+	_, err := m.Approve(alice, e.ID)
+	expectError(t, err, "you have already approved this request")
+	e = must.Return(m.Approve(bob, e.ID))
+	assert.DeepEqual(t, "state after second approval", e.State, ElevationActive)
+	assert.DeepEqual(t, "jane is admin", findUserForTests(t, nexus, "jane").Perms.Portunus.IsAdmin, true)
+
+	//revocation removes the membership right away
+	e = must.Return(m.Revoke(admin, e.ID))
+	assert.DeepEqual(t, "end reason after revocation", e.EndReason, "revoked by admin")
+	assert.DeepEqual(t, "jane is admin", findUserForTests(t, nexus, "jane").Perms.Portunus.IsAdmin, false)
+
+	//groups granting admin access cannot allow elevation with a single approval
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].Elevation.RequiredApprovals = 1
+		return nil
+	}, nil)
+	assert.DeepEqual(t, "validation errors", errs.Join("; "),
+		`field "elevation_required_approvals" in group "admins" must be at least 2 for groups that grant admin access to Portunus`)
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[2].Elevation.ApproverGroupName = "unknown"
+		db.Groups[2].Permissions.Portunus.IsAdmin = true
+		return nil
+	}, nil)
+	assert.DeepEqual(t, "validation errors", errs.Join("; "),
+		`field "elevation_required_approvals" in group "oncall" must be at least 2 for groups that grant admin access to Portunus; field "elevation_approver_group" in group "oncall" refers to unknown group "unknown"`)
+}
+
+func loginNamesOf(users []User) []string {
+	result := make([]string, len(users))
+	for idx, user := range users {
+		result[idx] = user.LoginName
+	}
+	return result
+}
+
+func TestEndElevationsOfUser(t *testing.T) {
+	nexus, m, events, _ := setupElevationTest(t)
+	admin := findUserForTests(t, nexus, "admin")
+	alice := findUserForTests(t, nexus, "alice")
+	jane := findUserForTests(t, nexus, "jane")
+
+	active := must.Return(m.Request(jane, "jane", "oncall", 8, "incident #42"))
+	must.Return(m.Approve(alice, active.ID))
+	pending := must.Return(m.Request(jane, "jane", "admins", 1, "incident #42"))
+	other := must.Return(m.Request(alice, "alice", "oncall", 1, "incident #42"))
+	*events = nil
+
+	count := must.Return(m.EndElevationsOfUser(admin.LoginName, "jane"))
+	assert.DeepEqual(t, "number of ended elevations", count, 2)
+	assert.DeepEqual(t, "jane is member after offboarding", isMemberForTests(nexus, "jane", "oncall"), false)
+	active, _ = m.Find(active.ID)
+	assert.DeepEqual(t, "end reason of active elevation", active.EndReason, "revoked by admin during offboarding")
+	pending, _ = m.Find(pending.ID)
+	assert.DeepEqual(t, "end reason of pending request", pending.EndReason, "withdrawn by admin during offboarding")
+	assert.DeepEqual(t, "event kinds", []ElevationEventKind{(*events)[0].Kind, (*events)[1].Kind}, []ElevationEventKind{ElevationCompleted, ElevationDenied})
+
+	//elevations of other users are not affected
+	other, _ = m.Find(other.ID)
+	assert.DeepEqual(t, "state of other request", other.State, ElevationPending)
+}
+
+func TestElevationNotifiesGroupOwners(t *testing.T) {
+	nexus, m, events, _ := setupElevationTest(t)
+	alice := findUserForTests(t, nexus, "alice")
+	jane := findUserForTests(t, nexus, "jane")
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[2].Owners = []string{"admin"}
+		return nil
+	}, nil))
+
+	//owners are notified about new requests...
+	e := must.Return(m.Request(jane, "jane", "oncall", 8, "incident #42"))
+	assert.DeepEqual(t, "recipients after request", loginNamesOf((*events)[0].Recipients), []string{"admin", "alice", "bob", "jane"})
+
+	//...but not about their outcome
+	must.Return(m.Approve(alice, e.ID))
+	assert.DeepEqual(t, "recipients after approval", loginNamesOf((*events)[1].Recipients), []string{"alice", "bob", "jane"})
+}
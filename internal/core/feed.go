@@ -0,0 +1,546 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// The LDAP attribute (in User.ExtraAttributes) that stores the match key from
+// the feed, i.e. the ID of the user in the HR system.
+const feedMatchKeyAttribute = "employeeNumber"
+
+// How many rows of the feed are applied in a single Nexus.Update().
+const feedBatchSize = 50
+
+// How many sync reports are retained in the FeedSyncStore.
+const feedReportRetention = 20
+
+// FeedConfig describes a CSV feed of user records (e.g. published by an HR
+// system) that FeedSync imports periodically.
+type FeedConfig struct {
+	URL string
+	//If not empty, sent as the Authorization header, e.g. "Bearer s3cr3t".
+	Authorization string
+	Interval      time.Duration
+	Timeout       time.Duration
+	MaxSize       int64 //in bytes
+	Mapping       FeedMapping
+	//If true, the changes are validated and reported, but not applied.
+	DryRun bool
+}
+
+// FeedMapping describes how the columns of the feed map to user fields. It
+// is read from the file referenced by PORTUNUS_SERVER_FEED_MAPPING.
+type FeedMapping struct {
+	//The column that identifies each user. Its value is stored in the
+	//employeeNumber attribute, so that users can be recognized even when other
+	//columns (including the login name) change.
+	MatchKey string `json:"match_key"`
+	//Maps user fields ("login_name", "given_name", "family_name", "email") to
+	//column names. The login name is only used for creating new users.
+	Columns map[string]string `json:"columns"`
+}
+
+var feedMappableFields = []string{"login_name", "given_name", "family_name", "email"}
+
+// ReadFeedConfigFromEnvironment reads the FeedConfig from the environment. If
+// no feed is configured (i.e. PORTUNUS_SERVER_FEED_URL is not set), nil is
+// returned.
+func ReadFeedConfigFromEnvironment() (*FeedConfig, error) {
+	feedURL := os.Getenv("PORTUNUS_SERVER_FEED_URL")
+	if feedURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("malformed value for PORTUNUS_SERVER_FEED_URL: %q (expected an URL like \"https://hr.example.org/export.csv\")", feedURL)
+	}
+	cfg := FeedConfig{
+		URL:           feedURL,
+		Authorization: os.Getenv("PORTUNUS_SERVER_FEED_AUTHORIZATION"),
+		DryRun:        os.Getenv("PORTUNUS_SERVER_FEED_DRY_RUN") == "true",
+	}
+	cfg.Interval, err = time.ParseDuration(osext.GetenvOrDefault("PORTUNUS_SERVER_FEED_INTERVAL", "24h"))
+	if err != nil || cfg.Interval <= 0 {
+		return nil, errors.New("malformed value for PORTUNUS_SERVER_FEED_INTERVAL (expected a positive duration like \"24h\")")
+	}
+	cfg.Timeout, err = time.ParseDuration(osext.GetenvOrDefault("PORTUNUS_SERVER_FEED_TIMEOUT", "1m"))
+	if err != nil || cfg.Timeout <= 0 {
+		return nil, errors.New("malformed value for PORTUNUS_SERVER_FEED_TIMEOUT (expected a positive duration like \"1m\")")
+	}
+	cfg.MaxSize, err = strconv.ParseInt(osext.GetenvOrDefault("PORTUNUS_SERVER_FEED_MAX_SIZE", "10485760"), 10, 64)
+	if err != nil || cfg.MaxSize <= 0 {
+		return nil, errors.New("malformed value for PORTUNUS_SERVER_FEED_MAX_SIZE (expected a positive integer)")
+	}
+
+	mappingPath := os.Getenv("PORTUNUS_SERVER_FEED_MAPPING")
+	if mappingPath == "" {
+		return nil, errors.New("PORTUNUS_SERVER_FEED_MAPPING must be set when PORTUNUS_SERVER_FEED_URL is set")
+	}
+	buf, err := os.ReadFile(mappingPath)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg.Mapping)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", mappingPath, err)
+	}
+	err = cfg.Mapping.validate()
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", mappingPath, err)
+	}
+	return &cfg, nil
+}
+
+func (m FeedMapping) validate() error {
+	if m.MatchKey == "" {
+		return errors.New("match_key is missing")
+	}
+	for field := range m.Columns {
+		isKnown := false
+		for _, f := range feedMappableFields {
+			isKnown = isKnown || f == field
+		}
+		if !isKnown {
+			return fmt.Errorf("cannot map column to unknown field %q (known fields are %s)", field, strings.Join(feedMappableFields, ", "))
+		}
+	}
+	for _, field := range []string{"login_name", "given_name", "family_name"} {
+		if m.Columns[field] == "" {
+			return fmt.Errorf("columns.%s is missing", field)
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// reports and persisted state
+
+// FeedSyncReport describes a single run of FeedSync.
+type FeedSyncReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DryRun     bool      `json:"dry_run,omitempty"`
+	//If true, the feed was not processed because it did not change since the
+	//last run.
+	Unchanged bool `json:"unchanged,omitempty"`
+	//If not empty, the feed could not be processed at all.
+	Error string `json:"error,omitempty"`
+	//Login names of the users that were created or updated.
+	Created []string `json:"created,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+	//Rows that could not be applied.
+	RowErrors []FeedRowError `json:"row_errors,omitempty"`
+	//Login names of the users that have a match key, but do not appear in the
+	//feed anymore. These users are never deleted by FeedSync; an admin needs to
+	//offboard them.
+	Departures []string `json:"departures,omitempty"`
+}
+
+// FeedRowError appears in type FeedSyncReport.
+type FeedRowError struct {
+	Line     int    `json:"line"`
+	MatchKey string `json:"match_key,omitempty"`
+	Message  string `json:"message"`
+}
+
+// FeedSyncState is persisted by a FeedSyncStore.
+type FeedSyncState struct {
+	Paused bool `json:"paused,omitempty"`
+	//The ETag and checksum of the last feed that was processed, to skip
+	//processing when the feed did not change.
+	ETag     string `json:"etag,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	//The most recent reports, most recent first.
+	Reports []FeedSyncReport `json:"reports,omitempty"`
+}
+
+// FeedSyncStore persists the FeedSyncState.
+type FeedSyncStore interface {
+	// LoadFeedSyncState returns the stored state.
+	LoadFeedSyncState() FeedSyncState
+	// SaveFeedSyncState replaces the stored state.
+	SaveFeedSyncState(FeedSyncState) error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type FeedSync
+
+// FeedSync periodically fetches a CSV feed of user records and applies it to
+// the Nexus. Users are created or updated, but never deleted.
+type FeedSync struct {
+	cfg    FeedConfig
+	nexus  Nexus
+	store  FeedSyncStore
+	client *http.Client //can be swapped in tests
+	//Ensures that runs do not overlap, and guards the read-modify-write cycles
+	//on the store.
+	mutex sync.Mutex
+}
+
+// NewFeedSync initializes a FeedSync.
+func NewFeedSync(cfg FeedConfig, nexus Nexus, store FeedSyncStore) *FeedSync {
+	return &FeedSync{cfg: cfg, nexus: nexus, store: store, client: http.DefaultClient}
+}
+
+// Config returns the FeedConfig of this FeedSync.
+func (s *FeedSync) Config() FeedConfig {
+	return s.cfg
+}
+
+// State returns the persisted state, including the recent reports.
+func (s *FeedSync) State() FeedSyncState {
+	return s.store.LoadFeedSyncState()
+}
+
+// SetPaused pauses or resumes the sync. While paused, the feed is not fetched.
+func (s *FeedSync) SetPaused(paused bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.store.LoadFeedSyncState()
+	state.Paused = paused
+	return s.store.SaveFeedSyncState(state)
+}
+
+// Run syncs the feed once per FeedConfig.Interval until `ctx` expires.
+func (s *FeedSync) Run(ctx context.Context) {
+	//wait for the database to be loaded, otherwise all users in the feed would
+	//look like they need to be created
+	isLoaded := make(chan struct{})
+	var once sync.Once
+	s.nexus.AddListener(ctx, func(Database) {
+		once.Do(func() { close(isLoaded) })
+	})
+	select {
+	case <-ctx.Done():
+		return
+	case <-isLoaded:
+	}
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		s.Sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync fetches and applies the feed once, unless the sync is paused. The
+// report is persisted and returned. If the sync is paused, nil is returned.
+func (s *FeedSync) Sync(ctx context.Context) *FeedSyncReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.store.LoadFeedSyncState()
+	if state.Paused {
+		logging.Info(logging.Fields{"event": "feed_sync"}, "skipping feed sync because it is paused")
+		return nil
+	}
+
+	report := FeedSyncReport{StartedAt: time.Now(), DryRun: s.cfg.DryRun}
+	etag, checksum, err := s.syncOnce(ctx, state, &report)
+	if err != nil {
+		report.Error = err.Error()
+	} else if !s.cfg.DryRun && !report.Unchanged {
+		state.ETag = etag
+		state.Checksum = checksum
+	}
+	report.FinishedAt = time.Now()
+	s.logReport(report)
+
+	state.Reports = append([]FeedSyncReport{report}, state.Reports...)
+	if len(state.Reports) > feedReportRetention {
+		state.Reports = state.Reports[:feedReportRetention]
+	}
+	err = s.store.SaveFeedSyncState(state)
+	if err != nil {
+		logging.Error(logging.Fields{"event": "feed_sync"}, "cannot persist feed sync report: %s", err.Error())
+	}
+	return &report
+}
+
+func (s *FeedSync) logReport(r FeedSyncReport) {
+	fields := logging.Fields{"event": "feed_sync"}
+	switch {
+	case r.Error != "":
+		logging.Error(fields, "feed sync failed: %s", r.Error)
+	case r.Unchanged:
+		logging.Info(fields, "feed sync skipped because the feed did not change")
+	default:
+		if r.DryRun {
+			fields["dry_run"] = "true"
+		}
+		logging.Info(fields, "feed sync finished: %d users created, %d users updated, %d rows rejected, %d departures",
+			len(r.Created), len(r.Updated), len(r.RowErrors), len(r.Departures))
+	}
+}
+
+// Returns the ETag and checksum of the feed that was processed.
+func (s *FeedSync) syncOnce(ctx context.Context, state FeedSyncState, report *FeedSyncReport) (etag, checksum string, err error) {
+	body, etag, err := s.fetch(ctx, state.ETag)
+	if err != nil {
+		return "", "", err
+	}
+	if body == nil {
+		report.Unchanged = true
+		return "", "", nil
+	}
+	hash := sha256.Sum256(body)
+	checksum = hex.EncodeToString(hash[:])
+	if checksum == state.Checksum {
+		report.Unchanged = true
+		return "", "", nil
+	}
+
+	rows, err := s.parse(body, report)
+	if err != nil {
+		return "", "", err
+	}
+	s.apply(rows, report)
+	return etag, checksum, nil
+}
+
+// Returns a nil body if the server reports that the feed did not change.
+func (s *FeedSync) fetch(ctx context.Context, lastETag string) (body []byte, etag string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.URL, http.NoBody)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.cfg.Authorization != "" {
+		req.Header.Set("Authorization", s.cfg.Authorization)
+	}
+	if lastETag != "" {
+		req.Header.Set("If-None-Match", lastETag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("GET %s returned %s", s.cfg.URL, resp.Status)
+	}
+
+	body, err = io.ReadAll(io.LimitReader(resp.Body, s.cfg.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > s.cfg.MaxSize {
+		return nil, "", fmt.Errorf("feed is larger than %d bytes", s.cfg.MaxSize)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// feedRow is a single row of the feed that passed parsing.
+type feedRow struct {
+	Line   int
+	Key    string
+	Fields map[string]string //keyed by user field name
+}
+
+// Parses the feed. Malformed rows are reported in the report. An error is only
+// returned if the feed cannot be processed at all.
+func (s *FeedSync) parse(body []byte, report *FeedSyncReport) ([]feedRow, error) {
+	body = bytes.TrimPrefix(body, []byte("\xEF\xBB\xBF")) //UTF-8 byte order mark, as written by spreadsheet programs
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header row of feed: %w", err)
+	}
+	columnIndex := make(map[string]int, len(header))
+	for idx, name := range header {
+		columnIndex[strings.TrimSpace(name)] = idx
+	}
+	requiredColumns := []string{s.cfg.Mapping.MatchKey}
+	for _, field := range feedMappableFields {
+		if column := s.cfg.Mapping.Columns[field]; column != "" {
+			requiredColumns = append(requiredColumns, column)
+		}
+	}
+	for _, column := range requiredColumns {
+		if _, exists := columnIndex[column]; !exists {
+			return nil, fmt.Errorf("feed does not have a column named %q", column)
+		}
+	}
+
+	var rows []feedRow
+	lineOfKey := make(map[string]int)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return nil, err
+			}
+			report.RowErrors = append(report.RowErrors, FeedRowError{Line: perr.StartLine, Message: perr.Err.Error()})
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) != len(header) {
+			msg := fmt.Sprintf("expected %d fields, but found %d", len(header), len(record))
+			report.RowErrors = append(report.RowErrors, FeedRowError{Line: line, Message: msg})
+			continue
+		}
+
+		row := feedRow{
+			Line:   line,
+			Key:    strings.TrimSpace(record[columnIndex[s.cfg.Mapping.MatchKey]]),
+			Fields: make(map[string]string),
+		}
+		for field, column := range s.cfg.Mapping.Columns {
+			row.Fields[field] = strings.TrimSpace(record[columnIndex[column]])
+		}
+		switch {
+		case row.Key == "":
+			report.RowErrors = append(report.RowErrors, FeedRowError{Line: line, Message: fmt.Sprintf("column %q is empty", s.cfg.Mapping.MatchKey)})
+		case lineOfKey[row.Key] != 0:
+			msg := fmt.Sprintf("duplicate value in column %q (also on line %d)", s.cfg.Mapping.MatchKey, lineOfKey[row.Key])
+			report.RowErrors = append(report.RowErrors, FeedRowError{Line: line, MatchKey: row.Key, Message: msg})
+		default:
+			lineOfKey[row.Key] = line
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// Applies the given rows in batches. If a batch fails validation, its rows are
+// applied one by one to find out which of them are broken.
+func (s *FeedSync) apply(rows []feedRow, report *FeedSyncReport) {
+	for start := 0; start < len(rows); start += feedBatchSize {
+		end := start + feedBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+
+		created, updated, errs := s.applyBatch(batch)
+		if errs.IsEmpty() {
+			report.Created = append(report.Created, created...)
+			report.Updated = append(report.Updated, updated...)
+			continue
+		}
+		for _, row := range batch {
+			created, updated, errs := s.applyBatch([]feedRow{row})
+			if errs.IsEmpty() {
+				report.Created = append(report.Created, created...)
+				report.Updated = append(report.Updated, updated...)
+			} else {
+				report.RowErrors = append(report.RowErrors, FeedRowError{Line: row.Line, MatchKey: row.Key, Message: errs.Join(", ")})
+			}
+		}
+	}
+	sort.Slice(report.RowErrors, func(i, j int) bool {
+		return report.RowErrors[i].Line < report.RowErrors[j].Line
+	})
+
+	//users that have disappeared from the feed are only reported, never deleted
+	isInFeed := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		isInFeed[row.Key] = true
+	}
+	for _, user := range s.nexus.ListUsers() {
+		keys := user.ExtraAttributes[feedMatchKeyAttribute]
+		if len(keys) > 0 && !isInFeed[keys[0]] && !user.IsExpiredAt(report.StartedAt) {
+			report.Departures = append(report.Departures, user.LoginName)
+		}
+	}
+	sort.Strings(report.Departures)
+}
+
+func (s *FeedSync) applyBatch(batch []feedRow) (created, updated []string, errs errext.ErrorSet) {
+	opts := UpdateOptions{
+		ConflictWithSeedIsError: true,
+		DryRun:                  s.cfg.DryRun,
+		Reason:                  "imported from HR feed",
+	}
+	errs = s.nexus.Update(func(db *Database) errext.ErrorSet {
+		created, updated = nil, nil
+		for _, row := range batch {
+			idx := db.findUserByFeedKey(row.Key)
+			if idx == -1 {
+				user := User{
+					LoginName:       row.Fields["login_name"],
+					ExtraAttributes: map[string][]string{feedMatchKeyAttribute: {row.Key}},
+				}
+				applyFeedRow(&user, row)
+				db.Users = append(db.Users, user)
+				created = append(created, user.LoginName)
+			} else if applyFeedRow(&db.Users[idx], row) {
+				updated = append(updated, db.Users[idx].LoginName)
+			}
+		}
+		return nil
+	}, &opts)
+	return created, updated, errs
+}
+
+// Returns the index of the user with the given match key, or -1.
+func (d Database) findUserByFeedKey(key string) int {
+	for idx, user := range d.Users {
+		keys := user.ExtraAttributes[feedMatchKeyAttribute]
+		if len(keys) > 0 && keys[0] == key {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Applies the mapped fields of the row (except for the login name) to the
+// given user. Returns whether anything changed.
+func applyFeedRow(user *User, row feedRow) (changed bool) {
+	apply := func(field string, target *string) {
+		value, exists := row.Fields[field]
+		if exists && *target != value {
+			*target = value
+			changed = true
+		}
+	}
+	apply("given_name", &user.GivenName)
+	apply("family_name", &user.FamilyName)
+	apply("email", &user.EMailAddress)
+	return changed
+}
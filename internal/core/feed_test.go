@@ -0,0 +1,171 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// A FeedSyncStore that only lives in memory. The actual implementation is
+// in the store package.
+type memoryFeedSyncStore struct {
+	state FeedSyncState
+}
+
+func (s *memoryFeedSyncStore) LoadFeedSyncState() FeedSyncState {
+	return s.state
+}
+
+func (s *memoryFeedSyncStore) SaveFeedSyncState(state FeedSyncState) error {
+	s.state = state
+	return nil
+}
+
+// A feed server that serves the given content with the given ETag.
+type feedServerDouble struct {
+	Content  string
+	ETag     string
+	Requests int
+}
+
+func (f *feedServerDouble) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Requests++
+	if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if f.ETag != "" {
+		w.Header().Set("ETag", f.ETag)
+		if r.Header.Get("If-None-Match") == f.ETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	_, _ = w.Write([]byte(f.Content))
+}
+
+func TestFeedSync(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{{LoginName: "admin", GivenName: "Admin", FamilyName: "User"}}
+		return nil
+	}, nil))
+
+	feed := &feedServerDouble{ETag: `"v1"`, Content: "\xEF\xBB\xBFEmployee ID,Username,First Name,Last Name\n" +
+		"E1,jane,Jane,Doe\n" +
+		"E2,john,John,Doe\n" +
+		",nokey,No,Key\n" +
+		"E3,bob$,Bob,Builder\n" +
+		"E4,short\n" +
+		"E5,\"broken,Broken,Row\n",
+	}
+	srv := httptest.NewTLSServer(feed)
+	defer srv.Close()
+
+	cfg := FeedConfig{
+		URL:           srv.URL + "/export.csv",
+		Authorization: "Bearer s3cr3t",
+		Interval:      24 * time.Hour,
+		Timeout:       time.Minute,
+		MaxSize:       1 << 20,
+		Mapping: FeedMapping{
+			MatchKey: "Employee ID",
+			Columns: map[string]string{
+				"login_name":  "Username",
+				"given_name":  "First Name",
+				"family_name": "Last Name",
+			},
+		},
+	}
+	store := &memoryFeedSyncStore{}
+	fs := NewFeedSync(cfg, nexus, store)
+	fs.client = srv.Client()
+	ctx := context.Background()
+	listLoginNames := func() (result []string) {
+		for _, u := range nexus.ListUsers() {
+			result = append(result, u.LoginName)
+		}
+		return result
+	}
+
+	//first run: valid rows are applied even though other rows are broken
+	report := fs.Sync(ctx)
+	assert.DeepEqual(t, "error in first run", report.Error, "")
+	assert.DeepEqual(t, "created users in first run", report.Created, []string{"jane", "john"})
+	assert.DeepEqual(t, "updated users in first run", report.Updated, []string(nil))
+	assert.DeepEqual(t, "row errors in first run", report.RowErrors, []FeedRowError{
+		{Line: 4, Message: `column "Employee ID" is empty`},
+		{Line: 5, MatchKey: "E3", Message: `field "login_name" in user "bob$" ` + errMalformedUserLoginName.Error()},
+		{Line: 6, Message: "expected 4 fields, but found 2"},
+		{Line: 7, Message: `extraneous or missing " in quoted-field`},
+	})
+	assert.DeepEqual(t, "users after first run", listLoginNames(), []string{"admin", "jane", "john"})
+	jane, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "match key of jane", jane.ExtraAttributes, map[string][]string{"employeeNumber": {"E1"}})
+
+	//second run: the server reports that nothing changed
+	report = fs.Sync(ctx)
+	assert.DeepEqual(t, "second run is skipped", report.Unchanged, true)
+
+	//third run: john has left the company, but is only reported, not deleted
+	feed.ETag = `"v2"`
+	feed.Content = "Employee ID,Username,First Name,Last Name\nE1,jane,Jane,Smith\n"
+	report = fs.Sync(ctx)
+	assert.DeepEqual(t, "created users in third run", report.Created, []string(nil))
+	assert.DeepEqual(t, "updated users in third run", report.Updated, []string{"jane"})
+	assert.DeepEqual(t, "departures in third run", report.Departures, []string{"john"})
+	assert.DeepEqual(t, "users after third run", listLoginNames(), []string{"admin", "jane", "john"})
+	jane, _ = nexus.FindUser(func(u User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "family name of jane", jane.FamilyName, "Smith")
+
+	//fourth run: the ETag changed, but the content did not
+	feed.ETag = `"v3"`
+	report = fs.Sync(ctx)
+	assert.DeepEqual(t, "fourth run is skipped", report.Unchanged, true)
+
+	//while paused, the feed is not even fetched
+	requestsBefore := feed.Requests
+	err := fs.SetPaused(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "report while paused", fs.Sync(ctx), (*FeedSyncReport)(nil))
+	assert.DeepEqual(t, "requests while paused", feed.Requests, requestsBefore)
+	err = fs.SetPaused(false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//in dry-run mode, changes are only reported
+	feed.Content = "Employee ID,Username,First Name,Last Name\nE1,jane,Jane,Smith\nE6,eve,Eve,Example\n"
+	cfg.DryRun = true
+	dryRunSync := NewFeedSync(cfg, nexus, store)
+	dryRunSync.client = srv.Client()
+	report = dryRunSync.Sync(ctx)
+	assert.DeepEqual(t, "created users in dry run", report.Created, []string{"eve"})
+	assert.DeepEqual(t, "users after dry run", listLoginNames(), []string{"admin", "jane", "john"})
+
+	//the reports are persisted, most recent first
+	reports := store.state.Reports
+	assert.DeepEqual(t, "number of reports", len(reports), 5)
+	assert.DeepEqual(t, "most recent report is dry run", reports[0].DryRun, true)
+
+	//a wrong Authorization header yields a fatal error
+	cfg.Authorization = "Bearer wrong"
+	failingSync := NewFeedSync(cfg, nexus, store)
+	failingSync.client = srv.Client()
+	report = failingSync.Sync(ctx)
+	assert.DeepEqual(t, "error with wrong credentials", report.Error, "GET "+cfg.URL+" returned 401 Unauthorized")
+}
@@ -8,6 +8,7 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,11 +22,37 @@ import (
 type Group struct {
 	Name             string           `json:"name"`
 	LongName         string           `json:"long_name"`
+	Description      string           `json:"description,omitempty"`
+	URL              string           `json:"url,omitempty"` //e.g. for documentation about this group
 	MemberLoginNames GroupMemberNames `json:"members"`
 	Permissions      Permissions      `json:"permissions"`
 	PosixGID         *PosixID         `json:"posix_gid,omitempty"`
+	//If set, this group does not appear in the isMemberOf attribute of its
+	//members in LDAP. The group object itself still lists all members.
+	HideFromMemberOf bool `json:"hide_from_member_of,omitempty"`
+	//If set, users can request temporary membership in this group.
+	Elevation *ElevationPolicy `json:"elevation,omitempty"`
+	//Login names of the users that are named as contacts for this group, e.g.
+	//for users who want to become members. Owners do not need to be members,
+	//and being an owner does not grant any permissions.
+	Owners []string `json:"owners,omitempty"`
 }
 
+// ElevationPolicy appears in type Group. It describes under which conditions
+// users can temporarily become members of the group.
+type ElevationPolicy struct {
+	//The members of this group decide on elevation requests.
+	ApproverGroupName string `json:"approver_group"`
+	//The longest duration for which membership can be granted at once.
+	MaxHours uint `json:"max_hours"`
+	//How many different approvers need to approve each request.
+	RequiredApprovals uint `json:"required_approvals"`
+}
+
+// Elevation into groups granting admin access to Portunus requires at least
+// this many approvals, so that a single approver cannot hand out admin access.
+const minApprovalsForAdminElevation = 2
+
 // Key implements the Object interface.
 func (g Group) Key() string {
 	return g.Name
@@ -40,10 +67,17 @@ func (g Group) Cloned() Group {
 			g.MemberLoginNames[name] = true
 		}
 	}
+	if g.Owners != nil {
+		g.Owners = append([]string(nil), g.Owners...)
+	}
 	if g.PosixGID != nil {
 		val := *g.PosixGID
 		g.PosixGID = &val
 	}
+	if g.Elevation != nil {
+		val := *g.Elevation
+		g.Elevation = &val
+	}
 	return g
 }
 
@@ -52,6 +86,17 @@ func (g Group) ContainsUser(u User) bool {
 	return g.MemberLoginNames[u.LoginName]
 }
 
+// IsOwnedBy checks whether the user with the given login name is an owner of
+// this group.
+func (g Group) IsOwnedBy(loginName string) bool {
+	for _, owner := range g.Owners {
+		if owner == loginName {
+			return true
+		}
+	}
+	return false
+}
+
 // GroupMemberNames is the type of Group.MemberLoginNames.
 type GroupMemberNames map[string]bool
 
@@ -104,6 +149,22 @@ func (g Group) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		MustNotBeEmpty(g.LongName),
 		MustNotHaveSurroundingSpaces(g.LongName),
 	))
+	errs.Add(ref.Field("description").Wrap(MustNotHaveSurroundingSpaces(g.Description)))
+	errs.Add(ref.Field("url").Wrap(MustBeURL(g.URL)))
+	if p := g.Elevation; p != nil {
+		if p.MaxHours == 0 {
+			errs.Add(ref.Field("elevation_max_hours").Wrap(errMustBePositive))
+		}
+		if p.RequiredApprovals == 0 {
+			errs.Add(ref.Field("elevation_required_approvals").Wrap(errMustBePositive))
+		} else if g.Permissions.Portunus.IsAdmin && p.RequiredApprovals < minApprovalsForAdminElevation {
+			err := fmt.Errorf("must be at least %d for groups that grant admin access to Portunus", minApprovalsForAdminElevation)
+			errs.Add(ref.Field("elevation_required_approvals").Wrap(err))
+		}
+		if cfg.RequireOwnersForElevation && len(g.Owners) == 0 {
+			errs.Add(ref.Field("owners").Wrap(errMissingOwnersForElevation))
+		}
+	}
 	return
 }
 
@@ -129,3 +190,18 @@ func ParsePosixID(input string, ref FieldRef) (PosixID, error) {
 	}
 	return PosixID(value), nil
 }
+
+// ParseNonnegativeInteger parses a number like ElevationPolicy.MaxHours from
+// its decimal text representation. If the parse fails, a ValidationError is
+// returned, using the provided FieldRef.
+func ParseNonnegativeInteger(input string, ref FieldRef) (uint, error) {
+	input = strings.TrimSpace(input)
+	if !grammars.IsNonnegativeInteger(input) {
+		return 0, ref.Wrap(errNotDecimalNumber)
+	}
+	value, err := strconv.ParseUint(input, 10, 32)
+	if err != nil {
+		return 0, ref.Wrap(err)
+	}
+	return uint(value), nil
+}
@@ -0,0 +1,55 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// GroupTemplate is a named preset that admins can choose when creating a
+// group in the web GUI. The template fills in the permissions (and optionally
+// the beginning of the long name) in the form. Which template was used is not
+// recorded on the group, so changing a template does not affect existing
+// groups.
+//
+// Group templates are defined in the primary seed.
+type GroupTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//If not empty, the long name of the new group starts with this and a space.
+	LongNamePrefix string      `json:"long_name_prefix,omitempty"`
+	Permissions    Permissions `json:"permissions"`
+}
+
+var errGrantsNoPermissions = errors.New("must grant at least one permission")
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (t GroupTemplate) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "group template",
+		Name: t.Name,
+	}
+}
+
+// Checks the individual attributes of this GroupTemplate. Uniqueness is
+// checked in DatabaseSeed.Validate().
+func (t GroupTemplate) validateLocal() (errs errext.ErrorSet) {
+	ref := t.Ref()
+	errs.Add(ref.Field("name").WrapFirst(
+		MustNotBeEmpty(t.Name),
+		MustNotHaveSurroundingSpaces(t.Name),
+	))
+	errs.Add(ref.Field("description").Wrap(MustNotHaveSurroundingSpaces(t.Description)))
+	errs.Add(ref.Field("long_name_prefix").Wrap(MustNotHaveSurroundingSpaces(t.LongNamePrefix)))
+	if t.Permissions == (Permissions{}) {
+		//a template without permissions is no different from not choosing a template
+		errs.Add(ref.Field("permissions").Wrap(errGrantsNoPermissions))
+	}
+	return
+}
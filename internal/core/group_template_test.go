@@ -0,0 +1,51 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestGroupTemplates(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-group-templates.json", vcfg)
+	expectNoErrors(t, errs)
+
+	//group templates are available through the nexus, but are not part of the database
+	nexus := NewNexus(seed, vcfg, &NoopHasher{})
+	assert.DeepEqual(t, "group templates", nexus.GroupTemplates(), []GroupTemplate{
+		{
+			Name:           "team",
+			Description:    "Regular team with LDAP access",
+			LongNamePrefix: "Team",
+			Permissions:    Permissions{LDAP: LDAPPermissions{CanRead: true}},
+		},
+		{
+			Name:        "viewers",
+			Permissions: Permissions{Portunus: PortunusPermissions{CanView: true}},
+		},
+	})
+	assert.DeepEqual(t, "group templates without seed", NewNexus(nil, vcfg, &NoopHasher{}).GroupTemplates(), []GroupTemplate(nil))
+
+	_, errs = ReadDatabaseSeed("fixtures/seed-group-templates-invalid.json", vcfg)
+	expectTheseErrors(t, errs,
+		`field "name" in group template "" is missing`,
+		`field "name" in group template " team" may not start with a space character`,
+		`field "description" in group template " team" may not end with a space character`,
+		`field "long_name_prefix" in group template " team" may not start with a space character`,
+		`field "permissions" in group template " team" must grant at least one permission`,
+		`field "name" in group template "viewers" is defined multiple times`,
+	)
+
+	//group templates may only be declared in the primary seed
+	_, errs = ReadDatabaseSeeds([]string{"fixtures/seed-delegation-primary.json", "fixtures/seed-delegation-group-templates.json"}, vcfg)
+	expectTheseErrors(t, errs,
+		`seed file fixtures/seed-delegation-group-templates.json declares a scope, so it may not declare group templates`,
+	)
+}
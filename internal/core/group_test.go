@@ -0,0 +1,83 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestGroupOwners(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	vcfg.RequireOwnersForElevation = true
+	nexus := NewNexus(nil, vcfg, &NoopHasher{})
+	users := []User{
+		{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"},
+		{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+	}
+
+	//owners must exist, and groups that allow temporary membership must have an owner
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = users
+		db.Groups = []Group{
+			{Name: "approvers", LongName: "Approvers", Owners: []string{"alice", "carol"}},
+			{Name: "oncall", LongName: "On-call engineers", Elevation: &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 8, RequiredApprovals: 1}},
+		}
+		return nil
+	}, nil),
+		`field "owners" in group "approvers" contains unknown user with login name "carol"`,
+		`field "owners" in group "oncall" must not be empty for groups that allow temporary membership`,
+	)
+
+	//owners are normalized, and do not need to be members
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = users
+		db.Groups = []Group{
+			{Name: "approvers", LongName: "Approvers", Owners: []string{"bob", "alice", "bob"}},
+			{Name: "oncall", LongName: "On-call engineers", Owners: []string{"alice"}, Elevation: &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 8, RequiredApprovals: 1}},
+		}
+		return nil
+	}, nil))
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "approvers" })
+	assert.DeepEqual(t, "owners of approvers", group.Owners, []string{"alice", "bob"})
+
+	//a sole owner cannot be deleted while the group requires an owner...
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		assert.DeepEqual(t, "groups solely owned by alice", db.GroupsSolelyOwnedBy("alice"), []string{"oncall"})
+		assert.DeepEqual(t, "groups solely owned by bob", db.GroupsSolelyOwnedBy("bob"), []string(nil))
+		return nil
+	}, &UpdateOptions{DryRun: true}))
+	expectTheseErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteUser("alice", "bob", time.Now(), time.Hour))
+		return errs
+	}, nil),
+		`field "owners" in group "oncall" must not be empty for groups that allow temporary membership`,
+	)
+
+	//...but once there is another owner, the deletion removes alice from all owner lists
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		db.Groups[1].Owners = []string{"alice", "bob"}
+		errs.Add(db.DeleteUser("alice", "bob", time.Now(), time.Hour))
+		return errs
+	}, nil))
+	for _, group := range nexus.ListGroups() {
+		assert.DeepEqual(t, "owners of "+group.Name+" after deletion", group.Owners, []string{"bob"})
+	}
+
+	//restoring the user also restores ownership
+	tombstone := nexus.ListDeletedUsers()[0]
+	assert.DeepEqual(t, "tombstone.OwnedGroupNames", tombstone.OwnedGroupNames, []string{"approvers", "oncall"})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		return db.RestoreDeletedUser(tombstone.ID)
+	}, nil))
+	for _, group := range nexus.ListGroups() {
+		assert.DeepEqual(t, "owners of "+group.Name+" after restore", group.Owners, []string{"alice", "bob"})
+	}
+}
@@ -0,0 +1,39 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import "sync"
+
+// HealthCheck is implemented by long-running components (like the disk store
+// and LDAP adapters) whose state is reported by the readiness endpoint.
+type HealthCheck interface {
+	// CheckHealth returns nil if the component is working normally, or an error
+	// describing why it is not.
+	CheckHealth() error
+}
+
+// HealthStatus is a building block for implementing HealthCheck. It holds the
+// most recent problem reported by its owner, and can be read from any
+// goroutine. The zero value reports a healthy status.
+type HealthStatus struct {
+	mutex sync.Mutex
+	err   error
+}
+
+// Report replaces the current status. A nil error marks the component as healthy.
+func (s *HealthStatus) Report(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+// CheckHealth implements the HealthCheck interface.
+func (s *HealthStatus) CheckHealth() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
@@ -0,0 +1,48 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+)
+
+// UserInvitation appears in type User. A user with an invitation does not
+// have a password yet. Instead, they can set their own password by visiting
+// the invitation link until the invitation expires.
+type UserInvitation struct {
+	//Only the hash of the token is stored, so that a leaked database file
+	//cannot be used to take over invited accounts.
+	TokenHash string    `json:"token_hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewUserInvitation generates a random invitation token, and returns it along
+// with the UserInvitation that accepts it. The token is only returned here
+// and must be passed on to the invited user right away.
+func NewUserInvitation(now time.Time, lifetime time.Duration) (token string, invitation UserInvitation) {
+	token = hex.EncodeToString(GenerateRandomKey(32))
+	return token, UserInvitation{
+		TokenHash: hashInvitationToken(token),
+		ExpiresAt: now.Add(lifetime).UTC(),
+	}
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsRedeemableWith returns whether the given token matches this invitation,
+// and the invitation has not expired yet.
+func (i UserInvitation) IsRedeemableWith(token string, now time.Time) bool {
+	tokenHash := hashInvitationToken(token)
+	isMatch := subtle.ConstantTimeCompare([]byte(tokenHash), []byte(i.TokenHash)) == 1
+	return isMatch && now.Before(i.ExpiresAt)
+}
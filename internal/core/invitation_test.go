@@ -0,0 +1,35 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserInvitation(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	token, inv := NewUserInvitation(now, 24*time.Hour)
+
+	if inv.TokenHash == token {
+		t.Error("expected token to be stored only as a hash")
+	}
+	if !inv.IsRedeemableWith(token, now.Add(time.Hour)) {
+		t.Error("expected invitation to be redeemable with its own token")
+	}
+	if inv.IsRedeemableWith(token+"0", now.Add(time.Hour)) {
+		t.Error("expected invitation to not be redeemable with a different token")
+	}
+	if inv.IsRedeemableWith(token, now.Add(25*time.Hour)) {
+		t.Error("expected invitation to not be redeemable after expiry")
+	}
+
+	otherToken, _ := NewUserInvitation(now, 24*time.Hour)
+	if otherToken == token {
+		t.Error("expected each invitation to have a different token")
+	}
+}
@@ -0,0 +1,248 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MergeConflict describes a field that was changed in different ways on both
+// sides of a three-way merge (see MergeDatabases).
+type MergeConflict struct {
+	Type string //either "user", "group" or "service user"
+	Key  string //the login name, group name or service user name
+	//Fields are identified in the same way as in type FieldChange. If the
+	//object was deleted on one side, but modified on the other side, Path is
+	//empty and the values are either "deleted" or "modified".
+	Path       string
+	BaseValue  string
+	OurValue   string
+	TheirValue string
+}
+
+// String returns a human-readable representation of this conflict.
+func (c MergeConflict) String() string {
+	if c.Path == "" {
+		return fmt.Sprintf("%s %q was %s in memory, but %s in the file", c.Type, c.Key, c.OurValue, c.TheirValue)
+	}
+	return fmt.Sprintf("%s %q: %s was changed to %s in memory, but to %s in the file",
+		c.Type, c.Key, c.Path, displayFieldValue(c.OurValue), displayFieldValue(c.TheirValue))
+}
+
+// MergeDatabases performs a three-way merge between two Databases that were
+// both derived from `base`. This is used when the database file is edited on
+// disk while the in-memory database (`ours`) has changes that were not
+// written yet.
+//
+// Changes from both sides are adopted on the level of individual fields. Lists
+// (e.g. group members) count as one field. If a field was changed in
+// different ways on both sides, the value from `ours` is kept, and the
+// conflict is reported in the second return value. Password hashes are
+// redacted in the reported conflicts.
+func MergeDatabases(base, ours, theirs Database) (result Database, conflicts []MergeConflict, err error) {
+	var groupConflicts, userConflicts, serviceUserConflicts []MergeConflict
+	result.Groups, groupConflicts, err = mergeObjectLists("group", base.Groups, ours.Groups, theirs.Groups)
+	if err != nil {
+		return Database{}, nil, err
+	}
+	result.Users, userConflicts, err = mergeObjectLists("user", base.Users, ours.Users, theirs.Users)
+	if err != nil {
+		return Database{}, nil, err
+	}
+	result.ServiceUsers, serviceUserConflicts, err = mergeObjectLists("service user", base.ServiceUsers, ours.ServiceUsers, theirs.ServiceUsers)
+	if err != nil {
+		return Database{}, nil, err
+	}
+	result.DeletedUsers = mergeDeletedUsers(base.DeletedUsers, ours.DeletedUsers, theirs.DeletedUsers)
+	conflicts = append(groupConflicts, userConflicts...)
+	return result, append(conflicts, serviceUserConflicts...), nil
+}
+
+func mergeObjectLists[T Object[T]](typeName string, baseList, ourList, theirList ObjectList[T]) (result ObjectList[T], conflicts []MergeConflict, err error) {
+	flattenList := func(list ObjectList[T]) map[string]map[string]string {
+		result := make(map[string]map[string]string, len(list))
+		for _, obj := range list {
+			result[obj.Key()] = flattenObject(obj)
+		}
+		return result
+	}
+	baseObjs, ourObjs, theirObjs := flattenList(baseList), flattenList(ourList), flattenList(theirList)
+
+	keys := make(map[string]bool)
+	for _, objs := range []map[string]map[string]string{baseObjs, ourObjs, theirObjs} {
+		for key := range objs {
+			keys[key] = true
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	result = make(ObjectList[T], 0, len(sortedKeys))
+	for _, key := range sortedKeys {
+		baseObj, existsInBase := baseObjs[key]
+		ourObj, existsInOurs := ourObjs[key]
+		theirObj, existsInTheirs := theirObjs[key]
+
+		//was the object deleted on one side, but modified on the other?
+		if existsInBase && existsInOurs != existsInTheirs {
+			modifiedObj := ourObj
+			if !existsInOurs {
+				modifiedObj = theirObj
+			}
+			if len(diffFields(baseObj, modifiedObj)) == 0 {
+				//no -> the deletion wins
+				continue
+			}
+			conflict := MergeConflict{Type: typeName, Key: key, OurValue: "modified", TheirValue: "deleted"}
+			if !existsInOurs {
+				conflict.OurValue, conflict.TheirValue = "deleted", "modified"
+			}
+			conflicts = append(conflicts, conflict)
+			if !existsInOurs {
+				continue
+			}
+			theirObj = ourObj //keep our version entirely
+		}
+		if !existsInOurs && !existsInTheirs {
+			continue //deleted on both sides
+		}
+		if !existsInOurs && !existsInBase {
+			ourObj = theirObj //created only on their side
+		}
+		if !existsInTheirs && !existsInBase {
+			theirObj = ourObj //created only on our side
+		}
+
+		fields, fieldConflicts := mergeFields(baseObj, ourObj, theirObj)
+		for _, c := range fieldConflicts {
+			c.Type, c.Key = typeName, key
+			conflicts = append(conflicts, c)
+		}
+		obj, err := unflattenObject[T](fields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot merge %s %q: %w", typeName, key, err)
+		}
+		result = append(result, obj)
+	}
+	return result, conflicts, nil
+}
+
+func mergeFields(baseObj, ourObj, theirObj map[string]string) (result map[string]string, conflicts []MergeConflict) {
+	paths := make(map[string]bool)
+	for _, obj := range []map[string]string{baseObj, ourObj, theirObj} {
+		for path := range obj {
+			paths[path] = true
+		}
+	}
+
+	result = make(map[string]string, len(paths))
+	for path := range paths {
+		baseValue, ourValue, theirValue := baseObj[path], ourObj[path], theirObj[path]
+		value := ourValue
+		switch {
+		case ourValue == theirValue, theirValue == baseValue:
+			//nothing to do
+		case ourValue == baseValue:
+			value = theirValue
+		default:
+			conflict := MergeConflict{Path: path, BaseValue: baseValue, OurValue: ourValue, TheirValue: theirValue}
+			if path == "password" {
+				conflict.BaseValue = redactPasswordHash(baseValue)
+				conflict.OurValue = redactPasswordHash(ourValue)
+				conflict.TheirValue = redactPasswordHash(theirValue)
+			}
+			conflicts = append(conflicts, conflict)
+		}
+		if value != "" {
+			result[path] = value
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return result, conflicts
+}
+
+// The reverse of flattenObject.
+func unflattenObject[T any](fields map[string]string) (result T, err error) {
+	data := make(map[string]any)
+	for path, value := range fields {
+		keys := strings.Split(path, ".")
+		current := data
+		for _, key := range keys[:len(keys)-1] {
+			next, ok := current[key].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				current[key] = next
+			}
+			current = next
+		}
+		current[keys[len(keys)-1]] = json.RawMessage(value)
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(buf, &result)
+	return result, err
+}
+
+// QueuedMergeConflict appears in type MergeConflictQueue.
+type QueuedMergeConflict struct {
+	MergeConflict
+	ID         uint64
+	DetectedAt time.Time
+}
+
+// MergeConflictQueue holds MergeConflicts until an admin has looked at them.
+// It can be used from any goroutine. The zero value is an empty queue.
+type MergeConflictQueue struct {
+	mutex     sync.Mutex
+	lastID    uint64
+	conflicts []QueuedMergeConflict
+}
+
+// Add appends the given conflicts to the queue.
+func (q *MergeConflictQueue) Add(conflicts []MergeConflict, detectedAt time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, c := range conflicts {
+		q.lastID++
+		q.conflicts = append(q.conflicts, QueuedMergeConflict{c, q.lastID, detectedAt})
+	}
+}
+
+// List returns all conflicts in the queue, oldest first.
+func (q *MergeConflictQueue) List() []QueuedMergeConflict {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]QueuedMergeConflict(nil), q.conflicts...)
+}
+
+// Dismiss removes the conflict with the given ID from the queue. Returns
+// false if there was no such conflict.
+func (q *MergeConflictQueue) Dismiss(id uint64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for idx, c := range q.conflicts {
+		if c.ID == id {
+			q.conflicts = append(q.conflicts[:idx], q.conflicts[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
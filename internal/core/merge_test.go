@@ -0,0 +1,74 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestMergeDatabases(t *testing.T) {
+	base := Database{
+		Groups: []Group{
+			{Name: "admins", LongName: "Administrators", MemberLoginNames: GroupMemberNames{"jane": true}},
+			{Name: "staff", LongName: "Staff", MemberLoginNames: GroupMemberNames{"jane": true}},
+		},
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "{SHA}base"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		},
+	}
+
+	//if only one side changed, the result is that side
+	changed := base.Cloned()
+	changed.Users[1].EMailAddress = "john@example.org"
+	for _, pair := range [][2]Database{{base, changed}, {changed, base}} {
+		merged, conflicts, err := MergeDatabases(base, pair[0], pair[1])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "merged database", merged, changed)
+		assert.DeepEqual(t, "merge conflicts", len(conflicts), 0)
+	}
+
+	//if both sides changed, non-conflicting changes are adopted from both sides,
+	//and conflicting changes are reported while keeping our side
+	ours := base.Cloned()
+	ours.Users[0].GivenName = "Janet"
+	ours.Users[0].PasswordHash = "{SHA}ours"
+	ours.Groups[0].LongName = "Admins"
+	ours.Groups = ours.Groups[:1] //delete "staff"
+	theirs := base.Cloned()
+	theirs.Users[0].FamilyName = "Smith"
+	theirs.Users[0].PasswordHash = "{SHA}theirs"
+	theirs.Groups[0].LongName = "Portunus admins"
+	theirs.Groups[1].LongName = "All staff" //modify "staff"
+	theirs.Users = append(theirs.Users, User{LoginName: "max", GivenName: "Max", FamilyName: "Mustermann"})
+
+	merged, conflicts, err := MergeDatabases(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := Database{
+		Groups: []Group{
+			{Name: "admins", LongName: "Admins", MemberLoginNames: GroupMemberNames{"jane": true}},
+		},
+		Users: []User{
+			{LoginName: "jane", GivenName: "Janet", FamilyName: "Smith", PasswordHash: "{SHA}ours"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+			{LoginName: "max", GivenName: "Max", FamilyName: "Mustermann"},
+		},
+		ServiceUsers: []ServiceUser{},
+	}
+	assert.DeepEqual(t, "merged database", merged, expected)
+	assert.DeepEqual(t, "merge conflicts", conflicts, []MergeConflict{
+		{Type: "group", Key: "admins", Path: "long_name", BaseValue: `"Administrators"`, OurValue: `"Admins"`, TheirValue: `"Portunus admins"`},
+		{Type: "group", Key: "staff", OurValue: "deleted", TheirValue: "modified"},
+		{Type: "user", Key: "jane", Path: "password", BaseValue: "(redacted)", OurValue: "(redacted)", TheirValue: "(redacted)"},
+	})
+}
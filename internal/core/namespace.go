@@ -0,0 +1,110 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Users and groups live in different OUs in LDAP, so a user and a group can
+// have the same name. Wherever a name crosses a boundary where its type is
+// not clear from context (e.g. in CLI arguments or API requests), it is
+// written as an ObjectRef string like "user/alice" or "group/alice".
+
+var (
+	// ErrUnknownObject is returned by ResolveObjectRef() if no user or group
+	// with the requested name exists.
+	ErrUnknownObject = errors.New("no such user or group")
+	// ErrAmbiguousObjectRef is returned by ResolveObjectRef() if a bare name
+	// refers to both a user and a group.
+	ErrAmbiguousObjectRef = errors.New("name refers to both a user and a group")
+)
+
+// String returns the string form of this ObjectRef, e.g. "user/alice" or
+// "group/alice". For an ObjectRef without type, only the bare name is returned.
+// This is the inverse of ParseObjectRef().
+func (r ObjectRef) String() string {
+	if r.Type == "" {
+		return r.Name
+	}
+	return strings.ReplaceAll(r.Type, " ", "-") + "/" + r.Name
+}
+
+// ParseObjectRef parses a reference to a user or group in the format
+// "user/alice" or "group/alice". Any other input is taken as a bare name, and
+// the result has an empty Type. Bare names need to be resolved with
+// ResolveObjectRef() before use.
+func ParseObjectRef(input string) ObjectRef {
+	for _, objectType := range []string{"user", "group"} {
+		name, ok := strings.CutPrefix(input, objectType+"/")
+		if ok {
+			return ObjectRef{Type: objectType, Name: name}
+		}
+	}
+	return ObjectRef{Name: input}
+}
+
+// ResolveObjectRef checks that the referenced user or group exists. If the
+// ObjectRef does not have a type, the bare name is only accepted if it is
+// unambiguous, and the returned ObjectRef has the type filled in.
+func ResolveObjectRef(n Nexus, ref ObjectRef) (ObjectRef, error) {
+	_, userExists := n.FindUser(func(u User) bool { return u.LoginName == ref.Name })
+	_, groupExists := n.FindGroup(func(g Group) bool { return g.Name == ref.Name })
+
+	switch {
+	case ref.Type == "user" && userExists, ref.Type == "" && userExists && !groupExists:
+		return ObjectRef{Type: "user", Name: ref.Name}, nil
+	case ref.Type == "group" && groupExists, ref.Type == "" && groupExists && !userExists:
+		return ObjectRef{Type: "group", Name: ref.Name}, nil
+	case ref.Type == "" && userExists && groupExists:
+		return ObjectRef{}, fmt.Errorf(`%w: use "user/%s" or "group/%s" to choose one`, ErrAmbiguousObjectRef, ref.Name, ref.Name)
+	default:
+		return ObjectRef{}, fmt.Errorf("%w: %q", ErrUnknownObject, ref.String())
+	}
+}
+
+var (
+	errIsUserLoginName = errors.New("is already in use as a user login name")
+	errIsGroupName     = errors.New("is already in use as a group name")
+)
+
+// If ValidationConfig.SharedNamespace is set, Nexus.Update() uses this to
+// reject users and groups with the same name. Collisions that already exist
+// in the given old Database are accepted, so that enabling the setting does
+// not make an existing database invalid.
+func (d Database) checkSharedNamespace(oldDB Database) (errs errext.ErrorSet) {
+	isOldUser := make(map[string]bool, len(oldDB.Users))
+	for _, u := range oldDB.Users {
+		isOldUser[u.LoginName] = true
+	}
+	isOldGroup := make(map[string]bool, len(oldDB.Groups))
+	for _, g := range oldDB.Groups {
+		isOldGroup[g.Name] = true
+	}
+
+	isUser := make(map[string]bool, len(d.Users))
+	for _, u := range d.Users {
+		isUser[u.LoginName] = true
+	}
+	for _, g := range d.Groups {
+		if !isUser[g.Name] || (isOldUser[g.Name] && isOldGroup[g.Name]) {
+			continue
+		}
+		//report the collision on whichever object is new
+		if !isOldGroup[g.Name] {
+			errs.Add(g.Ref().Field("name").Wrap(errIsUserLoginName))
+		}
+		if !isOldUser[g.Name] {
+			errs.Add(User{LoginName: g.Name}.Ref().Field("login_name").Wrap(errIsGroupName))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestParseObjectRef(t *testing.T) {
+	check := func(input string, expected ObjectRef) {
+		t.Helper()
+		actual := ParseObjectRef(input)
+		assert.DeepEqual(t, "ParseObjectRef("+input+")", actual, expected)
+		assert.DeepEqual(t, "String() after ParseObjectRef("+input+")", actual.String(), input)
+	}
+	check("user/alice", ObjectRef{Type: "user", Name: "alice"})
+	check("group/alice", ObjectRef{Type: "group", Name: "alice"})
+	check("alice", ObjectRef{Name: "alice"})
+	check("users/alice", ObjectRef{Name: "users/alice"})
+}
+
+func TestResolveObjectRef(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Administrators"},
+			{Name: "alice", LongName: "Alice's friends"},
+		}
+		return nil
+	}, nil))
+
+	check := func(input string, expected ObjectRef, expectedErr error) {
+		t.Helper()
+		actual, err := ResolveObjectRef(nexus, ParseObjectRef(input))
+		assert.DeepEqual(t, "result for "+input, actual, expected)
+		if !errors.Is(err, expectedErr) {
+			t.Errorf("expected error %v for %q, but got %v", expectedErr, input, err)
+		}
+	}
+	//unambiguous bare names
+	check("bob", ObjectRef{Type: "user", Name: "bob"}, nil)
+	check("admins", ObjectRef{Type: "group", Name: "admins"}, nil)
+	//ambiguous bare names need a type
+	check("alice", ObjectRef{}, ErrAmbiguousObjectRef)
+	check("user/alice", ObjectRef{Type: "user", Name: "alice"}, nil)
+	check("group/alice", ObjectRef{Type: "group", Name: "alice"}, nil)
+	//the type must match
+	check("group/bob", ObjectRef{}, ErrUnknownObject)
+	check("user/admins", ObjectRef{}, ErrUnknownObject)
+	check("carol", ObjectRef{}, ErrUnknownObject)
+}
+
+func TestSharedNamespace(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	vcfg.SharedNamespace = true
+	nexus := NewNexus(nil, vcfg, &NoopHasher{})
+
+	//a collision that already exists when the database is loaded is accepted
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"}}
+		db.Groups = []Group{{Name: "alice", LongName: "Alice's friends"}}
+		return nil
+	}, nil))
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].LongName = "Friends of Alice"
+		return nil
+	}, nil))
+
+	//new collisions are rejected in both directions
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users, User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"})
+		db.Groups = append(db.Groups, Group{Name: "carol", LongName: "Carol's friends"})
+		return nil
+	}, nil))
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = append(db.Groups, Group{Name: "bob", LongName: "Bob's friends"})
+		db.Users = append(db.Users, User{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson"})
+		return nil
+	}, nil),
+		`field "name" in group "bob" is already in use as a user login name`,
+		`field "login_name" in user "carol" is already in use as a group name`,
+	)
+
+	//when a grandfathered collision is resolved, it cannot come back
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = db.Groups[1:] //remove group "alice"
+		return nil
+	}, nil))
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = append(db.Groups, Group{Name: "alice", LongName: "Alice's friends"})
+		return nil
+	}, nil),
+		`field "name" in group "alice" is already in use as a user login name`,
+	)
+
+	//without the setting, collisions are allowed
+	vcfg.SharedNamespace = false
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = append(db.Groups, Group{Name: "alice", LongName: "Alice's friends"})
+		return nil
+	}, nil))
+}
@@ -9,8 +9,10 @@ package core
 import (
 	"context"
 	"errors"
-	"reflect"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/sapcc/go-bits/errext"
@@ -33,21 +35,59 @@ type Nexus interface {
 	// callback should send into a channel from which that goroutine is receiving.
 	AddListener(ctx context.Context, callback func(Database))
 
+	// AddActivityListener registers a listener with the nexus. Whenever an
+	// update changes group memberships, the callback will be invoked with a
+	// description of those changes. The listener will be removed from the nexus
+	// when `ctx` expires.
+	//
+	// Unlike with AddListener, the initial load of the database is not reported
+	// as a change. The same note about goroutines applies, though.
+	AddActivityListener(ctx context.Context, callback func([]MembershipChange))
+
+	// AddSeedCorrectionListener registers a listener with the nexus. Whenever
+	// an update had changes to seeded fields reverted by the seed (see
+	// UpdateOptions.ConflictWithSeedIsError), the callback will be invoked with
+	// a description of those corrections. The listener will be removed from the
+	// nexus when `ctx` expires.
+	//
+	// The same notes as for AddActivityListener apply.
+	AddSeedCorrectionListener(ctx context.Context, callback func([]SeedCorrection))
+
 	// Update changes the contents of the database. This interface follows the
 	// State Reducer pattern: The action callback is invoked with the current
 	// Database, and is expected to return the updated Database. The updated
 	// Database is then validated and the database seed is enforced, if any.
 	Update(action UpdateAction, opts *UpdateOptions) errext.ErrorSet
 
+	// SetReadOnly enables read-only mode with the given state, or disables it
+	// if nil is given. While read-only mode is enabled, Update() refuses all
+	// changes with ErrReadOnly, except for dry runs and for updates with
+	// UpdateOptions.SystemInternal.
+	SetReadOnly(state *ReadOnlyState)
+	// ReadOnly returns the state of read-only mode, or nil if it is disabled.
+	ReadOnly() *ReadOnlyState
+
 	// Assorted querying functions. The return values are always deep clones
 	// of their respective database entries.
 	ListGroups() []Group
 	ListUsers() []User
+	ListServiceUsers() []ServiceUser
+	ListDeletedUsers() []DeletedUser
 	FindGroup(predicate func(Group) bool) (Group, bool)
 	FindUser(predicate func(User) bool) (UserWithPerms, bool)
+	FindServiceUser(predicate func(ServiceUser) bool) (ServiceUser, bool)
+	// Revision returns Database.Revision and Database.UpdatedAt.
+	Revision() (revision uint64, updatedAt time.Time)
+	// SeededFields returns DatabaseSeed.SeededFields() for the referenced
+	// object, or nil if there is no seed.
+	SeededFields(ref ObjectRef) (paths []string, sourcePath string)
+	// GroupTemplates returns the group templates from the seed, or nil if
+	// there is no seed.
+	GroupTemplates() []GroupTemplate
 
 	// Components carried by the Nexus.
 	PasswordHasher() crypt.PasswordHasher
+	ValidationConfig() ValidationConfig
 }
 
 // UpdateOptions controls optional behavior in Nexus.Update().
@@ -60,8 +100,38 @@ type UpdateOptions struct {
 	//saved. This is used to obtain a more complete set of errors for the UI
 	//after a preliminary validation step already failed.
 	DryRun bool
+
+	//If not empty, the login name of the user who requested this update. This
+	//is reported to activity listeners.
+	Actor string
+
+	//If not empty, explains why this update was made, e.g. because a temporary
+	//elevation expired. This is reported to activity listeners as well.
+	Reason string
+
+	//If true, the update is rejected if it would leave no user with admin
+	//access to Portunus, unless there was no such user to begin with. This is
+	//used for interactive updates, to prevent admins from locking themselves
+	//out of the web GUI.
+	PreventAdminLockout bool
+
+	//If true and ValidationConfig.RequireGroupMembership is set, the update is
+	//rejected if it leaves a user without any group membership, unless that
+	//user had none to begin with. This is used for interactive updates, while
+	//automated updates (e.g. the expiry of a temporary membership) must not be
+	//blocked by this.
+	PreventOrphanedUsers bool
+
+	//If true, the update is applied even while read-only mode is enabled (see
+	//Nexus.SetReadOnly). This is only used for updates that Portunus makes by
+	//itself to stay consistent, e.g. when loading the database from disk.
+	SystemInternal bool
 }
 
+// ErrAdminLockout is returned by Nexus.Update() if an update would leave no
+// user with admin access, and UpdateOptions.PreventAdminLockout is set.
+var ErrAdminLockout = errors.New("this change is not allowed because it would leave no user with admin access to Portunus")
+
 // ErrDatabaseNeedsInitialization is used by the disk store connection to
 // signal to Nexus.Update() that no disk store exists yet. It will prompt the
 // nexus to perform first-time setup of the database contents.
@@ -76,10 +146,15 @@ type nexusImpl struct {
 	hasher crypt.PasswordHasher
 	vcfg   *ValidationConfig
 	//The mutex guards access to all fields listed below it in this struct.
-	mutex     sync.RWMutex
-	seed      *DatabaseSeed
-	db        Database
-	listeners []listener
+	mutex                   sync.RWMutex
+	seed                    *DatabaseSeed
+	db                      Database
+	listeners               []listener
+	activityListeners       []activityListener
+	seedCorrectionListeners []seedCorrectionListener
+	//This is not guarded by the mutex, so that it can be checked from within
+	//listener callbacks.
+	readOnly atomic.Pointer[ReadOnlyState]
 }
 
 type listener struct {
@@ -87,11 +162,26 @@ type listener struct {
 	callback func(Database)
 }
 
+type activityListener struct {
+	ctx      context.Context
+	callback func([]MembershipChange)
+}
+
+type seedCorrectionListener struct {
+	ctx      context.Context
+	callback func([]SeedCorrection)
+}
+
 // PasswordHasher implements the Nexus interface.
 func (n *nexusImpl) PasswordHasher() crypt.PasswordHasher {
 	return n.hasher
 }
 
+// ValidationConfig implements the Nexus interface.
+func (n *nexusImpl) ValidationConfig() ValidationConfig {
+	return *n.vcfg
+}
+
 // ListGroups implements the Nexus interface.
 func (n *nexusImpl) ListGroups() []Group {
 	n.mutex.RLock()
@@ -106,6 +196,31 @@ func (n *nexusImpl) ListUsers() []User {
 	return n.db.Users.Cloned()
 }
 
+// Revision implements the Nexus interface.
+func (n *nexusImpl) Revision() (revision uint64, updatedAt time.Time) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.Revision, n.db.UpdatedAt
+}
+
+// ListServiceUsers implements the Nexus interface.
+func (n *nexusImpl) ListServiceUsers() []ServiceUser {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.ServiceUsers.Cloned()
+}
+
+// ListDeletedUsers implements the Nexus interface.
+func (n *nexusImpl) ListDeletedUsers() []DeletedUser {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	result := make([]DeletedUser, len(n.db.DeletedUsers))
+	for idx, tombstone := range n.db.DeletedUsers {
+		result[idx] = tombstone.Cloned()
+	}
+	return result
+}
+
 // FindGroup implements the Nexus interface.
 func (n *nexusImpl) FindGroup(predicate func(Group) bool) (Group, bool) {
 	n.mutex.RLock()
@@ -125,6 +240,33 @@ func (n *nexusImpl) FindUser(predicate func(User) bool) (UserWithPerms, bool) {
 	return UserWithPerms{}, false
 }
 
+// FindServiceUser implements the Nexus interface.
+func (n *nexusImpl) FindServiceUser(predicate func(ServiceUser) bool) (ServiceUser, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.ServiceUsers.Find(predicate)
+}
+
+// SeededFields implements the Nexus interface.
+func (n *nexusImpl) SeededFields(ref ObjectRef) (paths []string, sourcePath string) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.seed == nil {
+		return nil, ""
+	}
+	return n.seed.SeededFields(ref)
+}
+
+// GroupTemplates implements the Nexus interface.
+func (n *nexusImpl) GroupTemplates() []GroupTemplate {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.seed == nil {
+		return nil
+	}
+	return slices.Clone(n.seed.GroupTemplates)
+}
+
 // AddListener implements the Nexus interface.
 func (n *nexusImpl) AddListener(ctx context.Context, callback func(Database)) {
 	n.mutex.Lock()
@@ -138,12 +280,49 @@ func (n *nexusImpl) AddListener(ctx context.Context, callback func(Database)) {
 	}
 }
 
+// AddActivityListener implements the Nexus interface.
+func (n *nexusImpl) AddActivityListener(ctx context.Context, callback func([]MembershipChange)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.activityListeners = append(n.activityListeners, activityListener{ctx, callback})
+}
+
+// AddSeedCorrectionListener implements the Nexus interface.
+func (n *nexusImpl) AddSeedCorrectionListener(ctx context.Context, callback func([]SeedCorrection)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.seedCorrectionListeners = append(n.seedCorrectionListeners, seedCorrectionListener{ctx, callback})
+}
+
+// SetReadOnly implements the Nexus interface.
+func (n *nexusImpl) SetReadOnly(state *ReadOnlyState) {
+	if state != nil {
+		val := *state
+		state = &val
+	}
+	n.readOnly.Store(state)
+}
+
+// ReadOnly implements the Nexus interface.
+func (n *nexusImpl) ReadOnly() *ReadOnlyState {
+	state := n.readOnly.Load()
+	if state == nil {
+		return nil
+	}
+	val := *state
+	return &val
+}
+
 // Update implements the Nexus interface.
 func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs errext.ErrorSet) {
 	var opts UpdateOptions
 	if optsPtr != nil {
 		opts = *optsPtr
 	}
+	if n.readOnly.Load() != nil && !opts.DryRun && !opts.SystemInternal {
+		errs.Add(ErrReadOnly)
+		return errs
+	}
 
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
@@ -167,24 +346,51 @@ func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs er
 	//normalize the DB and validate it against common rules and the seed
 	newDB.Normalize()
 	errs.Append(newDB.Validate(n.vcfg))
+	if n.vcfg.SharedNamespace && !n.db.IsEmpty() {
+		//existing collisions are accepted (this includes all collisions in the
+		//initial load from the store, where the previous DB is still empty)
+		errs.Append(newDB.checkSharedNamespace(n.db))
+	}
+	var corrections []SeedCorrection
 	if n.seed != nil {
 		if opts.ConflictWithSeedIsError {
 			errs.Append(n.seed.CheckConflicts(newDB, n.hasher))
 		} else {
+			uncorrectedDB := newDB.Cloned()
 			n.seed.ApplyTo(&newDB, n.hasher)
+			corrections = n.seed.collectCorrections(uncorrectedDB, newDB)
 		}
 	}
+	//this comes after the seed since the seed may create users
+	newDB.assignUserIDs(n.db)
+
+	if opts.PreventAdminLockout && n.db.hasAdmins() && !newDB.hasAdmins() {
+		errs.Add(ErrAdminLockout)
+	}
+	if opts.PreventOrphanedUsers && n.vcfg.RequireGroupMembership {
+		errs.Append(newDB.checkOrphanedUsers(n.db, *n.vcfg, time.Now()))
+	}
 
 	//do we have a reason to not update the DB for real?
 	if opts.DryRun || !errs.IsEmpty() {
 		return errs
 	}
 
+	//corrections are reported even if they leave the DB unchanged, since that
+	//is exactly what happens when something keeps fighting the seed
+	n.reportSeedCorrections(n.db, corrections, opts.Actor, opts.Reason)
+
 	//new DB looks good -> store it and inform our listeners *if* it actually
 	//represents a change
-	if reflect.DeepEqual(n.db, newDB) {
+	if n.db.HasSameContentsAs(newDB) {
 		return nil
 	}
+	//when the database is loaded from the store, it brings its own revision
+	if newDB.Revision <= n.db.Revision {
+		newDB.Revision = n.db.Revision + 1
+		newDB.UpdatedAt = time.Now()
+	}
+	n.reportActivity(n.db, newDB, opts.Actor, opts.Reason)
 	n.db = newDB
 	for _, listener := range n.listeners {
 		if listener.ctx.Err() == nil {
@@ -193,3 +399,43 @@ func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs er
 	}
 	return nil
 }
+
+func (n *nexusImpl) reportActivity(oldDB, newDB Database, actor, reason string) {
+	if len(n.activityListeners) == 0 || oldDB.IsEmpty() {
+		return
+	}
+	changes := DiffMemberships(oldDB, newDB)
+	if len(changes) == 0 {
+		return
+	}
+	now := time.Now()
+	for idx := range changes {
+		changes[idx].Actor = actor
+		changes[idx].Reason = reason
+		changes[idx].Time = now
+	}
+	for _, listener := range n.activityListeners {
+		if listener.ctx.Err() == nil {
+			listener.callback(changes)
+		}
+	}
+}
+
+func (n *nexusImpl) reportSeedCorrections(oldDB Database, corrections []SeedCorrection, actor, reason string) {
+	//when the database is first loaded or initialized, the seed fills in
+	//everything that is missing, which is not a correction of any change
+	if len(n.seedCorrectionListeners) == 0 || oldDB.IsEmpty() || len(corrections) == 0 {
+		return
+	}
+	now := time.Now()
+	for idx := range corrections {
+		corrections[idx].Actor = actor
+		corrections[idx].Reason = reason
+		corrections[idx].Time = now
+	}
+	for _, listener := range n.seedCorrectionListeners {
+		if listener.ctx.Err() == nil {
+			listener.callback(corrections)
+		}
+	}
+}
@@ -9,6 +9,7 @@ package core
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/errext"
@@ -84,3 +85,222 @@ func TestDryRun(t *testing.T) {
 	assert.DeepEqual(t, "user given name", actualDB.Users[0].FullName(), "Changed User")
 	assert.DeepEqual(t, "run counter", counter, 2)
 }
+
+func TestActivityListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	var reported [][]MembershipChange
+	nexus.AddActivityListener(ctx, func(changes []MembershipChange) {
+		reported = append(reported, changes)
+	})
+
+	//the initial load is not reported as a change
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		db.Groups = []Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: GroupMemberNames{"jane": true},
+		}}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "number of reports", len(reported), 0)
+
+	//changes that do not concern memberships are not reported either
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].LongName = "All staff"
+		return nil
+	}, &UpdateOptions{Actor: "jane"})
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "number of reports", len(reported), 0)
+
+	//membership changes are reported with the actor
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].MemberLoginNames = GroupMemberNames{"john": true}
+		return nil
+	}, &UpdateOptions{Actor: "jane"})
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "number of reports", len(reported), 1)
+	for idx := range reported[0] {
+		if reported[0][idx].Time.IsZero() {
+			t.Errorf("expected change %d to have a timestamp", idx)
+		}
+		reported[0][idx].Time = time.Time{}
+	}
+	assert.DeepEqual(t, "reported changes", reported[0], []MembershipChange{
+		{GroupName: "staff", LoginName: "jane", Kind: MemberRemoved, Actor: "jane"},
+		{GroupName: "staff", LoginName: "john", Kind: MemberAdded, Actor: "jane"},
+	})
+
+	//deleting a group removes all its members
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = nil
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "number of reports", len(reported), 2)
+	reported[1][0].Time = time.Time{}
+	assert.DeepEqual(t, "reported changes", reported[1], []MembershipChange{
+		{GroupName: "staff", LoginName: "john", Kind: MemberRemoved},
+	})
+}
+
+func TestPreventAdminLockout(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	adminPerms := Permissions{Portunus: PortunusPermissions{IsAdmin: true}}
+	opts := &UpdateOptions{PreventAdminLockout: true}
+
+	//a database without admins can be loaded and changed freely
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Admins", MemberLoginNames: GroupMemberNames{}},
+			{Name: "operators", LongName: "Operators", MemberLoginNames: GroupMemberNames{}},
+		}
+		return nil
+	}, opts)
+	expectNoErrors(t, errs)
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].MemberLoginNames = GroupMemberNames{"jane": true}
+		db.Groups[0].Permissions = adminPerms
+		db.Groups[1].MemberLoginNames = GroupMemberNames{"john": true}
+		return nil
+	}, opts)
+	expectNoErrors(t, errs)
+
+	//the last admin cannot be removed, regardless of how
+	reducers := map[string]UpdateAction{
+		"delete group": func(db *Database) errext.ErrorSet {
+			db.Groups = db.Groups[1:]
+			return nil
+		},
+		"revoke permission": func(db *Database) errext.ErrorSet {
+			db.Groups[0].Permissions = Permissions{}
+			return nil
+		},
+		"remove member": func(db *Database) errext.ErrorSet {
+			db.Groups[0].MemberLoginNames = GroupMemberNames{}
+			return nil
+		},
+	}
+	for desc, reducer := range reducers {
+		errs = nexus.Update(reducer, opts)
+		if len(errs) != 1 || errs[0] != ErrAdminLockout {
+			t.Errorf("expected ErrAdminLockout for %s, but got %v", desc, errs)
+		}
+	}
+
+	//once there is another admin, the first one can go
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[1].Permissions = adminPerms
+		return nil
+	}, opts)
+	expectNoErrors(t, errs)
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = db.Groups[1:]
+		return nil
+	}, opts)
+	expectNoErrors(t, errs)
+
+	//without the option, removing the last admin is allowed (e.g. for edits of the database file)
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = nil
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+}
+
+func TestImpactOfGroupDeletion(t *testing.T) {
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+			{LoginName: "mary", GivenName: "Mary", FamilyName: "Roe"},
+		},
+		Groups: []Group{
+			{
+				Name:             "admins",
+				MemberLoginNames: GroupMemberNames{"jane": true, "john": true},
+				Permissions: Permissions{
+					Portunus: PortunusPermissions{IsAdmin: true},
+					LDAP:     LDAPPermissions{CanRead: true},
+				},
+			},
+			{
+				Name:             "readers",
+				MemberLoginNames: GroupMemberNames{"john": true, "mary": true},
+				Permissions:      Permissions{LDAP: LDAPPermissions{CanRead: true}},
+			},
+		},
+	}
+
+	//only members without other sources for the same permission are affected
+	assert.DeepEqual(t, "impact of deleting admins", db.ImpactOfGroupDeletion("admins"), GroupDeletionImpact{
+		LosingAdminAccess: []string{"jane", "john"},
+		LosingLDAPAccess:  []string{"jane"},
+		AdminsRemain:      false,
+	})
+	assert.DeepEqual(t, "impact of deleting readers", db.ImpactOfGroupDeletion("readers"), GroupDeletionImpact{
+		LosingLDAPAccess: []string{"mary"},
+		AdminsRemain:     true,
+	})
+	assert.DeepEqual(t, "admins locked out", db.ImpactOfGroupDeletion("admins").LocksOutAllAdmins(), true)
+	assert.DeepEqual(t, "admins locked out", db.ImpactOfGroupDeletion("readers").LocksOutAllAdmins(), false)
+
+	//if there was no admin to begin with, nobody gets locked out
+	db.Groups[0].Permissions.Portunus.IsAdmin = false
+	assert.DeepEqual(t, "admins locked out", db.ImpactOfGroupDeletion("admins").LocksOutAllAdmins(), false)
+}
+
+func TestDatabaseRevision(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	var seenRevisions []uint64
+	nexus.AddListener(ctx, func(db Database) {
+		seenRevisions = append(seenRevisions, db.Revision)
+	})
+	setLongName := func(longName string) UpdateAction {
+		return func(db *Database) errext.ErrorSet {
+			db.Groups = []Group{{Name: "group", LongName: longName, MemberLoginNames: GroupMemberNames{}}}
+			return nil
+		}
+	}
+
+	//each update that changes the contents bumps the revision...
+	expectNoErrors(t, nexus.Update(setLongName("First"), nil))
+	expectNoErrors(t, nexus.Update(setLongName("Second"), nil))
+	//...but updates without an actual change do not
+	expectNoErrors(t, nexus.Update(setLongName("Second"), nil))
+	assert.DeepEqual(t, "revisions seen by listener", seenRevisions, []uint64{1, 2})
+	revision, updatedAt := nexus.Revision()
+	assert.DeepEqual(t, "revision", revision, uint64(2))
+	if updatedAt.IsZero() {
+		t.Error("expected UpdatedAt to be set after an update")
+	}
+
+	//a database loaded from the store brings its own revision, unless that one is outdated
+	loadedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		*db = Database{Revision: 42, UpdatedAt: loadedAt}
+		return setLongName("Loaded")(db)
+	}, nil))
+	revision, updatedAt = nexus.Revision()
+	assert.DeepEqual(t, "revision after load", revision, uint64(42))
+	assert.DeepEqual(t, "UpdatedAt after load", updatedAt, loadedAt)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		*db = Database{Revision: 5}
+		return setLongName("Outdated")(db)
+	}, nil))
+	assert.DeepEqual(t, "revisions seen by listener", seenRevisions, []uint64{1, 2, 42, 43})
+}
@@ -0,0 +1,156 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// OffboardingOptions selects which steps are taken by Database.Offboard() when
+// a user leaves the organization.
+type OffboardingOptions struct {
+	//Sets ValidUntil to the current time, and discards any pending invitation.
+	DisableAccount bool `json:"disable_account"`
+	WipeSSHKeys    bool `json:"wipe_ssh_keys"`
+	//Removes the user from all groups except those listed in RetainGroupNames.
+	RemoveMemberships bool     `json:"remove_memberships"`
+	RetainGroupNames  []string `json:"retain_groups,omitempty"`
+	//Ends all sessions, forgets all devices, and ends all elevations of the
+	//user. These are not part of the database, so Offboard() only reports this
+	//choice; the caller needs to act on it after the update was successful.
+	RevokeSessions bool `json:"revoke_sessions"`
+}
+
+// DefaultOffboardingOptions returns the options that are preselected when an
+// admin starts offboarding a user: Everything is taken away.
+func DefaultOffboardingOptions() OffboardingOptions {
+	return OffboardingOptions{
+		DisableAccount:    true,
+		WipeSSHKeys:       true,
+		RemoveMemberships: true,
+		RevokeSessions:    true,
+	}
+}
+
+// OffboardingReport summarizes the changes made while offboarding a user.
+// The last three fields are filled by the caller of Database.Offboard(), since
+// sessions, devices and elevations are not part of the database.
+type OffboardingReport struct {
+	LoginName          string     `json:"login_name"`
+	DisabledAt         *time.Time `json:"disabled_at,omitempty"`
+	RevokedInvitation  bool       `json:"revoked_invitation"`
+	RemovedSSHKeyCount int        `json:"removed_ssh_keys"`
+	RemovedFromGroups  []string   `json:"removed_from_groups"`
+	RetainedGroups     []string   `json:"retained_groups"`
+	EndedSessionCount  int        `json:"ended_sessions"`
+	ForgottenDevices   int        `json:"forgotten_devices"`
+	EndedElevations    int        `json:"ended_elevations"`
+}
+
+// Offboard applies the given options to the given user. All changes are made
+// to this database, so they become effective in a single update of the Nexus.
+//
+// If the user's departure would leave the approver group of any elevation
+// policy with fewer members than that policy requires approvals, an error is
+// returned for each affected approver group, and the caller must abort the
+// update. Another approver needs to be added to those groups first.
+func (d *Database) Offboard(loginName string, opts OffboardingOptions, now time.Time) (report OffboardingReport, errs errext.ErrorSet) {
+	report.LoginName = loginName
+	userIdx := -1
+	for idx, user := range d.Users {
+		if user.LoginName == loginName {
+			userIdx = idx
+		}
+	}
+	if userIdx < 0 {
+		errs.Addf("user %q does not exist", loginName)
+		return
+	}
+	isRetained := make(map[string]bool, len(opts.RetainGroupNames))
+	for _, groupName := range opts.RetainGroupNames {
+		isRetained[groupName] = true
+	}
+	user := &d.Users[userIdx]
+	if !user.IsExpiredAt(now) {
+		//users that have expired already do not count as approvers anyway
+		errs.Append(d.checkApproversAfterOffboarding(loginName, opts, isRetained, now))
+		if !errs.IsEmpty() {
+			return
+		}
+	}
+
+	if opts.DisableAccount {
+		if user.ValidUntil == nil || now.Before(*user.ValidUntil) {
+			user.ValidUntil = &now
+		}
+		report.DisabledAt = user.ValidUntil
+		report.RevokedInvitation = user.Invitation != nil
+		user.Invitation = nil
+	}
+	if opts.WipeSSHKeys {
+		report.RemovedSSHKeyCount = len(user.SSHPublicKeys)
+		user.SSHPublicKeys = nil
+	}
+
+	for _, group := range d.Groups {
+		if !group.MemberLoginNames[loginName] {
+			continue
+		}
+		if opts.RemoveMemberships && !isRetained[group.Name] {
+			group.MemberLoginNames[loginName] = false
+			report.RemovedFromGroups = append(report.RemovedFromGroups, group.Name)
+		} else {
+			report.RetainedGroups = append(report.RetainedGroups, group.Name)
+		}
+	}
+	return
+}
+
+// Returns an error for each approver group that could not approve elevation
+// requests anymore once the given user was offboarded.
+func (d Database) checkApproversAfterOffboarding(loginName string, opts OffboardingOptions, isRetained map[string]bool, now time.Time) (errs errext.ErrorSet) {
+	policiesByApproverGroup := make(map[string][]Group)
+	for _, group := range d.Groups {
+		if group.Elevation != nil {
+			approverGroupName := group.Elevation.ApproverGroupName
+			policiesByApproverGroup[approverGroupName] = append(policiesByApproverGroup[approverGroupName], group)
+		}
+	}
+
+	for _, group := range d.Groups {
+		if len(policiesByApproverGroup[group.Name]) == 0 || !group.MemberLoginNames[loginName] {
+			continue
+		}
+		staysApprover := !opts.DisableAccount && (!opts.RemoveMemberships || isRetained[group.Name])
+		if staysApprover {
+			continue
+		}
+		var remainingApprovers uint
+		for _, user := range d.Users {
+			if user.LoginName != loginName && group.ContainsUser(user) && !user.IsExpiredAt(now) {
+				remainingApprovers++
+			}
+		}
+		var affectedGroupNames []string
+		for _, target := range policiesByApproverGroup[group.Name] {
+			if remainingApprovers < max(target.Elevation.RequiredApprovals, 1) {
+				affectedGroupNames = append(affectedGroupNames, target.Name)
+			}
+		}
+		if len(affectedGroupNames) > 0 {
+			sort.Strings(affectedGroupNames)
+			errs.Add(fmt.Errorf("group %q needs another member first: without %q, elevations into %s could not be approved anymore",
+				group.Name, loginName, strings.Join(affectedGroupNames, ", ")))
+		}
+	}
+	return
+}
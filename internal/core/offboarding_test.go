@@ -0,0 +1,132 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func setupOffboardingTest() Database {
+	return Database{
+		Users: []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Approver"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Builder"},
+			{
+				LoginName:     "jane",
+				GivenName:     "Jane",
+				FamilyName:    "Doe",
+				SSHPublicKeys: []SSHKey{{Key: "ssh-ed25519 AAAA jane@laptop"}, {Key: "ssh-ed25519 BBBB jane@desktop"}},
+				Invitation:    &UserInvitation{TokenHash: "abc"},
+			},
+		},
+		Groups: []Group{
+			{
+				Name:             "approvers",
+				LongName:         "Approvers",
+				MemberLoginNames: GroupMemberNames{"alice": true, "jane": true},
+			},
+			{
+				Name:             "developers",
+				LongName:         "Developers",
+				MemberLoginNames: GroupMemberNames{"bob": true, "jane": true},
+			},
+			{
+				Name:             "oncall",
+				LongName:         "On-call engineers",
+				MemberLoginNames: GroupMemberNames{"jane": true},
+				Elevation:        &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 8, RequiredApprovals: 1},
+			},
+			{
+				Name:             "production",
+				LongName:         "Production access",
+				MemberLoginNames: GroupMemberNames{},
+				Elevation:        &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 4, RequiredApprovals: 2},
+			},
+		},
+	}
+}
+
+func TestOffboardingWithRetainedGroups(t *testing.T) {
+	db := setupOffboardingTest()
+	db.Groups[2].Elevation = nil //so that jane is not needed as an approver
+	db.Groups[3].Elevation = nil
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	opts := DefaultOffboardingOptions()
+	opts.RetainGroupNames = []string{"developers"}
+	report, errs := db.Offboard("jane", opts, now)
+	expectNoErrors(t, errs)
+
+	assert.DeepEqual(t, "report", report, OffboardingReport{
+		LoginName:          "jane",
+		DisabledAt:         &now,
+		RevokedInvitation:  true,
+		RemovedSSHKeyCount: 2,
+		RemovedFromGroups:  []string{"approvers", "oncall"},
+		RetainedGroups:     []string{"developers"},
+	})
+	jane := db.Users[2]
+	assert.DeepEqual(t, "ValidUntil", jane.ValidUntil, &now)
+	assert.DeepEqual(t, "Invitation", jane.Invitation, (*UserInvitation)(nil))
+	assert.DeepEqual(t, "SSHPublicKeys", jane.SSHPublicKeys, []SSHKey(nil))
+	for _, group := range db.Groups {
+		assert.DeepEqual(t, "membership in "+group.Name, group.MemberLoginNames["jane"], group.Name == "developers")
+	}
+
+	//when only some steps are selected, the rest of the account is left alone
+	db = setupOffboardingTest()
+	db.Groups[2].Elevation = nil
+	db.Groups[3].Elevation = nil
+	report, errs = db.Offboard("jane", OffboardingOptions{WipeSSHKeys: true}, now)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "report", report, OffboardingReport{
+		LoginName:          "jane",
+		RemovedSSHKeyCount: 2,
+		RetainedGroups:     []string{"approvers", "developers", "oncall"},
+	})
+	assert.DeepEqual(t, "ValidUntil", db.Users[2].ValidUntil, (*time.Time)(nil))
+}
+
+func TestOffboardingBlockedByLastApprover(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	//without jane, alice is the only approver, which is not enough for "production"
+	db := setupOffboardingTest()
+	_, errs := db.Offboard("jane", DefaultOffboardingOptions(), now)
+	expectTheseErrors(t, errs,
+		`group "approvers" needs another member first: without "jane", elevations into production could not be approved anymore`)
+	assert.DeepEqual(t, "jane is still in approvers", db.Groups[0].MemberLoginNames["jane"], true)
+
+	//if alice's account has expired, jane is the sole approver
+	db = setupOffboardingTest()
+	db.Users[0].ValidUntil = &now
+	_, errs = db.Offboard("jane", DefaultOffboardingOptions(), now)
+	expectTheseErrors(t, errs,
+		`group "approvers" needs another member first: without "jane", elevations into oncall, production could not be approved anymore`)
+
+	//retaining the membership does not help if the account is disabled...
+	db = setupOffboardingTest()
+	opts := DefaultOffboardingOptions()
+	opts.RetainGroupNames = []string{"approvers"}
+	_, errs = db.Offboard("jane", opts, now)
+	assert.DeepEqual(t, "number of errors", len(errs), 1)
+
+	//...but it does if the account stays enabled
+	opts.DisableAccount = false
+	_, errs = db.Offboard("jane", opts, now)
+	expectNoErrors(t, errs)
+
+	//once another approver was added, the offboarding can proceed
+	db = setupOffboardingTest()
+	db.Groups[0].MemberLoginNames["bob"] = true
+	_, errs = db.Offboard("jane", DefaultOffboardingOptions(), now)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "jane is still in approvers", db.Groups[0].MemberLoginNames["jane"], false)
+}
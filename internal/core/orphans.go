@@ -0,0 +1,114 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Users without any group membership usually indicate a half-finished
+// onboarding: They do not get any permissions, and are easy to forget. If
+// ValidationConfig.RequireGroupMembership is set, interactive updates may not
+// leave users in this state (see UpdateOptions.PreventOrphanedUsers).
+
+var errNoGroupMembership = errors.New("must include at least one group")
+
+// RequiresGroupMembership returns whether the given user must be a member of
+// at least one group. This is the single place that decides about exemptions:
+// Users are exempt if the policy is disabled, if their account has expired
+// (e.g. because they were offboarded), or if their login name matches
+// GroupMembershipExemptRegex (e.g. for test accounts). Service users are not
+// affected by the policy at all since they cannot be group members.
+func (cfg ValidationConfig) RequiresGroupMembership(u User, now time.Time) bool {
+	switch {
+	case !cfg.RequireGroupMembership:
+		return false
+	case u.IsExpiredAt(now):
+		return false
+	case cfg.GroupMembershipExemptRegex != nil && cfg.GroupMembershipExemptRegex.MatchString(u.LoginName):
+		return false
+	default:
+		return true
+	}
+}
+
+// FindOrphanedUsers returns all users that violate the policy from
+// ValidationConfig.RequireGroupMembership. Since the policy only applies to
+// changes, this can include users that were already in this state before the
+// policy was enabled.
+func (d Database) FindOrphanedUsers(cfg ValidationConfig, now time.Time) []User {
+	isMember := make(map[string]bool, len(d.Users))
+	for _, g := range d.Groups {
+		for loginName, ok := range g.MemberLoginNames {
+			if ok {
+				isMember[loginName] = true
+			}
+		}
+	}
+
+	var result []User
+	for _, u := range d.Users {
+		if !isMember[u.LoginName] && cfg.RequiresGroupMembership(u, now) {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// If UpdateOptions.PreventOrphanedUsers is set, Nexus.Update() uses this to
+// reject users without group memberships. Users that were already orphaned in
+// the given old Database are accepted, so that enabling the policy does not
+// make an existing database invalid.
+func (d Database) checkOrphanedUsers(oldDB Database, cfg ValidationConfig, now time.Time) (errs errext.ErrorSet) {
+	wasOrphaned := make(map[string]bool)
+	for _, u := range oldDB.FindOrphanedUsers(cfg, now) {
+		wasOrphaned[u.LoginName] = true
+	}
+	for _, u := range d.FindOrphanedUsers(cfg, now) {
+		if !wasOrphaned[u.LoginName] {
+			errs.Add(u.Ref().Field("memberships").Wrap(errNoGroupMembership))
+		}
+	}
+	return errs
+}
+
+// CheckDefaultGroup is called at startup if DefaultGroupName is set. The group
+// must exist in the given database or be defined by the seed, and the stored
+// group must not conflict with the seed. Otherwise, creating users with the
+// preselected group would fail.
+func (cfg ValidationConfig) CheckDefaultGroup(db Database, seed *DatabaseSeed, hasher crypt.PasswordHasher) error {
+	if cfg.DefaultGroupName == "" {
+		return nil
+	}
+	ref := Group{Name: cfg.DefaultGroupName}.Ref()
+	_, exists := db.Groups.Find(func(g Group) bool { return g.Name == ref.Name })
+	if !exists && seed != nil {
+		for _, g := range seed.Groups {
+			if string(g.Name) == ref.Name {
+				exists = true
+			}
+		}
+	}
+	if !exists {
+		return fmt.Errorf("PORTUNUS_USER_DEFAULT_GROUP refers to a group that does not exist: %q", ref.Name)
+	}
+
+	if seed != nil {
+		for _, err := range seed.CheckConflicts(db, hasher) {
+			var verr ValidationError
+			if errors.As(err, &verr) && verr.FieldRef.Object == ref {
+				return fmt.Errorf("PORTUNUS_USER_DEFAULT_GROUP refers to a group that conflicts with the seed: %w", err)
+			}
+		}
+	}
+	return nil
+}
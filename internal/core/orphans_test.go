@@ -0,0 +1,161 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func getOrphanPolicyConfigForTests() *ValidationConfig {
+	vcfg := GetValidationConfigForTests()
+	vcfg.RequireGroupMembership = true
+	vcfg.GroupMembershipExemptRegex = regexp.MustCompile(`^test-.*$`)
+	return vcfg
+}
+
+func TestRequiresGroupMembership(t *testing.T) {
+	vcfg := getOrphanPolicyConfigForTests()
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	check := func(u User, expected bool) {
+		t.Helper()
+		assert.DeepEqual(t, "RequiresGroupMembership for "+u.LoginName, vcfg.RequiresGroupMembership(u, now), expected)
+	}
+	check(User{LoginName: "jane"}, true)
+	check(User{LoginName: "jane", ValidUntil: &future}, true)
+	//disabled accounts and test accounts are exempt
+	check(User{LoginName: "jane", ValidUntil: &past}, false)
+	check(User{LoginName: "test-jane"}, false)
+
+	//nobody is affected if the policy is disabled
+	vcfg.RequireGroupMembership = false
+	check(User{LoginName: "jane"}, false)
+}
+
+func TestPreventOrphanedUsers(t *testing.T) {
+	nexus := NewNexus(nil, getOrphanPolicyConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+			//this user predates the policy
+			{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson"},
+		}
+		db.Groups = []Group{{
+			Name:             "staff",
+			LongName:         "All staff",
+			MemberLoginNames: GroupMemberNames{"alice": true, "bob": true},
+		}}
+		return nil
+	}, nil))
+	opts := &UpdateOptions{PreventOrphanedUsers: true}
+	setMembership := func(db *Database, loginName string, isMember bool) {
+		for _, g := range db.Groups {
+			if g.Name == "staff" {
+				g.MemberLoginNames[loginName] = isMember
+			}
+		}
+	}
+
+	//removing the last membership is rejected...
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		setMembership(db, "bob", false)
+		return nil
+	}, opts), `field "memberships" in user "bob" must include at least one group`)
+
+	//...unless the user is disabled at the same time
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		setMembership(db, "bob", false)
+		now := time.Now()
+		for idx := range db.Users {
+			if db.Users[idx].LoginName == "bob" {
+				db.Users[idx].ValidUntil = &now
+			}
+		}
+		return nil
+	}, opts))
+
+	//new users need a membership, except for test accounts
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			User{LoginName: "dave", GivenName: "Dave", FamilyName: "Davidson"},
+			User{LoginName: "test-eve", GivenName: "Eve", FamilyName: "Evans"},
+		)
+		return nil
+	}, opts), `field "memberships" in user "dave" must include at least one group`)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			User{LoginName: "dave", GivenName: "Dave", FamilyName: "Davidson"},
+			User{LoginName: "test-eve", GivenName: "Eve", FamilyName: "Evans"},
+		)
+		setMembership(db, "dave", true)
+		return nil
+	}, opts))
+
+	//existing orphans can still be changed
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		for idx := range db.Users {
+			if db.Users[idx].LoginName == "carol" {
+				db.Users[idx].GivenName = "Caroline"
+			}
+		}
+		return nil
+	}, opts))
+
+	//the report lists the existing orphans, but no exempt users
+	var orphanNames []string
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		for _, u := range db.FindOrphanedUsers(nexus.ValidationConfig(), time.Now()) {
+			orphanNames = append(orphanNames, u.LoginName)
+		}
+		return nil
+	}, &UpdateOptions{DryRun: true}))
+	assert.DeepEqual(t, "orphaned users", orphanNames, []string{"carol"})
+
+	//automated updates are not affected
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		setMembership(db, "alice", false)
+		return nil
+	}, nil))
+}
+
+func TestCheckDefaultGroup(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", vcfg)
+	expectNoErrors(t, errs)
+	hasher := &NoopHasher{}
+	db := Database{Groups: []Group{{Name: "staff", LongName: "All staff"}}}
+	expectSuccess := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("expected no error, but got: %s", err.Error())
+		}
+	}
+
+	//without a default group, there is nothing to check
+	expectSuccess(vcfg.CheckDefaultGroup(Database{}, nil, hasher))
+
+	//the group can come from the database or from the seed
+	vcfg.DefaultGroupName = "staff"
+	expectSuccess(vcfg.CheckDefaultGroup(db, seed, hasher))
+	vcfg.DefaultGroupName = "maxgroup"
+	expectSuccess(vcfg.CheckDefaultGroup(db, seed, hasher))
+	expectError(t, vcfg.CheckDefaultGroup(db, nil, hasher),
+		`PORTUNUS_USER_DEFAULT_GROUP refers to a group that does not exist: "maxgroup"`)
+
+	//the stored group may not conflict with the seed
+	db.Groups = append(db.Groups, Group{Name: "maxgroup", LongName: "Something else"})
+	expectError(t, vcfg.CheckDefaultGroup(db, seed, hasher),
+		`PORTUNUS_USER_DEFAULT_GROUP refers to a group that conflicts with the seed: field "long_name" in group "maxgroup" must be equal to the seeded value`)
+}
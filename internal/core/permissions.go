@@ -16,6 +16,13 @@ type Permissions struct {
 // PortunusPermissions appears in type Permissions.
 type PortunusPermissions struct {
 	IsAdmin bool `json:"is_admin"`
+	//CanView grants read-only access to the users and groups in the web GUI.
+	//It is implied by IsAdmin.
+	CanView bool `json:"can_view,omitempty"`
+	//CanBrowse grants access to the people directory in the web GUI, which
+	//lists the users with their contact details, but no other data. It is
+	//implied by CanView.
+	CanBrowse bool `json:"can_browse,omitempty"`
 }
 
 // LDAPPermissions appears in type Permissions.
@@ -24,15 +31,25 @@ type LDAPPermissions struct {
 }
 
 // Includes returns true when all the permissions are included in this
-// Permissions instance.
+// Permissions instance. Permissions that are implied by other permissions
+// (e.g. view access by admin access) are taken into account.
 func (p Permissions) Includes(other Permissions) bool {
+	p = p.withImplied()
 	return p.Union(other) == p
 }
 
+func (p Permissions) withImplied() Permissions {
+	p.Portunus.CanView = p.Portunus.CanView || p.Portunus.IsAdmin
+	p.Portunus.CanBrowse = p.Portunus.CanBrowse || p.Portunus.CanView
+	return p
+}
+
 // Union returns the union of the given permission sets.
 func (p Permissions) Union(other Permissions) Permissions {
 	var result Permissions
 	result.Portunus.IsAdmin = p.Portunus.IsAdmin || other.Portunus.IsAdmin
+	result.Portunus.CanView = p.Portunus.CanView || other.Portunus.CanView
+	result.Portunus.CanBrowse = p.Portunus.CanBrowse || other.Portunus.CanBrowse
 	result.LDAP.CanRead = p.LDAP.CanRead || other.LDAP.CanRead
 	return result
 }
@@ -0,0 +1,43 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestPermissionsIncludes(t *testing.T) {
+	var (
+		none    = Permissions{}
+		admin   = Permissions{Portunus: PortunusPermissions{IsAdmin: true}}
+		viewer  = Permissions{Portunus: PortunusPermissions{CanView: true}}
+		browser = Permissions{Portunus: PortunusPermissions{CanBrowse: true}}
+		reader  = Permissions{LDAP: LDAPPermissions{CanRead: true}}
+	)
+
+	assert.DeepEqual(t, "admin includes viewer", admin.Includes(viewer), true)
+	assert.DeepEqual(t, "viewer includes admin", viewer.Includes(admin), false)
+	assert.DeepEqual(t, "viewer includes viewer", viewer.Includes(viewer), true)
+	assert.DeepEqual(t, "viewer includes none", viewer.Includes(none), true)
+	assert.DeepEqual(t, "none includes viewer", none.Includes(viewer), false)
+	assert.DeepEqual(t, "admin includes LDAP reader", admin.Includes(reader), false)
+
+	//directory access is implied by view access, but does not imply it
+	assert.DeepEqual(t, "admin includes browser", admin.Includes(browser), true)
+	assert.DeepEqual(t, "viewer includes browser", viewer.Includes(browser), true)
+	assert.DeepEqual(t, "browser includes viewer", browser.Includes(viewer), false)
+	assert.DeepEqual(t, "reader includes browser", reader.Includes(browser), false)
+
+	//permissions from multiple groups are combined
+	combined := viewer.Union(reader)
+	assert.DeepEqual(t, "viewer+reader includes viewer", combined.Includes(viewer), true)
+	assert.DeepEqual(t, "viewer+reader includes reader", combined.Includes(reader), true)
+	assert.DeepEqual(t, "viewer+reader includes admin", combined.Includes(admin), false)
+	assert.DeepEqual(t, "admin+reader includes viewer+reader", admin.Union(reader).Includes(combined), true)
+}
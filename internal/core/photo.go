@@ -0,0 +1,108 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" //registers PNG support with image.Decode()
+)
+
+// UserPhotoMaxDimension is the maximum width and height of User.Photo in pixels.
+// Larger uploads are scaled down to fit.
+const UserPhotoMaxDimension = 256
+
+// Uploads with more pixels than this are rejected instead of being decoded.
+const userPhotoMaxSourcePixels = 50000000
+
+// ParseUserPhoto reads an uploaded image in PNG or JPEG format, and converts it
+// into the format required for User.Photo: a JPEG image that fits within
+// UserPhotoMaxDimension x UserPhotoMaxDimension pixels.
+func ParseUserPhoto(buf []byte, ref FieldRef) ([]byte, error) {
+	//check the dimensions before decoding to avoid excessive memory usage
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, ref.Wrap(errNotPhoto)
+	}
+	if cfg.Width*cfg.Height > userPhotoMaxSourcePixels {
+		return nil, ref.Wrap(fmt.Errorf("may not have more than %d megapixels", userPhotoMaxSourcePixels/1000000))
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(buf))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return nil, ref.Wrap(errNotPhoto)
+	}
+
+	var out bytes.Buffer
+	err = jpeg.Encode(&out, scaleDownToFit(img, UserPhotoMaxDimension), &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, ref.Wrap(fmt.Errorf("could not be converted into JPEG: %w", err))
+	}
+	return out.Bytes(), nil
+}
+
+// MustBeUserPhoto is a h.ValidationRule.
+func MustBeUserPhoto(photo []byte) error {
+	if len(photo) == 0 {
+		return nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(photo))
+	if err != nil || format != "jpeg" {
+		return errNotJPEGPhoto
+	}
+	if cfg.Width > UserPhotoMaxDimension || cfg.Height > UserPhotoMaxDimension {
+		return fmt.Errorf("may not be larger than %dx%d pixels", UserPhotoMaxDimension, UserPhotoMaxDimension)
+	}
+	return nil
+}
+
+// Scales the image down such that neither width nor height exceed the given
+// size, retaining the aspect ratio. Each target pixel is the average of the
+// source pixels that it covers. Since JPEG does not support transparency,
+// transparent areas are filled with white.
+func scaleDownToFit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	switch {
+	case srcW <= size && srcH <= size:
+		//no scaling necessary
+	case srcW > srcH:
+		dstW, dstH = size, max(1, srcH*size/srcW)
+	default:
+		dstW, dstH = max(1, srcW*size/srcH), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := bounds.Min.Y+y*srcH/dstH, bounds.Min.Y+(y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := bounds.Min.X+x*srcW/dstW, bounds.Min.X+(x+1)*srcW/dstW
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					count++
+				}
+			}
+			//RGBA() returns premultiplied values, so blending onto white only
+			//requires adding the missing opacity to each channel
+			white := 0xFFFF - a/count
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/count + white),
+				G: uint16(g/count + white),
+				B: uint16(b/count + white),
+				A: 0xFFFF,
+			})
+		}
+	}
+	return dst
+}
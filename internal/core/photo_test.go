@@ -0,0 +1,66 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestParseUserPhoto(t *testing.T) {
+	ref := User{LoginName: "jane"}.Ref().Field("photo")
+
+	//a PNG that is too large and partially transparent
+	src := image.NewNRGBA(image.Rect(0, 0, 512, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			src.Set(x, y, color.NRGBA{R: 0xFF, A: 0xFF})
+		}
+	}
+	var buf bytes.Buffer
+	must.Succeed(png.Encode(&buf, src))
+
+	photo, err := ParseUserPhoto(buf.Bytes(), ref)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "MustBeUserPhoto", MustBeUserPhoto(photo), nil)
+	img, err := jpeg.Decode(bytes.NewReader(photo))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "photo size", img.Bounds().Size(), image.Pt(256, 128))
+
+	//the opaque half keeps its color, the transparent half becomes white
+	r, g, b, _ := img.At(64, 64).RGBA()
+	assert.DeepEqual(t, "opaque pixel is red", r > 0xF000 && g < 0x1000 && b < 0x1000, true)
+	r, g, b, _ = img.At(192, 64).RGBA()
+	assert.DeepEqual(t, "transparent pixel is white", r > 0xF000 && g > 0xF000 && b > 0xF000, true)
+
+	//re-parsing a valid photo is lossy, but retains the size
+	photo, err = ParseUserPhoto(photo, ref)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cfg := must.Return(jpeg.DecodeConfig(bytes.NewReader(photo)))
+	assert.DeepEqual(t, "photo size after reparse", [2]int{cfg.Width, cfg.Height}, [2]int{256, 128})
+
+	//garbage input is rejected
+	_, err = ParseUserPhoto([]byte("not an image"), ref)
+	assert.DeepEqual(t, "error for garbage input", err, ref.Wrap(errNotPhoto))
+
+	//PNG photos cannot be stored directly
+	assert.DeepEqual(t, "MustBeUserPhoto on PNG", MustBeUserPhoto(buf.Bytes()), errNotJPEGPhoto)
+	assert.DeepEqual(t, "MustBeUserPhoto on empty photo", MustBeUserPhoto(nil), nil)
+}
@@ -0,0 +1,89 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// PosixDefaults contains default values for the POSIX attributes of users.
+// They are filled in by the web GUI and the control API when a user has POSIX
+// attributes, but the respective fields were left empty.
+type PosixDefaults struct {
+	HomeDirectoryTemplate *template.Template //from PORTUNUS_POSIX_HOME_TEMPLATE
+	LoginShell            string             //from PORTUNUS_POSIX_DEFAULT_SHELL
+}
+
+// ReadPosixDefaultsFromEnvironment builds a PosixDefaults from the respective
+// environment variables.
+func ReadPosixDefaultsFromEnvironment() (*PosixDefaults, error) {
+	return NewPosixDefaults(os.Getenv("PORTUNUS_POSIX_HOME_TEMPLATE"), os.Getenv("PORTUNUS_POSIX_DEFAULT_SHELL"))
+}
+
+// NewPosixDefaults builds a PosixDefaults. The home directory template uses
+// the syntax of the text/template package, and is executed with the User as
+// its data, e.g. "/home/{{.LoginName}}". Either argument may be empty if the
+// respective field shall not have a default value.
+func NewPosixDefaults(homeDirectoryTemplate, loginShell string) (*PosixDefaults, error) {
+	var d PosixDefaults
+	if homeDirectoryTemplate != "" {
+		tmpl, err := template.New("home").Parse(homeDirectoryTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("malformed value for PORTUNUS_POSIX_HOME_TEMPLATE: %w", err)
+		}
+		d.HomeDirectoryTemplate = tmpl
+
+		//some errors (e.g. references to nonexistent fields) only show up during
+		//execution, so we do a trial run now to report them at startup
+		_, err = d.HomeDirectoryFor(User{LoginName: "example"})
+		if err != nil {
+			return nil, fmt.Errorf("malformed value for PORTUNUS_POSIX_HOME_TEMPLATE: %w", err)
+		}
+	}
+
+	err := MustBeAbsolutePath(loginShell)
+	if err != nil {
+		return nil, fmt.Errorf("malformed value for PORTUNUS_POSIX_DEFAULT_SHELL: %q %w", loginShell, err)
+	}
+	d.LoginShell = loginShell
+
+	return &d, nil
+}
+
+// HomeDirectoryFor renders the home directory template for the given user.
+// If no template is configured, the empty string is returned.
+func (d PosixDefaults) HomeDirectoryFor(u User) (string, error) {
+	if d.HomeDirectoryTemplate == nil {
+		return "", nil
+	}
+	var buf strings.Builder
+	err := d.HomeDirectoryTemplate.Execute(&buf, u)
+	return buf.String(), err
+}
+
+// ApplyTo fills in the default values for all empty POSIX attributes of the
+// given user. Users without POSIX attributes are not changed. The result is
+// not validated here; that happens in Database.Validate() as usual.
+func (d PosixDefaults) ApplyTo(u *User) error {
+	if u.POSIX == nil {
+		return nil
+	}
+	if u.POSIX.HomeDirectory == "" {
+		homeDirectory, err := d.HomeDirectoryFor(*u)
+		if err != nil {
+			return u.Ref().Field("posix_home").Wrap(err)
+		}
+		u.POSIX.HomeDirectory = homeDirectory
+	}
+	if u.POSIX.LoginShell == "" {
+		u.POSIX.LoginShell = d.LoginShell
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ProxyAuthSecretHeader is the name of the request header that an
+// authenticating reverse proxy must set to the shared secret from
+// PORTUNUS_SERVER_PROXY_AUTH_SECRET.
+const ProxyAuthSecretHeader = "X-Portunus-Proxy-Secret"
+
+// ProxyAuthConfig describes how to trust an authenticating reverse proxy
+// (e.g. an SSO gateway) that puts the identity of the logged-in user into a
+// request header. Headers are only trusted if the request comes directly from
+// one of the trusted networks, and if it carries the shared secret.
+type ProxyAuthConfig struct {
+	UserHeader           string       //from PORTUNUS_SERVER_PROXY_AUTH_HEADER
+	TrustedNetworks      []*net.IPNet //from PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS
+	Secret               string       //from PORTUNUS_SERVER_PROXY_AUTH_SECRET
+	LogoutURL            string       //from PORTUNUS_SERVER_PROXY_AUTH_LOGOUT_URL
+	SkipOldPasswordCheck bool         //from PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK
+	LoginNameSuffix      string       //from PORTUNUS_SERVER_LOGIN_NAME_SUFFIX (see MatchUserIdent)
+}
+
+// ReadProxyAuthConfigFromEnvironment builds a ProxyAuthConfig from the
+// respective environment variables. If PORTUNUS_SERVER_PROXY_AUTH_HEADER is not
+// set, authentication through a proxy is disabled and nil is returned.
+func ReadProxyAuthConfigFromEnvironment() (*ProxyAuthConfig, error) {
+	userHeader := os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_HEADER")
+	if userHeader == "" {
+		return nil, nil
+	}
+	cfg, err := NewProxyAuthConfig(userHeader, os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS"), os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_SECRET"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.LogoutURL = os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_LOGOUT_URL")
+	cfg.SkipOldPasswordCheck = os.Getenv("PORTUNUS_SERVER_PROXY_AUTH_SKIP_OLD_PASSWORD_CHECK") == "true"
+	cfg.LoginNameSuffix = os.Getenv("PORTUNUS_SERVER_LOGIN_NAME_SUFFIX")
+	return cfg, nil
+}
+
+// NewProxyAuthConfig builds a ProxyAuthConfig. The list of trusted networks
+// contains IP addresses or CIDR ranges, separated by commas or whitespace.
+func NewProxyAuthConfig(userHeader, trustedNetworks, secret string) (*ProxyAuthConfig, error) {
+	cfg := ProxyAuthConfig{
+		UserHeader: http.CanonicalHeaderKey(userHeader),
+		Secret:     secret,
+	}
+	if secret == "" {
+		return nil, errors.New("PORTUNUS_SERVER_PROXY_AUTH_SECRET must be set when PORTUNUS_SERVER_PROXY_AUTH_HEADER is set")
+	}
+
+	var err error
+	cfg.TrustedNetworks, err = parseNetworkList(trustedNetworks, "PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.TrustedNetworks) == 0 {
+		return nil, errors.New("PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS must be set when PORTUNUS_SERVER_PROXY_AUTH_HEADER is set")
+	}
+
+	return &cfg, nil
+}
+
+// Authenticate checks whether the given request carries the identity of a
+// user that was authenticated by the proxy. The header value may be either a
+// login name or an email address, just like on the login form (see
+// FindUserByIdent).
+//
+// If the request does not carry the user header at all, false is returned
+// without an error, and the request shall go through the regular login flow.
+// If the header is present, but cannot be trusted or does not identify a
+// usable account, an error is returned. The regular login flow may still be
+// used in that case.
+func (c ProxyAuthConfig) Authenticate(r *http.Request, n Nexus) (UserWithPerms, bool, error) {
+	userIdent := r.Header.Get(c.UserHeader)
+	if userIdent == "" {
+		return UserWithPerms{}, false, nil
+	}
+
+	//only the proxy itself is trusted to set the header (we look at the actual
+	//peer address here, not at any X-Forwarded-For headers, since those could
+	//be spoofed as well)
+	host := peerAddressOf(r)
+	if !networksContain(c.TrustedNetworks, net.ParseIP(host)) {
+		return UserWithPerms{}, false, fmt.Errorf("ignoring %s header from untrusted address %s", c.UserHeader, host)
+	}
+	secret := r.Header.Get(ProxyAuthSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) != 1 {
+		return UserWithPerms{}, false, fmt.Errorf("ignoring %s header from %s because %s is missing or wrong", c.UserHeader, host, ProxyAuthSecretHeader)
+	}
+
+	user, exists := FindUserByIdent(n, userIdent, c.LoginNameSuffix)
+	if !exists {
+		return UserWithPerms{}, false, fmt.Errorf("user %q was authenticated by the proxy, but does not exist in Portunus", userIdent)
+	}
+	if user.IsExpiredAt(time.Now()) {
+		return UserWithPerms{}, false, fmt.Errorf("user %q was authenticated by the proxy, but their account has expired", userIdent)
+	}
+	return user, true, nil
+}
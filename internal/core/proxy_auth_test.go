@@ -0,0 +1,143 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestNewProxyAuthConfig(t *testing.T) {
+	cfg, err := NewProxyAuthConfig("x-remote-user", "10.0.0.0/8, 192.168.1.1 ::1", "swordfish")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "UserHeader", cfg.UserHeader, "X-Remote-User")
+	var networks []string
+	for _, network := range cfg.TrustedNetworks {
+		networks = append(networks, network.String())
+	}
+	assert.DeepEqual(t, "TrustedNetworks", networks, []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"})
+
+	_, err = NewProxyAuthConfig("X-Remote-User", "10.0.0.0/8", "")
+	assert.DeepEqual(t, "error without secret", err.Error(),
+		"PORTUNUS_SERVER_PROXY_AUTH_SECRET must be set when PORTUNUS_SERVER_PROXY_AUTH_HEADER is set")
+	_, err = NewProxyAuthConfig("X-Remote-User", "", "swordfish")
+	assert.DeepEqual(t, "error without trusted networks", err.Error(),
+		"PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS must be set when PORTUNUS_SERVER_PROXY_AUTH_HEADER is set")
+	_, err = NewProxyAuthConfig("X-Remote-User", "10.0.0.0/33", "swordfish")
+	assert.DeepEqual(t, "error for malformed network", err.Error(),
+		"malformed value for PORTUNUS_SERVER_PROXY_AUTH_TRUSTED_NETWORKS: invalid CIDR address: 10.0.0.0/33")
+}
+
+func TestProxyAuthenticate(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expiredAt := time.Now().Add(-time.Hour)
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", EMailAddress: "jane@example.org"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", ValidUntil: &expiredAt},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	cfg, err := NewProxyAuthConfig("X-Remote-User", "10.0.0.0/8", "swordfish")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	type testCase struct {
+		Desc          string
+		RemoteAddr    string
+		UserHeader    string
+		SecretHeader  string
+		ExpectedUser  string
+		ExpectedError string
+	}
+	testCases := []testCase{
+		{
+			//requests without the header use the regular login flow
+			Desc:       "no header",
+			RemoteAddr: "10.0.0.1:1234",
+		},
+		{
+			Desc:         "login name",
+			RemoteAddr:   "10.0.0.1:1234",
+			UserHeader:   "jane",
+			SecretHeader: "swordfish",
+			ExpectedUser: "jane",
+		},
+		{
+			Desc:         "email address",
+			RemoteAddr:   "10.0.0.1:1234",
+			UserHeader:   "jane@example.org",
+			SecretHeader: "swordfish",
+			ExpectedUser: "jane",
+		},
+		{
+			//someone talking to Portunus directly instead of through the proxy
+			Desc:          "spoofed from untrusted address",
+			RemoteAddr:    "192.168.1.1:1234",
+			UserHeader:    "jane",
+			SecretHeader:  "swordfish",
+			ExpectedError: "ignoring X-Remote-User header from untrusted address 192.168.1.1",
+		},
+		{
+			//someone within the trusted network that is not the proxy
+			Desc:          "spoofed without secret",
+			RemoteAddr:    "10.0.0.2:1234",
+			UserHeader:    "jane",
+			ExpectedError: "ignoring X-Remote-User header from 10.0.0.2 because X-Portunus-Proxy-Secret is missing or wrong",
+		},
+		{
+			Desc:          "spoofed with wrong secret",
+			RemoteAddr:    "10.0.0.2:1234",
+			UserHeader:    "jane",
+			SecretHeader:  "hunter2",
+			ExpectedError: "ignoring X-Remote-User header from 10.0.0.2 because X-Portunus-Proxy-Secret is missing or wrong",
+		},
+		{
+			Desc:          "missing user",
+			RemoteAddr:    "10.0.0.1:1234",
+			UserHeader:    "jim",
+			SecretHeader:  "swordfish",
+			ExpectedError: `user "jim" was authenticated by the proxy, but does not exist in Portunus`,
+		},
+		{
+			Desc:          "expired user",
+			RemoteAddr:    "10.0.0.1:1234",
+			UserHeader:    "john",
+			SecretHeader:  "swordfish",
+			ExpectedError: `user "john" was authenticated by the proxy, but their account has expired`,
+		},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/self", nil)
+		r.RemoteAddr = tc.RemoteAddr
+		if tc.UserHeader != "" {
+			r.Header.Set("X-Remote-User", tc.UserHeader)
+		}
+		if tc.SecretHeader != "" {
+			r.Header.Set(ProxyAuthSecretHeader, tc.SecretHeader)
+		}
+
+		user, ok, err := cfg.Authenticate(r, nexus)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		assert.DeepEqual(t, "error for "+tc.Desc, errMsg, tc.ExpectedError)
+		assert.DeepEqual(t, "ok for "+tc.Desc, ok, tc.ExpectedUser != "")
+		assert.DeepEqual(t, "user for "+tc.Desc, user.LoginName, tc.ExpectedUser)
+	}
+}
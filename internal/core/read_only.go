@@ -0,0 +1,43 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrReadOnly is returned by Nexus.Update() while read-only mode is enabled
+// (see Nexus.SetReadOnly), unless UpdateOptions.SystemInternal is set.
+var ErrReadOnly = errors.New("no changes can be made while Portunus is in read-only mode")
+
+// ReadOnlyState describes why read-only mode was enabled. While it is
+// enabled, the database can be viewed, but not changed. This is useful to
+// freeze the directory during maintenance, e.g. while migrating the LDAP
+// server.
+type ReadOnlyState struct {
+	//login name of the admin who enabled read-only mode, or empty if it was
+	//enabled through PORTUNUS_SERVER_READ_ONLY
+	EnabledBy string
+	Reason    string
+	EnabledAt time.Time
+}
+
+// ReadOnlyStateFromEnvironment returns the read-only state that
+// portunus-server starts with. This is nil unless PORTUNUS_SERVER_READ_ONLY
+// is set. Read-only mode can be toggled at runtime in the web GUI, but such
+// changes do not persist across restarts.
+func ReadOnlyStateFromEnvironment() *ReadOnlyState {
+	if os.Getenv("PORTUNUS_SERVER_READ_ONLY") != "true" {
+		return nil
+	}
+	return &ReadOnlyState{
+		Reason:    "enabled through PORTUNUS_SERVER_READ_ONLY",
+		EnabledAt: time.Now(),
+	}
+}
@@ -0,0 +1,69 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	var actualDB Database
+	nexus.AddListener(ctx, func(db Database) {
+		actualDB = db
+	})
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{{LoginName: "minuser", GivenName: "Minimal", FamilyName: "User"}}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	counter := 0
+	rename := func(name string) UpdateAction {
+		return func(db *Database) errext.ErrorSet {
+			db.Users[0].GivenName = name
+			counter++
+			return nil
+		}
+	}
+
+	//while read-only mode is enabled, normal updates are refused without running the action
+	nexus.SetReadOnly(&ReadOnlyState{EnabledBy: "jane", Reason: "LDAP migration", EnabledAt: time.Now()})
+	assert.DeepEqual(t, "enabled by", nexus.ReadOnly().EnabledBy, "jane")
+	errs = nexus.Update(rename("Changed"), nil)
+	assert.DeepEqual(t, "number of errors", len(errs), 1)
+	assert.DeepEqual(t, "error is ErrReadOnly", errors.Is(errs[0], ErrReadOnly), true)
+	assert.DeepEqual(t, "run counter", counter, 0)
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].GivenName, "Minimal")
+
+	//dry runs still work since they do not change anything
+	errs = nexus.Update(rename("Changed"), &UpdateOptions{DryRun: true})
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "run counter", counter, 1)
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].GivenName, "Minimal")
+
+	//system-internal updates (e.g. reloading the database from disk) are not affected
+	errs = nexus.Update(rename("Internal"), &UpdateOptions{SystemInternal: true})
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].GivenName, "Internal")
+
+	//after disabling read-only mode, normal updates work again
+	nexus.SetReadOnly(nil)
+	assert.DeepEqual(t, "read-only state", nexus.ReadOnly(), (*ReadOnlyState)(nil))
+	errs = nexus.Update(rename("Changed"), nil)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].GivenName, "Changed")
+}
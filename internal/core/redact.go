@@ -0,0 +1,96 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RedactedValue replaces the values of secret fields in the output of
+// RedactObject (and of password changes in FieldChange).
+const RedactedValue = "(redacted)"
+
+// The fields that RedactObject shows as they are, identified like in type
+// FieldChange. A trailing "*" matches all fields below the respective path.
+//
+// This is deliberately an allowlist: When a field is added to one of these
+// types, it stays redacted until it is added here.
+var unredactedFields = map[string][]string{
+	"user": {
+		"login_name", "given_name", "family_name", "family_name_first",
+		"email", "phone", "mobile_phone", "department", "preferred_language",
+		"timezone", "ssh_public_keys",
+		"posix.uid", "posix.gid", "posix.home", "posix.shell", "posix.gecos",
+		"extra_attributes.*", "must_change_password", "invitation.expires_at",
+		"valid_until", "photo", "former_login_names",
+	},
+	"group": {
+		"name", "long_name", "description", "url", "members", "owners",
+		"permissions.portunus.is_admin", "permissions.portunus.can_view",
+		"permissions.portunus.can_browse", "permissions.ldap.can_read",
+		"posix_gid", "hide_from_member_of",
+		"elevation.approver_group", "elevation.max_hours", "elevation.required_approvals",
+	},
+	"service user": {
+		"name", "description",
+	},
+}
+
+// RedactObject returns the JSON representation of the given user, group or
+// service user, with the values of all secret fields (like password hashes)
+// replaced by RedactedValue. Fields without a value are shown as they are, so
+// that it is still visible whether e.g. a password has been set.
+//
+// This is the only place that decides what counts as a secret, so this must
+// be used whenever a full object is shown to someone who could not obtain the
+// full database export anyway.
+func RedactObject[T Object[T]](obj T) map[string]any {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		//cannot happen for our own types
+		panic(err.Error())
+	}
+	var data map[string]any
+	err = json.Unmarshal(buf, &data)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	objectType := any(obj).(interface{ Ref() ObjectRef }).Ref().Type
+	redactInto(data, "", unredactedFields[objectType])
+	return data
+}
+
+// FlattenRedactedObject converts the output of RedactObject into a flat map
+// of field paths to JSON-encoded values, like in type FieldChange.
+func FlattenRedactedObject(data map[string]any) map[string]string {
+	return flattenObject(data)
+}
+
+func redactInto(data map[string]any, prefix string, allowlist []string) {
+	for key, value := range data {
+		path := prefix + key
+		if nested, ok := value.(map[string]any); ok {
+			redactInto(nested, path+".", allowlist)
+			continue
+		}
+		if value != nil && value != "" && !isUnredactedField(path, allowlist) {
+			data[key] = RedactedValue
+		}
+	}
+}
+
+func isUnredactedField(path string, allowlist []string) bool {
+	for _, pattern := range allowlist {
+		prefix, isWildcard := strings.CutSuffix(pattern, "*")
+		if path == pattern || (isWildcard && strings.HasPrefix(path, prefix)) {
+			return true
+		}
+	}
+	return false
+}
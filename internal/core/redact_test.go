@@ -0,0 +1,128 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+// All fields that RedactObject must not reveal. When a field is added to one
+// of the object types, this test fails until the field is either added to
+// unredactedFields or listed here.
+var knownSecretFields = map[string][]string{
+	"user":         {"password", "invitation.token_hash"},
+	"group":        nil,
+	"service user": {"password"},
+}
+
+func TestRedactObject(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	gid := PosixID(100)
+	user := User{
+		LoginName:       "jane",
+		GivenName:       "Jane",
+		FamilyName:      "Doe",
+		EMailAddress:    "jane@example.org",
+		SSHPublicKeys:   []SSHKey{{Key: "ssh-ed25519 AAAA", Comment: "laptop"}},
+		Phone:           "+1 555 0100",
+		MobilePhone:     "+1 555 0101",
+		FamilyNameFirst: true,
+		PasswordHash:    "{SSHA}secrethash",
+		POSIX: &UserPosixAttributes{
+			UID:           1000,
+			GID:           100,
+			HomeDirectory: "/home/jane",
+			LoginShell:    "/bin/zsh",
+			GECOS:         "Jane Doe",
+		},
+		ExtraAttributes:    map[string][]string{"mail": {"jane@example.com"}},
+		MustChangePassword: true,
+		Invitation:         &UserInvitation{TokenHash: "secrettokenhash", ExpiresAt: now},
+		ValidUntil:         &now,
+		Photo:              []byte("photo"),
+		Department:         "Sales",
+		FormerLoginNames:   []FormerLoginName{{LoginName: "jdoe", RenamedAt: now}},
+	}
+	group := Group{
+		Name:             "admins",
+		LongName:         "Administrators",
+		Description:      "Full access",
+		URL:              "https://example.org/admins",
+		MemberLoginNames: GroupMemberNames{"jane": true},
+		Permissions: Permissions{
+			Portunus: PortunusPermissions{IsAdmin: true, CanView: true, CanBrowse: true},
+			LDAP:     LDAPPermissions{CanRead: true},
+		},
+		PosixGID:         &gid,
+		HideFromMemberOf: true,
+		Elevation:        &ElevationPolicy{ApproverGroupName: "approvers", MaxHours: 8, RequiredApprovals: 2},
+		Owners:           []string{"jane"},
+	}
+	serviceUser := ServiceUser{
+		Name:         "backup",
+		Description:  "Backup agent",
+		PasswordHash: "{SSHA}secrethash",
+	}
+
+	checkRedaction(t, "user", user, RedactObject(user))
+	checkRedaction(t, "group", group, RedactObject(group))
+	checkRedaction(t, "service user", serviceUser, RedactObject(serviceUser))
+
+	//empty secrets are shown as they are
+	redacted := RedactObject(ServiceUser{Name: "backup"})
+	assert.DeepEqual(t, "redacted empty password", redacted["password"], any(""))
+}
+
+func checkRedaction(t *testing.T, objectType string, original any, redacted map[string]any) {
+	t.Helper()
+	originalFields := flattenObject(original)
+	redactedFields := flattenObject(redacted)
+	assert.DeepEqual(t, "number of fields in redacted "+objectType, len(redactedFields), len(originalFields))
+
+	isSecret := make(map[string]bool)
+	for _, path := range knownSecretFields[objectType] {
+		isSecret[path] = true
+		if _, exists := originalFields[path]; !exists {
+			t.Errorf("%s fixture does not fill the secret field %q", objectType, path)
+		}
+	}
+	for path, value := range originalFields {
+		if value == "" || value == `""` || value == "null" {
+			t.Errorf("%s fixture does not fill the field %q", objectType, path)
+		}
+		switch {
+		case isSecret[path]:
+			assert.DeepEqual(t, "redacted "+objectType+" field "+path, redactedFields[path], `"(redacted)"`)
+		case isUnredactedField(path, unredactedFields[objectType]):
+			assert.DeepEqual(t, "redacted "+objectType+" field "+path, redactedFields[path], value)
+		default:
+			t.Errorf("%s field %q is neither in unredactedFields nor in knownSecretFields", objectType, path)
+		}
+	}
+}
+
+func TestRedactUnknownFields(t *testing.T) {
+	//fields that are not on the allowlist are redacted even if nobody thought
+	//of them as secret
+	data := map[string]any{
+		"name":      "backup",
+		"new_token": "secret",
+		"nested":    map[string]any{"value": 42.0},
+		"unset":     nil,
+	}
+	redactInto(data, "", unredactedFields["service user"])
+	buf, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "redacted data", string(buf),
+		`{"name":"backup","nested":{"value":"(redacted)"},"new_token":"(redacted)","unset":null}`)
+}
@@ -0,0 +1,157 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FormerLoginName appears in type User. It records a login name that the
+// user had before it was renamed with Database.RenameUser().
+type FormerLoginName struct {
+	LoginName string    `json:"login_name"`
+	RenamedAt time.Time `json:"renamed_at"`
+	RenamedBy string    `json:"renamed_by,omitempty"` //login name of the admin, or empty if not known
+	//The record is dropped at this time. Until then, creating another user
+	//with this login name is allowed, but the admin is warned about it.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var errRenameToSameName = errors.New("is identical to the current name")
+
+// RenameUser changes the login name of the given user, and updates its group
+// memberships and group ownerships accordingly. Everything else about the
+// user is kept as it is. The old login name is recorded in
+// User.FormerLoginNames until the given retention period has passed.
+//
+// Uniqueness of the new login name is not checked here, since the Nexus
+// checks it anyway when validating the updated database.
+func (d *Database) RenameUser(oldLoginName, newLoginName, actor string, now time.Time, retention time.Duration) error {
+	userIdx := -1
+	for idx, user := range d.Users {
+		if user.LoginName == oldLoginName {
+			userIdx = idx
+		}
+	}
+	if userIdx < 0 {
+		return errNoSuchObject
+	}
+	user := &d.Users[userIdx]
+	if newLoginName == oldLoginName {
+		return user.Ref().Field("login_name").Wrap(errRenameToSameName)
+	}
+
+	//when renaming back to a former login name, that name is not former anymore
+	user.FormerLoginNames = slices.DeleteFunc(slices.Clone(user.FormerLoginNames), func(f FormerLoginName) bool {
+		return f.LoginName == newLoginName
+	})
+	user.FormerLoginNames = append(user.FormerLoginNames, FormerLoginName{
+		LoginName: oldLoginName,
+		RenamedAt: now,
+		RenamedBy: actor,
+		ExpiresAt: now.Add(retention),
+	})
+	user.LoginName = newLoginName
+
+	for idx, group := range d.Groups {
+		if group.MemberLoginNames[oldLoginName] {
+			delete(group.MemberLoginNames, oldLoginName)
+			group.MemberLoginNames[newLoginName] = true
+		}
+		if group.IsOwnedBy(oldLoginName) {
+			d.Groups[idx].Owners = slices.Clone(group.Owners)
+			for ownerIdx, owner := range d.Groups[idx].Owners {
+				if owner == oldLoginName {
+					d.Groups[idx].Owners[ownerIdx] = newLoginName
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RenameGroup changes the name of the given group. Elevation policies that
+// name this group as their approver group are updated accordingly, and so
+// are the tombstones of deleted users who were members or owners of this
+// group, so that restoring them still adds them back to it. Everything else
+// about the group is kept as it is.
+//
+// Uniqueness of the new group name is not checked here, since the Nexus
+// checks it anyway when validating the updated database.
+func (d *Database) RenameGroup(oldName, newName string) error {
+	groupIdx := -1
+	for idx, group := range d.Groups {
+		if group.Name == oldName {
+			groupIdx = idx
+		}
+	}
+	if groupIdx < 0 {
+		return errNoSuchObject
+	}
+	if newName == oldName {
+		return d.Groups[groupIdx].Ref().Field("name").Wrap(errRenameToSameName)
+	}
+	d.Groups[groupIdx].Name = newName
+
+	for _, group := range d.Groups {
+		if group.Elevation != nil && group.Elevation.ApproverGroupName == oldName {
+			group.Elevation.ApproverGroupName = newName
+		}
+	}
+	replaceName := func(names []string) []string {
+		if !slices.Contains(names, oldName) {
+			return names
+		}
+		names = slices.Clone(names)
+		for idx, name := range names {
+			if name == oldName {
+				names[idx] = newName
+			}
+		}
+		return names
+	}
+	for idx, tombstone := range d.DeletedUsers {
+		d.DeletedUsers[idx].GroupNames = replaceName(tombstone.GroupNames)
+		d.DeletedUsers[idx].OwnedGroupNames = replaceName(tombstone.OwnedGroupNames)
+	}
+	return nil
+}
+
+// FindFormerOwnerOfLoginName returns the user who had the given login name
+// before being renamed, if that rename has not expired yet (see
+// User.FormerLoginNames). Login names are compared case-insensitively, same
+// as in MatchUserIdent().
+func (d Database) FindFormerOwnerOfLoginName(loginName string, now time.Time) (User, FormerLoginName, bool) {
+	for _, user := range d.Users {
+		for _, former := range user.FormerLoginNames {
+			if strings.EqualFold(former.LoginName, loginName) && now.Before(former.ExpiresAt) {
+				return user, former, true
+			}
+		}
+	}
+	return User{}, FormerLoginName{}, false
+}
+
+// Part of Database.Normalize(): Drops FormerLoginNames whose retention period
+// has passed.
+func (d *Database) purgeFormerLoginNames(now time.Time) {
+	for idx, user := range d.Users {
+		if len(user.FormerLoginNames) == 0 {
+			continue
+		}
+		kept := slices.DeleteFunc(slices.Clone(user.FormerLoginNames), func(f FormerLoginName) bool {
+			return !now.Before(f.ExpiresAt)
+		})
+		if len(kept) == 0 {
+			kept = nil
+		}
+		d.Users[idx].FormerLoginNames = kept
+	}
+}
@@ -0,0 +1,124 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRenameUserAndGroup(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison", PasswordHash: "{SSHA}alice", EMailAddress: "alice@example.org"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Administrators", MemberLoginNames: GroupMemberNames{"alice": true, "bob": true}, Owners: []string{"alice"}},
+			{Name: "developers", LongName: "Developers", MemberLoginNames: GroupMemberNames{"bob": true}, Owners: []string{"alice", "bob"}},
+			{Name: "operators", LongName: "Operators", MemberLoginNames: GroupMemberNames{"alice": true},
+				Elevation: &ElevationPolicy{ApproverGroupName: "admins", MaxHours: 8, RequiredApprovals: 1}},
+		}
+		return nil
+	}, nil))
+
+	//renaming a user keeps all its attributes, memberships and ownerships
+	renamedAt := time.Now()
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("alice", "alison", "bob", renamedAt, time.Hour))
+		return
+	}, nil))
+	_, exists := nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice exists after rename", exists, false)
+	user, exists := nexus.FindUser(func(u User) bool { return u.LoginName == "alison" })
+	assert.DeepEqual(t, "alison exists after rename", exists, true)
+	assert.DeepEqual(t, "alison.PasswordHash", user.PasswordHash, "{SSHA}alice")
+	assert.DeepEqual(t, "alison.EMailAddress", user.EMailAddress, "alice@example.org")
+	assert.DeepEqual(t, "alison.FormerLoginNames", user.FormerLoginNames, []FormerLoginName{
+		{LoginName: "alice", RenamedAt: renamedAt, RenamedBy: "bob", ExpiresAt: renamedAt.Add(time.Hour)},
+	})
+	groups := nexus.ListGroups()
+	assert.DeepEqual(t, "admins.MemberLoginNames", groups[0].MemberLoginNames, GroupMemberNames{"alison": true, "bob": true})
+	assert.DeepEqual(t, "admins.Owners", groups[0].Owners, []string{"alison"})
+	assert.DeepEqual(t, "developers.Owners", groups[1].Owners, []string{"alison", "bob"})
+	assert.DeepEqual(t, "operators.MemberLoginNames", groups[2].MemberLoginNames, GroupMemberNames{"alison": true})
+
+	//the former login name can be looked up until it expires
+	expectFormerOwner := func(loginName string, now time.Time, expected string) {
+		t.Helper()
+		var actual string
+		expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+			user, _, exists := db.FindFormerOwnerOfLoginName(loginName, now)
+			if exists {
+				actual = user.LoginName
+			}
+			return nil
+		}, &UpdateOptions{DryRun: true}))
+		assert.DeepEqual(t, "former owner of "+loginName, actual, expected)
+	}
+	expectFormerOwner("Alice", renamedAt, "alison")
+	expectFormerOwner("alice", renamedAt.Add(2*time.Hour), "")
+	expectFormerOwner("bob", renamedAt, "")
+
+	//renaming fails if the new login name is taken, or if nothing would change
+	expectTheseErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("alison", "bob", "bob", time.Now(), time.Hour))
+		return
+	}, nil),
+		`field "login_name" in user "bob" is already in use`,
+	)
+	expectTheseErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("alison", "alison", "bob", time.Now(), time.Hour))
+		errs.Add(db.RenameGroup("admins", "admins"))
+		return
+	}, nil),
+		`field "login_name" in user "alison" is identical to the current name`,
+		`field "name" in group "admins" is identical to the current name`,
+	)
+
+	//renaming back to the former login name drops it from the list of former names
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("alison", "alice", "bob", renamedAt, time.Hour))
+		return
+	}, nil))
+	user, _ = nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice.FormerLoginNames", user.FormerLoginNames, []FormerLoginName{
+		{LoginName: "alison", RenamedAt: renamedAt, RenamedBy: "bob", ExpiresAt: renamedAt.Add(time.Hour)},
+	})
+
+	//renaming a group keeps its members, and updates references from elevation
+	//policies and from tombstones of deleted users
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteUser("bob", "alice", time.Now(), time.Hour))
+		return
+	}, nil))
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameGroup("admins", "superusers"))
+		return
+	}, nil))
+	group, exists := nexus.FindGroup(func(g Group) bool { return g.Name == "superusers" })
+	assert.DeepEqual(t, "superusers exists after rename", exists, true)
+	assert.DeepEqual(t, "superusers.LongName", group.LongName, "Administrators")
+	assert.DeepEqual(t, "superusers.MemberLoginNames", group.MemberLoginNames, GroupMemberNames{"alice": true})
+	group, _ = nexus.FindGroup(func(g Group) bool { return g.Name == "operators" })
+	assert.DeepEqual(t, "operators.Elevation.ApproverGroupName", group.Elevation.ApproverGroupName, "superusers")
+	tombstone := nexus.ListDeletedUsers()[0]
+	assert.DeepEqual(t, "tombstone.GroupNames", tombstone.GroupNames, []string{"superusers", "developers"})
+	assert.DeepEqual(t, "tombstone.OwnedGroupNames", tombstone.OwnedGroupNames, []string{"developers"})
+
+	//renaming fails if the new group name is taken
+	expectTheseErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameGroup("developers", "operators"))
+		return
+	}, nil),
+		`field "name" in group "operators" is already in use`,
+	)
+}
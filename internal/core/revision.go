@@ -0,0 +1,53 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// ErrConcurrentModification is returned by UpdateActions that edit an object
+// which has changed since the editor last looked at it, as determined by
+// UserRevision() or GroupRevision().
+var ErrConcurrentModification = errors.New("this object was modified by someone else in the meantime; please review the current values and try again")
+
+// UserRevision returns an opaque value that changes whenever the given user
+// or their group memberships change. The given list of groups must include at
+// least all groups that the user is a member of.
+func UserRevision(u User, groups []Group) string {
+	var memberships []string
+	for _, g := range groups {
+		if g.ContainsUser(u) {
+			memberships = append(memberships, g.Name)
+		}
+	}
+	sort.Strings(memberships)
+
+	return computeRevision(struct {
+		User        User     `json:"user"`
+		Memberships []string `json:"memberships"`
+	}{u, memberships})
+}
+
+// GroupRevision returns an opaque value that changes whenever the given group
+// changes, including changes to its list of members.
+func GroupRevision(g Group) string {
+	return computeRevision(g)
+}
+
+func computeRevision(data any) string {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		panic(err.Error()) //cannot happen for the types that we use
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:16])
+}
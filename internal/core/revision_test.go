@@ -0,0 +1,80 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRevisions(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Admins", MemberLoginNames: GroupMemberNames{"jane": true}},
+			{Name: "operators", LongName: "Operators"},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//This mirrors how the web GUI obtains revisions: The form is rendered with
+	//revisions of objects from the query functions, and the submission compares
+	//them against revisions of objects within an UpdateAction.
+	getRevisions := func() (jane, john, admins, operators string) {
+		findUser := func(name string) User {
+			u, _ := nexus.FindUser(func(u User) bool { return u.LoginName == name })
+			return u.User
+		}
+		findGroup := func(name string) Group {
+			g, _ := nexus.FindGroup(func(g Group) bool { return g.Name == name })
+			return g
+		}
+		groups := nexus.ListGroups()
+		return UserRevision(findUser("jane"), groups), UserRevision(findUser("john"), groups),
+			GroupRevision(findGroup("admins")), GroupRevision(findGroup("operators"))
+	}
+	jane1, john1, admins1, operators1 := getRevisions()
+
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		jane, _ := db.Users.Find(func(u User) bool { return u.LoginName == "jane" })
+		operators, _ := db.Groups.Find(func(g Group) bool { return g.Name == "operators" })
+		assert.DeepEqual(t, "user revision within UpdateAction", UserRevision(jane, db.Groups), jane1)
+		assert.DeepEqual(t, "group revision within UpdateAction", GroupRevision(operators), operators1)
+		return nil
+	}, &UpdateOptions{DryRun: true})
+	expectNoErrors(t, errs)
+
+	//adding John to a group changes his revision and that of the group, but
+	//not those of the unrelated user and group
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[1].MemberLoginNames["john"] = true
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	jane2, john2, admins2, operators2 := getRevisions()
+	assert.DeepEqual(t, "jane unchanged", jane2, jane1)
+	assert.DeepEqual(t, "john changed", john2 != john1, true)
+	assert.DeepEqual(t, "admins unchanged", admins2, admins1)
+	assert.DeepEqual(t, "operators changed", operators2 != operators1, true)
+
+	//changing an attribute of a user changes their revision
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].EMailAddress = "jane@example.org"
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	jane3, john3, _, _ := getRevisions()
+	assert.DeepEqual(t, "jane changed", jane3 != jane2, true)
+	assert.DeepEqual(t, "john unchanged", john3, john2)
+}
@@ -15,7 +15,9 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/sapcc/go-bits/errext"
@@ -26,38 +28,58 @@ import (
 // type DatabaseSeed
 
 // DatabaseSeed contains the contents of the seed file, if there is one.
+// When multiple seed files are used, this contains the merged contents of all
+// of them (see ReadDatabaseSeeds).
 type DatabaseSeed struct {
-	Groups []GroupSeed `json:"groups"`
-	Users  []UserSeed  `json:"users"`
+	Groups       []GroupSeed       `json:"groups"`
+	Users        []UserSeed        `json:"users"`
+	ServiceUsers []ServiceUserSeed `json:"service_users"`
+	//only allowed in the primary seed
+	Delegations    []SeedScope     `json:"delegations,omitempty"`
+	GroupTemplates []GroupTemplate `json:"group_templates,omitempty"`
+	//only allowed in delegated seeds
+	Scope *SeedScope `json:"scope,omitempty"`
+
+	//When multiple seed files are used, this records which file defines which
+	//object. Keys are e.g. "user:jane" or "group:admins".
+	sourcePaths map[string]string
 }
 
-// ReadDatabaseSeedFromEnvironment reads and validates the file at
+// ReadDatabaseSeedFromEnvironment reads and validates the file(s) at
 // PORTUNUS_SEED_PATH. If that environment variable was not provided, nil is
 // returned instead.
 func ReadDatabaseSeedFromEnvironment(cfg *ValidationConfig) (*DatabaseSeed, errext.ErrorSet) {
-	path := os.Getenv("PORTUNUS_SEED_PATH")
-	if path == "" {
+	pathList := os.Getenv("PORTUNUS_SEED_PATH")
+	if pathList == "" {
 		return nil, nil
 	}
-	return ReadDatabaseSeed(path, cfg)
+	paths, err := expandSeedPaths(pathList)
+	if err != nil {
+		var errs errext.ErrorSet
+		errs.Addf("while reading PORTUNUS_SEED_PATH: %w", err)
+		return nil, errs
+	}
+	return ReadDatabaseSeeds(paths, cfg)
 }
 
 // ReadDatabaseSeed reads and validates the seed file at the given path.
 func ReadDatabaseSeed(path string, cfg *ValidationConfig) (result *DatabaseSeed, errs errext.ErrorSet) {
+	return ReadDatabaseSeeds([]string{path}, cfg)
+}
+
+func parseDatabaseSeed(path string) (*DatabaseSeed, error) {
 	buf, err := os.ReadFile(path)
 	if err != nil {
-		errs.Add(err)
-		return nil, errs
+		return nil, err
 	}
 	dec := json.NewDecoder(bytes.NewReader(buf))
 	dec.DisallowUnknownFields()
 	var seed DatabaseSeed
 	err = dec.Decode(&seed)
 	if err != nil {
-		errs.Addf("while parsing %s: %w", path, err)
-		return nil, errs
+		return nil, fmt.Errorf("while parsing %s: %w", path, err)
 	}
-	return &seed, seed.Validate(cfg)
+	return &seed, nil
 }
 
 // Validate returns an error if the seed contains any invalid or missing values.
@@ -67,6 +89,10 @@ func (d DatabaseSeed) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 	var db Database
 	d.ApplyTo(&db, &NoopHasher{})
 	errs = db.Validate(cfg)
+	if cfg.SharedNamespace {
+		//collisions within the seed are never accepted
+		errs.Append(db.checkSharedNamespace(Database{}))
+	}
 
 	//the duplicate checks must be done differently for seeds because ApplyTo()
 	//will not create duplicate users or groups
@@ -92,6 +118,30 @@ func (d DatabaseSeed) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		}
 	}
 
+	serviceUserNameCounts := make(map[string]int)
+	for _, serviceUserSeed := range d.ServiceUsers {
+		serviceUserNameCounts[string(serviceUserSeed.Name)]++
+	}
+	for name, count := range serviceUserNameCounts {
+		if count > 1 {
+			ref := ServiceUser{Name: name}.Ref()
+			errs.Add(ref.Field("name").Wrap(errIsDuplicateInSeed))
+		}
+	}
+
+	//group templates are not part of the database, so they are validated only here
+	groupTemplateNameCounts := make(map[string]int)
+	for _, template := range d.GroupTemplates {
+		errs.Append(template.validateLocal())
+		groupTemplateNameCounts[template.Name]++
+	}
+	for name, count := range groupTemplateNameCounts {
+		if count > 1 {
+			ref := GroupTemplate{Name: name}.Ref()
+			errs.Add(ref.Field("name").Wrap(errIsDuplicateInSeed))
+		}
+	}
+
 	//non-nil-ness of posix.uid and posix.gid on UserSeeds cannot be checked in
 	//Database.Validate() because those fields are not pointers on type User
 	for _, userSeed := range d.Users {
@@ -148,21 +198,97 @@ func (d DatabaseSeed) ApplyTo(db *Database, hasher crypt.PasswordHasher) {
 		}
 	}
 
+	//same for the service user seeds
+	for _, serviceUserSeed := range d.ServiceUsers {
+		hasServiceUser := false
+		for idx, serviceUser := range db.ServiceUsers {
+			if serviceUser.Name == string(serviceUserSeed.Name) {
+				serviceUserSeed.ApplyTo(&db.ServiceUsers[idx], hasher)
+				hasServiceUser = true
+				break
+			}
+		}
+		if !hasServiceUser {
+			serviceUser := ServiceUser{Name: string(serviceUserSeed.Name)}
+			serviceUserSeed.ApplyTo(&serviceUser, hasher)
+			db.ServiceUsers = append(db.ServiceUsers, serviceUser)
+		}
+	}
+
 	db.Normalize()
 }
 
 var errSeededField = errors.New("must be equal to the seeded value")
 
+// Like errSeededField, but names the seed file that defines the respective
+// object if there are multiple seed files.
+func (d DatabaseSeed) seededFieldError(kind, key string) error {
+	path := d.sourcePaths[kind+":"+key]
+	if path == "" {
+		return errSeededField
+	}
+	return fmt.Errorf("must be equal to the value from seed file %s", path)
+}
+
+// SeededFields returns the fields of the referenced object that are governed
+// by the seed, or nil if the object is not seeded. Fields are identified like
+// in type FieldChange; a path also covers all fields below it (e.g.
+// "extra_attributes" covers "extra_attributes.mail"). If there are multiple
+// seed files, the one that defines the object is returned as well.
+func (d DatabaseSeed) SeededFields(ref ObjectRef) (paths []string, sourcePath string) {
+	switch ref.Type {
+	case "user":
+		for _, u := range d.Users {
+			if string(u.LoginName) == ref.Name {
+				paths = u.seededFields()
+			}
+		}
+		sourcePath = d.sourcePaths["user:"+ref.Name]
+	case "group":
+		for _, g := range d.Groups {
+			if string(g.Name) == ref.Name {
+				paths = g.seededFields()
+			}
+		}
+		sourcePath = d.sourcePaths["group:"+ref.Name]
+	case "service user":
+		for _, s := range d.ServiceUsers {
+			if string(s.Name) == ref.Name {
+				paths = s.seededFields()
+			}
+		}
+		sourcePath = d.sourcePaths["service_user:"+ref.Name]
+	}
+	if paths == nil {
+		return nil, ""
+	}
+	return paths, sourcePath
+}
+
+// Returned by CheckConflicts() when a seeded object does not exist.
+type seededObjectMissingError struct {
+	Object ObjectRef
+}
+
+// Error implements the builtin/error interface.
+func (e seededObjectMissingError) Error() string {
+	return fmt.Sprintf("%s %q is seeded and cannot be deleted", e.Object.Type, e.Object.Name)
+}
+
 // CheckConflicts returns errors for all ways in which the Database deviates
 // from the seed's expectation.
 func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
 	//if there are conflicts, then applying the seed to a copy of the DB will
 	//result in a different DB -- we will call the original DB "left-hand side"
 	//and its clone with the seed applied "right-hand side"
-	leftDB := db
 	rightDB := db.Cloned()
 	d.ApplyTo(&rightDB, hasher) //includes Normalize
+	return d.compareWithSeeded(db, rightDB)
+}
 
+// Returns errors for all differences between `leftDB` and `rightDB` that
+// concern seeded fields, where `rightDB` is `leftDB` with the seed applied.
+func (d DatabaseSeed) compareWithSeeded(leftDB, rightDB Database) (errs errext.ErrorSet) {
 	//NOTE: We do not need to check for users/groups that exist on the left but
 	//not on the right, because seeding only ever creates and updates objects,
 	//but never deletes any objects.
@@ -170,15 +296,22 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 	for _, rightGroup := range rightDB.Groups {
 		leftGroup, exists := leftDB.Groups.Find(func(g Group) bool { return g.Name == rightGroup.Name })
 		if !exists {
-			errs.Addf("group %q is seeded and cannot be deleted", rightGroup.Name)
+			errs.Add(seededObjectMissingError{rightGroup.Ref()})
 			continue
 		}
 
 		ref := leftGroup.Ref()
+		errSeededField := d.seededFieldError("group", leftGroup.Name)
 		if leftGroup.LongName != rightGroup.LongName {
 			errs.Add(ref.Field("long_name").Wrap(errSeededField))
 		}
-		if leftGroup.Permissions.Portunus.IsAdmin != rightGroup.Permissions.Portunus.IsAdmin {
+		if leftGroup.Description != rightGroup.Description {
+			errs.Add(ref.Field("description").Wrap(errSeededField))
+		}
+		if leftGroup.URL != rightGroup.URL {
+			errs.Add(ref.Field("url").Wrap(errSeededField))
+		}
+		if leftGroup.Permissions.Portunus != rightGroup.Permissions.Portunus {
 			errs.Add(ref.Field("portunus_perms").Wrap(errSeededField))
 		}
 		if leftGroup.Permissions.LDAP.CanRead != rightGroup.Permissions.LDAP.CanRead {
@@ -187,6 +320,12 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 		if !reflect.DeepEqual(leftGroup.PosixGID, rightGroup.PosixGID) {
 			errs.Add(ref.Field("posix_gid").Wrap(errSeededField))
 		}
+		if leftGroup.HideFromMemberOf != rightGroup.HideFromMemberOf {
+			errs.Add(ref.Field("member_of").Wrap(errSeededField))
+		}
+		if !slices.Equal(leftGroup.Owners, rightGroup.Owners) {
+			errs.Add(ref.Field("owners").Wrap(errSeededField))
+		}
 
 		//NOTE: Same logic as above. Seeds only ever add group memberships and
 		//never remove them, so we only need to check in one direction.
@@ -201,26 +340,52 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 	for _, rightUser := range rightDB.Users {
 		leftUser, exists := leftDB.Users.Find(func(u User) bool { return u.LoginName == rightUser.LoginName })
 		if !exists {
-			errs.Addf("user %q is seeded and cannot be deleted", rightUser.LoginName)
+			errs.Add(seededObjectMissingError{rightUser.Ref()})
 			continue
 		}
 
 		ref := leftUser.Ref()
+		errSeededField := d.seededFieldError("user", leftUser.LoginName)
 		if leftUser.GivenName != rightUser.GivenName {
 			errs.Add(ref.Field("given_name").Wrap(errSeededField))
 		}
 		if leftUser.FamilyName != rightUser.FamilyName {
 			errs.Add(ref.Field("family_name").Wrap(errSeededField))
 		}
+		if leftUser.FamilyNameFirst != rightUser.FamilyNameFirst {
+			errs.Add(ref.Field("name_order").Wrap(errSeededField))
+		}
 		if leftUser.EMailAddress != rightUser.EMailAddress {
 			errs.Add(ref.Field("email").Wrap(errSeededField))
 		}
-		if !reflect.DeepEqual(leftUser.SSHPublicKeys, rightUser.SSHPublicKeys) {
+		if leftUser.Phone != rightUser.Phone {
+			errs.Add(ref.Field("phone").Wrap(errSeededField))
+		}
+		if leftUser.MobilePhone != rightUser.MobilePhone {
+			errs.Add(ref.Field("mobile_phone").Wrap(errSeededField))
+		}
+		if leftUser.Department != rightUser.Department {
+			errs.Add(ref.Field("department").Wrap(errSeededField))
+		}
+		if leftUser.PreferredLanguage != rightUser.PreferredLanguage {
+			errs.Add(ref.Field("preferred_language").Wrap(errSeededField))
+		}
+		if leftUser.Timezone != rightUser.Timezone {
+			errs.Add(ref.Field("timezone").Wrap(errSeededField))
+		}
+		//only the keys themselves are seeded, their metadata can be changed freely
+		if !reflect.DeepEqual(SSHPublicKeyStrings(leftUser.SSHPublicKeys), SSHPublicKeyStrings(rightUser.SSHPublicKeys)) {
 			errs.Add(ref.Field("ssh_public_keys").Wrap(errSeededField))
 		}
+		if !reflect.DeepEqual(leftUser.ExtraAttributes, rightUser.ExtraAttributes) {
+			errs.Add(ref.Field("extra_attributes").Wrap(errSeededField))
+		}
 		if leftUser.PasswordHash != rightUser.PasswordHash {
 			errs.Add(ref.Field("password").Wrap(errSeededField))
 		}
+		if !equalTimePointers(leftUser.ValidUntil, rightUser.ValidUntil) {
+			errs.Add(ref.Field("valid_until").Wrap(errSeededField))
+		}
 		if (leftUser.POSIX == nil) != (rightUser.POSIX == nil) {
 			errs.Add(ref.Field("posix").Wrap(errSeededField))
 		}
@@ -246,6 +411,23 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 		}
 	}
 
+	for _, rightServiceUser := range rightDB.ServiceUsers {
+		leftServiceUser, exists := leftDB.ServiceUsers.Find(func(s ServiceUser) bool { return s.Name == rightServiceUser.Name })
+		if !exists {
+			errs.Add(seededObjectMissingError{rightServiceUser.Ref()})
+			continue
+		}
+
+		ref := leftServiceUser.Ref()
+		errSeededField := d.seededFieldError("service_user", leftServiceUser.Name)
+		if leftServiceUser.Description != rightServiceUser.Description {
+			errs.Add(ref.Field("description").Wrap(errSeededField))
+		}
+		if leftServiceUser.PasswordHash != rightServiceUser.PasswordHash {
+			errs.Add(ref.Field("password").Wrap(errSeededField))
+		}
+	}
+
 	return errs
 }
 
@@ -289,16 +471,22 @@ func initializeDatabase(d *DatabaseSeed, hasher crypt.PasswordHasher) Database {
 type GroupSeed struct {
 	Name             StringSeed   `json:"name"`
 	LongName         StringSeed   `json:"long_name"`
+	Description      StringSeed   `json:"description"`
+	URL              StringSeed   `json:"url"`
 	MemberLoginNames []StringSeed `json:"members"`
+	Owners           []StringSeed `json:"owners"`
 	Permissions      struct {
 		Portunus struct {
-			IsAdmin *bool `json:"is_admin"`
+			IsAdmin   *bool `json:"is_admin"`
+			CanView   *bool `json:"can_view"`
+			CanBrowse *bool `json:"can_browse"`
 		} `json:"portunus"`
 		LDAP struct {
 			CanRead *bool `json:"can_read"`
 		} `json:"ldap"`
 	} `json:"permissions"`
-	PosixGID *PosixID `json:"posix_gid"`
+	PosixGID         *PosixID `json:"posix_gid"`
+	HideFromMemberOf *bool    `json:"hide_from_member_of"`
 }
 
 // ApplyTo changes the attributes of this group to conform to the given seed.
@@ -310,6 +498,12 @@ func (g GroupSeed) ApplyTo(target *Group) {
 	}
 
 	target.LongName = string(g.LongName)
+	if g.Description != "" {
+		target.Description = string(g.Description)
+	}
+	if g.URL != "" {
+		target.URL = string(g.URL)
+	}
 
 	if target.MemberLoginNames == nil {
 		target.MemberLoginNames = make(GroupMemberNames)
@@ -317,16 +511,68 @@ func (g GroupSeed) ApplyTo(target *Group) {
 	for _, loginName := range g.MemberLoginNames {
 		target.MemberLoginNames[string(loginName)] = true
 	}
+	if len(g.Owners) > 0 {
+		target.Owners = make([]string, len(g.Owners))
+		for idx, loginName := range g.Owners {
+			target.Owners[idx] = string(loginName)
+		}
+	}
 
 	if g.Permissions.Portunus.IsAdmin != nil {
 		target.Permissions.Portunus.IsAdmin = *g.Permissions.Portunus.IsAdmin
 	}
+	if g.Permissions.Portunus.CanView != nil {
+		target.Permissions.Portunus.CanView = *g.Permissions.Portunus.CanView
+	}
+	if g.Permissions.Portunus.CanBrowse != nil {
+		target.Permissions.Portunus.CanBrowse = *g.Permissions.Portunus.CanBrowse
+	}
 	if g.Permissions.LDAP.CanRead != nil {
 		target.Permissions.LDAP.CanRead = *g.Permissions.LDAP.CanRead
 	}
 	if g.PosixGID != nil {
 		target.PosixGID = g.PosixGID
 	}
+	if g.HideFromMemberOf != nil {
+		target.HideFromMemberOf = *g.HideFromMemberOf
+	}
+}
+
+// Lists the fields that ApplyTo() sets, for DatabaseSeed.SeededFields().
+func (g GroupSeed) seededFields() []string {
+	paths := []string{"name", "long_name"}
+	if g.Description != "" {
+		paths = append(paths, "description")
+	}
+	if g.URL != "" {
+		paths = append(paths, "url")
+	}
+	//seeded members are enforced, but other members can be added as well
+	if len(g.MemberLoginNames) > 0 {
+		paths = append(paths, "members")
+	}
+	if len(g.Owners) > 0 {
+		paths = append(paths, "owners")
+	}
+	if g.Permissions.Portunus.IsAdmin != nil {
+		paths = append(paths, "permissions.portunus.is_admin")
+	}
+	if g.Permissions.Portunus.CanView != nil {
+		paths = append(paths, "permissions.portunus.can_view")
+	}
+	if g.Permissions.Portunus.CanBrowse != nil {
+		paths = append(paths, "permissions.portunus.can_browse")
+	}
+	if g.Permissions.LDAP.CanRead != nil {
+		paths = append(paths, "permissions.ldap.can_read")
+	}
+	if g.PosixGID != nil {
+		paths = append(paths, "posix_gid")
+	}
+	if g.HideFromMemberOf != nil {
+		paths = append(paths, "hide_from_member_of")
+	}
+	return paths
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -334,19 +580,27 @@ func (g GroupSeed) ApplyTo(target *Group) {
 
 // UserSeed contains the seeded configuration for a single user.
 type UserSeed struct {
-	LoginName     StringSeed   `json:"login_name"`
-	GivenName     StringSeed   `json:"given_name"`
-	FamilyName    StringSeed   `json:"family_name"`
-	EMailAddress  StringSeed   `json:"email"`
-	SSHPublicKeys []StringSeed `json:"ssh_public_keys"`
-	Password      StringSeed   `json:"password"`
-	POSIX         *struct {
+	LoginName         StringSeed   `json:"login_name"`
+	GivenName         StringSeed   `json:"given_name"`
+	FamilyName        StringSeed   `json:"family_name"`
+	FamilyNameFirst   *bool        `json:"family_name_first"`
+	EMailAddress      StringSeed   `json:"email"`
+	Phone             StringSeed   `json:"phone"`
+	MobilePhone       StringSeed   `json:"mobile_phone"`
+	Department        StringSeed   `json:"department"`
+	PreferredLanguage StringSeed   `json:"preferred_language"`
+	Timezone          StringSeed   `json:"timezone"`
+	SSHPublicKeys     []StringSeed `json:"ssh_public_keys"`
+	Password          StringSeed   `json:"password"`
+	POSIX             *struct {
 		UID           *PosixID   `json:"uid"`
 		GID           *PosixID   `json:"gid"`
 		HomeDirectory StringSeed `json:"home"`
 		LoginShell    StringSeed `json:"shell"`
 		GECOS         StringSeed `json:"gecos"`
 	} `json:"posix"`
+	ExtraAttributes map[string][]StringSeed `json:"extra_attributes"`
+	ValidUntil      *time.Time              `json:"valid_until"`
 }
 
 // ApplyTo changes the attributes of this group to conform to the given seed.
@@ -359,29 +613,52 @@ func (u UserSeed) ApplyTo(target *User, hasher crypt.PasswordHasher) {
 
 	target.GivenName = string(u.GivenName)
 	target.FamilyName = string(u.FamilyName)
+	if u.FamilyNameFirst != nil {
+		target.FamilyNameFirst = *u.FamilyNameFirst
+	}
 	if u.EMailAddress != "" {
 		target.EMailAddress = string(u.EMailAddress)
 	}
+	if u.Phone != "" {
+		target.Phone = string(u.Phone)
+	}
+	if u.MobilePhone != "" {
+		target.MobilePhone = string(u.MobilePhone)
+	}
+	if u.Department != "" {
+		target.Department = string(u.Department)
+	}
+	if u.PreferredLanguage != "" {
+		target.PreferredLanguage = string(u.PreferredLanguage)
+	}
+	if u.Timezone != "" {
+		target.Timezone = string(u.Timezone)
+	}
 
 	if len(u.SSHPublicKeys) > 0 {
-		target.SSHPublicKeys = nil
-		for _, key := range u.SSHPublicKeys {
-			target.SSHPublicKeys = append(target.SSHPublicKeys, string(key))
+		keys := make([]string, len(u.SSHPublicKeys))
+		for idx, key := range u.SSHPublicKeys {
+			keys[idx] = string(key)
 		}
+		target.SSHPublicKeys = MergeSSHPublicKeys(target.SSHPublicKeys, keys, nil)
 	}
 
-	if u.Password != "" {
-		//to avoid useless rehashing, the password is only applied:
-		//- on creation (when no PasswordHash exists),
-		//- on method mismatch (i.e. when the hasher wants us to change hash methods), or
-		//- on password mismatch (i.e. when the password is updated in the seed)
-		pw := string(u.Password)
-		hash := target.PasswordHash
-		if hash == "" || hasher.IsWeakHash(hash) || !hasher.CheckPasswordHash(pw, hash) {
-			target.PasswordHash = hasher.HashPassword(pw)
+	if len(u.ExtraAttributes) > 0 {
+		target.ExtraAttributes = make(map[string][]string, len(u.ExtraAttributes))
+		for name, values := range u.ExtraAttributes {
+			for _, value := range values {
+				target.ExtraAttributes[name] = append(target.ExtraAttributes[name], string(value))
+			}
 		}
 	}
 
+	applyPasswordSeed(u.Password, &target.PasswordHash, hasher)
+
+	if u.ValidUntil != nil {
+		validUntil := u.ValidUntil.UTC()
+		target.ValidUntil = &validUntil
+	}
+
 	if u.POSIX != nil {
 		if target.POSIX == nil {
 			target.POSIX = &UserPosixAttributes{}
@@ -406,6 +683,111 @@ func (u UserSeed) ApplyTo(target *User, hasher crypt.PasswordHasher) {
 	}
 }
 
+// Lists the fields that ApplyTo() sets, for DatabaseSeed.SeededFields().
+func (u UserSeed) seededFields() []string {
+	paths := []string{"login_name", "given_name", "family_name"}
+	if u.FamilyNameFirst != nil {
+		paths = append(paths, "family_name_first")
+	}
+	if u.EMailAddress != "" {
+		paths = append(paths, "email")
+	}
+	if u.Phone != "" {
+		paths = append(paths, "phone")
+	}
+	if u.MobilePhone != "" {
+		paths = append(paths, "mobile_phone")
+	}
+	if u.Department != "" {
+		paths = append(paths, "department")
+	}
+	if u.PreferredLanguage != "" {
+		paths = append(paths, "preferred_language")
+	}
+	if u.Timezone != "" {
+		paths = append(paths, "timezone")
+	}
+	//seeded keys are enforced, but other keys can be added as well
+	if len(u.SSHPublicKeys) > 0 {
+		paths = append(paths, "ssh_public_keys")
+	}
+	if len(u.ExtraAttributes) > 0 {
+		paths = append(paths, "extra_attributes")
+	}
+	if u.Password != "" {
+		paths = append(paths, "password")
+	}
+	if u.ValidUntil != nil {
+		paths = append(paths, "valid_until")
+	}
+	if u.POSIX != nil {
+		paths = append(paths, "posix.uid", "posix.gid", "posix.home")
+		if u.POSIX.LoginShell != "" {
+			paths = append(paths, "posix.shell")
+		}
+		if u.POSIX.GECOS != "" {
+			paths = append(paths, "posix.gecos")
+		}
+	}
+	return paths
+}
+
+// Applies a seeded password to the given password hash field.
+func applyPasswordSeed(password StringSeed, target *string, hasher crypt.PasswordHasher) {
+	if password == "" {
+		return
+	}
+	//to avoid useless rehashing, the password is only applied:
+	//- on creation (when no PasswordHash exists),
+	//- on method mismatch (i.e. when the hasher wants us to change hash methods), or
+	//- on password mismatch (i.e. when the password is updated in the seed)
+	pw := string(password)
+	hash := *target
+	if hash == "" || hasher.IsWeakHash(hash) || !hasher.CheckPasswordHash(pw, hash) {
+		*target = hasher.HashPassword(pw)
+	}
+}
+
+// Compares two optional timestamps. Unlike reflect.DeepEqual, this ignores
+// differences in time zone or monotonic clock reading.
+func equalTimePointers(left, right *time.Time) bool {
+	if left == nil || right == nil {
+		return left == right
+	}
+	return left.Equal(*right)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type ServiceUserSeed
+
+// ServiceUserSeed contains the seeded configuration for a single service user.
+type ServiceUserSeed struct {
+	Name        StringSeed `json:"name"`
+	Description StringSeed `json:"description"`
+	Password    StringSeed `json:"password"`
+}
+
+// ApplyTo changes the attributes of this service user to conform to the given seed.
+func (s ServiceUserSeed) ApplyTo(target *ServiceUser, hasher crypt.PasswordHasher) {
+	//consistency check (the caller must ensure that the seed matches the object)
+	if target.Name != string(s.Name) {
+		panic(fmt.Sprintf("cannot apply seed with Name = %q to service user with Name = %q",
+			string(s.Name), target.Name))
+	}
+
+	target.Description = string(s.Description)
+	applyPasswordSeed(s.Password, &target.PasswordHash, hasher)
+}
+
+// Lists the fields that ApplyTo() sets, for DatabaseSeed.SeededFields().
+func (s ServiceUserSeed) seededFields() []string {
+	paths := []string{"name", "description"}
+	if s.Password != "" {
+		paths = append(paths, "password")
+	}
+	return paths
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // type StringSeed
 
@@ -0,0 +1,219 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// SeedCorrection records that Nexus.Update() silently reverted a change to a
+// seeded field. This happens for all updates that do not set
+// UpdateOptions.ConflictWithSeedIsError, most notably when the database file
+// is edited on disk.
+type SeedCorrection struct {
+	Object ObjectRef `json:"object"`
+	//The field that was reverted (same names as in ValidationError), or empty
+	//if the seeded object had been deleted and was recreated.
+	Field string `json:"field,omitempty"`
+	//Same as in MembershipChange.
+	Actor  string    `json:"actor,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// String returns a human-readable description of this correction.
+func (c SeedCorrection) String() string {
+	if c.Field == "" {
+		return fmt.Sprintf("seed recreated %s %q", c.Object.Type, c.Object.Name)
+	}
+	return fmt.Sprintf("seed reverted field %q on %s %q", c.Field, c.Object.Type, c.Object.Name)
+}
+
+// Finds all seeded fields that differ between `oldDB` and `newDB`, where
+// `newDB` is `oldDB` with the seed applied. Fields that appear more than once
+// (e.g. for multiple missing group members) are only reported once.
+func (d DatabaseSeed) collectCorrections(oldDB, newDB Database) (result []SeedCorrection) {
+	isSeen := make(map[FieldRef]bool)
+	for _, err := range d.compareWithSeeded(oldDB, newDB) {
+		var (
+			ref        FieldRef
+			fieldErr   ValidationError
+			missingErr seededObjectMissingError
+		)
+		switch {
+		case errors.As(err, &fieldErr):
+			ref = fieldErr.FieldRef
+		case errors.As(err, &missingErr):
+			ref = FieldRef{Object: missingErr.Object}
+		default:
+			continue
+		}
+		if !isSeen[ref] {
+			isSeen[ref] = true
+			result = append(result, SeedCorrection{Object: ref.Object, Field: ref.Name})
+		}
+	}
+	return result
+}
+
+// SeedFight is reported by SeedCorrectionTracker when an object was corrected
+// so often within a short time that something (e.g. a script or another admin)
+// is most likely fighting against the seed.
+type SeedFight struct {
+	Object      ObjectRef
+	Corrections int           //within Window
+	Window      time.Duration //same as in SeedCorrectionTracker
+	//The correction that pushed the object over the threshold.
+	LastCorrection SeedCorrection
+	//All users with admin access to Portunus.
+	Recipients []User
+}
+
+// SeedCorrectionStats appears in type SeedCorrectionTracker.
+type SeedCorrectionStats struct {
+	Object ObjectRef
+	//Number of corrections since portunus-server was started.
+	Total uint64
+	//Number of corrections within SeedCorrectionTracker.Window.
+	Recent         int
+	LastCorrection SeedCorrection
+	//Whether a SeedFight was reported for the current streak of corrections.
+	IsFighting bool
+}
+
+// SeedCorrectionTracker counts SeedCorrections per object, logs them, and
+// reports a SeedFight when more than Threshold corrections for a single object
+// occur within Window. It needs to be registered with a Nexus through
+// Register(), and can be read from any goroutine.
+type SeedCorrectionTracker struct {
+	Threshold int
+	Window    time.Duration
+	//If not nil, this is called for each new SeedFight, e.g. to send notifications.
+	OnFight func(SeedFight)
+
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex  sync.Mutex
+	stats  map[ObjectRef]*seedCorrectionRecord
+	admins []User
+}
+
+type seedCorrectionRecord struct {
+	SeedCorrectionStats
+	//Times of the corrections within the window, oldest first.
+	RecentTimes []time.Time
+}
+
+// NewSeedCorrectionTracker initializes a SeedCorrectionTracker.
+func NewSeedCorrectionTracker(threshold int, window time.Duration) *SeedCorrectionTracker {
+	return &SeedCorrectionTracker{
+		Threshold: threshold,
+		Window:    window,
+		stats:     make(map[ObjectRef]*seedCorrectionRecord),
+	}
+}
+
+// Register adds the listeners that this tracker needs to the given Nexus.
+// They will be removed when `ctx` expires.
+func (t *SeedCorrectionTracker) Register(ctx context.Context, nexus Nexus) {
+	nexus.AddListener(ctx, t.updateAdmins)
+	nexus.AddSeedCorrectionListener(ctx, t.Record)
+}
+
+// Remembers who needs to be told about a SeedFight. We cannot ask the Nexus
+// in Record() because listeners are invoked while the Nexus is locked.
+func (t *SeedCorrectionTracker) updateAdmins(db Database) {
+	var admins []User
+	for _, user := range db.Users {
+		if db.collectUserPermissions(user).Perms.Portunus.IsAdmin {
+			admins = append(admins, user.Cloned())
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.admins = admins
+}
+
+// Record processes the given corrections. This is called by the Nexus, but
+// can also be called directly in tests.
+func (t *SeedCorrectionTracker) Record(corrections []SeedCorrection) {
+	var fights []SeedFight
+	t.mutex.Lock()
+	for _, c := range corrections {
+		fields := logging.Fields{"event": "seed_correction", "object_type": c.Object.Type, "object_name": c.Object.Name}
+		if c.Field != "" {
+			fields["field"] = c.Field
+		}
+		if c.Actor != "" {
+			fields["actor"] = c.Actor
+		}
+		logging.Info(fields, "%s", c.String())
+
+		rec := t.stats[c.Object]
+		if rec == nil {
+			rec = &seedCorrectionRecord{SeedCorrectionStats: SeedCorrectionStats{Object: c.Object}}
+			t.stats[c.Object] = rec
+		}
+		rec.Total++
+		rec.LastCorrection = c
+		rec.RecentTimes = append(rec.pruneRecentTimes(c.Time, t.Window), c.Time)
+		rec.Recent = len(rec.RecentTimes)
+
+		//report each fight only once, until it has calmed down
+		switch {
+		case rec.Recent > t.Threshold && !rec.IsFighting:
+			rec.IsFighting = true
+			fights = append(fights, SeedFight{c.Object, rec.Recent, t.Window, c, t.admins})
+		case rec.Recent <= t.Threshold:
+			rec.IsFighting = false
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, fight := range fights {
+		logging.Error(logging.Fields{"event": "seed_fight", "object_type": fight.Object.Type, "object_name": fight.Object.Name},
+			"seed had to correct %s %q %d times within %s, something is probably fighting the seed", fight.Object.Type, fight.Object.Name, fight.Corrections, fight.Window)
+		if t.OnFight != nil {
+			t.OnFight(fight)
+		}
+	}
+}
+
+// Returns the times within the window that ends at `now`.
+func (r seedCorrectionRecord) pruneRecentTimes(now time.Time, window time.Duration) []time.Time {
+	for idx, t := range r.RecentTimes {
+		if now.Sub(t) < window {
+			return r.RecentTimes[idx:]
+		}
+	}
+	return nil
+}
+
+// List returns the stats for all objects that were corrected at least once,
+// with the most recently corrected object first. The Recent counts (and thus
+// IsFighting) are computed for the window that ends at `now`.
+func (t *SeedCorrectionTracker) List(now time.Time) []SeedCorrectionStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]SeedCorrectionStats, 0, len(t.stats))
+	for _, rec := range t.stats {
+		stats := rec.SeedCorrectionStats
+		stats.Recent = len(rec.pruneRecentTimes(now, t.Window))
+		stats.IsFighting = stats.IsFighting && stats.Recent > t.Threshold
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastCorrection.Time.After(result[j].LastCorrection.Time)
+	})
+	return result
+}
@@ -0,0 +1,103 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestSeedCorrections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", vcfg)
+	expectNoErrors(t, errs)
+	nexus := NewNexus(seed, vcfg, &NoopHasher{})
+
+	tracker := NewSeedCorrectionTracker(3, time.Hour)
+	var fights []SeedFight
+	tracker.OnFight = func(fight SeedFight) { fights = append(fights, fight) }
+	var events []string
+	nexus.AddSeedCorrectionListener(ctx, func(corrections []SeedCorrection) {
+		for _, c := range corrections {
+			events = append(events, c.String()+" by "+c.Actor)
+		}
+	})
+	tracker.Register(ctx, nexus)
+
+	//the initial load fills in all seeded objects, which is not a correction
+	expectNoErrors(t, nexus.Update(reducerReturnEmpty, nil))
+	assert.DeepEqual(t, "events after initial load", events, []string(nil))
+
+	//an unseeded admin group determines who is told about fights
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = append(db.Groups, Group{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: GroupMemberNames{"minuser": true},
+			Permissions:      Permissions{Portunus: PortunusPermissions{IsAdmin: true}},
+		})
+		return nil
+	}, nil))
+	assert.DeepEqual(t, "events after unrelated update", events, []string(nil))
+
+	//something keeps renaming a seeded group, and the seed keeps reverting it
+	renameGroup := func(db *Database) errext.ErrorSet {
+		for idx, group := range db.Groups {
+			if group.Name == "maxgroup" {
+				db.Groups[idx].LongName = "Renamed Group"
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 4; i++ {
+		expectNoErrors(t, nexus.Update(renameGroup, &UpdateOptions{Actor: "script"}))
+	}
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "maxgroup" })
+	assert.DeepEqual(t, "long name after corrections", group.LongName, "Maximal Group")
+
+	expectedEvent := `seed reverted field "long_name" on group "maxgroup" by script`
+	assert.DeepEqual(t, "events", events, []string{expectedEvent, expectedEvent, expectedEvent, expectedEvent})
+
+	//the fourth correction exceeds the threshold, so the fight is reported exactly once
+	assert.DeepEqual(t, "number of fights", len(fights), 1)
+	assert.DeepEqual(t, "fought-over object", fights[0].Object, ObjectRef{Type: "group", Name: "maxgroup"})
+	assert.DeepEqual(t, "corrections in fight", fights[0].Corrections, 4)
+	assert.DeepEqual(t, "number of recipients of fight", len(fights[0].Recipients), 1)
+	assert.DeepEqual(t, "recipient of fight", fights[0].Recipients[0].LoginName, "minuser")
+
+	stats := tracker.List(time.Now())
+	assert.DeepEqual(t, "number of corrected objects", len(stats), 1)
+	assert.DeepEqual(t, "total corrections", stats[0].Total, uint64(4))
+	assert.DeepEqual(t, "recent corrections", stats[0].Recent, 4)
+	assert.DeepEqual(t, "fighting", stats[0].IsFighting, true)
+
+	//after the window has passed, the corrections do not count as recent anymore
+	stats = tracker.List(time.Now().Add(2 * time.Hour))
+	assert.DeepEqual(t, "recent corrections after window", stats[0].Recent, 0)
+	assert.DeepEqual(t, "total corrections after window", stats[0].Total, uint64(4))
+	assert.DeepEqual(t, "fighting after window", stats[0].IsFighting, false)
+
+	//with ConflictWithSeedIsError, the update is rejected instead of corrected
+	errs = nexus.Update(renameGroup, &UpdateOptions{ConflictWithSeedIsError: true})
+	expectTheseErrors(t, errs, `field "long_name" in group "maxgroup" must be equal to the seeded value`)
+	assert.DeepEqual(t, "number of events after rejected update", len(events), 4)
+
+	//deleting a seeded object is reported as well
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		var errs errext.ErrorSet
+		errs.Add(db.Groups.Delete("mingroup"))
+		return errs
+	}, nil))
+	assert.DeepEqual(t, "events after deletion", events[4:], []string{`seed recreated group "mingroup" by `})
+}
@@ -0,0 +1,211 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// SeedScope restricts which objects a delegated seed file may define. Each
+// delegated seed file declares its scope, and the primary seed file must
+// contain an identical scope in its list of delegations. This way, the owner
+// of a delegated seed file cannot widen its own scope.
+type SeedScope struct {
+	//identifies the scope in error messages, and in the primary seed's list of delegations
+	Name string `json:"name"`
+	//If not empty, the seed may define users, but only those whose extra
+	//attributes contain these values, e.g. {"departmentNumber": "sales"}.
+	UserAttributes map[string]string `json:"user_attributes,omitempty"`
+	//If not empty, the seed may define groups, but only those whose name starts with this prefix.
+	GroupNamePrefix string `json:"group_name_prefix,omitempty"`
+	//If not empty, the seed may define service users, but only those whose name starts with this prefix.
+	ServiceUserNamePrefix string `json:"service_user_name_prefix,omitempty"`
+}
+
+// Splits the value of PORTUNUS_SEED_PATH into individual seed files. The value
+// is a colon-separated list of paths. Each path can refer to a file or to a
+// directory, in which case all *.json files in that directory are used.
+func expandSeedPaths(pathList string) ([]string, error) {
+	var result []string
+	for _, path := range strings.Split(pathList, ":") {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			result = append(result, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no seed files (*.json) found in directory %s", path)
+		}
+		sort.Strings(matches)
+		result = append(result, matches...)
+	}
+	return result, nil
+}
+
+// ReadDatabaseSeeds reads and validates the seed files at the given paths,
+// and merges them into a single seed.
+//
+// Exactly one of the files must be the primary seed, i.e. it must not declare
+// a scope. All other files are delegated seeds: They must declare a scope that
+// is listed in the primary seed's delegations, and may only define objects
+// within that scope. No object may be defined by more than one seed file.
+func ReadDatabaseSeeds(paths []string, cfg *ValidationConfig) (result *DatabaseSeed, errs errext.ErrorSet) {
+	seeds := make([]*DatabaseSeed, len(paths))
+	for idx, path := range paths {
+		seed, err := parseDatabaseSeed(path)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		seeds[idx] = seed
+	}
+	if !errs.IsEmpty() {
+		return nil, errs
+	}
+
+	//find the primary seed
+	var primaryPaths []string
+	var primary *DatabaseSeed
+	for idx, seed := range seeds {
+		if seed.Scope == nil {
+			primaryPaths = append(primaryPaths, paths[idx])
+			primary = seed
+		}
+	}
+	switch len(primaryPaths) {
+	case 0:
+		errs.Addf("all seed files declare a scope, but one of them needs to be the primary seed without a scope")
+		return nil, errs
+	case 1:
+		//as expected
+	default:
+		errs.Addf("only one seed file may be the primary seed without a scope, but %s do not declare a scope", strings.Join(primaryPaths, " and "))
+		return nil, errs
+	}
+
+	//check each delegated seed against the primary seed
+	for idx, seed := range seeds {
+		if seed.Scope == nil {
+			continue
+		}
+		errs.Append(seed.checkScope(paths[idx], primary.Delegations))
+	}
+	if !errs.IsEmpty() {
+		return nil, errs
+	}
+	if len(seeds) == 1 {
+		return primary, primary.Validate(cfg)
+	}
+
+	//merge all seeds into one, and make sure that no object is defined twice
+	merged := &DatabaseSeed{
+		Delegations:    primary.Delegations,
+		GroupTemplates: primary.GroupTemplates,
+		sourcePaths:    make(map[string]string),
+	}
+	claim := func(kind, key, path string) {
+		sourceKey := kind + ":" + key
+		otherPath, exists := merged.sourcePaths[sourceKey]
+		if exists && otherPath != path {
+			errs.Addf("%s %q is defined in both %s and %s", strings.ReplaceAll(kind, "_", " "), key, otherPath, path)
+			return
+		}
+		merged.sourcePaths[sourceKey] = path
+	}
+	for idx, seed := range seeds {
+		path := paths[idx]
+		for _, groupSeed := range seed.Groups {
+			claim("group", string(groupSeed.Name), path)
+		}
+		for _, userSeed := range seed.Users {
+			claim("user", string(userSeed.LoginName), path)
+		}
+		for _, serviceUserSeed := range seed.ServiceUsers {
+			claim("service_user", string(serviceUserSeed.Name), path)
+		}
+		merged.Groups = append(merged.Groups, seed.Groups...)
+		merged.Users = append(merged.Users, seed.Users...)
+		merged.ServiceUsers = append(merged.ServiceUsers, seed.ServiceUsers...)
+	}
+	if !errs.IsEmpty() {
+		return nil, errs
+	}
+
+	//validation happens on the merged seed since e.g. groups may refer to users from other seed files
+	return merged, merged.Validate(cfg)
+}
+
+// Checks that a delegated seed is permitted by the primary seed's list of
+// delegations, and only defines objects within its scope.
+func (d DatabaseSeed) checkScope(path string, delegations []SeedScope) (errs errext.ErrorSet) {
+	scope := *d.Scope
+	if len(d.Delegations) > 0 {
+		errs.Addf("seed file %s declares a scope, so it may not declare delegations", path)
+	}
+	if len(d.GroupTemplates) > 0 {
+		errs.Addf("seed file %s declares a scope, so it may not declare group templates", path)
+	}
+	isPermitted := false
+	for _, delegation := range delegations {
+		if delegation.Name == scope.Name {
+			isPermitted = reflect.DeepEqual(delegation, scope)
+			break
+		}
+	}
+	if !isPermitted {
+		errs.Addf("seed file %s declares scope %q, which does not match any of the delegations in the primary seed", path, scope.Name)
+		return errs
+	}
+
+	for _, groupSeed := range d.Groups {
+		name := string(groupSeed.Name)
+		if scope.GroupNamePrefix == "" || !strings.HasPrefix(name, scope.GroupNamePrefix) {
+			errs.Addf("seed file %s may not define group %q because it is outside of scope %q", path, name, scope.Name)
+		}
+		//otherwise delegated seeds could make their own users admins
+		if groupSeed.Permissions.Portunus.IsAdmin != nil && *groupSeed.Permissions.Portunus.IsAdmin {
+			errs.Addf("seed file %s may not grant admin permissions to group %q because it is a delegated seed", path, name)
+		}
+	}
+	for _, userSeed := range d.Users {
+		loginName := string(userSeed.LoginName)
+		isInScope := len(scope.UserAttributes) > 0
+		for attrName, value := range scope.UserAttributes {
+			values := userSeed.ExtraAttributes[attrName]
+			if len(values) != 1 || string(values[0]) != value {
+				isInScope = false
+			}
+		}
+		if !isInScope {
+			errs.Addf("seed file %s may not define user %q because it is outside of scope %q", path, loginName, scope.Name)
+		}
+	}
+	for _, serviceUserSeed := range d.ServiceUsers {
+		name := string(serviceUserSeed.Name)
+		if scope.ServiceUserNamePrefix == "" || !strings.HasPrefix(name, scope.ServiceUserNamePrefix) {
+			errs.Addf("seed file %s may not define service user %q because it is outside of scope %q", path, name, scope.Name)
+		}
+	}
+	return errs
+}
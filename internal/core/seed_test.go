@@ -8,8 +8,13 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/sapcc/go-bits/assert"
@@ -18,6 +23,22 @@ import (
 
 const dummySSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGNvYUluYODNXoQKDGG+pTEigpsvJP2SHfMz0a+Hl2xO maxuser@example.org"
 
+// The seed tests only look at the database contents, so the revision that the
+// Nexus assigns on each update is removed before comparing.
+func withoutRevision(db Database) Database {
+	db.Revision = 0
+	db.UpdatedAt = time.Time{}
+	return db
+}
+
+// Clears the user IDs, which are generated randomly by Nexus.Update().
+func withoutUserIDs(db Database) Database {
+	for idx := range db.Users {
+		db.Users[idx].ID = ""
+	}
+	return db
+}
+
 // Returns the Database that results when applying `fixtures/seed-basic.json`
 // to an empty Database.
 func dbWithBasicSeedApplied() Database {
@@ -32,11 +53,16 @@ func dbWithBasicSeedApplied() Database {
 			{
 				Name:             "maxgroup",
 				LongName:         "Maximal Group",
+				Description:      "Everything that a group can have.",
+				URL:              "https://example.org/docs/maxgroup",
 				MemberLoginNames: GroupMemberNames{"maxuser": true},
 				Permissions: Permissions{
-					LDAP: LDAPPermissions{CanRead: true},
+					Portunus: PortunusPermissions{CanView: true},
+					LDAP:     LDAPPermissions{CanRead: true},
 				},
-				PosixGID: pointerTo(PosixID(23)),
+				PosixGID:         pointerTo(PosixID(23)),
+				HideFromMemberOf: true,
+				Owners:           []string{"maxuser"},
 			},
 			{
 				Name:             "mingroup",
@@ -50,8 +76,12 @@ func dbWithBasicSeedApplied() Database {
 				GivenName:     "Maximal",
 				FamilyName:    "User",
 				EMailAddress:  "maxuser@example.org",
-				SSHPublicKeys: []string{dummySSHPublicKey},
+				Phone:         "+49 30 1234567",
+				MobilePhone:   "+49 170 1234567",
+				Department:    "Engineering",
+				SSHPublicKeys: []SSHKey{{Key: dummySSHPublicKey}},
 				PasswordHash:  "{PLAINTEXT}swordfish",
+				ValidUntil:    pointerTo(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)),
 				POSIX: &UserPosixAttributes{
 					UID:           42,
 					GID:           23,
@@ -66,6 +96,7 @@ func dbWithBasicSeedApplied() Database {
 				FamilyName: "User",
 			},
 		},
+		ServiceUsers: []ServiceUser{},
 	}
 }
 
@@ -80,15 +111,24 @@ func reducerReturnEmpty(db *Database) errext.ErrorSet {
 func reducerOverwriteSeededAttrs1(hasher crypt.PasswordHasher) func(*Database) errext.ErrorSet {
 	return func(db *Database) errext.ErrorSet {
 		db.Groups[0].LongName += "-changed"
+		db.Groups[0].Description += " (changed)"
+		db.Groups[0].URL += "-changed"
 		db.Groups[0].MemberLoginNames = GroupMemberNames{} //removing seeded members is not allowed
 		db.Groups[0].Permissions.Portunus.IsAdmin = true
+		db.Groups[0].Permissions.Portunus.CanView = false
 		db.Groups[0].Permissions.LDAP.CanRead = false
 		db.Groups[0].PosixGID = pointerTo(*db.Groups[0].PosixGID + 1)
+		db.Groups[0].HideFromMemberOf = false
+		db.Groups[0].Owners = []string{"minuser"}
 		db.Users[0].GivenName += "-changed"
 		db.Users[0].FamilyName += "-changed"
 		db.Users[0].EMailAddress = "changed@example.org"
-		db.Users[0].SSHPublicKeys = append(db.Users[0].SSHPublicKeys, dummySSHPublicKey)
+		db.Users[0].Phone = "+49 30 7654321"
+		db.Users[0].MobilePhone = ""
+		db.Users[0].Department = "Sales"
+		db.Users[0].SSHPublicKeys = append(db.Users[0].SSHPublicKeys, SSHKey{Key: dummySSHPublicKey})
 		db.Users[0].PasswordHash = hasher.HashPassword("incorrect")
+		db.Users[0].ValidUntil = pointerTo(db.Users[0].ValidUntil.Add(time.Hour))
 		db.Users[0].POSIX.UID += 1
 		db.Users[0].POSIX.GID += 1
 		db.Users[0].POSIX.HomeDirectory += "-changed"
@@ -115,6 +155,7 @@ func reducerOverwriteSeededIdentifiers(db *Database) errext.ErrorSet {
 
 	//avoid complaints about an invalid group membership (that's not what we're testing here)
 	db.Groups[0].MemberLoginNames[previousUserName] = false
+	db.Groups[0].Owners = nil
 
 	return nil
 }
@@ -142,13 +183,19 @@ func reducerOverwriteMalleableAttributes(hasher crypt.PasswordHasher) func(*Data
 // the normalization sorts by identifier.)
 func reducerOverwriteUnseededAttributes(hasher crypt.PasswordHasher) func(*Database) errext.ErrorSet {
 	return func(db *Database) errext.ErrorSet {
+		db.Groups[1].Description = "Not much to see here."
+		db.Groups[1].URL = "https://example.org/docs/mingroup"
 		db.Groups[1].MemberLoginNames = GroupMemberNames{"minuser": true} //removing seeded members is not allowed
 		db.Groups[1].Permissions.Portunus.IsAdmin = true
+		db.Groups[1].Permissions.Portunus.CanView = true
 		db.Groups[1].Permissions.LDAP.CanRead = true
 		db.Groups[1].PosixGID = pointerTo(PosixID(123))
+		db.Groups[1].HideFromMemberOf = true
+		db.Groups[1].Owners = []string{"minuser"}
 		db.Users[1].EMailAddress = "minuser@example.org"
-		db.Users[1].SSHPublicKeys = []string{dummySSHPublicKey}
+		db.Users[1].SSHPublicKeys = []SSHKey{{Key: dummySSHPublicKey}}
 		db.Users[1].PasswordHash = hasher.HashPassword("qwerty")
+		db.Users[1].ValidUntil = pointerTo(time.Date(2031, 6, 30, 0, 0, 0, 0, time.UTC))
 		db.Users[1].POSIX = &UserPosixAttributes{
 			UID:           142,
 			GID:           123,
@@ -177,7 +224,7 @@ func TestSeedEnforcementRelaxed(t *testing.T) {
 	nexus := NewNexus(seed, vcfg, hasher)
 	var actualDB Database
 	nexus.AddListener(ctx, func(db Database) {
-		actualDB = db
+		actualDB = withoutUserIDs(withoutRevision(db))
 	})
 
 	//load an empty database (like on first startup) -> seed gets applied
@@ -235,7 +282,7 @@ func TestSeedEnforcementStrict(t *testing.T) {
 	var actualDB Database
 	updateCount := 0
 	nexus.AddListener(ctx, func(db Database) {
-		actualDB = db
+		actualDB = withoutUserIDs(withoutRevision(db))
 		updateCount++
 	})
 
@@ -252,15 +299,23 @@ func TestSeedEnforcementStrict(t *testing.T) {
 	errs = nexus.Update(reducerOverwriteSeededAttrs1(hasher), &opts)
 	expectTheseErrors(t, errs,
 		`field "long_name" in group "maxgroup" must be equal to the seeded value`,
+		`field "description" in group "maxgroup" must be equal to the seeded value`,
+		`field "url" in group "maxgroup" must be equal to the seeded value`,
 		`field "members" in group "maxgroup" must contain user "maxuser" because of seeded group membership`,
 		`field "portunus_perms" in group "maxgroup" must be equal to the seeded value`,
 		`field "ldap_perms" in group "maxgroup" must be equal to the seeded value`,
 		`field "posix_gid" in group "maxgroup" must be equal to the seeded value`,
+		`field "member_of" in group "maxgroup" must be equal to the seeded value`,
+		`field "owners" in group "maxgroup" must be equal to the seeded value`,
 		`field "given_name" in user "maxuser" must be equal to the seeded value`,
 		`field "family_name" in user "maxuser" must be equal to the seeded value`,
 		`field "email" in user "maxuser" must be equal to the seeded value`,
+		`field "phone" in user "maxuser" must be equal to the seeded value`,
+		`field "mobile_phone" in user "maxuser" must be equal to the seeded value`,
+		`field "department" in user "maxuser" must be equal to the seeded value`,
 		`field "ssh_public_keys" in user "maxuser" must be equal to the seeded value`,
 		`field "password" in user "maxuser" must be equal to the seeded value`,
+		`field "valid_until" in user "maxuser" must be equal to the seeded value`,
 		`field "posix_uid" in user "maxuser" must be equal to the seeded value`,
 		`field "posix_gid" in user "maxuser" must be equal to the seeded value`,
 		`field "posix_home" in user "maxuser" must be equal to the seeded value`,
@@ -321,6 +376,12 @@ func TestSeedParseAndValidationErrors(t *testing.T) {
 		`while parsing fixtures/seed-parse-error-2.json: json: cannot unmarshal object into Go struct field UserSeed.users.password of type string`,
 	)
 
+	//test a seed file with a misspelled permission flag
+	_, errs = ReadDatabaseSeed("fixtures/seed-parse-error-3.json", vcfg)
+	expectTheseErrors(t, errs,
+		`while parsing fixtures/seed-parse-error-3.json: json: unknown field "can_veiw"`,
+	)
+
 	//NOTE: We trust all other parse-level errors (e.g. GIDs/UIDs longer than 16
 	//bit) to be caught by the JSON parser, since these constraints are all
 	//expressed in the type system.
@@ -348,6 +409,9 @@ func TestSeedParseAndValidationErrors(t *testing.T) {
 		`field "posix_home" in user "posix-spaces-in-home" may not end with a space character`,
 		`field "posix_home" in user "posix-home-is-not-absolute" must be an absolute path, i.e. start with a /`,
 		`field "posix_shell" in user "posix-shell-is-not-absolute" must be an absolute path, i.e. start with a /`,
+		`field "extra_attributes" in user "extra-attributes-invalid" may not contain empty values (found one for "departmentNumber")`,
+		`field "extra_attributes" in user "extra-attributes-invalid" contains "employee_number", which is not a valid LDAP attribute name`,
+		`field "extra_attributes" in user "extra-attributes-invalid" contains "userPassword", which is not one of the supported attributes: `+strings.Join(SupportedExtraAttributes, ", "),
 		`field "name" in group "" is missing`,
 		`field "name" in group " spaces-in-name " may not start with a space character`,
 		`field "name" in group "malformed-name$" is not an acceptable group name`,
@@ -356,6 +420,8 @@ func TestSeedParseAndValidationErrors(t *testing.T) {
 		`field "name" in group "duplicate.name" is defined multiple times`,
 		`field "long_name" in group "missing-long-name" is missing`,
 		`field "long_name" in group "spaces-in-long-name" may not start with a space character`,
+		`field "description" in group "spaces-in-description" may not end with a space character`,
+		`field "url" in group "malformed-url" must be an absolute URL like https://example.com/docs`,
 		`field "members" in group "unknown-member" contains unknown user with login name "incognito"`,
 	)
 }
@@ -377,7 +443,7 @@ func TestSeedCryptoAgility(t *testing.T) {
 	nexus := NewNexus(seed, vcfg, hasher)
 	var actualDB Database
 	nexus.AddListener(ctx, func(db Database) {
-		actualDB = db
+		actualDB = withoutUserIDs(withoutRevision(db))
 	})
 
 	//load an empty database (like on first startup) -> seed gets applied
@@ -391,7 +457,8 @@ func TestSeedCryptoAgility(t *testing.T) {
 			FamilyName:   "User",
 			PasswordHash: "{PLAINTEXT}swordfish",
 		}},
-		Groups: []Group{},
+		Groups:       []Group{},
+		ServiceUsers: []ServiceUser{},
 	}
 	assert.DeepEqual(t, "database contents", actualDB, expectedDB)
 
@@ -437,3 +504,180 @@ func expectTheseErrors(t *testing.T, errs errext.ErrorSet, expected ...string) {
 func pointerTo[T any](val T) *T {
 	return &val
 }
+
+func TestSeedServiceUsers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-service-users.json", vcfg)
+	expectNoErrors(t, errs)
+
+	hasher := &NoopHasher{}
+	nexus := NewNexus(seed, vcfg, hasher)
+	var actualDB Database
+	nexus.AddListener(ctx, func(db Database) {
+		actualDB = withoutUserIDs(withoutRevision(db))
+	})
+
+	//load an empty database (like on first startup) -> seed gets applied
+	errs = nexus.Update(reducerReturnEmpty, nil)
+	expectNoErrors(t, errs)
+	expectedDB := Database{
+		Users:  []User{},
+		Groups: []Group{},
+		ServiceUsers: []ServiceUser{
+			{Name: "grafana", Description: "Grafana login", PasswordHash: "{PLAINTEXT}swordfish"},
+			{Name: "nextcloud", PasswordHash: "{PLAINTEXT}hunter2"},
+		},
+	}
+	assert.DeepEqual(t, "database contents", actualDB, expectedDB)
+
+	//overwriting seeded attributes or deleting seeded service users is not allowed
+	opts := UpdateOptions{ConflictWithSeedIsError: true}
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.ServiceUsers[0].Description = "changed"
+		db.ServiceUsers[0].PasswordHash = hasher.HashPassword("incorrect")
+		db.ServiceUsers = db.ServiceUsers[:1]
+		return nil
+	}, &opts)
+	expectTheseErrors(t, errs,
+		`field "description" in service user "grafana" must be equal to the seeded value`,
+		`field "password" in service user "grafana" must be equal to the seeded value`,
+		`service user "nextcloud" is seeded and cannot be deleted`,
+	)
+	assert.DeepEqual(t, "database contents", actualDB, expectedDB)
+
+	//test validation errors that are specific to service users
+	seed = &DatabaseSeed{
+		ServiceUsers: []ServiceUserSeed{
+			{Name: "duplicate", Password: "swordfish"},
+			{Name: "duplicate", Password: "swordfish"},
+			{Name: "spaces-in-description", Description: " foo ", Password: "swordfish"},
+			{Name: "no-password"},
+			{Name: "dn,syntax", Password: "swordfish"},
+		},
+	}
+	expectTheseErrors(t, seed.Validate(vcfg),
+		`field "name" in service user "duplicate" is defined multiple times`,
+		`field "description" in service user "spaces-in-description" may not start with a space character`,
+		`field "password" in service user "no-password" is missing`,
+		`field "name" in service user "dn,syntax" may not include commas, plus signs or equals signs`,
+	)
+}
+
+func TestSeedDelegation(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	hasher := &NoopHasher{}
+	primaryPath := "fixtures/seed-delegation-primary.json"
+	salesPath := "fixtures/seed-delegation-sales.json"
+
+	//groups in the primary seed can refer to users from delegated seeds
+	seed, errs := ReadDatabaseSeeds([]string{primaryPath, salesPath}, vcfg)
+	expectNoErrors(t, errs)
+	var db Database
+	seed.ApplyTo(&db, hasher)
+	userNames := func(db Database) (result []string) {
+		for _, u := range db.Users {
+			result = append(result, u.LoginName)
+		}
+		return result
+	}
+	assert.DeepEqual(t, "users after first seeding", userNames(db), []string{"admin", "sally", "sam"})
+	everyone, _ := db.Groups.Find(func(g Group) bool { return g.Name == "everyone" })
+	assert.DeepEqual(t, "members of everyone", everyone.MemberLoginNames, GroupMemberNames{"admin": true, "sally": true})
+
+	//conflicts name the seed file that owns the respective object
+	changedDB := db.Cloned()
+	changedDB.Users[0].GivenName = "Changed"
+	changedDB.Users[1].GivenName = "Changed"
+	expectTheseErrors(t, seed.CheckConflicts(changedDB, hasher),
+		`field "given_name" in user "admin" must be equal to the value from seed file fixtures/seed-delegation-primary.json`,
+		`field "given_name" in user "sally" must be equal to the value from seed file fixtures/seed-delegation-sales.json`,
+	)
+
+	//the inspector shows which seed file governs which fields
+	paths, sourcePath := seed.SeededFields(ObjectRef{Type: "user", Name: "sally"})
+	assert.DeepEqual(t, "seeded fields of sally", paths, []string{"login_name", "given_name", "family_name", "extra_attributes"})
+	assert.DeepEqual(t, "seed file of sally", sourcePath, salesPath)
+	paths, sourcePath = seed.SeededFields(ObjectRef{Type: "user", Name: "unseeded"})
+	assert.DeepEqual(t, "seeded fields of unseeded user", paths, []string(nil))
+	assert.DeepEqual(t, "seed file of unseeded user", sourcePath, "")
+
+	//when the delegated seed is updated, the objects from the primary seed are not touched
+	seed, errs = ReadDatabaseSeeds([]string{primaryPath, "fixtures/seed-delegation-sales-v2.json"}, vcfg)
+	expectNoErrors(t, errs)
+	newDB := db.Cloned()
+	seed.ApplyTo(&newDB, hasher)
+	assert.DeepEqual(t, "users after second seeding", userNames(newDB), []string{"admin", "sally", "sam", "sue"})
+	var changedObjects []string
+	for _, change := range DiffDatabases(db, newDB) {
+		changedObjects = append(changedObjects, fmt.Sprintf("%s %s %s", change.Kind, change.Type, change.Key))
+	}
+	assert.DeepEqual(t, "changes from updated seed", changedObjects, []string{
+		`modified group sales-team`,
+		`modified user sam`,
+		`created user sue`,
+	})
+
+	//seed files can also be found in a directory
+	dirPath := t.TempDir()
+	for _, path := range []string{primaryPath, salesPath} {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = os.WriteFile(filepath.Join(dirPath, filepath.Base(path)), buf, 0666)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	paths, err := expandSeedPaths(dirPath + ":")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "expanded seed paths", paths, []string{
+		filepath.Join(dirPath, "seed-delegation-primary.json"),
+		filepath.Join(dirPath, "seed-delegation-sales.json"),
+	})
+}
+
+func TestSeedDelegationErrors(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	primaryPath := "fixtures/seed-delegation-primary.json"
+
+	//delegated seeds may only define objects within their scope
+	violationsPath := "fixtures/seed-delegation-violations.json"
+	_, errs := ReadDatabaseSeeds([]string{primaryPath, violationsPath}, vcfg)
+	expectTheseErrors(t, errs,
+		`seed file fixtures/seed-delegation-violations.json may not define group "platform-team" because it is outside of scope "sales"`,
+		`seed file fixtures/seed-delegation-violations.json may not grant admin permissions to group "sales-admins" because it is a delegated seed`,
+		`seed file fixtures/seed-delegation-violations.json may not define user "paul" because it is outside of scope "sales"`,
+		`seed file fixtures/seed-delegation-violations.json may not define user "nina" because it is outside of scope "sales"`,
+		`seed file fixtures/seed-delegation-violations.json may not define service user "grafana" because it is outside of scope "sales"`,
+	)
+
+	//delegated seeds cannot widen their own scope
+	_, errs = ReadDatabaseSeeds([]string{primaryPath, "fixtures/seed-delegation-widened.json"}, vcfg)
+	expectTheseErrors(t, errs,
+		`seed file fixtures/seed-delegation-widened.json declares scope "sales", which does not match any of the delegations in the primary seed`,
+	)
+
+	//objects may not be defined in multiple seeds
+	_, errs = ReadDatabaseSeeds([]string{primaryPath, "fixtures/seed-delegation-sales.json", "fixtures/seed-delegation-sales-v2.json"}, vcfg)
+	expectTheseErrors(t, errs,
+		`group "sales-team" is defined in both fixtures/seed-delegation-sales.json and fixtures/seed-delegation-sales-v2.json`,
+		`user "sally" is defined in both fixtures/seed-delegation-sales.json and fixtures/seed-delegation-sales-v2.json`,
+		`user "sam" is defined in both fixtures/seed-delegation-sales.json and fixtures/seed-delegation-sales-v2.json`,
+	)
+
+	//there must be exactly one primary seed
+	_, errs = ReadDatabaseSeeds([]string{primaryPath, "fixtures/seed-basic.json"}, vcfg)
+	expectTheseErrors(t, errs,
+		`only one seed file may be the primary seed without a scope, but fixtures/seed-delegation-primary.json and fixtures/seed-basic.json do not declare a scope`,
+	)
+	_, errs = ReadDatabaseSeed("fixtures/seed-delegation-sales.json", vcfg)
+	expectTheseErrors(t, errs,
+		`all seed files declare a scope, but one of them needs to be the primary seed without a scope`,
+	)
+}
@@ -0,0 +1,53 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import "github.com/sapcc/go-bits/errext"
+
+// ServiceUser represents a bind account for an application that reads from
+// the LDAP directory. Unlike a User, it cannot log into Portunus, cannot be
+// put into groups and does not have POSIX attributes. It always has read
+// access to the LDAP directory, and nothing else.
+type ServiceUser struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//PasswordHash must be in the format generated by crypt(3).
+	PasswordHash string `json:"password"`
+}
+
+// Key implements the Object interface.
+func (s ServiceUser) Key() string {
+	return s.Name
+}
+
+// Cloned implements the Object interface.
+func (s ServiceUser) Cloned() ServiceUser {
+	return s
+}
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (s ServiceUser) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "service user",
+		Name: s.Name,
+	}
+}
+
+// Checks the individual attributes of this ServiceUser. Uniqueness is checked
+// in Database.Validate().
+func (s ServiceUser) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
+	ref := s.Ref()
+	errs.Add(ref.Field("name").WrapFirst(
+		MustNotBeEmpty(s.Name),
+		MustNotHaveSurroundingSpaces(s.Name),
+		MustBeUserLoginName(s.Name, cfg),
+		MustNotIncludeDNSyntaxElements(s.Name),
+	))
+	errs.Add(ref.Field("description").Wrap(MustNotHaveSurroundingSpaces(s.Description)))
+	errs.Add(ref.Field("password").Wrap(MustNotBeEmpty(s.PasswordHash)))
+	return
+}
@@ -0,0 +1,143 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TrustedProxies describes the reverse proxies in front of portunus-server
+// (e.g. an nginx that terminates TLS). Requests that come directly from one of
+// these networks may state the actual client IP in X-Forwarded-For or
+// X-Real-IP, and the protocol that the client used in X-Forwarded-Proto.
+// These headers are ignored on requests from all other peers, since they
+// could be forged by the client.
+type TrustedProxies struct {
+	Networks []*net.IPNet //from PORTUNUS_SERVER_TRUSTED_PROXIES
+}
+
+// ReadTrustedProxiesFromEnvironment builds a TrustedProxies instance from the
+// respective environment variable. If PORTUNUS_SERVER_TRUSTED_PROXIES is not
+// set, no proxy is trusted.
+func ReadTrustedProxiesFromEnvironment() (TrustedProxies, error) {
+	networks, err := parseNetworkList(os.Getenv("PORTUNUS_SERVER_TRUSTED_PROXIES"), "PORTUNUS_SERVER_TRUSTED_PROXIES")
+	return TrustedProxies{Networks: networks}, err
+}
+
+// ClientIP returns the IP address of the client that sent this request.
+//
+// If the request comes from a trusted proxy, X-Forwarded-For is read from
+// right to left: Each trusted proxy appends the address of its own peer, so
+// the first address that does not belong to a trusted proxy is the client.
+// Everything to the left of it could have been forged by the client.
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	peer := peerAddressOf(r)
+	ip := net.ParseIP(peer)
+	if !networksContain(p.Networks, ip) {
+		return peer
+	}
+
+	//proxies may add their own header line instead of appending to an
+	//existing one, so all lines need to be considered
+	if header := strings.Join(r.Header.Values("X-Forwarded-For"), ","); header != "" {
+		addrs := strings.Split(header, ",")
+		for idx := len(addrs) - 1; idx >= 0 && networksContain(p.Networks, ip); idx-- {
+			nextIP := net.ParseIP(strings.TrimSpace(addrs[idx]))
+			if nextIP == nil {
+				break
+			}
+			ip = nextIP
+		}
+		return ip.String()
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return peer
+}
+
+// IsHTTPS returns whether the client used HTTPS for this request, either to
+// connect to us directly, or to connect to a trusted proxy that says so in the
+// X-Forwarded-Proto header.
+func (p TrustedProxies) IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !networksContain(p.Networks, net.ParseIP(peerAddressOf(r))) {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")), "https")
+}
+
+type clientIPContextKey struct{}
+
+// AddClientIP returns a shallow copy of the given request that remembers the
+// result of ClientIP(), for use with ClientIPOf().
+func (p TrustedProxies) AddClientIP(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, p.ClientIP(r)))
+}
+
+// ClientIPOf returns the client IP that AddClientIP() has stored in this
+// request. If AddClientIP() was not called, the address of the direct peer is
+// returned. This is what all log messages shall show as the remote address.
+func ClientIPOf(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey{}).(string)
+	if ok {
+		return ip
+	}
+	return peerAddressOf(r)
+}
+
+// Returns the IP address of the direct peer of this request, without the port.
+func peerAddressOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Parses a list of IP addresses or CIDR ranges, separated by commas or
+// whitespace. The name of the environment variable is used in error messages.
+func parseNetworkList(input, envVarName string) ([]*net.IPNet, error) {
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	var result []*net.IPNet
+	for _, field := range fields {
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("malformed value for %s: %w", envVarName, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	t.Setenv("PORTUNUS_SERVER_TRUSTED_PROXIES", "10.0.0.0/8, ::1")
+	proxies, err := ReadTrustedProxiesFromEnvironment()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	type testCase struct {
+		Desc           string
+		RemoteAddr     string
+		ForwardedFor   []string //one entry per header line
+		RealIP         string
+		ForwardedProto string
+		ExpectedIP     string
+		ExpectedHTTPS  bool
+	}
+	testCases := []testCase{
+		{
+			Desc:       "direct request",
+			RemoteAddr: "198.51.100.7:1234",
+			ExpectedIP: "198.51.100.7",
+		},
+		{
+			Desc:           "request through proxy",
+			RemoteAddr:     "10.0.0.1:1234",
+			ForwardedFor:   []string{"198.51.100.7"},
+			ForwardedProto: "https",
+			ExpectedIP:     "198.51.100.7",
+			ExpectedHTTPS:  true,
+		},
+		{
+			Desc:       "request through proxy over IPv6",
+			RemoteAddr: "[::1]:1234",
+			RealIP:     "2001:db8::7",
+			ExpectedIP: "2001:db8::7",
+		},
+		{
+			//headers from untrusted peers are ignored entirely
+			Desc:           "spoofed headers",
+			RemoteAddr:     "198.51.100.7:1234",
+			ForwardedFor:   []string{"203.0.113.9"},
+			RealIP:         "203.0.113.9",
+			ForwardedProto: "https",
+			ExpectedIP:     "198.51.100.7",
+		},
+		{
+			//the client can prepend arbitrary addresses to X-Forwarded-For, so
+			//only the address that our proxy has appended is used
+			Desc:         "spoofed address in front of real address",
+			RemoteAddr:   "10.0.0.1:1234",
+			ForwardedFor: []string{"10.0.0.42, 203.0.113.9, 198.51.100.7"},
+			ExpectedIP:   "198.51.100.7",
+		},
+		{
+			//if the client sends its own X-Forwarded-For header, the proxy may
+			//add a separate header line instead of appending to the existing one
+			Desc:         "spoofed header line in front of real header line",
+			RemoteAddr:   "10.0.0.1:1234",
+			ForwardedFor: []string{"10.0.0.42, 203.0.113.9", "198.51.100.7"},
+			ExpectedIP:   "198.51.100.7",
+		},
+		{
+			Desc:         "chain of trusted proxies",
+			RemoteAddr:   "10.0.0.1:1234",
+			ForwardedFor: []string{"198.51.100.7, 10.0.0.2"},
+			ExpectedIP:   "198.51.100.7",
+		},
+		{
+			Desc:         "malformed address in chain",
+			RemoteAddr:   "10.0.0.1:1234",
+			ForwardedFor: []string{"198.51.100.7, garbage, 10.0.0.2"},
+			ExpectedIP:   "10.0.0.2",
+		},
+		{
+			//X-Real-IP is only used if X-Forwarded-For is not present
+			Desc:         "both headers",
+			RemoteAddr:   "10.0.0.1:1234",
+			ForwardedFor: []string{"198.51.100.7"},
+			RealIP:       "203.0.113.9",
+			ExpectedIP:   "198.51.100.7",
+		},
+		{
+			Desc:       "no headers from proxy",
+			RemoteAddr: "10.0.0.1:1234",
+			ExpectedIP: "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		r.RemoteAddr = tc.RemoteAddr
+		for _, line := range tc.ForwardedFor {
+			r.Header.Add("X-Forwarded-For", line)
+		}
+		if tc.RealIP != "" {
+			r.Header.Set("X-Real-IP", tc.RealIP)
+		}
+		if tc.ForwardedProto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.ForwardedProto)
+		}
+		assert.DeepEqual(t, "ClientIP for "+tc.Desc, proxies.ClientIP(r), tc.ExpectedIP)
+		assert.DeepEqual(t, "IsHTTPS for "+tc.Desc, proxies.IsHTTPS(r), tc.ExpectedHTTPS)
+		assert.DeepEqual(t, "ClientIPOf for "+tc.Desc, ClientIPOf(proxies.AddClientIP(r)), tc.ExpectedIP)
+	}
+
+	//without AddClientIP, ClientIPOf falls back to the direct peer
+	r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	assert.DeepEqual(t, "ClientIPOf without AddClientIP", ClientIPOf(r), "10.0.0.1")
+
+	//direct TLS connections are always HTTPS
+	r.TLS = &tls.ConnectionState{}
+	assert.DeepEqual(t, "IsHTTPS for TLS connection", TrustedProxies{}.IsHTTPS(r), true)
+
+	t.Setenv("PORTUNUS_SERVER_TRUSTED_PROXIES", "10.0.0.0/33")
+	_, err = ReadTrustedProxiesFromEnvironment()
+	assert.DeepEqual(t, "error for malformed network", err.Error(),
+		"malformed value for PORTUNUS_SERVER_TRUSTED_PROXIES: invalid CIDR address: 10.0.0.0/33")
+}
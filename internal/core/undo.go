@@ -0,0 +1,252 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// UndoRecord describes a change to a single user or group, such that it can
+// be reverted with Database.Undo() for a short time after it was made.
+type UndoRecord struct {
+	ID        string
+	Object    ObjectRef
+	Actor     string //login name of the admin who made the change
+	ChangedAt time.Time
+	ExpiresAt time.Time
+	//If not empty, this change cannot be undone, and this explains why.
+	NotUndoableReason string
+	//The fields of the object that were changed. Group members are not
+	//included here; they are covered by Memberships instead, so that unrelated
+	//membership changes in the meantime do not conflict with the undo.
+	Fields      []FieldChange
+	Memberships []MembershipChange
+}
+
+// Errors returned by Database.Undo().
+var (
+	ErrNotUndoable  = errors.New("this change cannot be undone")
+	ErrUndoExpired  = errors.New("this change cannot be undone anymore because it was made too long ago")
+	errUndoConflict = errors.New("cannot be reverted")
+)
+
+// NewUndoRecord compares the given object between the states of the
+// database before and after a change, and returns a record for undoing this
+// change until the given window has passed. False is returned if the object
+// did not change at all.
+//
+// Creations, deletions and password changes are recorded, but cannot be
+// undone (see UndoRecord.NotUndoableReason). Changes to seeded fields cannot
+// be made through the web GUI in the first place; if the seed changed in the
+// meantime, Database.Undo() reports the conflict as usual.
+func NewUndoRecord(before, after Database, ref ObjectRef, actor string, now time.Time, window time.Duration) (UndoRecord, bool) {
+	oldFields, existedBefore := before.flattenObjectForUndo(ref)
+	newFields, existsAfter := after.flattenObjectForUndo(ref)
+	r := UndoRecord{
+		ID:        hex.EncodeToString(GenerateRandomKey(12)),
+		Object:    ref,
+		Actor:     actor,
+		ChangedAt: now,
+		ExpiresAt: now.Add(window),
+		Fields:    diffFields(oldFields, newFields),
+	}
+	for _, change := range DiffMemberships(before, after) {
+		if (ref.Type == "user" && change.LoginName == ref.Name) || (ref.Type == "group" && change.GroupName == ref.Name) {
+			r.Memberships = append(r.Memberships, change)
+		}
+	}
+	if len(r.Fields) == 0 && len(r.Memberships) == 0 {
+		return UndoRecord{}, false
+	}
+	sort.Slice(r.Memberships, func(i, j int) bool {
+		lhs, rhs := r.Memberships[i], r.Memberships[j]
+		if lhs.GroupName != rhs.GroupName {
+			return lhs.GroupName < rhs.GroupName
+		}
+		return lhs.LoginName < rhs.LoginName
+	})
+
+	switch {
+	case !existedBefore:
+		r.NotUndoableReason = fmt.Sprintf("the %s was created by this change (delete it instead)", ref.Type)
+	case !existsAfter:
+		r.NotUndoableReason = fmt.Sprintf("the %s was deleted by this change", ref.Type)
+	default:
+		for _, field := range r.Fields {
+			if field.Path == "password" {
+				r.NotUndoableReason = "password changes cannot be undone (set the password again instead)"
+			}
+		}
+	}
+	if r.NotUndoableReason != "" {
+		//do not keep any field values around that cannot be used anyway
+		r.Fields, r.Memberships = nil, nil
+	}
+	return r, true
+}
+
+// Returns the flattened representation of the referenced object, as used in
+// an UndoRecord.
+func (d Database) flattenObjectForUndo(ref ObjectRef) (map[string]string, bool) {
+	switch ref.Type {
+	case "user":
+		user, exists := d.Users.Find(func(u User) bool { return u.LoginName == ref.Name })
+		if !exists {
+			return nil, false
+		}
+		return flattenObject(user), true
+	case "group":
+		group, exists := d.Groups.Find(func(g Group) bool { return g.Name == ref.Name })
+		if !exists {
+			return nil, false
+		}
+		fields := flattenObject(group)
+		delete(fields, "members")
+		return fields, true
+	default:
+		return nil, false
+	}
+}
+
+// Undo reverts the change described by the given record. Fields and
+// memberships that were changed again in the meantime are not overwritten:
+// Instead, a validation error is returned for each of them, and the caller
+// must abort the update. Fields that have already been reverted in the
+// meantime are left alone.
+func (d *Database) Undo(r UndoRecord, now time.Time) (errs errext.ErrorSet) {
+	if r.NotUndoableReason != "" {
+		errs.Addf("%s: %s", ErrNotUndoable.Error(), r.NotUndoableReason)
+		return errs
+	}
+	if !now.Before(r.ExpiresAt) {
+		errs.Add(ErrUndoExpired)
+		return errs
+	}
+
+	fields, exists := d.flattenObjectForUndo(r.Object)
+	if !exists {
+		errs.Addf("%s %q does not exist anymore", r.Object.Type, r.Object.Name)
+		return errs
+	}
+	for _, change := range r.Fields {
+		currentValue := fields[change.Path]
+		switch currentValue {
+		case change.OldValue:
+			//nothing to do
+		case change.NewValue:
+			if change.OldValue == "" {
+				delete(fields, change.Path)
+			} else {
+				fields[change.Path] = change.OldValue
+			}
+		default:
+			err := fmt.Errorf("%w because it was changed to %s in the meantime", errUndoConflict, displayFieldValue(currentValue))
+			errs.Add(r.Object.Field(change.Path).Wrap(err))
+		}
+	}
+	if !errs.IsEmpty() {
+		return errs
+	}
+
+	var err error
+	switch r.Object.Type {
+	case "user":
+		var user User
+		user, err = unflattenObject[User](fields)
+		if err == nil {
+			err = d.Users.Update(user)
+		}
+	case "group":
+		var group Group
+		group, err = unflattenObject[Group](fields)
+		if err == nil {
+			current, _ := d.Groups.Find(func(g Group) bool { return g.Name == r.Object.Name })
+			group.MemberLoginNames = current.MemberLoginNames
+			err = d.Groups.Update(group)
+		}
+	}
+	if err != nil {
+		errs.Add(fmt.Errorf("cannot undo change to %s %q: %w", r.Object.Type, r.Object.Name, err))
+		return errs
+	}
+
+	for _, change := range r.Memberships {
+		idx := -1
+		for groupIdx, group := range d.Groups {
+			if group.Name == change.GroupName {
+				idx = groupIdx
+			}
+		}
+		ref := Group{Name: change.GroupName}.Ref().Field("members")
+		switch {
+		case idx < 0:
+			errs.Addf("cannot revert membership of user %q in group %q: the group does not exist anymore", change.LoginName, change.GroupName)
+		case change.Kind == MemberAdded:
+			delete(d.Groups[idx].MemberLoginNames, change.LoginName)
+		case change.Kind == MemberRemoved:
+			if _, exists := d.Users.Find(func(u User) bool { return u.LoginName == change.LoginName }); !exists {
+				errs.Add(ref.Wrap(fmt.Errorf("%w because user %q does not exist anymore", errUndoConflict, change.LoginName)))
+				continue
+			}
+			if d.Groups[idx].MemberLoginNames == nil {
+				d.Groups[idx].MemberLoginNames = make(GroupMemberNames)
+			}
+			d.Groups[idx].MemberLoginNames[change.LoginName] = true
+		}
+	}
+	return errs
+}
+
+// UndoJournal holds the most recent UndoRecord for each user and group. It
+// can be used from any goroutine. The zero value is an empty journal.
+type UndoJournal struct {
+	mutex   sync.Mutex
+	records map[ObjectRef]UndoRecord
+}
+
+// Add stores the given record, replacing any older record for the same object.
+func (j *UndoJournal) Add(r UndoRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.records == nil {
+		j.records = make(map[ObjectRef]UndoRecord)
+	}
+	j.records[r.Object] = r
+}
+
+// Latest returns the most recent record for the given object, unless it has
+// expired.
+func (j *UndoJournal) Latest(ref ObjectRef, now time.Time) (UndoRecord, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	r, exists := j.records[ref]
+	if !exists {
+		return UndoRecord{}, false
+	}
+	if !now.Before(r.ExpiresAt) {
+		delete(j.records, ref)
+		return UndoRecord{}, false
+	}
+	return r, true
+}
+
+// Remove drops the record with the given ID, e.g. after it has been undone.
+// Nothing happens if the record has already been replaced by a newer one.
+func (j *UndoJournal) Remove(r UndoRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.records[r.Object].ID == r.ID {
+		delete(j.records, r.Object)
+	}
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestUndo(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison", PasswordHash: "{SSHA}alice"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+		}
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Administrators", MemberLoginNames: GroupMemberNames{"alice": true}},
+			{Name: "developers", LongName: "Developers", MemberLoginNames: GroupMemberNames{"bob": true}},
+		}
+		return nil
+	}, nil))
+
+	//records the change made by the given action to the given object
+	now := time.Now()
+	recordChange := func(ref ObjectRef, action func(db *Database)) (record UndoRecord, ok bool) {
+		t.Helper()
+		expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+			before := db.Cloned()
+			action(db)
+			record, ok = NewUndoRecord(before, *db, ref, "bob", now, 10*time.Minute)
+			return nil
+		}, nil))
+		return
+	}
+	undo := func(record UndoRecord, now time.Time) errext.ErrorSet {
+		return nexus.Update(func(db *Database) errext.ErrorSet {
+			return db.Undo(record, now)
+		}, &UpdateOptions{ConflictWithSeedIsError: true, Actor: "bob"})
+	}
+	alice := User{LoginName: "alice"}.Ref()
+
+	//no record is made if the object did not change
+	_, ok := recordChange(alice, func(db *Database) {
+		db.Users[1].GivenName = "Robert"
+	})
+	assert.DeepEqual(t, "record for unrelated change exists", ok, false)
+
+	//make a change that touches fields and memberships
+	record, ok := recordChange(alice, func(db *Database) {
+		db.Users[0].GivenName = "Alicia"
+		db.Users[0].EMailAddress = "alice@example.org"
+		db.Groups[1].MemberLoginNames["alice"] = true
+	})
+	assert.DeepEqual(t, "record exists", ok, true)
+	assert.DeepEqual(t, "record.NotUndoableReason", record.NotUndoableReason, "")
+	assert.DeepEqual(t, "record.Memberships", record.Memberships, []MembershipChange{
+		{GroupName: "developers", LoginName: "alice", Kind: MemberAdded},
+	})
+
+	//the undo fails once the window has passed
+	expectTheseErrors(t, undo(record, record.ExpiresAt),
+		ErrUndoExpired.Error(),
+	)
+
+	//the undo fails if the same field was changed again in the meantime
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].GivenName = "Ali"
+		return nil
+	}, nil))
+	expectTheseErrors(t, undo(record, now),
+		`field "given_name" in user "alice" cannot be reverted because it was changed to "Ali" in the meantime`,
+	)
+	user, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice.GivenName after failed undo", user.GivenName, "Ali")
+
+	//once the conflict is gone, the undo succeeds; fields that were reverted
+	//already in the meantime do not conflict
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].GivenName = "Alicia"
+		db.Users[0].EMailAddress = ""
+		return nil
+	}, nil))
+	expectNoErrors(t, undo(record, now))
+	user, _ = nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice.GivenName after undo", user.GivenName, "Alice")
+	assert.DeepEqual(t, "alice.EMailAddress after undo", user.EMailAddress, "")
+	assert.DeepEqual(t, "alice.PasswordHash after undo", user.PasswordHash, "{SSHA}alice")
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "developers" })
+	assert.DeepEqual(t, "developers.MemberLoginNames after undo", group.MemberLoginNames, GroupMemberNames{"bob": true})
+
+	//changes to group memberships are reverted individually, so unrelated
+	//membership changes in the meantime do not conflict
+	developers := Group{Name: "developers"}.Ref()
+	record, _ = recordChange(developers, func(db *Database) {
+		db.Groups[1].LongName = "Development"
+		db.Groups[1].MemberLoginNames["alice"] = true
+	})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		delete(db.Groups[1].MemberLoginNames, "bob")
+		return nil
+	}, nil))
+	expectNoErrors(t, undo(record, now))
+	group, _ = nexus.FindGroup(func(g Group) bool { return g.Name == "developers" })
+	assert.DeepEqual(t, "developers.LongName after undo", group.LongName, "Developers")
+	assert.DeepEqual(t, "developers.MemberLoginNames after undo", group.MemberLoginNames, GroupMemberNames{})
+
+	//password changes, creations and deletions cannot be undone
+	record, _ = recordChange(alice, func(db *Database) {
+		db.Users[0].GivenName = "Alicia"
+		db.Users[0].PasswordHash = "{SSHA}changed"
+	})
+	assert.DeepEqual(t, "record.Fields for password change", record.Fields, []FieldChange(nil))
+	expectTheseErrors(t, undo(record, now),
+		"this change cannot be undone: password changes cannot be undone (set the password again instead)",
+	)
+	carol := User{LoginName: "carol"}.Ref()
+	record, _ = recordChange(carol, func(db *Database) {
+		db.Users = append(db.Users, User{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson"})
+	})
+	expectTheseErrors(t, undo(record, now),
+		"this change cannot be undone: the user was created by this change (delete it instead)",
+	)
+	record, _ = recordChange(carol, func(db *Database) {
+		db.Users = db.Users[:2]
+	})
+	expectTheseErrors(t, undo(record, now),
+		"this change cannot be undone: the user was deleted by this change",
+	)
+}
+
+func TestUndoConflictsWithSeed(t *testing.T) {
+	//the seed enforces the current given name, so reverting it must fail
+	seed := &DatabaseSeed{
+		Users: []UserSeed{{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"}},
+	}
+	nexus := NewNexus(seed, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet { return nil }, nil))
+
+	before := Database{Users: []User{{LoginName: "alice", GivenName: "Alicia", FamilyName: "Allison"}}}
+	after := Database{Users: []User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"}}}
+	now := time.Now()
+	record, _ := NewUndoRecord(before, after, User{LoginName: "alice"}.Ref(), "bob", now, time.Minute)
+	expectTheseErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		return db.Undo(record, now)
+	}, &UpdateOptions{ConflictWithSeedIsError: true}),
+		`field "given_name" in user "alice" must be equal to the seeded value`,
+	)
+}
+
+func TestUndoJournal(t *testing.T) {
+	var journal UndoJournal
+	now := time.Now()
+	ref := User{LoginName: "alice"}.Ref()
+	first := UndoRecord{ID: "first", Object: ref, ExpiresAt: now.Add(time.Minute)}
+	second := UndoRecord{ID: "second", Object: ref, ExpiresAt: now.Add(time.Minute)}
+
+	//only the most recent record is kept
+	journal.Add(first)
+	journal.Add(second)
+	record, ok := journal.Latest(ref, now)
+	assert.DeepEqual(t, "latest record exists", ok, true)
+	assert.DeepEqual(t, "latest record", record.ID, "second")
+
+	//removing a replaced record does not affect its replacement
+	journal.Remove(first)
+	_, ok = journal.Latest(ref, now)
+	assert.DeepEqual(t, "latest record exists after removing the first", ok, true)
+	journal.Remove(second)
+	_, ok = journal.Latest(ref, now)
+	assert.DeepEqual(t, "latest record exists after removing the second", ok, false)
+
+	//expired records are not returned
+	journal.Add(first)
+	_, ok = journal.Latest(ref, now.Add(time.Minute))
+	assert.DeepEqual(t, "latest record exists after expiry", ok, false)
+}
@@ -7,7 +7,11 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sapcc/go-bits/errext"
 	"golang.org/x/crypto/ssh"
@@ -15,16 +19,88 @@ import (
 
 // User represents a single user account.
 type User struct {
+	//ID is generated by Portunus when the user is created and never changes
+	//afterwards, not even when the user is renamed. Applications can use it to
+	//recognize users (e.g. it is the subject of OIDC ID tokens).
+	ID            string   `json:"id,omitempty"`
 	LoginName     string   `json:"login_name"`
 	GivenName     string   `json:"given_name"`
 	FamilyName    string   `json:"family_name"`
 	EMailAddress  string   `json:"email,omitempty"`
-	SSHPublicKeys []string `json:"ssh_public_keys,omitempty"`
+	SSHPublicKeys []SSHKey `json:"ssh_public_keys,omitempty"`
+	//Phone and MobilePhone are shown as telephoneNumber and mobile in LDAP.
+	Phone       string `json:"phone,omitempty"`
+	MobilePhone string `json:"mobile_phone,omitempty"`
+	//If FamilyNameFirst is true, the full name is shown as "FamilyName GivenName"
+	//instead of "GivenName FamilyName".
+	FamilyNameFirst bool `json:"family_name_first,omitempty"`
 	//PasswordHash must be in the format generated by crypt(3).
 	PasswordHash string               `json:"password"`
 	POSIX        *UserPosixAttributes `json:"posix,omitempty"`
+	//ExtraAttributes are passed through into the user's LDAP object unchanged.
+	//Only attributes from SupportedExtraAttributes are allowed as keys.
+	ExtraAttributes map[string][]string `json:"extra_attributes,omitempty"`
+	//If MustChangePassword is set, the user needs to choose a new password
+	//before they can use anything else in the web GUI. This is set when an
+	//admin chooses the user's password for them.
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+	//Invitation is set for users that were created without a password, until
+	//they set their password through the invitation link.
+	Invitation *UserInvitation `json:"invitation,omitempty"`
+	//If ValidUntil is set, the user account expires at that time: The user
+	//cannot log in to Portunus anymore, and their password is removed from LDAP.
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	//Photo is a JPEG image (see ParseUserPhoto) that is shown as jpegPhoto in
+	//LDAP. In the database file, it appears base64-encoded.
+	Photo []byte `json:"photo,omitempty"`
+	//Department is shown as ou in LDAP. It does not affect the DN of the user.
+	Department string `json:"department,omitempty"`
+	//PreferredLanguage is a BCP 47 language tag like "de-CH". It is shown as
+	//preferredLanguage in LDAP.
+	PreferredLanguage string `json:"preferred_language,omitempty"`
+	//Timezone is an IANA time zone name like "Europe/Berlin". It is shown as
+	//portunusTimezone in LDAP.
+	Timezone string `json:"timezone,omitempty"`
+	//FormerLoginNames lists the login names that this user had before being
+	//renamed, until their retention period has passed (see Database.RenameUser).
+	FormerLoginNames []FormerLoginName `json:"former_login_names,omitempty"`
 }
 
+// SupportedExtraAttributes lists the LDAP attributes that can appear in
+// User.ExtraAttributes. These are the attributes allowed by the object classes
+// that Portunus puts on user objects (inetOrgPerson and its superclasses),
+// minus those that Portunus already manages by itself and those that require
+// binary values. Since all of them are defined in the standard schemas, using
+// them does not require any changes to the LDAP server's schema.
+//
+// The exceptions are mobile, telephoneNumber, ou and preferredLanguage. These
+// are managed through User.MobilePhone, User.Phone, User.Department and
+// User.PreferredLanguage now. They stay allowed for users that had them before
+// those fields existed, but only while the respective field is empty.
+var SupportedExtraAttributes = []string{
+	//from inetOrgPerson
+	"businessCategory", "carLicense", "departmentNumber", "displayName",
+	"employeeNumber", "employeeType", "homePhone", "homePostalAddress",
+	"initials", "labeledURI", "manager", "mobile", "o", "pager",
+	"preferredLanguage", "roomNumber", "secretary",
+	//from organizationalPerson
+	"destinationIndicator", "facsimileTelephoneNumber", "internationaliSDNNumber",
+	"l", "ou", "physicalDeliveryOfficeName", "postOfficeBox", "postalAddress",
+	"postalCode", "preferredDeliveryMethod", "registeredAddress", "st", "street",
+	"telephoneNumber", "teletexTerminalIdentifier", "telexNumber", "title",
+	"x121Address",
+	//from person
+	"description", "seeAlso",
+}
+
+var isSupportedExtraAttribute = func() map[string]bool {
+	result := make(map[string]bool, len(SupportedExtraAttributes))
+	for _, name := range SupportedExtraAttributes {
+		result[name] = true
+	}
+	return result
+}()
+
 // UserPosixAttributes appears in type User.
 type UserPosixAttributes struct {
 	UID           PosixID `json:"uid"`
@@ -34,6 +110,159 @@ type UserPosixAttributes struct {
 	GECOS         string  `json:"gecos"` //optional
 }
 
+// SSHKey appears in type User.
+type SSHKey struct {
+	//Key is the public key in the format used by authorized_keys(5).
+	Key     string `json:"key"`
+	Comment string `json:"comment,omitempty"`
+	//AddedAt is nil for keys that were added before Portunus started tracking
+	//this, or that come from a seed.
+	AddedAt *time.Time `json:"added_at,omitempty"`
+	//If Hidden is true, the key is not rendered into the sshPublicKey attribute
+	//in LDAP.
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// Cloned returns a deep copy of this key.
+func (k SSHKey) Cloned() SSHKey {
+	if k.AddedAt != nil {
+		val := *k.AddedAt
+		k.AddedAt = &val
+	}
+	return k
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+//
+// Keys without any metadata are written as plain strings, in the same format
+// that older versions of Portunus use. This keeps database files readable for
+// these older versions, until someone starts using the new fields.
+func (k SSHKey) MarshalJSON() ([]byte, error) {
+	if k.Comment == "" && k.AddedAt == nil && !k.Hidden {
+		return json.Marshal(k.Key)
+	}
+	type plainSSHKey SSHKey //same fields, but without the custom (un)marshaling
+	return json.Marshal(plainSSHKey(k))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Both the plain
+// string format from older versions of Portunus and the object format are
+// accepted.
+func (k *SSHKey) UnmarshalJSON(buf []byte) error {
+	var key string
+	if json.Unmarshal(buf, &key) == nil {
+		*k = SSHKey{Key: key}
+		return nil
+	}
+	type plainSSHKey SSHKey //same fields, but without the custom (un)marshaling
+	var result plainSSHKey
+	err := json.Unmarshal(buf, &result)
+	if err != nil {
+		return err
+	}
+	*k = SSHKey(result)
+	return nil
+}
+
+// VisibleSSHPublicKeys returns the SSH public keys that shall appear in LDAP,
+// that is, all keys that are not marked as hidden.
+func (u User) VisibleSSHPublicKeys() []string {
+	var result []string
+	for _, key := range u.SSHPublicKeys {
+		if !key.Hidden {
+			result = append(result, key.Key)
+		}
+	}
+	return result
+}
+
+// SSHPublicKeyStrings returns the keys in this list, without metadata.
+func SSHPublicKeyStrings(keys []SSHKey) []string {
+	if keys == nil {
+		return nil
+	}
+	result := make([]string, len(keys))
+	for idx, key := range keys {
+		result[idx] = key.Key
+	}
+	return result
+}
+
+// MergeSSHPublicKeys builds a new list of SSH public keys from the given list
+// of key strings. For keys that already appear in `existing`, their metadata
+// is retained. New keys are recorded as being added at `now` (which can be nil
+// if this is not known).
+func MergeSSHPublicKeys(existing []SSHKey, keys []string, now *time.Time) []SSHKey {
+	if len(keys) == 0 {
+		return nil
+	}
+	existingByKey := make(map[string]SSHKey, len(existing))
+	for _, key := range existing {
+		existingByKey[key.Key] = key
+	}
+	result := make([]SSHKey, len(keys))
+	for idx, key := range keys {
+		if e, exists := existingByKey[key]; exists {
+			result[idx] = e.Cloned()
+		} else {
+			result[idx] = SSHKey{Key: key}
+			if now != nil {
+				val := *now
+				result[idx].AddedAt = &val
+			}
+		}
+	}
+	return result
+}
+
+// MatchUserIdent returns a predicate that matches users with the given login
+// name or email address, as entered on the login form. Both are compared
+// case-insensitively. Since an identifier may match more than one user, use
+// FindUserByIdent to look up the user.
+//
+// If loginNameSuffix is not empty (e.g. "@example.org"), an identifier
+// with this suffix also matches the login name without the suffix, so that
+// users can log in with "jane@example.org" even if that is not their email
+// address.
+func MatchUserIdent(userIdent, loginNameSuffix string) func(User) bool {
+	if !strings.Contains(userIdent, "@") {
+		return func(u User) bool { return strings.EqualFold(u.LoginName, userIdent) }
+	}
+
+	loginName := ""
+	if loginNameSuffix != "" && len(userIdent) > len(loginNameSuffix) {
+		prefix, suffix := userIdent[:len(userIdent)-len(loginNameSuffix)], userIdent[len(userIdent)-len(loginNameSuffix):]
+		if strings.EqualFold(suffix, loginNameSuffix) {
+			loginName = prefix
+		}
+	}
+	return func(u User) bool {
+		if loginName != "" && strings.EqualFold(u.LoginName, loginName) {
+			return true
+		}
+		return u.EMailAddress != "" && strings.EqualFold(u.EMailAddress, userIdent)
+	}
+}
+
+// FindUserByIdent finds the user with the given login name or email address,
+// as entered on the login form (see MatchUserIdent). If the identifier matches
+// more than one user (e.g. when the login name of one user plus the login name
+// suffix is the email address of another user), no user is returned, since we
+// cannot know which one was meant.
+func FindUserByIdent(n Nexus, userIdent, loginNameSuffix string) (UserWithPerms, bool) {
+	predicate := MatchUserIdent(userIdent, loginNameSuffix)
+	var loginNames []string
+	for _, u := range n.ListUsers() {
+		if predicate(u) {
+			loginNames = append(loginNames, u.LoginName)
+		}
+	}
+	if len(loginNames) != 1 {
+		return UserWithPerms{}, false
+	}
+	return n.FindUser(func(u User) bool { return u.LoginName == loginNames[0] })
+}
+
 // Key implements the Object interface.
 func (u User) Key() string {
 	return u.LoginName
@@ -45,15 +274,82 @@ func (u User) Cloned() User {
 		val := *u.POSIX
 		u.POSIX = &val
 	}
+	if u.Invitation != nil {
+		val := *u.Invitation
+		u.Invitation = &val
+	}
+	if u.ValidUntil != nil {
+		val := *u.ValidUntil
+		u.ValidUntil = &val
+	}
 	if u.SSHPublicKeys != nil {
-		u.SSHPublicKeys = append([]string(nil), u.SSHPublicKeys...)
+		keys := make([]SSHKey, len(u.SSHPublicKeys))
+		for idx, key := range u.SSHPublicKeys {
+			keys[idx] = key.Cloned()
+		}
+		u.SSHPublicKeys = keys
+	}
+	if u.Photo != nil {
+		u.Photo = append([]byte(nil), u.Photo...)
+	}
+	if u.ExtraAttributes != nil {
+		extraAttrs := make(map[string][]string, len(u.ExtraAttributes))
+		for name, values := range u.ExtraAttributes {
+			extraAttrs[name] = append([]string(nil), values...)
+		}
+		u.ExtraAttributes = extraAttrs
+	}
+	if u.FormerLoginNames != nil {
+		u.FormerLoginNames = append([]FormerLoginName(nil), u.FormerLoginNames...)
 	}
 	return u
 }
 
-// FullName returns the user's full name.
+// FullName returns the user's full name, with the given name and family name
+// in the order requested by FamilyNameFirst. For users without a family name,
+// this is just the given name.
 func (u User) FullName() string {
-	return u.GivenName + " " + u.FamilyName //TODO: allow flipped order (family name first)
+	switch {
+	case u.FamilyName == "":
+		return u.GivenName
+	case u.FamilyNameFirst:
+		return u.FamilyName + " " + u.GivenName
+	default:
+		return u.GivenName + " " + u.FamilyName
+	}
+}
+
+// IsExpiredAt returns whether this user account has expired at the given time.
+func (u User) IsExpiredAt(now time.Time) bool {
+	return u.ValidUntil != nil && !now.Before(*u.ValidUntil)
+}
+
+// ExpiresWithin returns whether this user account has not expired yet at the
+// given time, but will expire within the given duration.
+func (u User) ExpiresWithin(now time.Time, d time.Duration) bool {
+	return u.ValidUntil != nil && !u.IsExpiredAt(now) && u.ValidUntil.Before(now.Add(d))
+}
+
+// ParseValidUntilDate parses a date like "2006-01-02" for use as
+// User.ValidUntil. The account stays valid until the end of the given day in
+// the server's local time zone. An empty input yields nil.
+func ParseValidUntilDate(input string, ref FieldRef) (*time.Time, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, input, time.Local)
+	if err != nil {
+		return nil, ref.Wrap(errNotDate)
+	}
+	validUntil := day.AddDate(0, 0, 1).UTC()
+	return &validUntil, nil
+}
+
+// FormatValidUntilDate is the inverse of ParseValidUntilDate: It returns the
+// last day on which an account with the given User.ValidUntil is valid.
+func FormatValidUntilDate(validUntil time.Time) string {
+	return validUntil.In(time.Local).Add(-time.Nanosecond).Format(time.DateOnly)
 }
 
 // Ref returns an ObjectRef that can be used to build validation errors.
@@ -80,19 +376,61 @@ func (u User) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		MustNotHaveSurroundingSpaces(u.GivenName),
 	))
 	errs.Add(ref.Field("family_name").WrapFirst(
-		MustNotBeEmpty(u.FamilyName),
+		MustNotBeEmptyIf(u.FamilyName, !cfg.AllowEmptyFamilyName),
 		MustNotHaveSurroundingSpaces(u.FamilyName),
 	))
 	errs.Add(ref.Field("email").Wrap(MustNotHaveSurroundingSpaces(u.EMailAddress)))
+	errs.Add(ref.Field("department").Wrap(MustNotHaveSurroundingSpaces(u.Department)))
+	errs.Add(ref.Field("phone").Wrap(MustBePhoneNumber(u.Phone)))
+	errs.Add(ref.Field("mobile_phone").Wrap(MustBePhoneNumber(u.MobilePhone)))
+	errs.Add(ref.Field("preferred_language").Wrap(MustBeLanguageTag(u.PreferredLanguage)))
+	errs.Add(ref.Field("timezone").Wrap(MustBeTimezoneName(u.Timezone)))
+	errs.Add(ref.Field("photo").Wrap(MustBeUserPhoto(u.Photo)))
 
 	for idx, key := range u.SSHPublicKeys {
-		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
 		if err != nil {
 			err = fmt.Errorf("must have a valid SSH public key on each line (parse error on line %d)", idx+1)
 			errs.Add(ref.Field("ssh_public_keys").Wrap(err))
 		}
 	}
 
+	//iterate in a stable order to get deterministic error messages
+	extraAttrNames := make([]string, 0, len(u.ExtraAttributes))
+	for name := range u.ExtraAttributes {
+		extraAttrNames = append(extraAttrNames, name)
+	}
+	sort.Strings(extraAttrNames)
+	for _, name := range extraAttrNames {
+		errs.Add(ref.Field("extra_attributes").WrapFirst(
+			MustBeLDAPAttributeDescriptor(name),
+			MustBeSupportedExtraAttribute(name),
+		))
+		for _, value := range u.ExtraAttributes[name] {
+			if value == "" {
+				err := fmt.Errorf("may not contain empty values (found one for %q)", name)
+				errs.Add(ref.Field("extra_attributes").Wrap(err))
+				break
+			}
+		}
+	}
+	if u.Phone != "" && len(u.ExtraAttributes["telephoneNumber"]) > 0 {
+		err := fmt.Errorf("may not contain %q while the phone number is set", "telephoneNumber")
+		errs.Add(ref.Field("extra_attributes").Wrap(err))
+	}
+	if u.MobilePhone != "" && len(u.ExtraAttributes["mobile"]) > 0 {
+		err := fmt.Errorf("may not contain %q while the mobile phone number is set", "mobile")
+		errs.Add(ref.Field("extra_attributes").Wrap(err))
+	}
+	if u.Department != "" && len(u.ExtraAttributes["ou"]) > 0 {
+		err := fmt.Errorf("may not contain %q while the department is set", "ou")
+		errs.Add(ref.Field("extra_attributes").Wrap(err))
+	}
+	if u.PreferredLanguage != "" && len(u.ExtraAttributes["preferredLanguage"]) > 0 {
+		err := fmt.Errorf("may not contain %q while the preferred language is set", "preferredLanguage")
+		errs.Add(ref.Field("extra_attributes").Wrap(err))
+	}
+
 	if u.POSIX != nil {
 		errs.Add(ref.Field("posix_home").WrapFirst(
 			MustNotBeEmpty(u.POSIX.HomeDirectory),
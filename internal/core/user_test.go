@@ -0,0 +1,386 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestUserNameOrder(t *testing.T) {
+	u := User{LoginName: "tanaka", GivenName: "Hanako", FamilyName: "Tanaka"}
+	assert.DeepEqual(t, "default order", u.FullName(), "Hanako Tanaka")
+
+	u.FamilyNameFirst = true
+	assert.DeepEqual(t, "family name first", u.FullName(), "Tanaka Hanako")
+
+	u.FamilyName = ""
+	assert.DeepEqual(t, "without family name", u.FullName(), "Hanako")
+}
+
+func TestUserWithoutFamilyName(t *testing.T) {
+	db := Database{
+		Users: []User{{LoginName: "teller", GivenName: "Teller"}},
+	}
+
+	//by default, the family name is required...
+	vcfg := GetValidationConfigForTests()
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "family_name" in user "teller" is missing`,
+	)
+
+	//...but this can be relaxed
+	vcfg.AllowEmptyFamilyName = true
+	expectNoErrors(t, db.Validate(vcfg))
+
+	//surrounding spaces are still not allowed
+	db.Users[0].FamilyName = " "
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "family_name" in user "teller" may not start with a space character`,
+	)
+}
+
+func TestPosixDefaults(t *testing.T) {
+	mustApply := func(d *PosixDefaults, u *User) {
+		t.Helper()
+		err := d.ApplyTo(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := NewPosixDefaults("/home/{{.LoginName}}", "/bin/bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//users without POSIX attributes are not touched
+	u := User{LoginName: "jdoe"}
+	mustApply(d, &u)
+	assert.DeepEqual(t, "POSIX attributes", u.POSIX, (*UserPosixAttributes)(nil))
+
+	//empty fields are filled in, but explicit values are retained
+	u.POSIX = &UserPosixAttributes{UID: 1000, GID: 100}
+	mustApply(d, &u)
+	assert.DeepEqual(t, "POSIX attributes", *u.POSIX, UserPosixAttributes{
+		UID:           1000,
+		GID:           100,
+		HomeDirectory: "/home/jdoe",
+		LoginShell:    "/bin/bash",
+	})
+	u.POSIX = &UserPosixAttributes{UID: 1000, GID: 100, HomeDirectory: "/srv/jdoe", LoginShell: "/bin/zsh"}
+	mustApply(d, &u)
+	assert.DeepEqual(t, "home directory", u.POSIX.HomeDirectory, "/srv/jdoe")
+	assert.DeepEqual(t, "login shell", u.POSIX.LoginShell, "/bin/zsh")
+
+	//the rendered home directory goes through the regular validation
+	d, err = NewPosixDefaults("home/{{.LoginName}}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.POSIX = &UserPosixAttributes{UID: 1000, GID: 100}
+	mustApply(d, &u)
+	db := Database{Users: []User{{LoginName: "jdoe", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "x", POSIX: u.POSIX}}}
+	expectTheseErrors(t, db.Validate(GetValidationConfigForTests()),
+		`field "posix_home" in user "jdoe" must be an absolute path, i.e. start with a /`,
+	)
+
+	//malformed configuration is reported upfront
+	_, err = NewPosixDefaults("/home/{{.LoginName", "")
+	assert.DeepEqual(t, "error for syntax error", err != nil, true)
+	_, err = NewPosixDefaults("/home/{{.UserName}}", "")
+	assert.DeepEqual(t, "error for nonexistent field", err != nil, true)
+	_, err = NewPosixDefaults("", "bash")
+	assert.DeepEqual(t, "error for relative shell path", err.Error(),
+		`malformed value for PORTUNUS_POSIX_DEFAULT_SHELL: "bash" must be an absolute path, i.e. start with a /`)
+}
+
+func TestUserExpiry(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	u := User{LoginName: "contractor"}
+	assert.DeepEqual(t, "expired without ValidUntil", u.IsExpiredAt(now), false)
+	assert.DeepEqual(t, "expiring without ValidUntil", u.ExpiresWithin(now, 24*time.Hour), false)
+
+	u.ValidUntil = pointerTo(now.Add(12 * time.Hour))
+	assert.DeepEqual(t, "expired before ValidUntil", u.IsExpiredAt(now), false)
+	assert.DeepEqual(t, "expiring within a day", u.ExpiresWithin(now, 24*time.Hour), true)
+	assert.DeepEqual(t, "expiring within an hour", u.ExpiresWithin(now, time.Hour), false)
+	assert.DeepEqual(t, "expired at ValidUntil", u.IsExpiredAt(*u.ValidUntil), true)
+	assert.DeepEqual(t, "expiring once expired", u.ExpiresWithin(*u.ValidUntil, 24*time.Hour), false)
+
+	//the date from the web GUI is the last day on which the account is valid
+	ref := u.Ref().Field("valid_until")
+	validUntil, err := ParseValidUntilDate("2024-03-31", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2024, 4, 1, 0, 0, 0, 0, time.Local).UTC()
+	assert.DeepEqual(t, "parsed date", *validUntil, expected)
+	assert.DeepEqual(t, "formatted date", FormatValidUntilDate(*validUntil), "2024-03-31")
+
+	validUntil, err = ParseValidUntilDate("", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "parsed empty date", validUntil, (*time.Time)(nil))
+
+	_, err = ParseValidUntilDate("31.03.2024", ref)
+	assert.DeepEqual(t, "error for malformed date", err.Error(),
+		`field "valid_until" in user "contractor" is not a date in the format YYYY-MM-DD`)
+}
+
+func TestSSHKeySerialization(t *testing.T) {
+	addedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	//database files from older versions contain plain strings, and keys without
+	//metadata are still written in that format
+	buf := `["ssh-ed25519 AAAA alice@old",{"key":"ssh-ed25519 BBBB alice@new","comment":"laptop","added_at":"2024-01-02T03:04:05Z","hidden":true}]`
+	var keys []SSHKey
+	must.Succeed(json.Unmarshal([]byte(buf), &keys))
+	assert.DeepEqual(t, "parsed keys", keys, []SSHKey{
+		{Key: "ssh-ed25519 AAAA alice@old"},
+		{Key: "ssh-ed25519 BBBB alice@new", Comment: "laptop", AddedAt: &addedAt, Hidden: true},
+	})
+	assert.DeepEqual(t, "rendered keys", string(must.Return(json.Marshal(keys))), buf)
+
+	u := User{SSHPublicKeys: keys}
+	assert.DeepEqual(t, "visible keys", u.VisibleSSHPublicKeys(), []string{"ssh-ed25519 AAAA alice@old"})
+
+	//a round trip through the textarea in the admin UI retains metadata for existing keys
+	now := addedAt.Add(time.Hour)
+	merged := MergeSSHPublicKeys(keys, []string{"ssh-ed25519 BBBB alice@new", "ssh-ed25519 CCCC alice@newer"}, &now)
+	assert.DeepEqual(t, "merged keys", merged, []SSHKey{
+		{Key: "ssh-ed25519 BBBB alice@new", Comment: "laptop", AddedAt: &addedAt, Hidden: true},
+		{Key: "ssh-ed25519 CCCC alice@newer", AddedAt: &now},
+	})
+	assert.DeepEqual(t, "merged keys", MergeSSHPublicKeys(keys, nil, &now), []SSHKey(nil))
+}
+
+func TestMatchUserIdent(t *testing.T) {
+	users := []User{
+		{LoginName: "jane", EMailAddress: "jane.doe@example.com"},
+		{LoginName: "john"},
+	}
+	check := func(userIdent, loginNameSuffix, expected string) {
+		t.Helper()
+		actual := ""
+		for _, u := range users {
+			if MatchUserIdent(userIdent, loginNameSuffix)(u) {
+				actual = u.LoginName
+				break
+			}
+		}
+		assert.DeepEqual(t, "match for "+userIdent, actual, expected)
+	}
+
+	check("jane", "", "jane")
+	check("JANE", "", "jane")
+	check("Jane.Doe@Example.com", "", "jane")
+	check("john@example.org", "", "")
+	check("jane@", "", "")
+
+	//with a login name suffix, the suffix is stripped before matching the login name
+	check("john@example.org", "@example.org", "john")
+	check("John@EXAMPLE.org", "@example.org", "john")
+	check("john@example.com", "@example.org", "")
+	check("@example.org", "@example.org", "")
+	check("jane.doe@example.com", "@example.org", "jane")
+}
+
+func TestUserNamesDifferingOnlyByCase(t *testing.T) {
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "Jane", GivenName: "Jane", FamilyName: "Dorian"},
+		},
+	}
+	vcfg := GetValidationConfigForTests()
+	vcfg.UserNameRegex = regexp.MustCompile(`^[a-zA-Z]+$`)
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "login_name" in user "jane" is already in use (with different capitalization)`,
+		`field "login_name" in user "Jane" is already in use (with different capitalization)`,
+	)
+
+	db.Users[1].LoginName = "janet"
+	expectNoErrors(t, db.Validate(vcfg))
+}
+
+func TestAmbiguousUserIdent(t *testing.T) {
+	//jane's email address looks like john's login name with the login name
+	//suffix, so "john@example.org" could refer to either of them
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", EMailAddress: "john@example.org"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	user, exists := FindUserByIdent(nexus, "john@example.org", "")
+	assert.DeepEqual(t, "user found without suffix", exists, true)
+	assert.DeepEqual(t, "login name without suffix", user.LoginName, "jane")
+	_, exists = FindUserByIdent(nexus, "John@Example.org", "@example.org")
+	assert.DeepEqual(t, "user found with suffix", exists, false)
+	user, exists = FindUserByIdent(nexus, "john", "@example.org")
+	assert.DeepEqual(t, "user found by login name with suffix", exists, true)
+	assert.DeepEqual(t, "login name with suffix", user.LoginName, "john")
+
+	//several users may share an email address (e.g. a team mailbox), but then
+	//none of them can log in with it
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[1].EMailAddress = "Jane@Example.org"
+		db.Users = append(db.Users, User{LoginName: "janet", GivenName: "Janet", FamilyName: "Doe", EMailAddress: "jane@example.org"})
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	_, exists = FindUserByIdent(nexus, "jane@example.org", "")
+	assert.DeepEqual(t, "user found by shared email address", exists, false)
+	user, exists = FindUserByIdent(nexus, "janet", "")
+	assert.DeepEqual(t, "user found by login name despite shared email address", exists, true)
+	assert.DeepEqual(t, "login name of user with shared email address", user.LoginName, "janet")
+}
+
+func TestUserIDs(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	findID := func(loginName string) string {
+		t.Helper()
+		user, exists := nexus.FindUser(func(u User) bool { return u.LoginName == loginName })
+		if !exists {
+			t.Fatalf("user %q does not exist", loginName)
+		}
+		return user.ID
+	}
+
+	//new users get an ID
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		return nil
+	}, nil))
+	janeID := findID("jane")
+	assert.DeepEqual(t, "length of ID", len(janeID), 32)
+	assert.DeepEqual(t, "IDs are different", janeID != findID("john"), true)
+
+	//the ID is kept when the user is edited (the web GUI builds a new User
+	//without ID in this case) or renamed
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.Users.Update(User{LoginName: "jane", GivenName: "Jane", FamilyName: "Dorian"}))
+		return
+	}, nil))
+	assert.DeepEqual(t, "ID after edit", findID("jane"), janeID)
+	expectNoErrors(t, nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("jane", "janet", "admin", time.Now(), time.Hour))
+		return
+	}, nil))
+	assert.DeepEqual(t, "ID after rename", findID("janet"), janeID)
+
+	//a new user with a previous login name is a different user
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users, User{LoginName: "jane", GivenName: "Jane", FamilyName: "Smith"})
+		return nil
+	}, nil))
+	assert.DeepEqual(t, "ID of new jane is different", findID("jane") != janeID, true)
+
+	//IDs must be unique
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].ID = db.Users[1].ID
+		return nil
+	}, nil)
+	expectTheseErrors(t, errs,
+		`field "id" in user "jane" is already in use`,
+		`field "id" in user "janet" is already in use`,
+	)
+}
+
+func TestUserPhoneNumbers(t *testing.T) {
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", Phone: " +49 (30) 123-4567\t", MobilePhone: "0170 1234567"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", Phone: "12", MobilePhone: "+49 170 CALL-ME"},
+			{LoginName: "joe", GivenName: "Joe", FamilyName: "Doe", Phone: "49+30", MobilePhone: "+49 170 1234567 8901234"},
+		},
+	}
+	vcfg := GetValidationConfigForTests()
+
+	//surrounding whitespace is removed by normalization instead of being rejected
+	db.Normalize()
+	assert.DeepEqual(t, "normalized phone number", db.Users[0].Phone, "+49 (30) 123-4567")
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "phone" in user "joe" `+errNotPhoneNumber.Error(),
+		`field "mobile_phone" in user "joe" `+errNotPhoneNumber.Error(),
+		`field "phone" in user "john" `+errNotPhoneNumber.Error(),
+		`field "mobile_phone" in user "john" `+errNotPhoneNumber.Error(),
+	)
+
+	//the respective extra attributes cannot be used at the same time
+	db.Users = db.Users[:1]
+	db.Users[0].Phone = ""
+	db.Users[0].ExtraAttributes = map[string][]string{
+		"mobile":          {"+49 170 7654321"},
+		"telephoneNumber": {"+49 30 1234567"},
+	}
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "extra_attributes" in user "jane" may not contain "mobile" while the mobile phone number is set`,
+	)
+}
+
+func TestUserDepartment(t *testing.T) {
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", Department: "Engineering"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", Department: " Sales"},
+		},
+	}
+	vcfg := GetValidationConfigForTests()
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "department" in user "john" `+errLeadingSpaces.Error(),
+	)
+
+	//the ou extra attribute cannot be used at the same time
+	db.Users = db.Users[:1]
+	db.Users[0].ExtraAttributes = map[string][]string{"ou": {"Research"}}
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "extra_attributes" in user "jane" may not contain "ou" while the department is set`,
+	)
+	db.Users[0].Department = ""
+	expectNoErrors(t, db.Validate(vcfg))
+}
+
+func TestUserLanguageAndTimezone(t *testing.T) {
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PreferredLanguage: "de-CH", Timezone: "Europe/Zurich"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", PreferredLanguage: "not a language", Timezone: "Europe/Springfield"},
+			{LoginName: "max", GivenName: "Max", FamilyName: "Mustermann", Timezone: "Local"},
+		},
+	}
+	vcfg := GetValidationConfigForTests()
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "preferred_language" in user "john" `+errNotLanguageTag.Error(),
+		`field "timezone" in user "john" `+errNotTimezoneName.Error(),
+		`field "timezone" in user "max" `+errNotTimezoneName.Error(),
+	)
+
+	//the preferredLanguage extra attribute cannot be used at the same time
+	db.Users = db.Users[:1]
+	db.Users[0].ExtraAttributes = map[string][]string{"preferredLanguage": {"fr"}}
+	expectTheseErrors(t, db.Validate(vcfg),
+		`field "extra_attributes" in user "jane" may not contain "preferredLanguage" while the preferred language is set`,
+	)
+	db.Users[0].PreferredLanguage = ""
+	expectNoErrors(t, db.Validate(vcfg))
+}
@@ -9,19 +9,23 @@ package core
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	_ "time/tzdata" //for MustBeTimezoneName, so that it does not depend on the host's zoneinfo
 	"unicode"
 
 	"github.com/majewsky/portunus/internal/grammars"
+	"golang.org/x/text/language"
 )
 
-// ObjectRef identifies a User or Group. It appears in type FieldRef.
+// ObjectRef identifies a User, Group or ServiceUser. It appears in type FieldRef.
 type ObjectRef struct {
-	Type string //either "user" or "group"
-	Name string //the LoginName for users or the Name for groups
+	Type string //either "user", "group" or "service user"
+	Name string //the LoginName for users or the Name for groups and service users
 }
 
 // Field constructs a FieldRef for this object.
@@ -73,6 +77,18 @@ func (e ValidationError) Error() string {
 type ValidationConfig struct {
 	GroupNameRegex *regexp.Regexp //from PORTUNUS_GROUP_NAME_REGEX
 	UserNameRegex  *regexp.Regexp //from PORTUNUS_USER_NAME_REGEX
+	//If true, users may have an empty family name (e.g. for mononymous people).
+	AllowEmptyFamilyName bool //from PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME
+	//If true, a group may not have the same name as a user, and vice versa.
+	SharedNamespace bool //from PORTUNUS_SHARED_NAMESPACE
+	//If true, groups that allow temporary membership must have at least one owner.
+	RequireOwnersForElevation bool //from PORTUNUS_GROUP_REQUIRE_OWNERS
+	//If true, interactive updates may not leave active users without any group
+	//membership (see RequiresGroupMembership for exemptions).
+	RequireGroupMembership     bool           //from PORTUNUS_USER_REQUIRE_GROUP
+	GroupMembershipExemptRegex *regexp.Regexp //from PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX
+	//If not empty, this group is preselected when creating a user.
+	DefaultGroupName string //from PORTUNUS_USER_DEFAULT_GROUP
 }
 
 // ReadValidationConfigFromEnvironment builds a ValidationConfig from the
@@ -87,6 +103,17 @@ func ReadValidationConfigFromEnvironment() (result *ValidationConfig, err error)
 	if err != nil {
 		return nil, err
 	}
+	cfg.AllowEmptyFamilyName = os.Getenv("PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME") == "true"
+	cfg.SharedNamespace = os.Getenv("PORTUNUS_SHARED_NAMESPACE") == "true"
+	cfg.RequireOwnersForElevation = os.Getenv("PORTUNUS_GROUP_REQUIRE_OWNERS") == "true"
+	cfg.RequireGroupMembership = os.Getenv("PORTUNUS_USER_REQUIRE_GROUP") == "true"
+	if os.Getenv("PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX") != "" {
+		cfg.GroupMembershipExemptRegex, err = compileRegexFromEnvironment("PORTUNUS_USER_REQUIRE_GROUP_EXEMPT_REGEX")
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.DefaultGroupName = os.Getenv("PORTUNUS_USER_DEFAULT_GROUP")
 	return &cfg, nil
 }
 
@@ -116,11 +143,12 @@ func compileRegexFromEnvironment(key string) (*regexp.Regexp, error) {
 }
 
 var (
-	errIsDuplicate       = errors.New("is already in use")
-	errIsDuplicateInSeed = errors.New("is defined multiple times")
-	errIsMissing         = errors.New("is missing")
-	errLeadingSpaces     = errors.New("may not start with a space character")
-	errTrailingSpaces    = errors.New("may not end with a space character")
+	errIsDuplicate             = errors.New("is already in use")
+	errIsDuplicateIgnoringCase = errors.New("is already in use (with different capitalization)")
+	errIsDuplicateInSeed       = errors.New("is defined multiple times")
+	errIsMissing               = errors.New("is missing")
+	errLeadingSpaces           = errors.New("may not start with a space character")
+	errTrailingSpaces          = errors.New("may not end with a space character")
 
 	errMalformedGroupName       = errors.New("is not an acceptable group name")
 	errMalformedUserLoginName   = errors.New("is not an acceptable user name")
@@ -128,9 +156,24 @@ var (
 
 	errNotPosixAccountName = fmt.Errorf("is not an acceptable POSIX account name matching the pattern /%s/", grammars.POSIXAccountNameRegex)
 	errNotDecimalNumber    = errors.New("is not a decimal number")
+	errMustBePositive      = errors.New("must be greater than zero")
 	errNotPosixUIDorGID    = errors.New("is not a number between 0 and 65535 inclusive")
 
+	errMissingOwnersForElevation = errors.New("must not be empty for groups that allow temporary membership")
+
 	errNotAbsolutePath = errors.New("must be an absolute path, i.e. start with a /")
+	errNotURL          = errors.New("must be an absolute URL like https://example.com/docs")
+
+	errNotDate = errors.New("is not a date in the format YYYY-MM-DD")
+
+	errNotPhoneNumber = fmt.Errorf("is not a phone number like +49 30 1234567 (only digits, spaces, and the characters +-() are allowed, and there must be between %d and %d digits)",
+		minPhoneNumberDigits, maxPhoneNumberDigits)
+
+	errNotLanguageTag  = errors.New(`is not a language tag like "en" or "de-CH"`)
+	errNotTimezoneName = errors.New(`is not a time zone name like "UTC" or "Europe/Berlin"`)
+
+	errNotPhoto     = errors.New("is not an image in PNG or JPEG format")
+	errNotJPEGPhoto = errors.New("is not an image in JPEG format")
 )
 
 // MustNotBeEmpty is a h.ValidationRule.
@@ -141,6 +184,15 @@ func MustNotBeEmpty(val string) error {
 	return nil
 }
 
+// MustNotBeEmptyIf is a validation rule that works like MustNotBeEmpty iff the
+// given condition is upheld.
+func MustNotBeEmptyIf(val string, condition bool) error {
+	if !condition {
+		return nil
+	}
+	return MustNotBeEmpty(val)
+}
+
 // MustNotHaveSurroundingSpaces is a h.ValidationRule.
 func MustNotHaveSurroundingSpaces(val string) error {
 	if val != "" {
@@ -210,6 +262,103 @@ func MustBeAbsolutePath(val string) error {
 	return nil
 }
 
+// MustBeURL is a h.ValidationRule. Whitespace is not allowed anywhere since
+// the LDAP attribute labeledURI uses it to separate the URL from its label.
+func MustBeURL(val string) error {
+	if val == "" {
+		return nil
+	}
+	u, err := url.Parse(val)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") || strings.IndexFunc(val, unicode.IsSpace) >= 0 {
+		return errNotURL
+	}
+	return nil
+}
+
+const (
+	//E.164 allows up to 15 digits. The lower bound is lenient enough for
+	//internal extensions.
+	minPhoneNumberDigits = 3
+	maxPhoneNumberDigits = 15
+)
+
+// MustBePhoneNumber is a h.ValidationRule. The check is deliberately lenient
+// since phone numbers are commonly written with spaces, dashes or parentheses
+// for readability: Only the set of allowed characters and the number of digits
+// are checked. A plus sign is only allowed at the start.
+func MustBePhoneNumber(val string) error {
+	if val == "" {
+		return nil
+	}
+	digitCount := 0
+	for idx, r := range val {
+		switch {
+		case r >= '0' && r <= '9':
+			digitCount++
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+			continue
+		case r == '+' && idx == 0:
+			continue
+		default:
+			return errNotPhoneNumber
+		}
+	}
+	if digitCount < minPhoneNumberDigits || digitCount > maxPhoneNumberDigits {
+		return errNotPhoneNumber
+	}
+	return nil
+}
+
+// MustBeLanguageTag is a h.ValidationRule that accepts BCP 47 language tags.
+func MustBeLanguageTag(val string) error {
+	if val == "" {
+		return nil
+	}
+	_, err := language.Parse(val)
+	if err != nil {
+		return errNotLanguageTag
+	}
+	return nil
+}
+
+// MustBeTimezoneName is a h.ValidationRule that accepts the names from the IANA
+// time zone database.
+func MustBeTimezoneName(val string) error {
+	if val == "" {
+		return nil
+	}
+	//"Local" is accepted by time.LoadLocation, but means nothing to other hosts
+	if val == "Local" {
+		return errNotTimezoneName
+	}
+	_, err := time.LoadLocation(val)
+	if err != nil {
+		return errNotTimezoneName
+	}
+	return nil
+}
+
+var ldapAttributeDescriptorRx = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// MustBeLDAPAttributeDescriptor is a validation rule that enforces the syntax
+// of an attribute name (the "descr" production from RFC 4512, section 1.4).
+func MustBeLDAPAttributeDescriptor(val string) error {
+	if !ldapAttributeDescriptorRx.MatchString(val) {
+		return fmt.Errorf("contains %q, which is not a valid LDAP attribute name", val)
+	}
+	return nil
+}
+
+// MustBeSupportedExtraAttribute is a validation rule that only accepts
+// attribute names from SupportedExtraAttributes.
+func MustBeSupportedExtraAttribute(val string) error {
+	if !isSupportedExtraAttribute[val] {
+		return fmt.Errorf("contains %q, which is not one of the supported attributes: %s",
+			val, strings.Join(SupportedExtraAttributes, ", "))
+	}
+	return nil
+}
+
 // SplitSSHPublicKeys preprocesses the content of a submitted <textarea> where a
 // list of SSH public keys is expected. The result will have one public key per
 // array entry.
@@ -0,0 +1,94 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// slapd's argon2 module expects this prefix instead of {CRYPT}.
+const argon2Prefix = "{ARGON2}"
+
+// The parameters for new Argon2id hashes, as recommended by RFC 9106, section 4.
+// Existing hashes are always verified with the parameters stored in them.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 //in KiB
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var argon2Encoding = base64.RawStdEncoding
+
+// Returns the part of an Argon2id hash that precedes the salt, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$". Hashes with a different prefix were
+// generated with different parameters.
+func argon2SettingPrefix() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$", argon2.Version, argon2Memory, argon2Time, argon2Threads)
+}
+
+// Generates an Argon2id hash in the PHC string format that libargon2 uses.
+func argon2Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return argon2SettingPrefix() + argon2Encoding.EncodeToString(salt) + "$" + argon2Encoding.EncodeToString(key), nil
+}
+
+// Verifies a password against a hash generated by argon2Hash() or by
+// libargon2. Both Argon2id and Argon2i are understood.
+func argon2Verify(password, hash string) (bool, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" {
+		return false, fmt.Errorf("malformed Argon2 hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported Argon2 version: %q", fields[2])
+	}
+	var (
+		memory  uint32
+		time    uint32
+		threads uint8
+	)
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || memory == 0 || time == 0 || threads == 0 {
+		return false, fmt.Errorf("malformed Argon2 parameters: %q", fields[3])
+	}
+	salt, err := argon2Encoding.DecodeString(fields[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed Argon2 salt: %w", err)
+	}
+	expected, err := argon2Encoding.DecodeString(fields[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed Argon2 hash value: %w", err)
+	}
+
+	var actual []byte
+	keyLen := uint32(len(expected))
+	switch fields[1] {
+	case "argon2id":
+		actual = argon2.IDKey([]byte(password), salt, time, memory, threads, keyLen)
+	case "argon2i":
+		actual = argon2.Key([]byte(password), salt, time, memory, threads, keyLen)
+	default:
+		return false, fmt.Errorf("unsupported Argon2 variant: %q", fields[1])
+	}
+	return subtle.ConstantTimeCompare(actual, expected) == 1, nil
+}
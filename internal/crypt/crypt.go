@@ -5,7 +5,8 @@
 *******************************************************************************/
 
 // Package crypt provides a type-safe interface to the password hashing
-// functionality in libxcrypt.
+// functionality in libxcrypt. Argon2 hashes, which libxcrypt does not support,
+// are generated in Go in the format expected by slapd's argon2 module.
 //
 // Please keep the imports of this package as small as reasonably possible.
 // All the code that is located or imported here ends up in the orchestrator
@@ -36,49 +37,88 @@ type PasswordHasher interface {
 	IsWeakHash(passwordHash string) bool
 }
 
-// NewPasswordHasher returns the real PasswordHasher implementation.
-func NewPasswordHasher() (PasswordHasher, error) {
+// NewPasswordHasher returns the real PasswordHasher implementation. New hashes
+// are generated with the given scheme. Existing hashes are verified regardless
+// of which scheme they were generated with, but IsWeakHash() reports all hashes
+// that do not match the given scheme, so that they get replaced over time.
+func NewPasswordHasher(scheme Scheme) (PasswordHasher, error) {
 	err := llFeatureTest()
 	if err != nil {
 		return nil, err
 	}
 
-	var h hasher
-	h.PreferredMethod = llPreferredMethod()
+	h := hasher{Scheme: scheme}
+	switch scheme.Method {
+	case SchemeMethodDefault:
+		h.SaltPrefix = llPreferredMethod()
+		h.HashPrefix = cryptPrefix + h.SaltPrefix
+	case SchemeMethodArgon2:
+		h.HashPrefix = argon2Prefix + argon2SettingPrefix()
+	case SchemeMethodSHA512Crypt, SchemeMethodBcrypt:
+		h.SaltPrefix = schemeCostParams[scheme.Method].Prefix
+		h.SaltCost = scheme.Cost
+		//the salt looks like "$6$rounds=N$..." or "$2b$N$...", and hashes with
+		//the same method and cost have everything up to the last "$" in common
+		salt, err := llGenerateSalt(h.SaltPrefix, h.SaltCost)
+		if err != nil {
+			return nil, fmt.Errorf("password hash scheme %s is not supported by libcrypt: %w", scheme, err)
+		}
+		h.HashPrefix = cryptPrefix + salt[:strings.LastIndex(salt, "$")+1]
+	default:
+		return nil, fmt.Errorf("unknown password hash scheme: %q", scheme.Method)
+	}
 
-	bogusPassword, err := llGenerateSalt(h.PreferredMethod)
+	//the bogus password is just some random string, we're not using it as a salt
+	bogusPassword, err := llGenerateSalt("", 0)
 	if err != nil {
 		return nil, fmt.Errorf("while generating a bogus password: %w", err)
 	}
-	bogusPasswordHash, err := llCrypt(bogusPassword, bogusPassword)
+	h.BogusPasswordHash, err = h.hashPassword(bogusPassword)
 	if err != nil {
-		return nil, fmt.Errorf("while generating a bogus password hash: %w", err)
+		return nil, fmt.Errorf("while generating a bogus password hash with scheme %s: %w", scheme, err)
 	}
-	h.BogusPasswordHash = cryptPrefix + bogusPasswordHash
-
-	//TODO: consider allowing manual override of the preferred method, to offer
-	//an upgrade path between libcrypt implementations with different preferences
 	return h, nil
 }
 
 type hasher struct {
-	PreferredMethod   string
+	Scheme Scheme
+	//for libcrypt-based schemes: the arguments for llGenerateSalt()
+	SaltPrefix string
+	SaltCost   uint64
+	//IsWeakHash() reports all hashes that do not start with this prefix
+	HashPrefix        string
 	BogusPasswordHash string
 }
 
 // HashPassword implements the PasswordHasher interface.
 func (h hasher) HashPassword(password string) string {
-	salt, err := llGenerateSalt(h.PreferredMethod)
+	hash, err := h.hashPassword(password)
 	if err != nil {
-		logg.Fatal("cannot generate salt for password hashing: %s", err.Error())
+		logg.Fatal(err.Error())
+	}
+	return hash
+}
+
+func (h hasher) hashPassword(password string) (string, error) {
+	if h.Scheme.Method == SchemeMethodArgon2 {
+		hash, err := argon2Hash(password)
+		if err != nil {
+			return "", fmt.Errorf("cannot hash password: %w", err)
+		}
+		return argon2Prefix + hash, nil
+	}
+
+	salt, err := llGenerateSalt(h.SaltPrefix, h.SaltCost)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate salt for password hashing: %w", err)
 	}
 	hash, err := llCrypt(password, salt)
 	if err != nil {
-		logg.Fatal("cannot hash password: %s", err.Error())
+		return "", fmt.Errorf("cannot hash password: %w", err)
 	}
 
 	//slapd expects an extra {CRYPT} prefix for password hashes generated by libcrypt
-	return cryptPrefix + hash
+	return cryptPrefix + hash, nil
 }
 
 // CheckPasswordHash implements the PasswordHasher interface.
@@ -93,28 +133,41 @@ func (h hasher) CheckPasswordHash(password, passwordHash string) bool {
 		passwordHash = h.BogusPasswordHash
 	}
 
+	ok, err := verifyPassword(password, passwordHash)
+	if err != nil {
+		logg.Error("cannot hash password for verification: %s", err.Error())
+		return false
+	}
+	return userExists && ok
+}
+
+// Verifies a password against a hash with either of the prefixes that we
+// generate. This does not depend on the configured scheme, so that hashes
+// from before a change of PORTUNUS_PASSWORD_HASH_SCHEME remain usable.
+func verifyPassword(password, passwordHash string) (bool, error) {
+	if hash, isArgon2 := strings.CutPrefix(passwordHash, argon2Prefix); isArgon2 {
+		return argon2Verify(password, hash)
+	}
+
 	//strip the required prefix that we attached at the end of HashPassword()
-	passwordHash, hasPrefix := strings.CutPrefix(passwordHash, cryptPrefix)
+	hash, hasPrefix := strings.CutPrefix(passwordHash, cryptPrefix)
 	if !hasPrefix {
-		return false
+		return false, nil
 	}
 
 	//if the password is correct, rehashing with the same settings as in the hash
 	//should reproduce the hash
-	rehashed, err := llCrypt(password, passwordHash)
+	rehashed, err := llCrypt(password, hash)
 	if err != nil {
-		logg.Error("cannot hash password for verification: %s", err.Error())
-		return false
+		return false, err
 	}
-	return userExists && rehashed == passwordHash
+	return rehashed == hash, nil
 }
 
 // IsWeakHash implements the PasswordHasher interface.
 func (h hasher) IsWeakHash(passwordHash string) bool {
-	passwordHash, hasPrefix := strings.CutPrefix(passwordHash, cryptPrefix)
-	if !hasPrefix {
+	if !strings.HasPrefix(passwordHash, cryptPrefix) && !strings.HasPrefix(passwordHash, argon2Prefix) {
 		return false
 	}
-
-	return !strings.HasPrefix(passwordHash, h.PreferredMethod)
+	return !strings.HasPrefix(passwordHash, h.HashPrefix)
 }
@@ -0,0 +1,122 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package crypt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestParseScheme(t *testing.T) {
+	validCases := map[string]Scheme{
+		"":                          {Method: SchemeMethodDefault},
+		"default":                   {Method: SchemeMethodDefault},
+		"sha512crypt":               {Method: SchemeMethodSHA512Crypt, Cost: 656000},
+		"sha512crypt:rounds=10000":  {Method: SchemeMethodSHA512Crypt, Cost: 10000},
+		"bcrypt":                    {Method: SchemeMethodBcrypt, Cost: 12},
+		"bcrypt:cost=10":            {Method: SchemeMethodBcrypt, Cost: 10},
+		"argon2":                    {Method: SchemeMethodArgon2},
+		"sha512crypt:rounds=999999": {Method: SchemeMethodSHA512Crypt, Cost: 999999},
+	}
+	for input, expected := range validCases {
+		scheme, err := ParseScheme(input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", input, err.Error())
+			continue
+		}
+		assert.DeepEqual(t, "scheme for "+input, scheme, expected)
+		//the canonical representation must parse into the same scheme
+		assert.DeepEqual(t, "reparsed scheme for "+input, must.Return(ParseScheme(scheme.String())), expected)
+	}
+
+	invalidCases := map[string]string{
+		"md5crypt":                  `invalid password hash scheme "md5crypt": method must be one of "default", "sha512crypt", "bcrypt" or "argon2"`,
+		"sha512crypt:rounds=500":    `invalid password hash scheme "sha512crypt:rounds=500": rounds must be an integer between 1000 and 999999999`,
+		"sha512crypt:cost=10":       `invalid password hash scheme "sha512crypt:cost=10": expected "sha512crypt:rounds=N"`,
+		"bcrypt:cost=32":            `invalid password hash scheme "bcrypt:cost=32": cost must be an integer between 4 and 31`,
+		"bcrypt:cost=twelve":        `invalid password hash scheme "bcrypt:cost=twelve": cost must be an integer between 4 and 31`,
+		"argon2:m=65536,t=3,p=4":    `invalid password hash scheme "argon2:m=65536,t=3,p=4": argon2 does not take any parameters`,
+		"default:rounds=10000":      `invalid password hash scheme "default:rounds=10000": method must be one of "default", "sha512crypt", "bcrypt" or "argon2"`,
+		"sha512crypt:rounds=10000:": `invalid password hash scheme "sha512crypt:rounds=10000:": rounds must be an integer between 1000 and 999999999`,
+	}
+	for input, expected := range invalidCases {
+		_, err := ParseScheme(input)
+		if err == nil {
+			t.Errorf("expected error for %q, but got none", input)
+			continue
+		}
+		assert.DeepEqual(t, "error for "+input, err.Error(), expected)
+	}
+}
+
+func TestKnownVectors(t *testing.T) {
+	//These hashes come from the reference implementations of each method:
+	//sha512crypt from the specification by Ulrich Drepper, bcrypt from the
+	//OpenBSD test suite, and Argon2 from the libargon2 command-line tool.
+	//They must be verifiable no matter which scheme is configured.
+	vectors := []struct {
+		Password string
+		Hash     string
+	}{
+		{"Hello world!", "{CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "{CRYPT}$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"U*U", "{CRYPT}$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"U*U", "{CRYPT}$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{"password", "{ARGON2}$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{"password", "{ARGON2}$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$wWKIMhR9lyDFvRz9YTZweHKfbftvj+qf+YFY4NeBbtA"},
+	}
+
+	for _, input := range []string{"default", "sha512crypt:rounds=1000", "bcrypt:cost=4", "argon2"} {
+		hasher := must.Return(NewPasswordHasher(must.Return(ParseScheme(input))))
+		for _, v := range vectors {
+			assert.DeepEqual(t, "correct password for "+v.Hash+" with "+input,
+				hasher.CheckPasswordHash(v.Password, v.Hash), true)
+			assert.DeepEqual(t, "wrong password for "+v.Hash+" with "+input,
+				hasher.CheckPasswordHash(v.Password+"x", v.Hash), false)
+		}
+	}
+}
+
+func TestHashPasswordWithEachScheme(t *testing.T) {
+	//the prefix of each hash shows that the configured method and cost were used
+	expectedPrefixes := map[string]string{
+		"sha512crypt:rounds=1000": "{CRYPT}$6$rounds=1000$",
+		"bcrypt:cost=4":           "{CRYPT}$2b$04$",
+		"argon2":                  "{ARGON2}$argon2id$v=19$m=65536,t=3,p=4$",
+	}
+
+	hashes := make(map[string]string)
+	for input, prefix := range expectedPrefixes {
+		hasher := must.Return(NewPasswordHasher(must.Return(ParseScheme(input))))
+		hash := hasher.HashPassword("swordfish")
+		if !strings.HasPrefix(hash, prefix) {
+			t.Errorf("expected hash with scheme %s to start with %q, but got %q", input, prefix, hash)
+		}
+		assert.DeepEqual(t, "correct password with "+input, hasher.CheckPasswordHash("swordfish", hash), true)
+		assert.DeepEqual(t, "wrong password with "+input, hasher.CheckPasswordHash("Swordfish", hash), false)
+		assert.DeepEqual(t, "nonexistent user with "+input, hasher.CheckPasswordHash("swordfish", ""), false)
+		hashes[input] = hash
+	}
+
+	//hashes from other schemes (or with a different cost) are weak, so that
+	//they get replaced after a change of PORTUNUS_PASSWORD_HASH_SCHEME
+	for input := range expectedPrefixes {
+		hasher := must.Return(NewPasswordHasher(must.Return(ParseScheme(input))))
+		for otherInput, hash := range hashes {
+			assert.DeepEqual(t, "IsWeakHash with "+input+" for hash from "+otherInput,
+				hasher.IsWeakHash(hash), input != otherInput)
+		}
+	}
+	hasher := must.Return(NewPasswordHasher(must.Return(ParseScheme("sha512crypt:rounds=2000"))))
+	assert.DeepEqual(t, "IsWeakHash for hash with fewer rounds", hasher.IsWeakHash(hashes["sha512crypt:rounds=1000"]), true)
+
+	//hashes that we did not generate ourselves are left alone
+	assert.DeepEqual(t, "IsWeakHash for foreign hash", hasher.IsWeakHash("{SSHA}cJYUSUn9b3ZdNdk0b9vjNHJ3MGGXCCTJ"), false)
+}
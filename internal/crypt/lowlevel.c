@@ -28,13 +28,13 @@ char *wrap_crypt_r(const char* phrase, const char* setting) {
 	}
 }
 
-char *wrap_crypt_gensalt_rn(const char* prefix) {
+char *wrap_crypt_gensalt_rn(const char* prefix, unsigned long count) {
 	if (strlen(prefix) == 0) {
 		prefix = NULL;
 	}
 
 	char buf[CRYPT_GENSALT_OUTPUT_SIZE];
-	char* result = crypt_gensalt_rn(prefix, 0, NULL, 0, buf, sizeof(buf));
+	char* result = crypt_gensalt_rn(prefix, count, NULL, 0, buf, sizeof(buf));
 	if (result == NULL) {
 		return NULL;
 	} else {
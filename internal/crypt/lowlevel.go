@@ -69,12 +69,13 @@ func llCrypt(phrase, setting string) (string, error) {
 
 // Wraps the C library function crypt_gensalt_rn(). If called with an empty `prefix`,
 // this autoselects the preferred hash algorithm. Otherwise, the hash algorithm
-// specified by the `prefix` will be used.
-func llGenerateSalt(prefix string) (string, error) {
+// specified by the `prefix` will be used. The `count` selects the work factor
+// for that algorithm (its meaning is algorithm-specific), or the default if 0.
+func llGenerateSalt(prefix string, count uint64) (string, error) {
 	prefixInput := C.CString(prefix)
 	defer C.free(unsafe.Pointer(prefixInput))
 
-	output, err := C.wrap_crypt_gensalt_rn(prefixInput)
+	output, err := C.wrap_crypt_gensalt_rn(prefixInput, C.ulong(count))
 	defer C.free(unsafe.Pointer(output))
 	if err != nil {
 		return "", err
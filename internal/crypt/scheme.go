@@ -0,0 +1,109 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package crypt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Scheme describes how new password hashes are generated. It is chosen
+// through the PORTUNUS_PASSWORD_HASH_SCHEME environment variable, see
+// ParseScheme() for the format.
+type Scheme struct {
+	// One of the SchemeMethod... constants.
+	Method string
+	// The work factor for the method: "rounds" for sha512crypt, "cost" for
+	// bcrypt. Always zero for the other methods.
+	Cost uint64
+}
+
+const (
+	// SchemeMethodDefault uses whatever method libcrypt prefers.
+	SchemeMethodDefault = "default"
+	// SchemeMethodSHA512Crypt uses the "$6$" method from libcrypt.
+	SchemeMethodSHA512Crypt = "sha512crypt"
+	// SchemeMethodBcrypt uses the "$2b$" method from libcrypt.
+	SchemeMethodBcrypt = "bcrypt"
+	// SchemeMethodArgon2 produces Argon2id hashes. Unlike the other methods,
+	// slapd can only verify these when its argon2 module is loaded.
+	SchemeMethodArgon2 = "argon2"
+)
+
+var schemeCostParams = map[string]struct {
+	Name    string
+	Prefix  string
+	Default uint64
+	Min     uint64
+	Max     uint64
+}{
+	//limits as enforced by crypt_gensalt(3)
+	SchemeMethodSHA512Crypt: {"rounds", "$6$", 656000, 1000, 999999999},
+	SchemeMethodBcrypt:      {"cost", "$2b$", 12, 4, 31},
+}
+
+// ParseScheme parses a value of PORTUNUS_PASSWORD_HASH_SCHEME. Accepted
+// values are "default" (or the empty string), "sha512crypt",
+// "sha512crypt:rounds=N", "bcrypt", "bcrypt:cost=N" and "argon2".
+func ParseScheme(input string) (Scheme, error) {
+	if input == "" || input == SchemeMethodDefault {
+		return Scheme{Method: SchemeMethodDefault}, nil
+	}
+
+	method, params, hasParams := strings.Cut(input, ":")
+	switch method {
+	case SchemeMethodArgon2:
+		if hasParams {
+			return Scheme{}, fmt.Errorf("invalid password hash scheme %q: %s does not take any parameters", input, method)
+		}
+		return Scheme{Method: method}, nil
+	case SchemeMethodSHA512Crypt, SchemeMethodBcrypt:
+		p := schemeCostParams[method]
+		if !hasParams {
+			return Scheme{Method: method, Cost: p.Default}, nil
+		}
+		valueStr, ok := strings.CutPrefix(params, p.Name+"=")
+		if !ok {
+			return Scheme{}, fmt.Errorf("invalid password hash scheme %q: expected \"%s:%s=N\"", input, method, p.Name)
+		}
+		value, err := strconv.ParseUint(valueStr, 10, 64)
+		if err != nil || value < p.Min || value > p.Max {
+			return Scheme{}, fmt.Errorf("invalid password hash scheme %q: %s must be an integer between %d and %d", input, p.Name, p.Min, p.Max)
+		}
+		return Scheme{Method: method, Cost: value}, nil
+	default:
+		return Scheme{}, fmt.Errorf("invalid password hash scheme %q: method must be one of %q, %q, %q or %q",
+			input, SchemeMethodDefault, SchemeMethodSHA512Crypt, SchemeMethodBcrypt, SchemeMethodArgon2)
+	}
+}
+
+// ReadSchemeFromEnvironment parses the PORTUNUS_PASSWORD_HASH_SCHEME
+// environment variable.
+func ReadSchemeFromEnvironment() (Scheme, error) {
+	return ParseScheme(os.Getenv("PORTUNUS_PASSWORD_HASH_SCHEME"))
+}
+
+// String renders the scheme in the format accepted by ParseScheme().
+func (s Scheme) String() string {
+	p, hasCost := schemeCostParams[s.Method]
+	if !hasCost {
+		return s.Method
+	}
+	return fmt.Sprintf("%s:%s=%d", s.Method, p.Name, s.Cost)
+}
+
+// SlapdModule returns the name of the slapd module that needs to be loaded for
+// slapd to understand the password hashes generated with this scheme, or ""
+// if slapd supports them out of the box.
+func (s Scheme) SlapdModule() string {
+	if s.Method == SchemeMethodArgon2 {
+		return "argon2"
+	}
+	return ""
+}
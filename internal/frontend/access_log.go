@@ -0,0 +1,149 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// Configuration for accessLogMiddleware.
+type accessLogConfig struct {
+	Enabled       bool //from PORTUNUS_SERVER_ACCESS_LOG
+	ExcludeStatic bool //from PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC
+	//If not empty, the remote IP is taken from this request header (e.g.
+	//X-Forwarded-For) instead of from the TCP connection. This must only be
+	//set if all requests come through a reverse proxy that sets this header.
+	//This predates PORTUNUS_SERVER_TRUSTED_PROXIES, which should be preferred
+	//since it also applies to all other log messages.
+	RemoteIPHeader string //from PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER
+}
+
+func readAccessLogConfigFromEnvironment() accessLogConfig {
+	return accessLogConfig{
+		Enabled:        os.Getenv("PORTUNUS_SERVER_ACCESS_LOG") != "false",
+		ExcludeStatic:  os.Getenv("PORTUNUS_SERVER_ACCESS_LOG_EXCLUDE_STATIC") == "true",
+		RemoteIPHeader: os.Getenv("PORTUNUS_SERVER_ACCESS_LOG_REMOTE_IP_HEADER"),
+	}
+}
+
+type accessLogContextKey struct{}
+
+// Collects information about a request while it is being handled, for use
+// in the access log.
+type accessLogAttribution struct {
+	LoginName      string
+	ImpersonatedBy string
+}
+
+// Records in the access log which user is logged in with the current session.
+// This is called by VerifyLogin() and after a successful login.
+func attributeRequestToUser(r *http.Request, info SessionInfo) {
+	attr, ok := r.Context().Value(accessLogContextKey{}).(*accessLogAttribution)
+	if ok {
+		attr.LoginName = info.LoginName
+		attr.ImpersonatedBy = info.ImpersonatedBy
+	}
+}
+
+// accessLogMiddleware logs one line for each request. This goes outside of
+// errorHandlingMiddleware, so that responses for panics are logged with
+// their actual status code.
+func accessLogMiddleware(inner http.Handler, cfg accessLogConfig) http.Handler {
+	if !cfg.Enabled {
+		return inner
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.ExcludeStatic && strings.HasPrefix(r.URL.Path, "/static/") {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		startedAt := time.Now()
+		attr := &accessLogAttribution{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, attr))
+		sw := &statusRecordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		inner.ServeHTTP(sw, r)
+		duration := time.Since(startedAt)
+
+		path := redactPathForAccessLog(r.URL.Path)
+		fields := logging.Fields{
+			"event":       "http_request",
+			"method":      r.Method,
+			"path":        path,
+			"status":      fmt.Sprint(sw.status),
+			"duration_ms": fmt.Sprintf("%.3f", float64(duration)/float64(time.Millisecond)),
+			"remote_ip":   remoteIPOf(r, cfg.RemoteIPHeader),
+			"request_id":  w.Header().Get("X-Request-Id"),
+		}
+		if attr.LoginName != "" {
+			fields["login_name"] = attr.LoginName
+		}
+		if attr.ImpersonatedBy != "" {
+			fields["impersonated_by"] = attr.ImpersonatedBy
+		}
+		logging.Info(fields, "%s %s returned %d", r.Method, path, sw.status)
+	})
+}
+
+// Paths that contain secret tokens, which must not appear in the log. Query
+// strings are never logged since they can contain secrets as well (e.g. OIDC
+// authorization codes).
+var secretPathPrefixes = []string{"/invitation/", "/device-confirmation/"}
+
+func redactPathForAccessLog(path string) string {
+	for _, prefix := range secretPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return prefix + "[redacted]"
+		}
+	}
+	return path
+}
+
+// Returns the IP address of the client that sent this request.
+func remoteIPOf(r *http.Request, header string) string {
+	if header != "" {
+		value := r.Header.Get(header)
+		if value != "" {
+			//if the header lists multiple addresses (like X-Forwarded-For), the
+			//last one was added by the reverse proxy in front of us; all others
+			//could have been forged by the client
+			addrs := strings.Split(value, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	return core.ClientIPOf(r)
+}
+
+// Like trackingResponseWriter, but remembers the status code.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *statusRecordingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *statusRecordingResponseWriter) Write(buf []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(buf)
+}
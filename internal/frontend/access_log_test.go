@@ -0,0 +1,117 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func TestAccessLog(t *testing.T) {
+	useFreshSessionTracker(t)
+	//HTTPHandler() shall not install its own access log, we add one below
+	oldConfig := accessLog
+	accessLog = accessLogConfig{}
+	defer func() { accessLog = oldConfig }()
+	_, mainHandler := setupErrorTest(t)
+	handler := accessLogMiddleware(mainHandler, accessLogConfig{
+		Enabled:        true,
+		ExcludeStatic:  true,
+		RemoteIPHeader: "X-Forwarded-For",
+	})
+	cookie := loginCookieForTests(t, "jane")
+
+	var buf bytes.Buffer
+	logg.SetLogger(stdlog.New(&buf, "", 0))
+	defer logg.SetLogger(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+
+	send := func(path, cookie, forwardedFor string) {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.RemoteAddr = "192.0.2.1:54321"
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("/self", cookie, "198.51.100.7, 203.0.113.9")
+	send("/self", "", "")
+	send("/static/css/portunus.css", "", "")
+	send("/invitation/s3cr3t?foo=bar", "", "")
+
+	//the duration and request ID are not deterministic
+	output := regexp.MustCompile(` duration_ms="[0-9.]+"`).ReplaceAllString(buf.String(), "")
+	output = regexp.MustCompile(` request_id="[0-9a-f]{16}"`).ReplaceAllString(output, ` request_id="X"`)
+	assert.DeepEqual(t, "access log", strings.Split(strings.TrimSuffix(output, "\n"), "\n"), []string{
+		`INFO: GET /self returned 200 event="http_request" login_name="jane" method="GET" path="/self" remote_ip="203.0.113.9" request_id="X" status="200"`,
+		`INFO: GET /self returned 303 event="http_request" method="GET" path="/self" remote_ip="192.0.2.1" request_id="X" status="303"`,
+		`INFO: GET /invitation/[redacted] returned 303 event="http_request" method="GET" path="/invitation/[redacted]" remote_ip="192.0.2.1" request_id="X" status="303"`,
+	})
+}
+
+func TestClientIPBehindTrustedProxy(t *testing.T) {
+	useFreshSessionTracker(t)
+	oldConfig := accessLog
+	accessLog = accessLogConfig{}
+	defer func() { accessLog = oldConfig }()
+	oldProxies := trustedProxies
+	defer func() { trustedProxies = oldProxies }()
+	t.Setenv("PORTUNUS_SERVER_TRUSTED_PROXIES", "10.0.0.1")
+	var err error
+	trustedProxies, err = core.ReadTrustedProxiesFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mainHandler := setupErrorTest(t)
+	handler := clientIPMiddleware(accessLogMiddleware(mainHandler, accessLogConfig{Enabled: true}))
+
+	var buf bytes.Buffer
+	logg.SetLogger(stdlog.New(&buf, "", 0))
+	defer logg.SetLogger(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+
+	send := func(remoteAddr string) *http.Cookie {
+		req := httptest.NewRequest(http.MethodGet, "/login", http.NoBody)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "_gorilla_csrf" {
+				return cookie
+			}
+		}
+		t.Fatalf("no CSRF cookie in response from %s", remoteAddr)
+		return nil
+	}
+
+	//the headers are honored if they come from the proxy...
+	cookie := send("10.0.0.1:54321")
+	assert.DeepEqual(t, "Secure flag on cookie through proxy", cookie.Secure, true)
+	//...but not if the client sends them directly
+	cookie = send("203.0.113.9:54321")
+	assert.DeepEqual(t, "Secure flag on cookie with spoofed headers", cookie.Secure, false)
+
+	output := regexp.MustCompile(` duration_ms="[0-9.]+"`).ReplaceAllString(buf.String(), "")
+	output = regexp.MustCompile(` request_id="[0-9a-f]{16}"`).ReplaceAllString(output, ` request_id="X"`)
+	assert.DeepEqual(t, "access log", strings.Split(strings.TrimSuffix(output, "\n"), "\n"), []string{
+		`INFO: GET /login returned 200 event="http_request" method="GET" path="/login" remote_ip="198.51.100.7" request_id="X" status="200"`,
+		`INFO: GET /login returned 200 event="http_request" method="GET" path="/login" remote_ip="203.0.113.9" request_id="X" status="200"`,
+	})
+}
@@ -0,0 +1,44 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+var (
+	//The locale configured in PORTUNUS_SERVER_LOCALE. This is used to sort
+	//names in list views unless the browser indicates a language preference.
+	instanceLocale    language.Tag
+	collationsMatcher = language.NewMatcher(collate.Supported())
+)
+
+func init() {
+	value := os.Getenv("PORTUNUS_SERVER_LOCALE")
+	if value == "" {
+		value = "en"
+	}
+	var err error
+	instanceLocale, err = language.Parse(value)
+	if err != nil {
+		logg.Fatal("malformed value for PORTUNUS_SERVER_LOCALE: %q (expected a BCP 47 language tag like \"en\" or \"de-CH\")", value)
+	}
+}
+
+// Returns the Collation that shall be used for sorting names in responses to
+// this request. The viewer's language preference (as indicated by the
+// Accept-Language header) takes precedence over the instance locale.
+func collationFor(r *http.Request) *core.Collation {
+	tag, _ := language.MatchStrings(collationsMatcher, r.Header.Get("Accept-Language"), instanceLocale.String())
+	return core.CollationFor(tag)
+}
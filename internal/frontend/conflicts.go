@@ -0,0 +1,119 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// This is set by HTTPHandler(). It is a package variable because the
+// navigation bar needs it on every page.
+var mergeConflicts *core.MergeConflictQueue
+
+func countMergeConflicts() int {
+	if mergeConflicts == nil {
+		return 0
+	}
+	return len(mergeConflicts.List())
+}
+
+// Handles GET /conflicts.
+func getConflictsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(conflictsList),
+	)
+}
+
+var conflictsListSnippet = h.NewSnippet(`
+	<p>
+		The database file was edited on disk while there were changes in memory that had not been written yet.
+		Both versions were merged, but for the fields listed below, the change from the file was not applied.
+		Check whether the value in effect is correct, edit the respective object if necessary, and then dismiss the conflict.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Detected at</th>
+				<th>Object</th>
+				<th>Field</th>
+				<th>Before both edits</th>
+				<th>Value in effect</th>
+				<th>Value from file (not applied)</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="Detected at">{{.Conflict.DetectedAt.UTC.Format "2006-01-02 15:04:05"}} UTC</td>
+					<td data-label="Object">{{.Conflict.Type}} <code>{{.Conflict.Key}}</code></td>
+					{{ if .Conflict.Path -}}
+						<td data-label="Field"><code>{{.Conflict.Path}}</code></td>
+					{{- else -}}
+						<td data-label="Field" class="text-muted">Whole object</td>
+					{{- end }}
+					<td data-label="Before both edits"><code>{{.Conflict.BaseValue}}</code></td>
+					<td data-label="Value in effect"><code>{{.Conflict.OurValue}}</code></td>
+					<td data-label="Value from file (not applied)"><code>{{.Conflict.TheirValue}}</code></td>
+					<td class="actions">{{.DismissForm}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="7" class="text-muted">No conflicts.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func conflictsList(i *Interaction) Page {
+	type conflictItem struct {
+		Conflict    core.QueuedMergeConflict
+		DismissForm template.HTML
+	}
+	var data []conflictItem
+	for _, c := range mergeConflicts.List() {
+		form := h.FormSpec{
+			PostTarget:          fmt.Sprintf("/conflicts/%d/dismiss", c.ID),
+			SubmitLabel:         "Dismiss",
+			IgnoresReadOnlyMode: true,
+		}
+		data = append(data, conflictItem{c, form.Render(i.Req, h.FormState{})})
+	}
+
+	return Page{
+		Status:   http.StatusOK,
+		Title:    "Merge conflicts",
+		Contents: conflictsListSnippet.Render(data),
+		Wide:     true,
+	}
+}
+
+// Handles POST /conflicts/:id/dismiss.
+func postConflictDismissHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			id, err := strconv.ParseUint(mux.Vars(i.Req)["id"], 10, 64)
+			if err != nil || !mergeConflicts.Dismiss(id) {
+				i.RedirectWithFlashTo("/conflicts", Flash{"danger", "No such conflict."})
+				return
+			}
+			i.RedirectWithFlashTo("/conflicts", Flash{"success", "Conflict dismissed."})
+		},
+	)
+}
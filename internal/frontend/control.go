@@ -0,0 +1,541 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// ControlHandler returns the http.Handler for the control API that is used by
+// portunusctl. This API does not do any authentication by itself, so it must
+// only be served on a Unix socket that is not accessible to unprivileged users.
+//
+// All request and response bodies are JSON. Failed requests return an object
+// of type control.ErrorResponse.
+//
+// GET requests for single users and groups return an ETag header. Requests
+// that change these objects accept the same value in an If-Match header, and
+// fail with 412 (Precondition Failed) if the object was changed in the
+// meantime.
+//
+// If a DestructiveWindow is given, DELETE requests and PUT /v1/database fail
+// with 403 (Forbidden) unless an admin has opened a window in the web GUI.
+//
+// While Portunus is in read-only mode, all requests that change the database
+// fail with 503 (Service Unavailable) and a Retry-After header.
+func ControlHandler(nexus core.Nexus, ldapAdapter *ldap.Adapter, window *core.DestructiveWindow) http.Handler {
+	c := controlAPI{nexus, ldapAdapter, window}
+	r := mux.NewRouter()
+
+	r.Methods("GET").Path(`/v1/users`).HandlerFunc(c.listUsers)
+	r.Methods("POST").Path(`/v1/users`).HandlerFunc(c.createUser)
+	r.Methods("GET").Path(`/v1/users/{uid}`).HandlerFunc(c.showUser)
+	r.Methods("DELETE").Path(`/v1/users/{uid}`).HandlerFunc(c.destructive(c.deleteUser))
+	r.Methods("PUT").Path(`/v1/users/{uid}/password`).HandlerFunc(c.setUserPassword)
+	r.Methods("POST").Path(`/v1/users/{uid}/offboard`).HandlerFunc(c.offboardUser)
+
+	r.Methods("GET").Path(`/v1/groups`).HandlerFunc(c.listGroups)
+	r.Methods("GET").Path(`/v1/groups/{name}`).HandlerFunc(c.showGroup)
+	r.Methods("PUT").Path(`/v1/groups/{name}/members/{uid}`).HandlerFunc(c.addGroupMember)
+	r.Methods("DELETE").Path(`/v1/groups/{name}/members/{uid}`).HandlerFunc(c.destructive(c.removeGroupMember))
+
+	r.Methods("GET").Path(`/v1/objects/{ref:.+}`).HandlerFunc(c.resolveObject)
+
+	r.Methods("GET").Path(`/v1/database`).HandlerFunc(c.exportDatabase)
+	r.Methods("PUT").Path(`/v1/database`).HandlerFunc(c.destructive(c.importDatabase))
+	r.Methods("GET").Path(`/v1/export.ldif`).HandlerFunc(c.exportLDIF)
+
+	r.Methods("POST").Path(`/v1/ldap/resync`).HandlerFunc(c.resyncLDAP)
+
+	r.Methods("GET").Path(`/v1/destructive-window`).HandlerFunc(c.showDestructiveWindow)
+
+	return r
+}
+
+type controlAPI struct {
+	nexus             core.Nexus
+	ldapAdapter       *ldap.Adapter
+	destructiveWindow *core.DestructiveWindow
+}
+
+func respondWithJSON(w http.ResponseWriter, status int, data any) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(buf, '\n'))
+}
+
+func respondWithErrors(w http.ResponseWriter, status int, errs errext.ErrorSet) {
+	var resp control.ErrorResponse
+	for _, err := range errs {
+		e := control.Error{Message: err.Error()}
+		var verr core.ValidationError
+		if errors.As(err, &verr) {
+			e.ObjectType = verr.FieldRef.Object.Type
+			e.ObjectName = verr.FieldRef.Object.Name
+			e.Field = verr.FieldRef.Name
+		}
+		if errors.Is(err, core.ErrReadOnly) {
+			e.Code = control.ErrorCodeReadOnly
+		}
+		resp.Errors = append(resp.Errors, e)
+	}
+	respondWithJSON(w, status, resp)
+}
+
+func respondWithError(w http.ResponseWriter, status int, msg string, args ...any) {
+	var errs errext.ErrorSet
+	errs.Addf(msg, args...)
+	respondWithErrors(w, status, errs)
+}
+
+// Wraps a handler for a destructive operation, which is only executed while a
+// destructive operations window is open.
+func (c controlAPI) destructive(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.destructiveWindow != nil {
+			err := c.destructiveWindow.Check()
+			if err != nil {
+				respondWithJSON(w, http.StatusForbidden, control.ErrorResponse{Errors: []control.Error{{
+					Message: err.Error(),
+					Code:    control.ErrorCodeDestructiveWindowClosed,
+				}}})
+				return
+			}
+		}
+		inner(w, r)
+	}
+}
+
+// Executes an update on the nexus and writes the response. Seed conflicts,
+// updates that remove the last admin and (if configured) users without groups
+// are reported as errors, like for updates made through the web GUI. Returns
+// whether the update was successful.
+func (c controlAPI) update(w http.ResponseWriter, status int, action core.UpdateAction) bool {
+	ok := c.tryUpdate(w, action)
+	if ok {
+		w.WriteHeader(status)
+	}
+	return ok
+}
+
+// Like update, but only writes a response if the update failed.
+func (c controlAPI) tryUpdate(w http.ResponseWriter, action core.UpdateAction) bool {
+	errs := c.nexus.Update(action, &core.UpdateOptions{
+		ConflictWithSeedIsError: true,
+		PreventAdminLockout:     true,
+		PreventOrphanedUsers:    true,
+	})
+	if !errs.IsEmpty() {
+		respondWithUpdateErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+// Writes the response for a failed update. Updates refused because of
+// read-only mode are reported as 503, so that clients know to try again later.
+func respondWithUpdateErrors(w http.ResponseWriter, errs errext.ErrorSet) {
+	errStatus := http.StatusUnprocessableEntity
+	for _, err := range errs {
+		switch {
+		case errors.Is(err, core.ErrReadOnly):
+			w.Header().Set("Retry-After", "60")
+			errStatus = http.StatusServiceUnavailable
+		case errors.Is(err, core.ErrConcurrentModification):
+			errStatus = http.StatusPreconditionFailed
+		}
+	}
+	respondWithErrors(w, errStatus, errs)
+}
+
+// Renders an object revision (see core.UserRevision and core.GroupRevision)
+// into an entity tag for use in the ETag header.
+func revisionETag(revision string) string {
+	return `"` + revision + `"`
+}
+
+// Checks the If-Match header of a request against the current revision of the
+// object that it refers to. This must be called within an UpdateAction to
+// ensure that the object is not changed between the check and the update.
+func checkIfMatch(r *http.Request, currentRevision string) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	for _, etag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(etag) == revisionETag(currentRevision) {
+			return nil
+		}
+	}
+	return core.ErrConcurrentModification
+}
+
+// Secrets like password hashes are not shown through the control API. They
+// can only be obtained through a full database export.
+func redactObjects[T core.Object[T]](objects []T) []map[string]any {
+	result := make([]map[string]any, len(objects))
+	for idx, obj := range objects {
+		result[idx] = core.RedactObject(obj)
+	}
+	return result
+}
+
+func (c controlAPI) findUser(w http.ResponseWriter, r *http.Request) (core.User, bool) {
+	loginName := mux.Vars(r)["uid"]
+	user, exists := c.nexus.FindUser(func(u core.User) bool { return u.LoginName == loginName })
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "user %q does not exist", loginName)
+	}
+	return user.User, exists
+}
+
+// Handles GET /v1/users.
+func (c controlAPI) listUsers(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, redactObjects(c.nexus.ListUsers()))
+}
+
+// Handles GET /v1/users/:uid.
+func (c controlAPI) showUser(w http.ResponseWriter, r *http.Request) {
+	user, exists := c.findUser(w, r)
+	if exists {
+		w.Header().Set("ETag", revisionETag(core.UserRevision(user, c.nexus.ListGroups())))
+		respondWithJSON(w, http.StatusOK, core.RedactObject(user))
+	}
+}
+
+// Handles POST /v1/users. The request body is a core.User. Its password hash
+// is ignored; the password needs to be set through PUT /v1/users/:uid/password.
+//
+// The query parameter "groups" can contain a comma-separated list of groups
+// that the new user is added to. If it is not given, the user is added to the
+// default group (PORTUNUS_USER_DEFAULT_GROUP), if any.
+func (c controlAPI) createUser(w http.ResponseWriter, r *http.Request) {
+	var user core.User
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&user)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "cannot parse request body: %s", err.Error())
+		return
+	}
+	user.PasswordHash = ""
+	user.Invitation = nil
+	err = posixDefaults.ApplyTo(&user)
+	if err != nil {
+		respondWithErrors(w, http.StatusUnprocessableEntity, errext.ErrorSet{err})
+		return
+	}
+
+	var groupNames []string
+	if r.URL.Query().Has("groups") {
+		for _, name := range strings.Split(r.URL.Query().Get("groups"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				groupNames = append(groupNames, name)
+			}
+		}
+	} else if name := c.nexus.ValidationConfig().DefaultGroupName; name != "" {
+		groupNames = []string{name}
+	}
+
+	//if the login name is already taken, Database.Validate() will complain
+	c.update(w, http.StatusCreated, func(db *core.Database) (errs errext.ErrorSet) {
+		db.Users = append(db.Users, user)
+		for _, name := range groupNames {
+			group, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == name })
+			if !exists {
+				errs.Addf("group %q does not exist", name)
+				continue
+			}
+			//Find() returns a clone, so the change needs to be written back
+			//(Cloned() also ensures that MemberLoginNames is not nil)
+			group.MemberLoginNames[user.LoginName] = true
+			errs.Add(db.Groups.Update(group))
+		}
+		return errs
+	})
+}
+
+// Handles DELETE /v1/users/:uid.
+func (c controlAPI) deleteUser(w http.ResponseWriter, r *http.Request) {
+	user, exists := c.findUser(w, r)
+	if !exists {
+		return
+	}
+	//sessions of the deleted user are revoked by revokeSessionsOfDeletedUsers()
+	c.update(w, http.StatusNoContent, func(db *core.Database) (errs errext.ErrorSet) {
+		current, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == user.LoginName })
+		if exists {
+			errs.Add(checkIfMatch(r, core.UserRevision(current, db.Groups)))
+		}
+		//the control API does not know who is calling, so the tombstone has no DeletedBy
+		errs.Add(db.DeleteUser(user.LoginName, "", time.Now(), deletedUserRetention))
+		return
+	})
+}
+
+// Handles PUT /v1/users/:uid/password. Like a password reset in the web GUI,
+// this requires the user to choose a new password on their next login.
+func (c controlAPI) setUserPassword(w http.ResponseWriter, r *http.Request) {
+	user, exists := c.findUser(w, r)
+	if !exists {
+		return
+	}
+	var req control.PasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "cannot parse request body: %s", err.Error())
+		return
+	}
+	if req.Password == "" {
+		respondWithError(w, http.StatusUnprocessableEntity, "password may not be empty")
+		return
+	}
+
+	passwordHash := c.nexus.PasswordHasher().HashPassword(req.Password)
+	ok := c.update(w, http.StatusNoContent, func(db *core.Database) (errs errext.ErrorSet) {
+		for idx := range db.Users {
+			if db.Users[idx].LoginName == user.LoginName {
+				errs.Add(checkIfMatch(r, core.UserRevision(db.Users[idx], db.Groups)))
+				db.Users[idx].PasswordHash = passwordHash
+				db.Users[idx].Invitation = nil
+				//same as in the web GUI: the admin knows the new password, so only the user shall know the next one
+				db.Users[idx].MustChangePassword = true
+				return
+			}
+		}
+		errs.Addf("user %q does not exist", user.LoginName)
+		return
+	})
+	if ok {
+		sessionTracker.DeleteSessionsOfUser(user.LoginName, "")
+	}
+}
+
+// Handles POST /v1/users/:uid/offboard. The request body is a
+// core.OffboardingOptions. Fields that are not given default to
+// core.DefaultOffboardingOptions(), so an empty object requests a complete
+// offboarding. The response body is a core.OffboardingReport.
+func (c controlAPI) offboardUser(w http.ResponseWriter, r *http.Request) {
+	user, exists := c.findUser(w, r)
+	if !exists {
+		return
+	}
+	opts := core.DefaultOffboardingOptions()
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&opts)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "cannot parse request body: %s", err.Error())
+		return
+	}
+
+	var report core.OffboardingReport
+	ok := c.tryUpdate(w, func(db *core.Database) (errs errext.ErrorSet) {
+		if current, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == user.LoginName }); exists {
+			errs.Add(checkIfMatch(r, core.UserRevision(current, db.Groups)))
+		}
+		if !errs.IsEmpty() {
+			return errs
+		}
+		report, errs = db.Offboard(user.LoginName, opts, time.Now())
+		return errs
+	})
+	if !ok {
+		return
+	}
+	if opts.RevokeSessions {
+		revokeAccessAfterOffboarding("", &report)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// Handles GET /v1/groups.
+func (c controlAPI) listGroups(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, redactObjects(c.nexus.ListGroups()))
+}
+
+// Handles GET /v1/groups/:name.
+func (c controlAPI) showGroup(w http.ResponseWriter, r *http.Request) {
+	groupName := mux.Vars(r)["name"]
+	group, exists := c.nexus.FindGroup(func(g core.Group) bool { return g.Name == groupName })
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "group %q does not exist", groupName)
+		return
+	}
+	w.Header().Set("ETag", revisionETag(core.GroupRevision(group)))
+	respondWithJSON(w, http.StatusOK, core.RedactObject(group))
+}
+
+// Handles PUT /v1/groups/:name/members/:uid.
+func (c controlAPI) addGroupMember(w http.ResponseWriter, r *http.Request) {
+	c.setGroupMembership(w, r, true)
+}
+
+// Handles DELETE /v1/groups/:name/members/:uid.
+func (c controlAPI) removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	c.setGroupMembership(w, r, false)
+}
+
+func (c controlAPI) setGroupMembership(w http.ResponseWriter, r *http.Request, isMember bool) {
+	groupName := mux.Vars(r)["name"]
+	_, exists := c.nexus.FindGroup(func(g core.Group) bool { return g.Name == groupName })
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "group %q does not exist", groupName)
+		return
+	}
+	user, exists := c.findUser(w, r)
+	if !exists {
+		return
+	}
+
+	c.update(w, http.StatusNoContent, func(db *core.Database) (errs errext.ErrorSet) {
+		for _, group := range db.Groups {
+			if group.Name == groupName {
+				errs.Add(checkIfMatch(r, core.GroupRevision(group)))
+				//Cloned() ensures that MemberLoginNames is not nil
+				group.MemberLoginNames[user.LoginName] = isMember
+				return
+			}
+		}
+		errs.Addf("group %q does not exist", groupName)
+		return
+	})
+}
+
+// Handles GET /v1/objects/:ref. The reference is either "user/:uid",
+// "group/:name" or a bare name, which is only accepted if it does not refer to
+// both a user and a group. The response body is a control.ObjectRef.
+func (c controlAPI) resolveObject(w http.ResponseWriter, r *http.Request) {
+	ref, err := core.ResolveObjectRef(c.nexus, core.ParseObjectRef(mux.Vars(r)["ref"]))
+	switch {
+	case errors.Is(err, core.ErrUnknownObject):
+		respondWithError(w, http.StatusNotFound, "%s", err.Error())
+	case errors.Is(err, core.ErrAmbiguousObjectRef):
+		respondWithError(w, http.StatusConflict, "%s", err.Error())
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "%s", err.Error())
+	default:
+		respondWithJSON(w, http.StatusOK, control.ObjectRef{Type: ref.Type, Name: ref.Name})
+	}
+}
+
+// Handles GET /v1/database. The response body has the same format as the
+// database file.
+func (c controlAPI) exportDatabase(w http.ResponseWriter, r *http.Request) {
+	db, errs := snapshotDatabase(c.nexus)
+	if !errs.IsEmpty() {
+		respondWithErrors(w, http.StatusInternalServerError, errs)
+		return
+	}
+
+	buf, err := store.RenderDatabase(db)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
+
+// Returns a consistent snapshot of the entire database.
+func snapshotDatabase(n core.Nexus) (db core.Database, errs errext.ErrorSet) {
+	//a no-op update is the only way to obtain a consistent snapshot of the entire database
+	errs = n.Update(func(current *core.Database) errext.ErrorSet {
+		db = current.Cloned()
+		return nil
+	}, &core.UpdateOptions{DryRun: true})
+	return db, errs
+}
+
+// Handles GET /v1/export.ldif. The response body is a LDIF document with all
+// entries that Portunus would put into the LDAP server (see ldap.ExportLDIF).
+// Password hashes are only included with the query parameter
+// "include-passwords=true".
+func (c controlAPI) exportLDIF(w http.ResponseWriter, r *http.Request) {
+	db, errs := snapshotDatabase(c.nexus)
+	if !errs.IsEmpty() {
+		respondWithErrors(w, http.StatusInternalServerError, errs)
+		return
+	}
+	writeLDIFExport(w, db, r.URL.Query().Get("include-passwords") == "true")
+}
+
+// Handles PUT /v1/database. The request body has the same format as the
+// database file, and replaces the entire database.
+//
+// If the new database conflicts with the seed, the request fails unless the
+// query parameter "force_seed_override=true" is given. In that case, the seed
+// takes precedence like when the database file is loaded at startup.
+func (c controlAPI) importDatabase(w http.ResponseWriter, r *http.Request) {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "cannot read request body: %s", err.Error())
+		return
+	}
+	newDB, err := store.ParseDatabase(buf)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "%s", err.Error())
+		return
+	}
+
+	action := func(db *core.Database) errext.ErrorSet {
+		*db = newDB
+		return nil
+	}
+	if r.URL.Query().Get("force_seed_override") != "true" {
+		c.update(w, http.StatusNoContent, action)
+		return
+	}
+	errs := c.nexus.Update(action, &core.UpdateOptions{PreventAdminLockout: true, PreventOrphanedUsers: true})
+	if !errs.IsEmpty() {
+		respondWithUpdateErrors(w, errs)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST /v1/ldap/resync. portunus-orchestrator calls this after
+// restarting slapd. The resync happens asynchronously.
+func (c controlAPI) resyncLDAP(w http.ResponseWriter, r *http.Request) {
+	c.ldapAdapter.RequestResync()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handles GET /v1/destructive-window.
+func (c controlAPI) showDestructiveWindow(w http.ResponseWriter, r *http.Request) {
+	var result control.DestructiveWindow
+	if c.destructiveWindow != nil {
+		result.Enabled = true
+		state, isOpen := c.destructiveWindow.Current()
+		if isOpen {
+			result.IsOpen = true
+			result.OpenedBy = state.OpenedBy
+			result.Reason = state.Reason
+			result.OpenedAt = &state.OpenedAt
+			result.ExpiresAt = &state.ExpiresAt
+		}
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,291 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestControlResolveObject(t *testing.T) {
+	nexus, _ := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison"})
+		db.Groups = []core.Group{
+			{Name: "admins", LongName: "Administrators"},
+			{Name: "alice", LongName: "Alice's friends"},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	handler := ControlHandler(nexus, nil, nil)
+
+	check := func(path string, expectedStatus int, expectedBody any) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.DeepEqual(t, "status for GET "+path, rec.Code, expectedStatus)
+
+		var actualBody any
+		switch expectedBody.(type) {
+		case control.ObjectRef:
+			var ref control.ObjectRef
+			err := json.Unmarshal(rec.Body.Bytes(), &ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actualBody = ref
+		case string:
+			var resp control.ErrorResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &resp)
+			if err != nil || len(resp.Errors) != 1 {
+				t.Fatalf("GET %s: unexpected response body %q", path, rec.Body.String())
+			}
+			actualBody = resp.Errors[0].Message
+		}
+		assert.DeepEqual(t, "response for GET "+path, actualBody, expectedBody)
+	}
+
+	check("/v1/objects/jane", http.StatusOK, control.ObjectRef{Type: "user", Name: "jane"})
+	check("/v1/objects/admins", http.StatusOK, control.ObjectRef{Type: "group", Name: "admins"})
+	check("/v1/objects/user/alice", http.StatusOK, control.ObjectRef{Type: "user", Name: "alice"})
+	check("/v1/objects/group%2Falice", http.StatusOK, control.ObjectRef{Type: "group", Name: "alice"})
+	check("/v1/objects/alice", http.StatusConflict,
+		`name refers to both a user and a group: use "user/alice" or "group/alice" to choose one`)
+	check("/v1/objects/group/jane", http.StatusNotFound, `no such user or group: "group/jane"`)
+}
+
+func TestControlDestructiveWindow(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, _ := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+			core.User{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson"},
+		)
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true, "bob": true, "carol": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	window := core.NewDestructiveWindow(time.Hour)
+	destructiveWindow = window
+	defer func() { destructiveWindow = nil }()
+	handler := ControlHandler(nexus, nil, window)
+
+	sendToAPI := func(method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, http.NoBody))
+		return rec
+	}
+	expectRefusal := func(method, path string) {
+		t.Helper()
+		rec := sendToAPI(method, path)
+		assert.DeepEqual(t, "status for "+method+" "+path, rec.Code, http.StatusForbidden)
+		var resp control.ErrorResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &resp)
+		if err != nil || len(resp.Errors) != 1 {
+			t.Fatalf("%s %s: unexpected response body %q", method, path, rec.Body.String())
+		}
+		assert.DeepEqual(t, "error code for "+method+" "+path, resp.Errors[0].Code, control.ErrorCodeDestructiveWindowClosed)
+	}
+	cookie := loginCookieForTests(t, "jane")
+	sendToGUI := func(handler http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		//this is usually done by the CSRF middleware, which we bypass here
+		err := req.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		errorHandlingMiddleware(handler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	//destructive operations are refused while no window is open
+	expectRefusal(http.MethodDelete, "/v1/groups/admins/members/bob")
+	expectRefusal(http.MethodDelete, "/v1/users/bob")
+	expectRefusal(http.MethodPut, "/v1/database")
+	var status control.DestructiveWindow
+	err := json.Unmarshal(sendToAPI(http.MethodGet, "/v1/destructive-window").Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "window status", status, control.DestructiveWindow{Enabled: true})
+
+	//deletions in the web GUI are not affected
+	deleteHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//this is usually done by the router, which we bypass here
+		postUserDeleteHandler(nexus).ServeHTTP(w, mux.SetURLVars(r, map[string]string{"uid": "carol"}))
+	})
+	rec := sendToGUI(deleteHandler, "/users/carol/delete", url.Values{})
+	assert.DeepEqual(t, "status for deletion in GUI", rec.Code, http.StatusSeeOther)
+	_, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "carol" })
+	assert.DeepEqual(t, "carol exists after deletion in GUI", exists, false)
+
+	//opening a window requires the admin's password
+	openHandler := postDestructiveWindowOpenHandler(nexus)
+	rec = sendToGUI(openHandler, "/destructive-window/open", url.Values{"reason": {"cleanup"}, "password": {"marlin"}})
+	assert.DeepEqual(t, "status for opening with wrong password", rec.Code, http.StatusOK)
+	expectRefusal(http.MethodDelete, "/v1/groups/admins/members/bob")
+	rec = sendToGUI(openHandler, "/destructive-window/open", url.Values{"reason": {"cleanup"}, "password": {"swordfish"}})
+	assert.DeepEqual(t, "status for opening", rec.Code, http.StatusSeeOther)
+
+	rec = sendToAPI(http.MethodDelete, "/v1/groups/admins/members/bob")
+	assert.DeepEqual(t, "status for DELETE while window is open", rec.Code, http.StatusNoContent)
+	err = json.Unmarshal(sendToAPI(http.MethodGet, "/v1/destructive-window").Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "window is open", status.IsOpen, true)
+	assert.DeepEqual(t, "window opened by", status.OpenedBy, "jane")
+
+	//after the window is closed, the next request in the series is refused
+	rec = sendToGUI(postDestructiveWindowCloseHandler(nexus), "/destructive-window/close", url.Values{})
+	assert.DeepEqual(t, "status for closing", rec.Code, http.StatusSeeOther)
+	expectRefusal(http.MethodDelete, "/v1/users/bob")
+
+	//without a window, the guard is disabled
+	rec = httptest.NewRecorder()
+	ControlHandler(nexus, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/users/bob", http.NoBody))
+	assert.DeepEqual(t, "status for DELETE without guard", rec.Code, http.StatusNoContent)
+}
+
+func TestControlImportDatabaseWithSeed(t *testing.T) {
+	seedPath := filepath.Join(t.TempDir(), "seed.json")
+	err := os.WriteFile(seedPath, []byte(`{
+		"users": [{"login_name": "jane", "given_name": "Jane", "family_name": "Doe"}],
+		"groups": [{
+			"name": "admins",
+			"long_name": "Administrators",
+			"members": ["jane"],
+			"permissions": {"portunus": {"is_admin": true}}
+		}]
+	}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcfg := core.GetValidationConfigForTests()
+	seed, errs := core.ReadDatabaseSeed(seedPath, vcfg)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	nexus := core.NewNexus(seed, vcfg, &core.NoopHasher{})
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet { return nil }, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	handler := ControlHandler(nexus, nil, nil)
+
+	//the restored database has a user that was not there before, but also
+	//reverts a seeded field to an outdated value
+	restored, err := store.RenderDatabase(core.Database{
+		Users: []core.User{
+			{LoginName: "jane", GivenName: "Janet", FamilyName: "Doe"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+		},
+		Groups: []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendToAPI := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, path, bytes.NewReader(restored)))
+		return rec
+	}
+
+	//by default, the conflict with the seed is refused...
+	rec := sendToAPI("/v1/database")
+	assert.DeepEqual(t, "status for conflicting restore", rec.Code, http.StatusUnprocessableEntity)
+	var resp control.ErrorResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil || len(resp.Errors) != 1 {
+		t.Fatalf("unexpected response body %q", rec.Body.String())
+	}
+	assert.DeepEqual(t, "error field", resp.Errors[0].Field, "given_name")
+	_, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "bob" })
+	assert.DeepEqual(t, "bob exists after refused restore", exists, false)
+
+	//...unless the seed is allowed to take precedence
+	rec = sendToAPI("/v1/database?force_seed_override=true")
+	assert.DeepEqual(t, "status for forced restore", rec.Code, http.StatusNoContent)
+	_, exists = nexus.FindUser(func(u core.User) bool { return u.LoginName == "bob" })
+	assert.DeepEqual(t, "bob exists after forced restore", exists, true)
+	jane, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "seeded given name after forced restore", jane.GivenName, "Jane")
+}
+
+func TestControlSetPasswordRequiresChange(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+
+	//like in the web GUI, the admin knows the new password, so only the user
+	//shall know the next one
+	req := httptest.NewRequest(http.MethodPut, "/v1/users/jane/password", strings.NewReader(`{"password":"marlin"}`))
+	rec := httptest.NewRecorder()
+	ControlHandler(nexus, nil, nil).ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status for setting password", rec.Code, http.StatusNoContent)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "password hash", user.PasswordHash, "{PLAINTEXT}marlin")
+	assert.DeepEqual(t, "MustChangePassword", user.MustChangePassword, true)
+
+	//after logging in with the new password, the user needs to change it first
+	form := url.Values{"user_ident": {"jane"}, "password": {"marlin"}}
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	//this is usually done by the CSRF middleware, which we bypass here
+	err := req.ParseForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	errorHandlingMiddleware(postLoginHandler(nexus)).ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status for login", rec.Code, http.StatusSeeOther)
+	cookie := loginCookieFromResponse(rec)
+
+	req = httptest.NewRequest(http.MethodGet, rec.Header().Get("Location"), http.NoBody)
+	req.Header.Set("Cookie", cookie)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status after login", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect after login", rec.Header().Get("Location"), "/self/password")
+}
@@ -7,10 +7,14 @@
 package frontend
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -18,24 +22,77 @@ import (
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/majewsky/portunus/internal/notify"
+	"github.com/majewsky/portunus/internal/oidc"
 	"github.com/majewsky/portunus/static"
 	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/logg"
 )
 
-// HTTPHandler returns the main http.Handler.
-func HTTPHandler(nexus core.Nexus, isBehindTLSProxy bool) http.Handler {
+// HTTPHandler returns the main http.Handler. The given health checks are
+// reported on the /readyz endpoint, keyed by component name.
+//
+// The device store recognizes the devices that users log in on. If the
+// notifier is not nil, users are notified when they log in on a new device.
+//
+// The certificate status describes the TLS certificate of the LDAP server. It
+// is nil if LDAP is used without TLS.
+//
+// The seed correction tracker is nil if no seed is configured. The OIDC
+// provider is nil if Portunus does not act as an OpenID Connect provider. The
+// feed sync is nil if no user feed is configured. The destructive operations
+// window is nil if destructive operations in the control API are not guarded.
+func HTTPHandler(nexus core.Nexus, isBehindTLSProxy bool, healthChecks map[string]core.HealthCheck, activityLog core.ActivityLog, conflicts *core.MergeConflictQueue, devices core.DeviceStore, notifier *notify.Notifier, elevations *core.ElevationManager, certStatus *ldap.CertificateStatus, corrections *core.SeedCorrectionTracker, provider *oidc.Provider, feed *core.FeedSync, window *core.DestructiveWindow, adapter *ldap.Adapter) http.Handler {
+	forceSecureRequests = isBehindTLSProxy
+	mergeConflicts = conflicts
+	ldapCertificate = certStatus
+	ldapAdapter = adapter
+	databaseRevision = nexus.Revision
+	currentReadOnlyState = nexus.ReadOnly
+	elevationManager = elevations
+	destructiveWindow = window
+	seedCorrections = corrections
+	oidcProvider = provider
+	feedSync = feed
+	deviceTracker = devices
+	deviceNotifier = notifier
+	if requireDeviceConfirmation && notifier == nil {
+		logg.Fatal("PORTUNUS_SERVER_DEVICE_CONFIRMATION requires email notifications to be configured (see PORTUNUS_SERVER_SMTP_HOST)")
+	}
+	nexus.AddListener(context.Background(), revokeSessionsOfDeletedUsers)
+	nexus.AddListener(context.Background(), forgetDevicesOfDeletedUsers)
+
 	r := mux.NewRouter()
 	r.Methods("GET").Path(`/`).Handler(getToplevelHandler(nexus))
 	r.Methods("GET").Path(`/static/{path:.+}`).Handler(http.StripPrefix("/static/", http.FileServer(http.FS(static.FS))))
+	r.Methods("GET").Path(`/healthz`).HandlerFunc(getHealthzHandler)
+	r.Methods("GET").Path(`/readyz`).Handler(getReadyzHandler(healthChecks))
+	r.Methods("GET").Path(`/metrics`).HandlerFunc(getMetricsHandler)
 
 	r.Methods("GET").Path(`/login`).Handler(getLoginHandler(nexus))
 	r.Methods("POST").Path(`/login`).Handler(postLoginHandler(nexus))
 	r.Methods("GET").Path(`/logout`).Handler(getLogoutHandler(nexus))
+	r.Methods("GET").Path(`/invitation/{token}`).Handler(getInvitationHandler(nexus))
+	r.Methods("POST").Path(`/invitation/{token}`).Handler(postInvitationHandler(nexus))
+	r.Methods("GET").Path(`/device-confirmation/{token}`).Handler(getDeviceConfirmationHandler())
+	r.Methods("POST").Path(`/device-confirmation/{token}`).Handler(postDeviceConfirmationHandler())
 
 	r.Methods("GET").Path(`/self`).Handler(getSelfHandler(nexus))
 	r.Methods("POST").Path(`/self`).Handler(postSelfHandler(nexus))
-
+	r.Methods("POST").Path(`/self/sessions`).Handler(postSelfSessionsHandler(nexus))
+	r.Methods("POST").Path(`/self/devices`).Handler(postSelfDevicesHandler(nexus))
+	r.Methods("GET").Path(`/self/password`).Handler(getSelfPasswordHandler(nexus))
+	r.Methods("POST").Path(`/self/password`).Handler(postSelfPasswordHandler(nexus))
+	r.Methods("GET").Path(`/self/ssh-keys/new`).Handler(getSelfSSHKeysNewHandler(nexus))
+	r.Methods("POST").Path(`/self/ssh-keys/new`).Handler(postSelfSSHKeysNewHandler(nexus))
+	r.Methods("POST").Path(`/self/ssh-keys/{id}/delete`).Handler(postSelfSSHKeyActionHandler(nexus, deleteSSHKey, "Deleted SSH public key."))
+	r.Methods("POST").Path(`/self/ssh-keys/{id}/toggle-visibility`).Handler(postSelfSSHKeyActionHandler(nexus, toggleSSHKeyVisibility, "Changed visibility of SSH public key."))
+	r.Methods("GET").Path(`/self/ldap`).Handler(getSelfLDAPHandler(nexus))
+	r.Methods("GET").Path(`/self/ldap.ldif`).Handler(getSelfLDIFHandler(nexus))
+
+	r.Methods("GET").Path(`/directory`).Handler(getDirectoryHandler(nexus))
 	r.Methods("GET").Path(`/users`).Handler(getUsersHandler(nexus))
 	r.Methods("GET").Path(`/users/new`).Handler(getUsersNewHandler(nexus))
 	r.Methods("POST").Path(`/users/new`).Handler(postUsersNewHandler(nexus))
@@ -43,22 +100,118 @@ func HTTPHandler(nexus core.Nexus, isBehindTLSProxy bool) http.Handler {
 	r.Methods("POST").Path(`/users/{uid}/edit`).Handler(postUserEditHandler(nexus))
 	r.Methods("GET").Path(`/users/{uid}/delete`).Handler(getUserDeleteHandler(nexus))
 	r.Methods("POST").Path(`/users/{uid}/delete`).Handler(postUserDeleteHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/offboard`).Handler(getUserOffboardHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/offboard`).Handler(postUserOffboardHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/rename`).Handler(getUserRenameHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/rename`).Handler(postUserRenameHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/undo`).Handler(getUserUndoHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/undo`).Handler(postUserUndoHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/impersonate`).Handler(getUserImpersonateHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/impersonate`).Handler(postUserImpersonateHandler(nexus))
+	r.Methods("GET").Path(`/impersonation/end`).Handler(getEndImpersonationHandler(nexus))
+
+	r.Methods("GET").Path(`/deleted-users`).Handler(getDeletedUsersHandler(nexus))
+	r.Methods("POST").Path(`/deleted-users/{id}/restore`).Handler(postDeletedUserRestoreHandler(nexus))
 
 	r.Methods("GET").Path(`/groups`).Handler(getGroupsHandler(nexus))
 	r.Methods("GET").Path(`/groups/new`).Handler(getGroupsNewHandler(nexus))
 	r.Methods("POST").Path(`/groups/new`).Handler(postGroupsNewHandler(nexus))
-	r.Methods("GET").Path(`/groups/{name}/edit`).Handler(getGroupEditHandler(nexus))
-	r.Methods("POST").Path(`/groups/{name}/edit`).Handler(postGroupEditHandler(nexus))
+	r.Methods("GET").Path(`/groups/templates`).Handler(getGroupTemplatesHandler(nexus))
+	r.Methods("GET").Path(`/groups/{name}/edit`).Handler(getGroupEditHandler(nexus, activityLog))
+	r.Methods("POST").Path(`/groups/{name}/edit`).Handler(postGroupEditHandler(nexus, activityLog))
+	r.Methods("GET").Path(`/groups/{name}/rename`).Handler(getGroupRenameHandler(nexus))
+	r.Methods("POST").Path(`/groups/{name}/rename`).Handler(postGroupRenameHandler(nexus))
+	r.Methods("GET").Path(`/groups/{name}/undo`).Handler(getGroupUndoHandler(nexus))
+	r.Methods("POST").Path(`/groups/{name}/undo`).Handler(postGroupUndoHandler(nexus))
 	r.Methods("GET").Path(`/groups/{name}/delete`).Handler(getGroupDeleteHandler(nexus))
 	r.Methods("POST").Path(`/groups/{name}/delete`).Handler(postGroupDeleteHandler(nexus))
 
-	//setup CSRF with maxAge = 30 minutes
-	csrfKey := core.GenerateRandomKey(32)
-	csrfMiddleware := csrf.Protect(csrfKey, csrf.MaxAge(1800), csrf.Secure(isBehindTLSProxy))
-	handler := csrfMiddleware(r)
+	r.Methods("GET").Path(`/service-users`).Handler(getServiceUsersHandler(nexus))
+	r.Methods("GET").Path(`/service-users/new`).Handler(getServiceUsersNewHandler(nexus))
+	r.Methods("POST").Path(`/service-users/new`).Handler(postServiceUsersNewHandler(nexus))
+	r.Methods("GET").Path(`/service-users/{name}/edit`).Handler(getServiceUserEditHandler(nexus))
+	r.Methods("POST").Path(`/service-users/{name}/edit`).Handler(postServiceUserEditHandler(nexus))
+	r.Methods("GET").Path(`/service-users/{name}/delete`).Handler(getServiceUserDeleteHandler(nexus))
+	r.Methods("POST").Path(`/service-users/{name}/delete`).Handler(postServiceUserDeleteHandler(nexus))
+
+	r.Methods("GET").Path(`/elevations`).Handler(getElevationsHandler(nexus))
+	r.Methods("GET").Path(`/elevations/new/{group}`).Handler(getElevationsNewHandler(nexus))
+	r.Methods("POST").Path(`/elevations/new/{group}`).Handler(postElevationsNewHandler(nexus))
+	r.Methods("GET").Path(`/elevations/{id}/extend`).Handler(getElevationExtendHandler(nexus))
+	r.Methods("POST").Path(`/elevations/{id}/extend`).Handler(postElevationExtendHandler(nexus))
+	r.Methods("POST").Path(`/elevations/{id}/approve`).Handler(postElevationActionHandler(nexus, (*core.ElevationManager).Approve, "approve", "Approved"))
+	r.Methods("POST").Path(`/elevations/{id}/deny`).Handler(postElevationActionHandler(nexus, (*core.ElevationManager).Deny, "deny", "Denied"))
+	r.Methods("POST").Path(`/elevations/{id}/revoke`).Handler(postElevationActionHandler(nexus, (*core.ElevationManager).Revoke, "revoke", "Revoked"))
+
+	r.Methods("GET").Path(`/conflicts`).Handler(getConflictsHandler(nexus))
+	r.Methods("POST").Path(`/conflicts/{id}/dismiss`).Handler(postConflictDismissHandler(nexus))
+	r.Methods("GET").Path(`/seed-corrections`).Handler(getSeedCorrectionsHandler(nexus))
+	if feed != nil {
+		r.Methods("GET").Path(`/feed-sync`).Handler(getFeedSyncHandler(nexus))
+		r.Methods("POST").Path(`/feed-sync/pause`).Handler(postFeedSyncToggleHandler(nexus, true))
+		r.Methods("POST").Path(`/feed-sync/resume`).Handler(postFeedSyncToggleHandler(nexus, false))
+	}
+
+	if window != nil {
+		r.Methods("GET").Path(`/destructive-window`).Handler(getDestructiveWindowHandler(nexus))
+		r.Methods("POST").Path(`/destructive-window/open`).Handler(postDestructiveWindowOpenHandler(nexus))
+		r.Methods("POST").Path(`/destructive-window/close`).Handler(postDestructiveWindowCloseHandler(nexus))
+	}
+
+	r.Methods("GET").Path(`/api/v1/export.ldif`).Handler(getLDIFExportHandler(nexus))
+
+	r.Methods("GET").Path(`/read-only`).Handler(getReadOnlyHandler(nexus))
+	r.Methods("POST").Path(`/read-only/enable`).Handler(postReadOnlyEnableHandler(nexus))
+	r.Methods("POST").Path(`/read-only/disable`).Handler(postReadOnlyDisableHandler(nexus))
+
+	r.Methods("GET").Path(`/inspect`).Handler(getInspectorHandler(nexus))
+	r.Methods("POST").Path(`/inspect`).Handler(postInspectorHandler(nexus))
+	r.Methods("POST").Path(`/inspect/unlock`).Handler(postInspectorUnlockHandler(nexus))
+	r.Methods("GET").Path(`/inspect/{type}/{name}`).Handler(getInspectedObjectHandler(nexus))
+	r.Methods("GET").Path(`/inspect/{type}/{name}/json`).Handler(getInspectedObjectJSONHandler(nexus))
+
+	r.Methods("GET").Path(`/ldap-config`).Handler(getSlapdConfigHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config.json`).Handler(getSlapdConfigJSONHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/simulate`).Handler(getLDAPSimulationHandler(nexus))
+	r.Methods("POST").Path(`/ldap-config/simulate`).Handler(postLDAPSimulationHandler(nexus))
+	r.Methods("POST").Path(`/ldap-config/simulate.ldif`).Handler(postLDAPSimulationLDIFHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/layout`).Handler(getLDAPLayoutHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/layout.ldif`).Handler(getLDAPLayoutLDIFHandler(nexus))
+	r.Methods("POST").Path(`/ldap-config/layout`).Handler(postLDAPLayoutHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/sync-status`).Handler(getLDAPSyncStatusHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/shadow`).Handler(getLDAPShadowHandler(nexus))
+	r.Methods("GET").Path(`/ldap-config/shadow.ldif`).Handler(getLDAPShadowLDIFHandler(nexus))
+	r.Methods("POST").Path(`/ldap-config/shadow/activate`).Handler(postLDAPShadowActivateHandler(nexus))
+
+	if provider != nil {
+		r.Methods("GET").Path(`/.well-known/openid-configuration`).HandlerFunc(provider.ServeDiscovery)
+		r.Methods("GET").Path(`/oidc/jwks`).HandlerFunc(provider.ServeJWKS)
+		r.Methods("GET").Path(`/oidc/authorize`).Handler(getOIDCAuthorizeHandler(nexus))
+		r.Methods("POST").Path(`/oidc/token`).HandlerFunc(provider.ServeToken)
+		r.Methods("GET", "POST").Path(`/oidc/userinfo`).HandlerFunc(provider.ServeUserInfo)
+		//relying parties redirect the user to /oidc/authorize from their own
+		//site, and browsers do not send SameSite=Strict cookies along with such
+		//cross-site navigations, so the login session would not be found
+		sessionStore.Options.SameSite = http.SameSiteLaxMode
+	}
+
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+
+	handler := h.ProtectAgainstCSRF(r, isSecureRequest, getCSRFFailureHandler())
+	if provider != nil {
+		handler = skipCSRFForOIDCMiddleware(handler)
+	}
 
 	//add various security headers via middleware
 	handler = securityHeadersMiddleware(handler)
+	handler = readOnlyMiddleware(handler)
+
+	//this goes last to also catch panics in the other middlewares
+	handler = errorHandlingMiddleware(handler)
+	//...except for the access log, which needs to see the final status code
+	handler = accessLogMiddleware(handler, accessLog)
+	handler = clientIPMiddleware(handler)
 
 	return handler
 }
@@ -75,6 +228,33 @@ func securityHeadersMiddleware(inner http.Handler) http.Handler {
 	})
 }
 
+func getCSRFFailureHandler() http.Handler {
+	return Do(
+		LoadSession,
+		func(i *Interaction) {
+			logging.Info(logging.Fields{"remote_addr": core.ClientIPOf(i.Req)}, "rejected %s %s: %s", i.Req.Method, i.Req.URL.Path, csrf.FailureReason(i.Req).Error())
+			if wantsJSON(i.Req) {
+				i.Fail(errForbidden("the request could not be verified as coming from Portunus itself (CSRF check failed)"))
+			}
+		},
+		ShowView(func(i *Interaction) Page {
+			return Page{
+				Status:   http.StatusForbidden,
+				Title:    "Form submission rejected",
+				Contents: csrfFailureSnippet.Render(nil),
+			}
+		}),
+	)
+}
+
+var csrfFailureSnippet = h.NewSnippet(`
+	<p>
+		This form submission could not be verified as coming from Portunus itself, so it was not processed.
+		This can happen when the form was left open for a long time, or when your browser does not accept cookies from Portunus.
+	</p>
+	<p>Please go back, reload the page, and submit the form again.</p>
+`)
+
 func getToplevelHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
@@ -103,6 +283,13 @@ func (hh Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Req:    r,
 		writer: w,
 	}
+	defer func() {
+		//if the request did not end in a redirect, a submitted form was not
+		//processed successfully (e.g. it was rendered again with errors)
+		if i.FormState != nil {
+			i.FormState.ReleaseSubmission()
+		}
+	}()
 	for _, step := range hh.steps {
 		step(&i)
 		if i.writer == nil {
@@ -122,23 +309,80 @@ type Interaction struct {
 	writer http.ResponseWriter
 	//Slots for data associated with a request, which may be stored by one step
 	//and then used by later steps.
-	Session     *sessions.Session
-	CurrentUser *core.UserWithPerms
-	FormSpec    *h.FormSpec
-	FormState   *h.FormState
-	TargetUser  *core.User     //only used by CRUD views editing a single user
-	TargetGroup *core.Group    //only used by CRUD views editing a single group
-	TargetRef   core.ObjectRef //refers to TargetGroup/TargetUser (for admin forms) or CurrentUser (for selfservice forms)
+	Session           *sessions.Session
+	CurrentUser       *core.UserWithPerms
+	FormSpec          *h.FormSpec
+	FormState         *h.FormState
+	TargetUser        *core.User        //only used by CRUD views editing a single user
+	TargetGroup       *core.Group       //only used by CRUD views editing a single group
+	TargetServiceUser *core.ServiceUser //only used by CRUD views editing a single service user
+	TargetRef         core.ObjectRef    //refers to TargetGroup/TargetUser/TargetServiceUser (for admin forms) or CurrentUser (for selfservice forms)
+	//only used when creating a user with an invitation instead of a password
+	InvitationToken string
+	//only used by the offboarding workflow, to show what was done
+	OffboardingReport *core.OffboardingReport
+	//only used when creating or renaming a user, if the login name belonged to
+	//another user before that user was renamed
+	LoginNameReuseWarning string
+	//only used by edit forms for users and groups, to offer undoing the change
+	//after it was saved (see undoable)
+	UndoRecord *core.UndoRecord
+	//if not empty, TryUpdateNexus passes this as UpdateOptions.Reason
+	UpdateReason string
+	//only used by the OIDC authorization endpoint, to continue the
+	//authorization after the user has logged in (see RedirectToLogin)
+	ReturnURLAfterLogin string
+	//set by TryUpdateNexus if the target object was modified by someone else
+	//since the form was rendered (see ReloadFormAfterConcurrentModification)
+	IsConcurrentlyModified bool
 }
 
-// WriteError wraps http.Error().
+// WriteError reports a failure with the given message and status code.
 func (i *Interaction) WriteError(msg string, code int) {
-	http.Error(i.writer, msg, code)
+	errorCode := ErrorCodeInternal
+	switch code {
+	case http.StatusUnauthorized:
+		errorCode = ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		errorCode = ErrorCodeForbidden
+	case http.StatusNotFound:
+		errorCode = ErrorCodeNotFound
+	}
+	i.Fail(HTTPError{Status: code, Code: errorCode, Message: msg})
+}
+
+// Fail writes the response for a failed request. Depending on the request,
+// this is either a plain-text error message or a JSON error envelope (see
+// writeError).
+func (i *Interaction) Fail(err HTTPError) {
+	writeError(i.writer, i.Req, err)
 	i.writer = nil
 }
 
-// RedirectTo redirects to the given URL.
+// RedirectToLogin redirects to the login page, or reports that a login is
+// required if the client is not a browser. If i.ReturnURLAfterLogin is set,
+// the user will be redirected there after a successful login.
+func (i *Interaction) RedirectToLogin() {
+	if wantsJSON(i.Req) {
+		i.Fail(errUnauthorized())
+		return
+	}
+	if i.ReturnURLAfterLogin != "" {
+		i.Session.Values["return_to"] = i.ReturnURLAfterLogin
+		if !i.SaveSession() {
+			return
+		}
+	}
+	i.RedirectTo("/login")
+}
+
+// RedirectTo redirects to the given URL. If a form submission was claimed by
+// this request, repeated submissions of the same form will be redirected to
+// this URL as well.
 func (i *Interaction) RedirectTo(url string) {
+	if i.FormState != nil {
+		i.FormState.CompleteSubmission(url)
+	}
 	http.Redirect(i.writer, i.Req, url, http.StatusSeeOther)
 	i.writer = nil
 }
@@ -151,6 +395,16 @@ func (i *Interaction) RedirectWithFlashTo(url string, f Flash) {
 	}
 }
 
+// RedirectWithFlashAndLinkTo is like RedirectWithFlashTo, but also shows a
+// link at the end of the flash message.
+func (i *Interaction) RedirectWithFlashAndLinkTo(url string, f Flash, link FlashLink) {
+	i.Session.AddFlash(f)
+	i.Session.AddFlash(link)
+	if i.SaveSession() {
+		i.RedirectTo(url)
+	}
+}
+
 // SaveSession calls i.Session.Save(). When false is returned, a 500 error was
 // written and the calling handler step shall abort immediately.
 func (i *Interaction) SaveSession() bool {
@@ -194,7 +448,26 @@ func RedirectWithFlashTo(url, action string) HandlerStep {
 	}
 }
 
-var sessionStore *sessions.CookieStore
+var (
+	sessionStore              *sessions.CookieStore
+	sessionTracker            SessionStore
+	deviceTracker             core.DeviceStore
+	deviceNotifier            *notify.Notifier
+	databaseRevision          func() (uint64, time.Time)
+	requireDeviceConfirmation bool
+	invitationLifetime        time.Duration
+	deletedUserRetention      time.Duration
+	undoWindow                time.Duration
+	photoMaxSize              int64
+	ldapSuffix                string
+	ldapOUNames               ldap.OUNames
+	ldapHideTempPasswords     bool
+	loginNameSuffix           string
+	proxyAuth                 *core.ProxyAuthConfig
+	trustedProxies            core.TrustedProxies
+	posixDefaults             *core.PosixDefaults
+	accessLog                 accessLogConfig
+)
 
 func init() {
 	keyPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "session-key.dat")
@@ -215,7 +488,65 @@ func init() {
 		}
 	}
 
+	cfg := SessionConfig{
+		Lifetime:    readDurationFromEnvironment("PORTUNUS_SERVER_SESSION_LIFETIME", 24*time.Hour),
+		IdleTimeout: readDurationFromEnvironment("PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT", 2*time.Hour),
+	}
 	sessionStore = sessions.NewCookieStore(keyBytes)
+	sessionStore.MaxAge(int(cfg.Lifetime / time.Second))
+	sessionStore.Options.SameSite = http.SameSiteStrictMode
+	sessionTracker = NewInMemorySessionStore(cfg)
+	invitationLifetime = readDurationFromEnvironment("PORTUNUS_SERVER_INVITATION_LIFETIME", 7*24*time.Hour)
+	deletedUserRetention = readDurationFromEnvironment("PORTUNUS_SERVER_DELETED_USER_RETENTION", 30*24*time.Hour)
+	undoWindow = readDurationFromEnvironment("PORTUNUS_SERVER_UNDO_WINDOW", 10*time.Minute)
+	photoMaxSize = readPositiveIntFromEnvironment("PORTUNUS_SERVER_PHOTO_MAX_SIZE", 1<<20)
+	ldapSuffix = os.Getenv("PORTUNUS_LDAP_SUFFIX")
+	ldapHideTempPasswords = os.Getenv("PORTUNUS_LDAP_HIDE_TEMP_PASSWORDS") == "true"
+	loginNameSuffix = os.Getenv("PORTUNUS_SERVER_LOGIN_NAME_SUFFIX")
+
+	requireDeviceConfirmation = os.Getenv("PORTUNUS_SERVER_DEVICE_CONFIRMATION") == "true"
+	accessLog = readAccessLogConfigFromEnvironment()
+
+	posixDefaults, err = core.ReadPosixDefaultsFromEnvironment()
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	proxyAuth, err = core.ReadProxyAuthConfigFromEnvironment()
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	trustedProxies, err = core.ReadTrustedProxiesFromEnvironment()
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	ldapOUNames, err = ldap.ReadOUNamesFromEnvironment()
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+}
+
+func readDurationFromEnvironment(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		logg.Fatal("malformed value for %s: %q (expected a positive duration like \"8h\" or \"30m\")", key, value)
+	}
+	return d
+}
+
+func readPositiveIntFromEnvironment(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		logg.Fatal("malformed value for %s: %q (expected a positive integer)", key, value)
+	}
+	return n
 }
 
 // LoadSession is a handler step that loads the session or starts a new one if
@@ -235,7 +566,9 @@ func LoadSession(i *Interaction) {
 	}
 	if i.Session == nil {
 		i.WriteError("unexpected empty session", http.StatusInternalServerError)
+		return
 	}
+	i.Session.Options.Secure = isSecureRequest(i.Req)
 }
 
 // SaveSession is a handler step that calls Interaction.SaveSession.
@@ -250,20 +583,64 @@ func VerifyLogin(n core.Nexus) HandlerStep {
 		if i.Session == nil {
 			panic("VerifyLogin must come after LoadSession")
 		}
-		uid, ok := i.Session.Values["uid"].(string)
+		loginViaProxy(n, i)
+		if i.writer == nil {
+			return
+		}
+		info, ok := currentSessionInfo(i)
 		if !ok {
-			i.RedirectTo("/login")
+			if isImpersonating(i) && !wantsJSON(i.Req) {
+				//the impersonation session was revoked, e.g. because the password of the impersonated user was reset
+				endImpersonation(i)
+				i.RedirectWithFlashTo("/self", Flash{"warning", "The impersonation has ended."})
+				return
+			}
+			i.RedirectToLogin()
 			return
 		}
-		user, ok := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
-		if ok {
+		//sessions of expired users end as soon as the account expires
+		user, ok := n.FindUser(func(u core.User) bool { return u.LoginName == info.LoginName })
+		if ok && !user.IsExpiredAt(time.Now()) {
 			i.CurrentUser = &user
+			attributeRequestToUser(i.Req, info)
 		} else {
-			i.RedirectTo("/login")
+			i.RedirectToLogin()
+			return
+		}
+		if info.ImpersonatedBy != "" {
+			verifyImpersonation(n, i, info)
+		}
+		if info.DeviceID != "" && i.writer != nil {
+			verifyDevice(i, info)
+		}
+		if i.writer != nil {
+			verifyPasswordChange(i, info)
 		}
 	}
 }
 
+// Returns the login name of the user logged in with the current session, if
+// the session is still valid.
+func currentLoginName(i *Interaction) (string, bool) {
+	info, ok := currentSessionInfo(i)
+	return info.LoginName, ok
+}
+
+// Like currentLoginName, but returns all information about the current session.
+func currentSessionInfo(i *Interaction) (SessionInfo, bool) {
+	sessionID, ok := i.Session.Values["sid"].(string)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return sessionTracker.CheckSession(sessionID)
+}
+
+// Returns the ID of the current server-side session, or "" if there is none.
+func currentSessionID(i *Interaction) string {
+	sessionID, _ := i.Session.Values["sid"].(string)
+	return sessionID
+}
+
 // VerifyPermissions is a handler step that checks whether the current user has
 // at least the given permissions.
 func VerifyPermissions(perms core.Permissions) HandlerStep {
@@ -278,6 +655,15 @@ func VerifyPermissions(perms core.Permissions) HandlerStep {
 	}
 }
 
+// Returns whether the current user may make changes to users and groups, as
+// opposed to only viewing them (see viewerPerms).
+func canEdit(i *Interaction) bool {
+	if i.CurrentUser == nil {
+		panic("canEdit must come after VerifyLogin")
+	}
+	return i.CurrentUser.Perms.Includes(adminPerms)
+}
+
 // UseEmptyFormState is a handler step that initializes an empty i.FormState.
 func UseEmptyFormState(i *Interaction) {
 	i.FormState = &h.FormState{}
@@ -285,6 +671,11 @@ func UseEmptyFormState(i *Interaction) {
 
 // ReadFormStateFromRequest is a handler step that initializes i.FormState from
 // the incoming request. This is only suitable for POST handlers.
+//
+// If the same form was already submitted successfully before (e.g. because the
+// user reloaded the result page or went back in the browser history), the
+// submission is not processed again. Instead, we redirect to the result page
+// of the earlier submission.
 func ReadFormStateFromRequest(i *Interaction) {
 	if i.FormSpec == nil {
 		panic("ReadFormStateFromRequest requires a form to be selected")
@@ -293,6 +684,11 @@ func ReadFormStateFromRequest(i *Interaction) {
 		i.FormState = &h.FormState{}
 	}
 	i.FormSpec.ReadState(i.Req, i.FormState)
+
+	if resultURL, isDuplicate := i.FormState.ClaimSubmission(); isDuplicate {
+		msg := "This form was already submitted. The changes were not applied a second time."
+		i.RedirectWithFlashTo(resultURL, Flash{"warning", msg})
+	}
 }
 
 // ShowForm is a final handler step that renders i.FormSpec with i.FormState.
@@ -307,6 +703,9 @@ func ShowForm(title string) HandlerStep {
 		if i.FormState == nil {
 			panic("ShowForm requires a form state")
 		}
+		if reportFormErrorsAsJSON(i) {
+			return
+		}
 		Page{
 			Status:   http.StatusOK,
 			Title:    title,
@@ -316,6 +715,18 @@ func ShowForm(title string) HandlerStep {
 	}
 }
 
+// ShowEditOrViewForm is like ShowForm, but uses the second title if i.FormSpec
+// is read-only.
+func ShowEditOrViewForm(editTitle, viewTitle string) HandlerStep {
+	return func(i *Interaction) {
+		if i.FormSpec != nil && i.FormSpec.ReadOnly {
+			ShowForm(viewTitle)(i)
+		} else {
+			ShowForm(editTitle)(i)
+		}
+	}
+}
+
 // ShowFormIfErrors is like ShowForm, but only renders an output if i.FormState
 // is not valid.
 func ShowFormIfErrors(title string) HandlerStep {
@@ -336,10 +747,55 @@ func TryUpdateNexus(n core.Nexus, action func(*core.Database, *Interaction, cryp
 		opts := core.UpdateOptions{
 			ConflictWithSeedIsError: true,
 			DryRun:                  !i.FormState.IsValid(),
+			PreventAdminLockout:     true,
+			PreventOrphanedUsers:    true,
+			Reason:                  i.UpdateReason,
+		}
+		if i.CurrentUser != nil {
+			opts.Actor = i.CurrentUser.LoginName
 		}
 		errs := n.Update(func(db *core.Database) errext.ErrorSet {
+			//The current user may have been deleted after VerifyLogin() ran. We are
+			//inside the critical section of the nexus now, so this check cannot
+			//race with the deletion.
+			if i.CurrentUser != nil {
+				isCurrentUser := func(u core.User) bool { return u.LoginName == i.CurrentUser.LoginName }
+				if _, exists := db.Users.Find(isCurrentUser); !exists {
+					return errext.ErrorSet{errors.New("your user account has been deleted in the meantime")}
+				}
+			}
 			return action(db, i, n.PasswordHasher())
 		}, &opts)
+		for _, err := range errs {
+			if errors.Is(err, core.ErrConcurrentModification) {
+				i.IsConcurrentlyModified = true
+			}
+		}
 		i.FormState.FillErrorsFrom(errs, i.TargetRef)
 	}
 }
+
+// ReloadFormAfterConcurrentModification is a handler step for edit forms that
+// comes after TryUpdateNexus. If the update was rejected because the target
+// object was modified by someone else in the meantime, the given steps are run
+// to reload the target object and rebuild i.FormSpec and i.FormState from its
+// current values. The form will then be shown again with only an error message
+// explaining what happened, so that the user can review the other changes
+// before repeating their own.
+func ReloadFormAfterConcurrentModification(steps ...HandlerStep) HandlerStep {
+	return func(i *Interaction) {
+		if !i.IsConcurrentlyModified {
+			return
+		}
+		//the submission was not applied, so the same form may be submitted again
+		i.FormState.ReleaseSubmission()
+
+		for _, step := range steps {
+			step(i)
+			if i.writer == nil {
+				return
+			}
+		}
+		i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, core.ErrConcurrentModification.Error())
+	}
+}
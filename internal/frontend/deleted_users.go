@@ -0,0 +1,126 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Handles GET /deleted-users.
+func getDeletedUsersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(deletedUsersList(n)),
+	)
+}
+
+var deletedUsersListSnippet = h.NewSnippet(`
+	<p>Deleted users can be restored until they are purged {{.Retention}} after their deletion. Restored users are added back to those of their former groups that still exist.</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Login name</th>
+				<th>Full name</th>
+				<th>Former groups</th>
+				<th>Deleted at</th>
+				<th>Deleted by</th>
+				<th>Purged at</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Items}}
+				<tr>
+					<td data-label="Login name"><code>{{.DeletedUser.User.LoginName}}</code></td>
+					<td data-label="Full name">{{.DeletedUser.User.FullName}}</td>
+					<td data-label="Former groups" class="comma-separated-list">
+						{{- range .DeletedUser.GroupNames -}}
+						<code>{{.}}</code><span class="comma">,&nbsp;</span>
+						{{- end -}}
+					</td>
+					<td data-label="Deleted at">{{.DeletedUser.DeletedAt.UTC.Format "2006-01-02 15:04"}} UTC</td>
+					{{ if .DeletedUser.DeletedBy -}}
+						<td data-label="Deleted by"><code>{{.DeletedUser.DeletedBy}}</code></td>
+					{{- else -}}
+						<td data-label="Deleted by" class="text-muted">portunusctl</td>
+					{{- end }}
+					<td data-label="Purged at">{{.DeletedUser.PurgeAt.UTC.Format "2006-01-02 15:04"}} UTC</td>
+					<td class="actions">{{.RestoreForm}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="7" class="text-muted">No recently deleted users.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func deletedUsersList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		type deletedUserItem struct {
+			DeletedUser core.DeletedUser
+			RestoreForm template.HTML
+		}
+		var items []deletedUserItem
+		for _, tombstone := range n.ListDeletedUsers() {
+			form := h.FormSpec{
+				PostTarget:  fmt.Sprintf("/deleted-users/%s/restore", tombstone.ID),
+				SubmitLabel: "Restore",
+			}
+			items = append(items, deletedUserItem{tombstone, form.Render(i.Req, h.FormState{})})
+		}
+
+		return Page{
+			Status: http.StatusOK,
+			Title:  "Recently deleted users",
+			Contents: deletedUsersListSnippet.Render(struct {
+				Items     []deletedUserItem
+				Retention string
+			}{items, deletedUserRetention.String()}),
+			Wide: true,
+		}
+	}
+}
+
+// Handles POST /deleted-users/:id/restore.
+func postDeletedUserRestoreHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			var loginName string
+			errs := n.Update(func(db *core.Database) errext.ErrorSet {
+				id := mux.Vars(i.Req)["id"]
+				for _, tombstone := range db.DeletedUsers {
+					if tombstone.ID == id {
+						loginName = tombstone.User.LoginName
+					}
+				}
+				return db.RestoreDeletedUser(id)
+			}, &core.UpdateOptions{
+				ConflictWithSeedIsError: true,
+				Actor:                   i.CurrentUser.LoginName,
+			})
+			if !errs.IsEmpty() {
+				msg := fmt.Sprintf("Could not restore user: %s.", errs.Join(", "))
+				i.RedirectWithFlashTo("/deleted-users", Flash{"danger", msg})
+				return
+			}
+			msg := fmt.Sprintf("Restored user %q.", loginName)
+			i.RedirectWithFlashTo("/users", Flash{"success", msg})
+		},
+	)
+}
@@ -0,0 +1,142 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// This is set by HTTPHandler(). It is a package variable because the
+// navigation bar needs it on every page. If nil, destructive operations in the
+// control API are always allowed.
+var destructiveWindow *core.DestructiveWindow
+
+// Returns the currently open destructive operations window, if any.
+func currentDestructiveWindow() (core.DestructiveWindowState, bool) {
+	if destructiveWindow == nil {
+		return core.DestructiveWindowState{}, false
+	}
+	return destructiveWindow.Current()
+}
+
+var destructiveWindowOpenSnippet = h.NewSnippet(`
+	A destructive operations window is open until {{.ExpiresAt.UTC.Format "2006-01-02 15:04"}} UTC.
+	It was opened by <code>{{.OpenedBy}}</code> with the reason: {{.Reason}}
+`)
+
+var destructiveWindowClosedSnippet = h.NewSnippet(`
+	Through the control API (e.g. with <code>portunusctl</code>), users and group memberships can only be deleted and the entire database can only be replaced while a destructive operations window is open.
+	Deletions in the web GUI are not affected.
+	A window stays open for {{.}}, or until it is closed.
+`)
+
+func useDestructiveWindowForm(i *Interaction) {
+	state, isOpen := currentDestructiveWindow()
+	if isOpen {
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/destructive-window/close",
+			SubmitLabel:         "Close window",
+			IgnoresReadOnlyMode: true,
+			Fields: []h.FormField{
+				h.StaticField{Value: destructiveWindowOpenSnippet.Render(state)},
+			},
+		}
+		return
+	}
+
+	fields := []h.FormField{
+		h.StaticField{Value: destructiveWindowClosedSnippet.Render(destructiveWindow.Duration.String())},
+		h.InputFieldSpec{
+			Name:      "reason",
+			Label:     "Reason",
+			InputType: "text",
+			AutoFocus: true,
+		},
+	}
+	//like sudo, this requires the admin to confirm their password
+	if needsOldPassword(i) {
+		fields = append(fields, h.InputFieldSpec{
+			Name:      "password",
+			Label:     "Your password",
+			InputType: "password",
+		})
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:          "/destructive-window/open",
+		SubmitLabel:         "Open window",
+		IgnoresReadOnlyMode: true,
+		Fields:              fields,
+	}
+}
+
+// Handles GET /destructive-window.
+func getDestructiveWindowHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useDestructiveWindowForm,
+		UseEmptyFormState,
+		ShowForm("Destructive operations"),
+	)
+}
+
+// Admins that impersonate another user cannot make changes, and the
+// impersonated user would appear as the one who opened the window.
+func refuseDestructiveWindowWhileImpersonating(i *Interaction) {
+	if isImpersonating(i) {
+		i.RedirectWithFlashTo("/destructive-window", Flash{"danger", "No changes can be made while impersonating another user."})
+	}
+}
+
+// Handles POST /destructive-window/open.
+func postDestructiveWindowOpenHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		refuseDestructiveWindowWhileImpersonating,
+		useDestructiveWindowForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			if needsOldPassword(i) {
+				password := fs.Fields["password"].GetValueOrSetError()
+				if password != "" && !n.PasswordHasher().CheckPasswordHash(password, i.CurrentUser.PasswordHash) {
+					fs.Fields["password"].ErrorMessage = "is not correct"
+				}
+			}
+			if !fs.IsValid() {
+				return
+			}
+			_, err := destructiveWindow.Open(*i.CurrentUser, fs.Fields["reason"].Value)
+			if err != nil {
+				fs.ErrorMessages = append(fs.ErrorMessages, err.Error())
+				return
+			}
+			i.RedirectWithFlashTo("/destructive-window", Flash{"success", "Destructive operations window opened."})
+		},
+		ShowFormIfErrors("Destructive operations"),
+	)
+}
+
+// Handles POST /destructive-window/close.
+func postDestructiveWindowCloseHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		refuseDestructiveWindowWhileImpersonating,
+		func(i *Interaction) {
+			destructiveWindow.Close(i.CurrentUser.LoginName)
+			i.RedirectWithFlashTo("/destructive-window", Flash{"success", "Destructive operations window closed."})
+		},
+	)
+}
@@ -0,0 +1,261 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/majewsky/portunus/internal/notify"
+)
+
+// Builds a short human-readable description like "Firefox on Linux" from a
+// User-Agent header. This is only meant to help users tell their devices
+// apart, so it does not need to be exact.
+func describeUserAgent(userAgent string) string {
+	browser := "Unknown browser"
+	//the order matters since most user agents claim to be several browsers at once
+	for _, candidate := range []struct{ Marker, Name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Chromium/", "Chromium"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, candidate.Marker) {
+			browser = candidate.Name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ Marker, Name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.Marker) {
+			return browser + " on " + candidate.Name
+		}
+	}
+	return browser
+}
+
+const deviceCookieName = "portunus-device"
+
+// The device cookie is renewed on each login, so it only expires when the
+// device is not used for a long time. By then, the device store will most
+// likely have forgotten the device anyway.
+const deviceCookieMaxAge = 400 * 24 * time.Hour
+
+// Identifies the device that the current login comes from, and notifies the
+// user if they have not logged in on this device before. Returns the device ID.
+func recognizeDevice(i *Interaction, user core.User) string {
+	secret := ""
+	if cookie, err := i.Req.Cookie(deviceCookieName); err == nil && len(cookie.Value) == 64 {
+		secret = cookie.Value
+	} else {
+		secret = hex.EncodeToString(core.GenerateRandomKey(32))
+	}
+	http.SetCookie(i.writer, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(deviceCookieMaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	//only the hash is stored, so that the cookie cannot be forged by someone who can read the device store
+	sum := sha256.Sum256([]byte(secret))
+	deviceID := hex.EncodeToString(sum[:])
+	name := describeUserAgent(i.Req.UserAgent())
+	if !deviceTracker.RecordLogin(user.LoginName, deviceID, name) {
+		return deviceID
+	}
+
+	fields := logging.Fields{"login_name": user.LoginName, "device": name, "remote_addr": core.ClientIPOf(i.Req)}
+	logging.Info(fields, "login from new device")
+	details := notify.LoginDetails{
+		DeviceName: name,
+		RemoteAddr: core.ClientIPOf(i.Req),
+	}
+	if requireDeviceConfirmation {
+		if user.EMailAddress == "" {
+			logging.Info(fields, "not requiring confirmation of new device because the user does not have an email address")
+		} else {
+			token := deviceTracker.RequireConfirmation(user.LoginName, deviceID)
+			details.ConfirmationURL = externalURL(i.Req, "/device-confirmation/"+token)
+		}
+	}
+	if deviceNotifier != nil {
+		deviceNotifier.NotifyNewDevice(user, details)
+	}
+	return deviceID
+}
+
+var unconfirmedDeviceSnippet = h.NewSnippet(`
+	<p>
+		No changes can be made from this device until it has been confirmed.
+		Please follow the link in the email that was sent to you when you signed in on this device.
+	</p>
+`)
+
+// Called by VerifyLogin for sessions that were started by a login on a
+// device. Rejects all requests that could make changes while the device is
+// not confirmed.
+func verifyDevice(i *Interaction, info SessionInfo) {
+	if i.Req.Method == http.MethodGet || i.Req.Method == http.MethodHead {
+		return
+	}
+	device, exists := deviceTracker.FindDevice(info.LoginName, info.DeviceID)
+	if exists && !device.IsConfirmed() {
+		logging.Info(logging.Fields{"login_name": info.LoginName, "device": device.Name},
+			"rejected %s %s from unconfirmed device", i.Req.Method, i.Req.URL.Path)
+		if wantsJSON(i.Req) {
+			i.Fail(errForbidden("changes cannot be made from this device until it has been confirmed"))
+			return
+		}
+		Page{
+			Status:   http.StatusForbidden,
+			Title:    "Device not confirmed",
+			Contents: unconfirmedDeviceSnippet.Render(nil),
+		}.Render(i.writer, i.Req, i.CurrentUser, i.Session)
+		i.writer = nil
+	}
+}
+
+// Builds the form on the /self page that lists the user's devices. Returns
+// nil if there are no devices to show.
+func buildDevicesForm(i *Interaction) *h.FormSpec {
+	info, _ := currentSessionInfo(i)
+	devices := deviceTracker.ListDevicesOfUser(i.CurrentUser.LoginName)
+	if len(devices) == 0 {
+		return nil
+	}
+
+	opts := make([]h.SelectOptionSpec, len(devices))
+	for idx, d := range devices {
+		notes := []string{
+			"first used " + d.CreatedAt.Local().Format("2006-01-02 15:04 MST"),
+			"last used " + d.LastSeenAt.Local().Format("2006-01-02 15:04 MST"),
+		}
+		if d.ID == info.DeviceID {
+			notes = append(notes, "this device")
+		}
+		if !d.IsConfirmed() {
+			notes = append(notes, "not confirmed yet")
+		}
+		opts[idx] = h.SelectOptionSpec{
+			Value: d.ID,
+			Label: fmt.Sprintf("%s (%s)", d.Name, strings.Join(notes, ", ")),
+		}
+	}
+	return &h.FormSpec{
+		PostTarget:          "/self/devices",
+		SubmitLabel:         "Forget selected devices",
+		IgnoresReadOnlyMode: true,
+		Fields: []h.FormField{
+			h.SelectFieldSpec{
+				Name:    "devices",
+				Label:   "Known devices (you will be notified when you sign in on any other device)",
+				Options: opts,
+			},
+		},
+	}
+}
+
+// Handles POST /self/devices.
+func postSelfDevicesHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			loginName := i.CurrentUser.LoginName
+			count := 0
+			for _, deviceID := range i.Req.PostForm["devices"] {
+				if _, exists := deviceTracker.FindDevice(loginName, deviceID); !exists {
+					continue
+				}
+				//logins on a forgotten device need to be confirmed again, so existing sessions cannot be kept
+				deviceTracker.DeleteDevice(loginName, deviceID)
+				sessionTracker.DeleteSessionsOfDevice(loginName, deviceID)
+				count++
+			}
+			logging.Info(logging.Fields{"login_name": loginName}, "forgot %d device(s)", count)
+			msg := fmt.Sprintf("Forgot %d device(s). Their sessions have been signed out.", count)
+			i.RedirectWithFlashTo("/self", Flash{"success", msg})
+		},
+	)
+}
+
+var deviceConfirmationSnippet = h.NewSnippet(`
+	<p>Confirm that you have signed in on a new device?</p>
+`)
+
+func useDeviceConfirmationForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:          "/device-confirmation/" + mux.Vars(i.Req)["token"],
+		SubmitLabel:         "Confirm device",
+		IgnoresReadOnlyMode: true,
+		Fields: []h.FormField{
+			h.StaticField{Value: deviceConfirmationSnippet.Render(nil)},
+		},
+	}
+}
+
+// Handles GET /device-confirmation/:token.
+func getDeviceConfirmationHandler() http.Handler {
+	return Do(
+		LoadSession,
+		useDeviceConfirmationForm,
+		UseEmptyFormState,
+		ShowForm("Confirm device"),
+	)
+}
+
+// Handles POST /device-confirmation/:token.
+func postDeviceConfirmationHandler() http.Handler {
+	return Do(
+		LoadSession,
+		useDeviceConfirmationForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			device, ok := deviceTracker.ConfirmDevice(mux.Vars(i.Req)["token"])
+			if !ok {
+				msg := "This confirmation link is not valid. The device may have been confirmed or forgotten already."
+				i.RedirectWithFlashTo("/login", Flash{"danger", msg})
+				return
+			}
+			logging.Info(logging.Fields{"login_name": device.LoginName, "device": device.Name}, "device confirmed")
+			msg := fmt.Sprintf("The device %q has been confirmed.", device.Name)
+			i.RedirectWithFlashTo("/self", Flash{"success", msg})
+		},
+	)
+}
+
+// Forgets the devices of all users that do not exist anymore. This runs as a
+// listener on the nexus, same as revokeSessionsOfDeletedUsers.
+func forgetDevicesOfDeletedUsers(db core.Database) {
+	knownLoginNames := make(map[string]bool, len(db.Users))
+	for _, user := range db.Users {
+		knownLoginNames[user.LoginName] = true
+	}
+	deviceTracker.DeleteDevicesOfUnknownUsers(knownLoginNames)
+}
@@ -0,0 +1,148 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Users with only these permissions can look up people in the directory, but
+// cannot see the users list or the groups list.
+var browserPerms = core.Permissions{
+	Portunus: core.PortunusPermissions{
+		CanBrowse: true,
+	},
+}
+
+func getDirectoryHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(browserPerms),
+		ShowView(directoryList(n)),
+	)
+}
+
+var directoryListSnippet = h.NewSnippet(`
+	<form method="GET" action="/directory">
+		<div class="form-row">
+			<label for="q">Search by name, login name or email address</label>
+			<input type="text" name="q" id="q" value="{{.Query}}" class="row-input">
+		</div>
+		<div class="button-row">
+			<button type="submit" class="button button-primary">Search</button>
+			{{- if .Query }}
+				<a href="/directory" class="button button-secondary">Show everyone</a>
+			{{- end }}
+		</div>
+	</form>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Photo</th>
+				<th>Name</th>
+				<th>Email address</th>
+				<th>Groups</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Users}}
+				<tr>
+					<td data-label="Photo">{{.Photo}}</td>
+					<td data-label="Name">
+						{{.UserFullName}}<br><code class="small">{{.User.LoginName}}</code>
+					</td>
+					{{ if .User.EMailAddress -}}
+						<td data-label="Email address"><a href="mailto:{{.User.EMailAddress}}">{{.User.EMailAddress}}</a></td>
+					{{- else -}}
+						<td data-label="Email address" class="text-muted">None</td>
+					{{- end }}
+					<td data-label="Groups" class="comma-separated-list">
+						{{- range .Groups -}}
+						<span>{{.LongName}}</span><span class="comma">,&nbsp;</span>
+						{{- end -}}
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="4" class="text-muted">Nobody matches this search.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+var directoryPhotoSnippet = h.NewSnippet(`<img class="user-photo" src="{{.}}" alt="Photo" width="64">`)
+
+func directoryList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		coll := collationFor(i.Req)
+		groups := n.ListGroups()
+		coll.SortGroups(groups)
+		users := n.ListUsers()
+		coll.SortUsers(users)
+		query := strings.TrimSpace(i.Req.URL.Query().Get("q"))
+		now := time.Now()
+
+		type userItem struct {
+			User         core.User
+			UserFullName string
+			Photo        template.HTML
+			Groups       []core.Group
+		}
+		var data []userItem
+		for _, user := range users {
+			//disabled accounts (e.g. of people who have left) are not listed
+			if user.IsExpiredAt(now) || !matchesDirectoryQuery(user, query) {
+				continue
+			}
+			item := userItem{
+				User:         user,
+				UserFullName: user.FullName(),
+			}
+			if len(user.Photo) > 0 {
+				item.Photo = directoryPhotoSnippet.Render(template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(user.Photo)))
+			}
+			for _, group := range groups {
+				if group.ContainsUser(user) {
+					item.Groups = append(item.Groups, group)
+				}
+			}
+			data = append(data, item)
+		}
+
+		return Page{
+			Status: http.StatusOK,
+			Title:  "Directory",
+			Contents: directoryListSnippet.Render(struct {
+				Users []userItem
+				Query string
+			}{data, query}),
+			Wide: true,
+		}
+	}
+}
+
+// Returns whether the given search query (case-insensitive) appears in the
+// name, login name or email address of the given user.
+func matchesDirectoryQuery(user core.User, query string) bool {
+	if query == "" {
+		return true
+	}
+	query = strings.ToLower(query)
+	for _, value := range []string{user.FullName(), user.LoginName, user.EMailAddress} {
+		if strings.Contains(strings.ToLower(value), query) {
+			return true
+		}
+	}
+	return false
+}
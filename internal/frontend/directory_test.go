@@ -0,0 +1,72 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestDirectory(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	past := time.Now().Add(-time.Hour)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			core.User{LoginName: "john", GivenName: "John", FamilyName: "Smith", EMailAddress: "john.smith@example.org"},
+			core.User{LoginName: "max", GivenName: "Max", FamilyName: "Mustermann", ValidUntil: &past},
+		)
+		db.Groups = []core.Group{{
+			Name:             "staff",
+			LongName:         "All staff",
+			MemberLoginNames: core.GroupMemberNames{"jane": true, "john": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{CanBrowse: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	cookie := loginCookieForTests(t, "jane")
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	//directory access does not unlock the admin pages
+	status, _ := get("/users")
+	assert.DeepEqual(t, "status of /users", status, http.StatusForbidden)
+	status, _ = get("/groups")
+	assert.DeepEqual(t, "status of /groups", status, http.StatusForbidden)
+
+	//the directory lists all active users with their contact details
+	status, body := get("/directory")
+	assert.DeepEqual(t, "status of /directory", status, http.StatusOK)
+	assert.DeepEqual(t, "nav contains directory", strings.Contains(body, `href="/directory"`), true)
+	assert.DeepEqual(t, "directory contains jane", strings.Contains(body, "<code class=\"small\">jane</code>"), true)
+	assert.DeepEqual(t, "directory contains john", strings.Contains(body, "mailto:john.smith@example.org"), true)
+	assert.DeepEqual(t, "directory contains group", strings.Contains(body, "All staff"), true)
+	assert.DeepEqual(t, "directory contains expired user", strings.Contains(body, "Mustermann"), false)
+	assert.DeepEqual(t, "directory links to user form", strings.Contains(body, "/users/john/edit"), false)
+
+	//search matches names and email addresses regardless of case
+	_, body = get("/directory?q=SMITH")
+	assert.DeepEqual(t, "search result contains john", strings.Contains(body, "<code class=\"small\">john</code>"), true)
+	assert.DeepEqual(t, "search result contains jane", strings.Contains(body, "<code class=\"small\">jane</code>"), false)
+	_, body = get("/directory?q=nobody")
+	assert.DeepEqual(t, "empty search result", strings.Contains(body, "Nobody matches this search."), true)
+}
@@ -0,0 +1,412 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// This is set by HTTPHandler().
+var elevationManager *core.ElevationManager
+
+// Handles GET /elevations.
+func getElevationsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		ShowView(elevationsList(n)),
+	)
+}
+
+var elevationsListSnippet = h.NewSnippet(`
+	<h2>Active elevations</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>User</th>
+				<th>Group</th>
+				<th>Expires at</th>
+				<th>Justification</th>
+				<th>Approved by</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Active}}
+				<tr>
+					<td data-label="User"><code>{{.Elevation.LoginName}}</code></td>
+					<td data-label="Group"><code>{{.Elevation.GroupName}}</code></td>
+					<td data-label="Expires at">{{.Elevation.ExpiresAt.UTC.Format "2006-01-02 15:04"}} UTC</td>
+					<td data-label="Justification">{{.Elevation.Justification}}</td>
+					<td data-label="Approved by">{{.ApprovedBy}}</td>
+					<td class="actions">
+						{{- if .CanExtend }}
+							<a href="/elevations/{{.Elevation.ID}}/extend">Extend</a>
+						{{- end }}
+						{{.Actions}}
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="6" class="text-muted">No active elevations.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	<h2>Pending requests</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>User</th>
+				<th>Group</th>
+				<th>Duration</th>
+				<th>Justification</th>
+				<th>Requested by</th>
+				<th>Approved by</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Pending}}
+				<tr>
+					<td data-label="User"><code>{{.Elevation.LoginName}}</code></td>
+					<td data-label="Group"><code>{{.Elevation.GroupName}}</code></td>
+					<td data-label="Duration">{{.Elevation.Hours}} hour(s){{if .Elevation.ExtendsID}} (extension){{end}}</td>
+					<td data-label="Justification">{{.Elevation.Justification}}</td>
+					<td data-label="Requested by"><code>{{.Elevation.RequestedBy}}</code> at {{.Elevation.RequestedAt.UTC.Format "2006-01-02 15:04"}} UTC</td>
+					<td data-label="Approved by">{{.ApprovedBy}}</td>
+					<td class="actions">{{.Actions}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="7" class="text-muted">No pending requests.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	<h2>Groups that allow temporary membership</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Long name</th>
+				<th>Maximum duration</th>
+				<th>Approved by members of</th>
+				<th>Owners</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Groups}}
+				<tr>
+					<td data-label="Name"><code>{{.Name}}</code></td>
+					<td data-label="Long name">{{.LongName}}</td>
+					<td data-label="Maximum duration">{{.Elevation.MaxHours}} hour(s)</td>
+					<td data-label="Approved by members of"><code>{{.Elevation.ApproverGroupName}}</code> ({{.Elevation.RequiredApprovals}} approval(s) required)</td>
+					{{ if .OwnerContacts -}}
+						<td data-label="Owners">{{.OwnerContacts}}</td>
+					{{- else -}}
+						<td data-label="Owners" class="text-muted">None</td>
+					{{- end }}
+					<td class="actions"><a href="/elevations/new/{{.Name}}">Request</a></td>
+				</tr>
+			{{else}}
+				<tr><td colspan="6" class="text-muted">No groups allow temporary membership.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+// Returns whether the current user may see the given elevation. Users with
+// view access see all elevations; everyone else only sees their own
+// elevations and the requests that they can approve.
+func canSeeElevation(i *Interaction, e core.Elevation) bool {
+	if i.CurrentUser.Perms.Includes(viewerPerms) {
+		return true
+	}
+	loginName := i.CurrentUser.LoginName
+	return e.LoginName == loginName || e.RequestedBy == loginName || elevationManager.CanApprove(*i.CurrentUser, e)
+}
+
+// Returns whether the current user may revoke or withdraw the given elevation.
+// This mirrors the check in core.ElevationManager.Revoke().
+func canRevokeElevation(i *Interaction, e core.Elevation) bool {
+	loginName := i.CurrentUser.LoginName
+	return e.LoginName == loginName || e.RequestedBy == loginName || canEdit(i)
+}
+
+func elevationsList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		type elevationItem struct {
+			Elevation  core.Elevation
+			ApprovedBy string
+			CanExtend  bool
+			Actions    template.HTML
+		}
+		type groupItem struct {
+			core.Group
+			OwnerContacts template.HTML
+		}
+		var data struct {
+			Active  []elevationItem
+			Pending []elevationItem
+			Groups  []groupItem
+		}
+
+		for _, e := range elevationManager.List() {
+			if !canSeeElevation(i, e) {
+				continue
+			}
+			item := elevationItem{Elevation: e, ApprovedBy: strings.Join(e.ApprovedBy, ", ")}
+			if e.State == core.ElevationPending && elevationManager.CanApprove(*i.CurrentUser, e) {
+				item.Actions += buildElevationActionForm(i, e, "approve", "Approve")
+				item.Actions += buildElevationActionForm(i, e, "deny", "Deny")
+			}
+			if canRevokeElevation(i, e) {
+				if e.State == core.ElevationActive {
+					item.CanExtend = true
+					item.Actions += buildElevationActionForm(i, e, "revoke", "Revoke")
+				} else {
+					item.Actions += buildElevationActionForm(i, e, "revoke", "Withdraw")
+				}
+			}
+			if e.State == core.ElevationActive {
+				data.Active = append(data.Active, item)
+			} else {
+				data.Pending = append(data.Pending, item)
+			}
+		}
+
+		var groups []core.Group
+		for _, g := range n.ListGroups() {
+			if g.Elevation != nil {
+				groups = append(groups, g)
+			}
+		}
+		collationFor(i.Req).SortGroups(groups)
+		for _, g := range groups {
+			item := groupItem{Group: g}
+			if contacts := listGroupOwnerContacts(n, g); len(contacts) > 0 {
+				item.OwnerContacts = groupOwnerContactsSnippet.Render(contacts)
+			}
+			data.Groups = append(data.Groups, item)
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Temporary group memberships",
+			Contents: elevationsListSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+func buildElevationActionForm(i *Interaction, e core.Elevation, action, label string) template.HTML {
+	form := h.FormSpec{
+		PostTarget:  fmt.Sprintf("/elevations/%s/%s", e.ID, action),
+		SubmitLabel: label,
+		//denying a request does not touch the database
+		IgnoresReadOnlyMode: action == "deny",
+	}
+	return form.Render(i.Req, h.FormState{})
+}
+
+// Handles POST /elevations/:id/approve, /deny and /revoke.
+func postElevationActionHandler(n core.Nexus, action func(*core.ElevationManager, core.UserWithPerms, string) (core.Elevation, error), verb, pastTense string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			e, err := action(elevationManager, *i.CurrentUser, mux.Vars(i.Req)["id"])
+			if err != nil {
+				msg := fmt.Sprintf("Could not %s elevation: %s.", verb, err.Error())
+				i.RedirectWithFlashTo("/elevations", Flash{"danger", msg})
+				return
+			}
+			msg := fmt.Sprintf("%s elevation of user %q into group %q.", pastTense, e.LoginName, e.GroupName)
+			if e.State == core.ElevationPending {
+				msg += " More approvals are required before it takes effect."
+			}
+			i.RedirectWithFlashTo("/elevations", Flash{"success", msg})
+		},
+	)
+}
+
+func useElevationRequestForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		groupName := mux.Vars(i.Req)["group"]
+		group, exists := n.FindGroup(func(g core.Group) bool { return g.Name == groupName })
+		if !exists || group.Elevation == nil {
+			msg := fmt.Sprintf("Group %q does not allow temporary membership.", groupName)
+			i.RedirectWithFlashTo("/elevations", Flash{"danger", msg})
+			return
+		}
+
+		fields := []h.FormField{
+			h.StaticField{
+				Label: "Group",
+				Value: codeTagSnippet.Render(group.Name),
+			},
+		}
+		//admins can request elevation on behalf of other users (e.g. for a new
+		//team member who cannot sign in yet)
+		if canEdit(i) {
+			fields = append(fields, h.InputFieldSpec{
+				Name:      "user",
+				Label:     "Login name of user to be elevated",
+				InputType: "text",
+			})
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/elevations/new/" + group.Name,
+			SubmitLabel:         "Request membership",
+			IgnoresReadOnlyMode: true,
+			Fields:              append(fields, buildElevationDurationFields(*group.Elevation)...),
+		}
+	}
+}
+
+func buildElevationDurationFields(policy core.ElevationPolicy) []h.FormField {
+	return []h.FormField{
+		h.InputFieldSpec{
+			Name:      "hours",
+			Label:     fmt.Sprintf("Duration in hours (at most %d)", policy.MaxHours),
+			InputType: "text",
+		},
+		h.InputFieldSpec{
+			Name:      "justification",
+			Label:     "Justification",
+			InputType: "text",
+		},
+	}
+}
+
+// Handles GET /elevations/new/:group.
+func getElevationsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useElevationRequestForm(n),
+		func(i *Interaction) {
+			i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+				"user": {Value: i.CurrentUser.LoginName},
+			}}
+		},
+		ShowForm("Request temporary membership"),
+	)
+}
+
+// Handles POST /elevations/new/:group.
+func postElevationsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useElevationRequestForm(n),
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			loginName := i.CurrentUser.LoginName
+			if canEdit(i) {
+				loginName = strings.TrimSpace(i.FormState.Fields["user"].Value)
+			}
+			hours, ok := readElevationHours(i)
+			if !ok {
+				return
+			}
+			e, err := elevationManager.Request(*i.CurrentUser, loginName, mux.Vars(i.Req)["group"], hours, i.FormState.Fields["justification"].Value)
+			if err != nil {
+				i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, err.Error())
+				return
+			}
+			msg := fmt.Sprintf("Requested temporary membership of user %q in group %q. The approvers have been notified.", e.LoginName, e.GroupName)
+			i.RedirectWithFlashTo("/elevations", Flash{"success", msg})
+		},
+		ShowFormIfErrors("Request temporary membership"),
+	)
+}
+
+func useElevationExtensionForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		id := mux.Vars(i.Req)["id"]
+		e, exists := elevationManager.Find(id)
+		if !exists || e.State != core.ElevationActive || !canSeeElevation(i, e) {
+			i.RedirectWithFlashTo("/elevations", Flash{"danger", "Only active elevations can be extended."})
+			return
+		}
+		group, exists := n.FindGroup(func(g core.Group) bool { return g.Name == e.GroupName })
+		if !exists || group.Elevation == nil {
+			i.RedirectWithFlashTo("/elevations", Flash{"danger", "This group does not allow temporary membership anymore."})
+			return
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/elevations/" + e.ID + "/extend",
+			SubmitLabel:         "Request extension",
+			IgnoresReadOnlyMode: true,
+			Fields: append([]h.FormField{
+				h.StaticField{
+					Label: "Elevation",
+					Value: elevationSummarySnippet.Render(e),
+				},
+			}, buildElevationDurationFields(*group.Elevation)...),
+		}
+	}
+}
+
+var elevationSummarySnippet = h.NewSnippet(`
+	User <code>{{.LoginName}}</code> in group <code>{{.GroupName}}</code> until {{.ExpiresAt.UTC.Format "2006-01-02 15:04"}} UTC
+`)
+
+// Handles GET /elevations/:id/extend.
+func getElevationExtendHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useElevationExtensionForm(n),
+		UseEmptyFormState,
+		ShowForm("Extend temporary membership"),
+	)
+}
+
+// Handles POST /elevations/:id/extend.
+func postElevationExtendHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useElevationExtensionForm(n),
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			hours, ok := readElevationHours(i)
+			if !ok {
+				return
+			}
+			e, err := elevationManager.Extend(*i.CurrentUser, mux.Vars(i.Req)["id"], hours, i.FormState.Fields["justification"].Value)
+			if err != nil {
+				i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, err.Error())
+				return
+			}
+			msg := fmt.Sprintf("Requested extension of the temporary membership of user %q in group %q. The approvers have been notified.", e.LoginName, e.GroupName)
+			i.RedirectWithFlashTo("/elevations", Flash{"success", msg})
+		},
+		ShowFormIfErrors("Extend temporary membership"),
+	)
+}
+
+// Reads the "hours" field from i.FormState. If it is not a number, an error
+// is put into the form state.
+func readElevationHours(i *Interaction) (uint, bool) {
+	ref := core.ObjectRef{Type: "elevation"}
+	hours, err := core.ParseNonnegativeInteger(i.FormState.Fields["hours"].Value, ref.Field("hours"))
+	if err != nil {
+		i.FormState.FillErrorsFrom(errext.ErrorSet{err}, ref)
+		return 0, false
+	}
+	return hours, true
+}
@@ -0,0 +1,234 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// ErrorCode identifies a class of failures in the JSON error responses that
+// are sent to API clients (see wantsJSON).
+type ErrorCode string
+
+// Acceptable values for ErrorCode.
+const (
+	ErrorCodeUnauthorized     ErrorCode = "unauthorized"
+	ErrorCodeForbidden        ErrorCode = "forbidden"
+	ErrorCodeNotFound         ErrorCode = "not_found"
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	ErrorCodeValidationFailed ErrorCode = "validation_failed"
+	ErrorCodeRateLimited      ErrorCode = "rate_limited"
+	ErrorCodeInternal         ErrorCode = "internal_error"
+)
+
+// HTTPError is a failure that is reported to the client. Handler steps report
+// these through Interaction.Fail() instead of writing an error response by
+// themselves, so that writeError() can choose the response format.
+type HTTPError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	//only used for ErrorCodeValidationFailed
+	Fields []FieldError
+	//only used for ErrorCodeRateLimited
+	RetryAfter time.Duration
+}
+
+// FieldError appears in type HTTPError.
+type FieldError struct {
+	//Field is empty for errors that do not refer to a single field.
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error implements the builtin/error interface.
+func (e HTTPError) Error() string {
+	return e.Message
+}
+
+// Returns the HTTPError for requests that need a login session.
+func errUnauthorized() HTTPError {
+	return HTTPError{http.StatusUnauthorized, ErrorCodeUnauthorized, "login required", nil, 0}
+}
+
+// Returns the HTTPError for requests by users that lack the required permissions.
+func errForbidden(msg string) HTTPError {
+	return HTTPError{http.StatusForbidden, ErrorCodeForbidden, msg, nil, 0}
+}
+
+// Returns the HTTPError for requests that shall be retried later.
+func errRateLimited(retryAfter time.Duration) HTTPError {
+	return HTTPError{http.StatusTooManyRequests, ErrorCodeRateLimited, "too many requests", nil, retryAfter}
+}
+
+// Returns the HTTPError for a form submission that was rejected. The field
+// errors are collected from the given FormState.
+func errValidationFailed(fs h.FormState) HTTPError {
+	var fields []FieldError
+	for name, field := range fs.Fields {
+		if field != nil && field.ErrorMessage != "" {
+			fields = append(fields, FieldError{name, field.ErrorMessage})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+	for _, msg := range fs.ErrorMessages {
+		fields = append(fields, FieldError{Message: msg})
+	}
+	return HTTPError{http.StatusUnprocessableEntity, ErrorCodeValidationFailed, "the submitted values are not acceptable", fields, 0}
+}
+
+// Handler steps that render a form again with the errors from i.FormState
+// call this first. For clients that want JSON, the errors are reported as a
+// validation failure instead, and true is returned.
+func reportFormErrorsAsJSON(i *Interaction) bool {
+	if !wantsJSON(i.Req) || i.FormState.IsValid() {
+		return false
+	}
+	i.Fail(errValidationFailed(*i.FormState))
+	return true
+}
+
+// Returns whether errors for this request shall be reported as JSON instead
+// of as HTML pages. This is the case for everything below /api/, and for all
+// requests that explicitly ask for JSON.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+type requestIDContextKey struct{}
+
+// Returns the ID that errorHandlingMiddleware assigned to this request.
+func requestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// errorHandlingMiddleware assigns an ID to each request (which is reported in
+// the X-Request-Id header and in all error responses), turns panics into 500
+// responses, and reports requests for unknown routes.
+func errorHandlingMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := hex.EncodeToString(core.GenerateRandomKey(8))
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, requestID))
+		w.Header().Set("X-Request-Id", requestID)
+
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				//this is how handlers abort a response on purpose, so let net/http handle it
+				panic(err)
+			}
+			logging.Error(logging.Fields{"request_id": requestID},
+				"panic while serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			if !tw.wroteHeader {
+				//the panic message is only logged, since it could contain secrets
+				writeError(tw, r, HTTPError{Status: http.StatusInternalServerError, Code: ErrorCodeInternal})
+			}
+		}()
+		inner.ServeHTTP(tw, r)
+	})
+}
+
+// Handles all requests that do not match a route.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, HTTPError{http.StatusNotFound, ErrorCodeNotFound, "not found", nil, 0})
+}
+
+// Handles all requests that match a route, but not its method.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, HTTPError{http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "method not allowed", nil, 0})
+}
+
+// errorEnvelope is the response body for failed requests that want JSON.
+type errorEnvelope struct {
+	Error errorEnvelopeContent `json:"error"`
+}
+
+type errorEnvelopeContent struct {
+	Code       ErrorCode    `json:"code"`
+	Message    string       `json:"message,omitempty"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	RequestID  string       `json:"request_id"`
+	RetryAfter int64        `json:"retry_after,omitempty"` //in seconds
+}
+
+// Writes the response for a failed request. API clients get a JSON error
+// envelope, browsers get the same plain-text error message as before.
+func writeError(w http.ResponseWriter, r *http.Request, e HTTPError) {
+	requestID := requestIDOf(r)
+	retryAfterSecs := int64((e.RetryAfter + time.Second - 1) / time.Second) //rounded up
+	if retryAfterSecs > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSecs, 10))
+	}
+
+	if !wantsJSON(r) {
+		msg := e.Message
+		if msg == "" {
+			msg = http.StatusText(e.Status)
+		}
+		if requestID != "" && e.Status >= 500 {
+			msg = fmt.Sprintf("%s (request ID: %s)", msg, requestID)
+		}
+		http.Error(w, msg, e.Status)
+		return
+	}
+
+	respondWithJSON(w, e.Status, errorEnvelope{errorEnvelopeContent{
+		Code:       e.Code,
+		Message:    e.Message,
+		Fields:     e.Fields,
+		RequestID:  requestID,
+		RetryAfter: retryAfterSecs,
+	}})
+}
+
+// A ResponseWriter that remembers whether a response has been started, so
+// that errorHandlingMiddleware does not write a second one after a panic.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *trackingResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *trackingResponseWriter) Write(buf []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(buf)
+}
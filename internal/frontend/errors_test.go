@@ -0,0 +1,235 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func setupErrorTest(t *testing.T) (core.Nexus, http.Handler) {
+	t.Helper()
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "{PLAINTEXT}swordfish"}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	devices, err := store.NewDeviceStore(filepath.Join(t.TempDir(), "devices.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nexus, HTTPHandler(nexus, false, nil, nil, nil, devices, nil, nil, nil, nil, nil, nil, nil, nil)
+}
+
+// Builds a session cookie for the given user, as if they had logged in.
+func loginCookieForTests(t *testing.T, loginName string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	session, err := sessionStore.New(req, "portunus-login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["sid"] = sessionTracker.NewSession(SessionInfo{LoginName: loginName})
+	rec := httptest.NewRecorder()
+	err = session.Save(req, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitN(rec.Header().Get("Set-Cookie"), ";", 2)[0]
+}
+
+type errorTestCase struct {
+	Method  string
+	Path    string
+	Form    url.Values
+	Cookie  string
+	Handler http.Handler //if nil, the main handler is used
+	//expectations for browsers
+	HTMLStatus int
+	HTMLBody   string //checked with strings.Contains()
+	Location   string
+	//expectations for API clients
+	JSONStatus   int
+	JSONEnvelope map[string]any //"request_id" is checked separately
+	RetryAfter   string
+}
+
+func (tc errorTestCase) run(t *testing.T, mainHandler http.Handler) {
+	t.Helper()
+	handler := tc.Handler
+	if handler == nil {
+		handler = mainHandler
+	}
+	send := func(accept string) *httptest.ResponseRecorder {
+		var body io.Reader = http.NoBody
+		if tc.Form != nil {
+			body = strings.NewReader(tc.Form.Encode())
+		}
+		req := httptest.NewRequest(tc.Method, tc.Path, body)
+		if tc.Form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			//this is usually done by the CSRF middleware, which some test cases bypass
+			err := req.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		req.Header.Set("Accept", accept)
+		if tc.Cookie != "" {
+			req.Header.Set("Cookie", tc.Cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//browsers get the same responses as before
+	if !strings.HasPrefix(tc.Path, "/api/") {
+		rec := send("text/html,application/xhtml+xml,*/*;q=0.8")
+		assert.DeepEqual(t, tc.Method+" "+tc.Path+" status for browsers", rec.Code, tc.HTMLStatus)
+		assert.DeepEqual(t, tc.Method+" "+tc.Path+" Location for browsers", rec.Header().Get("Location"), tc.Location)
+		if !strings.Contains(rec.Body.String(), tc.HTMLBody) {
+			t.Errorf("%s %s: expected response body for browsers to contain %q, but got %q", tc.Method, tc.Path, tc.HTMLBody, rec.Body.String())
+		}
+	}
+
+	//API clients get the JSON error envelope
+	rec := send("application/json")
+	assert.DeepEqual(t, tc.Method+" "+tc.Path+" status for API clients", rec.Code, tc.JSONStatus)
+	assert.DeepEqual(t, tc.Method+" "+tc.Path+" Content-Type for API clients", rec.Header().Get("Content-Type"), "application/json")
+	assert.DeepEqual(t, tc.Method+" "+tc.Path+" Retry-After for API clients", rec.Header().Get("Retry-After"), tc.RetryAfter)
+	var envelope map[string]map[string]any
+	err := json.Unmarshal(rec.Body.Bytes(), &envelope)
+	if err != nil {
+		t.Fatalf("%s %s: cannot parse response body %q: %s", tc.Method, tc.Path, rec.Body.String(), err.Error())
+	}
+	content := envelope["error"]
+	requestID, _ := content["request_id"].(string)
+	if requestID == "" || requestID != rec.Header().Get("X-Request-Id") {
+		t.Errorf("%s %s: expected request_id to match X-Request-Id header %q, but got %q", tc.Method, tc.Path, rec.Header().Get("X-Request-Id"), requestID)
+	}
+	delete(content, "request_id")
+	assert.DeepEqual(t, tc.Method+" "+tc.Path+" error envelope", content, tc.JSONEnvelope)
+}
+
+func TestErrorResponses(t *testing.T) {
+	nexus, handler := setupErrorTest(t)
+	cookie := loginCookieForTests(t, "jane")
+
+	testCases := []errorTestCase{
+		//authentication failures redirect browsers to the login page
+		{
+			Method: http.MethodGet, Path: "/self",
+			HTMLStatus: http.StatusSeeOther, HTMLBody: "", Location: "/login",
+			JSONStatus:   http.StatusUnauthorized,
+			JSONEnvelope: map[string]any{"code": "unauthorized", "message": "login required"},
+		},
+		//permission denials
+		{
+			Method: http.MethodGet, Path: "/users", Cookie: cookie,
+			HTMLStatus: http.StatusForbidden, HTMLBody: "Forbidden",
+			JSONStatus:   http.StatusForbidden,
+			JSONEnvelope: map[string]any{"code": "forbidden", "message": "Forbidden"},
+		},
+		{
+			Method: http.MethodPost, Path: "/self/sessions", Cookie: cookie, Form: url.Values{},
+			HTMLStatus: http.StatusForbidden, HTMLBody: "Form submission rejected",
+			JSONStatus: http.StatusForbidden,
+			JSONEnvelope: map[string]any{
+				"code":    "forbidden",
+				"message": "the request could not be verified as coming from Portunus itself (CSRF check failed)",
+			},
+		},
+		//validation errors (this bypasses the CSRF protection)
+		{
+			Method: http.MethodPost, Path: "/login", Form: url.Values{"user_ident": {"jane"}},
+			Handler:    errorHandlingMiddleware(postLoginHandler(nexus)),
+			HTMLStatus: http.StatusOK, HTMLBody: "must not be empty",
+			JSONStatus: http.StatusUnprocessableEntity,
+			JSONEnvelope: map[string]any{
+				"code":    "validation_failed",
+				"message": "the submitted values are not acceptable",
+				"fields":  []any{map[string]any{"field": "password", "message": "must not be empty"}},
+			},
+		},
+		//unknown routes
+		{
+			Method: http.MethodGet, Path: "/does-not-exist",
+			HTMLStatus: http.StatusNotFound, HTMLBody: "not found",
+			JSONStatus:   http.StatusNotFound,
+			JSONEnvelope: map[string]any{"code": "not_found", "message": "not found"},
+		},
+		{
+			Method: http.MethodGet, Path: "/self/sessions",
+			HTMLStatus: http.StatusMethodNotAllowed, HTMLBody: "method not allowed",
+			JSONStatus:   http.StatusMethodNotAllowed,
+			JSONEnvelope: map[string]any{"code": "method_not_allowed", "message": "method not allowed"},
+		},
+		//everything below /api/ always gets JSON
+		{
+			Method: http.MethodGet, Path: "/api/v1/users",
+			JSONStatus:   http.StatusNotFound,
+			JSONEnvelope: map[string]any{"code": "not_found", "message": "not found"},
+		},
+		//rate limiting
+		{
+			Method: http.MethodGet, Path: "/rate-limited",
+			Handler: errorHandlingMiddleware(Do(func(i *Interaction) {
+				i.Fail(errRateLimited(90*time.Second + time.Millisecond))
+			})),
+			HTMLStatus: http.StatusTooManyRequests, HTMLBody: "too many requests",
+			JSONStatus:   http.StatusTooManyRequests,
+			JSONEnvelope: map[string]any{"code": "rate_limited", "message": "too many requests", "retry_after": 91.0},
+			RetryAfter:   "91",
+		},
+		//panics do not leak their message
+		{
+			Method: http.MethodGet, Path: "/panic",
+			Handler: errorHandlingMiddleware(Do(func(i *Interaction) {
+				panic("secret")
+			})),
+			HTMLStatus: http.StatusInternalServerError, HTMLBody: "Internal Server Error (request ID: ",
+			JSONStatus:   http.StatusInternalServerError,
+			JSONEnvelope: map[string]any{"code": "internal_error"},
+		},
+	}
+	for _, tc := range testCases {
+		tc.run(t, handler)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	check := func(path, accept string, expected bool) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		assert.DeepEqual(t, "wantsJSON for "+path+" with Accept: "+accept, wantsJSON(req), expected)
+	}
+	check("/self", "", false)
+	check("/self", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false)
+	check("/self", "application/json", true)
+	check("/self", "text/plain, application/json; charset=utf-8", true)
+	check("/api/v1/users", "", true)
+	check("/apix", "", false)
+}
@@ -0,0 +1,122 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// This is set by HTTPHandler(). It is a package variable because the
+// navigation bar needs it on every page.
+var feedSync *core.FeedSync
+
+// Handles GET /feed-sync.
+func getFeedSyncHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(feedSyncView),
+	)
+}
+
+var feedSyncSnippet = h.NewSnippet(`
+	<p>
+		Users are imported from <code>{{.Config.URL}}</code> every {{.Config.Interval}}.
+		Users are created and updated, but never deleted: Users that have disappeared from the feed are listed as departures, and need to be offboarded by an admin.
+		{{if .Config.DryRun}}<strong>Dry-run mode is enabled</strong>, so changes are only reported, not applied.{{end}}
+	</p>
+	<p>
+		{{if .State.Paused}}
+			<strong>The sync is paused.</strong> The feed will not be fetched until the sync is resumed.
+		{{else}}
+			The sync is active.
+		{{end}}
+	</p>
+	{{.ToggleForm}}
+	{{range .State.Reports}}
+		<h2>Run started at {{.StartedAt.UTC.Format "2006-01-02 15:04:05"}} UTC{{if .DryRun}} (dry run){{end}}</h2>
+		{{if .Error}}
+			<p><strong>Failed:</strong> {{.Error}}</p>
+		{{else if .Unchanged}}
+			<p class="text-muted">Skipped because the feed did not change.</p>
+		{{else}}
+			<p>
+				Created: {{range $idx, $name := .Created}}{{if $idx}}, {{end}}<code>{{$name}}</code>{{else}}<span class="text-muted">none</span>{{end}}<br>
+				Updated: {{range $idx, $name := .Updated}}{{if $idx}}, {{end}}<code>{{$name}}</code>{{else}}<span class="text-muted">none</span>{{end}}<br>
+				Departures: {{range $idx, $name := .Departures}}{{if $idx}}, {{end}}<a href="/users/{{$name}}/offboard"><code>{{$name}}</code></a>{{else}}<span class="text-muted">none</span>{{end}}
+			</p>
+			{{if .RowErrors}}
+				<table class="table responsive">
+					<thead>
+						<tr>
+							<th>Line</th>
+							<th>Match key</th>
+							<th>Problem</th>
+						</tr>
+					</thead>
+					<tbody>
+						{{range .RowErrors}}
+							<tr>
+								<td data-label="Line">{{.Line}}</td>
+								<td data-label="Match key">{{if .MatchKey}}<code>{{.MatchKey}}</code>{{end}}</td>
+								<td data-label="Problem">{{.Message}}</td>
+							</tr>
+						{{end}}
+					</tbody>
+				</table>
+			{{end}}
+		{{end}}
+	{{else}}
+		<p class="text-muted">The feed has not been synced yet.</p>
+	{{end}}
+`)
+
+func feedSyncView(i *Interaction) Page {
+	state := feedSync.State()
+	toggleForm := h.FormSpec{PostTarget: "/feed-sync/pause", SubmitLabel: "Pause sync", IgnoresReadOnlyMode: true}
+	if state.Paused {
+		toggleForm = h.FormSpec{PostTarget: "/feed-sync/resume", SubmitLabel: "Resume sync", IgnoresReadOnlyMode: true}
+	}
+	return Page{
+		Status: http.StatusOK,
+		Title:  "Feed sync",
+		Contents: feedSyncSnippet.Render(struct {
+			Config     core.FeedConfig
+			State      core.FeedSyncState
+			ToggleForm template.HTML
+		}{feedSync.Config(), state, toggleForm.Render(i.Req, h.FormState{})}),
+		Wide: true,
+	}
+}
+
+// Handles POST /feed-sync/pause and POST /feed-sync/resume.
+func postFeedSyncToggleHandler(n core.Nexus, paused bool) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			err := feedSync.SetPaused(paused)
+			if err != nil {
+				i.RedirectWithFlashTo("/feed-sync", Flash{"danger", err.Error()})
+				return
+			}
+			msg := "Feed sync resumed."
+			if paused {
+				msg = "Feed sync paused."
+			}
+			logging.Info(logging.Fields{"event": "feed_sync", "actor": i.CurrentUser.LoginName}, "%s", msg)
+			i.RedirectWithFlashTo("/feed-sync", Flash{"success", msg})
+		},
+	)
+}
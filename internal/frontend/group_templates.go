@@ -0,0 +1,165 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+func getGroupTemplatesHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(groupTemplatesList(n)),
+	)
+}
+
+var groupTemplatesListSnippet = h.NewSnippet(`
+	{{- if .Templates }}
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Name</th>
+					<th>Description</th>
+					<th>Long name prefix</th>
+					<th>Permissions granted</th>
+					<th class="actions"></th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Templates}}
+					<tr>
+						<td data-label="Name"><code>{{.Template.Name}}</code></td>
+						<td data-label="Description">{{.Template.Description}}</td>
+						{{ if .Template.LongNamePrefix -}}
+							<td data-label="Long name prefix">{{.Template.LongNamePrefix}}</td>
+						{{- else -}}
+							<td data-label="Long name prefix" class="text-muted">None</td>
+						{{- end }}
+						<td data-label="Permissions granted">{{.PermissionsText}}</td>
+						<td class="actions">
+							<a href="/groups/new?template={{urlquery .Template.Name}}">Create group</a>
+						</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{- else }}
+		<p class="text-muted">
+			No group templates are defined. Group templates can be declared in the
+			<code>group_templates</code> section of the primary seed.
+		</p>
+	{{- end }}
+`)
+
+func groupTemplatesList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		type templateItem struct {
+			Template        core.GroupTemplate
+			PermissionsText string
+		}
+		var data []templateItem
+		for _, t := range n.GroupTemplates() {
+			data = append(data, templateItem{
+				Template:        t,
+				PermissionsText: describePermissions(t.Permissions),
+			})
+		}
+
+		return Page{
+			Status: http.StatusOK,
+			Title:  "Group templates",
+			Contents: groupTemplatesListSnippet.Render(struct {
+				Templates []templateItem
+			}{data}),
+			Wide: true,
+		}
+	}
+}
+
+// Pre-fills the form for a new group from the template selected with the
+// `template` query parameter, if any. The choice of template is not recorded
+// anywhere; it only serves as a starting point for filling out the form.
+func applyGroupTemplate(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		templateName := i.Req.URL.Query().Get("template")
+		if templateName == "" {
+			return
+		}
+		for _, t := range n.GroupTemplates() {
+			if t.Name != templateName {
+				continue
+			}
+			i.FormState.Fields["portunus_perms"] = &h.FieldState{
+				Selected: map[string]bool{
+					"is_admin":   t.Permissions.Portunus.IsAdmin,
+					"can_view":   t.Permissions.Portunus.CanView,
+					"can_browse": t.Permissions.Portunus.CanBrowse,
+				},
+			}
+			i.FormState.Fields["ldap_perms"] = &h.FieldState{
+				Selected: map[string]bool{
+					"can_read": t.Permissions.LDAP.CanRead,
+				},
+			}
+			if t.LongNamePrefix != "" {
+				i.FormState.Fields["long_name"] = &h.FieldState{Value: t.LongNamePrefix + " "}
+			}
+			return
+		}
+		msg := fmt.Sprintf("Group template %q does not exist.", templateName)
+		i.RedirectWithFlashTo("/groups/new", Flash{"danger", msg})
+	}
+}
+
+var groupTemplateChooserSnippet = h.NewSnippet(`
+	<form method="GET" action="/groups/new">
+		<div class="form-row">
+			<label for="template">Start from template</label>
+			<select name="template" id="template" class="row-input">
+				<option value="">No template</option>
+				{{- range .Templates }}
+					<option value="{{.Name}}" {{- if eq .Name $.Selected }} selected{{ end }}>
+						{{- .Name }}{{ if .Description }} ({{ .Description }}){{ end -}}
+					</option>
+				{{- end }}
+			</select>
+		</div>
+		<div class="button-row">
+			<button type="submit" class="button button-secondary">Apply template</button>
+		</div>
+	</form>
+`)
+
+// Like ShowForm("Create group"), but also renders a chooser for the group
+// templates above the form if there are any.
+func showGroupsNewForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if reportFormErrorsAsJSON(i) {
+			return
+		}
+		var chooser template.HTML
+		if templates := n.GroupTemplates(); len(templates) > 0 {
+			chooser = groupTemplateChooserSnippet.Render(struct {
+				Templates []core.GroupTemplate
+				Selected  string
+			}{templates, i.Req.URL.Query().Get("template")})
+		}
+		Page{
+			Status:   http.StatusOK,
+			Title:    "Create group",
+			Contents: chooser + i.FormSpec.Render(i.Req, *i.FormState),
+		}.Render(i.writer, i.Req, i.CurrentUser, i.Session)
+		i.writer = nil
+	}
+}
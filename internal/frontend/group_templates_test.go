@@ -0,0 +1,95 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestGroupTemplates(t *testing.T) {
+	useFreshSessionTracker(t)
+	seed := &core.DatabaseSeed{
+		GroupTemplates: []core.GroupTemplate{{
+			Name:           "team",
+			Description:    "Regular team",
+			LongNamePrefix: "Team",
+			Permissions: core.Permissions{
+				Portunus: core.PortunusPermissions{CanBrowse: true},
+				LDAP:     core.LDAPPermissions{CanRead: true},
+			},
+		}},
+	}
+	nexus := core.NewNexus(seed, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"}}
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	devices, err := store.NewDeviceStore(filepath.Join(t.TempDir(), "devices.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := HTTPHandler(nexus, false, nil, nil, nil, devices, nil, nil, nil, nil, nil, nil, nil, nil)
+
+	isChecked := func(body, value string) bool {
+		return regexp.MustCompile(`value="` + value + `"\s+checked`).MatchString(body)
+	}
+
+	cookie := loginCookieForTests(t, "jane")
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//the templates are listed on their own page, which is linked from the group list
+	body := get("/groups").Body.String()
+	assert.DeepEqual(t, "group list links to templates", strings.Contains(body, `href="/groups/templates"`), true)
+	body = get("/groups/templates").Body.String()
+	assert.DeepEqual(t, "template is listed", strings.Contains(body, `<code>team</code>`), true)
+	assert.DeepEqual(t, "template permissions are listed", strings.Contains(body, "Portunus directory access, LDAP read access"), true)
+
+	//without a template, the form for a new group is empty
+	body = get("/groups/new").Body.String()
+	assert.DeepEqual(t, "template chooser is shown", strings.Contains(body, `<option value="team">team (Regular team)</option>`), true)
+	assert.DeepEqual(t, "permissions are not preselected", isChecked(body, "can_read"), false)
+
+	//choosing a template fills in the permissions and the long name prefix
+	body = get("/groups/new?template=team").Body.String()
+	assert.DeepEqual(t, "template is selected in chooser", strings.Contains(body, `<option value="team" selected>`), true)
+	assert.DeepEqual(t, "LDAP permission is preselected", isChecked(body, "can_read"), true)
+	assert.DeepEqual(t, "Portunus permission is preselected", isChecked(body, "can_browse"), true)
+	assert.DeepEqual(t, "admin permission is not preselected", isChecked(body, "is_admin"), false)
+	assert.DeepEqual(t, "long name is prefilled", strings.Contains(body, `value="Team "`), true)
+
+	//unknown templates are reported
+	rec := get("/groups/new?template=unknown")
+	assert.DeepEqual(t, "status for unknown template", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect for unknown template", rec.Header().Get("Location"), "/groups/new")
+}
@@ -8,8 +8,10 @@ package frontend
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -23,7 +25,7 @@ func getGroupsHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		VerifyPermissions(adminPerms),
+		VerifyPermissions(viewerPerms),
 		ShowView(groupsList(n)),
 	)
 }
@@ -34,19 +36,30 @@ var groupsListSnippet = h.NewSnippet(`
 			<tr>
 				<th>Name</th>
 				<th>Long name</th>
+				<th>Description</th>
 				<th>POSIX ID</th>
 				<th>Members</th>
 				<th>Permissions granted</th>
 				<th class="actions">
-					<a href="/groups/new" class="button button-primary">New group</a>
+					{{- if .CanEdit }}
+						<a href="/groups/new" class="button button-primary">New group</a>
+						{{- if .HasTemplates }}
+							<a href="/groups/templates" class="button button-secondary">Templates</a>
+						{{- end }}
+					{{- end }}
 				</th>
 			</tr>
 		</thead>
 		<tbody>
-			{{range .}}
+			{{range .Groups}}
 				<tr>
 					<td data-label="Name"><code>{{.Group.Name}}</code></td>
 					<td data-label="Long name">{{.Group.LongName}}</td>
+					{{ if eq .DescriptionSummary .Group.Description -}}
+						<td data-label="Description">{{.Group.Description}}</td>
+					{{- else -}}
+						<td data-label="Description" title="{{.Group.Description}}">{{.DescriptionSummary}}</td>
+					{{- end }}
 					{{ if .Group.PosixGID -}}
 						<td data-label="POSIX ID">{{.Group.PosixGID}}</td>
 					{{- else -}}
@@ -55,9 +68,15 @@ var groupsListSnippet = h.NewSnippet(`
 					<td data-label="Members">{{.MemberCount}}</td>
 					<td data-label="Permissions granted">{{.PermissionsText}}</td>
 					<td class="actions">
-						<a href="/groups/{{.Group.Name}}/edit">Edit</a>
-						·
-						<a href="/groups/{{.Group.Name}}/delete">Delete</a>
+						{{- if $.CanEdit }}
+							<a href="/groups/{{.Group.Name}}/edit">Edit</a>
+							·
+							<a href="/groups/{{.Group.Name}}/rename">Rename</a>
+							·
+							<a href="/groups/{{.Group.Name}}/delete">Delete</a>
+						{{- else }}
+							<a href="/groups/{{.Group.Name}}/edit">View</a>
+						{{- end }}
 					</td>
 				</tr>
 			{{end}}
@@ -66,47 +85,76 @@ var groupsListSnippet = h.NewSnippet(`
 `)
 
 func groupsList(n core.Nexus) func(*Interaction) Page {
-	return func(_ *Interaction) Page {
+	return func(i *Interaction) Page {
 		groups := n.ListGroups()
-		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		collationFor(i.Req).SortGroups(groups)
 
 		type groupItem struct {
-			Group           core.Group
-			MemberCount     int
-			PermissionsText string
+			Group              core.Group
+			DescriptionSummary string
+			MemberCount        int
+			PermissionsText    string
 		}
 		data := make([]groupItem, len(groups))
 		for idx, group := range groups {
 			item := groupItem{
-				Group:       group,
-				MemberCount: len(group.MemberLoginNames),
-			}
-
-			var permTexts []string
-			if group.Permissions.Portunus.IsAdmin {
-				permTexts = append(permTexts, "Portunus admin")
-			}
-			if group.Permissions.LDAP.CanRead {
-				permTexts = append(permTexts, "LDAP read access")
+				Group:              group,
+				DescriptionSummary: summarizeDescription(group.Description),
+				MemberCount:        len(group.MemberLoginNames),
+				PermissionsText:    describePermissions(group.Permissions),
 			}
-
-			if len(permTexts) == 0 {
-				permTexts = []string{"None"}
-			}
-			item.PermissionsText = strings.Join(permTexts, ", ")
-
 			data[idx] = item
 		}
 
 		return Page{
-			Status:   http.StatusOK,
-			Title:    "Groups",
-			Contents: groupsListSnippet.Render(data),
-			Wide:     true,
+			Status: http.StatusOK,
+			Title:  "Groups",
+			Contents: groupsListSnippet.Render(struct {
+				Groups       []groupItem
+				CanEdit      bool
+				HasTemplates bool
+			}{data, canEdit(i), len(n.GroupTemplates()) > 0}),
+			Wide: true,
 		}
 	}
 }
 
+// Returns a short summary of the given permissions for use in list views.
+func describePermissions(perms core.Permissions) string {
+	var permTexts []string
+	if perms.Portunus.IsAdmin {
+		permTexts = append(permTexts, "Portunus admin")
+	} else if perms.Portunus.CanView {
+		permTexts = append(permTexts, "Portunus view access")
+	} else if perms.Portunus.CanBrowse {
+		permTexts = append(permTexts, "Portunus directory access")
+	}
+	if perms.LDAP.CanRead {
+		permTexts = append(permTexts, "LDAP read access")
+	}
+
+	if len(permTexts) == 0 {
+		return "None"
+	}
+	return strings.Join(permTexts, ", ")
+}
+
+// The group list only has room for one line of the description. The full text
+// is shown as a tooltip.
+const maxDescriptionSummaryLength = 80
+
+func summarizeDescription(description string) string {
+	summary, _, _ := strings.Cut(description, "\n")
+	summary = strings.TrimSpace(summary)
+	if runes := []rune(summary); len(runes) > maxDescriptionSummaryLength {
+		summary = strings.TrimSpace(string(runes[:maxDescriptionSummaryLength]))
+	}
+	if summary != description {
+		summary += "…"
+	}
+	return summary
+}
+
 func useGroupForm(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		i.FormState = &h.FormState{
@@ -117,7 +165,8 @@ func useGroupForm(n core.Nexus) HandlerStep {
 				buildGroupMasterdataFieldset(i.TargetGroup, i.FormState),
 				buildGroupPermissionsFieldset(i.TargetGroup, i.FormState),
 				buildGroupPosixFieldset(i.TargetGroup, i.FormState),
-				buildGroupMemberFieldset(n, i.TargetGroup, i.FormState),
+				buildGroupElevationFieldset(i.TargetGroup, i.FormState),
+				buildGroupMemberFieldset(n, i.TargetGroup, i.FormState, collationFor(i.Req)),
 			},
 		}
 
@@ -127,6 +176,20 @@ func useGroupForm(n core.Nexus) HandlerStep {
 		} else {
 			i.FormSpec.PostTarget = "/groups/" + i.TargetGroup.Name + "/edit"
 			i.FormSpec.SubmitLabel = "Save"
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.HiddenFieldSpec{Name: "revision"})
+			i.FormState.Fields["revision"] = &h.FieldState{Value: core.GroupRevision(*i.TargetGroup)}
+		}
+		if !canEdit(i) {
+			readOnlySpec := i.FormSpec.AsReadOnly()
+			i.FormSpec = &readOnlySpec
+		} else if i.TargetGroup != nil {
+			buttons := []h.FormField{
+				h.StaticField{Value: renameGroupButtonSnippet.Render(i.TargetGroup.Name)},
+			}
+			if undoButton := buildUndoButton(n, i.TargetRef); undoButton != nil {
+				buttons = append(buttons, undoButton)
+			}
+			i.FormSpec.Fields = append(buttons, i.FormSpec.Fields...)
 		}
 	}
 }
@@ -145,6 +208,13 @@ func buildGroupMasterdataFieldset(g *core.Group, state *h.FormState) h.FormField
 			Value: codeTagSnippet.Render(g.Name),
 		}
 		state.Fields["long_name"] = &h.FieldState{Value: g.LongName}
+		state.Fields["description"] = &h.FieldState{Value: g.Description}
+		state.Fields["url"] = &h.FieldState{Value: g.URL}
+		state.Fields["member_of"] = &h.FieldState{
+			Selected: map[string]bool{
+				"hide": g.HideFromMemberOf,
+			},
+		}
 	}
 
 	return h.FieldSet{
@@ -157,6 +227,25 @@ func buildGroupMasterdataFieldset(g *core.Group, state *h.FormState) h.FormField
 				Name:      "long_name",
 				Label:     "Long name",
 			},
+			h.MultilineInputFieldSpec{
+				Name:  "description",
+				Label: "Description (optional)",
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "url",
+				Label:     "Documentation URL (optional)",
+			},
+			h.SelectFieldSpec{
+				Name:  "member_of",
+				Label: "Visibility in LDAP",
+				Options: []h.SelectOptionSpec{
+					{
+						Value: "hide",
+						Label: "Do not list this group in the isMemberOf attribute of its members",
+					},
+				},
+			},
 		},
 	}
 }
@@ -165,7 +254,9 @@ func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormFiel
 	if g != nil {
 		state.Fields["portunus_perms"] = &h.FieldState{
 			Selected: map[string]bool{
-				"is_admin": g.Permissions.Portunus.IsAdmin,
+				"is_admin":   g.Permissions.Portunus.IsAdmin,
+				"can_view":   g.Permissions.Portunus.CanView,
+				"can_browse": g.Permissions.Portunus.CanBrowse,
 			},
 		}
 		state.Fields["ldap_perms"] = &h.FieldState{
@@ -187,6 +278,14 @@ func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormFiel
 						Value: "is_admin",
 						Label: "Admin access",
 					},
+					{
+						Value: "can_view",
+						Label: "View access to users and groups",
+					},
+					{
+						Value: "can_browse",
+						Label: "Access to the people directory",
+					},
 				},
 			},
 			h.SelectFieldSpec{
@@ -203,17 +302,17 @@ func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormFiel
 	}
 }
 
-func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState) h.FormField {
+func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState, coll *core.Collation) h.FormField {
 	allUsers := n.ListUsers()
 	sort.Slice(allUsers, func(i, j int) bool {
-		return allUsers[i].LoginName < allUsers[j].LoginName
+		return coll.CompareStrings(allUsers[i].LoginName, allUsers[j].LoginName) < 0
 	})
 	var memberOpts []h.SelectOptionSpec
 	isUserSelected := make(map[string]bool)
 	for _, user := range allUsers {
 		memberOpts = append(memberOpts, h.SelectOptionSpec{
 			Value: user.LoginName,
-			Label: user.LoginName,
+			Label: fmt.Sprintf("%s (%s)", user.LoginName, user.FullName()),
 		})
 		if g != nil {
 			isUserSelected[user.LoginName] = g.ContainsUser(user)
@@ -221,12 +320,18 @@ func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState) h
 	}
 	if g != nil {
 		state.Fields["members"] = &h.FieldState{Selected: isUserSelected}
+		state.Fields["owners"] = &h.FieldState{Value: strings.Join(g.Owners, " ")}
 	}
 
 	return h.FieldSet{
 		Label:      "Users",
 		IsFoldable: false,
 		Fields: []h.FormField{
+			h.InputFieldSpec{
+				Name:      "owners",
+				Label:     "Owners, i.e. contacts for users who want to join (login names separated by spaces; optional)",
+				InputType: "text",
+			},
 			h.SelectFieldSpec{
 				Name:    "members",
 				Label:   "Members of this Group",
@@ -236,6 +341,36 @@ func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState) h
 	}
 }
 
+type groupOwnerContact struct {
+	LoginName    string
+	FullName     string
+	EMailAddress string
+}
+
+// Returns the owners of the given group, as far as they can be found.
+func listGroupOwnerContacts(n core.Nexus, g core.Group) (result []groupOwnerContact) {
+	for _, loginName := range g.Owners {
+		user, exists := n.FindUser(func(u core.User) bool { return u.LoginName == loginName })
+		if exists {
+			result = append(result, groupOwnerContact{loginName, user.FullName(), user.EMailAddress})
+		}
+	}
+	return result
+}
+
+var groupOwnerContactsSnippet = h.NewSnippet(`
+	<span class="comma-separated-list">
+		{{- range . -}}
+			{{- if .EMailAddress -}}
+				<a href="mailto:{{.EMailAddress}}">{{.FullName}}</a>
+			{{- else -}}
+				{{.FullName}}
+			{{- end -}}
+			<span class="comma">,&nbsp;</span>
+		{{- end -}}
+	</span>
+`)
+
 func buildGroupPosixFieldset(g *core.Group, state *h.FormState) h.FormField {
 	if g != nil && g.PosixGID != nil {
 		state.Fields["posix"] = &h.FieldState{IsUnfolded: true}
@@ -256,18 +391,50 @@ func buildGroupPosixFieldset(g *core.Group, state *h.FormState) h.FormField {
 	}
 }
 
-func getGroupEditHandler(n core.Nexus) http.Handler {
+func buildGroupElevationFieldset(g *core.Group, state *h.FormState) h.FormField {
+	if g != nil && g.Elevation != nil {
+		state.Fields["elevation"] = &h.FieldState{IsUnfolded: true}
+		state.Fields["elevation_approver_group"] = &h.FieldState{Value: g.Elevation.ApproverGroupName}
+		state.Fields["elevation_max_hours"] = &h.FieldState{Value: strconv.FormatUint(uint64(g.Elevation.MaxHours), 10)}
+		state.Fields["elevation_required_approvals"] = &h.FieldState{Value: strconv.FormatUint(uint64(g.Elevation.RequiredApprovals), 10)}
+	}
+
+	return h.FieldSet{
+		Name:       "elevation",
+		Label:      "Allows temporary membership on request",
+		IsFoldable: true,
+		Fields: []h.FormField{
+			h.InputFieldSpec{
+				Name:      "elevation_approver_group",
+				Label:     "Name of group whose members approve requests",
+				InputType: "text",
+			},
+			h.InputFieldSpec{
+				Name:      "elevation_max_hours",
+				Label:     "Maximum duration (in hours)",
+				InputType: "text",
+			},
+			h.InputFieldSpec{
+				Name:      "elevation_required_approvals",
+				Label:     "Required number of approvals (at least 2 if the group grants admin access)",
+				InputType: "text",
+			},
+		},
+	}
+}
+
+func getGroupEditHandler(n core.Nexus, activityLog core.ActivityLog) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		VerifyPermissions(adminPerms),
+		VerifyPermissions(viewerPerms),
 		loadTargetGroup(n),
 		useGroupForm(n),
-		ShowForm("Edit group"),
+		showGroupEditPage(n, activityLog),
 	)
 }
 
-func postGroupEditHandler(n core.Nexus) http.Handler {
+func postGroupEditHandler(n core.Nexus, activityLog core.ActivityLog) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
@@ -275,12 +442,83 @@ func postGroupEditHandler(n core.Nexus) http.Handler {
 		loadTargetGroup(n),
 		useGroupForm(n),
 		ReadFormStateFromRequest,
-		TryUpdateNexus(n, executeEditGroup),
-		ShowFormIfErrors("Edit group"),
-		RedirectWithFlashTo("/groups", "Updated"),
+		TryUpdateNexus(n, undoable(executeEditGroup)),
+		ReloadFormAfterConcurrentModification(loadTargetGroup(n), useGroupForm(n)),
+		func(i *Interaction) {
+			if !i.FormState.IsValid() {
+				showGroupEditPage(n, activityLog)(i)
+			}
+		},
+		redirectAfterUndoableEdit("/groups"),
 	)
 }
 
+var groupOwnersSnippet = h.NewSnippet(`
+	{{- with . }}
+		<h2>Owners</h2>
+		<p>If you want to join this group or have questions about it, please contact its owners: {{.}}</p>
+	{{- end }}
+`)
+
+var groupActivitySnippet = h.NewSnippet(`
+	<h2>Recent membership changes</h2>
+	{{if .}}
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Time</th>
+					<th>User</th>
+					<th>Change</th>
+					<th>Changed by</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .}}
+					<tr>
+						<td data-label="Time">{{.Time.UTC.Format "2006-01-02 15:04:05"}} UTC</td>
+						<td data-label="User"><code>{{.LoginName}}</code></td>
+						<td data-label="Change">{{.Kind}}{{if .Reason}} ({{.Reason}}){{end}}</td>
+						{{ if .Actor -}}
+							<td data-label="Changed by"><code>{{.Actor}}</code></td>
+						{{- else if .Reason -}}
+							<td data-label="Changed by" class="text-muted">Portunus</td>
+						{{- else -}}
+							<td data-label="Changed by" class="text-muted">Seed or database file</td>
+						{{- end }}
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{else}}
+		<p class="text-muted">No membership changes have been recorded for this group yet.</p>
+	{{end}}
+`)
+
+// Like ShowEditOrViewForm("Edit group", "Group details"), but also renders the
+// owners and the recent membership changes of the group below the form.
+func showGroupEditPage(n core.Nexus, activityLog core.ActivityLog) HandlerStep {
+	return func(i *Interaction) {
+		if reportFormErrorsAsJSON(i) {
+			return
+		}
+		title := "Edit group"
+		if i.FormSpec.ReadOnly {
+			title = "Group details"
+		}
+		var owners template.HTML
+		if contacts := listGroupOwnerContacts(n, *i.TargetGroup); len(contacts) > 0 {
+			owners = groupOwnerContactsSnippet.Render(contacts)
+		}
+		activity := activityLog.ListForGroup(i.TargetGroup.Name)
+		Page{
+			Status:   http.StatusOK,
+			Title:    title,
+			Contents: i.FormSpec.Render(i.Req, *i.FormState) + groupOwnersSnippet.Render(owners) + groupActivitySnippet.Render(activity),
+		}.Render(i.writer, i.Req, i.CurrentUser, i.Session)
+		i.writer = nil
+	}
+}
+
 func loadTargetGroup(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		groupName := mux.Vars(i.Req)["name"]
@@ -299,26 +537,60 @@ func buildGroupFromFormState(fs *h.FormState, name string) (result core.Group, e
 	result = core.Group{
 		Name:             name,
 		LongName:         fs.Fields["long_name"].Value,
+		Description:      strings.ReplaceAll(fs.Fields["description"].Value, "\r\n", "\n"),
+		URL:              fs.Fields["url"].Value,
 		MemberLoginNames: fs.Fields["members"].Selected,
 		Permissions: core.Permissions{
 			Portunus: core.PortunusPermissions{
-				IsAdmin: fs.Fields["portunus_perms"].Selected["is_admin"],
+				IsAdmin:   fs.Fields["portunus_perms"].Selected["is_admin"],
+				CanView:   fs.Fields["portunus_perms"].Selected["can_view"],
+				CanBrowse: fs.Fields["portunus_perms"].Selected["can_browse"],
 			},
 			LDAP: core.LDAPPermissions{
 				CanRead: fs.Fields["ldap_perms"].Selected["can_read"],
 			},
 		},
-		PosixGID: nil,
+		PosixGID:         nil,
+		HideFromMemberOf: fs.Fields["member_of"].Selected["hide"],
+		Owners:           strings.Fields(fs.Fields["owners"].Value),
 	}
 	if fs.Fields["posix"].IsUnfolded {
 		gid, err := core.ParsePosixID(fs.Fields["posix_gid"].Value, result.Ref().Field("posix_gid"))
 		result.PosixGID = &gid
 		errs.Add(err)
 	}
+	if fs.Fields["elevation"].IsUnfolded {
+		ref := result.Ref()
+		maxHours, err := core.ParseNonnegativeInteger(fs.Fields["elevation_max_hours"].Value, ref.Field("elevation_max_hours"))
+		errs.Add(err)
+		requiredApprovals, err := core.ParseNonnegativeInteger(fs.Fields["elevation_required_approvals"].Value, ref.Field("elevation_required_approvals"))
+		errs.Add(err)
+		result.Elevation = &core.ElevationPolicy{
+			ApproverGroupName: strings.TrimSpace(fs.Fields["elevation_approver_group"].Value),
+			MaxHours:          maxHours,
+			RequiredApprovals: requiredApprovals,
+		}
+	}
 	return
 }
 
+// Like verifyUserRevision, but for groups.
+func verifyGroupRevision(db *core.Database, i *Interaction) error {
+	expected := i.FormState.Fields["revision"].Value
+	if expected == "" {
+		return nil //form was rendered before revisions were introduced
+	}
+	group, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == i.TargetGroup.Name })
+	if !exists || core.GroupRevision(group) != expected {
+		return core.ErrConcurrentModification
+	}
+	return nil
+}
+
 func executeEditGroup(db *core.Database, i *Interaction, _ crypt.PasswordHasher) errext.ErrorSet {
+	if err := verifyGroupRevision(db, i); err != nil {
+		return errext.ErrorSet{err}
+	}
 	newGroup, errs := buildGroupFromFormState(i.FormState, i.TargetGroup.Name)
 	errs.Add(db.Groups.Update(newGroup))
 	return errs
@@ -330,7 +602,8 @@ func getGroupsNewHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		useGroupForm(n),
-		ShowForm("Create group"),
+		applyGroupTemplate(n),
+		showGroupsNewForm(n),
 	)
 }
 
@@ -361,25 +634,66 @@ func getGroupDeleteHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetGroup(n),
-		useDeleteGroupForm,
+		useDeleteGroupForm(n),
 		UseEmptyFormState,
 		ShowForm("Confirm group deletion"),
 	)
 }
 
 var deleteGroupConfirmSnippet = h.NewSnippet(`
-	<p>Really delete group <code>{{.}}</code>? This cannot be undone.</p>
+	<p>Really delete group <code>{{.Name}}</code>? This cannot be undone.</p>
+	{{- with .Impact.LosingAdminAccess }}
+		<p>
+			{{len .}} member(s) will lose admin access to Portunus:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
+	{{- with .Impact.LosingLDAPAccess }}
+		<p>
+			{{len .}} member(s) will lose read access to LDAP:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
 `)
 
-func useDeleteGroupForm(i *Interaction) {
-	i.FormSpec = &h.FormSpec{
-		PostTarget:  "/groups/" + i.TargetGroup.Name + "/delete",
-		SubmitLabel: "Delete group",
-		Fields: []h.FormField{
-			h.StaticField{
-				Value: deleteGroupConfirmSnippet.Render(i.TargetGroup.Name),
+func useDeleteGroupForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		//a no-op update is the only way to look at the entire database at once
+		var impact core.GroupDeletionImpact
+		errs := n.Update(func(db *core.Database) errext.ErrorSet {
+			impact = db.ImpactOfGroupDeletion(i.TargetGroup.Name)
+			return nil
+		}, &core.UpdateOptions{DryRun: true})
+		if !errs.IsEmpty() {
+			i.RedirectWithFlashTo("/groups", Flash{"danger", errs.Join(", ")})
+			return
+		}
+		if impact.LocksOutAllAdmins() {
+			msg := fmt.Sprintf("Group %q cannot be deleted because no user would have admin access to Portunus afterwards.", i.TargetGroup.Name)
+			i.RedirectWithFlashTo("/groups", Flash{"danger", msg})
+			return
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/groups/" + i.TargetGroup.Name + "/delete",
+			SubmitLabel: "Delete group",
+			Fields: []h.FormField{
+				h.StaticField{
+					Value: deleteGroupConfirmSnippet.Render(struct {
+						Name   string
+						Impact core.GroupDeletionImpact
+					}{i.TargetGroup.Name, impact}),
+				},
 			},
-		},
+		}
 	}
 }
 
@@ -389,8 +703,8 @@ func postGroupDeleteHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetGroup(n),
-		useDeleteGroupForm,
-		UseEmptyFormState,
+		useDeleteGroupForm(n),
+		ReadFormStateFromRequest,
 		TryUpdateNexus(n, executeDeleteGroup),
 		ShowFormIfErrors("Confirm group deletion"),
 		RedirectWithFlashTo("/groups", "Deleted"),
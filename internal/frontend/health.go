@@ -0,0 +1,138 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// Handles GET /healthz. This is a liveness check: As long as the process can
+// serve HTTP requests, it is considered alive.
+func getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+type readinessReport struct {
+	Ready bool `json:"ready"`
+	//key = component name, value = error message
+	Problems map[string]string `json:"problems,omitempty"`
+}
+
+// Handles GET /readyz. This is a readiness check that reports whether all
+// components are working normally.
+func getReadyzHandler(healthChecks map[string]core.HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := readinessReport{Ready: true}
+		for name, check := range healthChecks {
+			err := check.CheckHealth()
+			if err != nil {
+				if report.Problems == nil {
+					report.Problems = make(map[string]string)
+				}
+				report.Problems[name] = err.Error()
+				report.Ready = false
+			}
+		}
+
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		buf, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(append(buf, '\n'))
+	})
+}
+
+// Handles GET /metrics. This reports values that are useful for alerting in
+// the Prometheus text format.
+func getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if info, ok := ldapCertificate.Get(); ok {
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_tls_certificate_expiry_timestamp_seconds When the TLS certificate presented by the LDAP server expires.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_tls_certificate_expiry_timestamp_seconds gauge")
+		fmt.Fprintf(&buf, "portunus_ldap_tls_certificate_expiry_timestamp_seconds %d\n", info.NotAfter.Unix())
+	}
+	if seedCorrections != nil {
+		//only aggregates are reported since /metrics is not authenticated, and
+		//object names would reveal login names; the details are on the "Seed
+		//corrections" page in the web GUI
+		correctionCounts := make(map[string]uint64)
+		fightingCounts := make(map[string]int)
+		for _, s := range seedCorrections.List(time.Now()) {
+			correctionCounts[s.Object.Type] += s.Total
+			if s.IsFighting {
+				fightingCounts[s.Object.Type]++
+			}
+		}
+		objectTypes := make([]string, 0, len(correctionCounts))
+		for objectType := range correctionCounts {
+			objectTypes = append(objectTypes, objectType)
+		}
+		sort.Strings(objectTypes)
+		fmt.Fprintln(&buf, "# HELP portunus_seed_corrections_total How often the seed reverted changes to objects of this type since startup.")
+		fmt.Fprintln(&buf, "# TYPE portunus_seed_corrections_total counter")
+		for _, objectType := range objectTypes {
+			fmt.Fprintf(&buf, "portunus_seed_corrections_total{object_type=%q} %d\n", objectType, correctionCounts[objectType])
+		}
+		fmt.Fprintln(&buf, "# HELP portunus_seed_fighting_objects How many objects of this type the seed had to correct more often than PORTUNUS_SERVER_SEED_FIGHT_THRESHOLD within PORTUNUS_SERVER_SEED_FIGHT_WINDOW.")
+		fmt.Fprintln(&buf, "# TYPE portunus_seed_fighting_objects gauge")
+		for _, objectType := range objectTypes {
+			fmt.Fprintf(&buf, "portunus_seed_fighting_objects{object_type=%q} %d\n", objectType, fightingCounts[objectType])
+		}
+	}
+	if ldapAdapter != nil {
+		stats := ldapAdapter.SyncStats()
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_sync_pending_operations How many write operations are left in the LDAP sync that is currently running.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_sync_pending_operations gauge")
+		fmt.Fprintf(&buf, "portunus_ldap_sync_pending_operations %d\n", stats.PendingOperations)
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_sync_queue_depth How many database snapshots are waiting to be synced into LDAP.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_sync_queue_depth gauge")
+		fmt.Fprintf(&buf, "portunus_ldap_sync_queue_depth %d\n", stats.QueueDepth)
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_last_sync_duration_seconds How long the most recent LDAP sync took.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_last_sync_duration_seconds gauge")
+		fmt.Fprintf(&buf, "portunus_ldap_last_sync_duration_seconds %g\n", stats.LastSyncDuration.Seconds())
+
+		errorCounts := ldapAdapter.SyncErrorCounts()
+		failingCounts := make(map[string]int, len(errorCounts))
+		for _, s := range ldapAdapter.FailingEntities() {
+			failingCounts[s.EntityType]++
+		}
+		entityTypes := make([]string, 0, len(errorCounts))
+		for entityType := range errorCounts {
+			entityTypes = append(entityTypes, entityType)
+		}
+		sort.Strings(entityTypes)
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_sync_errors_total How many LDAP write operations were rejected by the LDAP server since startup.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_sync_errors_total counter")
+		for _, entityType := range entityTypes {
+			fmt.Fprintf(&buf, "portunus_ldap_sync_errors_total{entity_type=%q} %d\n", entityType, errorCounts[entityType])
+		}
+		fmt.Fprintln(&buf, "# HELP portunus_ldap_sync_failing_entities How many LDAP objects are out of sync because their most recent write operation was rejected.")
+		fmt.Fprintln(&buf, "# TYPE portunus_ldap_sync_failing_entities gauge")
+		for _, entityType := range entityTypes {
+			fmt.Fprintf(&buf, "portunus_ldap_sync_failing_entities{entity_type=%q} %d\n", entityType, failingCounts[entityType])
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,54 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestMetricsForSeedCorrections(t *testing.T) {
+	oldTracker := seedCorrections
+	t.Cleanup(func() { seedCorrections = oldTracker })
+	seedCorrections = core.NewSeedCorrectionTracker(2, time.Hour)
+
+	now := time.Now()
+	jane := core.User{LoginName: "jane"}.Ref()
+	john := core.User{LoginName: "john"}.Ref()
+	admins := core.Group{Name: "admins"}.Ref()
+	seedCorrections.Record([]core.SeedCorrection{
+		{Object: jane, Field: "given_name", Time: now},
+		{Object: jane, Field: "given_name", Time: now},
+		{Object: jane, Field: "given_name", Time: now},
+		{Object: john, Field: "email", Time: now},
+		{Object: admins, Field: "long_name", Time: now},
+	})
+
+	rec := httptest.NewRecorder()
+	getMetricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	assert.DeepEqual(t, "status of /metrics", rec.Code, http.StatusOK)
+	var lines []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "portunus_seed_") {
+			lines = append(lines, line)
+		}
+	}
+
+	//since /metrics is not authenticated, only aggregates by object type are reported
+	assert.DeepEqual(t, "seed correction metrics", lines, []string{
+		`portunus_seed_corrections_total{object_type="group"} 1`,
+		`portunus_seed_corrections_total{object_type="user"} 4`,
+		`portunus_seed_fighting_objects{object_type="group"} 0`,
+		`portunus_seed_fighting_objects{object_type="user"} 1`,
+	})
+}
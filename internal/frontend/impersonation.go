@@ -0,0 +1,215 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// Impersonation allows admins to view Portunus as another user sees it, e.g.
+// to debug why that user cannot see a certain group.
+//
+// While impersonating, the cookie holds two sessions: "sid" is an impersonation
+// session for the target user, and "admin_sid" is the admin's own session,
+// which is restored when the impersonation ends. Impersonation is strictly
+// read-only: VerifyLogin rejects all requests other than GET.
+
+// Handles GET /users/:uid/impersonate.
+func getUserImpersonateHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useImpersonateUserForm(n),
+		UseEmptyFormState,
+		ShowForm("Confirm impersonation"),
+	)
+}
+
+var impersonateUserConfirmSnippet = h.NewSnippet(`
+	<p>
+		View Portunus as it appears to user <code>{{.}}</code>?
+		You will not be able to make any changes until you end the impersonation.
+	</p>
+`)
+
+var impersonateButtonSnippet = h.NewSnippet(`
+	<p><a href="/users/{{.}}/impersonate" class="button button-secondary">Impersonate</a></p>
+`)
+
+func useImpersonateUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		editURL := "/users/" + i.TargetUser.LoginName + "/edit"
+		if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+			i.RedirectWithFlashTo(editURL, Flash{"danger", "You cannot impersonate yourself."})
+			return
+		}
+		//this would not get past VerifyLogin anyway
+		if i.TargetUser.IsExpiredAt(time.Now()) {
+			msg := fmt.Sprintf("User %q cannot be impersonated because their account has expired.", i.TargetUser.LoginName)
+			i.RedirectWithFlashTo(editURL, Flash{"danger", msg})
+			return
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/users/" + i.TargetUser.LoginName + "/impersonate",
+			SubmitLabel:         "Impersonate user",
+			IgnoresReadOnlyMode: true,
+			Fields: []h.FormField{
+				h.StaticField{
+					Value: impersonateUserConfirmSnippet.Render(i.TargetUser.LoginName),
+				},
+			},
+		}
+
+		//impersonating an admin reveals everything that admin can see, so this needs an extra confirmation
+		target, exists := n.FindUser(func(u core.User) bool { return u.LoginName == i.TargetUser.LoginName })
+		if exists && target.Perms.Includes(adminPerms) {
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.SelectFieldSpec{
+				Name:  "confirm_admin",
+				Label: "This user is an admin.",
+				Options: []h.SelectOptionSpec{{
+					Value: "yes",
+					Label: "I understand that I am impersonating another admin.",
+				}},
+			})
+		}
+	}
+}
+
+// Handles POST /users/:uid/impersonate.
+func postUserImpersonateHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useImpersonateUserForm(n),
+		ReadFormStateFromRequest,
+		validateImpersonateUserForm,
+		ShowFormIfErrors("Confirm impersonation"),
+		startImpersonation,
+	)
+}
+
+func validateImpersonateUserForm(i *Interaction) {
+	if field := i.FormState.Fields["confirm_admin"]; field != nil && !field.Selected["yes"] {
+		field.ErrorMessage = "must be confirmed"
+	}
+}
+
+func startImpersonation(i *Interaction) {
+	adminLoginName := i.CurrentUser.LoginName
+	targetLoginName := i.TargetUser.LoginName
+	i.Session.Values["admin_sid"] = currentSessionID(i)
+	i.Session.Values["sid"] = sessionTracker.NewSession(SessionInfo{
+		LoginName:      targetLoginName,
+		ImpersonatedBy: adminLoginName,
+	})
+	i.Session.Values["impersonated_by"] = adminLoginName
+	logging.Info(logging.Fields{"login_name": adminLoginName, "target_login_name": targetLoginName}, "impersonation started")
+	i.RedirectWithFlashTo("/self", Flash{"success", fmt.Sprintf("Impersonating user %q.", targetLoginName)})
+}
+
+// Handles GET /impersonation/end.
+func getEndImpersonationHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		func(i *Interaction) {
+			if !isImpersonating(i) {
+				i.RedirectTo("/self")
+				return
+			}
+			info, _ := currentSessionInfo(i)
+			endImpersonation(i)
+			logging.Info(logging.Fields{"login_name": info.ImpersonatedBy, "target_login_name": info.LoginName}, "impersonation ended")
+
+			url := "/self"
+			if info.LoginName != "" {
+				url = "/users/" + info.LoginName + "/edit"
+			}
+			i.RedirectWithFlashTo(url, Flash{"success", "The impersonation has ended."})
+		},
+	)
+}
+
+// Returns whether the current session is an impersonation session.
+func isImpersonating(i *Interaction) bool {
+	_, ok := i.Session.Values["admin_sid"].(string)
+	return ok
+}
+
+// Ends the impersonation and restores the admin's own session. The caller
+// needs to save the session afterwards.
+func endImpersonation(i *Interaction) {
+	if sessionID := currentSessionID(i); sessionID != "" {
+		sessionTracker.DeleteSession(sessionID)
+	}
+	adminSessionID, _ := i.Session.Values["admin_sid"].(string)
+	i.Session.Values["sid"] = adminSessionID
+	delete(i.Session.Values, "admin_sid")
+	delete(i.Session.Values, "impersonated_by")
+}
+
+// Discards the admin's own session if an impersonation is in progress. This
+// is used when the entire login ends, rather than only the impersonation.
+func clearImpersonation(i *Interaction) {
+	if adminSessionID, ok := i.Session.Values["admin_sid"].(string); ok {
+		sessionTracker.DeleteSession(adminSessionID)
+	}
+	delete(i.Session.Values, "admin_sid")
+	delete(i.Session.Values, "impersonated_by")
+}
+
+var impersonationReadOnlySnippet = h.NewSnippet(`
+	<p>No changes can be made while impersonating another user. End the impersonation to make changes as yourself.</p>
+`)
+
+// Called by VerifyLogin for impersonation sessions. Ends the impersonation if
+// the admin's own login is not valid anymore, and rejects all requests that
+// could make changes.
+func verifyImpersonation(n core.Nexus, i *Interaction, info SessionInfo) {
+	//the impersonation shall not outlive the admin's own session (e.g. when the
+	//admin signed out all their other sessions) or their admin permissions
+	adminSessionID, _ := i.Session.Values["admin_sid"].(string)
+	adminInfo, ok := sessionTracker.CheckSession(adminSessionID)
+	if ok {
+		admin, exists := n.FindUser(func(u core.User) bool { return u.LoginName == info.ImpersonatedBy })
+		ok = exists && adminInfo.LoginName == info.ImpersonatedBy &&
+			!admin.IsExpiredAt(time.Now()) && admin.Perms.Includes(adminPerms)
+	}
+	if !ok {
+		logging.Info(logging.Fields{"login_name": info.ImpersonatedBy, "target_login_name": info.LoginName}, "impersonation revoked")
+		clearLogin(i)
+		if i.SaveSession() {
+			i.RedirectToLogin()
+		}
+		return
+	}
+
+	if i.Req.Method != http.MethodGet && i.Req.Method != http.MethodHead {
+		logging.Info(logging.Fields{"login_name": info.ImpersonatedBy, "target_login_name": info.LoginName},
+			"rejected %s %s during impersonation", i.Req.Method, i.Req.URL.Path)
+		if wantsJSON(i.Req) {
+			i.Fail(errForbidden("changes cannot be made while impersonating another user"))
+			return
+		}
+		Page{
+			Status:   http.StatusForbidden,
+			Title:    "Not allowed while impersonating",
+			Contents: impersonationReadOnlySnippet.Render(nil),
+		}.Render(i.writer, i.Req, i.CurrentUser, i.Session)
+		i.writer = nil
+	}
+}
@@ -0,0 +1,210 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/oidc"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/must"
+)
+
+type impersonationTest struct {
+	t       *testing.T
+	nexus   core.Nexus
+	handler http.Handler
+}
+
+// Sets up jane and bob as admins, and carol as a regular user.
+func setupImpersonationTest(t *testing.T) impersonationTest {
+	t.Helper()
+	nexus, _ := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users,
+			core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"},
+			core.User{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlsen"},
+		)
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true, "bob": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	devices := must.Return(store.NewDeviceStore(filepath.Join(t.TempDir(), "devices.json"), time.Hour))
+	key := must.Return(rsa.GenerateKey(rand.Reader, 2048))
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:  "https://portunus.example.org",
+		Clients: []oidc.Client{{ID: "wiki", RedirectURIs: []string{"https://wiki.example.org/callback"}}},
+	}, key, nexus)
+	handler := HTTPHandler(nexus, false, nil, nil, nil, devices, nil, nil, nil, nil, provider, nil, nil, nil)
+	return impersonationTest{t, nexus, handler}
+}
+
+// Sends a GET request through the main handler.
+func (s impersonationTest) get(path, cookie string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+	req.Header.Set("Cookie", cookie)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// Submits the impersonation form for the given user. If the impersonation
+// starts, the new session cookie is returned.
+func (s impersonationTest) impersonate(cookie, loginName string, form url.Values) (*httptest.ResponseRecorder, string) {
+	s.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/users/"+loginName+"/impersonate", strings.NewReader(form.Encode()))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	//this is usually done by the CSRF middleware, which we bypass here
+	err := req.ParseForm()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"uid": loginName})
+	rec := httptest.NewRecorder()
+	errorHandlingMiddleware(postUserImpersonateHandler(s.nexus)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		return rec, ""
+	}
+	return rec, loginCookieFromResponse(rec)
+}
+
+// Returns the login cookie set by the response, in the format of a Cookie header.
+func loginCookieFromResponse(rec *httptest.ResponseRecorder) string {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "portunus-login" {
+			return c.Name + "=" + c.Value
+		}
+	}
+	return ""
+}
+
+func TestImpersonationOfAdminNeedsConfirmation(t *testing.T) {
+	useFreshSessionTracker(t)
+	s := setupImpersonationTest(t)
+	cookie := loginCookieForTests(t, "jane")
+
+	rec, _ := s.impersonate(cookie, "bob", url.Values{})
+	assert.DeepEqual(t, "status without confirmation", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "form error without confirmation", strings.Contains(rec.Body.String(), "must be confirmed"), true)
+
+	_, impersonationCookie := s.impersonate(cookie, "bob", url.Values{"confirm_admin": {"yes"}})
+	assert.DeepEqual(t, "impersonation started with confirmation", impersonationCookie != "", true)
+	assert.DeepEqual(t, "status of /self as bob", s.get("/self", impersonationCookie).Code, http.StatusOK)
+
+	//non-admins can be impersonated without confirmation
+	_, impersonationCookie = s.impersonate(cookie, "carol", url.Values{})
+	assert.DeepEqual(t, "impersonation of non-admin started", impersonationCookie != "", true)
+}
+
+func TestImpersonationIsReadOnly(t *testing.T) {
+	useFreshSessionTracker(t)
+	s := setupImpersonationTest(t)
+	_, cookie := s.impersonate(loginCookieForTests(t, "jane"), "carol", url.Values{})
+	if cookie == "" {
+		t.Fatal("could not start impersonation")
+	}
+
+	//this stands in for all handlers that make changes
+	isReached := false
+	handler := errorHandlingMiddleware(Do(LoadSession, VerifyLogin(s.nexus), func(i *Interaction) {
+		isReached = true
+		i.RedirectTo("/self")
+	}))
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		for _, asJSON := range []bool{false, true} {
+			isReached = false
+			req := httptest.NewRequest(method, "/self", http.NoBody)
+			req.Header.Set("Cookie", cookie)
+			if asJSON {
+				req.Header.Set("Accept", "application/json")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			desc := method
+			if asJSON {
+				desc += " with JSON"
+			}
+			if method == http.MethodGet {
+				assert.DeepEqual(t, "handler reached for "+desc, isReached, true)
+			} else {
+				assert.DeepEqual(t, "status for "+desc, rec.Code, http.StatusForbidden)
+				assert.DeepEqual(t, "handler reached for "+desc, isReached, false)
+			}
+		}
+	}
+
+	//signing in to other applications is refused, since that could make changes there
+	query := url.Values{
+		"client_id":             {"wiki"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		"code_challenge_method": {"S256"},
+	}
+	rec := s.get("/oidc/authorize?"+query.Encode(), cookie)
+	assert.DeepEqual(t, "status for OIDC authorization while impersonating", rec.Code, http.StatusForbidden)
+	rec = s.get("/impersonation/end", cookie)
+	assert.DeepEqual(t, "status for ending impersonation", rec.Code, http.StatusSeeOther)
+	cookie = loginCookieFromResponse(rec)
+	rec = s.get("/oidc/authorize?"+query.Encode(), cookie)
+	assert.DeepEqual(t, "status for OIDC authorization after impersonation", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect for OIDC authorization after impersonation",
+		strings.HasPrefix(rec.Header().Get("Location"), "https://wiki.example.org/callback?code="), true)
+}
+
+func TestImpersonationEndsWithAdminSession(t *testing.T) {
+	useFreshSessionTracker(t)
+	s := setupImpersonationTest(t)
+
+	//when the admin's own session is revoked (e.g. by signing out all other
+	//sessions), the impersonation ends, too
+	_, cookie := s.impersonate(loginCookieForTests(t, "jane"), "carol", url.Values{})
+	assert.DeepEqual(t, "status of /self while impersonating", s.get("/self", cookie).Code, http.StatusOK)
+	sessionTracker.DeleteSessionsOfUser("jane", "")
+	rec := s.get("/self", cookie)
+	assert.DeepEqual(t, "status of /self after revocation", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect after revocation", rec.Header().Get("Location"), "/login")
+	assert.DeepEqual(t, "sessions of carol after revocation", sessionTracker.CountSessionsOfUser("carol"), 0)
+
+	//the same applies when the admin's session reaches the end of its lifetime,
+	//even if the impersonation session is younger
+	now := time.Now()
+	sessionTracker = NewInMemorySessionStore(SessionConfig{Lifetime: 3 * time.Hour, IdleTimeout: 2 * time.Hour})
+	sessionTracker.(*memorySessionStore).now = func() time.Time { return now }
+	adminCookie := loginCookieForTests(t, "jane")
+	now = now.Add(time.Hour)
+	_, cookie = s.impersonate(adminCookie, "carol", url.Values{})
+	now = now.Add(time.Hour)
+	assert.DeepEqual(t, "status of /self before end of lifetime", s.get("/self", cookie).Code, http.StatusOK)
+	now = now.Add(time.Hour + time.Minute)
+	rec = s.get("/self", cookie)
+	assert.DeepEqual(t, "status of /self after end of lifetime", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect after end of lifetime", rec.Header().Get("Location"), "/login")
+}
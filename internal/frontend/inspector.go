@@ -0,0 +1,415 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/majewsky/portunus/internal/store"
+)
+
+// How long the inspector stays unlocked after the admin confirmed their password.
+const inspectorUnlockDuration = 10 * time.Minute
+
+// Reads the database in the form that is stored on disk. This is a variable
+// so that tests can replace it.
+var readStoredDatabase = store.ReadDatabaseFromEnvironment
+
+// Like sudo, the inspector is unlocked for the current session only. The
+// session ID is recorded to ensure that the unlock does not carry over into
+// the next login.
+func isInspectorUnlocked(i *Interaction) bool {
+	sessionID, _ := i.Session.Values["inspector_sid"].(string)
+	unlockedUntil, _ := i.Session.Values["inspector_until"].(int64)
+	return sessionID != "" && sessionID == currentSessionID(i) && time.Now().Unix() < unlockedUntil
+}
+
+// Handler step that refuses access to the inspector unless it is unlocked.
+func verifyInspectorUnlocked(i *Interaction) {
+	if !isInspectorUnlocked(i) {
+		i.RedirectWithFlashTo("/inspect", Flash{"danger", "Please confirm your password to use the inspector."})
+	}
+}
+
+// Parses an object reference in the format "user/jane", "group/admins" or
+// "service-user/backup" (as used in the inspector URLs), or a bare name that
+// refers to exactly one user or group.
+func resolveInspectedObject(n core.Nexus, input string) (core.ObjectRef, error) {
+	name, ok := strings.CutPrefix(input, "service-user/")
+	if !ok {
+		return core.ResolveObjectRef(n, core.ParseObjectRef(input))
+	}
+	if _, exists := n.FindServiceUser(func(s core.ServiceUser) bool { return s.Name == name }); !exists {
+		return core.ObjectRef{}, fmt.Errorf("no such service user: %q", name)
+	}
+	return core.ObjectRef{Type: "service user", Name: name}, nil
+}
+
+func inspectorURL(ref core.ObjectRef) string {
+	return "/inspect/" + ref.String()
+}
+
+// Returns the redacted JSON representation of the referenced object from the
+// given database.
+func findRedactedObject(db core.Database, ref core.ObjectRef) (map[string]any, bool) {
+	switch ref.Type {
+	case "user":
+		user, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == ref.Name })
+		if exists {
+			return core.RedactObject(user), true
+		}
+	case "group":
+		group, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == ref.Name })
+		if exists {
+			return core.RedactObject(group), true
+		}
+	case "service user":
+		serviceUser, exists := db.ServiceUsers.Find(func(s core.ServiceUser) bool { return s.Name == ref.Name })
+		if exists {
+			return core.RedactObject(serviceUser), true
+		}
+	}
+	return nil, false
+}
+
+// Handler step that loads the object referenced in the URL into i.TargetRef.
+func loadInspectedObject(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		vars := mux.Vars(i.Req)
+		input := vars["type"] + "/" + vars["name"]
+		ref, err := resolveInspectedObject(n, input)
+		if err != nil {
+			i.RedirectWithFlashTo("/inspect", Flash{"danger", fmt.Sprintf("Cannot inspect %q: %s.", input, err.Error())})
+			return
+		}
+		i.TargetRef = ref
+	}
+}
+
+// Every access to the inspector is audited, even though secrets are redacted,
+// since it reveals more about an object than the regular admin UI.
+func auditInspection(i *Interaction, format string) {
+	ref := i.TargetRef
+	logging.Info(logging.Fields{"event": "database_inspected", "actor": i.CurrentUser.LoginName, "object_type": ref.Type, "object_name": ref.Name, "format": format},
+		"inspected %s %q", ref.Type, ref.Name)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// unlocking and object selection
+
+func useInspectorForm(i *Interaction) {
+	if isInspectorUnlocked(i) {
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/inspect",
+			SubmitLabel:         "Inspect",
+			IgnoresReadOnlyMode: true,
+			Fields: []h.FormField{
+				h.InputFieldSpec{
+					Name:      "object",
+					Label:     `Object (e.g. "user/jane", "group/admins" or "service-user/backup")`,
+					InputType: "text",
+					AutoFocus: true,
+				},
+			},
+		}
+		return
+	}
+
+	fields := []h.FormField{
+		h.StaticField{Value: inspectorLockedSnippet.Render(inspectorUnlockDuration.String())},
+	}
+	//like sudo, this requires the admin to confirm their password
+	if needsOldPassword(i) {
+		fields = append(fields, h.InputFieldSpec{
+			Name:      "password",
+			Label:     "Your password",
+			InputType: "password",
+			AutoFocus: true,
+		})
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:          "/inspect/unlock",
+		SubmitLabel:         "Unlock inspector",
+		IgnoresReadOnlyMode: true,
+		Fields:              fields,
+	}
+}
+
+var inspectorLockedSnippet = h.NewSnippet(`
+	The inspector shows the raw data of a single user, group or service user, with all secrets redacted.
+	It is meant for debugging; changes cannot be made here.
+	Every access is logged.
+	Once unlocked, the inspector stays available for {{.}}.
+`)
+
+// Handles GET /inspect.
+func getInspectorHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useInspectorForm,
+		UseEmptyFormState,
+		ShowForm("Inspector"),
+	)
+}
+
+// Handles POST /inspect/unlock.
+func postInspectorUnlockHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			if isImpersonating(i) {
+				i.RedirectWithFlashTo("/self", Flash{"danger", "The inspector cannot be used while impersonating another user."})
+			}
+		},
+		useInspectorForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			if needsOldPassword(i) {
+				password := fs.Fields["password"].GetValueOrSetError()
+				if password != "" && !n.PasswordHasher().CheckPasswordHash(password, i.CurrentUser.PasswordHash) {
+					fs.Fields["password"].ErrorMessage = "is not correct"
+				}
+			}
+			if !fs.IsValid() {
+				return
+			}
+			i.Session.Values["inspector_sid"] = currentSessionID(i)
+			i.Session.Values["inspector_until"] = time.Now().Add(inspectorUnlockDuration).Unix()
+			logging.Info(logging.Fields{"event": "inspector_unlocked", "actor": i.CurrentUser.LoginName}, "inspector unlocked")
+			i.RedirectWithFlashTo("/inspect", Flash{"success", "Inspector unlocked."})
+		},
+		ShowFormIfErrors("Inspector"),
+	)
+}
+
+// Handles POST /inspect.
+func postInspectorHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		verifyInspectorUnlocked,
+		useInspectorForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			field := i.FormState.Fields["object"]
+			input := strings.TrimSpace(field.GetValueOrSetError())
+			if input == "" {
+				return
+			}
+			ref, err := resolveInspectedObject(n, input)
+			if err != nil {
+				field.ErrorMessage = err.Error()
+				return
+			}
+			i.RedirectTo(inspectorURL(ref))
+		},
+		ShowFormIfErrors("Inspector"),
+	)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// object view
+
+// Handles GET /inspect/:type/:name.
+func getInspectedObjectHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		verifyInspectorUnlocked,
+		loadInspectedObject(n),
+		func(i *Interaction) {
+			auditInspection(i, "html")
+		},
+		ShowView(inspectedObjectView(n)),
+	)
+}
+
+var inspectedObjectSnippet = h.NewSnippet(`
+	<div class="contains-body-text">
+		<p>
+			The stored form is what is currently in the database file (or SQLite database).
+			The in-memory form is what Portunus works with, after normalization and after the seed was applied.
+			The two differ while a change has not been written yet, or when the stored data was edited by hand.
+			Secrets are shown as <code>(redacted)</code>.
+		</p>
+	</div>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Stored form</th>
+				<th>In-memory form</th>
+			</tr>
+		</thead>
+		<tbody>
+			<tr>
+				{{ if .StoredError -}}
+					<td data-label="Stored form" class="text-muted">Not available: {{.StoredError}}</td>
+				{{- else if .StoredJSON -}}
+					<td data-label="Stored form"><pre><code>{{.StoredJSON}}</code></pre></td>
+				{{- else -}}
+					<td data-label="Stored form" class="text-muted">Does not exist.</td>
+				{{- end }}
+				{{ if .MemoryJSON -}}
+					<td data-label="In-memory form"><pre><code>{{.MemoryJSON}}</code></pre></td>
+				{{- else -}}
+					<td data-label="In-memory form" class="text-muted">Does not exist.</td>
+				{{- end }}
+			</tr>
+		</tbody>
+	</table>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Field</th>
+				<th>Stored</th>
+				<th>In memory</th>
+				<th>Governed by</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{- range .Fields }}
+				<tr>
+					<td data-label="Field"><code>{{.Path}}</code>{{if .Differs}} <strong>(differs)</strong>{{end}}</td>
+					<td data-label="Stored">{{with .StoredValue}}<code>{{.}}</code>{{else}}<span class="text-muted">(unset)</span>{{end}}</td>
+					<td data-label="In memory">{{with .MemoryValue}}<code>{{.}}</code>{{else}}<span class="text-muted">(unset)</span>{{end}}</td>
+					<td data-label="Governed by">{{with .Seed}}{{.}}{{else}}<span class="text-muted">not seeded</span>{{end}}</td>
+				</tr>
+			{{- end }}
+		</tbody>
+	</table>
+	<div class="button-row">
+		<a href="{{.DownloadURL}}" class="button button-primary">Download redacted JSON</a>
+		<a href="/inspect" class="button">Inspect another object</a>
+	</div>
+`)
+
+type inspectedField struct {
+	Path        string
+	StoredValue string
+	MemoryValue string
+	Differs     bool
+	Seed        string
+}
+
+func inspectedObjectView(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		ref := i.TargetRef
+		data := struct {
+			StoredJSON  string
+			StoredError string
+			MemoryJSON  string
+			Fields      []inspectedField
+			DownloadURL string
+		}{DownloadURL: inspectorURL(ref) + "/json"}
+
+		var storedFields, memoryFields map[string]string
+		storedDB, err := readStoredDatabase()
+		if err == nil {
+			if obj, exists := findRedactedObject(storedDB, ref); exists {
+				data.StoredJSON = renderInspectedJSON(obj)
+				storedFields = core.FlattenRedactedObject(obj)
+			}
+		} else {
+			data.StoredError = err.Error()
+		}
+		memoryDB := core.Database{Users: n.ListUsers(), Groups: n.ListGroups(), ServiceUsers: n.ListServiceUsers()}
+		if obj, exists := findRedactedObject(memoryDB, ref); exists {
+			data.MemoryJSON = renderInspectedJSON(obj)
+			memoryFields = core.FlattenRedactedObject(obj)
+		}
+
+		seededPaths, seedPath := n.SeededFields(ref)
+		seedLabel := "seed"
+		if seedPath != "" {
+			seedLabel = "seed file " + seedPath
+		}
+		paths := make(map[string]bool, len(memoryFields))
+		for path := range storedFields {
+			paths[path] = true
+		}
+		for path := range memoryFields {
+			paths[path] = true
+		}
+		for path := range paths {
+			field := inspectedField{
+				Path:        path,
+				StoredValue: storedFields[path],
+				MemoryValue: memoryFields[path],
+			}
+			field.Differs = data.StoredError == "" && field.StoredValue != field.MemoryValue
+			for _, seededPath := range seededPaths {
+				if path == seededPath || strings.HasPrefix(path, seededPath+".") {
+					field.Seed = seedLabel
+				}
+			}
+			data.Fields = append(data.Fields, field)
+		}
+		sort.Slice(data.Fields, func(i, j int) bool {
+			return data.Fields[i].Path < data.Fields[j].Path
+		})
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    fmt.Sprintf("Inspect %s %s", ref.Type, ref.Name),
+			Contents: inspectedObjectSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+func renderInspectedJSON(obj map[string]any) string {
+	buf, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		//cannot happen for the output of core.RedactObject()
+		panic(err.Error())
+	}
+	return string(buf)
+}
+
+// Handles GET /inspect/:type/:name/json.
+func getInspectedObjectJSONHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		verifyInspectorUnlocked,
+		loadInspectedObject(n),
+		func(i *Interaction) {
+			ref := i.TargetRef
+			memoryDB := core.Database{Users: n.ListUsers(), Groups: n.ListGroups(), ServiceUsers: n.ListServiceUsers()}
+			obj, exists := findRedactedObject(memoryDB, ref)
+			if !exists {
+				i.WriteError(fmt.Sprintf("%s %q does not exist", ref.Type, ref.Name), http.StatusNotFound)
+				return
+			}
+			auditInspection(i, "json")
+
+			fileName := strings.ReplaceAll(ref.String(), "/", "-") + ".json"
+			i.writer.Header().Set("Content-Type", "application/json")
+			i.writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write([]byte(renderInspectedJSON(obj) + "\n"))
+			i.writer = nil
+		},
+	)
+}
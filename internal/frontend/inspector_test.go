@@ -0,0 +1,143 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func TestInspector(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{
+			LoginName:  "john",
+			GivenName:  "John",
+			FamilyName: "Doe",
+			Invitation: &core.UserInvitation{TokenHash: "invitationtokenhash", ExpiresAt: time.Now().Add(time.Hour)},
+		})
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		db.ServiceUsers = []core.ServiceUser{{Name: "backup", PasswordHash: "{PLAINTEXT}serviceuserpassword"}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	//the stored form of jane has not caught up with a change yet
+	oldReadStoredDatabase := readStoredDatabase
+	t.Cleanup(func() { readStoredDatabase = oldReadStoredDatabase })
+	readStoredDatabase = func() (core.Database, error) {
+		return core.Database{Users: []core.User{
+			{LoginName: "jane", GivenName: "Janet", FamilyName: "Doe", PasswordHash: "{PLAINTEXT}oldswordfish"},
+		}}, nil
+	}
+
+	var logBuffer bytes.Buffer
+	logg.SetLogger(stdlog.New(&logBuffer, "", 0))
+	defer logg.SetLogger(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+
+	cookie := loginCookieForTests(t, "jane")
+	send := func(handler http.Handler, method, path string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Cookie", cookie)
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			//this is usually done by the CSRF middleware, which we bypass here
+			err := req.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//the inspector needs to be unlocked with the admin's password first
+	rec := send(handler, http.MethodGet, "/inspect/user/jane/json", nil)
+	assert.DeepEqual(t, "status before unlock", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect before unlock", rec.Header().Get("Location"), "/inspect")
+	unlockHandler := postInspectorUnlockHandler(nexus)
+	rec = send(unlockHandler, http.MethodPost, "/inspect/unlock", url.Values{"password": {"marlin"}})
+	assert.DeepEqual(t, "status of unlock with wrong password", rec.Code, http.StatusOK)
+	rec = send(unlockHandler, http.MethodPost, "/inspect/unlock", url.Values{"password": {"swordfish"}})
+	assert.DeepEqual(t, "status of unlock", rec.Code, http.StatusSeeOther)
+	cookie = strings.SplitN(rec.Header().Get("Set-Cookie"), ";", 2)[0]
+
+	//the view shows both forms side by side, without secrets
+	rec = send(handler, http.MethodGet, "/inspect/user/jane", nil)
+	assert.DeepEqual(t, "status of GET /inspect/user/jane", rec.Code, http.StatusOK)
+	body := rec.Body.String()
+	assert.DeepEqual(t, "view shows stored form", strings.Contains(body, "Janet"), true)
+	assert.DeepEqual(t, "view shows difference", strings.Contains(body, "<code>given_name</code> <strong>(differs)</strong>"), true)
+	for _, secret := range []string{"swordfish", "oldswordfish"} {
+		assert.DeepEqual(t, "view contains "+secret, strings.Contains(body, secret), false)
+	}
+
+	//every known secret field is redacted in the download
+	downloads := []struct {
+		Path         string
+		SecretFields []string
+	}{
+		{"/inspect/user/jane/json", []string{"password"}},
+		{"/inspect/user/john/json", []string{"invitation.token_hash"}},
+		{"/inspect/service-user/backup/json", []string{"password"}},
+	}
+	for _, download := range downloads {
+		path := download.Path
+		rec = send(handler, http.MethodGet, path, nil)
+		assert.DeepEqual(t, "status of GET "+path, rec.Code, http.StatusOK)
+		for _, secret := range []string{"swordfish", "invitationtokenhash", "serviceuserpassword"} {
+			assert.DeepEqual(t, path+" contains "+secret, strings.Contains(rec.Body.String(), secret), false)
+		}
+		var data map[string]any
+		err := json.Unmarshal(rec.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := core.FlattenRedactedObject(data)
+		for _, field := range download.SecretFields {
+			assert.DeepEqual(t, "field "+field+" in "+path, fields[field], `"(redacted)"`)
+		}
+	}
+
+	//every access was audited
+	var auditLines []string
+	for _, line := range strings.Split(logBuffer.String(), "\n") {
+		if strings.Contains(line, "actor=") {
+			auditLines = append(auditLines, line)
+		}
+	}
+	assert.DeepEqual(t, "audit log", auditLines, []string{
+		`INFO: inspector unlocked actor="jane" event="inspector_unlocked"`,
+		`INFO: inspected user "jane" actor="jane" event="database_inspected" format="html" object_name="jane" object_type="user"`,
+		`INFO: inspected user "jane" actor="jane" event="database_inspected" format="json" object_name="jane" object_type="user"`,
+		`INFO: inspected user "john" actor="jane" event="database_inspected" format="json" object_name="john" object_type="user"`,
+		`INFO: inspected service user "backup" actor="jane" event="database_inspected" format="json" object_name="backup" object_type="service user"`,
+	})
+}
@@ -0,0 +1,148 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Returns the link that an invited user needs to visit to set their password.
+func invitationURL(r *http.Request, token string) string {
+	return externalURL(r, "/invitation/"+token)
+}
+
+// Returns an absolute URL for the given path, for use in links that are sent
+// to users outside of the web GUI.
+func externalURL(r *http.Request, path string) string {
+	scheme := "http"
+	if isSecureRequest(r) {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
+
+// Handles GET /invitation/:token.
+func getInvitationHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		loadInvitedUser(n),
+		useInvitationForm,
+		UseEmptyFormState,
+		ShowForm("Welcome to Portunus"),
+	)
+}
+
+// Handles POST /invitation/:token.
+func postInvitationHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		loadInvitedUser(n),
+		useInvitationForm,
+		ReadFormStateFromRequest,
+		validateInvitationForm,
+		TryUpdateNexus(n, executeRedeemInvitation),
+		ShowFormIfErrors("Welcome to Portunus"),
+		func(i *Interaction) {
+			msg := "Your password has been set. You can now log in."
+			i.RedirectWithFlashTo("/login", Flash{"success", msg})
+		},
+	)
+}
+
+func loadInvitedUser(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		token := mux.Vars(i.Req)["token"]
+		now := time.Now()
+		user, exists := n.FindUser(func(u core.User) bool {
+			return u.Invitation != nil && u.Invitation.IsRedeemableWith(token, now)
+		})
+		if exists {
+			i.TargetUser = &user.User
+			i.TargetRef = user.User.Ref()
+		} else {
+			msg := "This invitation link is not valid. It may have expired or may have been used already."
+			i.RedirectWithFlashTo("/login", Flash{"danger", msg})
+		}
+	}
+}
+
+func useInvitationForm(i *Interaction) {
+	u := i.TargetUser
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/invitation/" + mux.Vars(i.Req)["token"],
+		SubmitLabel: "Set password",
+		Fields: []h.FormField{
+			h.StaticField{
+				Label: "Login name",
+				Value: codeTagSnippet.Render(u.LoginName),
+			},
+			h.StaticField{
+				Label: "Full name",
+				Value: userFullNameSnippet.Render(u),
+			},
+			h.InputFieldSpec{
+				InputType:        "password",
+				Name:             "password",
+				Label:            "Password",
+				AutoFocus:        true,
+				AutocompleteMode: "new-password",
+			},
+			h.InputFieldSpec{
+				InputType:        "password",
+				Name:             "repeat_password",
+				Label:            "Repeat password",
+				AutocompleteMode: "new-password",
+			},
+			h.MultilineInputFieldSpec{
+				Name:  "ssh_public_keys",
+				Label: "SSH public key(s) (optional)",
+			},
+		},
+	}
+}
+
+func validateInvitationForm(i *Interaction) {
+	fs := i.FormState
+	password1 := fs.Fields["password"].GetValueOrSetError()
+	password2 := fs.Fields["repeat_password"].GetValueOrSetError()
+	if password2 != "" && password1 != password2 {
+		fs.Fields["repeat_password"].ErrorMessage = "did not match"
+	}
+}
+
+var errInvitationAlreadyRedeemed = errors.New("this invitation has already been used")
+
+func executeRedeemInvitation(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
+	fs := i.FormState
+	for idx, user := range db.Users {
+		if user.LoginName != i.TargetUser.LoginName {
+			continue
+		}
+		//the invitation might have been redeemed in a different request since we
+		//loaded i.TargetUser
+		if user.Invitation == nil || user.Invitation.TokenHash != i.TargetUser.Invitation.TokenHash {
+			errs.Add(errInvitationAlreadyRedeemed)
+			return
+		}
+		user.PasswordHash = hasher.HashPassword(fs.Fields["password"].Value)
+		now := time.Now()
+		user.SSHPublicKeys = core.MergeSSHPublicKeys(user.SSHPublicKeys, core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value), &now)
+		user.Invitation = nil
+		user.MustChangePassword = false
+		db.Users[idx] = user //`user` copies by value, so we need to write the changes back explicitly
+	}
+	return
+}
@@ -0,0 +1,205 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// Returns the layout in which user entries are placed in the LDAP directory.
+func currentLDAPUserLayout() ldap.UserLayout {
+	if ldapAdapter == nil {
+		return ldap.FlatUserLayout
+	}
+	return ldapAdapter.UserLayout()
+}
+
+// Returns the layout that the admin can switch to on the layout page. (There
+// are only two layouts, so this is always the other one.)
+func otherLDAPUserLayout() ldap.UserLayout {
+	if currentLDAPUserLayout() == ldap.DepartmentUserLayout {
+		return ldap.FlatUserLayout
+	}
+	return ldap.DepartmentUserLayout
+}
+
+// Computes the changes for switching to the other layout. False is returned
+// in shadow mode, where the switch shows up in the shadow report instead.
+func previewLDAPUserLayout(n core.Nexus) (ldap.ShadowReport, bool) {
+	if ldapAdapter == nil || isLDAPShadowMode() {
+		return ldap.ShadowReport{}, false
+	}
+	db := core.Database{Users: n.ListUsers(), Groups: n.ListGroups(), ServiceUsers: n.ListServiceUsers()}
+	return ldapAdapter.PreviewUserLayout(db, otherLDAPUserLayout()), true
+}
+
+var ldapLayoutSnippet = h.NewSnippet(`
+	<div class="contains-body-text">
+		<p>
+			{{ if eq .Current "department" -}}
+				Users are currently placed below an organizational unit for their department, e.g. <code>uid=jane,ou=Sales,{{.UsersDN}}</code>.
+				Users without a department are placed below <code>ou=unassigned,{{.UsersDN}}</code>.
+				When switching to the flat layout, all users are moved directly below <code>{{.UsersDN}}</code>, and the department OUs are deleted.
+			{{- else -}}
+				Users are currently placed directly below <code>{{.UsersDN}}</code>, e.g. <code>uid=jane,{{.UsersDN}}</code>.
+				When switching to the department layout, users are moved below an organizational unit for their department, e.g. <code>uid=jane,ou=Sales,{{.UsersDN}}</code>.
+				Users without a department are moved below <code>ou=unassigned,{{.UsersDN}}</code>.
+			{{- end }}
+			Group memberships are updated to the new DNs in the same step.
+			Applications that refer to user entries by their DN need to be reconfigured.
+		</p>
+		{{ if .Report -}}
+			<p>As of {{.ComputedAt}}, the following changes would be written:</p>
+			<ul>
+				<li>{{.Report.AddCount}} objects would be created</li>
+				<li>{{.Report.MoveCount}} objects would be moved</li>
+				<li>{{.Report.ModifyCount}} objects would be updated</li>
+				<li>{{.Report.DeleteCount}} objects would be deleted</li>
+			</ul>
+			<p><a href="/ldap-config/layout.ldif">Download the changes as LDIF</a></p>
+		{{- else -}}
+			<p>Portunus is running in shadow mode, so the changes for the new layout will appear in the <a href="/ldap-config/shadow">pending changes</a> instead.</p>
+		{{- end }}
+		<p>
+			The layout is reset to the value of <code>PORTUNUS_LDAP_USER_LAYOUT</code> when Portunus restarts.
+			Update that setting to keep the new layout.
+		</p>
+	</div>
+`)
+
+func useLDAPLayoutForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if ldapAdapter == nil {
+			i.RedirectWithFlashTo("/ldap-config", Flash{"danger", "The LDAP user layout cannot be changed because the LDAP sync is not running."})
+			return
+		}
+		report, hasReport := previewLDAPUserLayout(n)
+		data := struct {
+			Current    ldap.UserLayout
+			UsersDN    string
+			Report     *ldap.ShadowReport
+			ComputedAt string
+		}{Current: currentLDAPUserLayout(), UsersDN: "ou=" + ldapOUNames.Users + "," + ldapSuffix}
+		if hasReport {
+			data.Report = &report
+			data.ComputedAt = report.ComputedAt.Local().Format("2006-01-02 15:04:05 MST")
+		}
+
+		fields := []h.FormField{
+			h.StaticField{Value: ldapLayoutSnippet.Render(data)},
+			h.HiddenFieldSpec{Name: "report"},
+		}
+		//like sudo, this requires the admin to confirm their password
+		if needsOldPassword(i) {
+			fields = append(fields, h.InputFieldSpec{
+				Name:      "password",
+				Label:     "Your password",
+				InputType: "password",
+			})
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/ldap-config/layout",
+			SubmitLabel:         "Switch to " + string(otherLDAPUserLayout()) + " layout",
+			IgnoresReadOnlyMode: true,
+			Fields:              fields,
+		}
+	}
+}
+
+// Identifies the changes that the admin reviewed before switching layouts.
+func ldapLayoutReportID(n core.Nexus) string {
+	report, ok := previewLDAPUserLayout(n)
+	if !ok {
+		return string(otherLDAPUserLayout())
+	}
+	return shadowReportID(report)
+}
+
+// Handles GET /ldap-config/layout.
+func getLDAPLayoutHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useLDAPLayoutForm(n),
+		func(i *Interaction) {
+			i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+				"report": {Value: ldapLayoutReportID(n)},
+			}}
+		},
+		ShowForm("LDAP user layout"),
+	)
+}
+
+// Handles GET /ldap-config/layout.ldif.
+func getLDAPLayoutLDIFHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			report, ok := previewLDAPUserLayout(n)
+			if !ok {
+				i.RedirectWithFlashTo("/ldap-config/layout", Flash{"danger", "The changes for switching the layout cannot be computed in shadow mode."})
+				return
+			}
+			hdr := i.writer.Header()
+			hdr.Set("Content-Type", "text/x-ldif; charset=utf-8")
+			hdr.Set("Content-Disposition", `attachment; filename="ldap-layout-changes.ldif"`)
+			hdr.Set("Cache-Control", "no-store")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(report.MarshalLDIF())
+			i.writer = nil
+		},
+	)
+}
+
+// Handles POST /ldap-config/layout.
+func postLDAPLayoutHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			if isImpersonating(i) {
+				i.RedirectWithFlashTo("/ldap-config/layout", Flash{"danger", "No changes can be made while impersonating another user."})
+			}
+		},
+		useLDAPLayoutForm(n),
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			//if the changes are different from what the admin looked at, show them the current ones
+			reportID := ldapLayoutReportID(n)
+			if fs.Fields["report"].Value != reportID {
+				fs.ErrorMessages = append(fs.ErrorMessages, "The changes are different now because the database or the LDAP server changed in the meantime. Please review them once more.")
+				fs.Fields["report"] = &h.FieldState{Value: reportID}
+			}
+			if needsOldPassword(i) {
+				password := fs.Fields["password"].GetValueOrSetError()
+				if password != "" && !n.PasswordHasher().CheckPasswordHash(password, i.CurrentUser.PasswordHash) {
+					fs.Fields["password"].ErrorMessage = "is not correct"
+				}
+			}
+			if !fs.IsValid() {
+				return
+			}
+
+			oldLayout, newLayout := currentLDAPUserLayout(), otherLDAPUserLayout()
+			ldapAdapter.SetUserLayout(newLayout)
+			logging.Info(logging.Fields{"event": "ldap_user_layout_changed", "actor": i.CurrentUser.LoginName},
+				"switched LDAP user layout from %q to %q", oldLayout, newLayout)
+			i.RedirectWithFlashTo("/ldap-config", Flash{"success", "Switched to the " + string(newLayout) + " layout. The user entries are being moved in the LDAP server."})
+		},
+		ShowFormIfErrors("LDAP user layout"),
+	)
+}
@@ -0,0 +1,181 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// This is set by HTTPHandler(). If nil, shadow mode is not available.
+var ldapAdapter *ldap.Adapter
+
+func isLDAPShadowMode() bool {
+	return ldapAdapter != nil && ldapAdapter.IsShadowMode()
+}
+
+// Identifies the changes in a ShadowReport, so that we can detect whether the
+// changes that the admin reviewed are still the current ones. (The report is
+// computed again periodically, so its timestamp is not suitable for this.)
+func shadowReportID(report ldap.ShadowReport) string {
+	hash := sha256.Sum256(report.MarshalLDIF())
+	return hex.EncodeToString(hash[:])
+}
+
+var ldapShadowReportSnippet = h.NewSnippet(`
+	<div class="contains-body-text">
+		<p>
+			Portunus is running in shadow mode: It only reads from the LDAP server, and does not write any changes into it.
+			Below are the changes that it would write to bring the LDAP server in sync with the Portunus database.
+			They are computed again whenever the database changes.
+		</p>
+		{{ if .Report -}}
+			<p>As of {{.ComputedAt}} (database revision {{.Report.Revision}}), {{.Report.OperationCount}} changes would be written:</p>
+			<ul>
+				<li>{{.Report.AddCount}} objects would be created</li>
+				<li>{{.Report.MoveCount}} objects would be moved</li>
+				<li>{{.Report.ModifyCount}} objects would be updated</li>
+				<li>{{.Report.DeleteCount}} objects would be deleted</li>
+			</ul>
+			<p><a href="/ldap-config/shadow.ldif">Download the changes as LDIF</a></p>
+			<p>
+				When switching to active mode, these changes are written into the LDAP server right away, and all further changes are written as they happen.
+				Shadow mode can only be entered again by restarting Portunus with <code>PORTUNUS_LDAP_SHADOW_MODE</code> set.
+				(Conversely, remove that setting to stay in active mode after the next restart.)
+			</p>
+		{{- else -}}
+			<p class="text-muted">The changes have not been computed yet. Please reload this page in a moment.</p>
+		{{- end }}
+	</div>
+`)
+
+func useLDAPShadowForm(i *Interaction) {
+	if !isLDAPShadowMode() {
+		i.RedirectWithFlashTo("/ldap-config", Flash{"info", "Portunus is not running in shadow mode."})
+		return
+	}
+	report, hasReport := ldapAdapter.ShadowReport()
+	data := struct {
+		Report     *ldap.ShadowReport
+		ComputedAt string
+	}{}
+	if hasReport {
+		data.Report = &report
+		data.ComputedAt = report.ComputedAt.Local().Format("2006-01-02 15:04:05 MST")
+	}
+
+	fields := []h.FormField{
+		h.StaticField{Value: ldapShadowReportSnippet.Render(data)},
+		h.HiddenFieldSpec{Name: "report"},
+	}
+	//like sudo, this requires the admin to confirm their password
+	if hasReport && needsOldPassword(i) {
+		fields = append(fields, h.InputFieldSpec{
+			Name:      "password",
+			Label:     "Your password",
+			InputType: "password",
+		})
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:          "/ldap-config/shadow/activate",
+		SubmitLabel:         "Switch to active mode",
+		IgnoresReadOnlyMode: true,
+		Fields:              fields,
+		ReadOnly:            !hasReport,
+	}
+}
+
+// Handles GET /ldap-config/shadow.
+func getLDAPShadowHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useLDAPShadowForm,
+		func(i *Interaction) {
+			i.FormState = &h.FormState{Fields: map[string]*h.FieldState{}}
+			if report, ok := ldapAdapter.ShadowReport(); ok {
+				i.FormState.Fields["report"] = &h.FieldState{Value: shadowReportID(report)}
+			}
+		},
+		ShowForm("LDAP shadow mode"),
+	)
+}
+
+// Handles GET /ldap-config/shadow.ldif.
+func getLDAPShadowLDIFHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			report, ok := ldapAdapter.ShadowReport()
+			if !isLDAPShadowMode() || !ok {
+				i.RedirectWithFlashTo("/ldap-config/shadow", Flash{"danger", "No changes have been computed in shadow mode."})
+				return
+			}
+			hdr := i.writer.Header()
+			hdr.Set("Content-Type", "text/x-ldif; charset=utf-8")
+			hdr.Set("Content-Disposition", `attachment; filename="ldap-shadow-changes.ldif"`)
+			hdr.Set("Cache-Control", "no-store")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(report.MarshalLDIF())
+			i.writer = nil
+		},
+	)
+}
+
+// Handles POST /ldap-config/shadow/activate.
+func postLDAPShadowActivateHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			if isImpersonating(i) {
+				i.RedirectWithFlashTo("/ldap-config/shadow", Flash{"danger", "No changes can be made while impersonating another user."})
+			}
+		},
+		useLDAPShadowForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			report, ok := ldapAdapter.ShadowReport()
+			if !ok || i.FormSpec.ReadOnly {
+				//the form does not have a submit button in this case, but the report might have disappeared in the meantime
+				fs.ErrorMessages = append(fs.ErrorMessages, "The changes have not been computed yet.")
+				return
+			}
+			//if the changes were computed again since the admin looked at them, show them the current ones
+			if fs.Fields["report"].Value != shadowReportID(report) {
+				fs.ErrorMessages = append(fs.ErrorMessages, "The changes have been computed again in the meantime. Please review them once more.")
+				fs.Fields["report"] = &h.FieldState{Value: shadowReportID(report)}
+			}
+			if needsOldPassword(i) {
+				password := fs.Fields["password"].GetValueOrSetError()
+				if password != "" && !n.PasswordHasher().CheckPasswordHash(password, i.CurrentUser.PasswordHash) {
+					fs.Fields["password"].ErrorMessage = "is not correct"
+				}
+			}
+			if !fs.IsValid() {
+				return
+			}
+
+			ldapAdapter.Activate()
+			logging.Info(logging.Fields{"event": "ldap_shadow_mode_left", "actor": i.CurrentUser.LoginName},
+				"switched LDAP sync from shadow mode to active mode with %d pending changes", report.OperationCount())
+			i.RedirectWithFlashTo("/ldap-config", Flash{"success", "Switched to active mode. The pending changes are being written into the LDAP server."})
+		},
+		ShowFormIfErrors("LDAP shadow mode"),
+	)
+}
@@ -0,0 +1,334 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+)
+
+var ldapSearchScopes = map[string]int{
+	"base": goldap.ScopeBaseObject,
+	"one":  goldap.ScopeSingleLevel,
+	"sub":  goldap.ScopeWholeSubtree,
+}
+
+var ldapSimulationFieldNames = []string{"bind_dn", "base_dn", "scope", "filter", "attributes"}
+
+func useLDAPSimulationForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:          "/ldap-config/simulate",
+		SubmitLabel:         "Simulate search",
+		IgnoresReadOnlyMode: true,
+		Fields: []h.FormField{
+			h.InputFieldSpec{
+				Name:      "bind_dn",
+				Label:     "Bind DN (leave empty for an anonymous bind)",
+				InputType: "text",
+				AutoFocus: true,
+			},
+			h.InputFieldSpec{
+				Name:      "base_dn",
+				Label:     "Search base",
+				InputType: "text",
+			},
+			h.InputFieldSpec{
+				Name:      "scope",
+				Label:     `Scope ("base", "one" or "sub")`,
+				InputType: "text",
+			},
+			h.InputFieldSpec{
+				Name:      "filter",
+				Label:     "Filter",
+				InputType: "text",
+			},
+			h.InputFieldSpec{
+				Name:      "attributes",
+				Label:     "Requested attributes (separated by spaces, or empty for all attributes)",
+				InputType: "text",
+			},
+		},
+	}
+}
+
+// Reads the form state of the simulation form without claiming the
+// submission, since simulations do not change anything and may be repeated.
+func readLDAPSimulationFormState(i *Interaction) {
+	i.FormState = &h.FormState{}
+	i.FormSpec.ReadState(i.Req, i.FormState)
+}
+
+// Builds the SearchSimulation described by the given form state. Errors are
+// reported in the form state.
+func buildLDAPSimulation(fs *h.FormState) ldap.SearchSimulation {
+	s := ldap.SearchSimulation{
+		BindDN:     strings.TrimSpace(fs.Fields["bind_dn"].Value),
+		BaseDN:     strings.TrimSpace(fs.Fields["base_dn"].GetValueOrSetError()),
+		Attributes: strings.Fields(fs.Fields["attributes"].Value),
+	}
+	scope, exists := ldapSearchScopes[strings.TrimSpace(fs.Fields["scope"].Value)]
+	if exists {
+		s.Scope = scope
+	} else {
+		fs.Fields["scope"].ErrorMessage = `must be "base", "one" or "sub"`
+	}
+	filter, err := ldap.ParseFilter(fs.Fields["filter"].Value)
+	if err == nil {
+		s.Filter = filter
+	} else {
+		fs.Fields["filter"].ErrorMessage = err.Error()
+	}
+	return s
+}
+
+// Runs the simulation described by the given form state. Errors are reported
+// in the form state.
+func runLDAPSimulation(n core.Nexus, fs *h.FormState) []ldap.SimulatedEntry {
+	s := buildLDAPSimulation(fs)
+	if !fs.IsValid() {
+		return nil
+	}
+	db := core.Database{Users: n.ListUsers(), Groups: n.ListGroups(), ServiceUsers: n.ListServiceUsers()}
+	entries, err := ldap.SimulateSearch(db, ldapSuffix, ldapOUNames, currentLDAPUserLayout(), time.Now(), ldapHideTempPasswords, s)
+	if err != nil {
+		fs.ErrorMessages = append(fs.ErrorMessages, err.Error())
+		return nil
+	}
+	return entries
+}
+
+// Handles GET /ldap-config/simulate.
+func getLDAPSimulationHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useLDAPSimulationForm,
+		func(i *Interaction) {
+			i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+				"base_dn": {Value: ldapSuffix},
+				"scope":   {Value: "sub"},
+				"filter":  {Value: "(objectClass=*)"},
+			}}
+		},
+		ShowView(ldapSimulationView(n)),
+	)
+}
+
+// Handles POST /ldap-config/simulate.
+func postLDAPSimulationHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useLDAPSimulationForm,
+		readLDAPSimulationFormState,
+		ShowView(ldapSimulationView(n)),
+	)
+}
+
+var ldapSimulationSnippet = h.NewSnippet(`
+	{{- define "node" -}}
+		<details>
+			<summary>
+				<code>{{.DN}}</code>
+				{{- if not .IsVisible }} <span class="text-muted">(not visible to the bind DN)</span>{{ end }}
+			</summary>
+			<table class="table responsive">
+				<tbody>
+					{{- range .Values }}
+						<tr>
+							<td data-label="Attribute"><code>{{.Type}}</code></td>
+							{{ if .IsPassword -}}
+								<td data-label="Value" class="text-muted">Password hash (not shown)</td>
+							{{- else if .IsBinary -}}
+								<td data-label="Value" class="text-muted">Binary data ({{len .Value}} bytes)</td>
+							{{- else -}}
+								<td data-label="Value"><code>{{.Value}}</code></td>
+							{{- end }}
+							{{ if .IsReturned -}}
+								<td data-label="Returned">yes</td>
+							{{- else -}}
+								<td data-label="Returned" class="text-muted">no</td>
+							{{- end }}
+						</tr>
+					{{- end }}
+				</tbody>
+			</table>
+			{{- range .Children }}{{ template "node" . }}{{ end }}
+		</details>
+	{{- end -}}
+
+	<div class="contains-body-text">
+		<p>
+			This predicts what a search on the LDAP server would return, based on the current Portunus database and the access rules in the LDAP server configuration.
+			The LDAP server is not contacted.
+			Entries that match the filter, but would not be returned because the bind DN cannot read them, are shown as well.
+			Password hashes are not shown, and are left out of the LDIF download.
+		</p>
+	</div>
+	{{.Form}}
+	{{ if .HasResult -}}
+		<div class="contains-body-text">
+			<h2>Result</h2>
+			<p>{{.MatchCount}} entries match the filter. {{.VisibleCount}} of them would be returned.</p>
+		</div>
+		{{ range .Roots }}{{ template "node" . }}{{ end }}
+		{{ .DownloadForm }}
+	{{- end }}
+	<div class="button-row">
+		<a href="/ldap-config" class="button">Back to LDAP config</a>
+	</div>
+`)
+
+type ldapSimulationNode struct {
+	DN        string
+	IsVisible bool
+	Values    []ldapSimulationValue
+	Children  []*ldapSimulationNode
+}
+
+type ldapSimulationValue struct {
+	Type       string
+	Value      string
+	IsPassword bool
+	IsBinary   bool
+	IsReturned bool
+}
+
+// Arranges the given entries into a tree. The entries must be sorted such
+// that each entry comes after its parent, as returned by ldap.SimulateSearch().
+func buildLDAPSimulationTree(entries []ldap.SimulatedEntry) (roots []*ldapSimulationNode) {
+	var stack []*ldapSimulationNode
+	for _, entry := range entries {
+		node := &ldapSimulationNode{DN: entry.DN, IsVisible: entry.IsVisible}
+		for _, attr := range entry.Attributes {
+			for _, value := range attr.Values {
+				node.Values = append(node.Values, ldapSimulationValue{
+					Type:       attr.Type,
+					Value:      value,
+					IsPassword: attr.Type == "userPassword",
+					IsBinary:   !utf8.ValidString(value),
+					IsReturned: attr.IsReturned,
+				})
+			}
+		}
+		dn := strings.ToLower(entry.DN)
+		for len(stack) > 0 && !strings.HasSuffix(dn, ","+strings.ToLower(stack[len(stack)-1].DN)) {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, node)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, node)
+		}
+		stack = append(stack, node)
+	}
+	return roots
+}
+
+func ldapSimulationView(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		data := struct {
+			Form         template.HTML
+			HasResult    bool
+			MatchCount   int
+			VisibleCount int
+			Roots        []*ldapSimulationNode
+			DownloadForm template.HTML
+		}{}
+
+		if i.Req.Method == http.MethodPost {
+			entries := runLDAPSimulation(n, i.FormState)
+			if i.FormState.IsValid() {
+				data.HasResult = true
+				data.MatchCount = len(entries)
+				for _, entry := range entries {
+					if entry.IsVisible {
+						data.VisibleCount++
+					}
+				}
+				data.Roots = buildLDAPSimulationTree(entries)
+
+				downloadForm := h.FormSpec{
+					PostTarget:          "/ldap-config/simulate.ldif",
+					SubmitLabel:         "Download result as LDIF",
+					IgnoresReadOnlyMode: true,
+				}
+				for _, name := range ldapSimulationFieldNames {
+					downloadForm.Fields = append(downloadForm.Fields, h.HiddenFieldSpec{Name: name})
+				}
+				data.DownloadForm = downloadForm.Render(i.Req, *i.FormState)
+			}
+		}
+		data.Form = i.FormSpec.Render(i.Req, *i.FormState)
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Simulate LDAP search",
+			Contents: ldapSimulationSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+// Handles POST /ldap-config/simulate.ldif.
+func postLDAPSimulationLDIFHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			i.FormSpec = &h.FormSpec{}
+			for _, name := range ldapSimulationFieldNames {
+				i.FormSpec.Fields = append(i.FormSpec.Fields, h.HiddenFieldSpec{Name: name})
+			}
+		},
+		readLDAPSimulationFormState,
+		func(i *Interaction) {
+			entries := runLDAPSimulation(n, i.FormState)
+			if !i.FormState.IsValid() {
+				i.RedirectWithFlashTo("/ldap-config/simulate", Flash{"danger", "The simulation could not be repeated. Please run it again."})
+				return
+			}
+
+			//like ldapsearch, only list the entries that are actually returned
+			var reqs []goldap.AddRequest
+			for _, entry := range entries {
+				if !entry.IsVisible {
+					continue
+				}
+				req := entry.AsAddRequest()
+				attrs := req.Attributes[:0]
+				for _, attr := range req.Attributes {
+					if attr.Type != "userPassword" {
+						attrs = append(attrs, attr)
+					}
+				}
+				req.Attributes = attrs
+				reqs = append(reqs, req)
+			}
+
+			hdr := i.writer.Header()
+			hdr.Set("Content-Type", "text/x-ldif; charset=utf-8")
+			hdr.Set("Content-Disposition", `attachment; filename="ldap-simulation.ldif"`)
+			hdr.Set("Cache-Control", "no-store")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(ldap.MarshalLDIFEntries(reqs))
+			i.writer = nil
+		},
+	)
+}
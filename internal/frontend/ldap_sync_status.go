@@ -0,0 +1,103 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+)
+
+func countFailingLDAPEntities() int {
+	if ldapAdapter == nil {
+		return 0
+	}
+	return len(ldapAdapter.FailingEntities())
+}
+
+// Handles GET /ldap-config/sync-status.
+func getLDAPSyncStatusHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(ldapSyncStatusView),
+	)
+}
+
+var ldapSyncStatusSnippet = h.NewSnippet(`
+	<div class="contains-body-text">
+		<p>
+			These objects could not be written into the LDAP server because the LDAP server rejected the most recent change to them.
+			All other objects are still kept in sync as usual.
+			The failed changes are retried on every sync (at the latest after one minute), and objects disappear from this list once a retry succeeds.
+		</p>
+	</div>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Type</th>
+				<th>Name</th>
+				<th>Last operation</th>
+				<th>Last attempt</th>
+				<th>Last success</th>
+				<th>Error</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{- range .Entities }}
+				<tr>
+					<td data-label="Type">{{.EntityType}}</td>
+					<td data-label="Name"><span title="{{.DN}}">{{.EntityName}}</span></td>
+					<td data-label="Last operation">{{.LastOperation}}</td>
+					<td data-label="Last attempt">{{.LastAttemptAt}}</td>
+					<td data-label="Last success">{{with .LastSuccessAt}}{{.}}{{else}}<span class="text-muted">not since startup</span>{{end}}</td>
+					<td data-label="Error"><code>{{.LastError}}</code></td>
+				</tr>
+			{{- else }}
+				<tr><td colspan="6" class="text-muted">All objects are in sync.</td></tr>
+			{{- end }}
+		</tbody>
+	</table>
+`)
+
+func ldapSyncStatusView(i *Interaction) Page {
+	type entityDisplay struct {
+		ldap.EntitySyncStatus
+		LastAttemptAt string
+		LastSuccessAt string
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("2006-01-02 15:04:05 MST")
+	}
+
+	var data struct {
+		Entities []entityDisplay
+	}
+	if ldapAdapter != nil {
+		for _, s := range ldapAdapter.FailingEntities() {
+			data.Entities = append(data.Entities, entityDisplay{
+				EntitySyncStatus: s,
+				LastAttemptAt:    formatTime(s.LastAttemptAt),
+				LastSuccessAt:    formatTime(s.LastSuccessAt),
+			})
+		}
+	}
+
+	return Page{
+		Status:   http.StatusOK,
+		Title:    "LDAP sync status",
+		Contents: ldapSyncStatusSnippet.Render(data),
+		Wide:     true,
+	}
+}
@@ -0,0 +1,51 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// Handles GET /api/v1/export.ldif. This is the same export as in the control
+// API (GET /v1/export.ldif), for admins that do not have shell access to the
+// Portunus host.
+func getLDIFExportHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			db, errs := snapshotDatabase(n)
+			if !errs.IsEmpty() {
+				i.WriteError(errs.Join(", "), http.StatusInternalServerError)
+				return
+			}
+			includePasswords := i.Req.URL.Query().Get("include-passwords") == "true"
+			logging.Info(logging.Fields{"event": "ldif_exported", "actor": i.CurrentUser.LoginName, "include_passwords": strconv.FormatBool(includePasswords)},
+				"LDIF export downloaded by %s", i.CurrentUser.LoginName)
+			writeLDIFExport(i.writer, db, includePasswords)
+			i.writer = nil
+		},
+	)
+}
+
+// Writes the response for an LDIF export of the given database.
+func writeLDIFExport(w http.ResponseWriter, db core.Database, includePasswords bool) {
+	buf := ldap.ExportLDIF(db, ldapSuffix, ldapOUNames, currentLDAPUserLayout(), time.Now(), ldapHideTempPasswords, includePasswords)
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/x-ldif; charset=utf-8")
+	hdr.Set("Content-Disposition", `attachment; filename="portunus-export.ldif"`)
+	hdr.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
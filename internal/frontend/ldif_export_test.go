@@ -0,0 +1,75 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestLDIFExport(t *testing.T) {
+	useFreshSessionTracker(t)
+	oldSuffix, oldOUNames := ldapSuffix, ldapOUNames
+	ldapSuffix, ldapOUNames = "dc=example,dc=org", ldap.DefaultOUNames
+	t.Cleanup(func() { ldapSuffix, ldapOUNames = oldSuffix, oldOUNames })
+
+	nexus, handler := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"})
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	get := func(handler http.Handler, path, loginName string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		if loginName != "" {
+			req.Header.Set("Cookie", loginCookieForTests(t, loginName))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//the export is only available to admins, and errors are reported as JSON
+	rec := get(handler, "/api/v1/export.ldif", "")
+	assert.DeepEqual(t, "status without login", rec.Code, http.StatusUnauthorized)
+	rec = get(handler, "/api/v1/export.ldif", "bob")
+	assert.DeepEqual(t, "status for non-admin", rec.Code, http.StatusForbidden)
+	assert.DeepEqual(t, "content type for non-admin", strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json"), true)
+
+	//password hashes are only included on request
+	rec = get(handler, "/api/v1/export.ldif", "jane")
+	assert.DeepEqual(t, "status for admin", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "content type for admin", rec.Header().Get("Content-Type"), "text/x-ldif; charset=utf-8")
+	body := rec.Body.String()
+	assert.DeepEqual(t, "export contains jane", strings.Contains(body, "\ndn: uid=jane,ou=users,dc=example,dc=org\n"), true)
+	assert.DeepEqual(t, "export contains admins", strings.Contains(body, "\ndn: cn=admins,ou=groups,dc=example,dc=org\n"), true)
+	assert.DeepEqual(t, "export contains password", strings.Contains(body, "userPassword:"), false)
+	rec = get(handler, "/api/v1/export.ldif?include-passwords=true", "jane")
+	assert.DeepEqual(t, "export contains password on request", strings.Contains(rec.Body.String(), "\nuserPassword: {PLAINTEXT}swordfish\n"), true)
+
+	//the control API returns the same export
+	controlHandler := ControlHandler(nexus, nil, nil)
+	rec = get(controlHandler, "/v1/export.ldif", "")
+	assert.DeepEqual(t, "status in control API", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "export in control API", rec.Body.String(), body)
+}
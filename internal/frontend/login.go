@@ -8,17 +8,19 @@ package frontend
 
 import (
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/majewsky/portunus/internal/core"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
 	"github.com/sapcc/go-bits/errext"
 )
 
 func useLoginForm(i *Interaction) {
 	i.FormSpec = &h.FormSpec{
-		PostTarget:  "/login",
-		SubmitLabel: "Login",
+		PostTarget:          "/login",
+		SubmitLabel:         "Login",
+		IgnoresReadOnlyMode: true,
 		Fields: []h.FormField{
 			h.InputFieldSpec{
 				InputType:        "text",
@@ -50,15 +52,58 @@ func getLoginHandler(n core.Nexus) http.Handler {
 
 func skipLoginIfAlreadyLoggedIn(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
-		if uid, ok := i.Session.Values["uid"].(string); ok {
-			_, exists := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
-			if exists {
+		loginViaProxy(n, i)
+		if i.writer == nil {
+			return
+		}
+		if uid, ok := currentLoginName(i); ok {
+			user, exists := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
+			if exists && !user.IsExpiredAt(time.Now()) {
 				i.RedirectTo("/self")
 			}
 		}
 	}
 }
 
+// If Portunus runs behind an authenticating reverse proxy, starts a session
+// for the user identified by the proxy (unless the current session already
+// belongs to that user). If the proxy did not identify a user, the existing
+// session (if any) is left alone, so the regular login flow can be used.
+func loginViaProxy(n core.Nexus, i *Interaction) {
+	if proxyAuth == nil {
+		return
+	}
+	user, ok, err := proxyAuth.Authenticate(i.Req, n)
+	if err != nil {
+		//this is not counted as a failed login, since no password was involved
+		logging.Info(logging.Fields{"remote_addr": core.ClientIPOf(i.Req)}, "proxy authentication refused: %s", err.Error())
+		return
+	}
+	if !ok {
+		return
+	}
+	if info, ok := currentSessionInfo(i); ok && (info.LoginName == user.LoginName || info.ImpersonatedBy == user.LoginName) {
+		return
+	}
+
+	//the proxy is authoritative: if someone else was logged in with this
+	//session, they are logged out
+	if sessionID := currentSessionID(i); sessionID != "" {
+		sessionTracker.DeleteSession(sessionID)
+	}
+	clearImpersonation(i)
+	i.Session.Values["sid"] = sessionTracker.NewSession(SessionInfo{LoginName: user.LoginName})
+	i.Session.Values["proxy_auth"] = true
+	logging.Info(logging.Fields{"login_name": user.LoginName}, "login successful via proxy")
+	i.SaveSession()
+}
+
+// Returns whether the current session was started by loginViaProxy.
+func isProxyAuthenticated(i *Interaction) bool {
+	isProxyAuth, _ := i.Session.Values["proxy_auth"].(bool)
+	return proxyAuth != nil && isProxyAuth
+}
+
 // Handles POST /login.
 func postLoginHandler(n core.Nexus) http.Handler {
 	return Do(
@@ -67,11 +112,23 @@ func postLoginHandler(n core.Nexus) http.Handler {
 		ReadFormStateFromRequest,
 		checkLogin(n),
 		ShowFormIfErrors("Login"),
-		SaveSession,
-		RedirectTo("/self"),
+		redirectAfterLogin,
 	)
 }
 
+// Redirects to the page that asked for the login (see
+// Interaction.ReturnURLAfterLogin), or to /self by default.
+func redirectAfterLogin(i *Interaction) {
+	target, ok := i.Session.Values["return_to"].(string)
+	if !ok {
+		target = "/self"
+	}
+	delete(i.Session.Values, "return_to")
+	if i.SaveSession() {
+		i.RedirectTo(target)
+	}
+}
+
 func checkLogin(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		fs := i.FormState
@@ -79,14 +136,8 @@ func checkLogin(n core.Nexus) HandlerStep {
 		pwd := fs.Fields["password"].GetValueOrSetError()
 
 		if fs.IsValid() {
-			var predicate func(core.User) bool
-			if strings.Contains(userIdent, "@") {
-				predicate = func(u core.User) bool { return u.EMailAddress == userIdent }
-			} else {
-				predicate = func(u core.User) bool { return u.LoginName == userIdent }
-			}
-
-			user, exists := n.FindUser(predicate)
+			//the session always refers to the canonical login name, regardless of how it was entered
+			user, exists := core.FindUserByIdent(n, userIdent, loginNameSuffix)
 			passwordHash := ""
 			if exists {
 				passwordHash = user.PasswordHash
@@ -94,14 +145,32 @@ func checkLogin(n core.Nexus) HandlerStep {
 
 			hasher := n.PasswordHasher()
 			if !hasher.CheckPasswordHash(pwd, passwordHash) {
+				logging.Info(logging.Fields{"user_ident": userIdent}, "login failed")
 				fs.Fields["password"].ErrorMessage = "is not valid (or the user account does not exist)"
 				return
 			}
-			i.Session.Values["uid"] = user.LoginName
+			//this is only revealed to someone who knows the correct password
+			if user.IsExpiredAt(time.Now()) {
+				logging.Info(logging.Fields{"login_name": user.LoginName}, "login refused for expired user account")
+				fs.Fields["user_ident"].ErrorMessage = "belongs to a user account that has expired"
+				return
+			}
+			if sessionID := currentSessionID(i); sessionID != "" {
+				sessionTracker.DeleteSession(sessionID)
+			}
+			clearImpersonation(i)
+			i.Session.Values["sid"] = sessionTracker.NewSession(SessionInfo{
+				LoginName: user.LoginName,
+				DeviceID:  recognizeDevice(i, user.User),
+			})
+			delete(i.Session.Values, "proxy_auth")
+			logging.Info(logging.Fields{"login_name": user.LoginName}, "login successful")
+			attributeRequestToUser(i.Req, SessionInfo{LoginName: user.LoginName})
 
-			if hasher.IsWeakHash(passwordHash) {
+			if hasher.IsWeakHash(passwordHash) && n.ReadOnly() == nil {
 				//since the last login of this user, the hasher started preferring a different method
 				//-> we do have the user password right now, so we can rehash it transparently
+				//(in read-only mode, this waits until the next login)
 				newPasswordHash := hasher.HashPassword(pwd)
 				errs := n.Update(func(db *core.Database) (errs errext.ErrorSet) {
 					for idx, dbUser := range db.Users {
@@ -124,12 +193,27 @@ func checkLogin(n core.Nexus) HandlerStep {
 func getLogoutHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
-		clearLogin,
-		SaveSession,
-		RedirectTo("/login"),
+		func(i *Interaction) {
+			//sessions started by the proxy would be started again immediately, so
+			//we need to end the session at the proxy as well
+			logoutURL := "/login"
+			if isProxyAuthenticated(i) && proxyAuth.LogoutURL != "" {
+				logoutURL = proxyAuth.LogoutURL
+			}
+			clearLogin(i)
+			if i.SaveSession() {
+				i.RedirectTo(logoutURL)
+			}
+		},
 	)
 }
 
 func clearLogin(i *Interaction) {
-	delete(i.Session.Values, "uid")
+	if sessionID := currentSessionID(i); sessionID != "" {
+		sessionTracker.DeleteSession(sessionID)
+	}
+	clearImpersonation(i)
+	delete(i.Session.Values, "sid")
+	delete(i.Session.Values, "proxy_auth")
+	delete(i.Session.Values, "uid") //from cookies issued before server-side sessions were introduced
 }
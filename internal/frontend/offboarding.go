@@ -0,0 +1,206 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var offboardButtonSnippet = h.NewSnippet(`
+	<p><a href="/users/{{.}}/offboard" class="button button-secondary">Offboard</a></p>
+`)
+
+var offboardUserIntroSnippet = h.NewSnippet(`
+	<p>
+		All selected steps are applied to user <code>{{.}}</code> at once.
+		If their departure would leave a group without enough members to approve elevation requests,
+		another member needs to be added to that group first.
+	</p>
+`)
+
+func useOffboardUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+			i.RedirectWithFlashTo("/users", Flash{"danger", "You cannot offboard yourself."})
+			return
+		}
+
+		var groupOptions []h.SelectOptionSpec
+		for _, group := range n.ListGroups() {
+			if group.MemberLoginNames[i.TargetUser.LoginName] {
+				groupOptions = append(groupOptions, h.SelectOptionSpec{Value: group.Name, Label: group.LongName})
+			}
+		}
+
+		fields := []h.FormField{
+			h.StaticField{Value: offboardUserIntroSnippet.Render(i.TargetUser.LoginName)},
+			h.SelectFieldSpec{
+				Name:  "steps",
+				Label: "Steps",
+				Options: []h.SelectOptionSpec{
+					{Value: "disable_account", Label: "Disable the account immediately (this also discards a pending invitation)"},
+					{Value: "wipe_ssh_keys", Label: fmt.Sprintf("Remove all SSH public keys (currently %d)", len(i.TargetUser.SSHPublicKeys))},
+					{Value: "remove_memberships", Label: "Remove all group memberships, except for those selected below"},
+					{Value: "revoke_sessions", Label: "End all sessions, forget all devices, and end all elevations"},
+				},
+			},
+		}
+		if len(groupOptions) > 0 {
+			fields = append(fields, h.SelectFieldSpec{
+				Name:    "retain_groups",
+				Label:   "Keep memberships in",
+				Options: groupOptions,
+			})
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/users/" + i.TargetUser.LoginName + "/offboard",
+			SubmitLabel: "Offboard user",
+			Fields:      fields,
+		}
+	}
+}
+
+// Handles GET /users/:uid/offboard.
+func getUserOffboardHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useOffboardUserForm(n),
+		useDefaultOffboardingSteps,
+		ShowForm("Offboard user"),
+	)
+}
+
+// Everything is taken away unless the admin decides otherwise.
+func useDefaultOffboardingSteps(i *Interaction) {
+	opts := core.DefaultOffboardingOptions()
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{
+			"steps": {Selected: map[string]bool{
+				"disable_account":    opts.DisableAccount,
+				"wipe_ssh_keys":      opts.WipeSSHKeys,
+				"remove_memberships": opts.RemoveMemberships,
+				"revoke_sessions":    opts.RevokeSessions,
+			}},
+		},
+	}
+}
+
+// Handles POST /users/:uid/offboard.
+func postUserOffboardHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useOffboardUserForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeOffboardUser),
+		ShowFormIfErrors("Offboard user"),
+		func(i *Interaction) {
+			report := i.OffboardingReport
+			if readOffboardingOptions(i.FormState).RevokeSessions {
+				revokeAccessAfterOffboarding(i.CurrentUser.LoginName, report)
+			}
+			msg := fmt.Sprintf("Offboarded user %q: %s.", report.LoginName, describeOffboardingReport(*report))
+			i.RedirectWithFlashTo("/users", Flash{"success", msg})
+		},
+	)
+}
+
+func readOffboardingOptions(fs *h.FormState) core.OffboardingOptions {
+	steps := fs.Fields["steps"].Selected
+	opts := core.OffboardingOptions{
+		DisableAccount:    steps["disable_account"],
+		WipeSSHKeys:       steps["wipe_ssh_keys"],
+		RemoveMemberships: steps["remove_memberships"],
+		RevokeSessions:    steps["revoke_sessions"],
+	}
+	if field := fs.Fields["retain_groups"]; field != nil {
+		for groupName, isSelected := range field.Selected {
+			if isSelected {
+				opts.RetainGroupNames = append(opts.RetainGroupNames, groupName)
+			}
+		}
+	}
+	return opts
+}
+
+func executeOffboardUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) errext.ErrorSet {
+	if !i.FormState.IsValid() {
+		return nil
+	}
+	report, errs := db.Offboard(i.TargetUser.LoginName, readOffboardingOptions(i.FormState), time.Now())
+	i.OffboardingReport = &report
+	return errs
+}
+
+// Revokes everything that grants access to Portunus without being stored in
+// the database. This runs after the offboarding update was successful. The
+// actor is empty for offboardings requested through the control API.
+func revokeAccessAfterOffboarding(actor string, report *core.OffboardingReport) {
+	loginName := report.LoginName
+	report.EndedSessionCount = sessionTracker.CountSessionsOfUser(loginName)
+	sessionTracker.DeleteSessionsOfUser(loginName, "")
+	if deviceTracker != nil {
+		for _, device := range deviceTracker.ListDevicesOfUser(loginName) {
+			deviceTracker.DeleteDevice(loginName, device.ID)
+			report.ForgottenDevices++
+		}
+	}
+	if elevationManager != nil {
+		count, err := elevationManager.EndElevationsOfUser(actor, loginName)
+		if err != nil {
+			logging.Error(logging.Fields{"login_name": loginName}, "cannot end elevations during offboarding: %s", err.Error())
+		}
+		report.EndedElevations = count
+	}
+	logging.Info(logging.Fields{"login_name": loginName, "actor": actor}, "offboarding completed: %s", describeOffboardingReport(*report))
+}
+
+func describeOffboardingReport(r core.OffboardingReport) string {
+	var parts []string
+	if r.DisabledAt != nil {
+		parts = append(parts, "account disabled")
+	}
+	if r.RevokedInvitation {
+		parts = append(parts, "invitation revoked")
+	}
+	if r.RemovedSSHKeyCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d SSH public key(s) removed", r.RemovedSSHKeyCount))
+	}
+	if len(r.RemovedFromGroups) > 0 {
+		parts = append(parts, "removed from "+strings.Join(r.RemovedFromGroups, ", "))
+	}
+	if len(r.RetainedGroups) > 0 {
+		parts = append(parts, "still member of "+strings.Join(r.RetainedGroups, ", "))
+	}
+	if r.EndedSessionCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d session(s) ended", r.EndedSessionCount))
+	}
+	if r.ForgottenDevices > 0 {
+		parts = append(parts, fmt.Sprintf("%d device(s) forgotten", r.ForgottenDevices))
+	}
+	if r.EndedElevations > 0 {
+		parts = append(parts, fmt.Sprintf("%d elevation(s) ended", r.EndedElevations))
+	}
+	if len(parts) == 0 {
+		return "nothing to do"
+	}
+	return strings.Join(parts, "; ")
+}
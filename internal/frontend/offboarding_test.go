@@ -0,0 +1,107 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestOffboardingRevokesAllCredentials(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	invitationToken, invitation := core.NewUserInvitation(time.Now(), time.Hour)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users[0].SSHPublicKeys = []core.SSHKey{{Key: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGNvYUluYODNXoQKDGG+pTEigpsvJP2SHfMz0a+Hl2xO jane@example.org"}}
+		db.Users[0].Invitation = &invitation
+		db.Groups = []core.Group{
+			{Name: "developers", LongName: "Developers", MemberLoginNames: core.GroupMemberNames{"jane": true}},
+			{Name: "readers", LongName: "Readers", MemberLoginNames: core.GroupMemberNames{"jane": true}},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	cookie := loginCookieForTests(t, "jane")
+	deviceTracker.RecordLogin("jane", "laptop", "Firefox on Linux")
+	getSelf := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/self", http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.DeepEqual(t, "status of /self before offboarding", getSelf(), http.StatusOK)
+
+	//this is how an HR system would trigger the offboarding
+	req := httptest.NewRequest(http.MethodPost, "/v1/users/jane/offboard", strings.NewReader(`{"retain_groups":["readers"]}`))
+	rec := httptest.NewRecorder()
+	ControlHandler(nexus, nil, nil).ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status of offboarding request", rec.Code, http.StatusOK)
+	var report core.OffboardingReport
+	err := json.Unmarshal(rec.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.DisabledAt = nil //not deterministic
+	assert.DeepEqual(t, "offboarding report", report, core.OffboardingReport{
+		LoginName:          "jane",
+		RevokedInvitation:  true,
+		RemovedSSHKeyCount: 1,
+		RemovedFromGroups:  []string{"developers"},
+		RetainedGroups:     []string{"readers"},
+		EndedSessionCount:  1,
+		ForgottenDevices:   1,
+	})
+
+	//the existing session is dead
+	assert.DeepEqual(t, "status of /self after offboarding", getSelf(), http.StatusSeeOther)
+
+	//the password cannot be used to log in anymore
+	form := url.Values{"user_ident": {"jane"}, "password": {"swordfish"}}
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = req.ParseForm() //this is usually done by the CSRF middleware, which we bypass here
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	errorHandlingMiddleware(postLoginHandler(nexus)).ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status of login attempt", rec.Code, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "has expired") {
+		t.Errorf("expected login to be refused for expired account, but got %q", rec.Body.String())
+	}
+
+	//the invitation link cannot be used to set a new password
+	req = httptest.NewRequest(http.MethodGet, "/invitation/"+invitationToken, http.NoBody)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "redirect from invitation link", rec.Header().Get("Location"), "/login")
+
+	//neither the password nor the SSH key appears in LDAP
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	entry := ldap.RenderUserEntry(user.User, "dc=example,dc=org", ldap.DefaultOUNames, ldap.FlatUserLayout, nexus.ListGroups(), time.Now(), false)
+	for _, attr := range entry.Attributes {
+		if attr.Type == "userPassword" || attr.Type == "sshPublicKey" {
+			t.Errorf("expected no %s attribute in LDAP after offboarding, but found %v", attr.Type, attr.Vals)
+		}
+	}
+
+	//the device would have to be confirmed again
+	assert.DeepEqual(t, "number of devices", len(deviceTracker.ListDevicesOfUser("jane")), 0)
+}
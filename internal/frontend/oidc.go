@@ -0,0 +1,71 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/csrf"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/majewsky/portunus/internal/oidc"
+)
+
+// This is set by HTTPHandler().
+var oidcProvider *oidc.Provider
+
+// Handles GET /oidc/authorize.
+func getOIDCAuthorizeHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		func(i *Interaction) {
+			//invalid requests are rejected before asking the user to log in
+			i.ReturnURLAfterLogin = i.Req.URL.RequestURI()
+			_, err := oidcProvider.ParseAuthorizationRequest(i.Req.URL.Query())
+			if err != nil {
+				failOIDCAuthorization(i, err)
+			}
+		},
+		VerifyLogin(n),
+		func(i *Interaction) {
+			if isImpersonating(i) {
+				i.Fail(errForbidden("cannot sign in to other applications while impersonating another user"))
+				return
+			}
+			//the request was already validated above, so this cannot fail
+			req, err := oidcProvider.ParseAuthorizationRequest(i.Req.URL.Query())
+			if err != nil {
+				failOIDCAuthorization(i, err)
+				return
+			}
+			i.RedirectTo(oidcProvider.IssueCode(req, i.CurrentUser.LoginName))
+		},
+	)
+}
+
+func failOIDCAuthorization(i *Interaction, err error) {
+	logging.Info(logging.Fields{"remote_addr": core.ClientIPOf(i.Req)}, "rejected OIDC authorization request: %s", err.Error())
+	var aerr oidc.AuthorizationError
+	if errors.As(err, &aerr) && aerr.RedirectURI != "" {
+		i.RedirectTo(aerr.RedirectURL())
+	} else {
+		i.Fail(HTTPError{http.StatusBadRequest, ErrorCodeValidationFailed, err.Error(), nil, 0})
+	}
+}
+
+// The token and userinfo endpoints are called by relying parties, not by
+// browsers, and the requests are authenticated by client secrets and access
+// tokens, so the CSRF protection does not apply to them.
+func skipCSRFForOIDCMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oidc/token" || r.URL.Path == "/oidc/userinfo" {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Users with core.User.MustChangePassword cannot go anywhere except for the
+// page where they choose their new password. Admins impersonating these users
+// are not affected, since they could not choose the password anyway.
+func verifyPasswordChange(i *Interaction, info SessionInfo) {
+	if !i.CurrentUser.MustChangePassword || info.ImpersonatedBy != "" || i.Req.URL.Path == "/self/password" {
+		return
+	}
+	if wantsJSON(i.Req) {
+		i.Fail(errForbidden("a new password must be chosen at /self/password first"))
+		return
+	}
+	i.RedirectTo("/self/password")
+}
+
+func useChangePasswordForm(i *Interaction) {
+	i.TargetRef = i.CurrentUser.Ref()
+	var fields []h.FormField
+	if needsOldPassword(i) {
+		fields = append(fields, h.InputFieldSpec{
+			InputType: "password",
+			Name:      "old_password",
+			Label:     "Current password",
+		})
+	}
+	fields = append(fields,
+		h.InputFieldSpec{
+			InputType: "password",
+			Name:      "new_password",
+			Label:     "New password",
+			AutoFocus: !needsOldPassword(i),
+		},
+		h.InputFieldSpec{
+			InputType: "password",
+			Name:      "repeat_password",
+			Label:     "Repeat password",
+		},
+	)
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/self/password",
+		SubmitLabel: "Set new password",
+		Fields: append([]h.FormField{
+			h.StaticField{Value: mustChangePasswordSnippet.Render(nil)},
+		}, fields...),
+	}
+}
+
+var mustChangePasswordSnippet = h.NewSnippet(`
+	Your password was chosen by an administrator. Please choose a new password before you continue.
+`)
+
+// Only users that need to change their password are served by this page.
+// Everyone else changes their password on their "My profile" page.
+func skipPasswordChangeIfNotRequired(i *Interaction) {
+	if !i.CurrentUser.MustChangePassword {
+		i.RedirectTo("/self")
+	}
+}
+
+// Handles GET /self/password.
+func getSelfPasswordHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		skipPasswordChangeIfNotRequired,
+		useChangePasswordForm,
+		UseEmptyFormState,
+		ShowForm("Choose new password"),
+	)
+}
+
+// Handles POST /self/password.
+func postSelfPasswordHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		skipPasswordChangeIfNotRequired,
+		useChangePasswordForm,
+		ReadFormStateFromRequest,
+		validateChangePasswordForm(n),
+		TryUpdateNexus(n, executeChangePassword),
+		ShowFormIfErrors("Choose new password"),
+		func(i *Interaction) {
+			sessionTracker.DeleteSessionsOfUser(i.CurrentUser.LoginName, currentSessionID(i))
+			logging.Info(logging.Fields{"login_name": i.CurrentUser.LoginName}, "required password change completed")
+			i.RedirectWithFlashTo("/self", Flash{"success", "Your new password has been set."})
+		},
+	)
+}
+
+func validateChangePasswordForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		fs := i.FormState
+		hasher := n.PasswordHasher()
+		if needsOldPassword(i) {
+			oldPassword := fs.Fields["old_password"].GetValueOrSetError()
+			if oldPassword != "" && !hasher.CheckPasswordHash(oldPassword, i.CurrentUser.PasswordHash) {
+				fs.Fields["old_password"].ErrorMessage = "is not correct"
+			}
+		}
+
+		newPassword1 := fs.Fields["new_password"].GetValueOrSetError()
+		newPassword2 := fs.Fields["repeat_password"].GetValueOrSetError()
+		switch {
+		case newPassword2 != "" && newPassword1 != newPassword2:
+			fs.Fields["repeat_password"].ErrorMessage = "did not match"
+		case newPassword1 != "" && hasher.CheckPasswordHash(newPassword1, i.CurrentUser.PasswordHash):
+			fs.Fields["new_password"].ErrorMessage = "must be different from the password chosen by the administrator"
+		}
+	}
+}
+
+// The flag is cleared in the same update as the password, so there is no
+// point in time where the user could get around the password change.
+func executeChangePassword(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
+	if !i.FormState.IsValid() {
+		return
+	}
+	for idx, user := range db.Users {
+		if user.LoginName == i.CurrentUser.LoginName {
+			db.Users[idx].PasswordHash = hasher.HashPassword(i.FormState.Fields["new_password"].Value)
+			db.Users[idx].MustChangePassword = false
+		}
+	}
+	return
+}
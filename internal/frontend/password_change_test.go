@@ -0,0 +1,86 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRequiredPasswordChange(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users[0].MustChangePassword = true
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	cookie := loginCookieForTests(t, "jane")
+	send := func(handler http.Handler, method, path string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Cookie", cookie)
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			//this is usually done by the CSRF middleware, which we bypass here
+			err := req.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//all other pages are blocked until the password has been changed
+	rec := send(handler, http.MethodGet, "/self", nil)
+	assert.DeepEqual(t, "status of /self", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect from /self", rec.Header().Get("Location"), "/self/password")
+	rec = send(handler, http.MethodGet, "/self/password", nil)
+	assert.DeepEqual(t, "status of /self/password", rec.Code, http.StatusOK)
+
+	//the new password must actually be new
+	postHandler := errorHandlingMiddleware(postSelfPasswordHandler(nexus))
+	rec = send(postHandler, http.MethodPost, "/self/password", url.Values{
+		"old_password":    {"swordfish"},
+		"new_password":    {"swordfish"},
+		"repeat_password": {"swordfish"},
+	})
+	assert.DeepEqual(t, "status after reusing password", rec.Code, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "must be different") {
+		t.Errorf("expected error message about reused password, but got %q", rec.Body.String())
+	}
+
+	rec = send(postHandler, http.MethodPost, "/self/password", url.Values{
+		"old_password":    {"swordfish"},
+		"new_password":    {"marlin"},
+		"repeat_password": {"marlin"},
+	})
+	assert.DeepEqual(t, "status after password change", rec.Code, http.StatusSeeOther)
+	assert.DeepEqual(t, "redirect after password change", rec.Header().Get("Location"), "/self")
+
+	//password and flag are updated together
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "password hash", user.PasswordHash, "{PLAINTEXT}marlin")
+	assert.DeepEqual(t, "MustChangePassword", user.MustChangePassword, false)
+
+	//the rest of the GUI is usable again, and the password page is not
+	rec = send(handler, http.MethodGet, "/self", nil)
+	assert.DeepEqual(t, "status of /self afterwards", rec.Code, http.StatusOK)
+	rec = send(handler, http.MethodGet, "/self/password", nil)
+	assert.DeepEqual(t, "redirect from /self/password afterwards", rec.Header().Get("Location"), "/self")
+}
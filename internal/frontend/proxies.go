@@ -0,0 +1,29 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import "net/http"
+
+// If true, all cookies have the Secure flag and all generated links use
+// https, regardless of what the request looks like. This is set by
+// HTTPHandler() from PORTUNUS_SERVER_HTTP_SECURE.
+var forceSecureRequests bool
+
+// Returns whether the client used HTTPS for this request. This decides whether
+// cookies get the Secure flag, and which scheme generated links use.
+func isSecureRequest(r *http.Request) bool {
+	return forceSecureRequests || trustedProxies.IsHTTPS(r)
+}
+
+// Determines the client IP of each request once (see core.ClientIPOf), so that
+// all log messages for this request show the same address. This goes outside
+// of all other middlewares, including the access log.
+func clientIPMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner.ServeHTTP(w, trustedProxies.AddClientIP(r))
+	})
+}
@@ -0,0 +1,164 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// This is set by HTTPHandler(). It is a package variable because the banner
+// for read-only mode appears on every page.
+var currentReadOnlyState func() *core.ReadOnlyState
+
+// Returns the state of read-only mode, or nil if it is disabled.
+func readOnlyStateForBanner() *core.ReadOnlyState {
+	if currentReadOnlyState == nil {
+		return nil
+	}
+	return currentReadOnlyState()
+}
+
+// readOnlyMiddleware disables the submit buttons of all forms that would
+// change the database while read-only mode is enabled. The changes themselves
+// are refused by the nexus.
+func readOnlyMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnlyStateForBanner() != nil {
+			r = h.WithReadOnlyMode(r)
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+var readOnlyEnabledSnippet = h.NewSnippet(`
+	Portunus is in read-only mode since {{.EnabledAt.UTC.Format "2006-01-02 15:04"}} UTC.
+	{{- if .EnabledBy }}
+		It was enabled by <code>{{.EnabledBy}}</code> with the reason: {{.Reason}}
+	{{- else }}
+		It was {{.Reason}}.
+	{{- end }}
+`)
+
+var readOnlyDisabledSnippet = h.NewSnippet(`
+	In read-only mode, users and groups can be viewed, but nobody can change them, neither in the web GUI nor through the control API (e.g. with <code>portunusctl</code>).
+	This is useful to freeze the directory during maintenance, e.g. while migrating the LDAP server.
+	Read-only mode stays enabled until it is disabled again here, or until Portunus is restarted.
+`)
+
+func useReadOnlyForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		state := n.ReadOnly()
+		if state != nil {
+			i.FormSpec = &h.FormSpec{
+				PostTarget:          "/read-only/disable",
+				SubmitLabel:         "Disable read-only mode",
+				IgnoresReadOnlyMode: true,
+				Fields: []h.FormField{
+					h.StaticField{Value: readOnlyEnabledSnippet.Render(state)},
+				},
+			}
+			return
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:          "/read-only/enable",
+			SubmitLabel:         "Enable read-only mode",
+			IgnoresReadOnlyMode: true,
+			Fields: []h.FormField{
+				h.StaticField{Value: readOnlyDisabledSnippet.Render(nil)},
+				h.InputFieldSpec{
+					Name:      "reason",
+					Label:     "Reason (shown to all users)",
+					InputType: "text",
+					AutoFocus: true,
+				},
+			},
+		}
+	}
+}
+
+// Handles GET /read-only.
+func getReadOnlyHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useReadOnlyForm(n),
+		UseEmptyFormState,
+		ShowForm("Read-only mode"),
+	)
+}
+
+// Admins that impersonate another user cannot make changes, and the
+// impersonated user would appear as the one who toggled read-only mode.
+func refuseReadOnlyToggleWhileImpersonating(i *Interaction) {
+	if isImpersonating(i) {
+		i.RedirectWithFlashTo("/read-only", Flash{"danger", "No changes can be made while impersonating another user."})
+	}
+}
+
+// Handles POST /read-only/enable.
+func postReadOnlyEnableHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		refuseReadOnlyToggleWhileImpersonating,
+		useReadOnlyForm(n),
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			if fs.Fields["reason"] == nil {
+				//read-only mode was enabled in the meantime
+				i.RedirectTo("/read-only")
+				return
+			}
+			reason := strings.TrimSpace(fs.Fields["reason"].GetValueOrSetError())
+			if !fs.IsValid() {
+				return
+			}
+			n.SetReadOnly(&core.ReadOnlyState{
+				EnabledBy: i.CurrentUser.LoginName,
+				Reason:    reason,
+				EnabledAt: time.Now(),
+			})
+			logging.Info(logging.Fields{
+				"event":  "read_only_enabled",
+				"actor":  i.CurrentUser.LoginName,
+				"reason": reason,
+			}, "read-only mode enabled by %s", i.CurrentUser.LoginName)
+			i.RedirectWithFlashTo("/read-only", Flash{"success", "Read-only mode enabled."})
+		},
+		ShowFormIfErrors("Read-only mode"),
+	)
+}
+
+// Handles POST /read-only/disable.
+func postReadOnlyDisableHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		refuseReadOnlyToggleWhileImpersonating,
+		func(i *Interaction) {
+			if n.ReadOnly() != nil {
+				n.SetReadOnly(nil)
+				logging.Info(logging.Fields{
+					"event": "read_only_disabled",
+					"actor": i.CurrentUser.LoginName,
+				}, "read-only mode disabled by %s", i.CurrentUser.LoginName)
+			}
+			i.RedirectWithFlashTo("/read-only", Flash{"success", "Read-only mode disabled."})
+		},
+	)
+}
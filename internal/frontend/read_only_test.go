@@ -0,0 +1,101 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/control"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson"})
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true, "bob": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	controlHandler := ControlHandler(nexus, nil, nil)
+
+	cookie := loginCookieForTests(t, "jane")
+	get := func(path string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.DeepEqual(t, "status for GET "+path, rec.Code, http.StatusOK)
+		return rec.Body.String()
+	}
+	post := func(handler http.Handler, path string, form url.Values) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		//this is usually done by the CSRF middleware, which we bypass here
+		err := req.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		errorHandlingMiddleware(handler).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	//enabling read-only mode requires a reason
+	enableHandler := postReadOnlyEnableHandler(nexus)
+	assert.DeepEqual(t, "status for enabling without reason", post(enableHandler, "/read-only/enable", url.Values{"reason": {""}}), http.StatusOK)
+	assert.DeepEqual(t, "read-only mode after failed enable", nexus.ReadOnly(), (*core.ReadOnlyState)(nil))
+	assert.DeepEqual(t, "status for enabling", post(enableHandler, "/read-only/enable", url.Values{"reason": {"LDAP migration"}}), http.StatusSeeOther)
+	assert.DeepEqual(t, "read-only mode enabled by", nexus.ReadOnly().EnabledBy, "jane")
+
+	//all pages show a banner, and only forms that do not change the database can be submitted
+	body := get("/self")
+	assert.DeepEqual(t, "banner is shown", strings.Contains(body, "Portunus is in read-only mode: LDAP migration."), true)
+	assert.DeepEqual(t, "profile form is disabled", strings.Contains(body, `disabled>Update profile</button>`), true)
+	assert.DeepEqual(t, "sessions form is disabled", strings.Contains(body, `disabled>Sign out other sessions</button>`), false)
+
+	//changes through the control API are refused with 503
+	rec := httptest.NewRecorder()
+	controlHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/users/bob", http.NoBody))
+	assert.DeepEqual(t, "status for DELETE in read-only mode", rec.Code, http.StatusServiceUnavailable)
+	assert.DeepEqual(t, "Retry-After for DELETE in read-only mode", rec.Header().Get("Retry-After"), "60")
+	var resp control.ErrorResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if err != nil || len(resp.Errors) != 1 {
+		t.Fatalf("unexpected response body %q", rec.Body.String())
+	}
+	assert.DeepEqual(t, "error code for DELETE in read-only mode", resp.Errors[0].Code, control.ErrorCodeReadOnly)
+	_, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "bob" })
+	assert.DeepEqual(t, "bob exists in read-only mode", exists, true)
+
+	//after disabling read-only mode, everything works as usual
+	assert.DeepEqual(t, "status for disabling", post(postReadOnlyDisableHandler(nexus), "/read-only/disable", url.Values{}), http.StatusSeeOther)
+	body = get("/self")
+	assert.DeepEqual(t, "banner is shown after disabling", strings.Contains(body, "Portunus is in read-only mode"), false)
+	assert.DeepEqual(t, "profile form is disabled after disabling", strings.Contains(body, `disabled>Update profile</button>`), false)
+	rec = httptest.NewRecorder()
+	controlHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/users/bob", http.NoBody))
+	assert.DeepEqual(t, "status for DELETE after disabling", rec.Code, http.StatusNoContent)
+}
@@ -0,0 +1,302 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var renameUserButtonSnippet = h.NewSnippet(`
+	<p><a href="/users/{{.}}/rename" class="button button-secondary">Rename</a></p>
+`)
+
+var renameGroupButtonSnippet = h.NewSnippet(`
+	<p><a href="/groups/{{.}}/rename" class="button button-secondary">Rename</a></p>
+`)
+
+var renameUserConfirmSnippet = h.NewSnippet(`
+	<p>
+		Rename user <code>{{.LoginName}}</code>?
+		The user keeps all their other attributes, their password, their group memberships and their group ownerships.
+		The user is logged out of Portunus, and needs to log in with the new login name from now on.
+	</p>
+	{{- with .MemberOf }}
+		<p>
+			The membership in {{len .}} group(s) will be updated:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
+	{{- with .OwnerOf }}
+		<p>
+			The ownership of {{len .}} group(s) will be updated:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
+	<p>
+		In LDAP, the user object is recreated under the new DN, and all references to it are updated.
+		Applications that store login names or DNs by themselves need to be updated separately.
+		For {{.Retention}}, creating another user with the old login name shows a warning, since those applications might confuse that user with this one.
+	</p>
+`)
+
+var renameGroupConfirmSnippet = h.NewSnippet(`
+	<p>
+		Rename group <code>{{.Name}}</code>?
+		The group keeps all its other attributes, its members and its owners.
+		{{- if .MemberCount }} In LDAP, the group object is recreated under the new DN, and the <code>isMemberOf</code> attribute of its {{.MemberCount}} member(s) is updated.{{ end }}
+		Applications that store group names or DNs by themselves need to be updated separately.
+	</p>
+	{{- with .ApprovedGroupNames }}
+		<p>
+			The elevation policies of {{len .}} group(s) will be updated to refer to the new name:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
+`)
+
+// Elevations refer to users and groups by name, so they cannot survive a
+// rename. Returns an error message if there are any elevations that have not
+// ended yet and that match the given predicate.
+func checkOpenElevationsBeforeRename(kind, name string, predicate func(core.Elevation) bool) string {
+	if elevationManager == nil {
+		return ""
+	}
+	count := 0
+	for _, e := range elevationManager.List() {
+		if e.State != core.ElevationEnded && predicate(e) {
+			count++
+		}
+	}
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %q cannot be renamed while %d elevation(s) for it are pending or active. Please wait for them to end, or revoke them.", kind, name, count)
+}
+
+// Builds a warning if the given login name belonged to another user before
+// that user was renamed (see core.FormerLoginName). This must be called
+// within an UpdateAction.
+func warnAboutReusedLoginName(db *core.Database, i *Interaction, loginName string) {
+	former, record, exists := db.FindFormerOwnerOfLoginName(loginName, time.Now())
+	if !exists || former.LoginName == loginName {
+		return
+	}
+	i.LoginNameReuseWarning = fmt.Sprintf(
+		"The login name %q belonged to user %q until %s. Applications that store login names by themselves might confuse these users.",
+		record.LoginName, former.LoginName, record.RenamedAt.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+func useRenameUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		editURL := "/users/" + i.TargetUser.LoginName + "/edit"
+		if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+			i.RedirectWithFlashTo(editURL, Flash{"danger", "You cannot rename yourself."})
+			return
+		}
+		msg := checkOpenElevationsBeforeRename("User", i.TargetUser.LoginName, func(e core.Elevation) bool {
+			return e.LoginName == i.TargetUser.LoginName
+		})
+		if msg != "" {
+			i.RedirectWithFlashTo(editURL, Flash{"danger", msg})
+			return
+		}
+
+		data := struct {
+			LoginName string
+			MemberOf  []string
+			OwnerOf   []string
+			Retention time.Duration
+		}{LoginName: i.TargetUser.LoginName, Retention: deletedUserRetention}
+		groups := n.ListGroups()
+		for _, group := range groups {
+			if group.ContainsUser(*i.TargetUser) {
+				data.MemberOf = append(data.MemberOf, group.Name)
+			}
+			if group.IsOwnedBy(i.TargetUser.LoginName) {
+				data.OwnerOf = append(data.OwnerOf, group.Name)
+			}
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/users/" + i.TargetUser.LoginName + "/rename",
+			SubmitLabel: "Rename user",
+			Fields: []h.FormField{
+				h.StaticField{Value: renameUserConfirmSnippet.Render(data)},
+				h.InputFieldSpec{
+					Name:      "login_name",
+					Label:     "New login name",
+					InputType: "text",
+					AutoFocus: true,
+				},
+				h.HiddenFieldSpec{Name: "revision"},
+			},
+		}
+		i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+			"login_name": {Value: i.TargetUser.LoginName},
+			//the list of affected groups is only correct for this revision of the user
+			"revision": {Value: core.UserRevision(*i.TargetUser, groups)},
+		}}
+	}
+}
+
+// Handles GET /users/:uid/rename.
+func getUserRenameHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useRenameUserForm(n),
+		ShowForm("Rename user"),
+	)
+}
+
+// Handles POST /users/:uid/rename.
+func postUserRenameHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useRenameUserForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeRenameUser),
+		ReloadFormAfterConcurrentModification(loadTargetUser(n), useRenameUserForm(n)),
+		ShowFormIfErrors("Rename user"),
+		func(i *Interaction) {
+			msg := fmt.Sprintf("Renamed user %q to %q.", i.TargetUser.LoginName, i.TargetRef.Name)
+			flash := Flash{"success", msg}
+			if i.LoginNameReuseWarning != "" {
+				flash = Flash{"warning", msg + " " + i.LoginNameReuseWarning}
+			}
+			i.RedirectWithFlashTo("/users/"+i.TargetRef.Name+"/edit", flash)
+		},
+	)
+}
+
+func executeRenameUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	if err := verifyUserRevision(db, i); err != nil {
+		return errext.ErrorSet{err}
+	}
+	newLoginName := strings.TrimSpace(i.FormState.Fields["login_name"].GetValueOrSetError())
+	if newLoginName == "" {
+		return nil
+	}
+	//validation errors for the new login name shall be shown on the form field
+	i.TargetRef = core.User{LoginName: newLoginName}.Ref()
+	errs.Add(db.RenameUser(i.TargetUser.LoginName, newLoginName, i.CurrentUser.LoginName, time.Now(), deletedUserRetention))
+	warnAboutReusedLoginName(db, i, newLoginName)
+	return errs
+}
+
+func useRenameGroupForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		editURL := "/groups/" + i.TargetGroup.Name + "/edit"
+		msg := checkOpenElevationsBeforeRename("Group", i.TargetGroup.Name, func(e core.Elevation) bool {
+			return e.GroupName == i.TargetGroup.Name
+		})
+		if msg != "" {
+			i.RedirectWithFlashTo(editURL, Flash{"danger", msg})
+			return
+		}
+
+		data := struct {
+			Name               string
+			MemberCount        int
+			ApprovedGroupNames []string
+		}{Name: i.TargetGroup.Name, MemberCount: len(i.TargetGroup.MemberLoginNames)}
+		for _, group := range n.ListGroups() {
+			if group.Elevation != nil && group.Elevation.ApproverGroupName == i.TargetGroup.Name {
+				data.ApprovedGroupNames = append(data.ApprovedGroupNames, group.Name)
+			}
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/groups/" + i.TargetGroup.Name + "/rename",
+			SubmitLabel: "Rename group",
+			Fields: []h.FormField{
+				h.StaticField{Value: renameGroupConfirmSnippet.Render(data)},
+				h.InputFieldSpec{
+					Name:      "name",
+					Label:     "New name",
+					InputType: "text",
+					AutoFocus: true,
+				},
+				h.HiddenFieldSpec{Name: "revision"},
+			},
+		}
+		i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+			"name":     {Value: i.TargetGroup.Name},
+			"revision": {Value: core.GroupRevision(*i.TargetGroup)},
+		}}
+	}
+}
+
+// Handles GET /groups/:name/rename.
+func getGroupRenameHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useRenameGroupForm(n),
+		ShowForm("Rename group"),
+	)
+}
+
+// Handles POST /groups/:name/rename.
+func postGroupRenameHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useRenameGroupForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeRenameGroup),
+		ReloadFormAfterConcurrentModification(loadTargetGroup(n), useRenameGroupForm(n)),
+		ShowFormIfErrors("Rename group"),
+		func(i *Interaction) {
+			msg := fmt.Sprintf("Renamed group %q to %q.", i.TargetGroup.Name, i.TargetRef.Name)
+			i.RedirectWithFlashTo("/groups/"+i.TargetRef.Name+"/edit", Flash{"success", msg})
+		},
+	)
+}
+
+func executeRenameGroup(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	if err := verifyGroupRevision(db, i); err != nil {
+		return errext.ErrorSet{err}
+	}
+	newName := strings.TrimSpace(i.FormState.Fields["name"].GetValueOrSetError())
+	if newName == "" {
+		return nil
+	}
+	//validation errors for the new name shall be shown on the form field
+	i.TargetRef = core.Group{Name: newName}.Ref()
+	errs.Add(db.RenameGroup(i.TargetGroup.Name, newName))
+	return errs
+}
@@ -0,0 +1,100 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// This is set by HTTPHandler(). It is a package variable because the
+// navigation bar and the metrics endpoint need it.
+var seedCorrections *core.SeedCorrectionTracker
+
+func listSeedCorrections() []core.SeedCorrectionStats {
+	if seedCorrections == nil {
+		return nil
+	}
+	return seedCorrections.List(time.Now())
+}
+
+// Handles GET /seed-corrections.
+func getSeedCorrectionsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(seedCorrectionsList),
+	)
+}
+
+var seedCorrectionsListSnippet = h.NewSnippet(`
+	<p>
+		The objects listed below were changed in a way that contradicts the seed, and the seed silently reverted the change.
+		If an object keeps getting corrected, something (e.g. a script or another admin) is fighting against the seed.
+		Objects are marked as fighting when they were corrected more than {{.Threshold}} times within {{.Window}}.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Object</th>
+				<th>Last correction</th>
+				<th>Last corrected at</th>
+				<th>Last changed by</th>
+				<th>Within {{.Window}}</th>
+				<th>Since startup</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Stats}}
+				<tr>
+					<td data-label="Object">
+						{{.Object.Type}} <code>{{.Object.Name}}</code>
+						{{if .IsFighting}}<strong>(fighting)</strong>{{end}}
+					</td>
+					{{ if .LastCorrection.Field -}}
+						<td data-label="Last correction">reverted <code>{{.LastCorrection.Field}}</code></td>
+					{{- else -}}
+						<td data-label="Last correction">recreated after deletion</td>
+					{{- end }}
+					<td data-label="Last corrected at">{{.LastCorrection.Time.UTC.Format "2006-01-02 15:04:05"}} UTC</td>
+					{{ if .LastCorrection.Actor -}}
+						<td data-label="Last changed by"><code>{{.LastCorrection.Actor}}</code></td>
+					{{- else -}}
+						<td data-label="Last changed by" class="text-muted">Unknown</td>
+					{{- end }}
+					<td data-label="Within {{$.Window}}">{{.Recent}}</td>
+					<td data-label="Since startup">{{.Total}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="6" class="text-muted">No corrections since startup.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func seedCorrectionsList(i *Interaction) Page {
+	data := struct {
+		Stats     []core.SeedCorrectionStats
+		Threshold int
+		Window    time.Duration
+	}{Stats: listSeedCorrections()}
+	if seedCorrections != nil {
+		data.Threshold = seedCorrections.Threshold
+		data.Window = seedCorrections.Window
+	}
+
+	return Page{
+		Status:   http.StatusOK,
+		Title:    "Seed corrections",
+		Contents: seedCorrectionsListSnippet.Render(data),
+		Wide:     true,
+	}
+}
@@ -7,19 +7,29 @@
 package frontend
 
 import (
+	"fmt"
+	"mime"
 	"net/http"
-	"sort"
-	"strings"
+	"time"
+	"unicode/utf8"
 
+	goldap "github.com/go-ldap/ldap/v3"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
 	"github.com/sapcc/go-bits/errext"
 )
 
-// TODO: allow flipped order (family name first)
+// This follows the same rules as core.User.FullName().
 var userFullNameSnippet = h.NewSnippet(`
-	<span class="given-name">{{.GivenName}}</span> <span class="family-name">{{.FamilyName}}</span>
+	{{- if not .FamilyName -}}
+		<span class="given-name">{{.GivenName}}</span>
+	{{- else if .FamilyNameFirst -}}
+		<span class="family-name">{{.FamilyName}}</span> <span class="given-name">{{.GivenName}}</span>
+	{{- else -}}
+		<span class="given-name">{{.GivenName}}</span> <span class="family-name">{{.FamilyName}}</span>
+	{{- end -}}
 `)
 var userEMailAddressSnippet = h.NewSnippet(`
 	{{if .EMailAddress}}{{.EMailAddress}}{{else}}<em>Not specified</em>{{end}}
@@ -35,9 +45,7 @@ func useSelfServiceForm(n core.Nexus) HandlerStep {
 		if isAdmin {
 			visibleGroups = n.ListGroups()
 		}
-		sort.Slice(visibleGroups, func(i, j int) bool {
-			return visibleGroups[i].LongName < visibleGroups[j].LongName
-		})
+		collationFor(i.Req).SortGroups(visibleGroups)
 
 		var memberships []h.SelectOptionSpec
 		isSelected := make(map[string]bool)
@@ -55,15 +63,38 @@ func useSelfServiceForm(n core.Nexus) HandlerStep {
 				"memberships": {
 					Selected: isSelected,
 				},
-				"ssh_public_keys": {
-					Value: strings.Join(user.SSHPublicKeys, "\r\n"),
-				},
+				"phone":              {Value: user.Phone},
+				"mobile_phone":       {Value: user.MobilePhone},
+				"preferred_language": {Value: user.PreferredLanguage},
+				"timezone":           {Value: user.Timezone},
 			},
 		}
 
+		var passwordFields []h.FormField
+		if needsOldPassword(i) {
+			passwordFields = append(passwordFields, h.InputFieldSpec{
+				InputType: "password",
+				Name:      "old_password",
+				Label:     "Old password",
+			})
+		}
+		passwordFields = append(passwordFields,
+			h.InputFieldSpec{
+				InputType: "password",
+				Name:      "new_password",
+				Label:     "New password",
+			},
+			h.InputFieldSpec{
+				InputType: "password",
+				Name:      "repeat_password",
+				Label:     "Repeat password",
+			},
+		)
+
 		i.FormSpec = &h.FormSpec{
 			PostTarget:  "/self",
 			SubmitLabel: "Update profile",
+			IsMultipart: true,
 			Fields: []h.FormField{
 				h.StaticField{
 					Label: "Login name",
@@ -77,49 +108,63 @@ func useSelfServiceForm(n core.Nexus) HandlerStep {
 					Label: "Email address",
 					Value: userEMailAddressSnippet.Render(user),
 				},
+				h.InputFieldSpec{
+					InputType: "tel",
+					Name:      "phone",
+					Label:     "Phone number (optional)",
+				},
+				h.InputFieldSpec{
+					InputType: "tel",
+					Name:      "mobile_phone",
+					Label:     "Mobile phone number (optional)",
+				},
+				h.InputFieldSpec{
+					InputType: "text",
+					Name:      "preferred_language",
+					Label:     "Preferred language (optional; a language tag like \"en\" or \"de-CH\")",
+				},
+				h.InputFieldSpec{
+					InputType: "text",
+					Name:      "timezone",
+					Label:     "Time zone (optional; a name like \"Europe/Berlin\")",
+				},
+				h.StaticField{
+					Label: "LDAP entry",
+					Value: selfLDAPLinkSnippet.Render(nil),
+				},
 				h.SelectFieldSpec{
 					Name:     "memberships",
 					Label:    "Group memberships",
 					Options:  memberships,
 					ReadOnly: true,
 				},
-				h.MultilineInputFieldSpec{
-					Name:  "ssh_public_keys",
-					Label: "SSH public key(s)",
+				h.FieldSet{
+					Label:      "Photo",
+					Fields:     buildUserPhotoFields(&user.User, true),
+					IsFoldable: false,
 				},
 				h.FieldSet{
 					Name:       "change_password",
 					Label:      "Change password",
 					IsFoldable: true,
-					Fields: []h.FormField{
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "old_password",
-							Label:     "Old password",
-						},
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "new_password",
-							Label:     "New password",
-						},
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "repeat_password",
-							Label:     "Repeat password",
-						},
-					},
+					Fields:     passwordFields,
 				},
 			},
 		}
 	}
 }
 
+// Returns whether the user needs to enter their old password to set a new one.
+func needsOldPassword(i *Interaction) bool {
+	return !(isProxyAuthenticated(i) && proxyAuth.SkipOldPasswordCheck)
+}
+
 func getSelfHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		useSelfServiceForm(n),
-		ShowForm("My profile"),
+		showSelfServicePage,
 	)
 }
 
@@ -131,19 +176,84 @@ func postSelfHandler(n core.Nexus) http.Handler {
 		ReadFormStateFromRequest,
 		validateSelfServiceForm(n),
 		TryUpdateNexus(n, executeSelfService),
-		ShowFormIfErrors("My profile"),
+		showSelfServicePageIfErrors,
+		revokeOtherSessionsOnPasswordChange,
 		RedirectWithFlashTo("/self", "Updated"),
 	)
 }
 
+// Like ShowForm("My profile"), but also renders the list of SSH public keys and
+// the forms for signing out other sessions and for forgetting devices below the
+// profile form.
+func showSelfServicePage(i *Interaction) {
+	sessionsForm := h.FormSpec{
+		PostTarget:          "/self/sessions",
+		SubmitLabel:         "Sign out other sessions",
+		IgnoresReadOnlyMode: true,
+		Fields: []h.FormField{
+			h.StaticField{
+				Label: "Active sessions",
+				Value: activeSessionsSnippet.Render(sessionTracker.CountSessionsOfUser(i.CurrentUser.LoginName)),
+			},
+		},
+	}
+	contents := i.FormSpec.Render(i.Req, *i.FormState) + renderSelfSSHKeys(i) + sessionsForm.Render(i.Req, h.FormState{})
+	if devicesForm := buildDevicesForm(i); devicesForm != nil {
+		contents += devicesForm.Render(i.Req, h.FormState{})
+	}
+	Page{
+		Status:   http.StatusOK,
+		Title:    "My profile",
+		Contents: contents,
+	}.Render(i.writer, i.Req, i.CurrentUser, i.Session)
+	i.writer = nil
+}
+
+var selfLDAPLinkSnippet = h.NewSnippet(`
+	<a href="/self/ldap">Show how my account appears in LDAP</a>
+`)
+
+var activeSessionsSnippet = h.NewSnippet(`
+	{{.}} (including this one)
+`)
+
+func showSelfServicePageIfErrors(i *Interaction) {
+	if !i.FormState.IsValid() && !reportFormErrorsAsJSON(i) {
+		showSelfServicePage(i)
+	}
+}
+
+func revokeOtherSessionsOnPasswordChange(i *Interaction) {
+	if i.FormState.Fields["change_password"].IsUnfolded {
+		sessionTracker.DeleteSessionsOfUser(i.CurrentUser.LoginName, currentSessionID(i))
+	}
+}
+
+// Handles POST /self/sessions.
+func postSelfSessionsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			loginName := i.CurrentUser.LoginName
+			count := sessionTracker.CountSessionsOfUser(loginName) - 1
+			sessionTracker.DeleteSessionsOfUser(loginName, currentSessionID(i))
+			msg := fmt.Sprintf("Signed out %d other session(s).", count)
+			i.RedirectWithFlashTo("/self", Flash{"success", msg})
+		},
+	)
+}
+
 func validateSelfServiceForm(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		fs := i.FormState
 
 		if fs.Fields["change_password"].IsUnfolded {
-			oldPassword := fs.Fields["old_password"].GetValueOrSetError()
-			if oldPassword != "" && !n.PasswordHasher().CheckPasswordHash(oldPassword, i.CurrentUser.PasswordHash) {
-				fs.Fields["old_password"].ErrorMessage = "is not correct"
+			if needsOldPassword(i) {
+				oldPassword := fs.Fields["old_password"].GetValueOrSetError()
+				if oldPassword != "" && !n.PasswordHasher().CheckPasswordHash(oldPassword, i.CurrentUser.PasswordHash) {
+					fs.Fields["old_password"].ErrorMessage = "is not correct"
+				}
 			}
 
 			newPassword1 := fs.Fields["new_password"].GetValueOrSetError()
@@ -163,9 +273,126 @@ func executeSelfService(db *core.Database, i *Interaction, hasher crypt.Password
 		}
 		if fs.Fields["change_password"].IsUnfolded {
 			user.PasswordHash = hasher.HashPassword(fs.Fields["new_password"].Value)
+			user.MustChangePassword = false
 		}
-		user.SSHPublicKeys = core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value)
+		user.Phone = fs.Fields["phone"].Value
+		user.MobilePhone = fs.Fields["mobile_phone"].Value
+		user.PreferredLanguage = fs.Fields["preferred_language"].Value
+		user.Timezone = fs.Fields["timezone"].Value
+		photo, err := readUserPhotoFromFormState(fs, user.Photo, user.Ref().Field("photo"))
+		errs.Add(err)
+		user.Photo = photo
 		db.Users[idx] = user //`user` copies by value, so we need to write the changes back explicitly
 	}
 	return
 }
+
+// Returns the LDAP entry of the current user as it is written into the LDAP
+// server, except for the password hash.
+func renderSelfLDAPEntry(n core.Nexus, i *Interaction) goldap.AddRequest {
+	req := ldap.RenderUserEntry(i.CurrentUser.User, ldapSuffix, ldapOUNames, currentLDAPUserLayout(), n.ListGroups(), time.Now(), ldapHideTempPasswords)
+	attrs := make([]goldap.Attribute, 0, len(req.Attributes))
+	for _, attr := range req.Attributes {
+		if attr.Type != "userPassword" {
+			attrs = append(attrs, attr)
+		}
+	}
+	req.Attributes = attrs
+	return req
+}
+
+// Handles GET /self/ldap.
+func getSelfLDAPHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		ShowView(selfLDAPEntryView(n)),
+	)
+}
+
+var selfLDAPEntrySnippet = h.NewSnippet(`
+	<p>
+		This is your user account as it appears in the LDAP directory.
+		Your password hash is not shown.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Attribute</th>
+				<th>Value</th>
+			</tr>
+		</thead>
+		<tbody>
+			<tr>
+				<td data-label="Attribute"><code>dn</code></td>
+				<td data-label="Value"><code>{{.DN}}</code></td>
+			</tr>
+			{{range .Values}}
+				<tr>
+					<td data-label="Attribute"><code>{{.Type}}</code></td>
+					{{ if .IsBinary -}}
+						<td data-label="Value" class="text-muted">Binary data ({{.Size}} bytes)</td>
+					{{- else -}}
+						<td data-label="Value"><code>{{.Value}}</code></td>
+					{{- end }}
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+	<div class="button-row">
+		<a href="/self/ldap.ldif" class="button button-primary">Download as LDIF</a>
+		<a href="/self" class="button">Back to my profile</a>
+	</div>
+`)
+
+func selfLDAPEntryView(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		type attributeValue struct {
+			Type     string
+			Value    string
+			IsBinary bool
+			Size     int
+		}
+		req := renderSelfLDAPEntry(n, i)
+		var values []attributeValue
+		for _, attr := range req.Attributes {
+			for _, value := range attr.Vals {
+				values = append(values, attributeValue{
+					Type:     attr.Type,
+					Value:    value,
+					IsBinary: !utf8.ValidString(value),
+					Size:     len(value),
+				})
+			}
+		}
+
+		return Page{
+			Status: http.StatusOK,
+			Title:  "My LDAP entry",
+			Contents: selfLDAPEntrySnippet.Render(struct {
+				DN     string
+				Values []attributeValue
+			}{req.DN, values}),
+			Wide: true,
+		}
+	}
+}
+
+// Handles GET /self/ldap.ldif.
+func getSelfLDIFHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			buf := ldap.MarshalLDIF(renderSelfLDAPEntry(n, i))
+			filename := i.CurrentUser.LoginName + ".ldif"
+			hdr := i.writer.Header()
+			hdr.Set("Content-Type", "text/x-ldif; charset=utf-8")
+			hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			hdr.Set("Cache-Control", "no-store")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(buf)
+			i.writer = nil
+		},
+	)
+}
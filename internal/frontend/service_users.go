@@ -0,0 +1,285 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func getServiceUsersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(serviceUsersList(n)),
+	)
+}
+
+var serviceUsersListSnippet = h.NewSnippet(`
+	<p>
+		Service users are bind accounts for applications that need to read from the LDAP directory.
+		They can bind and read, but cannot log into Portunus and cannot be put into groups.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Description</th>
+				<th class="actions">
+					<a href="/service-users/new" class="button button-primary">New service user</a>
+				</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="Name"><code>{{.Name}}</code></td>
+					<td data-label="Description">{{.Description}}</td>
+					<td class="actions">
+						<a href="/service-users/{{.Name}}/edit">Edit</a>
+						·
+						<a href="/service-users/{{.Name}}/delete">Delete</a>
+					</td>
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func serviceUsersList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		//service users are identified by their name only, so the sort order
+		//established by Database.Normalize() is good enough
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Service users",
+			Contents: serviceUsersListSnippet.Render(n.ListServiceUsers()),
+			Wide:     true,
+		}
+	}
+}
+
+func useServiceUserForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{}
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{},
+	}
+
+	s := i.TargetServiceUser
+	if s == nil {
+		i.FormSpec.PostTarget = "/service-users/new"
+		i.FormSpec.SubmitLabel = "Create service user"
+		i.FormSpec.Fields = append(i.FormSpec.Fields, h.InputFieldSpec{
+			InputType: "text",
+			Name:      "name",
+			Label:     "Name",
+		})
+	} else {
+		i.FormSpec.PostTarget = "/service-users/" + s.Name + "/edit"
+		i.FormSpec.SubmitLabel = "Save"
+		i.FormSpec.Fields = append(i.FormSpec.Fields, h.StaticField{
+			Label: "Name",
+			Value: codeTagSnippet.Render(s.Name),
+		})
+		i.FormState.Fields["description"] = &h.FieldState{Value: s.Description}
+	}
+
+	i.FormSpec.Fields = append(i.FormSpec.Fields,
+		h.InputFieldSpec{
+			InputType: "text",
+			Name:      "description",
+			Label:     "Description (optional)",
+		},
+		buildServiceUserPasswordFieldset(s),
+	)
+}
+
+func buildServiceUserPasswordFieldset(s *core.ServiceUser) h.FormField {
+	fields := []h.FormField{
+		h.InputFieldSpec{
+			InputType:        "password",
+			Name:             "password",
+			Label:            "Password",
+			AutocompleteMode: "new-password",
+		},
+		h.InputFieldSpec{
+			InputType:        "password",
+			Name:             "repeat_password",
+			Label:            "Repeat password",
+			AutocompleteMode: "new-password",
+		},
+	}
+
+	if s == nil {
+		return h.FieldSet{
+			Label:      "Password",
+			IsFoldable: false,
+			Fields:     fields,
+		}
+	}
+	return h.FieldSet{
+		Name:       "reset_password",
+		Label:      "Rotate password",
+		IsFoldable: true,
+		Fields:     fields,
+	}
+}
+
+func validateServiceUserForm(i *Interaction) {
+	fs := i.FormState
+	if i.TargetServiceUser == nil || fs.Fields["reset_password"].IsUnfolded {
+		password1 := fs.Fields["password"].GetValueOrSetError()
+		password2 := fs.Fields["repeat_password"].GetValueOrSetError()
+		if password2 != "" && password1 != password2 {
+			fs.Fields["repeat_password"].ErrorMessage = "did not match"
+		}
+	}
+}
+
+func loadTargetServiceUser(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		name := mux.Vars(i.Req)["name"]
+		serviceUser, exists := n.FindServiceUser(func(s core.ServiceUser) bool { return s.Name == name })
+		if exists {
+			i.TargetServiceUser = &serviceUser
+			i.TargetRef = serviceUser.Ref()
+		} else {
+			msg := fmt.Sprintf("Service user %q does not exist.", name)
+			i.RedirectWithFlashTo("/service-users", Flash{"danger", msg})
+		}
+	}
+}
+
+func getServiceUserEditHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceUser(n),
+		useServiceUserForm,
+		ShowForm("Edit service user"),
+	)
+}
+
+func postServiceUserEditHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceUser(n),
+		useServiceUserForm,
+		ReadFormStateFromRequest,
+		validateServiceUserForm,
+		TryUpdateNexus(n, executeEditServiceUser),
+		ShowFormIfErrors("Edit service user"),
+		RedirectWithFlashTo("/service-users", "Updated"),
+	)
+}
+
+func executeEditServiceUser(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
+	newServiceUser := core.ServiceUser{
+		Name:         i.TargetServiceUser.Name,
+		Description:  i.FormState.Fields["description"].Value,
+		PasswordHash: i.TargetServiceUser.PasswordHash,
+	}
+	if i.FormState.Fields["reset_password"].IsUnfolded {
+		if pw := i.FormState.Fields["password"].Value; pw != "" {
+			newServiceUser.PasswordHash = hasher.HashPassword(pw)
+		}
+	}
+	errs.Add(db.ServiceUsers.Update(newServiceUser))
+	return
+}
+
+func getServiceUsersNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useServiceUserForm,
+		ShowForm("Create service user"),
+	)
+}
+
+func postServiceUsersNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useServiceUserForm,
+		ReadFormStateFromRequest,
+		validateServiceUserForm,
+		TryUpdateNexus(n, executeCreateServiceUser),
+		ShowFormIfErrors("Create service user"),
+		RedirectWithFlashTo("/service-users", "Created"),
+	)
+}
+
+func executeCreateServiceUser(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
+	newServiceUser := core.ServiceUser{
+		Name:         i.FormState.Fields["name"].Value,
+		Description:  i.FormState.Fields["description"].Value,
+		PasswordHash: hasher.HashPassword(i.FormState.Fields["password"].Value),
+	}
+	i.TargetRef = newServiceUser.Ref()
+	db.ServiceUsers = append(db.ServiceUsers, newServiceUser)
+	return nil
+}
+
+func getServiceUserDeleteHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceUser(n),
+		useDeleteServiceUserForm,
+		UseEmptyFormState,
+		ShowForm("Confirm service user deletion"),
+	)
+}
+
+var deleteServiceUserConfirmSnippet = h.NewSnippet(`
+	<p>Really delete service user <code>{{.}}</code>? Applications using it will not be able to bind anymore. This cannot be undone.</p>
+`)
+
+func useDeleteServiceUserForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/service-users/" + i.TargetServiceUser.Name + "/delete",
+		SubmitLabel: "Delete service user",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: deleteServiceUserConfirmSnippet.Render(i.TargetServiceUser.Name),
+			},
+		},
+	}
+}
+
+func postServiceUserDeleteHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceUser(n),
+		useDeleteServiceUserForm,
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeDeleteServiceUser),
+		ShowFormIfErrors("Confirm service user deletion"),
+		RedirectWithFlashTo("/service-users", "Deleted"),
+	)
+}
+
+func executeDeleteServiceUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	errs.Add(db.ServiceUsers.Delete(i.TargetServiceUser.Name))
+	return
+}
@@ -0,0 +1,365 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// SessionStore tracks login sessions on the server side. The session cookie
+// only carries the session ID, so sessions can be invalidated by the server
+// (e.g. when the user's password changes) regardless of what the browser
+// does with its cookies.
+//
+// The in-memory implementation is the only one for now. Deployments with
+// multiple replicas would need an implementation backed by shared storage.
+type SessionStore interface {
+	// NewSession creates a session with the given properties and returns its ID.
+	NewSession(info SessionInfo) (sessionID string)
+	// CheckSession returns information about the given session and resets its
+	// idle timer. If the session does not exist or has expired, false is returned.
+	CheckSession(sessionID string) (info SessionInfo, ok bool)
+	// CountSessionsOfUser returns how many sessions of this user are valid.
+	CountSessionsOfUser(loginName string) int
+	// DeleteSession invalidates the given session.
+	DeleteSession(sessionID string)
+	// DeleteSessionsOfUser invalidates all sessions of the given user except
+	// for the one with the given ID (which may be empty to delete all sessions).
+	DeleteSessionsOfUser(loginName, exceptSessionID string)
+	// DeleteSessionsOfDevice invalidates all sessions of the given user that
+	// were started on the given device.
+	DeleteSessionsOfDevice(loginName, deviceID string)
+	// DeleteSessionsOfUnknownUsers invalidates all sessions of users that are
+	// not in the given set (including impersonation sessions started by those
+	// users), and returns how many sessions were invalidated.
+	DeleteSessionsOfUnknownUsers(knownLoginNames map[string]bool) int
+	// SaveTo writes all valid sessions into the given file, so that they can be
+	// restored after a restart.
+	SaveTo(path string) error
+	// RestoreFrom loads the sessions from a file written by SaveTo(), and
+	// returns how many valid sessions were restored. The file is removed
+	// afterwards, so that it cannot bring back sessions that end while this
+	// process is running.
+	RestoreFrom(path string) (int, error)
+}
+
+// SessionInfo describes a valid login session.
+type SessionInfo struct {
+	LoginName string
+	//if not empty, the admin with this login name is viewing Portunus as the
+	//user identified by LoginName (see impersonation.go)
+	ImpersonatedBy string
+	//if not empty, the session was started by a login on this device (see devices.go)
+	DeviceID string
+}
+
+// SessionConfig contains the expiry rules for login sessions.
+type SessionConfig struct {
+	Lifetime    time.Duration //from PORTUNUS_SERVER_SESSION_LIFETIME
+	IdleTimeout time.Duration //from PORTUNUS_SERVER_SESSION_IDLE_TIMEOUT
+}
+
+// NewInMemorySessionStore builds a SessionStore that holds all sessions in
+// memory. Sessions only survive a restart if they are handed over through
+// SaveTo() and RestoreFrom().
+func NewInMemorySessionStore(cfg SessionConfig) SessionStore {
+	return &memorySessionStore{
+		cfg:      cfg,
+		now:      time.Now,
+		sessions: make(map[string]sessionRecord),
+	}
+}
+
+type memorySessionStore struct {
+	cfg SessionConfig
+	now func() time.Time //can be swapped in tests
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex sync.Mutex
+	//keyed by hashSessionID(), so that the session IDs do not end up on disk
+	sessions map[string]sessionRecord
+}
+
+type sessionRecord struct {
+	SessionInfo
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// Session IDs are only held in hashed form. They are random and long enough
+// that a plain hash without salt is fine.
+func hashSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r sessionRecord) isValidAt(now time.Time, cfg SessionConfig) bool {
+	return now.Before(r.CreatedAt.Add(cfg.Lifetime)) && now.Before(r.LastSeenAt.Add(cfg.IdleTimeout))
+}
+
+// NewSession implements the SessionStore interface.
+func (s *memorySessionStore) NewSession(info SessionInfo) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	//this is a convenient time to garbage-collect expired sessions
+	now := s.now()
+	for id, record := range s.sessions {
+		if !record.isValidAt(now, s.cfg) {
+			delete(s.sessions, id)
+		}
+	}
+
+	id := hex.EncodeToString(core.GenerateRandomKey(32))
+	s.sessions[hashSessionID(id)] = sessionRecord{
+		SessionInfo: info,
+		CreatedAt:   now,
+		LastSeenAt:  now,
+	}
+	return id
+}
+
+// CheckSession implements the SessionStore interface.
+func (s *memorySessionStore) CheckSession(sessionID string) (SessionInfo, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := hashSessionID(sessionID)
+	record, exists := s.sessions[key]
+	if !exists {
+		return SessionInfo{}, false
+	}
+	now := s.now()
+	if !record.isValidAt(now, s.cfg) {
+		delete(s.sessions, key)
+		return SessionInfo{}, false
+	}
+	record.LastSeenAt = now
+	s.sessions[key] = record
+	return record.SessionInfo, true
+}
+
+// CountSessionsOfUser implements the SessionStore interface.
+func (s *memorySessionStore) CountSessionsOfUser(loginName string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	count := 0
+	for _, record := range s.sessions {
+		if record.LoginName == loginName && record.isValidAt(now, s.cfg) {
+			count++
+		}
+	}
+	return count
+}
+
+// DeleteSession implements the SessionStore interface.
+func (s *memorySessionStore) DeleteSession(sessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, hashSessionID(sessionID))
+}
+
+// DeleteSessionsOfUser implements the SessionStore interface.
+func (s *memorySessionStore) DeleteSessionsOfUser(loginName, exceptSessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	exceptKey := ""
+	if exceptSessionID != "" {
+		exceptKey = hashSessionID(exceptSessionID)
+	}
+	for key, record := range s.sessions {
+		if record.LoginName == loginName && key != exceptKey {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// DeleteSessionsOfDevice implements the SessionStore interface.
+func (s *memorySessionStore) DeleteSessionsOfDevice(loginName, deviceID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, record := range s.sessions {
+		if record.LoginName == loginName && record.DeviceID == deviceID {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// DeleteSessionsOfUnknownUsers implements the SessionStore interface.
+func (s *memorySessionStore) DeleteSessionsOfUnknownUsers(knownLoginNames map[string]bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for id, record := range s.sessions {
+		isImpersonatedByUnknownUser := record.ImpersonatedBy != "" && !knownLoginNames[record.ImpersonatedBy]
+		if !knownLoginNames[record.LoginName] || isImpersonatedByUnknownUser {
+			delete(s.sessions, id)
+			count++
+		}
+	}
+	return count
+}
+
+// The format version of the file written by SaveTo(). Increase this whenever
+// the format changes incompatibly: Files with a different version are
+// discarded, which logs out the affected users, but does not break anything.
+const persistedSessionsVersion = 1
+
+// persistedSessions is what gets persisted by SaveTo().
+type persistedSessions struct {
+	Version  int                `json:"version"`
+	Sessions []persistedSession `json:"sessions"`
+}
+
+type persistedSession struct {
+	IDHash         string    `json:"id_hash"`
+	LoginName      string    `json:"login_name"`
+	ImpersonatedBy string    `json:"impersonated_by,omitempty"`
+	DeviceID       string    `json:"device_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastSeenAt     time.Time `json:"last_seen_at"`
+}
+
+// SaveTo implements the SessionStore interface.
+func (s *memorySessionStore) SaveTo(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	ps := persistedSessions{Version: persistedSessionsVersion, Sessions: []persistedSession{}}
+	for key, record := range s.sessions {
+		if record.isValidAt(now, s.cfg) {
+			ps.Sessions = append(ps.Sessions, persistedSession{
+				IDHash:         key,
+				LoginName:      record.LoginName,
+				ImpersonatedBy: record.ImpersonatedBy,
+				DeviceID:       record.DeviceID,
+				CreatedAt:      record.CreatedAt,
+				LastSeenAt:     record.LastSeenAt,
+			})
+		}
+	}
+	buf, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+
+	//write atomically, same as for the database file; this file is only
+	//readable by us since whoever can write it could forge sessions
+	tmpPath := filepath.Join(
+		filepath.Dir(path),
+		fmt.Sprintf(".%s.%d", filepath.Base(path), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, append(buf, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RestoreFrom implements the SessionStore interface.
+func (s *memorySessionStore) RestoreFrom(path string) (int, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	//the file is consumed even if we cannot use it, since it would not get any better on the next restart
+	err = os.Remove(path)
+	if err != nil {
+		return 0, err
+	}
+
+	//the version is checked first, since other formats may not even parse into our types
+	var header struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(buf, &header)
+	if err == nil && header.Version != persistedSessionsVersion {
+		return 0, fmt.Errorf("cannot use %s: expected format version %d, but got %d", path, persistedSessionsVersion, header.Version)
+	}
+	var ps persistedSessions
+	if err == nil {
+		err = json.Unmarshal(buf, &ps)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	count := 0
+	for _, p := range ps.Sessions {
+		record := sessionRecord{
+			SessionInfo: SessionInfo{
+				LoginName:      p.LoginName,
+				ImpersonatedBy: p.ImpersonatedBy,
+				DeviceID:       p.DeviceID,
+			},
+			CreatedAt:  p.CreatedAt,
+			LastSeenAt: p.LastSeenAt,
+		}
+		if p.IDHash != "" && p.LoginName != "" && record.isValidAt(now, s.cfg) {
+			s.sessions[p.IDHash] = record
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RestoreSessions restores the login sessions that were saved by SaveSessions()
+// before the last shutdown, so that a restart does not log out all users.
+// Errors are logged, but not fatal: The worst outcome is that users need to
+// log in again.
+func RestoreSessions(path string) {
+	count, err := sessionTracker.RestoreFrom(path)
+	if err != nil {
+		logg.Error("discarding saved login sessions: %s", err.Error())
+		return
+	}
+	logg.Info("restored %d login session(s) from before the restart", count)
+}
+
+// SaveSessions saves all valid login sessions during shutdown, so that they
+// can be restored by RestoreSessions() after the restart.
+func SaveSessions(path string) {
+	err := sessionTracker.SaveTo(path)
+	if err != nil {
+		logg.Error("cannot save login sessions to %s: %s", path, err.Error())
+	}
+}
+
+// Invalidates the sessions of all users that do not exist anymore. This runs
+// as a listener on the nexus, so it covers all ways in which users can be
+// deleted (through the web GUI, through the control API, by editing the
+// database file, or by changing the seed). Since listeners are called before
+// Nexus.Update() returns, the sessions are gone before anyone can observe the
+// deletion.
+func revokeSessionsOfDeletedUsers(db core.Database) {
+	knownLoginNames := make(map[string]bool, len(db.Users))
+	for _, user := range db.Users {
+		knownLoginNames[user.LoginName] = true
+	}
+	count := sessionTracker.DeleteSessionsOfUnknownUsers(knownLoginNames)
+	if count > 0 {
+		logg.Info("revoked %d session(s) belonging to deleted users", count)
+	}
+}
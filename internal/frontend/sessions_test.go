@@ -0,0 +1,147 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+// Builds a memorySessionStore whose clock can be advanced by the test.
+func newSessionStoreForTests() (*memorySessionStore, func(time.Duration)) {
+	now := time.Unix(1700000000, 0)
+	store := NewInMemorySessionStore(SessionConfig{Lifetime: 24 * time.Hour, IdleTimeout: 2 * time.Hour}).(*memorySessionStore)
+	store.now = func() time.Time { return now }
+	return store, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestSessionLifetime(t *testing.T) {
+	store, advance := newSessionStoreForTests()
+	sessionID := store.NewSession(SessionInfo{LoginName: "jane"})
+
+	//as long as the session is used regularly, it stays valid until the end of its lifetime
+	for elapsed := time.Hour; elapsed < 24*time.Hour; elapsed += time.Hour {
+		advance(time.Hour)
+		_, ok := store.CheckSession(sessionID)
+		assert.DeepEqual(t, "session valid after "+elapsed.String(), ok, true)
+	}
+	advance(time.Hour)
+	_, ok := store.CheckSession(sessionID)
+	assert.DeepEqual(t, "session valid after lifetime", ok, false)
+
+	//once expired, the session stays gone
+	assert.DeepEqual(t, "session count after lifetime", store.CountSessionsOfUser("jane"), 0)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	store, advance := newSessionStoreForTests()
+	sessionID := store.NewSession(SessionInfo{LoginName: "jane"})
+
+	//each use resets the idle timer
+	advance(90 * time.Minute)
+	info, ok := store.CheckSession(sessionID)
+	assert.DeepEqual(t, "session valid before idle timeout", ok, true)
+	assert.DeepEqual(t, "login name of session", info.LoginName, "jane")
+	advance(90 * time.Minute)
+	_, ok = store.CheckSession(sessionID)
+	assert.DeepEqual(t, "session valid after reset of idle timer", ok, true)
+
+	//without use, the session expires after the idle timeout
+	advance(2 * time.Hour)
+	_, ok = store.CheckSession(sessionID)
+	assert.DeepEqual(t, "session valid after idle timeout", ok, false)
+}
+
+func TestSessionRevocation(t *testing.T) {
+	store, _ := newSessionStoreForTests()
+	current := store.NewSession(SessionInfo{LoginName: "jane"})
+	other := store.NewSession(SessionInfo{LoginName: "jane"})
+	unrelated := store.NewSession(SessionInfo{LoginName: "john"})
+	assert.DeepEqual(t, "session count", store.CountSessionsOfUser("jane"), 2)
+
+	//signing out other sessions keeps the current one
+	store.DeleteSessionsOfUser("jane", current)
+	_, ok := store.CheckSession(other)
+	assert.DeepEqual(t, "other session valid after revocation", ok, false)
+	_, ok = store.CheckSession(current)
+	assert.DeepEqual(t, "current session valid after revocation", ok, true)
+	_, ok = store.CheckSession(unrelated)
+	assert.DeepEqual(t, "unrelated session valid after revocation", ok, true)
+
+	//e.g. when an admin resets the password, all sessions are revoked
+	store.DeleteSessionsOfUser("jane", "")
+	assert.DeepEqual(t, "session count after full revocation", store.CountSessionsOfUser("jane"), 0)
+	store.DeleteSession(unrelated)
+	_, ok = store.CheckSession(unrelated)
+	assert.DeepEqual(t, "unrelated session valid after deletion", ok, false)
+}
+
+// Replaces the global session tracker with a fresh one for the duration of the test.
+func useFreshSessionTracker(t *testing.T) {
+	t.Helper()
+	oldTracker := sessionTracker
+	t.Cleanup(func() { sessionTracker = oldTracker })
+	sessionTracker = NewInMemorySessionStore(SessionConfig{Lifetime: 24 * time.Hour, IdleTimeout: 2 * time.Hour})
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	useFreshSessionTracker(t)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	_, handler := setupErrorTest(t)
+	cookie := loginCookieForTests(t, "jane")
+	getSelf := func(handler http.Handler) int {
+		req := httptest.NewRequest(http.MethodGet, "/self", http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.DeepEqual(t, "status before restart", getSelf(handler), http.StatusOK)
+
+	//simulate a restart: the old process saves its sessions during shutdown,
+	//and the new process starts with an empty session store and a new handler
+	SaveSessions(path)
+	useFreshSessionTracker(t)
+	assert.DeepEqual(t, "status without restored sessions", getSelf(handler), http.StatusSeeOther)
+	count := must.Return(sessionTracker.RestoreFrom(path))
+	assert.DeepEqual(t, "number of restored sessions", count, 1)
+	_, handler = setupErrorTest(t)
+	assert.DeepEqual(t, "status after restart", getSelf(handler), http.StatusOK)
+
+	//the file is consumed by the restore, so a later crash cannot bring back
+	//sessions that have ended in the meantime
+	_, err := os.Stat(path)
+	assert.DeepEqual(t, "sessions file exists after restore", os.IsNotExist(err), true)
+}
+
+func TestSessionsFromIncompatibleVersion(t *testing.T) {
+	useFreshSessionTracker(t)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	must.Succeed(os.WriteFile(path, []byte(`{"version":0,"sessions":{"abc":"jane"}}`), 0600))
+
+	_, err := sessionTracker.RestoreFrom(path)
+	if err == nil {
+		t.Fatal("expected error for sessions file with unknown version, but got none")
+	}
+	assert.DeepEqual(t, "error for unknown version", err.Error(),
+		"cannot use "+path+": expected format version 1, but got 0")
+	_, err = os.Stat(path)
+	assert.DeepEqual(t, "sessions file exists after failed restore", os.IsNotExist(err), true)
+
+	//a missing file is not an error, since that is the normal case on the first start
+	count, err := sessionTracker.RestoreFrom(path)
+	assert.DeepEqual(t, "number of sessions restored from missing file", count, 0)
+	assert.DeepEqual(t, "error for missing file", err, nil)
+}
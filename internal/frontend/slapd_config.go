@@ -0,0 +1,139 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+)
+
+// This is set by HTTPHandler().
+var ldapCertificate *ldap.CertificateStatus
+
+// Returns the description of the slapd configuration that portunus-orchestrator
+// writes into our state directory on startup.
+func readSlapdConfigDescription() ([]byte, error) {
+	return os.ReadFile(filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "slapd-config.json"))
+}
+
+// Handles GET /ldap-config.
+func getSlapdConfigHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(slapdConfigView),
+	)
+}
+
+var slapdConfigSnippet = h.NewSnippet(`
+	{{ if .IsShadowMode -}}
+		<div class="flash flash-warning">
+			Portunus is running in shadow mode and does not write any changes into the LDAP server.
+			<a href="/ldap-config/shadow">Review the pending changes</a>
+		</div>
+	{{- end }}
+	{{ if .FailingEntityCount -}}
+		<div class="flash flash-warning">
+			The LDAP server rejected the most recent changes to {{.FailingEntityCount}} objects, so these objects are out of sync.
+			<a href="/ldap-config/sync-status">Show the errors</a>
+		</div>
+	{{- end }}
+	<div class="contains-body-text">
+		<p>
+			This is the configuration that the LDAP server (slapd) was started with.
+			The checksums of the configuration files were recorded when they were written,
+			and can be compared to the current files with <code>sha256sum</code> to detect manual changes.
+		</p>
+		{{ if .Error -}}
+			<p class="text-muted">The configuration is not available: {{.Error}}</p>
+		{{- else -}}
+			<pre><code>{{.Description}}</code></pre>
+		{{- end }}
+	</div>
+	<div class="button-row">
+		{{ if not .Error -}}
+			<a href="/ldap-config.json" class="button button-primary">Download as JSON</a>
+		{{- end }}
+		<a href="/ldap-config/simulate" class="button">Simulate a search</a>
+		<a href="/api/v1/export.ldif" class="button">Export all entries as LDIF</a>
+		<a href="/ldap-config/sync-status" class="button">Sync status</a>
+		<a href="/ldap-config/layout" class="button">User layout: {{.UserLayout}}</a>
+	</div>
+	{{ if .Certificate -}}
+		{{ if .Certificate.Warning -}}
+			<div class="flash flash-warning">The TLS certificate of the LDAP server needs attention: The {{.Certificate.Warning}}.</div>
+		{{- end }}
+		<div class="contains-body-text">
+			<h2>TLS certificate</h2>
+			<p>
+				Portunus connects to the LDAP server as <code>{{.Certificate.DomainName}}</code>.
+				The certificate presented by the LDAP server is valid for {{range $idx, $name := .Certificate.SubjectAlternativeNames}}{{if $idx}}, {{end}}<code>{{$name}}</code>{{end}},
+				and expires at {{.CertificateExpiresAt}}.
+			</p>
+		</div>
+	{{- end }}
+`)
+
+func slapdConfigView(i *Interaction) Page {
+	data := struct {
+		Description          string
+		Error                string
+		Certificate          *ldap.CertificateInfo
+		CertificateExpiresAt string
+		IsShadowMode         bool
+		FailingEntityCount   int
+		UserLayout           ldap.UserLayout
+	}{IsShadowMode: isLDAPShadowMode(), FailingEntityCount: countFailingLDAPEntities(), UserLayout: currentLDAPUserLayout()}
+	if info, ok := ldapCertificate.Get(); ok {
+		data.Certificate = &info
+		data.CertificateExpiresAt = info.NotAfter.Local().Format("2006-01-02 15:04 MST")
+	}
+	buf, err := readSlapdConfigDescription()
+	if err == nil {
+		var indented bytes.Buffer
+		err = json.Indent(&indented, buf, "", "  ")
+		data.Description = indented.String()
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	return Page{
+		Status:   http.StatusOK,
+		Title:    "LDAP server configuration",
+		Contents: slapdConfigSnippet.Render(data),
+		Wide:     true,
+	}
+}
+
+// Handles GET /ldap-config.json.
+func getSlapdConfigJSONHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			buf, err := readSlapdConfigDescription()
+			if err != nil {
+				i.WriteError(err.Error(), http.StatusInternalServerError)
+				return
+			}
+			i.writer.Header().Set("Content-Type", "application/json")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(buf)
+			i.writer = nil
+		},
+	)
+}
@@ -0,0 +1,242 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+	"golang.org/x/crypto/ssh"
+)
+
+// Identifies an SSH public key in URL paths. The key itself is too long and
+// contains characters that are not allowed there.
+func sshKeyID(key core.SSHKey) string {
+	sum := sha256.Sum256([]byte(key.Key))
+	return hex.EncodeToString(sum[:8])
+}
+
+var selfSSHKeysSnippet = h.NewSnippet(`
+	<h2>SSH public keys</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Key</th>
+				<th>Comment</th>
+				<th>Added at</th>
+				<th>Visible in LDAP</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="Key"><code>{{.Fingerprint}}</code></td>
+					<td data-label="Comment">{{.Key.Comment}}</td>
+					{{ if .Key.AddedAt -}}
+						<td data-label="Added at">{{.Key.AddedAt.UTC.Format "2006-01-02 15:04"}} UTC</td>
+					{{- else -}}
+						<td data-label="Added at" class="text-muted">Unknown</td>
+					{{- end }}
+					<td data-label="Visible in LDAP">{{if .Key.Hidden}}No{{else}}Yes{{end}}</td>
+					<td class="actions">{{.Actions}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="5" class="text-muted">No SSH public keys.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	<div class="button-row">
+		<a href="/self/ssh-keys/new" class="button button-primary">Add SSH public key</a>
+	</div>
+`)
+
+// Renders the list of the current user's SSH public keys for the "My profile"
+// page. Each key gets its own forms for hiding and deleting it, so these
+// cannot be part of the main profile form.
+func renderSelfSSHKeys(i *Interaction) template.HTML {
+	type keyItem struct {
+		Key         core.SSHKey
+		Fingerprint string
+		Actions     template.HTML
+	}
+	var data []keyItem
+	for _, key := range i.CurrentUser.SSHPublicKeys {
+		item := keyItem{Key: key, Fingerprint: key.Key}
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+		if err == nil {
+			item.Fingerprint = pubkey.Type() + " " + ssh.FingerprintSHA256(pubkey)
+		}
+		visibilityLabel := "Hide from LDAP"
+		if key.Hidden {
+			visibilityLabel = "Show in LDAP"
+		}
+		item.Actions = buildSSHKeyActionForm(i, key, "toggle-visibility", visibilityLabel) +
+			buildSSHKeyActionForm(i, key, "delete", "Delete")
+		data = append(data, item)
+	}
+	return selfSSHKeysSnippet.Render(data)
+}
+
+func buildSSHKeyActionForm(i *Interaction, key core.SSHKey, action, label string) template.HTML {
+	form := h.FormSpec{
+		PostTarget:  fmt.Sprintf("/self/ssh-keys/%s/%s", sshKeyID(key), action),
+		SubmitLabel: label,
+	}
+	return form.Render(i.Req, h.FormState{})
+}
+
+func useAddSSHKeyForm(i *Interaction) {
+	i.TargetRef = i.CurrentUser.Ref()
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/self/ssh-keys/new",
+		SubmitLabel: "Add SSH public key",
+		Fields: []h.FormField{
+			h.InputFieldSpec{
+				Name:      "key",
+				Label:     "SSH public key (in the format used by authorized_keys)",
+				InputType: "text",
+				AutoFocus: true,
+			},
+			h.InputFieldSpec{
+				Name:      "comment",
+				Label:     "Comment (optional, e.g. the name of the device that holds the private key)",
+				InputType: "text",
+			},
+			h.SelectFieldSpec{
+				Name:  "visibility",
+				Label: "Visibility",
+				Options: []h.SelectOptionSpec{{
+					Value: "hidden",
+					Label: "Hide this key from LDAP (it can only be seen in Portunus)",
+				}},
+			},
+		},
+	}
+}
+
+// Handles GET /self/ssh-keys/new.
+func getSelfSSHKeysNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useAddSSHKeyForm,
+		UseEmptyFormState,
+		ShowForm("Add SSH public key"),
+	)
+}
+
+// Handles POST /self/ssh-keys/new.
+func postSelfSSHKeysNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useAddSSHKeyForm,
+		ReadFormStateFromRequest,
+		validateAddSSHKeyForm,
+		TryUpdateNexus(n, executeAddSSHKey),
+		ShowFormIfErrors("Add SSH public key"),
+		func(i *Interaction) {
+			i.RedirectWithFlashTo("/self", Flash{"success", "Added SSH public key."})
+		},
+	)
+}
+
+func validateAddSSHKeyForm(i *Interaction) {
+	field := i.FormState.Fields["key"]
+	field.Value = strings.TrimSpace(field.Value)
+	if field.GetValueOrSetError() == "" {
+		return
+	}
+	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(field.Value))
+	if err != nil {
+		field.ErrorMessage = "is not a valid SSH public key"
+		return
+	}
+	for _, key := range i.CurrentUser.SSHPublicKeys {
+		if key.Key == field.Value {
+			field.ErrorMessage = "is already in your list of SSH public keys"
+		}
+	}
+}
+
+func executeAddSSHKey(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	fs := i.FormState
+	if !fs.IsValid() {
+		//do not report an invalid key a second time through the validation in core
+		return
+	}
+	now := time.Now()
+	key := core.SSHKey{
+		Key:     fs.Fields["key"].Value,
+		Comment: strings.TrimSpace(fs.Fields["comment"].Value),
+		AddedAt: &now,
+		Hidden:  fs.Fields["visibility"].Selected["hidden"],
+	}
+	for idx, user := range db.Users {
+		if user.LoginName == i.CurrentUser.LoginName {
+			db.Users[idx].SSHPublicKeys = append(user.SSHPublicKeys, key)
+		}
+	}
+	return
+}
+
+// Handles POST /self/ssh-keys/:id/delete and /self/ssh-keys/:id/toggle-visibility.
+func postSelfSSHKeyActionHandler(n core.Nexus, action func([]core.SSHKey, int) []core.SSHKey, successMsg string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			i.TargetRef = i.CurrentUser.Ref()
+			i.FormSpec = &h.FormSpec{PostTarget: i.Req.URL.Path}
+		},
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, func(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+			id := mux.Vars(i.Req)["id"]
+			for userIdx, user := range db.Users {
+				if user.LoginName != i.CurrentUser.LoginName {
+					continue
+				}
+				for keyIdx, key := range user.SSHPublicKeys {
+					if sshKeyID(key) == id {
+						db.Users[userIdx].SSHPublicKeys = action(user.SSHPublicKeys, keyIdx)
+						return
+					}
+				}
+			}
+			errs.Addf("no such SSH public key")
+			return
+		}),
+		func(i *Interaction) {
+			if i.FormState.IsValid() {
+				i.RedirectWithFlashTo("/self", Flash{"success", successMsg})
+			} else {
+				msg := fmt.Sprintf("Could not update SSH public keys: %s.", strings.Join(i.FormState.ErrorMessages, ", "))
+				i.RedirectWithFlashTo("/self", Flash{"danger", msg})
+			}
+		},
+	)
+}
+
+func deleteSSHKey(keys []core.SSHKey, idx int) []core.SSHKey {
+	return append(keys[:idx:idx], keys[idx+1:]...)
+}
+
+func toggleSSHKeyVisibility(keys []core.SSHKey, idx int) []core.SSHKey {
+	keys[idx].Hidden = !keys[idx].Hidden
+	return keys
+}
@@ -0,0 +1,261 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Holds the most recent change to each user and group that was made through
+// an edit form, so that it can be undone until undoWindow has passed.
+var undoJournal core.UndoJournal
+
+func objectURL(ref core.ObjectRef, action string) string {
+	if ref.Type == "group" {
+		return "/groups/" + ref.Name + "/" + action
+	}
+	return "/users/" + ref.Name + "/" + action
+}
+
+// Wraps an action for TryUpdateNexus such that the change that it makes to
+// i.TargetRef is recorded in i.UndoRecord. The record is only added to the
+// undo journal by redirectAfterUndoableEdit once the update has succeeded.
+func undoable(action func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet) func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet {
+	return func(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
+		before := db.Cloned()
+		errs := action(db, i, hasher)
+		if errs.IsEmpty() && i.CurrentUser != nil {
+			record, changed := core.NewUndoRecord(before, *db, i.TargetRef, i.CurrentUser.LoginName, time.Now(), undoWindow)
+			if changed {
+				i.UndoRecord = &record
+			}
+		}
+		return errs
+	}
+}
+
+// Like RedirectWithFlashTo(url, "Updated"), but also offers to undo the change
+// from the flash message.
+func redirectAfterUndoableEdit(url string) HandlerStep {
+	return func(i *Interaction) {
+		ref := i.TargetRef
+		flash := Flash{"success", fmt.Sprintf("Updated %s %q.", ref.Type, ref.Name)}
+		if i.UndoRecord == nil {
+			i.RedirectWithFlashTo(url, flash)
+			return
+		}
+		undoJournal.Add(*i.UndoRecord)
+		if i.UndoRecord.NotUndoableReason != "" {
+			i.RedirectWithFlashTo(url, flash)
+			return
+		}
+		i.RedirectWithFlashAndLinkTo(url, flash, FlashLink{"Undo", objectURL(ref, "undo")})
+	}
+}
+
+// Checks whether the given record can be undone right now, by trying the undo
+// without saving it. Besides conflicts with changes in the meantime, this
+// catches changes that would be reverted by the seed.
+func checkUndo(n core.Nexus, record core.UndoRecord) errext.ErrorSet {
+	return n.Update(func(db *core.Database) errext.ErrorSet {
+		return db.Undo(record, time.Now())
+	}, &core.UpdateOptions{ConflictWithSeedIsError: true, DryRun: true, PreventAdminLockout: true, PreventOrphanedUsers: true})
+}
+
+var undoButtonSnippet = h.NewSnippet(`
+	{{- if .Reason }}
+		<p class="text-muted">The last change (by <code>{{.Actor}}</code> at {{.ChangedAt}}) cannot be undone: {{.Reason}}</p>
+	{{- else }}
+		<p><a href="{{.URL}}" class="button button-secondary">Undo last change</a></p>
+	{{- end }}
+`)
+
+// Returns a form field for the edit form of the given object that offers to
+// undo the last change to it, or explains why this is not possible. Returns
+// nil if there is no recent change.
+func buildUndoButton(n core.Nexus, ref core.ObjectRef) h.FormField {
+	record, exists := undoJournal.Latest(ref, time.Now())
+	if !exists {
+		return nil
+	}
+	data := struct {
+		Actor     string
+		ChangedAt string
+		Reason    string
+		URL       string
+	}{
+		Actor:     record.Actor,
+		ChangedAt: record.ChangedAt.UTC().Format("2006-01-02 15:04 MST"),
+		Reason:    record.NotUndoableReason,
+		URL:       objectURL(ref, "undo"),
+	}
+	if data.Reason == "" {
+		if errs := checkUndo(n, record); !errs.IsEmpty() {
+			data.Reason = errs.Join(", ")
+		}
+	}
+	return h.StaticField{Value: undoButtonSnippet.Render(data)}
+}
+
+var undoConfirmSnippet = h.NewSnippet(`
+	<p>
+		Undo the change to {{.Object.Type}} <code>{{.Object.Name}}</code> that <code>{{.Actor}}</code> made at {{.ChangedAt}}?
+		The following changes will be reverted.
+		Fields that were changed again in the meantime will not be overwritten.
+		The undo itself cannot be undone.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Field</th>
+				<th>Current value</th>
+				<th>Value after undo</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{- range .Fields }}
+				<tr>
+					<td data-label="Field"><code>{{.Path}}</code></td>
+					<td data-label="Current value">{{with .NewValue}}<code>{{.}}</code>{{else}}<span class="text-muted">(unset)</span>{{end}}</td>
+					<td data-label="Value after undo">{{with .OldValue}}<code>{{.}}</code>{{else}}<span class="text-muted">(unset)</span>{{end}}</td>
+				</tr>
+			{{- end }}
+			{{- range .Memberships }}
+				<tr>
+					<td data-label="Field">Membership of <code>{{.LoginName}}</code> in <code>{{.GroupName}}</code></td>
+					<td data-label="Current value">{{if eq .Kind "added"}}member{{else}}not a member{{end}}</td>
+					<td data-label="Value after undo">{{if eq .Kind "added"}}not a member{{else}}member{{end}}</td>
+				</tr>
+			{{- end }}
+		</tbody>
+	</table>
+`)
+
+func useUndoForm(i *Interaction) {
+	ref := i.TargetRef
+	record, exists := undoJournal.Latest(ref, time.Now())
+	if !exists {
+		msg := fmt.Sprintf("There is no change to %s %q that could still be undone.", ref.Type, ref.Name)
+		i.RedirectWithFlashTo(objectURL(ref, "edit"), Flash{"danger", msg})
+		return
+	}
+	if record.NotUndoableReason != "" {
+		msg := fmt.Sprintf("The last change to %s %q cannot be undone: %s.", ref.Type, ref.Name, record.NotUndoableReason)
+		i.RedirectWithFlashTo(objectURL(ref, "edit"), Flash{"danger", msg})
+		return
+	}
+	i.UndoRecord = &record
+	i.UpdateReason = "undo of change by " + record.Actor
+
+	data := struct {
+		core.UndoRecord
+		ChangedAt string
+	}{record, record.ChangedAt.UTC().Format("2006-01-02 15:04 MST")}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  objectURL(ref, "undo"),
+		SubmitLabel: "Undo change",
+		Fields: []h.FormField{
+			h.StaticField{Value: undoConfirmSnippet.Render(data)},
+			h.HiddenFieldSpec{Name: "record"},
+		},
+	}
+	//if the object is changed again before the form is submitted, the admin
+	//needs to review the new change instead
+	i.FormState = &h.FormState{Fields: map[string]*h.FieldState{
+		"record": {Value: record.ID},
+	}}
+}
+
+// Shows on the confirmation page already whether the undo would fail.
+func showUndoErrors(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		i.FormState.FillErrorsFrom(checkUndo(n, *i.UndoRecord), i.TargetRef)
+	}
+}
+
+func executeUndo(db *core.Database, i *Interaction, _ crypt.PasswordHasher) errext.ErrorSet {
+	if i.FormState.Fields["record"].Value != i.UndoRecord.ID {
+		i.FormState.Fields["record"].Value = i.UndoRecord.ID
+		return errext.ErrorSet{errors.New("there has been another change in the meantime, please review it before undoing it")}
+	}
+	return db.Undo(*i.UndoRecord, time.Now())
+}
+
+func finishUndo(i *Interaction) {
+	record := *i.UndoRecord
+	//the undo itself is not recorded, so this also ensures that the undo cannot be undone
+	undoJournal.Remove(record)
+	logging.Info(logging.Fields{"event": "undo", "actor": i.CurrentUser.LoginName, "object_type": record.Object.Type, "object_name": record.Object.Name},
+		"undid change made by %s at %s", record.Actor, record.ChangedAt.UTC().Format(time.RFC3339))
+	msg := fmt.Sprintf("Undid the last change to %s %q.", record.Object.Type, record.Object.Name)
+	i.RedirectWithFlashTo(objectURL(record.Object, "edit"), Flash{"success", msg})
+}
+
+// Handles GET /users/:uid/undo.
+func getUserUndoHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useUndoForm,
+		showUndoErrors(n),
+		ShowForm("Undo last change"),
+	)
+}
+
+// Handles POST /users/:uid/undo.
+func postUserUndoHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useUndoForm,
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeUndo),
+		ShowFormIfErrors("Undo last change"),
+		finishUndo,
+	)
+}
+
+// Handles GET /groups/:name/undo.
+func getGroupUndoHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useUndoForm,
+		showUndoErrors(n),
+		ShowForm("Undo last change"),
+	)
+}
+
+// Handles POST /groups/:name/undo.
+func postGroupUndoHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useUndoForm,
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeUndo),
+		ShowFormIfErrors("Undo last change"),
+		finishUndo,
+	)
+}
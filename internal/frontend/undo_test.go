@@ -0,0 +1,87 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestUndoLastChange(t *testing.T) {
+	useFreshSessionTracker(t)
+	nexus, handler := setupErrorTest(t)
+	var record core.UndoRecord
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "john", GivenName: "John", FamilyName: "Doe"})
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		before := db.Cloned()
+		db.Users[1].GivenName = "Johnny"
+		record, _ = core.NewUndoRecord(before, *db, db.Users[1].Ref(), "jane", time.Now(), time.Minute)
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	undoJournal.Add(record)
+	cookie := loginCookieForTests(t, "jane")
+
+	undoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//this is usually done by the router, which we bypass here
+		postUserUndoHandler(nexus).ServeHTTP(w, mux.SetURLVars(r, map[string]string{"uid": "john"}))
+	})
+	send := func(handler http.Handler, method, path string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Cookie", cookie)
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			//this is usually done by the CSRF middleware, which we bypass here
+			err := req.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	//the edit form offers the undo, and the confirmation page shows what will be reverted
+	rec := send(handler, http.MethodGet, "/users/john/edit", nil)
+	assert.DeepEqual(t, "edit form offers undo", strings.Contains(rec.Body.String(), `href="/users/john/undo"`), true)
+	rec = send(handler, http.MethodGet, "/users/john/undo", nil)
+	assert.DeepEqual(t, "status of GET /users/john/undo", rec.Code, http.StatusOK)
+	assert.DeepEqual(t, "confirmation lists given_name", strings.Contains(rec.Body.String(), "<code>given_name</code>"), true)
+
+	//submitting with an outdated record ID does not undo anything
+	rec = send(undoHandler, http.MethodPost, "/users/john/undo", url.Values{"record": {"outdated"}})
+	assert.DeepEqual(t, "status of POST /users/john/undo with outdated record", rec.Code, http.StatusOK)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "GivenName after rejected undo", user.GivenName, "Johnny")
+
+	//the undo succeeds, and cannot be repeated
+	rec = send(undoHandler, http.MethodPost, "/users/john/undo", url.Values{"record": {record.ID}})
+	assert.DeepEqual(t, "status of POST /users/john/undo", rec.Code, http.StatusSeeOther)
+	user, _ = nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "GivenName after undo", user.GivenName, "John")
+	rec = send(handler, http.MethodGet, "/users/john/undo", nil)
+	assert.DeepEqual(t, "status of GET /users/john/undo after undo", rec.Code, http.StatusSeeOther)
+}
@@ -7,10 +7,12 @@
 package frontend
 
 import (
+	"encoding/base64"
 	"fmt"
+	"html/template"
 	"net/http"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/majewsky/portunus/internal/core"
@@ -25,16 +27,55 @@ var adminPerms = core.Permissions{
 	},
 }
 
+// Users with only these permissions can look at users and groups, but not
+// change them.
+var viewerPerms = core.Permissions{
+	Portunus: core.PortunusPermissions{
+		CanView: true,
+	},
+}
+
+// Accounts that expire within this period are highlighted in the users list.
+const expiryWarningPeriod = 14 * 24 * time.Hour
+
 func getUsersHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		VerifyPermissions(adminPerms),
+		VerifyPermissions(viewerPerms),
 		ShowView(usersList(n)),
 	)
 }
 
 var usersListSnippet = h.NewSnippet(`
+	{{- if .ShowOnlyOrphans }}
+		<div class="flash flash-primary">
+			Showing only the {{len .Users}} active user(s) without any group membership.
+			They were created before the policy was enabled, or they were not created in Portunus.
+			<a href="/users">Show all users</a>
+		</div>
+	{{- else if .OrphanCount }}
+		<div class="flash flash-warning">
+			{{.OrphanCount}} active user(s) are not in any group, even though a group membership is required.
+			<a href="/users?without_groups=true">Show them</a>
+		</div>
+	{{- end }}
+	{{- if .Departments }}
+		<form method="GET" action="/users">
+			<div class="form-row">
+				<label for="department">Department</label>
+				<select name="department" id="department" class="row-input">
+					<option value="">All departments</option>
+					{{- range .Departments }}
+						<option value="{{.}}" {{- if eq . $.SelectedDepartment }} selected{{ end }}>{{.}}</option>
+					{{- end }}
+				</select>
+			</div>
+			<div class="button-row">
+				<button type="submit" class="button button-primary">Filter</button>
+			</div>
+		</form>
+	{{- end }}
 	<table class="table responsive">
 		<thead>
 			<tr>
@@ -43,14 +84,20 @@ var usersListSnippet = h.NewSnippet(`
 				<th>POSIX ID</th>
 				<th>Groups</th>
 				<th class="actions">
-					<a href="/users/new" class="button button-primary">New user</a>
+					{{- if .CanEdit }}
+						<a href="/users/new" class="button button-primary">New user</a>
+						<a href="/deleted-users" class="button button-secondary">Recently deleted</a>
+					{{- end }}
 				</th>
 			</tr>
 		</thead>
 		<tbody>
-			{{range .}}
+			{{range .Users}}
 				<tr>
-					<td data-label="Login name"><code>{{.User.LoginName}}</code></td>
+					<td data-label="Login name">
+						<code>{{.User.LoginName}}</code>
+						{{- if .ExpiryNote }}<br><span class="small text-muted">{{.ExpiryNote}}</span>{{ end }}
+					</td>
 					<td data-label="Full name">{{.UserFullName}}</td>
 					{{ if .User.POSIX -}}
 						<td data-label="POSIX ID">{{.User.POSIX.UID}}</td>
@@ -63,9 +110,17 @@ var usersListSnippet = h.NewSnippet(`
 						{{- end -}}
 					</td>
 					<td class="actions">
-						<a href="/users/{{.User.LoginName}}/edit">Edit</a>
-						·
-						<a href="/users/{{.User.LoginName}}/delete">Delete</a>
+						{{- if $.CanEdit }}
+							<a href="/users/{{.User.LoginName}}/edit">Edit</a>
+							·
+							<a href="/users/{{.User.LoginName}}/rename">Rename</a>
+							·
+							<a href="/users/{{.User.LoginName}}/offboard">Offboard</a>
+							·
+							<a href="/users/{{.User.LoginName}}/delete">Delete</a>
+						{{- else }}
+							<a href="/users/{{.User.LoginName}}/edit">View</a>
+						{{- end }}
 					</td>
 				</tr>
 			{{end}}
@@ -74,15 +129,39 @@ var usersListSnippet = h.NewSnippet(`
 `)
 
 func usersList(n core.Nexus) func(*Interaction) Page {
-	return func(_ *Interaction) Page {
+	return func(i *Interaction) Page {
+		coll := collationFor(i.Req)
 		groups := n.ListGroups()
-		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		coll.SortGroups(groups)
 		users := n.ListUsers()
-		sort.Slice(users, func(i, j int) bool { return users[i].LoginName < users[j].LoginName })
+		coll.SortUsers(users)
+		departments := listDepartments(users, coll)
+
+		//users without groups are listed separately for cleanup, since they are
+		//only rejected when they are created or changed
+		now := time.Now()
+		orphans := core.Database{Users: users, Groups: groups}.FindOrphanedUsers(n.ValidationConfig(), now)
+		showOnlyOrphans := i.Req.URL.Query().Get("without_groups") == "true"
+		if showOnlyOrphans {
+			users = orphans
+		}
+
+		//if a department is selected, only show the users in that department
+		selectedDepartment := i.Req.URL.Query().Get("department")
+		if selectedDepartment != "" {
+			var filtered []core.User
+			for _, user := range users {
+				if user.Department == selectedDepartment {
+					filtered = append(filtered, user)
+				}
+			}
+			users = filtered
+		}
 
 		type userItem struct {
 			User         core.User
 			UserFullName string
+			ExpiryNote   string
 			Groups       []core.Group
 		}
 		data := make([]userItem, len(users))
@@ -91,6 +170,12 @@ func usersList(n core.Nexus) func(*Interaction) Page {
 				User:         user,
 				UserFullName: user.FullName(),
 			}
+			switch {
+			case user.IsExpiredAt(now):
+				item.ExpiryNote = "Expired"
+			case user.ExpiresWithin(now, expiryWarningPeriod):
+				item.ExpiryNote = "Valid until " + core.FormatValidUntilDate(*user.ValidUntil)
+			}
 			for _, group := range groups {
 				if group.ContainsUser(user) {
 					item.Groups = append(item.Groups, group)
@@ -100,14 +185,35 @@ func usersList(n core.Nexus) func(*Interaction) Page {
 		}
 
 		return Page{
-			Status:   http.StatusOK,
-			Title:    "Users",
-			Contents: usersListSnippet.Render(data),
-			Wide:     true,
+			Status: http.StatusOK,
+			Title:  "Users",
+			Contents: usersListSnippet.Render(struct {
+				Users              []userItem
+				CanEdit            bool
+				Departments        []string
+				SelectedDepartment string
+				OrphanCount        int
+				ShowOnlyOrphans    bool
+			}{data, canEdit(i), departments, selectedDepartment, len(orphans), showOnlyOrphans}),
+			Wide: true,
 		}
 	}
 }
 
+// Returns the distinct departments of the given users in sorted order.
+func listDepartments(users []core.User, coll *core.Collation) []string {
+	var result []string
+	isSeen := make(map[string]bool)
+	for _, user := range users {
+		if user.Department != "" && !isSeen[user.Department] {
+			isSeen[user.Department] = true
+			result = append(result, user.Department)
+		}
+	}
+	coll.SortStrings(result)
+	return result
+}
+
 var codeTagSnippet = h.NewSnippet(`<code>{{.}}</code>`)
 
 func useUserForm(n core.Nexus) HandlerStep {
@@ -126,14 +232,67 @@ func useUserForm(n core.Nexus) HandlerStep {
 		}
 
 		i.FormSpec.Fields = append(i.FormSpec.Fields,
-			buildUserMasterdataFieldset(n, i.TargetUser, i.FormState),
+			buildUserMasterdataFieldset(n, i.TargetUser, i.FormState, collationFor(i.Req)),
+		)
+		if i.TargetUser != nil {
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.HiddenFieldSpec{Name: "revision"})
+			i.FormState.Fields["revision"] = &h.FieldState{Value: core.UserRevision(*i.TargetUser, n.ListGroups())}
+		}
+		if photoFields := buildUserPhotoFields(i.TargetUser, canEdit(i)); len(photoFields) > 0 {
+			i.FormSpec.IsMultipart = true
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.FieldSet{
+				Label:      "Photo",
+				Fields:     photoFields,
+				IsFoldable: false,
+			})
+		}
+		i.FormSpec.Fields = append(i.FormSpec.Fields,
 			buildUserPosixFieldset(i.TargetUser, i.FormState),
+		)
+		if !canEdit(i) {
+			//view-only access: there is no point in showing the password fields
+			readOnlySpec := i.FormSpec.AsReadOnly()
+			i.FormSpec = &readOnlySpec
+			return
+		}
+		i.FormSpec.Fields = append(i.FormSpec.Fields,
 			buildUserPasswordFieldset(i.TargetUser),
+			h.SelectFieldSpec{
+				Name:  "password_policy",
+				Label: "Password policy",
+				Options: []h.SelectOptionSpec{{
+					Value: "must_change_password",
+					Label: "User must choose a new password on their next login (this is always set when you reset the password of someone else)",
+				}},
+			},
 		)
+		//for new users, the admin chooses the initial password, so the user should replace it by default
+		i.FormState.Fields["password_policy"] = &h.FieldState{Selected: map[string]bool{
+			"must_change_password": i.TargetUser == nil || i.TargetUser.MustChangePassword,
+		}}
+		if i.TargetUser != nil && i.TargetUser.LoginName != i.CurrentUser.LoginName {
+			i.FormSpec.Fields = append([]h.FormField{
+				h.StaticField{Value: impersonateButtonSnippet.Render(i.TargetUser.LoginName)},
+				h.StaticField{Value: renameUserButtonSnippet.Render(i.TargetUser.LoginName)},
+				h.StaticField{Value: offboardButtonSnippet.Render(i.TargetUser.LoginName)},
+			}, i.FormSpec.Fields...)
+		}
+		if i.TargetUser != nil {
+			if undoButton := buildUndoButton(n, i.TargetRef); undoButton != nil {
+				i.FormSpec.Fields = append([]h.FormField{undoButton}, i.FormSpec.Fields...)
+			}
+		}
+		if i.TargetUser == nil {
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.FieldSet{
+				Name:       "invite",
+				Label:      "Instead of setting an initial password, create an invitation link for the user to set their own password",
+				IsFoldable: true,
+			})
+		}
 	}
 }
 
-func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState) h.FormField {
+func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState, coll *core.Collation) h.FormField {
 	var fields []h.FormField
 	if u == nil {
 		fields = append(fields, h.InputFieldSpec{
@@ -159,29 +318,82 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 			Name:      "family_name",
 			Label:     "Family name",
 		},
+		h.SelectFieldSpec{
+			Name:  "name_order",
+			Label: "Name order",
+			Options: []h.SelectOptionSpec{
+				{
+					Value: "family_name_first",
+					Label: "Show family name before given name",
+				},
+			},
+		},
 		h.InputFieldSpec{
 			InputType: "text",
 			Name:      "email",
 			Label:     "Email address (optional in Portunus, but required by some services)",
 		},
+		h.InputFieldSpec{
+			InputType: "tel",
+			Name:      "phone",
+			Label:     "Phone number (optional)",
+		},
+		h.InputFieldSpec{
+			InputType: "tel",
+			Name:      "mobile_phone",
+			Label:     "Mobile phone number (optional)",
+		},
+		h.InputFieldSpec{
+			InputType:   "text",
+			Name:        "department",
+			Label:       "Department (optional)",
+			Suggestions: listDepartments(n.ListUsers(), coll),
+		},
+		h.InputFieldSpec{
+			InputType: "text",
+			Name:      "preferred_language",
+			Label:     "Preferred language (optional; a language tag like \"en\" or \"de-CH\")",
+		},
+		h.InputFieldSpec{
+			InputType: "text",
+			Name:      "timezone",
+			Label:     "Time zone (optional; a name like \"Europe/Berlin\")",
+		},
 		h.MultilineInputFieldSpec{
 			Name:  "ssh_public_keys",
 			Label: "SSH public key(s)",
 		},
+		h.InputFieldSpec{
+			InputType: "date",
+			Name:      "valid_until",
+			Label:     "Account valid until (optional; the account expires at the end of this day)",
+		},
 	)
 	if u != nil {
 		state.Fields["given_name"] = &h.FieldState{Value: u.GivenName}
 		state.Fields["family_name"] = &h.FieldState{Value: u.FamilyName}
+		state.Fields["name_order"] = &h.FieldState{
+			Selected: map[string]bool{
+				"family_name_first": u.FamilyNameFirst,
+			},
+		}
 		state.Fields["email"] = &h.FieldState{Value: u.EMailAddress}
+		state.Fields["phone"] = &h.FieldState{Value: u.Phone}
+		state.Fields["mobile_phone"] = &h.FieldState{Value: u.MobilePhone}
+		state.Fields["department"] = &h.FieldState{Value: u.Department}
+		state.Fields["preferred_language"] = &h.FieldState{Value: u.PreferredLanguage}
+		state.Fields["timezone"] = &h.FieldState{Value: u.Timezone}
 		state.Fields["ssh_public_keys"] = &h.FieldState{
-			Value: strings.Join(u.SSHPublicKeys, "\r\n"),
+			Value: strings.Join(core.SSHPublicKeyStrings(u.SSHPublicKeys), "\r\n"),
+		}
+		if u.ValidUntil != nil {
+			state.Fields["valid_until"] = &h.FieldState{Value: core.FormatValidUntilDate(*u.ValidUntil)}
 		}
 	}
 
+	vcfg := n.ValidationConfig()
 	allGroups := n.ListGroups()
-	sort.Slice(allGroups, func(i, j int) bool {
-		return allGroups[i].LongName < allGroups[j].LongName
-	})
+	coll.SortGroups(allGroups)
 	var groupOpts []h.SelectOptionSpec
 	isGroupSelected := make(map[string]bool)
 	for _, group := range allGroups {
@@ -191,11 +403,17 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 		})
 		if u != nil {
 			isGroupSelected[group.Name] = group.ContainsUser(*u)
+		} else {
+			isGroupSelected[group.Name] = group.Name == vcfg.DefaultGroupName
 		}
 	}
+	membershipsLabel := "Group memberships"
+	if vcfg.RequireGroupMembership {
+		membershipsLabel = "Group memberships (at least one is required for active users)"
+	}
 	fields = append(fields, h.SelectFieldSpec{
 		Name:    "memberships",
-		Label:   "Group memberships",
+		Label:   membershipsLabel,
 		Options: groupOpts,
 	})
 	state.Fields["memberships"] = &h.FieldState{Selected: isGroupSelected}
@@ -236,6 +454,56 @@ func buildUserPasswordFieldset(u *core.User) h.FormField {
 	}
 }
 
+var userPhotoSnippet = h.NewSnippet(`<img class="user-photo" src="{{.}}" alt="Photo">`)
+
+// Renders the given photo (in the format of core.User.Photo) for use in a StaticField.
+func renderUserPhoto(photo []byte) template.HTML {
+	return userPhotoSnippet.Render(template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(photo)))
+}
+
+// Builds the fields for showing, uploading or deleting a user photo. Forms
+// containing these fields must have FormSpec.IsMultipart set. If `editable` is
+// false, only the existing photo (if any) is shown.
+func buildUserPhotoFields(u *core.User, editable bool) []h.FormField {
+	var fields []h.FormField
+	hasPhoto := u != nil && len(u.Photo) > 0
+	if hasPhoto {
+		fields = append(fields, h.StaticField{
+			Label: "Photo",
+			Value: renderUserPhoto(u.Photo),
+		})
+	}
+	if !editable {
+		return fields
+	}
+	if hasPhoto {
+		fields = append(fields, h.SelectFieldSpec{
+			Name: "photo_options",
+			Options: []h.SelectOptionSpec{{
+				Value: "delete",
+				Label: "Delete photo",
+			}},
+		})
+	}
+	return append(fields, h.FileFieldSpec{
+		Name:    "photo",
+		Label:   fmt.Sprintf("Upload new photo (optional; PNG or JPEG, will be scaled down to %dx%d pixels)", core.UserPhotoMaxDimension, core.UserPhotoMaxDimension),
+		Accept:  "image/png,image/jpeg",
+		MaxSize: photoMaxSize,
+	})
+}
+
+// Reads the fields from buildUserPhotoFields(), and returns the new value for core.User.Photo.
+func readUserPhotoFromFormState(fs *h.FormState, oldPhoto []byte, ref core.FieldRef) ([]byte, error) {
+	if upload := fs.Fields["photo"]; upload != nil && len(upload.Upload) > 0 {
+		return core.ParseUserPhoto(upload.Upload, ref)
+	}
+	if opts := fs.Fields["photo_options"]; opts != nil && opts.Selected["delete"] {
+		return nil, nil
+	}
+	return oldPhoto, nil
+}
+
 func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
 	if u != nil && u.POSIX != nil {
 		state.Fields["posix"] = &h.FieldState{IsUnfolded: true}
@@ -244,6 +512,24 @@ func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
 		state.Fields["posix_home"] = &h.FieldState{Value: u.POSIX.HomeDirectory}
 		state.Fields["posix_shell"] = &h.FieldState{Value: u.POSIX.LoginShell}
 		state.Fields["posix_gecos"] = &h.FieldState{Value: u.POSIX.GECOS}
+	} else {
+		//pre-fill the defaults for when the admin enables POSIX attributes
+		//(the home directory can only be rendered once we know the login name)
+		state.Fields["posix_shell"] = &h.FieldState{Value: posixDefaults.LoginShell}
+		if u != nil {
+			homeDirectory, err := posixDefaults.HomeDirectoryFor(*u)
+			if err == nil {
+				state.Fields["posix_home"] = &h.FieldState{Value: homeDirectory}
+			}
+		}
+	}
+
+	homeDirectoryLabel := "Home directory"
+	if u == nil && posixDefaults.HomeDirectoryTemplate != nil {
+		example, err := posixDefaults.HomeDirectoryFor(core.User{LoginName: "<login name>"})
+		if err == nil {
+			homeDirectoryLabel = fmt.Sprintf("Home directory (if empty: %s)", example)
+		}
 	}
 
 	return h.FieldSet{
@@ -263,7 +549,7 @@ func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
 			},
 			h.InputFieldSpec{
 				Name:      "posix_home",
-				Label:     "Home directory",
+				Label:     homeDirectoryLabel,
 				InputType: "text",
 			},
 			h.InputFieldSpec{
@@ -284,10 +570,10 @@ func getUserEditHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		VerifyPermissions(adminPerms),
+		VerifyPermissions(viewerPerms),
 		loadTargetUser(n),
 		useUserForm(n),
-		ShowForm("Edit user"),
+		ShowEditOrViewForm("Edit user", "User details"),
 	)
 }
 
@@ -300,12 +586,26 @@ func postUserEditHandler(n core.Nexus) http.Handler {
 		useUserForm(n),
 		ReadFormStateFromRequest,
 		validateUserForm,
-		TryUpdateNexus(n, executeEditUser),
+		TryUpdateNexus(n, undoable(executeEditUser)),
+		ReloadFormAfterConcurrentModification(loadTargetUser(n), useUserForm(n)),
 		ShowFormIfErrors("Edit user"),
-		RedirectWithFlashTo("/users", "Updated"),
+		revokeSessionsOnPasswordReset,
+		redirectAfterUndoableEdit("/users"),
 	)
 }
 
+func revokeSessionsOnPasswordReset(i *Interaction) {
+	fs := i.FormState
+	if fs.Fields["reset_password"].IsUnfolded && fs.Fields["password"].Value != "" {
+		revokeSessionsOfTargetUser(i)
+	}
+}
+
+func revokeSessionsOfTargetUser(i *Interaction) {
+	//when an admin resets their own password, they shall not be logged out by it
+	sessionTracker.DeleteSessionsOfUser(i.TargetUser.LoginName, currentSessionID(i))
+}
+
 func loadTargetUser(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		userLoginName := mux.Vars(i.Req)["uid"]
@@ -320,16 +620,29 @@ func loadTargetUser(n core.Nexus) HandlerStep {
 	}
 }
 
-func buildUserFromFormState(fs *h.FormState, loginName, passwordHash string) (result core.User, errs errext.ErrorSet) {
+func buildUserFromFormState(fs *h.FormState, loginName, passwordHash string, oldPhoto []byte, oldSSHPublicKeys []core.SSHKey) (result core.User, errs errext.ErrorSet) {
+	now := time.Now()
 	result = core.User{
-		LoginName:     loginName,
-		GivenName:     fs.Fields["given_name"].Value,
-		FamilyName:    fs.Fields["family_name"].Value,
-		EMailAddress:  fs.Fields["email"].Value,
-		SSHPublicKeys: core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value),
-		PasswordHash:  passwordHash,
-		POSIX:         nil,
+		LoginName:          loginName,
+		GivenName:          fs.Fields["given_name"].Value,
+		FamilyName:         fs.Fields["family_name"].Value,
+		FamilyNameFirst:    fs.Fields["name_order"].Selected["family_name_first"],
+		EMailAddress:       fs.Fields["email"].Value,
+		Phone:              fs.Fields["phone"].Value,
+		MobilePhone:        fs.Fields["mobile_phone"].Value,
+		Department:         fs.Fields["department"].Value,
+		PreferredLanguage:  fs.Fields["preferred_language"].Value,
+		Timezone:           fs.Fields["timezone"].Value,
+		SSHPublicKeys:      core.MergeSSHPublicKeys(oldSSHPublicKeys, core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value), &now),
+		PasswordHash:       passwordHash,
+		POSIX:              nil,
+		MustChangePassword: fs.Fields["password_policy"].Selected["must_change_password"],
 	}
+	var err error
+	result.ValidUntil, err = core.ParseValidUntilDate(fs.Fields["valid_until"].Value, result.Ref().Field("valid_until"))
+	errs.Add(err)
+	result.Photo, err = readUserPhotoFromFormState(fs, oldPhoto, result.Ref().Field("photo"))
+	errs.Add(err)
 	if fs.Fields["posix"].IsUnfolded {
 		uid, err := core.ParsePosixID(fs.Fields["posix_uid"].Value, result.Ref().Field("posix_uid"))
 		errs.Add(err)
@@ -343,13 +656,15 @@ func buildUserFromFormState(fs *h.FormState, loginName, passwordHash string) (re
 			LoginShell:    fs.Fields["posix_shell"].Value,
 			GECOS:         fs.Fields["posix_gecos"].Value,
 		}
+		errs.Add(posixDefaults.ApplyTo(&result))
 	}
 	return
 }
 
 func validateUserForm(i *Interaction) {
 	fs := i.FormState
-	if i.TargetUser == nil || fs.Fields["reset_password"].IsUnfolded {
+	isInvitation := i.TargetUser == nil && fs.Fields["invite"].IsUnfolded
+	if (i.TargetUser == nil && !isInvitation) || fs.Fields["reset_password"].IsUnfolded {
 		password1 := fs.Fields["password"].GetValueOrSetError()
 		password2 := fs.Fields["repeat_password"].GetValueOrSetError()
 		if password2 != "" && password1 != password2 {
@@ -358,7 +673,25 @@ func validateUserForm(i *Interaction) {
 	}
 }
 
+// Checks that the target user was not modified since the form was rendered.
+// This must be called within the UpdateAction, since i.TargetUser was loaded
+// before the update started.
+func verifyUserRevision(db *core.Database, i *Interaction) error {
+	expected := i.FormState.Fields["revision"].Value
+	if expected == "" {
+		return nil //form was rendered before revisions were introduced
+	}
+	user, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == i.TargetUser.LoginName })
+	if !exists || core.UserRevision(user, db.Groups) != expected {
+		return core.ErrConcurrentModification
+	}
+	return nil
+}
+
 func executeEditUser(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
+	if err := verifyUserRevision(db, i); err != nil {
+		return errext.ErrorSet{err}
+	}
 	passwordHash := i.TargetUser.PasswordHash
 	if i.FormState.Fields["reset_password"].IsUnfolded {
 		if pw := i.FormState.Fields["password"].Value; pw != "" {
@@ -366,7 +699,20 @@ func executeEditUser(db *core.Database, i *Interaction, hasher crypt.PasswordHas
 		}
 	}
 
-	newUser, errs := buildUserFromFormState(i.FormState, i.TargetUser.LoginName, passwordHash)
+	newUser, errs := buildUserFromFormState(i.FormState, i.TargetUser.LoginName, passwordHash, i.TargetUser.Photo, i.TargetUser.SSHPublicKeys)
+	newUser.ExtraAttributes = i.TargetUser.ExtraAttributes //not editable in the UI
+	if oldValue := i.TargetUser.ValidUntil; oldValue != nil && newUser.ValidUntil != nil &&
+		core.FormatValidUntilDate(*oldValue) == core.FormatValidUntilDate(*newUser.ValidUntil) {
+		//the form only shows the date, so keep the exact time if it was set elsewhere (e.g. in the seed)
+		newUser.ValidUntil = oldValue
+	}
+	if passwordHash == i.TargetUser.PasswordHash {
+		//a pending invitation stays valid until a password is set
+		newUser.Invitation = i.TargetUser.Invitation
+	} else if i.TargetUser.LoginName != i.CurrentUser.LoginName {
+		//the admin knows the new password, so only the user shall know the next one
+		newUser.MustChangePassword = true
+	}
 	errs.Add(db.Users.Update(newUser))
 
 	isMemberOf := i.FormState.Fields["memberships"].Selected
@@ -400,17 +746,33 @@ func postUsersNewHandler(n core.Nexus) http.Handler {
 		validateUserForm,
 		TryUpdateNexus(n, executeCreateUser),
 		ShowFormIfErrors("Create user"),
-		RedirectWithFlashTo("/users", "Created"),
+		redirectAfterCreateUser,
 	)
 }
 
 func executeCreateUser(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
 	loginName := i.FormState.Fields["login_name"].Value
-	passwordHash := hasher.HashPassword(i.FormState.Fields["password"].Value)
+	var (
+		passwordHash string
+		invitation   *core.UserInvitation
+	)
+	if i.FormState.Fields["invite"].IsUnfolded {
+		var inv core.UserInvitation
+		i.InvitationToken, inv = core.NewUserInvitation(time.Now(), invitationLifetime)
+		invitation = &inv
+	} else {
+		passwordHash = hasher.HashPassword(i.FormState.Fields["password"].Value)
+	}
 
-	newUser, errs := buildUserFromFormState(i.FormState, loginName, passwordHash)
+	newUser, errs := buildUserFromFormState(i.FormState, loginName, passwordHash, nil, nil)
+	newUser.Invitation = invitation
+	if invitation != nil {
+		//the user chooses their own password anyway
+		newUser.MustChangePassword = false
+	}
 	i.TargetRef = newUser.Ref()
 	db.Users = append(db.Users, newUser)
+	warnAboutReusedLoginName(db, i, loginName)
 
 	isMemberOf := i.FormState.Fields["memberships"].Selected
 	for idx := range db.Groups {
@@ -423,36 +785,87 @@ func executeCreateUser(db *core.Database, i *Interaction, hasher crypt.PasswordH
 	return errs
 }
 
+func redirectAfterCreateUser(i *Interaction) {
+	if i.InvitationToken == "" && i.LoginNameReuseWarning == "" {
+		RedirectWithFlashTo("/users", "Created")(i)
+		return
+	}
+	msg := fmt.Sprintf("Created user %q.", i.TargetRef.Name)
+	if i.InvitationToken != "" {
+		msg += fmt.Sprintf(" Send them this invitation link to set their password (valid for %s): %s",
+			invitationLifetime, invitationURL(i.Req, i.InvitationToken))
+	}
+	if i.LoginNameReuseWarning != "" {
+		i.RedirectWithFlashTo("/users", Flash{"warning", msg + " " + i.LoginNameReuseWarning})
+		return
+	}
+	i.RedirectWithFlashTo("/users", Flash{"success", msg})
+}
+
 func getUserDeleteHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
-		useDeleteUserForm,
+		useDeleteUserForm(n),
 		UseEmptyFormState,
 		ShowForm("Confirm user deletion"),
 	)
 }
 
 var deleteUserConfirmSnippet = h.NewSnippet(`
-	<p>Really delete user <code>{{.}}</code>? This cannot be undone.</p>
+	<p>Really delete user <code>{{.LoginName}}</code>? The user can be restored from the <a href="/deleted-users">recently deleted users</a> within {{.Retention}}.</p>
+	{{- with .SolelyOwnedGroupNames }}
+		<p>
+			{{len .}} group(s) will be left without an owner:
+			<span class="comma-separated-list">
+				{{- range . -}}
+				<code>{{.}}</code><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
 `)
 
-func useDeleteUserForm(i *Interaction) {
-	if i.TargetUser.LoginName == i.CurrentUser.LoginName {
-		i.RedirectWithFlashTo("/users", Flash{"danger", "You cannot delete yourself."})
-		return
-	}
+func useDeleteUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+			i.RedirectWithFlashTo("/users", Flash{"danger", "You cannot delete yourself."})
+			return
+		}
 
-	i.FormSpec = &h.FormSpec{
-		PostTarget:  "/users/" + i.TargetUser.LoginName + "/delete",
-		SubmitLabel: "Delete user",
-		Fields: []h.FormField{
-			h.StaticField{
-				Value: deleteUserConfirmSnippet.Render(i.TargetUser.LoginName),
+		//a dry-run update is the only way to look at the entire database at once
+		var solelyOwnedGroupNames []string
+		errs := n.Update(func(db *core.Database) (errs errext.ErrorSet) {
+			solelyOwnedGroupNames = db.GroupsSolelyOwnedBy(i.TargetUser.LoginName)
+			if len(solelyOwnedGroupNames) > 0 {
+				//groups that allow temporary membership may be required to have an
+				//owner (see PORTUNUS_GROUP_REQUIRE_OWNERS), so check upfront if the
+				//deletion would be rejected
+				errs.Add(db.DeleteUser(i.TargetUser.LoginName, i.CurrentUser.LoginName, time.Now(), deletedUserRetention))
+			}
+			return errs
+		}, &core.UpdateOptions{DryRun: true})
+		if !errs.IsEmpty() {
+			msg := fmt.Sprintf("User %q cannot be deleted: %s. Please choose other owners for their groups first.", i.TargetUser.LoginName, errs.Join(", "))
+			i.RedirectWithFlashTo("/users", Flash{"danger", msg})
+			return
+		}
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/users/" + i.TargetUser.LoginName + "/delete",
+			SubmitLabel: "Delete user",
+			Fields: []h.FormField{
+				h.StaticField{
+					Value: deleteUserConfirmSnippet.Render(struct {
+						LoginName             string
+						Retention             time.Duration
+						SolelyOwnedGroupNames []string
+					}{i.TargetUser.LoginName, deletedUserRetention, solelyOwnedGroupNames}),
+				},
 			},
-		},
+		}
 	}
 }
 
@@ -462,8 +875,8 @@ func postUserDeleteHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
-		useDeleteUserForm,
-		UseEmptyFormState,
+		useDeleteUserForm(n),
+		ReadFormStateFromRequest,
 		TryUpdateNexus(n, executeDeleteUser),
 		ShowFormIfErrors("Confirm user deletion"),
 		RedirectWithFlashTo("/users", "Deleted"),
@@ -471,13 +884,6 @@ func postUserDeleteHandler(n core.Nexus) http.Handler {
 }
 
 func executeDeleteUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
-	userLoginName := i.TargetUser.LoginName
-	errs.Add(db.Users.Delete(userLoginName))
-
-	for _, group := range db.Groups {
-		if group.MemberLoginNames != nil {
-			group.MemberLoginNames[userLoginName] = false
-		}
-	}
+	errs.Add(db.DeleteUser(i.TargetUser.LoginName, i.CurrentUser.LoginName, time.Now(), deletedUserRetention))
 	return
 }
@@ -0,0 +1,80 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRequiredGroupMembership(t *testing.T) {
+	useFreshSessionTracker(t)
+	vcfg := core.GetValidationConfigForTests()
+	vcfg.RequireGroupMembership = true
+	vcfg.DefaultGroupName = "staff"
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "{PLAINTEXT}swordfish"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe"},
+		}
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"jane": true},
+				Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+			},
+			{Name: "staff", LongName: "All staff"},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	devices, err := store.NewDeviceStore(filepath.Join(t.TempDir(), "devices.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := HTTPHandler(nexus, false, nil, nil, nil, devices, nil, nil, nil, nil, nil, nil, nil, nil)
+	cookie := loginCookieForTests(t, "jane")
+	get := func(path string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Set("Cookie", cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.DeepEqual(t, "status of "+path, rec.Code, http.StatusOK)
+		return rec.Body.String()
+	}
+
+	//the default group is preselected when creating a user
+	body := get("/users/new")
+	isChecked := func(groupName string) bool {
+		return regexp.MustCompile(`value="` + groupName + `"\s+checked`).MatchString(body)
+	}
+	assert.DeepEqual(t, "staff preselected", isChecked("staff"), true)
+	assert.DeepEqual(t, "admins preselected", isChecked("admins"), false)
+	assert.DeepEqual(t, "memberships label", strings.Contains(body, "at least one is required for active users"), true)
+
+	//john predates the policy and is reported as orphaned
+	body = get("/users")
+	assert.DeepEqual(t, "orphan notice", strings.Contains(body, "1 active user(s) are not in any group"), true)
+	body = get("/users?without_groups=true")
+	assert.DeepEqual(t, "filtered list contains john", strings.Contains(body, `href="/users/john/edit"`), true)
+	assert.DeepEqual(t, "filtered list contains jane", strings.Contains(body, `href="/users/jane/edit"`), false)
+}
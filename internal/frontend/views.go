@@ -50,10 +50,32 @@ var mainSnippet = h.NewSnippet(`
 					<div class="nav-area" id="nav-left">
 						{{ if .CurrentUser }}
 							<a href="/self" class="nav-item {{if eq .CurrentSection "self"}}nav-item-current{{end}}">My profile</a>
-							{{if .CurrentUser.Perms.Portunus.IsAdmin}}
+							<a href="/elevations" class="nav-item {{if eq .CurrentSection "elevations"}}nav-item-current{{end}}">Elevations</a>
+							{{if or .CurrentUser.Perms.Portunus.IsAdmin .CurrentUser.Perms.Portunus.CanView}}
 								<a href="/users" class="nav-item {{if eq .CurrentSection "users"}}nav-item-current{{end}}">Users</a>
 								<a href="/groups" class="nav-item {{if eq .CurrentSection "groups"}}nav-item-current{{end}}">Groups</a>
 							{{end}}
+							{{if or .CurrentUser.Perms.Portunus.IsAdmin .CurrentUser.Perms.Portunus.CanView .CurrentUser.Perms.Portunus.CanBrowse}}
+								<a href="/directory" class="nav-item {{if eq .CurrentSection "directory"}}nav-item-current{{end}}">Directory</a>
+							{{end}}
+							{{if .CurrentUser.Perms.Portunus.IsAdmin}}
+								<a href="/service-users" class="nav-item {{if eq .CurrentSection "service-users"}}nav-item-current{{end}}">Service users</a>
+								<a href="/ldap-config" class="nav-item {{if eq .CurrentSection "ldap-config"}}nav-item-current{{end}}">LDAP config</a>
+								<a href="/inspect" class="nav-item {{if eq .CurrentSection "inspect"}}nav-item-current{{end}}">Inspector</a>
+								<a href="/read-only" class="nav-item {{if eq .CurrentSection "read-only"}}nav-item-current{{end}}">Read-only mode{{if .ReadOnly}} (enabled){{end}}</a>
+								{{if .HasDestructiveWindow}}
+									<a href="/destructive-window" class="nav-item {{if eq .CurrentSection "destructive-window"}}nav-item-current{{end}}">Destructive operations{{if .DestructiveWindow}} (open){{end}}</a>
+								{{end}}
+								{{if .HasFeedSync}}
+									<a href="/feed-sync" class="nav-item {{if eq .CurrentSection "feed-sync"}}nav-item-current{{end}}">Feed sync</a>
+								{{end}}
+								{{if .ConflictCount}}
+									<a href="/conflicts" class="nav-item {{if eq .CurrentSection "conflicts"}}nav-item-current{{end}}">Conflicts ({{.ConflictCount}})</a>
+								{{end}}
+								{{if .SeedCorrectionCount}}
+									<a href="/seed-corrections" class="nav-item {{if eq .CurrentSection "seed-corrections"}}nav-item-current{{end}}">Seed corrections ({{.SeedCorrectionCount}})</a>
+								{{end}}
+							{{end}}
 						{{ else }}
 							<a class="nav-item nav-item-current" href="/login">Login to Portunus</a>
 						{{ end }}
@@ -67,8 +89,33 @@ var mainSnippet = h.NewSnippet(`
 				</div>
 			</nav>
 			<main>
-				{{range .Flashes}}<div class="flash flash-{{.Type}}">{{.Message}}</div>{{end}}
+				{{ if .ReadOnly }}
+					<div class="flash flash-warning">
+						Portunus is in read-only mode{{ if .ReadOnly.EnabledBy }}: {{.ReadOnly.Reason}}{{ end }}. Changes cannot be made until read-only mode is disabled.
+						{{- if and .CurrentUser .CurrentUser.Perms.Portunus.IsAdmin }}
+							<a href="/read-only">Disable read-only mode</a>
+						{{- end }}
+					</div>
+				{{ end }}
+				{{ if .ImpersonatedBy }}
+					<div class="flash flash-warning">
+						You are viewing Portunus as it appears to user <code>{{.CurrentUser.LoginName}}</code> (on behalf of <code>{{.ImpersonatedBy}}</code>). No changes can be made while impersonating another user.
+						<a href="/impersonation/end">End impersonation</a>
+					</div>
+				{{ end }}
+				{{ if .DestructiveWindow }}
+					<div class="flash flash-warning">
+						A destructive operations window is open until {{.DestructiveWindow.ExpiresAt.UTC.Format "2006-01-02 15:04"}} UTC (opened by <code>{{.DestructiveWindow.OpenedBy}}</code>).
+						<a href="/destructive-window">Close window</a>
+					</div>
+				{{ end }}
+				{{range .Flashes}}<div class="flash flash-{{.Type}}">{{.Message}}{{with .Link}} <a href="{{.URL}}">{{.Label}}</a>{{end}}</div>{{end}}
 				{{.Page.Contents}}
+				{{ if .DatabaseRevision }}
+					<footer class="small text-muted">
+						Database revision {{.DatabaseRevision}}{{ if .DatabaseUpdatedAt }}, last changed {{.DatabaseUpdatedAt}}{{ end }}
+					</footer>
+				{{ end }}
 			</main>
 		</body>
 	</html>
@@ -80,8 +127,21 @@ type Flash struct {
 	Message string
 }
 
+// FlashLink can be added to the session right after a Flash to show a link
+// at the end of its message.
+type FlashLink struct {
+	Label string
+	URL   string
+}
+
 func init() {
 	gob.Register(Flash{})
+	gob.Register(FlashLink{})
+}
+
+type flashWithLink struct {
+	Flash
+	Link *FlashLink
 }
 
 // Page describes a HTML page produced by Portunus.
@@ -95,24 +155,56 @@ type Page struct {
 // Render renders the given page.
 func (p Page) Render(w http.ResponseWriter, r *http.Request, currentUser *core.UserWithPerms, s *sessions.Session) {
 	data := struct {
-		Page                Page
-		CurrentUser         *core.UserWithPerms
-		CurrentUserFullName string
-		CurrentSection      string
-		Navigation          template.HTML
-		Flashes             []Flash
+		Page                 Page
+		CurrentUser          *core.UserWithPerms
+		CurrentUserFullName  string
+		CurrentSection       string
+		Navigation           template.HTML
+		Flashes              []flashWithLink
+		ConflictCount        int
+		SeedCorrectionCount  int
+		HasFeedSync          bool
+		HasDestructiveWindow bool
+		//only set for admins while a window is open
+		DestructiveWindow *core.DestructiveWindowState
+		ReadOnly          *core.ReadOnlyState
+		ImpersonatedBy    string
+		DatabaseRevision  uint64
+		DatabaseUpdatedAt string
 	}{
-		Page:           p,
-		CurrentUser:    currentUser,
-		CurrentSection: strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0],
+		Page:                 p,
+		CurrentUser:          currentUser,
+		CurrentSection:       strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0],
+		ConflictCount:        countMergeConflicts(),
+		SeedCorrectionCount:  len(listSeedCorrections()),
+		HasFeedSync:          feedSync != nil,
+		HasDestructiveWindow: destructiveWindow != nil,
+		ReadOnly:             readOnlyStateForBanner(),
 	}
 	if currentUser != nil {
 		data.CurrentUserFullName = currentUser.FullName()
+		data.ImpersonatedBy, _ = s.Values["impersonated_by"].(string)
+		if state, isOpen := currentDestructiveWindow(); isOpen && currentUser.Perms.Portunus.IsAdmin {
+			data.DestructiveWindow = &state
+		}
+		//support staff can quote this when correlating log messages
+		if currentUser.Perms.Portunus.IsAdmin && databaseRevision != nil {
+			revision, updatedAt := databaseRevision()
+			data.DatabaseRevision = revision
+			if !updatedAt.IsZero() {
+				data.DatabaseUpdatedAt = updatedAt.Local().Format("2006-01-02 15:04:05 MST")
+			}
+		}
 	}
 
 	for _, value := range s.Flashes() {
-		if f, ok := value.(Flash); ok {
-			data.Flashes = append(data.Flashes, f)
+		switch value := value.(type) {
+		case Flash:
+			data.Flashes = append(data.Flashes, flashWithLink{Flash: value})
+		case FlashLink:
+			if len(data.Flashes) > 0 {
+				data.Flashes[len(data.Flashes)-1].Link = &value
+			}
 		}
 	}
 	err := s.Save(r, w)
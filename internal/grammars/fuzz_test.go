@@ -49,6 +49,19 @@ func FuzzIsNonnegativeInteger(f *testing.F) {
 	})
 }
 
+func FuzzIsOUName(f *testing.F) {
+	ouNameRx := regexp.MustCompile(OUNameRegex)
+	f.Add("users")
+	f.Add("posix-groups")
+	f.Fuzz(func(t *testing.T, input string) {
+		actual := IsOUName(input)
+		expected := ouNameRx.MatchString(input)
+		if actual != expected {
+			t.Errorf("expected IsOUName(%q) = %t, but got %t", input, expected, actual)
+		}
+	})
+}
+
 func FuzzIsPOSIXAccountName(f *testing.F) {
 	posixAccountNameRx := regexp.MustCompile(POSIXAccountNameRegex)
 	f.Add("john_doe")
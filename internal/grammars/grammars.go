@@ -35,6 +35,14 @@ const (
 	// This is only shown for documentation purposes here; use func IsNonnegativeInteger instead.
 	NonnegativeIntegerRegex = `^(?:0|[1-9][0-9]*)$`
 
+	// OUNameRegex is a regex for matching the names of the organizational units
+	// that Portunus places its objects in, e.g. `users` for `ou=users,dc=example,dc=org`.
+	// This is deliberately stricter than the DN syntax, so that these names never
+	// need to be escaped.
+	//
+	// This is only shown for documentation purposes here; use func IsOUName instead.
+	OUNameRegex = `^[A-Za-z0-9][A-Za-z0-9_-]*$`
+
 	// POSIXAccountNameRegex is a regex for matching POSIX user or group names.
 	// This regex is based on the respective format description in the useradd(8) manpage.
 	//
@@ -146,6 +154,26 @@ func checkByteInPositiveInteger(idx, length int, b byte) bool {
 	}
 }
 
+// IsOUName returns whether the string matches OUNameRegex.
+func IsOUName(input string) bool {
+	if len(input) == 0 {
+		return false
+	}
+	return checkEachByte([]byte(input), checkByteInOUName)
+}
+
+func checkByteInOUName(idx, length int, b byte) bool {
+	_ = length
+	switch {
+	case (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9'):
+		return true
+	case b == '-' || b == '_':
+		return idx != 0 // not allowed at start
+	default:
+		return false
+	}
+}
+
 // IsPOSIXAccountName returns whether the string matches POSIXAccountNameRegex.
 func IsPOSIXAccountName(input string) bool {
 	input = strings.TrimSuffix(input, "$")
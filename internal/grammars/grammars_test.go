@@ -66,6 +66,18 @@ func TestGrammars(t *testing.T) {
 		"080", //leading zero
 		"0.5", //invalid characters
 		"a+2", //invalid characters
+
+		//valid OU names
+		"users",
+		"People",
+		"posix-groups",
+		"role_2",
+		//invalid OU names
+		"",
+		"-people",        //dash not allowed at start
+		"people,ou=role", //no nesting
+		"Abteilung Süd",  //spaces and Unicode chars not allowed
+		"ou=people",      //only the value, not the entire RDN
 	}
 
 	// The test checks that the Is...() functions return the same results as
@@ -73,6 +85,7 @@ func TestGrammars(t *testing.T) {
 	ldapSuffixRx := regexp.MustCompile(LDAPSuffixRegex)
 	listenAddressRx := regexp.MustCompile(ListenAddressRegex)
 	nonnegativeIntegerRx := regexp.MustCompile(NonnegativeIntegerRegex)
+	ouNameRx := regexp.MustCompile(OUNameRegex)
 	posixAccountNameRx := regexp.MustCompile(POSIXAccountNameRegex)
 
 	for _, input := range testCases {
@@ -94,6 +107,12 @@ func TestGrammars(t *testing.T) {
 			t.Errorf("expected IsPOSIXAccountName(%q) = %t, but got %t", input, expected, actual)
 		}
 
+		actual = IsOUName(input)
+		expected = ouNameRx.MatchString(input)
+		if actual != expected {
+			t.Errorf("expected IsOUName(%q) = %t, but got %t", input, expected, actual)
+		}
+
 		actual = IsPOSIXAccountName(input)
 		expected = posixAccountNameRx.MatchString(input)
 		if actual != expected {
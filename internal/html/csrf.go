@@ -0,0 +1,50 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package h
+
+import (
+	"net/http"
+
+	"github.com/gorilla/csrf"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// How long a CSRF token stays valid after it was issued, in seconds.
+const csrfTokenMaxAge = 30 * 60
+
+// ProtectAgainstCSRF wraps the given handler in a middleware that rejects all
+// POST requests that do not carry the CSRF token which FormSpec.Render()
+// embeds into each form. Rejected requests are served by the given failure
+// handler, which shall respond with status 403. Use csrf.FailureReason() to
+// find out why the request was rejected.
+//
+// The given function decides for each request whether the CSRF cookie gets
+// the Secure flag.
+func ProtectAgainstCSRF(inner http.Handler, isSecure func(*http.Request) bool, failureHandler http.Handler) http.Handler {
+	//the Secure flag can only be configured per middleware instance, so we need
+	//two of them; since they share the key, each accepts the cookies of the other
+	csrfKey := core.GenerateRandomKey(32)
+	buildMiddleware := func(secure bool) http.Handler {
+		middleware := csrf.Protect(csrfKey,
+			csrf.MaxAge(csrfTokenMaxAge),
+			csrf.Secure(secure),
+			csrf.SameSite(csrf.SameSiteStrictMode),
+			csrf.ErrorHandler(failureHandler),
+		)
+		return middleware(inner)
+	}
+	secureHandler := buildMiddleware(true)
+	insecureHandler := buildMiddleware(false)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSecure(r) {
+			secureHandler.ServeHTTP(w, r)
+		} else {
+			insecureHandler.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package h
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+var csrfTokenRx = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+func TestCSRFProtection(t *testing.T) {
+	processedCount := 0
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(createUserForm.Render(r, FormState{})))
+		case http.MethodPost:
+			processedCount++
+			w.WriteHeader(http.StatusSeeOther)
+		}
+	})
+	failureHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	handler := ProtectAgainstCSRF(inner, func(*http.Request) bool { return false }, failureHandler)
+
+	//render the form like the browser would see it
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/new", nil))
+	assert.DeepEqual(t, "status for GET", rec.Code, http.StatusOK)
+	match := csrfTokenRx.FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("no CSRF token found in rendered form: %s", rec.Body.String())
+	}
+	token := match[1]
+	cookies := rec.Result().Cookies()
+	assert.DeepEqual(t, "cookie count", len(cookies), 1)
+	assert.DeepEqual(t, "cookie SameSite", cookies[0].SameSite, http.SameSiteStrictMode)
+
+	submit := func(token string, withCookie bool) int {
+		values := url.Values{"login_name": {"jane"}, "password": {"swordfish"}}
+		if token != "" {
+			values.Set("gorilla.csrf.Token", token)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/users/new", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if withCookie {
+			r.AddCookie(cookies[0])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	//a POST from a foreign page (which cannot read the token) is rejected
+	assert.DeepEqual(t, "status without token", submit("", true), http.StatusForbidden)
+	assert.DeepEqual(t, "status with forged token", submit(strings.Repeat("A", len(token)), true), http.StatusForbidden)
+	//the token is only valid together with the cookie that it was issued for
+	assert.DeepEqual(t, "status without cookie", submit(token, false), http.StatusForbidden)
+	assert.DeepEqual(t, "processed count after rejected requests", processedCount, 0)
+
+	//the legitimate form submission goes through
+	assert.DeepEqual(t, "status with token", submit(token, true), http.StatusSeeOther)
+	assert.DeepEqual(t, "processed count after valid request", processedCount, 1)
+}
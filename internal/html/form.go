@@ -7,7 +7,11 @@
 package h
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 
 	"github.com/gorilla/csrf"
@@ -20,8 +24,10 @@ import (
 
 // FormState describes the state of an HTML form.
 type FormState struct {
-	Fields        map[string]*FieldState
-	ErrorMessages []string //errors that do not apply to specific fields
+	Fields          map[string]*FieldState
+	ErrorMessages   []string //errors that do not apply to specific fields
+	SubmissionToken string   //see ClaimSubmission
+	isClaimed       bool
 }
 
 // IsValid returns false if any field has a validation error.
@@ -37,6 +43,43 @@ func (s FormState) IsValid() bool {
 	return true
 }
 
+// ClaimSubmission shall be called by POST handlers after ReadState(). If the
+// same form was already submitted successfully before, the URL of the result
+// page of that earlier submission is returned, and the handler shall redirect
+// there instead of processing the submission again.
+//
+// Otherwise, the submission is claimed by this request until either
+// CompleteSubmission() or ReleaseSubmission() is called. Concurrent
+// submissions of the same form wait for that to happen.
+func (s *FormState) ClaimSubmission() (resultURL string, isDuplicate bool) {
+	if s.SubmissionToken == "" || s.isClaimed {
+		return "", false
+	}
+	resultURL, isDuplicate = submissions.Claim(s.SubmissionToken)
+	s.isClaimed = !isDuplicate
+	return resultURL, isDuplicate
+}
+
+// CompleteSubmission records that the submission claimed by ClaimSubmission()
+// was successful, and that repeated submissions of the same form shall be sent
+// to the given result page.
+func (s *FormState) CompleteSubmission(resultURL string) {
+	if s.isClaimed {
+		submissions.Complete(s.SubmissionToken, resultURL)
+		s.isClaimed = false
+	}
+}
+
+// ReleaseSubmission records that the submission claimed by ClaimSubmission()
+// was not successful, so that the same form may be submitted again. This is a
+// no-op if the submission was not claimed or has already been completed.
+func (s *FormState) ReleaseSubmission() {
+	if s.isClaimed {
+		submissions.Release(s.SubmissionToken)
+		s.isClaimed = false
+	}
+}
+
 // FillErrorsFrom distributes all core.ValidationError instances matching the
 // given ObjectRef into the individual FieldState.ErrorMessage fields,
 // and collects all other errors in the main FormState.ErrorMessages field.
@@ -61,6 +104,7 @@ type FieldState struct {
 	Value        string          //only used by InputFieldSpec
 	Selected     map[string]bool //only used by SelectFieldSpec
 	IsUnfolded   bool            //only used by FieldSet
+	Upload       []byte          //only used by FileFieldSpec
 	ErrorMessage string
 }
 
@@ -87,6 +131,60 @@ type FormSpec struct {
 	PostTarget  string
 	SubmitLabel string
 	Fields      []FormField
+	ReadOnly    bool //if true, the form is rendered without a submit button
+	IsMultipart bool //must be true if the form contains a FileFieldSpec
+	//If true, the submit button is not disabled by WithReadOnlyMode, because
+	//submitting this form does not change the database.
+	IgnoresReadOnlyMode bool
+}
+
+type readOnlyModeKey struct{}
+
+// WithReadOnlyMode returns a copy of the request for which all forms are
+// rendered with a disabled submit button, except for those that set
+// FormSpec.IgnoresReadOnlyMode.
+func WithReadOnlyMode(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), readOnlyModeKey{}, true))
+}
+
+func isReadOnlyMode(r *http.Request) bool {
+	isReadOnly, _ := r.Context().Value(readOnlyModeKey{}).(bool)
+	return isReadOnly
+}
+
+// AsReadOnly returns a copy of this form in which all fields are read-only.
+func (f FormSpec) AsReadOnly() FormSpec {
+	f.Fields = makeReadOnly(f.Fields)
+	f.ReadOnly = true
+	return f
+}
+
+func makeReadOnly(fields []FormField) []FormField {
+	result := make([]FormField, 0, len(fields))
+	for _, field := range fields {
+		switch field := field.(type) {
+		case InputFieldSpec:
+			field.ReadOnly = true
+			result = append(result, field)
+		case MultilineInputFieldSpec:
+			field.ReadOnly = true
+			result = append(result, field)
+		case SelectFieldSpec:
+			field.ReadOnly = true
+			result = append(result, field)
+		case FieldSet:
+			field.Fields = makeReadOnly(field.Fields)
+			field.ReadOnly = true
+			result = append(result, field)
+		case FileFieldSpec:
+			//there is nothing to show for an upload field
+			continue
+		default:
+			//StaticField is read-only by definition
+			result = append(result, field)
+		}
+	}
+	return result
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
@@ -95,6 +193,7 @@ func (f FormSpec) ReadState(r *http.Request, s *FormState) {
 	if s.Fields == nil {
 		s.Fields = make(map[string]*FieldState)
 	}
+	s.SubmissionToken = r.PostForm.Get(submissionTokenFieldName)
 	for _, field := range f.Fields {
 		field.ReadState(r, s)
 	}
@@ -104,24 +203,34 @@ var formSpecSnippet = NewSnippet(`
 	{{- range .ErrorMessages }}
 		<div class="flash flash-danger">{{ . }}</div>
 	{{- end }}
-	<form method="POST" action={{.Spec.PostTarget}}>
+	<form method="POST" action="{{.Spec.PostTarget}}" {{- if .Spec.IsMultipart }} enctype="multipart/form-data"{{ end }}>
 		{{.Fields}}
-		<div class="button-row">
-			<button type="submit" class="button button-primary">{{.Spec.SubmitLabel}}</button>
-		</div>
+		{{- if not .Spec.ReadOnly }}
+			<div class="button-row">
+				<button type="submit" class="button button-primary" {{- if .SubmitDisabled }} disabled{{ end }}>{{.Spec.SubmitLabel}}</button>
+			</div>
+		{{- end }}
 	</form>
 `)
 
-// Render produces the HTML for this form.
+var submissionTokenSnippet = NewSnippet(`<input type="hidden" name="` + submissionTokenFieldName + `" value="{{.}}">`)
+
+// Render produces the HTML for this form. Unless the form is read-only, each
+// call issues a new submission token (see FormState.ClaimSubmission).
 func (f FormSpec) Render(r *http.Request, s FormState) template.HTML {
 	data := struct {
-		Spec          FormSpec
-		Fields        template.HTML
-		ErrorMessages []string
+		Spec           FormSpec
+		Fields         template.HTML
+		ErrorMessages  []string
+		SubmitDisabled bool
 	}{
-		Spec:          f,
-		Fields:        csrf.TemplateField(r),
-		ErrorMessages: s.ErrorMessages,
+		Spec:           f,
+		Fields:         csrf.TemplateField(r),
+		ErrorMessages:  s.ErrorMessages,
+		SubmitDisabled: !f.IgnoresReadOnlyMode && isReadOnlyMode(r),
+	}
+	if !f.ReadOnly {
+		data.Fields += submissionTokenSnippet.Render(submissions.Issue())
 	}
 	for _, field := range f.Fields {
 		data.Fields = data.Fields + field.RenderField(s)
@@ -139,11 +248,18 @@ type InputFieldSpec struct {
 	InputType        string
 	AutoFocus        bool
 	AutocompleteMode string
+	ReadOnly         bool
+	//If Suggestions is not empty, these values are offered for completion
+	//through a <datalist>, but the user can still enter any other value.
+	Suggestions []string
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
 // in the given FormState.
 func (f InputFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	if f.ReadOnly {
+		return
+	}
 	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
 }
 
@@ -159,9 +275,18 @@ var inputFieldSnippet = NewSnippet(`
 			name="{{.Spec.Name}}" type="{{.Spec.InputType}}"
 			{{ if and (ne .State.Value "") (ne .Spec.InputType "password") }}value="{{.State.Value}}"{{ end }}
 			{{ if .Spec.AutoFocus }}autofocus{{ end }}
+			{{ if .Spec.ReadOnly }}readonly{{ end }}
 			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
 			autocomplete="{{if .Spec.AutocompleteMode}}{{.Spec.AutocompleteMode}}{{else}}off{{end}}"
+			{{ if .Spec.Suggestions }}list="{{.Spec.Name}}-suggestions"{{ end }}
 		/>
+		{{- if .Spec.Suggestions }}
+			<datalist id="{{.Spec.Name}}-suggestions">
+				{{- range .Spec.Suggestions }}
+					<option value="{{.}}"></option>
+				{{- end }}
+			</datalist>
+		{{- end }}
 	</div>
 `)
 
@@ -185,13 +310,17 @@ func (f InputFieldSpec) RenderField(state FormState) template.HTML {
 
 // MultilineInputFieldSpec describes a single <input> field within type FormSpec.
 type MultilineInputFieldSpec struct {
-	Name  string
-	Label string
+	Name     string
+	Label    string
+	ReadOnly bool
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
 // in the given FormState.
 func (f MultilineInputFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	if f.ReadOnly {
+		return
+	}
 	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
 }
 
@@ -206,6 +335,7 @@ var multilineInputFieldSnippet = NewSnippet(`
 		<textarea
 			name="{{.Spec.Name}}"
 			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
+			{{ if .Spec.ReadOnly }}readonly{{ end }}
 			autocomplete="off">
 				{{- .State.Value -}}
 		</textarea>
@@ -227,6 +357,74 @@ func (f MultilineInputFieldSpec) RenderField(state FormState) template.HTML {
 	return multilineInputFieldSnippet.Render(data)
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// type FileFieldSpec
+
+// FileFieldSpec describes an <input type="file"> field within type FormSpec.
+// The uploaded file is stored in FieldState.Upload. Forms containing this
+// field must have FormSpec.IsMultipart set.
+type FileFieldSpec struct {
+	Name    string
+	Label   string
+	Accept  string //list of MIME types, e.g. "image/png,image/jpeg"
+	MaxSize int64  //in bytes
+}
+
+// ReadState implements the FormField interface.
+func (f FileFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	s := &FieldState{}
+	formState.Fields[f.Name] = s
+
+	file, header, err := r.FormFile(f.Name)
+	if errors.Is(err, http.ErrMissingFile) {
+		return //no file was uploaded
+	}
+	if err != nil {
+		s.ErrorMessage = err.Error()
+		return
+	}
+	defer file.Close()
+	if f.MaxSize > 0 && header.Size > f.MaxSize {
+		s.ErrorMessage = fmt.Sprintf("may not be larger than %d KiB", f.MaxSize/1024)
+		return
+	}
+	s.Upload, err = io.ReadAll(file)
+	if err != nil {
+		s.ErrorMessage = err.Error()
+	}
+}
+
+var fileFieldSnippet = NewSnippet(`
+	<div class="form-row">
+		<label for="{{.Spec.Name}}">
+			{{.Spec.Label}}
+			{{if .State.ErrorMessage}}
+				<span class="form-error">{{.State.ErrorMessage}}</span>
+			{{end}}
+		</label>
+		<input
+			id="{{.Spec.Name}}" name="{{.Spec.Name}}" type="file"
+			{{ if .Spec.Accept }}accept="{{.Spec.Accept}}"{{ end }}
+			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
+		/>
+	</div>
+`)
+
+// RenderField implements the FormField interface.
+func (f FileFieldSpec) RenderField(state FormState) template.HTML {
+	data := struct {
+		Spec  FileFieldSpec
+		State *FieldState
+	}{
+		Spec:  f,
+		State: state.Fields[f.Name],
+	}
+	if data.State == nil {
+		data.State = &FieldState{}
+	}
+	return fileFieldSnippet.Render(data)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // type StaticField
 
@@ -255,6 +453,34 @@ func (f StaticField) RenderField(FormState) template.HTML {
 	return staticFieldSnippet.Render(f)
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// type HiddenFieldSpec
+
+// HiddenFieldSpec describes an <input type="hidden"> field within type
+// FormSpec. Its value is round-tripped through the browser in FieldState.Value.
+type HiddenFieldSpec struct {
+	Name string
+}
+
+// ReadState implements the FormField interface.
+func (f HiddenFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
+}
+
+var hiddenFieldSnippet = NewSnippet(`<input type="hidden" name="{{.Name}}" value="{{.Value}}">`)
+
+// RenderField implements the FormField interface.
+func (f HiddenFieldSpec) RenderField(state FormState) template.HTML {
+	data := struct {
+		Name  string
+		Value string
+	}{Name: f.Name}
+	if s := state.Fields[f.Name]; s != nil {
+		data.Value = s.Value
+	}
+	return hiddenFieldSnippet.Render(data)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // type FieldSet
 
@@ -264,10 +490,14 @@ type FieldSet struct {
 	Label      string
 	Fields     []FormField
 	IsFoldable bool
+	ReadOnly   bool //if true, neither the fold state nor the contained fields are read from requests
 }
 
 // ReadState implements the FormField interface.
 func (fs FieldSet) ReadState(r *http.Request, s *FormState) {
+	if fs.ReadOnly {
+		return
+	}
 	if fs.IsFoldable {
 		isUnfolded := r.PostForm.Get(fs.Name) == "1"
 		s.Fields[fs.Name] = &FieldState{IsUnfolded: isUnfolded}
@@ -285,7 +515,7 @@ func (fs FieldSet) ReadState(r *http.Request, s *FormState) {
 // special layouting rules that make styling them with CSS unnecessarily hard.
 var fieldSetSnippet = NewSnippet(`
 	{{if .Spec.IsFoldable}}
-		<input type="checkbox" class="for-fieldset" id="{{.Spec.Name}}" name="{{.Spec.Name}}" value="1" {{if .State.IsUnfolded}}checked{{end}}>
+		<input type="checkbox" class="for-fieldset" id="{{.Spec.Name}}" name="{{.Spec.Name}}" value="1" {{if .State.IsUnfolded}}checked{{end}} {{if .Spec.ReadOnly}}disabled{{end}}>
 	{{end}}
 	<fieldset>
 		<label for="{{.Spec.Name}}">{{.Spec.Label}}</label>
@@ -0,0 +1,138 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package h
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// How long a form can be submitted after it was rendered while still being
+// protected against duplicate submission. Forms that are submitted later are
+// processed normally. This is also how long completed submissions are
+// remembered.
+const submissionTokenLifetime = 24 * time.Hour
+
+// The name of the hidden form field that carries the submission token.
+const submissionTokenFieldName = "submission_token"
+
+// Each rendered form carries a one-time token. When a form is submitted, its
+// token is claimed by the first request. When the request succeeds, the token
+// remembers the URL of the result page, so that a repeated submission of the
+// same form (e.g. by reloading the page or going back in the browser history)
+// can be sent to the result page instead of applying the same change twice.
+type submissionTracker struct {
+	mutex     sync.Mutex
+	now       func() time.Time
+	entries   map[string]*submissionEntry
+	lastPrune time.Time
+}
+
+type submissionEntry struct {
+	issuedAt  time.Time
+	claimed   bool
+	resultURL string        //only set when the submission was completed
+	done      chan struct{} //closed when a claimed submission is completed or released
+}
+
+var submissions = newSubmissionTracker(time.Now)
+
+func newSubmissionTracker(now func() time.Time) *submissionTracker {
+	return &submissionTracker{
+		now:     now,
+		entries: make(map[string]*submissionEntry),
+	}
+}
+
+// Issue generates a new token for a form that is being rendered.
+func (t *submissionTracker) Issue() string {
+	token := hex.EncodeToString(core.GenerateRandomKey(16))
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	t.pruneIfNecessary(now)
+	t.entries[token] = &submissionEntry{issuedAt: now}
+	return token
+}
+
+// Claim is called when a form with the given token is submitted. If the token
+// was already used by a successful submission, the URL of its result page is
+// returned. If another request holding this token is still in flight, Claim
+// waits for it to finish first.
+//
+// Unknown tokens (e.g. from forms rendered before a restart) are claimed as if
+// they had just been issued.
+func (t *submissionTracker) Claim(token string) (resultURL string, isDuplicate bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for {
+		entry, exists := t.entries[token]
+		if !exists {
+			entry = &submissionEntry{issuedAt: t.now()}
+			t.entries[token] = entry
+		}
+		if entry.resultURL != "" {
+			return entry.resultURL, true
+		}
+		if !entry.claimed {
+			entry.claimed = true
+			entry.done = make(chan struct{})
+			return "", false
+		}
+
+		//another request is processing this submission right now -> wait for it
+		//to finish, then check again
+		done := entry.done
+		t.mutex.Unlock()
+		<-done
+		t.mutex.Lock()
+	}
+}
+
+// Complete records that the submission holding this token was successful, and
+// that repeated submissions shall be sent to the given result page.
+func (t *submissionTracker) Complete(token, resultURL string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry, exists := t.entries[token]
+	if !exists || !entry.claimed || entry.resultURL != "" {
+		return
+	}
+	entry.resultURL = resultURL
+	close(entry.done)
+}
+
+// Release records that the submission holding this token was not successful
+// (e.g. because of validation errors), so the same form may be submitted again.
+func (t *submissionTracker) Release(token string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry, exists := t.entries[token]
+	if !exists || !entry.claimed || entry.resultURL != "" {
+		return
+	}
+	entry.claimed = false
+	close(entry.done)
+}
+
+// Must be called with t.mutex held.
+func (t *submissionTracker) pruneIfNecessary(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for token, entry := range t.entries {
+		isInFlight := entry.claimed && entry.resultURL == ""
+		if !isInFlight && now.Sub(entry.issuedAt) > submissionTokenLifetime {
+			delete(t.entries, token)
+		}
+	}
+}
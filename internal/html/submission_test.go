@@ -0,0 +1,182 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package h
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+var createUserForm = FormSpec{
+	PostTarget:  "/users/new",
+	SubmitLabel: "Create user",
+	Fields: []FormField{
+		InputFieldSpec{InputType: "text", Name: "login_name", Label: "Login name"},
+		InputFieldSpec{InputType: "password", Name: "password", Label: "Password"},
+	},
+}
+
+var selfServiceForm = FormSpec{
+	PostTarget:  "/self",
+	SubmitLabel: "Update profile",
+	Fields: []FormField{
+		FieldSet{
+			Name:       "change_password",
+			Label:      "Change password",
+			IsFoldable: true,
+			Fields: []FormField{
+				InputFieldSpec{InputType: "password", Name: "old_password", Label: "Old password"},
+				InputFieldSpec{InputType: "password", Name: "new_password", Label: "New password"},
+			},
+		},
+	},
+}
+
+var submissionTokenRx = regexp.MustCompile(`name="submission_token" value="([0-9a-f]+)"`)
+
+// Renders the form like a GET handler would, and returns the submission token
+// from the rendered HTML.
+func renderForToken(t *testing.T, f FormSpec) string {
+	t.Helper()
+	html := string(f.Render(httptest.NewRequest(http.MethodGet, f.PostTarget, nil), FormState{}))
+	match := submissionTokenRx.FindStringSubmatch(html)
+	if match == nil {
+		t.Fatalf("no submission token found in rendered form: %s", html)
+	}
+	return match[1]
+}
+
+// Reads the form state from a POST request like ReadFormStateFromRequest would.
+func submitForm(f FormSpec, values url.Values) *FormState {
+	r := httptest.NewRequest(http.MethodPost, f.PostTarget, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err := r.ParseForm()
+	if err != nil {
+		panic(err.Error())
+	}
+	var s FormState
+	f.ReadState(r, &s)
+	return &s
+}
+
+func TestDoubleSubmitOfCreateUserForm(t *testing.T) {
+	values := url.Values{
+		"login_name":       {"jane"},
+		"password":         {"swordfish"},
+		"submission_token": {renderForToken(t, createUserForm)},
+	}
+
+	//first submission is processed and redirects to the users list
+	s := submitForm(createUserForm, values)
+	resultURL, isDuplicate := s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate on first submit", isDuplicate, false)
+	assert.DeepEqual(t, "resultURL on first submit", resultURL, "")
+	s.CompleteSubmission("/users")
+
+	//browser resubmits the same form (e.g. after "back" or "reload") -> not
+	//processed again, but sent to the same result page
+	s = submitForm(createUserForm, values)
+	resultURL, isDuplicate = s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate on second submit", isDuplicate, true)
+	assert.DeepEqual(t, "resultURL on second submit", resultURL, "/users")
+
+	//a freshly rendered form can be submitted again
+	values.Set("submission_token", renderForToken(t, createUserForm))
+	s = submitForm(createUserForm, values)
+	_, isDuplicate = s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate on new form", isDuplicate, false)
+	s.ReleaseSubmission()
+
+	//forms without a token (e.g. rendered by an older version) are not protected
+	values.Del("submission_token")
+	for idx := 0; idx < 2; idx++ {
+		s = submitForm(createUserForm, values)
+		_, isDuplicate = s.ClaimSubmission()
+		assert.DeepEqual(t, "isDuplicate without token", isDuplicate, false)
+		s.CompleteSubmission("/users")
+	}
+}
+
+func TestDoubleSubmitOfSelfServicePasswordForm(t *testing.T) {
+	values := url.Values{
+		"change_password":  {"1"},
+		"old_password":     {"wrong"},
+		"new_password":     {"swordfish"},
+		"submission_token": {renderForToken(t, selfServiceForm)},
+	}
+
+	//first submission fails validation -> the claim is released, so the same
+	//submission may be sent again (e.g. by reloading the error page)
+	s := submitForm(selfServiceForm, values)
+	_, isDuplicate := s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate on failed submit", isDuplicate, false)
+	s.ReleaseSubmission()
+
+	//second submission succeeds
+	s = submitForm(selfServiceForm, values)
+	_, isDuplicate = s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate on retry", isDuplicate, false)
+
+	//while the second submission is in flight, a third one (e.g. from a
+	//double-click) waits for it to finish instead of being processed in parallel
+	type result struct {
+		URL         string
+		IsDuplicate bool
+	}
+	resultChan := make(chan result)
+	go func() {
+		s := submitForm(selfServiceForm, values)
+		url, isDuplicate := s.ClaimSubmission()
+		resultChan <- result{url, isDuplicate}
+	}()
+	select {
+	case <-resultChan:
+		t.Fatal("concurrent submission did not wait for the submission in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.CompleteSubmission("/self")
+	assert.DeepEqual(t, "result of concurrent submit", <-resultChan, result{"/self", true})
+
+	//the password change is not applied again when going back and resubmitting
+	s = submitForm(selfServiceForm, values)
+	resultURL, isDuplicate := s.ClaimSubmission()
+	assert.DeepEqual(t, "isDuplicate after success", isDuplicate, true)
+	assert.DeepEqual(t, "resultURL after success", resultURL, "/self")
+}
+
+func TestSubmissionTokensExpire(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tracker := newSubmissionTracker(func() time.Time { return now })
+
+	completedToken := tracker.Issue()
+	tracker.Claim(completedToken)
+	tracker.Complete(completedToken, "/users")
+	inFlightToken := tracker.Issue()
+	tracker.Claim(inFlightToken)
+	unusedToken := tracker.Issue()
+	assert.DeepEqual(t, "entry count before expiry", len(tracker.entries), 3)
+
+	//after the token lifetime, everything except for in-flight submissions is forgotten
+	now = now.Add(submissionTokenLifetime + time.Minute)
+	tracker.Issue()
+	assert.DeepEqual(t, "entry count after expiry", len(tracker.entries), 2)
+	_, isKnown := tracker.entries[inFlightToken]
+	assert.DeepEqual(t, "in-flight token is retained", isKnown, true)
+
+	//forgotten tokens can be submitted as if they were new
+	_, isDuplicate := tracker.Claim(completedToken)
+	assert.DeepEqual(t, "isDuplicate for expired token", isDuplicate, false)
+	_, isDuplicate = tracker.Claim(unusedToken)
+	assert.DeepEqual(t, "isDuplicate for expired unused token", isDuplicate, false)
+}
@@ -8,14 +8,33 @@ package ldap
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	goldap "github.com/go-ldap/ldap/v3"
 	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/logging"
+	"github.com/sapcc/go-bits/logg"
 )
 
+// How often the Adapter checks for user accounts that have expired since the
+// last database change (see User.ValidUntil).
+const expiryCheckInterval = time.Minute
+
+// How many write operations the Adapter sends to the LDAP server without
+// waiting for their results. The LDAP protocol allows several requests to be
+// in flight on the same connection, which saves a lot of round-trips when a
+// large number of objects is written at once (e.g. during the initial sync).
+const maxPipelinedOperations = 16
+
+// How many write operations the Adapter executes before checking whether a
+// newer snapshot of the Portunus database has arrived in the meantime.
+const syncChunkSize = 4 * maxPipelinedOperations
+
 // Adapter translates changes to the Portunus database into updates in the LDAP
 // database.
 type Adapter struct {
@@ -24,15 +43,92 @@ type Adapter struct {
 	init         sync.Once
 	objects      []Object //persisted objects, key = object DN
 	objectsMutex sync.Mutex
+	health       core.HealthStatus
+	stats        SyncStats
+	statsMutex   sync.Mutex
+	resyncChan   chan struct{}
+	//These are guarded by statsMutex as well (see FailingEntities).
+	entityStatus    map[string]EntitySyncStatus //key = object DN
+	syncErrorCounts map[string]uint64           //key = entity type
+
+	//the layout of user entries (see SetUserLayout)
+	layoutMutex sync.Mutex
+	userLayout  UserLayout
+
+	//state for shadow mode (see EnableShadowMode)
+	shadowMutex  sync.Mutex
+	isShadowMode bool
+	shadowReport *ShadowReport
+	//These are only accessed by the goroutine that executes Run(). While a sync
+	//is computed in shadow mode, isPlanning is set, and executeOperations()
+	//records the operations instead of executing them.
+	isPlanning         bool
+	recordedOperations []operation
+
+	//If HideTemporaryPasswords is set, users that need to change their
+	//password (see core.User.MustChangePassword) cannot bind until they have
+	//done so. This must be set before Run() is called.
+	HideTemporaryPasswords bool
+	//The names of the OUs that contain user and group entries. This must be
+	//set before Run() is called. NewAdapter() sets it to DefaultOUNames.
+	OUNames OUNames
+}
+
+// SyncStats contains statistics about how the Adapter keeps up with changes to
+// the Portunus database.
+type SyncStats struct {
+	//how long the most recent sync took, and how many write operations it sent
+	LastSyncDuration   time.Duration
+	LastSyncOperations int
+	//how many database snapshots are waiting to be synced (since snapshots that
+	//arrive during a sync are coalesced, this is at most 1)
+	QueueDepth int
+	//how many database snapshots were skipped entirely because a newer one
+	//arrived before they could be synced
+	CoalescedSnapshots uint64
+	//how many write operations are left in the sync that is currently running
+	PendingOperations int
+	//how often a running sync was replanned because a newer snapshot arrived
+	//(this is expected to happen mostly during long resyncs)
+	Preemptions uint64
 }
 
 // NewAdapter initializes an Adapter instance.
 func NewAdapter(nexus core.Nexus, conn Connection) *Adapter {
-	return &Adapter{nexus: nexus, conn: conn}
+	a := &Adapter{nexus: nexus, conn: conn, resyncChan: make(chan struct{}, 1), userLayout: FlatUserLayout, OUNames: DefaultOUNames}
+	a.health.Report(errors.New("initial synchronization into LDAP has not completed yet"))
+	return a
+}
+
+// CheckHealth implements the core.HealthCheck interface.
+func (a *Adapter) CheckHealth() error {
+	return a.health.CheckHealth()
+}
+
+// SyncStats returns statistics about the syncs performed by this Adapter.
+func (a *Adapter) SyncStats() SyncStats {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	return a.stats
+}
+
+// RequestResync asks the Adapter to reconnect to the LDAP server and bring the
+// LDAP database back in sync with the Portunus database. This is used when
+// slapd was restarted, so that its contents are restored right away instead of
+// on the next write (which would only then notice the broken connection).
+func (a *Adapter) RequestResync() {
+	select {
+	case a.resyncChan <- struct{}{}:
+	default:
+		//a resync is already pending
+	}
 }
 
 // Run listens for changes to the Portunus database until `ctx` expires.
-// An error is returned if any write into the LDAP database fails.
+// An error is returned if the connection to the LDAP server is lost and cannot
+// be re-established. Writes that the LDAP server rejects for a specific object
+// do not interrupt the sync; they are retried on every subsequent sync (see
+// FailingEntities).
 func (a *Adapter) Run(ctx context.Context) error {
 	//create main directory structure, but only when Run() is called for the first time
 	//(this precaution is not relevant for regular execution because main() calls
@@ -40,10 +136,14 @@ func (a *Adapter) Run(ctx context.Context) error {
 	//test LDAP activity with fine granularity)
 	isFirstRun := false
 	a.init.Do(func() { isFirstRun = true })
-	if isFirstRun {
-		for _, addReq := range makeStaticObjects(a.conn.DNSuffix()) {
+	//in shadow mode, the static objects are included in the ShadowReport by
+	//resync() instead
+	a.isPlanning = a.IsShadowMode()
+	if isFirstRun && !a.isPlanning {
+		for _, addReq := range makeStaticObjects(a.conn.DNSuffix(), a.OUNames) {
 			err := a.conn.Add(addReq)
 			if err != nil {
+				a.health.Report(err)
 				return err
 			}
 		}
@@ -55,40 +155,458 @@ func (a *Adapter) Run(ctx context.Context) error {
 	defer cancel()
 
 	//writes get sent to us from whatever goroutine the nexus update is running on
+	//
+	//Since each update carries a full snapshot of the database, we only care
+	//about the most recent one. Stale snapshots are discarded, so that nexus
+	//updates do not block while we are waiting for the LDAP server to come back.
+	//(This is safe because the nexus never invokes listeners concurrently.)
+	//Bursts of updates (e.g. during a CSV import) thus result in a single sync
+	//once the previous sync is complete.
 	writeChan := make(chan core.Database, 1)
 	a.nexus.AddListener(ctxListen, func(db core.Database) {
+		a.statsMutex.Lock()
+		defer a.statsMutex.Unlock()
+		select {
+		case <-writeChan:
+			a.stats.CoalescedSnapshots++
+		default:
+		}
 		writeChan <- db
+		a.stats.QueueDepth = len(writeChan)
 	})
 
+	//user accounts can expire without the database changing, so the last known
+	//database is rendered again periodically to remove the passwords of expired
+	//users from the LDAP database on time
+	var lastDB *core.Database
+	expiryTicker := time.NewTicker(expiryCheckInterval)
+	defer expiryTicker.Stop()
+
 	for {
+		var db core.Database
+		isResyncRequested := false
 		select {
 		case <-ctx.Done():
 			return nil
-		case db := <-writeChan:
-			for _, op := range a.computeUpdates(db) {
-				err := op.ExecuteOn(a.conn)
-				if err != nil {
-					return err
+		case db = <-writeChan:
+			a.updateQueueDepth(writeChan)
+		case <-expiryTicker.C:
+			if lastDB == nil {
+				continue
+			}
+			db = *lastDB
+		case <-a.resyncChan:
+			if lastDB == nil {
+				continue //the initial sync has not happened yet, so there is nothing to restore
+			}
+			db = *lastDB
+			isResyncRequested = true
+		}
+
+		//after leaving shadow mode, we do not know what is in the LDAP database
+		//(since we have not written anything), so we need to diff against it
+		wasPlanning := a.isPlanning
+		a.isPlanning = a.IsShadowMode()
+		if wasPlanning && !a.isPlanning {
+			isResyncRequested = true
+		}
+
+		var err error
+		switch {
+		case a.isPlanning:
+			//in shadow mode, each sync is planned against what is actually in the
+			//LDAP database
+			db, err = a.resync(db, writeChan)
+		case isResyncRequested:
+			logg.Info("resynchronizing LDAP database on request")
+		default:
+			db, err = a.sync(db, writeChan)
+		}
+		if err != nil {
+			a.health.Report(err)
+			if !isConnectionError(err) {
+				return err
+			}
+			logg.Error("lost connection to LDAP server: %s", err.Error())
+		}
+		if (isResyncRequested && !a.isPlanning) || err != nil {
+			db, err = a.reconnectAndResync(ctx, db, writeChan)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil //shutdown was requested while reconnecting
 				}
+				a.health.Report(err)
+				return err
 			}
 		}
+		lastDB = &db
+		a.health.Report(nil)
 	}
 }
 
-func (a *Adapter) computeUpdates(db core.Database) []operation {
-	newObjects := renderDBToLDAP(db, a.conn.DNSuffix())
+func (a *Adapter) updateQueueDepth(writeChan <-chan core.Database) {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	a.stats.QueueDepth = len(writeChan)
+}
 
+// Brings the LDAP database in sync with the given snapshot of the Portunus
+// database, starting from the objects that we put there during the last sync.
+// Returns the snapshot that was synced, which may be newer than the one given
+// (see converge).
+func (a *Adapter) sync(db core.Database, writeChan <-chan core.Database) (core.Database, error) {
 	a.objectsMutex.Lock()
-	defer a.objectsMutex.Unlock()
+	actualObjects := a.objects
+	a.objectsMutex.Unlock()
+	return a.converge(actualObjects, db, writeChan)
+}
+
+// Brings the LDAP database from the given actual state into the state
+// described by the given snapshot of the Portunus database.
+//
+// The write operations are executed in chunks. Whenever a newer snapshot
+// arrives on writeChan between chunks, the remaining operations are replanned
+// against it, and the operations for objects that were changed by the newer
+// snapshot are moved to the front of their phase (see operation.phase). This
+// way, a long-running sync (e.g. a full resync after reconnecting) does not
+// hold up live changes. Since each plan contains at most one operation per
+// object and phase, and each chunk is completed before replanning, a write
+// from an older plan can never overwrite a newer state of the same object.
+//
+// Returns the snapshot that was synced, which may be newer than the one given.
+func (a *Adapter) converge(actualObjects []Object, db core.Database, writeChan <-chan core.Database) (core.Database, error) {
+	startedAt := time.Now()
+	dnSuffix := a.conn.DNSuffix()
+	layout := a.UserLayout()
+
+	//keep track of what is in the LDAP database as we go, so that we can replan
+	//from there when preempted
+	actualByDN := make(map[string]Object, len(actualObjects))
+	for _, obj := range actualObjects {
+		actualByDN[obj.DN] = obj
+	}
+	desiredObjects := renderDBToLDAP(db, dnSuffix, a.OUNames, layout, time.Now(), a.HideTemporaryPasswords)
+	desiredByDN := indexObjectsByDN(desiredObjects)
+	ops := computeUpdates(actualObjects, desiredObjects)
+	executedCount := 0
+	failedCount := 0
+	//if an operation fails, further operations for the same object are pointless
+	//(e.g. a modify after a failed move), so they are skipped until the next sync
+	isFailedDN := make(map[string]bool)
+
+	for len(ops) > 0 {
+		a.reportPendingOperations(len(ops), false)
+		var chunk []operation
+		chunk, ops = nextChunk(ops, isFailedDN)
+		if len(chunk) == 0 {
+			continue
+		}
+		failedDNs, err := a.executeOperations(chunk)
+		if err != nil {
+			a.reportPendingOperations(0, false)
+			return db, err
+		}
+		executedCount += len(chunk) - len(failedDNs)
+		failedCount += len(failedDNs)
+		for _, op := range chunk {
+			dn := op.DN()
+			switch {
+			case failedDNs[dn]:
+				//the object stays as it was, so that the next sync retries the operation
+				isFailedDN[dn] = true
+			case op.DeleteRequest != nil:
+				delete(actualByDN, dn)
+			case op.ModifyDNRequest != nil:
+				//the attributes are not changed by the move itself (if they need to
+				//change, a modify operation for the new DN follows)
+				oldDN := op.ModifyDNRequest.DN
+				actualByDN[dn] = Object{DN: dn, Attributes: actualByDN[oldDN].Attributes}
+				delete(actualByDN, oldDN)
+			default:
+				actualByDN[dn] = desiredByDN[dn]
+			}
+		}
+
+		if a.isPlanning {
+			//nothing was actually written, so replanning against a newer snapshot
+			//would yield operations that conflict with the ones recorded so far
+			//(the newer snapshot is picked up by the next sync instead)
+			continue
+		}
+		select {
+		case newDB := <-writeChan:
+			a.updateQueueDepth(writeChan)
+			a.reportPendingOperations(len(ops), true)
+			newDesiredObjects := renderDBToLDAP(newDB, dnSuffix, a.OUNames, layout, time.Now(), a.HideTemporaryPasswords)
+			actualObjects = make([]Object, 0, len(actualByDN))
+			for _, obj := range actualByDN {
+				actualObjects = append(actualObjects, obj)
+			}
+			ops = prioritizeOperations(computeUpdates(actualObjects, newDesiredObjects), desiredByDN, newDesiredObjects)
+			db = newDB
+			desiredObjects = newDesiredObjects
+			desiredByDN = indexObjectsByDN(desiredObjects)
+		default:
+		}
+	}
+
+	if a.isPlanning {
+		a.reportPendingOperations(0, false)
+		a.publishShadowReport(db.Revision)
+		return db, nil
+	}
+
+	syncedObjects := desiredObjects
+	if failedCount > 0 {
+		syncedObjects = make([]Object, 0, len(actualByDN))
+		for _, obj := range actualByDN {
+			syncedObjects = append(syncedObjects, obj)
+		}
+		sort.Slice(syncedObjects, func(i, j int) bool {
+			return syncedObjects[i].DN < syncedObjects[j].DN
+		})
+	}
+	a.objectsMutex.Lock()
+	a.objects = syncedObjects
+	a.objectsMutex.Unlock()
+	isStaticDN := make(map[string]bool)
+	for _, addReq := range makeStaticObjects(dnSuffix, a.OUNames) {
+		isStaticDN[addReq.DN] = true
+	}
+	a.forgetEntitySyncStatus(func(dn string) bool {
+		_, isDesired := desiredByDN[dn]
+		_, isActual := actualByDN[dn]
+		return isDesired || isActual || isStaticDN[dn]
+	})
+
+	duration := time.Since(startedAt)
+	a.statsMutex.Lock()
+	a.stats.LastSyncDuration = duration
+	a.stats.LastSyncOperations = executedCount
+	a.stats.PendingOperations = 0
+	a.statsMutex.Unlock()
+	if executedCount > 0 {
+		logg.Info("synced %d changes into LDAP in %s (database revision %d)", executedCount, duration.Round(time.Millisecond), db.Revision)
+	}
+	if failedCount > 0 {
+		logg.Error("%d changes were rejected by the LDAP server and will be retried on the next sync (database revision %d)", failedCount, db.Revision)
+	}
+	return db, nil
+}
 
-	result := computeUpdates(a.objects, newObjects)
-	a.objects = newObjects
+func (a *Adapter) reportPendingOperations(count int, isPreemption bool) {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	a.stats.PendingOperations = count
+	if isPreemption {
+		a.stats.Preemptions++
+	}
+}
+
+// Takes the next chunk of operations that can be executed at once from the
+// given list: up to syncChunkSize operations from the same phase (see
+// operation.phase). Operations for objects in isFailedDN are dropped.
+func nextChunk(ops []operation, isFailedDN map[string]bool) (chunk, rest []operation) {
+	for idx, op := range ops {
+		if len(chunk) == syncChunkSize || (len(chunk) > 0 && op.phase() != chunk[0].phase()) {
+			return chunk, ops[idx:]
+		}
+		if !isFailedDN[op.DN()] {
+			chunk = append(chunk, op)
+		}
+	}
+	return chunk, nil
+}
+
+func indexObjectsByDN(objects []Object) map[string]Object {
+	result := make(map[string]Object, len(objects))
+	for _, obj := range objects {
+		result[obj.DN] = obj
+	}
+	return result
+}
+
+// Reorders a replanned list of operations such that, within each phase (see
+// operation.phase), operations for objects whose desired state was changed by
+// the newer snapshot come first. The order is otherwise preserved.
+func prioritizeOperations(ops []operation, oldDesiredByDN map[string]Object, newDesiredObjects []Object) []operation {
+	isChanged := make(map[string]bool)
+	for dn := range oldDesiredByDN {
+		isChanged[dn] = true //until proven otherwise below (this covers deleted objects)
+	}
+	for _, obj := range newDesiredObjects {
+		oldObj, exists := oldDesiredByDN[obj.DN]
+		isChanged[obj.DN] = !exists || len(buildModifyRequest(obj.DN, oldObj.Attributes, obj.Attributes)) > 0
+	}
+
+	result := make([]operation, 0, len(ops))
+	for _, op := range ops {
+		if isChanged[op.DN()] {
+			result = append(result, op)
+		}
+	}
+	for _, op := range ops {
+		if !isChanged[op.DN()] {
+			result = append(result, op)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].phase() < result[j].phase()
+	})
 	return result
 }
 
+// Sends the given operations to the LDAP server. Each operation refers to a
+// different object, so they can be executed in any order, and we can have
+// several of them in flight at once (the underlying LDAP connection supports
+// concurrent requests).
+//
+// If an operation fails because the connection was lost, no further operations
+// are sent and the first such error is returned. Any other failure only
+// concerns the object in question: It is recorded in the EntitySyncStatus, and
+// the DNs of all such objects are returned, so that the caller does not
+// consider them to be in sync.
+//
+// In shadow mode, the operations are only recorded for the ShadowReport.
+func (a *Adapter) executeOperations(ops []operation) (failedDNs map[string]bool, err error) {
+	if a.isPlanning {
+		a.recordedOperations = append(a.recordedOperations, ops...)
+		return nil, nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	failedDNs = make(map[string]bool)
+	slots := make(chan struct{}, maxPipelinedOperations)
+	for _, op := range ops {
+		slots <- struct{}{}
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		go func(op operation) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := op.ExecuteOn(a.conn)
+			if err != nil && isConnectionError(err) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if a.recordOperationResult(op, err, time.Now()) {
+				//the error message contains the DN as well, but log pipelines
+				//prefer having it in a separate field
+				logging.Error(logging.Fields{"dn": op.DN()}, "LDAP sync failed: %s", err.Error())
+			}
+			if err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				failedDNs[op.DN()] = true
+			}
+		}(op)
+	}
+	wg.Wait()
+	return failedDNs, firstErr
+}
+
+// Re-establishes the connection to the LDAP server, and then brings the LDAP
+// database in sync with the given snapshot of the Portunus database. Since we
+// do not know which changes made it to the LDAP server before the connection
+// was lost (or whether the LDAP server lost its state entirely because it
+// restarted), we cannot rely on a.objects and need to diff against what is
+// actually there. Returns the snapshot that was synced, which may be newer than
+// the one given.
+func (a *Adapter) reconnectAndResync(ctx context.Context, db core.Database, writeChan <-chan core.Database) (core.Database, error) {
+	for {
+		err := a.conn.Reconnect(ctx)
+		if err != nil {
+			return db, err
+		}
+
+		//if the database changed while we were reconnecting, sync the new state instead
+		select {
+		case db = <-writeChan:
+			a.updateQueueDepth(writeChan)
+		default:
+		}
+
+		db, err = a.resync(db, writeChan)
+		if err == nil {
+			logg.Info("LDAP database has been resynchronized after reconnect (database revision %d)", db.Revision)
+			return db, nil
+		}
+		if !isConnectionError(err) {
+			return db, err
+		}
+		logg.Error("lost connection to LDAP server again during resync: %s", err.Error())
+	}
+}
+
+func (a *Adapter) resync(db core.Database, writeChan <-chan core.Database) (core.Database, error) {
+	a.recordedOperations = nil
+	dnSuffix := a.conn.DNSuffix()
+	result, err := a.conn.Search(goldap.SearchRequest{
+		BaseDN:     dnSuffix,
+		Scope:      goldap.ScopeWholeSubtree,
+		Filter:     "(objectClass=*)",
+		Attributes: []string{"*"},
+	})
+	var entries []*goldap.Entry
+	switch {
+	case err == nil:
+		entries = result.Entries
+	case hasResultCode(err, goldap.LDAPResultNoSuchObject):
+		//the LDAP server came back empty (e.g. because its state was on a tmpfs)
+		entries = nil
+	default:
+		return db, err
+	}
+
+	//restore static objects if necessary (in order, since they depend on each other)
+	existingDNs := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		existingDNs[entry.DN] = true
+	}
+	isStaticDN := make(map[string]bool)
+	for _, addReq := range makeStaticObjects(dnSuffix, a.OUNames) {
+		isStaticDN[addReq.DN] = true
+		if !existingDNs[addReq.DN] {
+			req := addReq
+			_, err := a.executeOperations([]operation{{AddRequest: &req}})
+			if err != nil {
+				return db, err
+			}
+		}
+	}
+
+	//diff the remaining objects against the desired state
+	var actualObjects []Object
+	for _, entry := range entries {
+		if isStaticDN[entry.DN] {
+			continue
+		}
+		obj := Object{DN: entry.DN, Attributes: make(map[string][]string, len(entry.Attributes))}
+		for _, attr := range entry.Attributes {
+			obj.Attributes[attr.Name] = attr.Values
+		}
+		actualObjects = append(actualObjects, obj)
+	}
+	return a.converge(actualObjects, db, writeChan)
+}
+
 // Renders the static objects that we need to establish our basic LDAP
 // directory structure.
-func makeStaticObjects(dnSuffix string) (result []goldap.AddRequest) {
+func makeStaticObjects(dnSuffix string, ous OUNames) (result []goldap.AddRequest) {
 	//shorthand for obtaining a goldap.Attribute object
 	attr := func(typeName string, values ...string) goldap.Attribute {
 		return goldap.Attribute{Type: typeName, Vals: values}
@@ -107,7 +625,7 @@ func makeStaticObjects(dnSuffix string) (result []goldap.AddRequest) {
 	})
 
 	//organizational units
-	for _, ouName := range []string{"users", "groups", "posix-groups"} {
+	for _, ouName := range append([]string{ous.Users, ous.Groups}, fixedOUNames...) {
 		result = append(result, goldap.AddRequest{
 			DN: fmt.Sprintf("ou=%s,%s", ouName, dnSuffix),
 			Attributes: []goldap.Attribute{
@@ -140,31 +658,41 @@ func makeStaticObjects(dnSuffix string) (result []goldap.AddRequest) {
 	return result
 }
 
-// Converts a core.Database instance into a list of LDAP objects.
-func renderDBToLDAP(db core.Database, dnSuffix string) (result []Object) {
+// Converts a core.Database instance into a list of LDAP objects, as of the
+// given time.
+func renderDBToLDAP(db core.Database, dnSuffix string, ous OUNames, layout UserLayout, now time.Time, hideTemporaryPasswords bool) (result []Object) {
+	dns := newDNFactory(db.Users, dnSuffix, ous, layout)
+	result = append(result, dns.renderDepartmentOUs()...)
 	for _, u := range db.Users {
-		result = append(result, renderUser(u, dnSuffix, db.Groups))
+		result = append(result, renderUser(u, dns, db.Groups, now, hideTemporaryPasswords))
 	}
 	for _, g := range db.Groups {
-		result = append(result, renderGroup(g, dnSuffix)...)
+		result = append(result, renderGroup(g, dns)...)
+	}
+	for _, s := range db.ServiceUsers {
+		result = append(result, renderServiceUser(s, dns))
 	}
 
 	//render the virtual group that controls read access to the LDAP server (this
-	//group is hardcoded in the LDAP server's ACL)
+	//group is hardcoded in the LDAP server's ACL); service users are always
+	//members since read access is their entire purpose
 	var ldapViewerDNames []string
+	for _, s := range db.ServiceUsers {
+		ldapViewerDNames = append(ldapViewerDNames, dns.ServiceUserDN(s.Name))
+	}
 	for _, group := range db.Groups {
 		if group.Permissions.LDAP.CanRead {
 			for loginName, isMember := range group.MemberLoginNames {
 				if isMember {
-					dn := fmt.Sprintf("uid=%s,ou=users,%s", loginName, dnSuffix)
-					ldapViewerDNames = append(ldapViewerDNames, dn)
+					ldapViewerDNames = append(ldapViewerDNames, dns.UserDN(loginName))
 				}
 			}
 		}
 	}
+	sort.Strings(ldapViewerDNames)
 	if len(ldapViewerDNames) == 0 {
 		//groups need to have at least one member
-		ldapViewerDNames = append(ldapViewerDNames, "cn=nobody,"+dnSuffix)
+		ldapViewerDNames = append(ldapViewerDNames, dns.NobodyDN())
 	}
 	result = append(result, Object{
 		DN: fmt.Sprintf("cn=portunus-viewers,%s", dnSuffix),
@@ -7,7 +7,12 @@
 package ldap
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +20,7 @@ import (
 	goldap "github.com/go-ldap/ldap/v3"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/errext"
 )
 
@@ -83,6 +89,13 @@ func setupAdapterTest(t *testing.T) (conn *test.LDAPConnectionDouble, updateDBWi
 			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
 		},
 	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "ou=services,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "ou", Vals: []string{"services"}},
+			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
+		},
+	})
 	conn.ExpectAdd(goldap.AddRequest{
 		DN: "cn=portunus,dc=example,dc=org",
 		Attributes: []goldap.Attribute{
@@ -227,20 +240,45 @@ const dummySSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGNvYUluYODNXoQKD
 // The password belonging to this hash is "foo".
 const dummyPasswordHash = "$6$sxI7hpdrkEHuquNj$6zcRp52hrMXSFeF1EOrdETuVYmAmOsYCiG7sCCP54CoX8vHwCEUURWxY5Si0LyvRoC/oZPDaNjUh4DDFBO/Wi/"
 
+// Returns a valid value for core.User.Photo.
+func dummyPhoto(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	photo, err := core.ParseUserPhoto(buf.Bytes(), core.User{}.Ref().Field("photo"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return photo
+}
+
 func TestAllFieldsFilled(t *testing.T) {
 	//This test puts values into all user/group fields, including the optional
 	//ones, to check how those are rendered in the directory.
 	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
 
 	//put one user and one group in the database
+	photo := dummyPhoto(t)
 	action := func(db *core.Database) errext.ErrorSet {
 		db.Users = []core.User{{
-			LoginName:     "alice",
-			GivenName:     "Alice",
-			FamilyName:    "Administrator",
-			EMailAddress:  "alice@example.org",
-			SSHPublicKeys: []string{dummySSHPublicKey},
-			PasswordHash:  dummyPasswordHash,
+			LoginName:         "alice",
+			GivenName:         "Alice",
+			FamilyName:        "Administrator",
+			EMailAddress:      "alice@example.org",
+			Phone:             "+49 30 1234567",
+			MobilePhone:       "+49 170 1234567",
+			Department:        "Engineering",
+			PreferredLanguage: "en-GB",
+			Timezone:          "Europe/Berlin",
+			SSHPublicKeys: []core.SSHKey{
+				{Key: dummySSHPublicKey},
+				//hidden keys do not appear in LDAP
+				{Key: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO9eJnuOMkHmHC+X48YkjiFA4pGPGlfHlcemJcOAojuW alice@laptop", Hidden: true},
+			},
+			PasswordHash: dummyPasswordHash,
+			Photo:        photo,
 			POSIX: &core.UserPosixAttributes{
 				UID:           1234,
 				GID:           123,
@@ -248,11 +286,17 @@ func TestAllFieldsFilled(t *testing.T) {
 				LoginShell:    "/bin/zsh",
 				GECOS:         "Alice Allison",
 			},
+			ExtraAttributes: map[string][]string{
+				"employeeNumber": {"4711"},
+				"l":              {"Berlin", "Hamburg"},
+			},
 		}}
 		gid := core.PosixID(123)
 		db.Groups = []core.Group{{
 			Name:             "admins",
 			LongName:         "Administrators",
+			Description:      "People who can change everything.",
+			URL:              "https://example.org/docs/admins",
 			MemberLoginNames: core.GroupMemberNames{"alice": true},
 			Permissions: core.Permissions{
 				Portunus: core.PortunusPermissions{IsAdmin: true},
@@ -275,12 +319,20 @@ func TestAllFieldsFilled(t *testing.T) {
 			{Type: "givenName", Vals: []string{"Alice"}},
 			{Type: "userPassword", Vals: []string{dummyPasswordHash}},
 			{Type: "mail", Vals: []string{"alice@example.org"}},
+			{Type: "telephoneNumber", Vals: []string{"+49 30 1234567"}},
+			{Type: "mobile", Vals: []string{"+49 170 1234567"}},
+			{Type: "ou", Vals: []string{"Engineering"}},
+			{Type: "preferredLanguage", Vals: []string{"en-GB"}},
+			{Type: "portunusTimezone", Vals: []string{"Europe/Berlin"}},
 			{Type: "sshPublicKey", Vals: []string{dummySSHPublicKey}},
+			{Type: "jpegPhoto", Vals: []string{string(photo)}},
 			{Type: "uidNumber", Vals: []string{"1234"}},
 			{Type: "gidNumber", Vals: []string{"123"}},
 			{Type: "homeDirectory", Vals: []string{"/home/alice"}},
 			{Type: "loginShell", Vals: []string{"/bin/zsh"}},
 			{Type: "gecos", Vals: []string{"Alice Allison"}},
+			{Type: "employeeNumber", Vals: []string{"4711"}},
+			{Type: "l", Vals: []string{"Berlin", "Hamburg"}},
 			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
 			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top", "posixAccount"}},
 		},
@@ -290,7 +342,9 @@ func TestAllFieldsFilled(t *testing.T) {
 		Attributes: []goldap.Attribute{
 			{Type: "cn", Vals: []string{"admins"}},
 			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
-			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+			{Type: "description", Vals: []string{"People who can change everything."}},
+			{Type: "labeledURI", Vals: []string{"https://example.org/docs/admins"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top", "labeledURIObject"}},
 		},
 	})
 	conn.ExpectAdd(goldap.AddRequest{
@@ -543,3 +597,929 @@ func TestLDAPViewerPermission(t *testing.T) {
 	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
 	conn.CheckAllExecuted(t)
 }
+
+func TestHideFromMemberOf(t *testing.T) {
+	//This test checks that Group.HideFromMemberOf removes the group from the
+	//isMemberOf attribute of its members, but not the members from the group.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{{
+			Name:             "everyone",
+			LongName:         "Mailing list for everyone",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+			HideFromMemberOf: true,
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=everyone,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"everyone"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}}, //placeholder because attribute is required
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//clearing the flag only touches the members, not the group itself
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].HideFromMemberOf = false
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "isMemberOf", Vals: []string{"cn=everyone,ou=groups,dc=example,dc=org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestRenameUser(t *testing.T) {
+	//This test checks that a rename through core.Database.RenameUser() also
+	//updates the references to the user's DN in the groups it belongs to.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}}, //placeholder because attribute is required
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//as explained in TestBasicOperations, the user object is replaced, and the
+	//group's member attribute follows it to the new DN
+	action = func(db *core.Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameUser("alice", "alison", "", time.Now(), time.Hour))
+		return
+	}
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alison,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alison"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "member", Vals: []string{"uid=alison,ou=users,dc=example,dc=org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//renaming the group replaces the group object, and the user's isMemberOf
+	//attribute follows it to the new DN
+	action = func(db *core.Database) (errs errext.ErrorSet) {
+		errs.Add(db.RenameGroup("admins", "superusers"))
+		return
+	}
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=superusers,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"superusers"}},
+			{Type: "member", Vals: []string{"uid=alison,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alison,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "isMemberOf", Vals: []string{"cn=superusers,ou=groups,dc=example,dc=org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestAccountExpiry(t *testing.T) {
+	//This test checks that expired users do not have a password in LDAP, even
+	//if they expire while the database does not change.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	validUntil := time.Now().Add(500 * time.Millisecond)
+	expiredAt := time.Now().Add(-time.Hour)
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{
+				LoginName:    "alice",
+				GivenName:    "Alice",
+				FamilyName:   "Contractor",
+				PasswordHash: "x",
+				ValidUntil:   &validUntil,
+			},
+			{
+				LoginName:    "bob",
+				GivenName:    "Bob",
+				FamilyName:   "Contractor",
+				PasswordHash: "y",
+				ValidUntil:   &expiredAt,
+			},
+		}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Contractor"}},
+			{Type: "sn", Vals: []string{"Contractor"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Contractor"}},
+			{Type: "sn", Vals: []string{"Contractor"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}}, //placeholder because attribute is required
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//once alice has expired, the adapter removes her password without any
+	//change to the database being necessary
+	time.Sleep(time.Until(validUntil))
+	action = func(db *core.Database) errext.ErrorSet {
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.DeleteAttribute,
+			Modification: goldap.PartialAttribute{Type: "userPassword"},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestServiceUsers(t *testing.T) {
+	//This test checks that service users are rendered into ou=services and are
+	//always members of the virtual group that grants read access.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.ServiceUsers = []core.ServiceUser{{
+			Name:         "grafana",
+			Description:  "Grafana login",
+			PasswordHash: "x",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=grafana,ou=services,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"grafana"}},
+			{Type: "description", Vals: []string{"Grafana login"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"applicationProcess", "simpleSecurityObject", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=grafana,ou=services,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//rotating the password only touches the service user object
+	action = func(db *core.Database) errext.ErrorSet {
+		db.ServiceUsers[0].PasswordHash = "y"
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "cn=grafana,ou=services,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "userPassword", Vals: []string{"y"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestReconnectAfterConnectionLoss(t *testing.T) {
+	//This test simulates slapd being restarted while Portunus is running. The
+	//adapter shall reconnect and bring the LDAP database back in sync with the
+	//Portunus database, regardless of which state slapd came back with.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	//start with a single user
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}}, //placeholder because attribute is required
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//now the connection is lost, and when we come back, slapd has a somewhat
+	//different state than what we last put there: one of the OUs is missing,
+	//one user is outdated, and another user should not exist at all
+	conn.SimulateConnectionLoss()
+	conn.ExpectSearch(
+		goldap.NewEntry("dc=example,dc=org", map[string][]string{
+			"dc":          {"example"},
+			"o":           {"example"},
+			"objectClass": {"dcObject", "organization", "top"},
+		}),
+		goldap.NewEntry("ou=users,dc=example,dc=org", map[string][]string{
+			"ou":          {"users"},
+			"objectClass": {"organizationalUnit", "top"},
+		}),
+		goldap.NewEntry("ou=groups,dc=example,dc=org", map[string][]string{
+			"ou":          {"groups"},
+			"objectClass": {"organizationalUnit", "top"},
+		}),
+		goldap.NewEntry("ou=services,dc=example,dc=org", map[string][]string{
+			"ou":          {"services"},
+			"objectClass": {"organizationalUnit", "top"},
+		}),
+		goldap.NewEntry("cn=portunus,dc=example,dc=org", map[string][]string{
+			"cn":          {"portunus"},
+			"description": {"Internal service user for Portunus"},
+			"objectClass": {"organizationalRole", "top"},
+		}),
+		goldap.NewEntry("cn=nobody,dc=example,dc=org", map[string][]string{
+			"cn":          {"nobody"},
+			"description": {"Dummy user for empty groups (all groups need to have at least one member)"},
+			"objectClass": {"organizationalRole", "top"},
+		}),
+		goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", map[string][]string{
+			"uid":          {"alice"},
+			"cn":           {"Alicia Administrator"},
+			"sn":           {"Administrator"},
+			"givenName":    {"Alicia"},
+			"userPassword": {"x"},
+			"objectClass":  {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+		}),
+		goldap.NewEntry("uid=carol,ou=users,dc=example,dc=org", map[string][]string{
+			"uid":          {"carol"},
+			"cn":           {"Carol Contractor"},
+			"sn":           {"Contractor"},
+			"givenName":    {"Carol"},
+			"userPassword": {"x"},
+			"objectClass":  {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+		}),
+		goldap.NewEntry("cn=portunus-viewers,dc=example,dc=org", map[string][]string{
+			"cn":          {"portunus-viewers"},
+			"member":      {"cn=nobody,dc=example,dc=org"},
+			"objectClass": {"groupOfNames", "top"},
+		}),
+	)
+
+	//the next write fails because of the lost connection...
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{
+			LoginName:    "bob",
+			GivenName:    "Bob",
+			FamilyName:   "Builder",
+			PasswordHash: "y",
+		})
+		return nil
+	}
+
+	//...so the adapter reconnects and restores the desired state
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "ou=posix-groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "ou", Vals: []string{"posix-groups"}},
+			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
+		},
+	})
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{
+			{
+				Operation:    goldap.ReplaceAttribute,
+				Modification: goldap.PartialAttribute{Type: "cn", Vals: []string{"Alice Administrator"}},
+			},
+			{
+				Operation:    goldap.ReplaceAttribute,
+				Modification: goldap.PartialAttribute{Type: "givenName", Vals: []string{"Alice"}},
+			},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Builder"}},
+			{Type: "sn", Vals: []string{"Builder"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "userPassword", Vals: []string{"y"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "uid=carol,ou=users,dc=example,dc=org",
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+	if conn.ReconnectCount != 1 {
+		t.Errorf("expected 1 reconnect, but got %d", conn.ReconnectCount)
+	}
+}
+
+func TestBulkSync(t *testing.T) {
+	//This test checks that a large number of changes (e.g. from a CSV import) is
+	//synced completely, even though the writes are pipelined.
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	conn := test.NewLDAPConnectionDouble("dc=example,dc=org")
+	adapter := NewAdapter(nexus, conn)
+
+	var db core.Database
+	for idx := 1; idx <= 5*maxPipelinedOperations; idx++ {
+		loginName := fmt.Sprintf("user%03d", idx)
+		db.Users = append(db.Users, core.User{
+			LoginName:    loginName,
+			GivenName:    "Test",
+			FamilyName:   "User",
+			PasswordHash: "x",
+		})
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: fmt.Sprintf("uid=%s,ou=users,dc=example,dc=org", loginName),
+			Attributes: []goldap.Attribute{
+				{Type: "uid", Vals: []string{loginName}},
+				{Type: "cn", Vals: []string{"Test User"}},
+				{Type: "sn", Vals: []string{"User"}},
+				{Type: "givenName", Vals: []string{"Test"}},
+				{Type: "userPassword", Vals: []string{"x"}},
+				{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+			},
+		})
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}}, //placeholder because attribute is required
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+
+	_, err := adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	conn.CheckAllExecuted(t)
+	stats := adapter.SyncStats()
+	if stats.LastSyncOperations != len(db.Users)+1 {
+		t.Errorf("expected %d operations in SyncStats, but got %d", len(db.Users)+1, stats.LastSyncOperations)
+	}
+
+	//when the connection breaks down, the pipelined writes report the
+	//connection error, so that Run() knows to reconnect
+	for idx := range db.Users {
+		db.Users[idx].PasswordHash = "y"
+	}
+	conn.SimulateConnectionLoss()
+	_, err = adapter.sync(db, nil)
+	if !isConnectionError(err) {
+		t.Errorf("expected connection error, but got %v", err)
+	}
+}
+
+func TestResyncPreemptedByLiveChanges(t *testing.T) {
+	//This test simulates a resync of a large directory, during which admins
+	//keep making changes. The resync shall pick up those changes as it goes,
+	//and the LDAP database shall end up exactly in the latest state.
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+
+	var db core.Database
+	for idx := 1; idx <= 300; idx++ {
+		db.Users = append(db.Users, core.User{
+			LoginName:    fmt.Sprintf("user%03d", idx),
+			GivenName:    "Test",
+			FamilyName:   "User",
+			PasswordHash: "x",
+		})
+	}
+
+	//the LDAP server comes back with some of the users being outdated, and
+	//one user that should not exist anymore
+	for _, obj := range renderDBToLDAP(core.Database{Users: db.Users[:100]}, dir.DNSuffix(), DefaultOUNames, FlatUserLayout, time.Now(), false) {
+		obj.Attributes["userPassword"] = []string{"outdated"}
+		dir.Put(obj.DN, obj.Attributes)
+	}
+	dir.Put("uid=obsolete,ou=users,dc=example,dc=org", map[string][]string{
+		"uid":         {"obsolete"},
+		"objectClass": {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+	})
+
+	//while the resync is running, each new snapshot touches objects that the
+	//resync has already written as well as objects that it has not reached yet
+	writeChan := make(chan core.Database, 1)
+	changeCount := 0
+	dir.AfterWrite = func(writeCount int) {
+		if writeCount%50 != 0 || changeCount >= 5 {
+			return
+		}
+		changeCount++
+		newDB := core.Database{Users: append([]core.User(nil), db.Users...)}
+		newDB.Users[changeCount].GivenName = fmt.Sprintf("Changed%d", changeCount)
+		newDB.Users[len(newDB.Users)-changeCount].PasswordHash = fmt.Sprintf("changed%d", changeCount)
+		newDB.Users = append(newDB.Users[:150], newDB.Users[151:]...)
+		newDB.Users = append(newDB.Users, core.User{
+			LoginName:    fmt.Sprintf("new%d", changeCount),
+			GivenName:    "New",
+			FamilyName:   "User",
+			PasswordHash: "y",
+		})
+		db = newDB
+		select {
+		case <-writeChan:
+		default:
+		}
+		writeChan <- newDB
+	}
+
+	syncedDB, err := adapter.resync(db, writeChan)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of live changes", changeCount, 5)
+	assert.DeepEqual(t, "number of users in synced snapshot", len(syncedDB.Users), len(db.Users))
+	stats := adapter.SyncStats()
+	if stats.Preemptions == 0 {
+		t.Error("expected the resync to be preempted, but it was not")
+	}
+	assert.DeepEqual(t, "pending operations after resync", stats.PendingOperations, 0)
+
+	//check final state of the LDAP database
+	expected := make(map[string]map[string][]string)
+	for _, addReq := range makeStaticObjects(dir.DNSuffix(), DefaultOUNames) {
+		attrs := make(map[string][]string)
+		for _, attr := range addReq.Attributes {
+			attrs[attr.Type] = attr.Vals
+		}
+		expected[addReq.DN] = attrs
+	}
+	for _, obj := range renderDBToLDAP(db, dir.DNSuffix(), DefaultOUNames, FlatUserLayout, time.Now(), false) {
+		expected[obj.DN] = obj.Attributes
+	}
+	normalize := func(entries map[string]map[string][]string) map[string]map[string][]string {
+		result := make(map[string]map[string][]string, len(entries))
+		for dn, attrs := range entries {
+			result[dn] = make(map[string][]string, len(attrs))
+			for key, values := range attrs {
+				if len(values) > 0 {
+					values = append([]string(nil), values...)
+					sort.Strings(values)
+					result[dn][key] = values
+				}
+			}
+		}
+		return result
+	}
+	actual := normalize(dir.Entries())
+	for dn, attrs := range normalize(expected) {
+		assert.DeepEqual(t, "attributes of "+dn, actual[dn], attrs)
+		delete(actual, dn)
+	}
+	for dn := range actual {
+		t.Errorf("unexpected LDAP object: %s", dn)
+	}
+}
+
+func TestResyncOnRequest(t *testing.T) {
+	//This test simulates slapd being restarted by portunus-orchestrator and
+	//coming back empty. When asked to, the adapter shall restore the LDAP
+	//database right away, without waiting for the next change.
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", PasswordHash: "x"}}
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		test.ExpectNoError(t, adapter.Run(ctx))
+		close(done)
+	}()
+
+	countEntries := func() int {
+		return len(dir.Entries())
+	}
+	waitForEntries := func(expected int) {
+		t.Helper()
+		for attempt := 0; countEntries() != expected; attempt++ {
+			if attempt > 500 {
+				t.Fatalf("expected %d LDAP objects, but got %d", expected, countEntries())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	//static objects, plus alice and the portunus-viewers group
+	expectedCount := len(makeStaticObjects(dir.DNSuffix(), DefaultOUNames)) + 2
+	waitForEntries(expectedCount)
+
+	dir.Clear()
+	dir.TakeRequests()
+	adapter.RequestResync()
+	waitForEntries(expectedCount)
+
+	//since the LDAP server came back empty, the resync shall only create objects
+	requests := dir.TakeRequests()
+	assert.DeepEqual(t, "number of add requests", len(requests.Add), expectedCount)
+	assert.DeepEqual(t, "number of modify requests", len(requests.Modify), 0)
+	assert.DeepEqual(t, "number of delete requests", len(requests.Delete), 0)
+
+	cancel()
+	<-done
+}
+
+func TestRejectedWritesAreRetried(t *testing.T) {
+	//This test simulates slapd rejecting a single object (e.g. because of a
+	//schema violation). All other objects shall be synced regardless, and the
+	//rejected object shall be reported as failing until a retry succeeds.
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+	db := core.Database{
+		Users: []core.User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", PasswordHash: "x"}},
+		Groups: []core.Group{
+			{Name: "broken", LongName: "Broken", MemberLoginNames: core.GroupMemberNames{"alice": true}},
+			{Name: "working", LongName: "Working", MemberLoginNames: core.GroupMemberNames{"alice": true}},
+		},
+	}
+	brokenDN := "cn=broken,ou=groups,dc=example,dc=org"
+	dir.RejectWrites(brokenDN, goldap.LDAPResultObjectClassViolation)
+
+	_, err := adapter.resync(db, nil)
+	test.ExpectNoError(t, err)
+	entries := dir.Entries()
+	for _, dn := range []string{"uid=alice,ou=users,dc=example,dc=org", "cn=working,ou=groups,dc=example,dc=org"} {
+		if entries[dn] == nil {
+			t.Errorf("expected %s to be synced, but it was not", dn)
+		}
+	}
+	if entries[brokenDN] != nil {
+		t.Errorf("expected %s to not be synced, but it was", brokenDN)
+	}
+	failing := adapter.FailingEntities()
+	if len(failing) != 1 {
+		t.Fatalf("expected 1 failing entity, but got %#v", failing)
+	}
+	assert.DeepEqual(t, "failing entity", []string{failing[0].DN, failing[0].EntityType, failing[0].EntityName, failing[0].LastOperation},
+		[]string{brokenDN, "group", "broken", "add"})
+	assert.DeepEqual(t, "LastError of failing entity", failing[0].LastError,
+		`LDAP Result Code 65 "Object Class Violation": write to cn=broken,ou=groups,dc=example,dc=org rejected`)
+	assert.DeepEqual(t, "LastSuccessAt of failing entity", failing[0].LastSuccessAt.IsZero(), true)
+
+	//the next sync retries the rejected write (and only that one)
+	dir.TakeRequests()
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of failing entities after retry", len(adapter.FailingEntities()), 1)
+	assert.DeepEqual(t, "error counts after retry", adapter.SyncErrorCounts(), map[string]uint64{
+		"user": 0, "group": 2, "posix_group": 0, "service_user": 0, "department": 0, "internal": 0,
+	})
+
+	//once the write succeeds, the object is not reported as failing anymore
+	dir.RejectWrites(brokenDN, 0)
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of failing entities after successful retry", len(adapter.FailingEntities()), 0)
+	requests := dir.TakeRequests()
+	assert.DeepEqual(t, "number of add requests", len(requests.Add), 1)
+	assert.DeepEqual(t, "number of modify requests", len(requests.Modify), 0)
+
+	//a failing object is also not reported anymore once it is deleted from Portunus
+	dir.RejectWrites("cn=new,ou=groups,dc=example,dc=org", goldap.LDAPResultObjectClassViolation)
+	db.Groups = append(db.Groups, core.Group{Name: "new", LongName: "New", MemberLoginNames: core.GroupMemberNames{"alice": true}})
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of failing entities after adding another broken group", len(adapter.FailingEntities()), 1)
+	db.Groups = db.Groups[:2]
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of failing entities after deleting the broken group", len(adapter.FailingEntities()), 0)
+}
+
+func TestDepartmentUserLayout(t *testing.T) {
+	//This test moves users between departments and switches between layouts.
+	//The fake directory rejects objects below missing parents and deletions of
+	//objects with children, so this also checks that the department OUs are
+	//created and deleted in the right order.
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+	adapter.SetUserLayout(DepartmentUserLayout)
+	db := core.Database{
+		Users: []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", Department: "Sales", PasswordHash: "x"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Builder", Department: "Sales", PasswordHash: "x"},
+			{LoginName: "carol", GivenName: "Carol", FamilyName: "Contractor", PasswordHash: "x"},
+		},
+		Groups: []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: core.GroupMemberNames{"alice": true, "bob": true, "carol": true},
+			Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+		}},
+	}
+
+	//all DNs that appear in member and isMemberOf attributes must exist
+	expectConsistentReferences := func(expectedMemberDNs ...string) {
+		t.Helper()
+		entries := dir.Entries()
+		for dn, attrs := range entries {
+			for _, attrType := range []string{"member", "isMemberOf"} {
+				for _, refDN := range attrs[attrType] {
+					if entries[refDN] == nil {
+						t.Errorf("%s refers to missing object %s in its %s attribute", dn, refDN, attrType)
+					}
+				}
+			}
+		}
+		for _, groupDN := range []string{"cn=staff,ou=groups,dc=example,dc=org", "cn=portunus-viewers,dc=example,dc=org"} {
+			memberDNs := entries[groupDN]["member"]
+			sort.Strings(memberDNs)
+			assert.DeepEqual(t, "member DNs of "+groupDN, memberDNs, expectedMemberDNs)
+		}
+	}
+	expectEntries := func(dns ...string) {
+		t.Helper()
+		entries := dir.Entries()
+		for _, dn := range dns {
+			if entries[dn] == nil {
+				t.Errorf("expected LDAP object %s to exist, but it does not", dn)
+			}
+		}
+	}
+	expectNoEntries := func(dns ...string) {
+		t.Helper()
+		entries := dir.Entries()
+		for _, dn := range dns {
+			if entries[dn] != nil {
+				t.Errorf("expected LDAP object %s to not exist, but it does", dn)
+			}
+		}
+	}
+
+	//initial sync: users are placed below their department's OU, or below
+	//ou=unassigned if they do not have a department
+	_, err := adapter.resync(db, nil)
+	test.ExpectNoError(t, err)
+	expectEntries(
+		"ou=Sales,ou=users,dc=example,dc=org",
+		"ou=unassigned,ou=users,dc=example,dc=org",
+		"uid=alice,ou=Sales,ou=users,dc=example,dc=org",
+		"uid=bob,ou=Sales,ou=users,dc=example,dc=org",
+		"uid=carol,ou=unassigned,ou=users,dc=example,dc=org",
+	)
+	expectConsistentReferences(
+		"uid=alice,ou=Sales,ou=users,dc=example,dc=org",
+		"uid=bob,ou=Sales,ou=users,dc=example,dc=org",
+		"uid=carol,ou=unassigned,ou=users,dc=example,dc=org",
+	)
+	assert.DeepEqual(t, "failing entities after initial sync", adapter.FailingEntities(), []EntitySyncStatus(nil))
+	dir.TakeRequests()
+
+	//when a user changes their department, the user entry is moved instead of
+	//being recreated, and the OU of the new department is created first
+	db.Users[1].Department = "Engineering, R&D"
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	engineeringDN := `ou=Engineering\, R&D,ou=users,dc=example,dc=org`
+	expectEntries(engineeringDN, "uid=bob,"+engineeringDN, "ou=Sales,ou=users,dc=example,dc=org")
+	expectNoEntries("uid=bob,ou=Sales,ou=users,dc=example,dc=org")
+	expectConsistentReferences(
+		"uid=alice,ou=Sales,ou=users,dc=example,dc=org",
+		"uid=bob,"+engineeringDN,
+		"uid=carol,ou=unassigned,ou=users,dc=example,dc=org",
+	)
+	requests := dir.TakeRequests()
+	assert.DeepEqual(t, "move requests after department change", requests.ModifyDN, []goldap.ModifyDNRequest{{
+		DN:           "uid=bob,ou=Sales,ou=users,dc=example,dc=org",
+		NewRDN:       "uid=bob",
+		DeleteOldRDN: true,
+		NewSuperior:  engineeringDN,
+	}})
+	assert.DeepEqual(t, "number of delete requests after department change", len(requests.Delete), 0)
+	assert.DeepEqual(t, "ou of moved user", dir.Entries()["uid=bob,"+engineeringDN]["ou"], []string{"Engineering, R&D"})
+
+	//when the last user leaves a department, its OU is deleted after the user
+	//entry has been moved out of it
+	db.Users[0].Department = "Engineering, R&D"
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	expectEntries("uid=alice," + engineeringDN)
+	expectNoEntries("ou=Sales,ou=users,dc=example,dc=org", "uid=alice,ou=Sales,ou=users,dc=example,dc=org")
+	expectConsistentReferences(
+		"uid=alice,"+engineeringDN,
+		"uid=bob,"+engineeringDN,
+		"uid=carol,ou=unassigned,ou=users,dc=example,dc=org",
+	)
+	requests = dir.TakeRequests()
+	assert.DeepEqual(t, "delete requests after emptying a department", requests.Delete, []goldap.DelRequest{{DN: "ou=Sales,ou=users,dc=example,dc=org"}})
+	assert.DeepEqual(t, "failing entities after emptying a department", adapter.FailingEntities(), []EntitySyncStatus(nil))
+
+	//switching back to the flat layout moves all users and deletes all department OUs;
+	//the preview predicts exactly these changes
+	report := adapter.PreviewUserLayout(db, FlatUserLayout)
+	assert.DeepEqual(t, "operation counts in preview", [4]int{report.AddCount, report.MoveCount, report.ModifyCount, report.DeleteCount}, [4]int{0, 3, 2, 2})
+	if !bytes.Contains(report.MarshalLDIF(), []byte("dn: uid=carol,ou=unassigned,ou=users,dc=example,dc=org\nchangetype: modrdn\nnewrdn: uid=carol\ndeleteoldrdn: 1\nnewsuperior: ou=users,dc=example,dc=org\n")) {
+		t.Errorf("expected preview LDIF to contain the move of carol, but got:\n%s", report.MarshalLDIF())
+	}
+	adapter.SetUserLayout(FlatUserLayout)
+	_, err = adapter.sync(db, nil)
+	test.ExpectNoError(t, err)
+	expectNoEntries(engineeringDN, "ou=unassigned,ou=users,dc=example,dc=org")
+	expectConsistentReferences(
+		"uid=alice,ou=users,dc=example,dc=org",
+		"uid=bob,ou=users,dc=example,dc=org",
+		"uid=carol,ou=users,dc=example,dc=org",
+	)
+	requests = dir.TakeRequests()
+	assert.DeepEqual(t, "number of move requests after switching layouts", len(requests.ModifyDN), report.MoveCount)
+	assert.DeepEqual(t, "number of modify requests after switching layouts", len(requests.Modify), report.ModifyCount)
+	assert.DeepEqual(t, "number of delete requests after switching layouts", len(requests.Delete), report.DeleteCount)
+}
+
+func TestCustomOUNames(t *testing.T) {
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+	adapter.OUNames = OUNames{Users: "people", Groups: "role"}
+	adapter.SetUserLayout(DepartmentUserLayout)
+	db := core.Database{
+		Users: []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", Department: "Sales", PasswordHash: "x"},
+		},
+		Groups: []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+		}},
+	}
+
+	_, err := adapter.resync(db, nil)
+	test.ExpectNoError(t, err)
+	entries := dir.Entries()
+	for _, dn := range []string{
+		"ou=people,dc=example,dc=org",
+		"ou=role,dc=example,dc=org",
+		"ou=posix-groups,dc=example,dc=org",
+		"ou=services,dc=example,dc=org",
+		"ou=Sales,ou=people,dc=example,dc=org",
+		"uid=alice,ou=Sales,ou=people,dc=example,dc=org",
+		"cn=staff,ou=role,dc=example,dc=org",
+	} {
+		if entries[dn] == nil {
+			t.Errorf("expected LDAP object %s to exist, but it does not", dn)
+		}
+	}
+	for _, dn := range []string{"ou=users,dc=example,dc=org", "ou=groups,dc=example,dc=org"} {
+		if entries[dn] != nil {
+			t.Errorf("expected LDAP object %s to not exist, but it does", dn)
+		}
+	}
+	assert.DeepEqual(t, "member of group",
+		entries["cn=staff,ou=role,dc=example,dc=org"]["member"],
+		[]string{"uid=alice,ou=Sales,ou=people,dc=example,dc=org"})
+	assert.DeepEqual(t, "isMemberOf of user",
+		entries["uid=alice,ou=Sales,ou=people,dc=example,dc=org"]["isMemberOf"],
+		[]string{"cn=staff,ou=role,dc=example,dc=org"})
+
+	//the sync status classifies objects by the configured OU names
+	for dn, expected := range map[string][2]string{
+		"uid=alice,ou=Sales,ou=people,dc=example,dc=org": {"user", "alice"},
+		"ou=Sales,ou=people,dc=example,dc=org":           {"department", "Sales"},
+		"cn=staff,ou=role,dc=example,dc=org":             {"group", "staff"},
+		"cn=staff,ou=posix-groups,dc=example,dc=org":     {"posix_group", "staff"},
+		"cn=wiki,ou=services,dc=example,dc=org":          {"service_user", "wiki"},
+		"ou=people,dc=example,dc=org":                    {"internal", "people"},
+		"cn=staff,ou=groups,dc=example,dc=org":           {"internal", "staff"},
+	} {
+		entityType, entityName := classifyDN(dn, "dc=example,dc=org", adapter.OUNames)
+		assert.DeepEqual(t, "classification of "+dn, [2]string{entityType, entityName}, expected)
+	}
+}
@@ -0,0 +1,148 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// CertificateExpiryWarningPeriod is how long before its expiry a TLS
+// certificate is reported as expiring soon.
+const CertificateExpiryWarningPeriod = 21 * 24 * time.Hour
+
+// CheckServerCertificate checks whether the given certificate can be used by
+// slapd when clients connect to it through the given domain name (i.e.
+// PORTUNUS_SLAPD_TLS_DOMAIN_NAME). An error is returned if the certificate does
+// not cover the domain name, or if it is not valid at the given time. If the
+// certificate is usable, but expires soon, a warning is returned instead.
+func CheckServerCertificate(cert *x509.Certificate, domainName string, now time.Time) (warning string, err error) {
+	err = cert.VerifyHostname(domainName)
+	if err != nil {
+		sans := SubjectAlternativeNames(cert)
+		if len(sans) == 0 {
+			return "", fmt.Errorf("certificate does not contain any subject alternative names, so it is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME %q (subject common name %q is ignored by TLS clients)",
+				domainName, cert.Subject.CommonName)
+		}
+		return "", fmt.Errorf("certificate is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME %q, only for %s",
+			domainName, strings.Join(sans, ", "))
+	}
+
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("certificate is not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if !now.Before(cert.NotAfter) {
+		return "", fmt.Errorf("certificate has expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if cert.NotAfter.Sub(now) < CertificateExpiryWarningPeriod {
+		days := int(math.Ceil(cert.NotAfter.Sub(now).Hours() / 24))
+		return fmt.Sprintf("certificate expires in %d day(s), at %s", days, cert.NotAfter.UTC().Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+// SubjectAlternativeNames lists the DNS names and IP addresses that the given
+// certificate is valid for, in the format used by `openssl x509 -text`.
+func SubjectAlternativeNames(cert *x509.Certificate) []string {
+	var result []string
+	for _, name := range cert.DNSNames {
+		result = append(result, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		result = append(result, "IP:"+ip.String())
+	}
+	return result
+}
+
+// If the given error from a TLS handshake concerns the server certificate,
+// explains how the certificate relates to the domain name that we connected
+// to. The x509 errors by themselves are too opaque to fix the problem.
+func explainCertificateError(err error, domainName string) error {
+	var (
+		cert       *x509.Certificate
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &hostErr):
+		cert = hostErr.Certificate
+	case errors.As(err, &invalidErr):
+		cert = invalidErr.Cert
+	}
+	if cert == nil {
+		return err
+	}
+	_, checkErr := CheckServerCertificate(cert, domainName, time.Now())
+	if checkErr == nil {
+		return err
+	}
+	return fmt.Errorf("%w (the %s)", err, checkErr.Error())
+}
+
+// CertificateInfo describes the TLS certificate that the LDAP server presented.
+type CertificateInfo struct {
+	DomainName              string
+	SubjectAlternativeNames []string
+	NotAfter                time.Time
+	//Contains the warning from CheckServerCertificate(), if any.
+	Warning string
+}
+
+// CertificateStatus records the TLS certificate that the LDAP server presented
+// on the most recent connection. It can be given in type ConnectionOptions,
+// and then be read from other goroutines. A nil CertificateStatus is valid and
+// does not record anything.
+type CertificateStatus struct {
+	mutex sync.Mutex
+	info  *CertificateInfo
+}
+
+// Record is called by the Connection after each successful TLS handshake.
+func (s *CertificateStatus) Record(cert *x509.Certificate, domainName string, now time.Time) {
+	if s == nil {
+		return
+	}
+	info := CertificateInfo{
+		DomainName:              domainName,
+		SubjectAlternativeNames: SubjectAlternativeNames(cert),
+		NotAfter:                cert.NotAfter,
+	}
+	warning, err := CheckServerCertificate(cert, domainName, now)
+	if err == nil {
+		info.Warning = warning
+	} else {
+		info.Warning = err.Error()
+	}
+	if info.Warning != "" {
+		logg.Other("WARNING", "TLS certificate of LDAP server: %s", info.Warning)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.info = &info
+}
+
+// Get returns the information recorded by the most recent call to Record(), or
+// false if there was no TLS handshake yet.
+func (s *CertificateStatus) Get() (CertificateInfo, bool) {
+	if s == nil {
+		return CertificateInfo{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.info == nil {
+		return CertificateInfo{}, false
+	}
+	return *s.info, true
+}
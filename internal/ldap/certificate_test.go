@@ -0,0 +1,92 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestCheckServerCertificate(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	validSince := now.Add(-24 * time.Hour)
+	validUntil := now.Add(90 * 24 * time.Hour)
+
+	testCases := []struct {
+		DNSNames        []string
+		NotBefore       time.Time
+		NotAfter        time.Time
+		DomainName      string
+		ExpectedWarning string
+		ExpectedError   string
+	}{
+		//matching
+		{[]string{"ldap.example.org"}, validSince, validUntil, "ldap.example.org", "", ""},
+		{[]string{"www.example.org", "ldap.example.org"}, validSince, validUntil, "ldap.example.org", "", ""},
+		//non-matching
+		{[]string{"www.example.org", "example.org"}, validSince, validUntil, "ldap.example.org", "",
+			`certificate is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME "ldap.example.org", only for DNS:www.example.org, DNS:example.org`},
+		{nil, validSince, validUntil, "ldap.example.org", "",
+			`certificate does not contain any subject alternative names, so it is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME "ldap.example.org" (subject common name "portunus-test" is ignored by TLS clients)`},
+		//wildcard (only covers one level of subdomains)
+		{[]string{"*.example.org"}, validSince, validUntil, "ldap.example.org", "", ""},
+		{[]string{"*.example.org"}, validSince, validUntil, "ldap.internal.example.org", "",
+			`certificate is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME "ldap.internal.example.org", only for DNS:*.example.org`},
+		//expired or not yet valid
+		{[]string{"ldap.example.org"}, now.Add(-90 * 24 * time.Hour), now.Add(-time.Hour), "ldap.example.org", "",
+			`certificate has expired at 2024-05-06T06:08:09Z`},
+		{[]string{"ldap.example.org"}, now.Add(time.Hour), validUntil, "ldap.example.org", "",
+			`certificate is not valid before 2024-05-06T08:08:09Z`},
+		//expiring soon
+		{[]string{"ldap.example.org"}, validSince, now.Add(3*24*time.Hour - time.Hour), "ldap.example.org",
+			`certificate expires in 3 day(s), at 2024-05-09T06:08:09Z`, ""},
+	}
+
+	for idx, tc := range testCases {
+		cert := test.GenerateCertificate(t, tc.DNSNames, tc.NotBefore, tc.NotAfter)
+		warning, err := CheckServerCertificate(cert.Parsed, tc.DomainName, now)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		assert.DeepEqual(t, fmt.Sprintf("warning in test case #%d", idx), warning, tc.ExpectedWarning)
+		assert.DeepEqual(t, fmt.Sprintf("error in test case #%d", idx), errMsg, tc.ExpectedError)
+	}
+}
+
+func TestExplainCertificateError(t *testing.T) {
+	now := time.Now()
+	cert := test.GenerateCertificate(t, []string{"ldap.example.com"}, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	//this is how a failed TLS handshake in goldap.DialTLS() looks like
+	var err error = goldap.NewError(goldap.ErrorNetwork, x509.HostnameError{Certificate: cert.Parsed, Host: "ldap.example.org"})
+	err = explainCertificateError(err, "ldap.example.org")
+	assert.DeepEqual(t, "explained error", err.Error(),
+		`LDAP Result Code 200 "Network Error": x509: certificate is valid for ldap.example.com, not ldap.example.org`+
+			` (the certificate is not valid for PORTUNUS_SLAPD_TLS_DOMAIN_NAME "ldap.example.org", only for DNS:ldap.example.com)`)
+	//the error must still be recognized as a connection error, so that reconnects are attempted
+	assert.DeepEqual(t, "isConnectionError", isConnectionError(err), true)
+
+	//the status that is shown to admins records the certificate once connected
+	var status CertificateStatus
+	_, ok := status.Get()
+	assert.DeepEqual(t, "certificate known before connecting", ok, false)
+	status.Record(cert.Parsed, "ldap.example.com", now)
+	info, ok := status.Get()
+	assert.DeepEqual(t, "certificate known after connecting", ok, true)
+	assert.DeepEqual(t, "certificate info", info, CertificateInfo{
+		DomainName:              "ldap.example.com",
+		SubjectAlternativeNames: []string{"DNS:ldap.example.com"},
+		NotAfter:                cert.Parsed.NotAfter,
+	})
+}
@@ -6,14 +6,20 @@
 
 package ldap
 
-import goldap "github.com/go-ldap/ldap/v3"
+import (
+	"sort"
+	"strings"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
 
 // A sum type of all possible requests that we can send to the server.
 type operation struct {
 	//Exactly one of these must be non-nil.
-	AddRequest    *goldap.AddRequest
-	ModifyRequest *goldap.ModifyRequest
-	DeleteRequest *goldap.DelRequest
+	AddRequest      *goldap.AddRequest
+	ModifyRequest   *goldap.ModifyRequest
+	ModifyDNRequest *goldap.ModifyDNRequest //only used for moving objects to a different parent
+	DeleteRequest   *goldap.DelRequest
 }
 
 // ExecuteOn dispatches into the respective method call on the `conn` interface.
@@ -23,6 +29,8 @@ func (op operation) ExecuteOn(conn Connection) error {
 		return conn.Add(*op.AddRequest)
 	case op.ModifyRequest != nil:
 		return conn.Modify(*op.ModifyRequest)
+	case op.ModifyDNRequest != nil:
+		return conn.ModifyDN(*op.ModifyDNRequest)
 	case op.DeleteRequest != nil:
 		return conn.Delete(*op.DeleteRequest)
 	default:
@@ -30,32 +38,132 @@ func (op operation) ExecuteOn(conn Connection) error {
 	}
 }
 
+// DN returns the DN of the object that this operation refers to. For moves,
+// this is the DN that the object has after the move.
+func (op operation) DN() string {
+	switch {
+	case op.AddRequest != nil:
+		return op.AddRequest.DN
+	case op.ModifyRequest != nil:
+		return op.ModifyRequest.DN
+	case op.ModifyDNRequest != nil:
+		return op.ModifyDNRequest.NewRDN + "," + op.ModifyDNRequest.NewSuperior
+	case op.DeleteRequest != nil:
+		return op.DeleteRequest.DN
+	default:
+		panic("operation had no non-nil member field!")
+	}
+}
+
+// Kind returns "add", "modify", "move" or "delete", depending on the type of
+// request.
+func (op operation) Kind() string {
+	switch {
+	case op.AddRequest != nil:
+		return "add"
+	case op.ModifyRequest != nil:
+		return "modify"
+	case op.ModifyDNRequest != nil:
+		return "move"
+	case op.DeleteRequest != nil:
+		return "delete"
+	default:
+		panic("operation had no non-nil member field!")
+	}
+}
+
+// Returns in which phase of a sync this operation needs to be executed. All
+// operations of one phase must be completed before the next phase starts,
+// since the LDAP server only accepts objects below existing parent objects,
+// and only deletes objects without children. Within a phase, operations can
+// be executed in any order.
+//
+// The only parent objects that come and go are the department OUs (see
+// DepartmentUserLayout), so they are created before all other operations, and
+// deleted after all other operations. Moves come before all other operations
+// on the moved objects (see computeUpdates).
+func (op operation) phase() int {
+	isOU := strings.HasPrefix(op.DN(), "ou=")
+	switch {
+	case op.AddRequest != nil && isOU:
+		return 0
+	case op.ModifyDNRequest != nil:
+		return 1
+	case op.DeleteRequest != nil && isOU:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Splits a DN into its first RDN and the DN of its parent object.
+func splitDN(dn string) (rdn, parentDN string) {
+	for idx := 0; idx < len(dn); idx++ {
+		switch dn[idx] {
+		case '\\':
+			idx++ //skip escaped character
+		case ',':
+			return dn[:idx], dn[idx+1:]
+		}
+	}
+	return dn, ""
+}
+
 // Computes a minimal changeset (i.e. a set of LDAP write operations) by
-// diffing two sets of LDAP objects.
+// diffing two sets of LDAP objects. The operations are sorted by phase (see
+// operation.phase).
+//
+// User entries that change their parent object (e.g. when the department of
+// a user changes in DepartmentUserLayout) are moved instead of being deleted
+// and created again, so that the LDAP server keeps their entryUUID and
+// operational attributes. Such a move can be followed by a modify operation on
+// the new DN.
 func computeUpdates(oldObjects, newObjects []Object) (result []operation) {
 	oldObjectsByDN := make(map[string]Object, len(oldObjects))
 	for _, oldObj := range oldObjects {
 		oldObjectsByDN[oldObj.DN] = oldObj
 	}
-
-	isExistingDN := make(map[string]bool)
+	isExistingDN := make(map[string]bool, len(newObjects))
 	for _, newObj := range newObjects {
 		isExistingDN[newObj.DN] = true
+	}
+	movableObjectsByRDN := make(map[string]Object)
+	for _, oldObj := range oldObjects {
+		rdn, _ := splitDN(oldObj.DN)
+		if !isExistingDN[oldObj.DN] && strings.HasPrefix(rdn, "uid=") {
+			movableObjectsByRDN[rdn] = oldObj
+		}
+	}
+
+	isMovedDN := make(map[string]bool)
+	for _, newObj := range newObjects {
 		oldObj, exists := oldObjectsByDN[newObj.DN]
 		if exists {
 			result = append(result, buildModifyRequest(newObj.DN, oldObj.Attributes, newObj.Attributes)...)
-		} else {
-			result = append(result, buildAddRequest(newObj))
+			continue
+		}
+		rdn, parentDN := splitDN(newObj.DN)
+		oldObj, exists = movableObjectsByRDN[rdn]
+		if exists && !isMovedDN[oldObj.DN] {
+			isMovedDN[oldObj.DN] = true
+			req := goldap.ModifyDNRequest{DN: oldObj.DN, NewRDN: rdn, DeleteOldRDN: true, NewSuperior: parentDN}
+			result = append(result, operation{ModifyDNRequest: &req})
+			result = append(result, buildModifyRequest(newObj.DN, oldObj.Attributes, newObj.Attributes)...)
+			continue
 		}
+		result = append(result, buildAddRequest(newObj))
 	}
 
 	for _, oldObj := range oldObjects {
-		if !isExistingDN[oldObj.DN] {
+		if !isExistingDN[oldObj.DN] && !isMovedDN[oldObj.DN] {
 			req := goldap.DelRequest{DN: oldObj.DN}
 			result = append(result, operation{DeleteRequest: &req})
 		}
 	}
 
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].phase() < result[j].phase()
+	})
 	return result
 }
 
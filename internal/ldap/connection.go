@@ -7,6 +7,7 @@
 package ldap
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -22,7 +23,24 @@ type Connection interface {
 	DNSuffix() string
 	Add(goldap.AddRequest) error
 	Modify(goldap.ModifyRequest) error
+	ModifyDN(goldap.ModifyDNRequest) error
 	Delete(goldap.DelRequest) error
+	Search(goldap.SearchRequest) (*goldap.SearchResult, error)
+	// Reconnect replaces a broken connection with a new one. It blocks until
+	// the new connection has been established or until `ctx` expires.
+	Reconnect(ctx context.Context) error
+}
+
+// Returns whether the given error indicates that the connection to the LDAP
+// server was lost (as opposed to the LDAP server rejecting a request).
+func isConnectionError(err error) bool {
+	return hasResultCode(err, goldap.ErrorNetwork)
+}
+
+// Like goldap.IsErrorWithCode, but also understands wrapped errors.
+func hasResultCode(err error, code uint16) bool {
+	var ldapErr *goldap.Error
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == code
 }
 
 // ConnectionOptions contains all configuration values that we need to connect
@@ -31,6 +49,9 @@ type ConnectionOptions struct {
 	DNSuffix      string //e.g. "dc=example,dc=org"
 	Password      string //for Portunus' service user
 	TLSDomainName string //if empty, LDAP without TLS is used
+	//If not nil, the server certificate is recorded in here after each TLS
+	//handshake.
+	CertificateStatus *CertificateStatus
 }
 
 type connectionImpl struct {
@@ -63,21 +84,60 @@ func (c *connectionImpl) getConn(retryCounter int, sleepInterval time.Duration)
 	}
 	time.Sleep(sleepInterval)
 
+	err = c.dial()
+	if err != nil {
+		logg.Info("cannot connect to LDAP server (attempt %d/10): %s", retryCounter+1, err.Error())
+		return c.getConn(retryCounter+1, sleepInterval*2)
+	}
+
+	logg.Info("connected to LDAP server")
+	return nil
+}
+
+func (c *connectionImpl) dial() (err error) {
 	if c.opts.TLSDomainName != "" {
 		c.conn, err = goldap.DialTLS("tcp", c.opts.TLSDomainName+":ldaps", nil)
+		if err != nil {
+			return explainCertificateError(err, c.opts.TLSDomainName)
+		}
+		state, ok := c.conn.TLSConnectionState()
+		if ok && len(state.PeerCertificates) > 0 {
+			c.opts.CertificateStatus.Record(state.PeerCertificates[0], c.opts.TLSDomainName, time.Now())
+		}
 	} else {
 		c.conn, err = goldap.Dial("tcp", ":ldap")
 	}
 	if err == nil {
 		err = c.conn.Bind(c.userDN, c.opts.Password)
 	}
-	if err != nil {
-		logg.Info("cannot connect to LDAP server (attempt %d/10): %s", retryCounter+1, err.Error())
-		return c.getConn(retryCounter+1, sleepInterval*2)
+	return err
+}
+
+// Reconnect implements the Connection interface.
+func (c *connectionImpl) Reconnect(ctx context.Context) error {
+	if c.conn != nil {
+		c.conn.Close()
 	}
 
-	logg.Info("connected to LDAP server")
-	return nil
+	//unlike during startup, we don't know how long slapd will take to come
+	//back, so we keep retrying forever, but back off to at most one attempt
+	//every 30 seconds
+	sleepInterval := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := c.dial()
+		if err == nil {
+			logg.Info("reconnected to LDAP server")
+			return nil
+		}
+		logg.Info("cannot reconnect to LDAP server (attempt %d): %s", attempt, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepInterval):
+		}
+		sleepInterval = min(sleepInterval*2, 30*time.Second)
+	}
 }
 
 // DNSuffix implements the Connection interface.
@@ -89,7 +149,7 @@ func (c *connectionImpl) DNSuffix() string {
 func (c *connectionImpl) Add(req goldap.AddRequest) error {
 	err := c.conn.Add(&req)
 	if err == nil {
-		logg.Info("LDAP object %s created", req.DN)
+		logg.Debug("LDAP object %s created", req.DN)
 	} else {
 		return fmt.Errorf("cannot create LDAP object %s: %w", req.DN, err)
 	}
@@ -100,18 +160,42 @@ func (c *connectionImpl) Add(req goldap.AddRequest) error {
 func (c *connectionImpl) Modify(req goldap.ModifyRequest) error {
 	err := c.conn.Modify(&req)
 	if err == nil {
-		logg.Info("LDAP object %s updated", req.DN)
+		logg.Debug("LDAP object %s updated", req.DN)
 	} else {
 		return fmt.Errorf("cannot update LDAP object %s: %w", req.DN, err)
 	}
 	return nil
 }
 
+// ModifyDN implements the Connection interface.
+func (c *connectionImpl) ModifyDN(req goldap.ModifyDNRequest) error {
+	err := c.conn.ModifyDN(&req)
+	if err == nil {
+		logg.Debug("LDAP object %s moved below %s", req.DN, req.NewSuperior)
+	} else {
+		return fmt.Errorf("cannot move LDAP object %s below %s: %w", req.DN, req.NewSuperior, err)
+	}
+	return nil
+}
+
+// The page size for searches. This matches slapd's default size limit, so
+// that searches keep working even if the size limit was not lifted for us.
+const searchPageSize = 500
+
+// Search implements the Connection interface.
+func (c *connectionImpl) Search(req goldap.SearchRequest) (*goldap.SearchResult, error) {
+	result, err := c.conn.SearchWithPaging(&req, searchPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot search LDAP objects below %s: %w", req.BaseDN, err)
+	}
+	return result, nil
+}
+
 // Delete implements the Connection interface.
 func (c *connectionImpl) Delete(req goldap.DelRequest) error {
 	err := c.conn.Del(&req)
 	if err == nil {
-		logg.Info("LDAP object %s deleted", req.DN)
+		logg.Debug("LDAP object %s deleted", req.DN)
 	} else {
 		return fmt.Errorf("cannot delete LDAP object %s: %w", req.DN, err)
 	}
@@ -0,0 +1,43 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"sort"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// ExportLDIF renders a LDIF document (RFC 2849) with all entries that the
+// Adapter would write into the LDAP server for the given database at the given
+// time: the basic directory structure (the suffix entry, the OUs and the
+// internal entries for Portunus itself) as well as all users, groups and
+// service users. This is intended for migrating to or from other directory
+// servers.
+//
+// Entries are ordered such that each entry comes after its parent, and groups
+// come after their members, so the result can be loaded with ldapadd(1) or
+// slapadd(8). Attributes are sorted by name. Unless includePasswords is set,
+// userPassword attributes are left out. The other arguments are as for
+// SimulateSearch().
+func ExportLDIF(db core.Database, dnSuffix string, ous OUNames, layout UserLayout, now time.Time, hideTemporaryPasswords, includePasswords bool) []byte {
+	objects := renderAllObjects(db, dnSuffix, ous, layout, now, hideTemporaryPasswords)
+	reqs := make([]goldap.AddRequest, 0, len(objects))
+	for _, obj := range objects {
+		if !includePasswords {
+			delete(obj.Attributes, "userPassword")
+		}
+		req := *buildAddRequest(obj).AddRequest
+		sort.Slice(req.Attributes, func(i, j int) bool {
+			return req.Attributes[i].Type < req.Attributes[j].Type
+		})
+		reqs = append(reqs, req)
+	}
+	return MarshalLDIFEntries(reqs)
+}
@@ -0,0 +1,76 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	_ "embed"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+//go:embed fixtures/export.ldif
+var expectedExportLDIF string
+
+func TestExportLDIF(t *testing.T) {
+	gid := core.PosixID(1000)
+	db := core.Database{
+		Users: []core.User{
+			{
+				LoginName:    "jane",
+				GivenName:    "Jane",
+				FamilyName:   "Doe",
+				EMailAddress: "jane@example.org",
+				Department:   "Engineering",
+				PasswordHash: "{SSHA}dummy",
+			},
+			{
+				LoginName:    "juergen",
+				GivenName:    "Jürgen",
+				FamilyName:   "Müller",
+				PasswordHash: "{SSHA}other",
+			},
+		},
+		Groups: []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"jane": true, "juergen": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+				PosixGID:         &gid,
+			},
+			{
+				Name:             "empty",
+				LongName:         "Empty group",
+				MemberLoginNames: core.GroupMemberNames{},
+			},
+		},
+		ServiceUsers: []core.ServiceUser{
+			{Name: "nextcloud", Description: "Nextcloud", PasswordHash: "{SSHA}service"},
+		},
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	//the golden file is rendered with the department layout to cover entries below the top-level OUs
+	actual := string(ExportLDIF(db, "dc=example,dc=org", DefaultOUNames, DepartmentUserLayout, now, false, false))
+	assert.DeepEqual(t, "LDIF", actual, expectedExportLDIF)
+
+	//passwords are only included on request
+	actual = string(ExportLDIF(db, "dc=example,dc=org", DefaultOUNames, DepartmentUserLayout, now, false, true))
+	for _, line := range []string{"userPassword: {SSHA}dummy", "userPassword: {SSHA}other", "userPassword: {SSHA}service"} {
+		assert.DeepEqual(t, "LDIF contains "+line, strings.Contains(actual, "\n"+line+"\n"), true)
+	}
+	withoutPasswords := strings.NewReplacer(
+		"userPassword: {SSHA}dummy\n", "",
+		"userPassword: {SSHA}other\n", "",
+		"userPassword: {SSHA}service\n", "",
+	).Replace(actual)
+	assert.DeepEqual(t, "LDIF without passwords", withoutPasswords, expectedExportLDIF)
+}
@@ -0,0 +1,269 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Filter is a parsed LDAP search filter (RFC 4515) that can be evaluated
+// against rendered objects without asking an LDAP server. Only the filter
+// types that are useful for the objects that Portunus renders are supported:
+// equality, presence and substring matches, and their combination with and,
+// or and not.
+//
+// All values are matched case-insensitively. This is correct for almost all
+// attributes rendered by Portunus (which use caseIgnoreMatch,
+// distinguishedNameMatch or integerMatch), except for userPassword and
+// jpegPhoto, which nobody should be searching for anyway.
+type Filter struct {
+	op       filterOp
+	attr     string   //for all ops except and, or and not
+	value    string   //for equality
+	initial  string   //for substrings
+	any      []string //for substrings
+	final    string   //for substrings
+	children []Filter //for and, or and not
+}
+
+type filterOp int
+
+const (
+	filterAnd filterOp = iota
+	filterOr
+	filterNot
+	filterEquality
+	filterPresent
+	filterSubstrings
+)
+
+// ParseFilter parses a search filter in the string representation from RFC
+// 4515, e.g. "(&(objectClass=person)(uid=j*))". For convenience, the outermost
+// pair of parentheses may be omitted, like with ldapsearch.
+func ParseFilter(input string) (Filter, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return Filter{}, errors.New("filter is empty")
+	}
+	if !strings.HasPrefix(input, "(") {
+		input = "(" + input + ")"
+	}
+	f, rest, err := parseFilter(input)
+	if err == nil && rest != "" {
+		err = fmt.Errorf("unexpected %q after end of filter", rest)
+	}
+	if err != nil {
+		return Filter{}, fmt.Errorf("cannot parse filter: %w", err)
+	}
+	return f, nil
+}
+
+// Parses one parenthesized filter from the start of the input, and returns
+// the remaining input.
+func parseFilter(input string) (Filter, string, error) {
+	if !strings.HasPrefix(input, "(") {
+		return Filter{}, "", fmt.Errorf("expected \"(\" at %q", input)
+	}
+	input = input[1:]
+	if input == "" {
+		return Filter{}, "", errors.New("unexpected end of filter")
+	}
+
+	var f Filter
+	switch input[0] {
+	case '&', '|':
+		f.op = filterAnd
+		if input[0] == '|' {
+			f.op = filterOr
+		}
+		input = input[1:]
+		for strings.HasPrefix(input, "(") {
+			child, rest, err := parseFilter(input)
+			if err != nil {
+				return Filter{}, "", err
+			}
+			f.children = append(f.children, child)
+			input = rest
+		}
+	case '!':
+		child, rest, err := parseFilter(input[1:])
+		if err != nil {
+			return Filter{}, "", err
+		}
+		f = Filter{op: filterNot, children: []Filter{child}}
+		input = rest
+	default:
+		end := strings.IndexByte(input, ')')
+		if end == -1 {
+			return Filter{}, "", errors.New("unexpected end of filter")
+		}
+		var err error
+		f, err = parseItem(input[:end])
+		if err != nil {
+			return Filter{}, "", err
+		}
+		input = input[end:]
+	}
+
+	if !strings.HasPrefix(input, ")") {
+		return Filter{}, "", fmt.Errorf("expected \")\" at %q", input)
+	}
+	return f, input[1:], nil
+}
+
+// Parses a filter item without the surrounding parentheses, e.g. "uid=j*".
+func parseItem(item string) (Filter, error) {
+	attr, value, ok := strings.Cut(item, "=")
+	if !ok {
+		return Filter{}, fmt.Errorf("missing \"=\" in %q", item)
+	}
+	if attr == "" {
+		return Filter{}, fmt.Errorf("missing attribute name in %q", item)
+	}
+	if strings.ContainsAny(attr[len(attr)-1:], "<>~:") {
+		return Filter{}, fmt.Errorf("unsupported filter type in %q (only equality, presence and substring matches are supported)", item)
+	}
+	for _, r := range attr {
+		isAllowed := r == '-' || r == ';' || r == '.' || (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')
+		if !isAllowed {
+			return Filter{}, fmt.Errorf("invalid attribute name %q", attr)
+		}
+	}
+
+	if value == "*" {
+		return Filter{op: filterPresent, attr: attr}, nil
+	}
+
+	//unescaped asterisks separate the parts of a substring match
+	parts := strings.Split(value, "*")
+	for idx, part := range parts {
+		var err error
+		parts[idx], err = unescapeFilterValue(part)
+		if err != nil {
+			return Filter{}, err
+		}
+	}
+	if len(parts) == 1 {
+		return Filter{op: filterEquality, attr: attr, value: parts[0]}, nil
+	}
+	f := Filter{
+		op:      filterSubstrings,
+		attr:    attr,
+		initial: parts[0],
+		final:   parts[len(parts)-1],
+	}
+	for _, part := range parts[1 : len(parts)-1] {
+		if part == "" {
+			return Filter{}, fmt.Errorf("invalid substring match %q (consecutive asterisks)", value)
+		}
+		f.any = append(f.any, part)
+	}
+	return f, nil
+}
+
+// Resolves escape sequences like "\2a" in a filter value.
+func unescapeFilterValue(value string) (string, error) {
+	if !strings.Contains(value, `\`) {
+		if strings.ContainsAny(value, "()") {
+			return "", fmt.Errorf("unescaped parenthesis in %q", value)
+		}
+		return value, nil
+	}
+	var sb strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		switch value[idx] {
+		case '(', ')':
+			return "", fmt.Errorf("unescaped parenthesis in %q", value)
+		case '\\':
+			if idx+2 >= len(value) {
+				return "", fmt.Errorf("incomplete escape sequence in %q", value)
+			}
+			decoded, err := hex.DecodeString(value[idx+1 : idx+3])
+			if err != nil {
+				return "", fmt.Errorf("invalid escape sequence in %q", value)
+			}
+			sb.Write(decoded)
+			idx += 2
+		default:
+			sb.WriteByte(value[idx])
+		}
+	}
+	return sb.String(), nil
+}
+
+// Matches returns whether the given object matches this filter.
+func (f Filter) Matches(obj Object) bool {
+	switch f.op {
+	case filterAnd:
+		for _, child := range f.children {
+			if !child.Matches(obj) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range f.children {
+			if child.Matches(obj) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !f.children[0].Matches(obj)
+	}
+
+	values := obj.attributeValues(f.attr)
+	if f.op == filterPresent {
+		return len(values) > 0
+	}
+	for _, value := range values {
+		if f.matchesValue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matchesValue(value string) bool {
+	if f.op == filterEquality {
+		return strings.EqualFold(value, f.value)
+	}
+
+	value = strings.ToLower(value)
+	initial := strings.ToLower(f.initial)
+	final := strings.ToLower(f.final)
+	if !strings.HasPrefix(value, initial) {
+		return false
+	}
+	value = value[len(initial):]
+	for _, part := range f.any {
+		part = strings.ToLower(part)
+		idx := strings.Index(value, part)
+		if idx == -1 {
+			return false
+		}
+		value = value[idx+len(part):]
+	}
+	return strings.HasSuffix(value, final)
+}
+
+// Returns the values of the given attribute. Attribute names are matched
+// case-insensitively, like in LDAP.
+func (o Object) attributeValues(attr string) []string {
+	if values, exists := o.Attributes[attr]; exists {
+		return values
+	}
+	for key, values := range o.Attributes {
+		if strings.EqualFold(key, attr) {
+			return values
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+	obj := Object{
+		DN: "uid=jane,ou=users,dc=example,dc=org",
+		Attributes: map[string][]string{
+			"uid":         {"jane"},
+			"cn":          {"Jane Doe"},
+			"mail":        {"jane.doe@example.org"},
+			"description": {"star*child (retired)"},
+			"isMemberOf":  {"cn=admins,ou=groups,dc=example,dc=org", "cn=users,ou=groups,dc=example,dc=org"},
+			"objectClass": {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+		},
+	}
+
+	testCases := map[string]bool{
+		//equality (values and attribute names are case-insensitive)
+		"(uid=jane)":                 true,
+		"(uid=john)":                 false,
+		"(UID=JANE)":                 true,
+		"(objectClass=person)":       true,
+		"(objectClass=posixAccount)": false,
+		"(isMemberOf=cn=Admins,ou=groups,dc=example,dc=org)": true,
+		//presence
+		"(mail=*)":            true,
+		"(telephoneNumber=*)": false,
+		//substrings
+		"(cn=Jane*)":           true,
+		"(cn=*Doe)":            true,
+		"(cn=*ne D*)":          true,
+		"(cn=J*e*e)":           true,
+		"(cn=J*x*e)":           false,
+		"(cn=Jane Doe*e)":      false, //initial and final must not overlap
+		"(mail=*@example.org)": true,
+		//escaped values
+		`(description=star\2achild \28retired\29)`: true,
+		`(description=star\2a*)`:                   true,
+		`(description=star\2ax*)`:                  false,
+		//boolean combinations
+		"(&(objectClass=person)(uid=j*))":       true,
+		"(&(objectClass=person)(uid=x*))":       false,
+		"(|(uid=john)(uid=jane))":               true,
+		"(|(uid=john)(uid=jack))":               false,
+		"(!(uid=john))":                         true,
+		"(!(uid=jane))":                         false,
+		"(&(|(uid=john)(cn=Jane*))(!(mail=*)))": false,
+		"(&)":                                   true,
+		"(|)":                                   false,
+		//outermost parentheses may be omitted
+		"uid=jane": true,
+	}
+
+	for input, expected := range testCases {
+		f, err := ParseFilter(input)
+		if err != nil {
+			t.Errorf("cannot parse %q: %s", input, err.Error())
+			continue
+		}
+		if f.Matches(obj) != expected {
+			t.Errorf("expected %q to return %t, but got %t", input, expected, !expected)
+		}
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	testCases := map[string]string{
+		"":                  "filter is empty",
+		"(uid=jane":         "cannot parse filter: unexpected end of filter",
+		"(uid=jane))":       `cannot parse filter: unexpected ")" after end of filter`,
+		"(&(uid=jane)":      `cannot parse filter: expected ")" at ""`,
+		"(uid)":             `cannot parse filter: missing "=" in "uid"`,
+		"(=jane)":           `cannot parse filter: missing attribute name in "=jane"`,
+		"(uid>=jane)":       `cannot parse filter: unsupported filter type in "uid>=jane" (only equality, presence and substring matches are supported)`,
+		"(uid~=jane)":       `cannot parse filter: unsupported filter type in "uid~=jane" (only equality, presence and substring matches are supported)`,
+		"(cn:dn:=jane)":     `cannot parse filter: unsupported filter type in "cn:dn:=jane" (only equality, presence and substring matches are supported)`,
+		"(u id=jane)":       `cannot parse filter: invalid attribute name "u id"`,
+		"(cn=a**b)":         `cannot parse filter: invalid substring match "a**b" (consecutive asterisks)`,
+		"(cn=a(b)":          `cannot parse filter: unescaped parenthesis in "a(b"`,
+		`(cn=a\2)`:          `cannot parse filter: incomplete escape sequence in "a\\2"`,
+		`(cn=a\zz)`:         `cannot parse filter: invalid escape sequence in "a\\zz"`,
+		"(!(uid=a)(uid=b))": `cannot parse filter: expected ")" at "(uid=b))"`,
+	}
+
+	for input, expected := range testCases {
+		_, err := ParseFilter(input)
+		if err == nil {
+			t.Errorf("expected %q to fail parsing, but it succeeded", input)
+		} else if err.Error() != expected {
+			t.Errorf("expected %q to fail with %q, but got %q", input, expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/grammars"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// OUNames contains the names of the organizational units directly below the
+// LDAP suffix that contain user and group entries.
+type OUNames struct {
+	Users  string `json:"users"`  //e.g. "users" for ou=users,dc=example,dc=org
+	Groups string `json:"groups"` //e.g. "groups" for ou=groups,dc=example,dc=org
+}
+
+// DefaultOUNames contains the OU names that are used unless configured
+// otherwise.
+var DefaultOUNames = OUNames{Users: "users", Groups: "groups"}
+
+// The names of the organizational units that are not configurable.
+var fixedOUNames = []string{"posix-groups", "services"}
+
+// ReadOUNamesFromEnvironment reads the OU names from the environment variables
+// PORTUNUS_LDAP_USERS_OU and PORTUNUS_LDAP_GROUPS_OU, using the values from
+// DefaultOUNames for unset variables.
+func ReadOUNamesFromEnvironment() (OUNames, error) {
+	ous := OUNames{
+		Users:  osext.GetenvOrDefault("PORTUNUS_LDAP_USERS_OU", DefaultOUNames.Users),
+		Groups: osext.GetenvOrDefault("PORTUNUS_LDAP_GROUPS_OU", DefaultOUNames.Groups),
+	}
+	return ous, ous.validate()
+}
+
+func (ous OUNames) validate() error {
+	if !grammars.IsOUName(ous.Users) {
+		return fmt.Errorf("invalid value for PORTUNUS_LDAP_USERS_OU: %q does not match /%s/", ous.Users, grammars.OUNameRegex)
+	}
+	if !grammars.IsOUName(ous.Groups) {
+		return fmt.Errorf("invalid value for PORTUNUS_LDAP_GROUPS_OU: %q does not match /%s/", ous.Groups, grammars.OUNameRegex)
+	}
+	//attribute values in DNs are compared case-insensitively
+	if strings.EqualFold(ous.Users, ous.Groups) {
+		return fmt.Errorf("PORTUNUS_LDAP_USERS_OU and PORTUNUS_LDAP_GROUPS_OU must be different, but both are %q", ous.Users)
+	}
+	for _, name := range fixedOUNames {
+		if strings.EqualFold(ous.Users, name) || strings.EqualFold(ous.Groups, name) {
+			return fmt.Errorf("ou=%s is reserved for Portunus and cannot be used for users or groups", name)
+		}
+	}
+	return nil
+}
+
+// CheckOUNames compares the given OU names with the ones that were recorded in
+// the given file during the previous startup, and then records the given OU
+// names in there. If the OU names have changed, a warning is logged and true
+// is returned: The LDAP server is resynced with the new DNs on startup anyway,
+// but all LDAP clients that reference the old DNs (e.g. in their base DN or
+// in group filters) stop working until they are reconfigured.
+//
+// If the file does not exist yet, but isExistingDatabase is true, the previous
+// OU names are assumed to be DefaultOUNames, since those were used before the
+// OU names became configurable.
+func CheckOUNames(path string, ous OUNames, isExistingDatabase bool) (isChanged bool, err error) {
+	var previous *OUNames
+	buf, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(buf, &previous)
+		if err != nil {
+			return false, fmt.Errorf("cannot parse %s: %w", path, err)
+		}
+	case os.IsNotExist(err):
+		if isExistingDatabase {
+			previous = &DefaultOUNames
+		}
+	default:
+		return false, err
+	}
+
+	if previous != nil && *previous != ous {
+		isChanged = true
+		logg.Other("WARNING", "LDAP OU names changed from ou=%s and ou=%s to ou=%s and ou=%s: all users and groups get new DNs in LDAP, so LDAP clients that reference the old DNs need to be reconfigured",
+			previous.Users, previous.Groups, ous.Users, ous.Groups)
+	}
+
+	buf, err = json.Marshal(ous)
+	if err != nil {
+		return isChanged, err
+	}
+	return isChanged, os.WriteFile(path, append(buf, '\n'), 0644)
+}
+
+// UserLayout describes where user entries are placed in the LDAP directory.
+type UserLayout string
+
+const (
+	// FlatUserLayout places all users directly below ou=users (or whatever
+	// OUNames.Users says), e.g. uid=jane,ou=users,dc=example,dc=org. This is
+	// the default.
+	FlatUserLayout UserLayout = "flat"
+	// DepartmentUserLayout places users below an OU for their department, e.g.
+	// uid=jane,ou=Sales,ou=users,dc=example,dc=org. Users without a department
+	// are placed below ou=unassigned,ou=users instead. The department OUs are
+	// created and deleted by the Adapter as needed.
+	DepartmentUserLayout UserLayout = "department"
+)
+
+// The name of the OU that contains the users without a department in
+// DepartmentUserLayout.
+const unassignedDepartmentOU = "unassigned"
+
+// ParseUserLayout parses the value of PORTUNUS_LDAP_USER_LAYOUT. The empty
+// string is accepted as FlatUserLayout.
+func ParseUserLayout(input string) (UserLayout, error) {
+	switch layout := UserLayout(input); layout {
+	case "":
+		return FlatUserLayout, nil
+	case FlatUserLayout, DepartmentUserLayout:
+		return layout, nil
+	default:
+		return "", fmt.Errorf(`invalid LDAP user layout %q (expected "flat" or "department")`, input)
+	}
+}
+
+// dnFactory computes the DNs of the LDAP objects that are rendered from a
+// specific snapshot of the Portunus database. This is the only place that
+// knows where each kind of object lives, so that references to users (e.g. in
+// the `member` attribute of groups) always match the DN of the user entry.
+type dnFactory struct {
+	dnSuffix string
+	ous      OUNames
+	layout   UserLayout
+	//only used in DepartmentUserLayout
+	departmentByLoginName map[string]string
+}
+
+func newDNFactory(users []core.User, dnSuffix string, ous OUNames, layout UserLayout) dnFactory {
+	f := dnFactory{dnSuffix: dnSuffix, ous: ous, layout: layout}
+	if layout == DepartmentUserLayout {
+		f.departmentByLoginName = make(map[string]string, len(users))
+		for _, u := range users {
+			f.departmentByLoginName[u.LoginName] = u.Department
+		}
+	}
+	return f
+}
+
+// Returns the DN of the object that contains the entry of the given user.
+func (f dnFactory) userParentDN(loginName string) string {
+	if f.layout != DepartmentUserLayout {
+		return f.usersDN()
+	}
+	department := f.departmentByLoginName[loginName]
+	if department == "" {
+		department = unassignedDepartmentOU
+	}
+	return f.departmentDN(department)
+}
+
+func (f dnFactory) usersDN() string {
+	return fmt.Sprintf("ou=%s,%s", f.ous.Users, f.dnSuffix)
+}
+
+func (f dnFactory) departmentDN(department string) string {
+	return fmt.Sprintf("ou=%s,%s", goldap.EscapeDN(department), f.usersDN())
+}
+
+func (f dnFactory) UserDN(loginName string) string {
+	return fmt.Sprintf("uid=%s,%s", loginName, f.userParentDN(loginName))
+}
+
+func (f dnFactory) GroupDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=%s,%s", name, f.ous.Groups, f.dnSuffix)
+}
+
+func (f dnFactory) PosixGroupDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=posix-groups,%s", name, f.dnSuffix)
+}
+
+func (f dnFactory) ServiceUserDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=services,%s", name, f.dnSuffix)
+}
+
+func (f dnFactory) NobodyDN() string {
+	return "cn=nobody," + f.dnSuffix
+}
+
+// Renders the OUs that contain the user entries in DepartmentUserLayout. Only
+// OUs that contain at least one user are rendered, so the OU of a department
+// is deleted once its last user leaves it.
+func (f dnFactory) renderDepartmentOUs() []Object {
+	if f.layout != DepartmentUserLayout {
+		return nil
+	}
+	isDepartment := make(map[string]bool)
+	for _, department := range f.departmentByLoginName {
+		if department == "" {
+			department = unassignedDepartmentOU
+		}
+		isDepartment[department] = true
+	}
+	departments := make([]string, 0, len(isDepartment))
+	for department := range isDepartment {
+		departments = append(departments, department)
+	}
+	sort.Strings(departments)
+
+	result := make([]Object, 0, len(departments))
+	for _, department := range departments {
+		result = append(result, Object{
+			DN: f.departmentDN(department),
+			Attributes: map[string][]string{
+				"ou":          {department},
+				"objectClass": {"organizationalUnit", "top"},
+			},
+		})
+	}
+	return result
+}
+
+// UserLayout returns the layout in which the Adapter places user entries.
+func (a *Adapter) UserLayout() UserLayout {
+	a.layoutMutex.Lock()
+	defer a.layoutMutex.Unlock()
+	return a.userLayout
+}
+
+// SetUserLayout changes the layout in which the Adapter places user entries.
+// If the Adapter is already running, it resyncs with the LDAP server right
+// away, which moves all user entries into their new place (see
+// PreviewUserLayout).
+func (a *Adapter) SetUserLayout(layout UserLayout) {
+	a.layoutMutex.Lock()
+	isChanged := a.userLayout != layout
+	a.userLayout = layout
+	a.layoutMutex.Unlock()
+
+	if isChanged {
+		logg.Info("LDAP user layout is now %q", layout)
+		a.RequestResync()
+	}
+}
+
+// PreviewUserLayout computes the write operations that SetUserLayout would
+// execute when switching to the given layout, based on the given snapshot of
+// the Portunus database. The result is reported like in shadow mode. Objects
+// that the Adapter could not sync so far (see FailingEntities) are included,
+// since they would be retried during the switch.
+func (a *Adapter) PreviewUserLayout(db core.Database, layout UserLayout) ShadowReport {
+	a.objectsMutex.Lock()
+	actualObjects := a.objects
+	a.objectsMutex.Unlock()
+	now := time.Now()
+	desiredObjects := renderDBToLDAP(db, a.conn.DNSuffix(), a.OUNames, layout, now, a.HideTemporaryPasswords)
+	return newShadowReport(computeUpdates(actualObjects, desiredObjects), db.Revision, now)
+}
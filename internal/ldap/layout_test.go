@@ -0,0 +1,56 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestReadOUNamesFromEnvironment(t *testing.T) {
+	t.Setenv("PORTUNUS_LDAP_USERS_OU", "")
+	t.Setenv("PORTUNUS_LDAP_GROUPS_OU", "")
+	assert.DeepEqual(t, "defaults", must.Return(ReadOUNamesFromEnvironment()), DefaultOUNames)
+
+	testCases := map[[2]string]string{
+		{"people", "role"}:         "",
+		{"people,ou=x", "role"}:    `invalid value for PORTUNUS_LDAP_USERS_OU: "people,ou=x" does not match /^[A-Za-z0-9][A-Za-z0-9_-]*$/`,
+		{"people", "ou=role"}:      `invalid value for PORTUNUS_LDAP_GROUPS_OU: "ou=role" does not match /^[A-Za-z0-9][A-Za-z0-9_-]*$/`,
+		{"people", "People"}:       `PORTUNUS_LDAP_USERS_OU and PORTUNUS_LDAP_GROUPS_OU must be different, but both are "people"`,
+		{"people", "posix-groups"}: `ou=posix-groups is reserved for Portunus and cannot be used for users or groups`,
+	}
+	for input, expectedError := range testCases {
+		t.Setenv("PORTUNUS_LDAP_USERS_OU", input[0])
+		t.Setenv("PORTUNUS_LDAP_GROUPS_OU", input[1])
+		_, err := ReadOUNamesFromEnvironment()
+		actualError := ""
+		if err != nil {
+			actualError = err.Error()
+		}
+		assert.DeepEqual(t, "error for "+input[0]+" and "+input[1], actualError, expectedError)
+	}
+}
+
+func TestCheckOUNames(t *testing.T) {
+	custom := OUNames{Users: "people", Groups: "role"}
+
+	//on a fresh installation, there is nothing to compare with
+	path := filepath.Join(t.TempDir(), "ldap-ou-names.json")
+	assert.DeepEqual(t, "change on fresh installation", must.Return(CheckOUNames(path, custom, false)), false)
+	assert.DeepEqual(t, "change on restart", must.Return(CheckOUNames(path, custom, false)), false)
+	assert.DeepEqual(t, "change after reconfiguration", must.Return(CheckOUNames(path, DefaultOUNames, true)), true)
+	assert.DeepEqual(t, "change on restart after reconfiguration", must.Return(CheckOUNames(path, DefaultOUNames, true)), false)
+
+	//on an existing installation without a record, the defaults were in use
+	path = filepath.Join(t.TempDir(), "ldap-ou-names.json")
+	assert.DeepEqual(t, "change from implied defaults", must.Return(CheckOUNames(path, custom, true)), true)
+	path = filepath.Join(t.TempDir(), "ldap-ou-names.json")
+	assert.DeepEqual(t, "no change from implied defaults", must.Return(CheckOUNames(path, DefaultOUNames, true)), false)
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// The maximum line length in LDIF output. Longer lines are folded.
+const ldifLineLength = 76
+
+// RenderUserEntry returns the LDAP entry for the given user exactly as the
+// Adapter would write it into the LDAP server at the given time, with
+// attributes sorted by name. The given list of groups must contain all groups
+// in the database, since it is used to compute the isMemberOf attribute.
+// The OU names, the layout and the last argument must match Adapter.OUNames,
+// Adapter.UserLayout() and Adapter.HideTemporaryPasswords, respectively.
+func RenderUserEntry(u core.User, dnSuffix string, ous OUNames, layout UserLayout, allGroups []core.Group, now time.Time, hideTemporaryPasswords bool) goldap.AddRequest {
+	dns := newDNFactory([]core.User{u}, dnSuffix, ous, layout)
+	req := *buildAddRequest(renderUser(u, dns, allGroups, now, hideTemporaryPasswords)).AddRequest
+	sort.Slice(req.Attributes, func(i, j int) bool {
+		return req.Attributes[i].Type < req.Attributes[j].Type
+	})
+	return req
+}
+
+// MarshalLDIF serializes the given entry into a LDIF document (RFC 2849).
+// Values that cannot be represented as plain strings in LDIF (e.g. non-ASCII
+// text or binary data like jpegPhoto) are base64-encoded, and long lines are
+// folded.
+func MarshalLDIF(req goldap.AddRequest) []byte {
+	return MarshalLDIFEntries([]goldap.AddRequest{req})
+}
+
+// MarshalLDIFEntries is like MarshalLDIF, but serializes multiple entries
+// into the same document.
+func MarshalLDIFEntries(reqs []goldap.AddRequest) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("version: 1\n")
+	for _, req := range reqs {
+		buf.WriteByte('\n')
+		writeLDIFLine(&buf, "dn", req.DN)
+		for _, attr := range req.Attributes {
+			for _, value := range attr.Vals {
+				writeLDIFLine(&buf, attr.Type, value)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// Serializes the given operations into a LDIF document with change records
+// (RFC 2849), like ldapmodify(1) would accept it.
+func marshalLDIFChanges(ops []operation) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("version: 1\n")
+	for _, op := range ops {
+		buf.WriteByte('\n')
+		if op.ModifyDNRequest != nil {
+			//the change record for a move refers to the old DN
+			writeLDIFLine(&buf, "dn", op.ModifyDNRequest.DN)
+		} else {
+			writeLDIFLine(&buf, "dn", op.DN())
+		}
+		switch {
+		case op.AddRequest != nil:
+			writeLDIFLine(&buf, "changetype", "add")
+			for _, attr := range op.AddRequest.Attributes {
+				for _, value := range attr.Vals {
+					writeLDIFLine(&buf, attr.Type, value)
+				}
+			}
+		case op.ModifyRequest != nil:
+			writeLDIFLine(&buf, "changetype", "modify")
+			for _, change := range op.ModifyRequest.Changes {
+				attr := change.Modification
+				switch change.Operation {
+				case goldap.AddAttribute:
+					writeLDIFLine(&buf, "add", attr.Type)
+				case goldap.DeleteAttribute:
+					writeLDIFLine(&buf, "delete", attr.Type)
+				default:
+					writeLDIFLine(&buf, "replace", attr.Type)
+				}
+				for _, value := range attr.Vals {
+					writeLDIFLine(&buf, attr.Type, value)
+				}
+				buf.WriteString("-\n")
+			}
+		case op.ModifyDNRequest != nil:
+			writeLDIFLine(&buf, "changetype", "modrdn")
+			writeLDIFLine(&buf, "newrdn", op.ModifyDNRequest.NewRDN)
+			writeLDIFLine(&buf, "deleteoldrdn", "1")
+			writeLDIFLine(&buf, "newsuperior", op.ModifyDNRequest.NewSuperior)
+		case op.DeleteRequest != nil:
+			writeLDIFLine(&buf, "changetype", "delete")
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeLDIFLine(buf *bytes.Buffer, key, value string) {
+	var line string
+	if isSafeLDIFString(value) {
+		line = key + ": " + value
+	} else {
+		line = key + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	//fold long lines: continuation lines start with a single space that is not
+	//part of the value (all lines are ASCII at this point, so we can split
+	//anywhere)
+	for len(line) > ldifLineLength {
+		buf.WriteString(line[:ldifLineLength])
+		buf.WriteString("\n ")
+		line = line[ldifLineLength:]
+	}
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+}
+
+// Implements the SAFE-STRING production from RFC 2849. Additionally, values
+// with trailing spaces are not considered safe, as recommended by the RFC.
+func isSafeLDIFString(value string) bool {
+	if value == "" {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for idx := 0; idx < len(value); idx++ {
+		c := value[idx]
+		if c == 0 || c == '\n' || c == '\r' || c > 0x7F {
+			return false
+		}
+	}
+	return true
+}
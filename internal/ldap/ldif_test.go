@@ -0,0 +1,114 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestMarshalLDIF(t *testing.T) {
+	req := goldap.AddRequest{
+		DN: "uid=jürgen,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"Jürgen Doe"}},
+			{Type: "description", Vals: []string{
+				"plain value",
+				" leading space",
+				"trailing space ",
+				":leading colon",
+				"<leading angle bracket",
+				"line\nbreak",
+				"",
+			}},
+			{Type: "jpegPhoto", Vals: []string{"\xff\xd8\xff\x00"}},
+			{Type: "sshPublicKey", Vals: []string{"ssh-ed25519 " + strings.Repeat("A", 80) + " jurgen@example.org"}},
+		},
+	}
+
+	expected := strings.Join([]string{
+		"version: 1",
+		"",
+		"dn:: dWlkPWrDvHJnZW4sb3U9dXNlcnMsZGM9ZXhhbXBsZSxkYz1vcmc=",
+		"cn:: SsO8cmdlbiBEb2U=",
+		"description: plain value",
+		"description:: IGxlYWRpbmcgc3BhY2U=",
+		"description:: dHJhaWxpbmcgc3BhY2Ug",
+		"description:: OmxlYWRpbmcgY29sb24=",
+		"description:: PGxlYWRpbmcgYW5nbGUgYnJhY2tldA==",
+		"description:: bGluZQpicmVhaw==",
+		"description: ",
+		"jpegPhoto:: /9j/AA==",
+		"sshPublicKey: ssh-ed25519 AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		" AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA jurgen@example.org",
+		"",
+	}, "\n")
+	assert.DeepEqual(t, "LDIF", string(MarshalLDIF(req)), expected)
+}
+
+func TestRenderUserEntry(t *testing.T) {
+	user := core.User{
+		LoginName:    "jane",
+		GivenName:    "Jane",
+		FamilyName:   "Doe",
+		EMailAddress: "jane@example.org",
+		PasswordHash: "{SSHA}dummy",
+	}
+	groups := []core.Group{
+		{Name: "admins", MemberLoginNames: core.GroupMemberNames{"jane": true}},
+		{Name: "secret", MemberLoginNames: core.GroupMemberNames{"jane": true}, HideFromMemberOf: true},
+		{Name: "users", MemberLoginNames: core.GroupMemberNames{"john": true}},
+	}
+
+	req := RenderUserEntry(user, "dc=example,dc=org", DefaultOUNames, FlatUserLayout, groups, time.Now(), false)
+	assert.DeepEqual(t, "entry", req, goldap.AddRequest{
+		DN: "uid=jane,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"Jane Doe"}},
+			{Type: "givenName", Vals: []string{"Jane"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "mail", Vals: []string{"jane@example.org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+			{Type: "sn", Vals: []string{"Doe"}},
+			{Type: "uid", Vals: []string{"jane"}},
+			{Type: "userPassword", Vals: []string{"{SSHA}dummy"}},
+		},
+	})
+}
+
+func TestRenderUserEntryWithTemporaryPassword(t *testing.T) {
+	user := core.User{
+		LoginName:          "jane",
+		GivenName:          "Jane",
+		FamilyName:         "Doe",
+		PasswordHash:       "{SSHA}dummy",
+		MustChangePassword: true,
+	}
+	hasPassword := func(req goldap.AddRequest) bool {
+		for _, attr := range req.Attributes {
+			if attr.Type == "userPassword" {
+				return true
+			}
+		}
+		return false
+	}
+
+	//by default, users can bind with their temporary password...
+	req := RenderUserEntry(user, "dc=example,dc=org", DefaultOUNames, FlatUserLayout, nil, time.Now(), false)
+	assert.DeepEqual(t, "userPassword present by default", hasPassword(req), true)
+	//...but this can be prevented until they have chosen a new password
+	req = RenderUserEntry(user, "dc=example,dc=org", DefaultOUNames, FlatUserLayout, nil, time.Now(), true)
+	assert.DeepEqual(t, "userPassword present when hidden", hasPassword(req), false)
+	user.MustChangePassword = false
+	req = RenderUserEntry(user, "dc=example,dc=org", DefaultOUNames, FlatUserLayout, nil, time.Now(), true)
+	assert.DeepEqual(t, "userPassword present after password change", hasPassword(req), true)
+}
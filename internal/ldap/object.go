@@ -7,7 +7,8 @@
 package ldap
 
 import (
-	"fmt"
+	"sort"
+	"time"
 
 	"github.com/majewsky/portunus/internal/core"
 )
@@ -19,33 +20,45 @@ type Object struct {
 }
 
 // Produces the LDAP objects representing the given group.
-func renderGroup(g core.Group, dnSuffix string) []Object {
+func renderGroup(g core.Group, dns dnFactory) []Object {
 	memberDNames := make([]string, 0, len(g.MemberLoginNames))
 	memberLoginNames := make([]string, 0, len(g.MemberLoginNames))
 	for name, isMember := range g.MemberLoginNames {
 		if isMember {
-			memberDNames = append(memberDNames, fmt.Sprintf("uid=%s,ou=users,%s", name, dnSuffix))
+			memberDNames = append(memberDNames, dns.UserDN(name))
 			memberLoginNames = append(memberLoginNames, name)
 		}
 	}
+	//sort the members to make the rendering deterministic (this is required for
+	//comparing previews of the changes, see Adapter.PreviewUserLayout)
+	sort.Strings(memberDNames)
+	sort.Strings(memberLoginNames)
 	if len(memberDNames) == 0 {
 		//The OpenLDAP core.schema requires that `groupOfNames` contain at least
 		//one `member` attribute. If the group does not have any proper members,
 		//add the dummy user account "nobody" to it.
-		memberDNames = append(memberDNames, "cn=nobody,"+dnSuffix)
+		memberDNames = append(memberDNames, dns.NobodyDN())
 	}
 
 	objs := []Object{{
-		DN: fmt.Sprintf("cn=%s,ou=groups,%s", g.Name, dnSuffix),
+		DN: dns.GroupDN(g.Name),
 		Attributes: map[string][]string{
 			"cn":          {g.Name},
 			"member":      memberDNames,
 			"objectClass": {"groupOfNames", "top"},
 		},
 	}}
+	if g.Description != "" {
+		objs[0].Attributes["description"] = []string{g.Description}
+	}
+	if g.URL != "" {
+		//groupOfNames does not allow labeledURI, so the auxiliary class from RFC 2079 is needed
+		objs[0].Attributes["labeledURI"] = []string{g.URL}
+		objs[0].Attributes["objectClass"] = append(objs[0].Attributes["objectClass"], "labeledURIObject")
+	}
 	if g.PosixGID != nil {
 		objs = append(objs, Object{
-			DN: fmt.Sprintf("cn=%s,ou=posix-groups,%s", g.Name, dnSuffix),
+			DN: dns.PosixGroupDN(g.Name),
 			Attributes: map[string][]string{
 				"cn":          {g.Name},
 				"gidNumber":   {g.PosixGID.String()},
@@ -57,34 +70,70 @@ func renderGroup(g core.Group, dnSuffix string) []Object {
 	return objs
 }
 
-// Produces the LDAP object representing the given user.
-func renderUser(u core.User, dnSuffix string, allGroups []core.Group) Object {
+// Produces the LDAP object representing the given user at the given time.
+// If hideTemporaryPasswords is set, the password of users that need to change
+// it is not rendered (see Adapter.HideTemporaryPasswords).
+func renderUser(u core.User, dns dnFactory, allGroups []core.Group, now time.Time, hideTemporaryPasswords bool) Object {
 	var memberOfGroupDNames []string
 	for _, group := range allGroups {
-		if group.ContainsUser(u) {
-			dn := fmt.Sprintf("cn=%s,ou=groups,%s", group.Name, dnSuffix)
-			memberOfGroupDNames = append(memberOfGroupDNames, dn)
+		if group.ContainsUser(u) && !group.HideFromMemberOf {
+			memberOfGroupDNames = append(memberOfGroupDNames, dns.GroupDN(group.Name))
 		}
 	}
 
+	//sn is mandatory in inetOrgPerson, so users without a family name (if
+	//allowed by PORTUNUS_USER_ALLOW_EMPTY_FAMILY_NAME) use their given name there
+	surname := u.FamilyName
+	if surname == "" {
+		surname = u.GivenName
+	}
+
 	obj := Object{
-		DN: fmt.Sprintf("uid=%s,ou=users,%s", u.LoginName, dnSuffix),
+		DN: dns.UserDN(u.LoginName),
 		Attributes: map[string][]string{
-			"uid":          {u.LoginName},
-			"cn":           {u.FullName()},
-			"sn":           {u.FamilyName},
-			"givenName":    {u.GivenName},
-			"userPassword": {u.PasswordHash},
-			"isMemberOf":   memberOfGroupDNames,
-			"objectClass":  {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+			"uid":         {u.LoginName},
+			"cn":          {u.FullName()},
+			"sn":          {surname},
+			"givenName":   {u.GivenName},
+			"isMemberOf":  memberOfGroupDNames,
+			"objectClass": {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
 		},
 	}
 
+	//users that have not redeemed their invitation yet do not have a password,
+	//so they cannot bind until they set one; expired users cannot bind at all;
+	//the same can be configured for passwords that were chosen by an admin
+	isTemporaryPassword := u.MustChangePassword && hideTemporaryPasswords
+	if u.PasswordHash != "" && !u.IsExpiredAt(now) && !isTemporaryPassword {
+		obj.Attributes["userPassword"] = []string{u.PasswordHash}
+	}
 	if u.EMailAddress != "" {
 		obj.Attributes["mail"] = []string{u.EMailAddress}
 	}
-	if len(u.SSHPublicKeys) > 0 {
-		obj.Attributes["sshPublicKey"] = u.SSHPublicKeys
+	if u.Phone != "" {
+		obj.Attributes["telephoneNumber"] = []string{u.Phone}
+	}
+	if u.MobilePhone != "" {
+		obj.Attributes["mobile"] = []string{u.MobilePhone}
+	}
+	if u.Department != "" {
+		obj.Attributes["ou"] = []string{u.Department}
+	}
+	if u.PreferredLanguage != "" {
+		obj.Attributes["preferredLanguage"] = []string{u.PreferredLanguage}
+	}
+	if u.Timezone != "" {
+		obj.Attributes["portunusTimezone"] = []string{u.Timezone}
+	}
+	if keys := u.VisibleSSHPublicKeys(); len(keys) > 0 {
+		obj.Attributes["sshPublicKey"] = keys
+	}
+	if len(u.Photo) > 0 {
+		obj.Attributes["jpegPhoto"] = []string{string(u.Photo)}
+	}
+
+	for name, values := range u.ExtraAttributes {
+		obj.Attributes[name] = values
 	}
 
 	if u.POSIX != nil {
@@ -104,3 +153,19 @@ func renderUser(u core.User, dnSuffix string, allGroups []core.Group) Object {
 
 	return obj
 }
+
+// Produces the LDAP object representing the given service user.
+func renderServiceUser(s core.ServiceUser, dns dnFactory) Object {
+	obj := Object{
+		DN: dns.ServiceUserDN(s.Name),
+		Attributes: map[string][]string{
+			"cn":           {s.Name},
+			"userPassword": {s.PasswordHash},
+			"objectClass":  {"applicationProcess", "simpleSecurityObject", "top"},
+		},
+	}
+	if s.Description != "" {
+		obj.Attributes["description"] = []string{s.Description}
+	}
+	return obj
+}
@@ -0,0 +1,144 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// ShadowReport describes the write operations that an Adapter in shadow mode
+// would send to the LDAP server to bring it in sync with the Portunus
+// database. It is computed with the same code path that performs the sync in
+// active mode, except that the write operations are recorded instead of being
+// executed.
+type ShadowReport struct {
+	//when the report was computed, and from which database revision
+	ComputedAt time.Time
+	Revision   uint64
+	//how many operations of each type would be executed
+	AddCount    int
+	ModifyCount int
+	MoveCount   int
+	DeleteCount int
+	operations  []operation //sorted by phase and DN, with attributes sorted by type
+}
+
+// OperationCount returns the total number of operations in this report.
+func (r ShadowReport) OperationCount() int {
+	return r.AddCount + r.ModifyCount + r.MoveCount + r.DeleteCount
+}
+
+// MarshalLDIF serializes the operations in this report into a LDIF document
+// with change records, which can be reviewed or applied with ldapmodify(1).
+func (r ShadowReport) MarshalLDIF() []byte {
+	return marshalLDIFChanges(r.operations)
+}
+
+func newShadowReport(ops []operation, revision uint64, now time.Time) ShadowReport {
+	r := ShadowReport{
+		ComputedAt: now,
+		Revision:   revision,
+		operations: append([]operation(nil), ops...),
+	}
+	//within each phase, sort by DN (the phases need to be kept in order, so
+	//that the LDIF can be applied with ldapmodify)
+	sort.SliceStable(r.operations, func(i, j int) bool {
+		lhs, rhs := r.operations[i], r.operations[j]
+		if lhs.phase() != rhs.phase() {
+			return lhs.phase() < rhs.phase()
+		}
+		return lhs.DN() < rhs.DN()
+	})
+	//the attributes are rendered from maps, so sort them to make the LDIF
+	//reproducible (this is safe since these operations will never be executed)
+	for _, op := range r.operations {
+		switch {
+		case op.AddRequest != nil:
+			r.AddCount++
+			attrs := op.AddRequest.Attributes
+			sort.Slice(attrs, func(i, j int) bool { return attrs[i].Type < attrs[j].Type })
+		case op.ModifyRequest != nil:
+			r.ModifyCount++
+			changes := op.ModifyRequest.Changes
+			sort.Slice(changes, func(i, j int) bool { return changes[i].Modification.Type < changes[j].Modification.Type })
+		case op.ModifyDNRequest != nil:
+			r.MoveCount++
+		case op.DeleteRequest != nil:
+			r.DeleteCount++
+		}
+	}
+	return r
+}
+
+// EnableShadowMode puts the Adapter into shadow mode: It only reads from the
+// LDAP server, and computes a ShadowReport of the write operations that it
+// would execute, instead of executing them. The report is computed again
+// whenever the Portunus database changes. This must be called before Run().
+func (a *Adapter) EnableShadowMode() {
+	a.shadowMutex.Lock()
+	defer a.shadowMutex.Unlock()
+	a.isShadowMode = true
+}
+
+// IsShadowMode returns whether the Adapter is in shadow mode (see
+// EnableShadowMode).
+func (a *Adapter) IsShadowMode() bool {
+	a.shadowMutex.Lock()
+	defer a.shadowMutex.Unlock()
+	return a.isShadowMode
+}
+
+// ShadowReport returns the most recent report computed in shadow mode. False
+// is returned if the Adapter is not in shadow mode, or if the first report
+// has not been computed yet.
+func (a *Adapter) ShadowReport() (ShadowReport, bool) {
+	a.shadowMutex.Lock()
+	defer a.shadowMutex.Unlock()
+	if !a.isShadowMode || a.shadowReport == nil {
+		return ShadowReport{}, false
+	}
+	return *a.shadowReport, true
+}
+
+// Activate leaves shadow mode. Since the Adapter has not written anything up
+// to this point, it resyncs with the LDAP server right away, which executes
+// the operations from the most recent ShadowReport (or newer ones, if the
+// LDAP server or the Portunus database changed in the meantime).
+func (a *Adapter) Activate() {
+	a.shadowMutex.Lock()
+	wasShadowMode := a.isShadowMode
+	a.isShadowMode = false
+	a.shadowReport = nil
+	a.shadowMutex.Unlock()
+
+	if wasShadowMode {
+		logg.Info("leaving shadow mode: changes will be written into LDAP from now on")
+		a.RequestResync()
+	}
+}
+
+// Publishes the operations recorded during the current sync as the new
+// ShadowReport, unless shadow mode was left in the meantime.
+func (a *Adapter) publishShadowReport(revision uint64) {
+	report := newShadowReport(a.recordedOperations, revision, time.Now())
+	a.recordedOperations = nil
+
+	a.shadowMutex.Lock()
+	defer a.shadowMutex.Unlock()
+	if !a.isShadowMode {
+		return
+	}
+	//the report is recomputed every time the expiry check runs, so only log when it changes
+	if a.shadowReport == nil || a.shadowReport.OperationCount() != report.OperationCount() {
+		logg.Info("shadow mode: %d changes would be written into LDAP (%d adds, %d modifies, %d moves, %d deletes; database revision %d)",
+			report.OperationCount(), report.AddCount, report.ModifyCount, report.MoveCount, report.DeleteCount, revision)
+	}
+	a.shadowReport = &report
+}
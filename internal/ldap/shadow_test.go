@@ -0,0 +1,144 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestShadowMode(t *testing.T) {
+	//This test simulates trialing Portunus against an LDAP server that already
+	//contains a directory tree: In shadow mode, nothing shall be written, but
+	//the report shall contain exactly what active mode then writes.
+	dir := test.NewFakeLDAPDirectory("dc=example,dc=org")
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, dir)
+	adapter.EnableShadowMode()
+
+	alice := core.User{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", PasswordHash: "x"}
+	bob := core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson", PasswordHash: "y"}
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{alice, bob}
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+
+	//the existing tree has most static objects, an outdated alice, and a user
+	//that does not exist in Portunus
+	for _, addReq := range makeStaticObjects(dir.DNSuffix(), DefaultOUNames) {
+		if addReq.DN == "cn=nobody,dc=example,dc=org" {
+			continue
+		}
+		attrs := make(map[string][]string)
+		for _, attr := range addReq.Attributes {
+			attrs[attr.Type] = attr.Vals
+		}
+		dir.Put(addReq.DN, attrs)
+	}
+	for _, obj := range renderDBToLDAP(core.Database{Users: []core.User{alice}}, dir.DNSuffix(), DefaultOUNames, FlatUserLayout, time.Now(), false) {
+		if obj.DN == "uid=alice,ou=users,dc=example,dc=org" {
+			obj.Attributes["userPassword"] = []string{"outdated"}
+		}
+		dir.Put(obj.DN, obj.Attributes)
+	}
+	dir.Put("uid=carol,ou=users,dc=example,dc=org", map[string][]string{
+		"uid":         {"carol"},
+		"objectClass": {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		test.ExpectNoError(t, adapter.Run(ctx))
+		close(done)
+	}()
+
+	waitForReport := func() ShadowReport {
+		t.Helper()
+		revision, _ := nexus.Revision()
+		for attempt := 0; ; attempt++ {
+			report, ok := adapter.ShadowReport()
+			if ok && report.Revision == revision {
+				return report
+			}
+			if attempt > 500 {
+				t.Fatalf("no shadow report for database revision %d", revision)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	expectNoWrites := func() {
+		t.Helper()
+		requests := dir.TakeRequests()
+		assert.DeepEqual(t, "number of write requests in shadow mode", len(requests.Add)+len(requests.Modify)+len(requests.Delete), 0)
+	}
+
+	//the report covers the missing static object, the missing user bob, the
+	//outdated user alice, and the obsolete user carol
+	report := waitForReport()
+	expectNoWrites()
+	assert.DeepEqual(t, "operation counts", [3]int{report.AddCount, report.ModifyCount, report.DeleteCount}, [3]int{2, 1, 1})
+	ldif := string(report.MarshalLDIF())
+	for _, line := range []string{
+		"dn: cn=nobody,dc=example,dc=org\nchangetype: add\n",
+		"dn: uid=alice,ou=users,dc=example,dc=org\nchangetype: modify\nreplace: userPassword\nuserPassword: x\n-\n",
+		"dn: uid=bob,ou=users,dc=example,dc=org\nchangetype: add\n",
+		"dn: uid=carol,ou=users,dc=example,dc=org\nchangetype: delete\n",
+	} {
+		if !strings.Contains(ldif, line) {
+			t.Errorf("expected shadow report LDIF to contain %q, but got:\n%s", line, ldif)
+		}
+	}
+
+	//the report follows changes to the database
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{alice}
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+	report = waitForReport()
+	expectNoWrites()
+	assert.DeepEqual(t, "operation counts after change", [3]int{report.AddCount, report.ModifyCount, report.DeleteCount}, [3]int{1, 1, 1})
+
+	//after leaving shadow mode, exactly the reported operations are executed
+	adapter.Activate()
+	if _, ok := adapter.ShadowReport(); ok {
+		t.Error("expected no shadow report after leaving shadow mode")
+	}
+	var executed []operation
+	for attempt := 0; len(executed) < report.OperationCount(); attempt++ {
+		if attempt > 500 {
+			t.Fatalf("expected %d write requests after leaving shadow mode, but got %d", report.OperationCount(), len(executed))
+		}
+		time.Sleep(10 * time.Millisecond)
+		requests := dir.TakeRequests()
+		for idx := range requests.Add {
+			executed = append(executed, operation{AddRequest: &requests.Add[idx]})
+		}
+		for idx := range requests.Modify {
+			executed = append(executed, operation{ModifyRequest: &requests.Modify[idx]})
+		}
+		for idx := range requests.Delete {
+			executed = append(executed, operation{DeleteRequest: &requests.Delete[idx]})
+		}
+	}
+	executedReport := newShadowReport(executed, report.Revision, report.ComputedAt)
+	assert.DeepEqual(t, "executed operations", string(executedReport.MarshalLDIF()), string(report.MarshalLDIF()))
+
+	cancel()
+	<-done
+	assert.DeepEqual(t, "extra write requests", dir.TakeRequests(), test.FakeLDAPRequests{})
+}
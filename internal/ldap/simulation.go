@@ -0,0 +1,198 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// SearchSimulation describes an LDAP search whose result shall be predicted
+// by SimulateSearch().
+type SearchSimulation struct {
+	BindDN     string //empty for an anonymous bind
+	BaseDN     string
+	Scope      int //one of goldap.ScopeBaseObject, goldap.ScopeSingleLevel or goldap.ScopeWholeSubtree
+	Filter     Filter
+	Attributes []string //if empty, all attributes are requested
+}
+
+// SimulatedEntry is an entry that matches the filter of a SearchSimulation.
+type SimulatedEntry struct {
+	DN string
+	//This is false if the entry matches the filter, but is not returned
+	//because the bind DN does not have read access to it.
+	IsVisible  bool
+	Attributes []SimulatedAttribute //sorted by type
+}
+
+// SimulatedAttribute is an attribute of a SimulatedEntry.
+type SimulatedAttribute struct {
+	Type   string
+	Values []string
+	//This is false if the attribute was not requested, or if the entry is not
+	//visible to the bind DN.
+	IsReturned bool
+}
+
+// SimulateSearch predicts which entries and attributes an LDAP search would
+// return on the LDAP server that is managed by Portunus, without asking the
+// LDAP server. The entries are rendered from the given database like the
+// Adapter renders them, and access is evaluated with the access rules that
+// portunus-orchestrator puts into the slapd configuration:
+//
+//   - Members of cn=portunus-viewers (service users and users with the
+//     LDAP.CanRead permission) can read everything.
+//   - Users can read their own entry.
+//   - Anonymous binds cannot read anything.
+//
+// The resulting entries are sorted such that each entry comes after its parent.
+func SimulateSearch(db core.Database, dnSuffix string, ous OUNames, layout UserLayout, now time.Time, hideTemporaryPasswords bool, s SearchSimulation) ([]SimulatedEntry, error) {
+	objects := renderAllObjects(db, dnSuffix, ous, layout, now, hideTemporaryPasswords)
+
+	objectsByDN := make(map[string]Object, len(objects))
+	for _, obj := range objects {
+		objectsByDN[normalizeDN(obj.DN)] = obj
+	}
+
+	//check that the bind would succeed
+	bindDN := normalizeDN(s.BindDN)
+	if bindDN != "" {
+		bindObj, exists := objectsByDN[bindDN]
+		if !exists {
+			return nil, fmt.Errorf("cannot bind as %s: no such object", s.BindDN)
+		}
+		if len(bindObj.Attributes["userPassword"]) == 0 {
+			return nil, fmt.Errorf("cannot bind as %s: this account does not have a password in LDAP (e.g. because it expired, or because the invitation was not redeemed yet)", s.BindDN)
+		}
+	}
+	canReadAll := false
+	if bindDN != "" {
+		viewers := objectsByDN[normalizeDN("cn=portunus-viewers,"+dnSuffix)]
+		for _, memberDN := range viewers.Attributes["member"] {
+			if normalizeDN(memberDN) == bindDN {
+				canReadAll = true
+			}
+		}
+	}
+
+	baseDN := normalizeDN(s.BaseDN)
+	if _, exists := objectsByDN[baseDN]; !exists {
+		return nil, fmt.Errorf("base DN %s does not exist", s.BaseDN)
+	}
+	isRequested := make(map[string]bool, len(s.Attributes))
+	for _, attr := range s.Attributes {
+		isRequested[strings.ToLower(attr)] = true
+	}
+
+	var result []SimulatedEntry
+	for _, obj := range objects {
+		dn := normalizeDN(obj.DN)
+		if !isInScope(dn, baseDN, s.Scope) || !s.Filter.Matches(obj) {
+			continue
+		}
+		entry := SimulatedEntry{
+			DN:        obj.DN,
+			IsVisible: canReadAll || dn == bindDN,
+		}
+		for attrType, values := range obj.Attributes {
+			if len(values) == 0 {
+				continue
+			}
+			entry.Attributes = append(entry.Attributes, SimulatedAttribute{
+				Type:       attrType,
+				Values:     values,
+				IsReturned: entry.IsVisible && (len(isRequested) == 0 || isRequested[strings.ToLower(attrType)]),
+			})
+		}
+		sort.Slice(entry.Attributes, func(i, j int) bool {
+			return entry.Attributes[i].Type < entry.Attributes[j].Type
+		})
+		result = append(result, entry)
+	}
+
+	//sort by the reversed list of RDNs, so that parents come before their children
+	sortKey := func(dn string) string {
+		rdns := strings.Split(normalizeDN(dn), ",")
+		for i, j := 0, len(rdns)-1; i < j; i, j = i+1, j-1 {
+			rdns[i], rdns[j] = rdns[j], rdns[i]
+		}
+		//use a separator that sorts before all characters allowed in DNs
+		return strings.Join(rdns, "\x00")
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return sortKey(result[i].DN) < sortKey(result[j].DN)
+	})
+	return result, nil
+}
+
+// Like renderDBToLDAP, but also includes the static objects that establish the
+// basic directory structure. Each object comes after its parent, and groups
+// come after the users that they refer to.
+func renderAllObjects(db core.Database, dnSuffix string, ous OUNames, layout UserLayout, now time.Time, hideTemporaryPasswords bool) []Object {
+	var objects []Object
+	for _, req := range makeStaticObjects(dnSuffix, ous) {
+		obj := Object{DN: req.DN, Attributes: make(map[string][]string, len(req.Attributes))}
+		for _, attr := range req.Attributes {
+			obj.Attributes[attr.Type] = attr.Vals
+		}
+		objects = append(objects, obj)
+	}
+	return append(objects, renderDBToLDAP(db, dnSuffix, ous, layout, now, hideTemporaryPasswords)...)
+}
+
+// Returns whether the given entry is in scope of a search with the given base
+// DN. Both DNs must be normalized.
+func isInScope(dn, baseDN string, scope int) bool {
+	switch scope {
+	case goldap.ScopeBaseObject:
+		return dn == baseDN
+	case goldap.ScopeSingleLevel:
+		_, parentDN := splitDN(dn)
+		return parentDN == baseDN
+	default:
+		return dn == baseDN || strings.HasSuffix(dn, ","+baseDN)
+	}
+}
+
+// Normalizes the given DN for comparison purposes. This is good enough for
+// the DNs rendered by Portunus, where escaped characters can only appear in
+// the names of department OUs (see DepartmentUserLayout).
+func normalizeDN(dn string) string {
+	var rdns []string
+	for rest := dn; ; {
+		var rdn string
+		rdn, rest = splitDN(rest)
+		attr, value, _ := strings.Cut(rdn, "=")
+		rdns = append(rdns, strings.ToLower(strings.TrimSpace(attr))+"="+strings.ToLower(strings.TrimSpace(value)))
+		if rest == "" {
+			break
+		}
+	}
+	if len(rdns) == 1 && rdns[0] == "=" {
+		return ""
+	}
+	return strings.Join(rdns, ",")
+}
+
+// AsAddRequest returns the part of this entry that the LDAP server would
+// return (which is nothing if the entry is not visible), for rendering with
+// MarshalLDIF().
+func (e SimulatedEntry) AsAddRequest() goldap.AddRequest {
+	req := goldap.AddRequest{DN: e.DN}
+	for _, attr := range e.Attributes {
+		if attr.IsReturned {
+			req.Attributes = append(req.Attributes, goldap.Attribute{Type: attr.Type, Vals: attr.Values})
+		}
+	}
+	return req
+}
@@ -0,0 +1,119 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSimulateSearch(t *testing.T) {
+	db := core.Database{
+		Users: []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison", PasswordHash: "{SSHA}alice"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson", PasswordHash: "{SSHA}bob"},
+			{LoginName: "carol", GivenName: "Carol", FamilyName: "Carlson"}, //invitation not redeemed yet
+		},
+		Groups: []core.Group{{
+			Name:             "viewers",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+			Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+		}},
+		ServiceUsers: []core.ServiceUser{
+			{Name: "svc-wiki", PasswordHash: "{SSHA}wiki"},
+		},
+	}
+	const suffix = "dc=example,dc=org"
+	personFilter, err := ParseFilter("(objectClass=person)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	simulate := func(s SearchSimulation) (visible, hidden []string) {
+		t.Helper()
+		entries, err := SimulateSearch(db, suffix, DefaultOUNames, FlatUserLayout, time.Now(), false, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsVisible {
+				visible = append(visible, entry.DN)
+			} else {
+				hidden = append(hidden, entry.DN)
+			}
+		}
+		return visible, hidden
+	}
+	allPersons := []string{
+		"uid=alice,ou=users,dc=example,dc=org",
+		"uid=bob,ou=users,dc=example,dc=org",
+		"uid=carol,ou=users,dc=example,dc=org",
+	}
+
+	//service users and members of groups with LDAP read permission can see everything
+	for _, bindDN := range []string{"cn=svc-wiki,ou=services,dc=example,dc=org", "uid=alice,ou=users,dc=example,dc=org"} {
+		visible, hidden := simulate(SearchSimulation{BindDN: bindDN, BaseDN: suffix, Scope: goldap.ScopeWholeSubtree, Filter: personFilter})
+		assert.DeepEqual(t, "visible entries for "+bindDN, visible, allPersons)
+		assert.DeepEqual(t, "hidden entries for "+bindDN, len(hidden), 0)
+	}
+
+	//other users can only see themselves
+	visible, hidden := simulate(SearchSimulation{BindDN: "UID=bob, ou=users, dc=example, dc=org", BaseDN: suffix, Scope: goldap.ScopeWholeSubtree, Filter: personFilter})
+	assert.DeepEqual(t, "visible entries for bob", visible, allPersons[1:2])
+	assert.DeepEqual(t, "hidden entries for bob", hidden, []string{allPersons[0], allPersons[2]})
+
+	//anonymous binds cannot see anything
+	visible, hidden = simulate(SearchSimulation{BaseDN: suffix, Scope: goldap.ScopeWholeSubtree, Filter: personFilter})
+	assert.DeepEqual(t, "visible entries for anonymous", len(visible), 0)
+	assert.DeepEqual(t, "hidden entries for anonymous", hidden, allPersons)
+
+	//users without a password cannot bind
+	_, err = SimulateSearch(db, suffix, DefaultOUNames, FlatUserLayout, time.Now(), false, SearchSimulation{BindDN: "uid=carol,ou=users,dc=example,dc=org", BaseDN: suffix, Filter: personFilter})
+	if err == nil || !strings.Contains(err.Error(), "does not have a password in LDAP") {
+		t.Errorf("expected bind error for carol, but got %v", err)
+	}
+
+	//scopes are respected, and parents are sorted before their children
+	everything, err := ParseFilter("(objectClass=*)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcWiki := "cn=svc-wiki,ou=services,dc=example,dc=org"
+	visible, _ = simulate(SearchSimulation{BindDN: svcWiki, BaseDN: "ou=services," + suffix, Scope: goldap.ScopeWholeSubtree, Filter: everything})
+	assert.DeepEqual(t, "subtree search", visible, []string{"ou=services,dc=example,dc=org", svcWiki})
+	visible, _ = simulate(SearchSimulation{BindDN: svcWiki, BaseDN: "ou=services," + suffix, Scope: goldap.ScopeSingleLevel, Filter: everything})
+	assert.DeepEqual(t, "one-level search", visible, []string{svcWiki})
+	visible, _ = simulate(SearchSimulation{BindDN: svcWiki, BaseDN: "ou=services," + suffix, Scope: goldap.ScopeBaseObject, Filter: everything})
+	assert.DeepEqual(t, "base search", visible, []string{"ou=services,dc=example,dc=org"})
+	_, err = SimulateSearch(db, suffix, DefaultOUNames, FlatUserLayout, time.Now(), false, SearchSimulation{BindDN: svcWiki, BaseDN: "ou=nothing," + suffix, Filter: everything})
+	assert.DeepEqual(t, "error for missing base DN", err.Error(), "base DN ou=nothing,dc=example,dc=org does not exist")
+
+	//only the requested attributes are returned
+	uidFilter, err := ParseFilter("(uid=bob)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := SimulateSearch(db, suffix, DefaultOUNames, FlatUserLayout, time.Now(), false, SearchSimulation{
+		BindDN:     svcWiki,
+		BaseDN:     suffix,
+		Scope:      goldap.ScopeWholeSubtree,
+		Filter:     uidFilter,
+		Attributes: []string{"CN", "mail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "returned entry", entries[0].AsAddRequest(), goldap.AddRequest{
+		DN:         "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{{Type: "cn", Vals: []string{"Bob Bobson"}}},
+	})
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// EntitySyncStatus describes how the most recent write operation for a single
+// LDAP object went.
+type EntitySyncStatus struct {
+	DN string
+	//one of "user", "group", "posix_group", "service_user", "department" (for
+	//the OUs of DepartmentUserLayout) or "internal" (for the objects that
+	//Portunus creates for itself, like the top-level OUs)
+	EntityType string
+	EntityName string
+	//the most recent write operation for this object ("add", "modify" or
+	//"delete"), and when it was sent
+	LastOperation string
+	LastAttemptAt time.Time
+	//the error returned by the LDAP server for the most recent operation, or
+	//empty if that operation succeeded
+	LastError string
+	//when a write operation for this object last succeeded (zero if none has
+	//succeeded since startup)
+	LastSuccessAt time.Time
+}
+
+// IsFailing returns whether the most recent write operation for this object
+// was rejected by the LDAP server.
+func (s EntitySyncStatus) IsFailing() bool {
+	return s.LastError != ""
+}
+
+var entityTypes = []string{"user", "group", "posix_group", "service_user", "department", "internal"}
+
+// Derives the entity type and name for an EntitySyncStatus from the DN of
+// the respective LDAP object.
+func classifyDN(dn, dnSuffix string, ous OUNames) (entityType, entityName string) {
+	entityTypesByOU := map[string]string{
+		strings.ToLower("ou=" + ous.Users):  "user",
+		strings.ToLower("ou=" + ous.Groups): "group",
+		"ou=posix-groups":                   "posix_group",
+		"ou=services":                       "service_user",
+	}
+
+	rdn, parentDN := splitDN(strings.TrimSuffix(dn, ","+dnSuffix))
+	_, entityName, _ = strings.Cut(rdn, "=")
+	//the type is determined by the top-level OU that the object is in (users
+	//can be one level further down, see DepartmentUserLayout)
+	var topRDN string
+	for rest := parentDN; rest != ""; {
+		topRDN, rest = splitDN(rest)
+	}
+	entityType, ok := entityTypesByOU[strings.ToLower(topRDN)]
+	switch {
+	case !ok:
+		return "internal", entityName
+	case entityType == "user" && strings.HasPrefix(rdn, "ou="):
+		return "department", entityName
+	default:
+		return entityType, entityName
+	}
+}
+
+// FailingEntities returns the status of all LDAP objects whose most recent
+// write operation was rejected by the LDAP server, sorted by DN. These
+// operations are retried on every sync (at the latest after one minute), and
+// objects stop being reported here as soon as a retry succeeds, or once they
+// are not supposed to exist anymore.
+func (a *Adapter) FailingEntities() []EntitySyncStatus {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	var result []EntitySyncStatus
+	for _, s := range a.entityStatus {
+		if s.IsFailing() {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DN < result[j].DN
+	})
+	return result
+}
+
+// SyncErrorCounts returns how many write operations were rejected by the
+// LDAP server since startup, grouped by entity type (see EntitySyncStatus).
+// All entity types are included, even if their count is zero.
+func (a *Adapter) SyncErrorCounts() map[string]uint64 {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	result := make(map[string]uint64, len(entityTypes))
+	for _, entityType := range entityTypes {
+		result[entityType] = a.syncErrorCounts[entityType]
+	}
+	return result
+}
+
+// Records the result of a write operation in the EntitySyncStatus of the
+// respective object. Returns whether the operation failed with a different
+// error than the previous one (so that repeated failures can be logged only
+// once).
+func (a *Adapter) recordOperationResult(op operation, err error, now time.Time) (isNewError bool) {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	if a.entityStatus == nil {
+		a.entityStatus = make(map[string]EntitySyncStatus)
+	}
+	if a.syncErrorCounts == nil {
+		a.syncErrorCounts = make(map[string]uint64)
+	}
+
+	dn := op.DN()
+	s, exists := a.entityStatus[dn]
+	if !exists {
+		s.DN = dn
+		s.EntityType, s.EntityName = classifyDN(dn, a.conn.DNSuffix(), a.OUNames)
+	}
+	previousError := s.LastError
+	s.LastOperation = op.Kind()
+	s.LastAttemptAt = now
+	if err == nil {
+		s.LastError = ""
+		s.LastSuccessAt = now
+	} else {
+		s.LastError = err.Error()
+		a.syncErrorCounts[s.EntityType]++
+	}
+	a.entityStatus[dn] = s
+	return err != nil && s.LastError != previousError
+}
+
+// Drops the EntitySyncStatus of all objects that neither exist in the LDAP
+// database nor are supposed to exist there, so that the status does not keep
+// growing as objects are deleted, and so that a failing object stops being
+// reported once it has been deleted from Portunus.
+func (a *Adapter) forgetEntitySyncStatus(isRelevantDN func(dn string) bool) {
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	for dn := range a.entityStatus {
+		if !isRelevantDN(dn) {
+			delete(a.entityStatus, dn)
+		}
+	}
+}
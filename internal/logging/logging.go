@@ -0,0 +1,139 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package logging is a thin layer on top of package logg that adds an optional
+// JSON output format (PORTUNUS_LOG_FORMAT=json) and log messages with
+// structured fields.
+//
+// Plain logg calls keep working as before: In JSON mode, their output is
+// converted into JSON objects as well, just without any structured fields.
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Fields are structured fields attached to a log message. In the plain-text
+// format, they are appended to the message as key=value pairs.
+type Fields map[string]string
+
+var (
+	jsonMode bool
+	//The mutex guards access to all fields listed below it.
+	mutex  sync.Mutex
+	output io.Writer = os.Stderr
+	now              = time.Now
+)
+
+// Setup configures the log format. Valid values are "text" (or the empty
+// string) and "json". This must be called before the first log message is
+// written by any goroutine other than the caller.
+func Setup(format string) {
+	jsonMode = format == "json"
+	if jsonMode {
+		logg.SetLogger(stdlog.New(lineWriter{}, "", 0))
+	}
+}
+
+// IsValidFormat returns whether the given value is acceptable for Setup().
+func IsValidFormat(format string) bool {
+	return format == "text" || format == "json"
+}
+
+// Info logs an informational message with structured fields.
+func Info(fields Fields, msg string, args ...any) {
+	doLog("INFO", fields, msg, args)
+}
+
+// Error logs a non-fatal error with structured fields.
+func Error(fields Fields, msg string, args ...any) {
+	doLog("ERROR", fields, msg, args)
+}
+
+// ForwardLines reads the given stream until EOF, and logs each line as an
+// informational message with the given structured fields. This is used to
+// capture the output of child processes like slapd.
+func ForwardLines(r io.Reader, fields Fields) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			Info(fields, "%s", line)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		logg.Error("cannot read log output of child process: %s", err.Error())
+	}
+}
+
+func doLog(level string, fields Fields, msg string, args []any) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	if jsonMode {
+		writeJSON(level, msg, fields)
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg += fmt.Sprintf(" %s=%q", key, fields[key])
+	}
+	//pass the message as an argument, in case it contains percent signs
+	logg.Other(level, "%s", msg)
+}
+
+func writeJSON(level, msg string, fields Fields) {
+	obj := make(map[string]string, len(fields)+3)
+	for key, value := range fields {
+		obj[key] = value
+	}
+	//the standard keys take precedence over structured fields of the same name
+	obj["level"] = strings.ToLower(level)
+	obj["time"] = now().UTC().Format(time.RFC3339Nano)
+	obj["message"] = msg
+
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		//cannot happen since we only marshal strings, but let's be defensive
+		buf = []byte(fmt.Sprintf(`{"level":"error","message":%q}`, err.Error()))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, _ = output.Write(append(buf, '\n'))
+}
+
+// lineWriter receives the output of logg in JSON mode. Each write contains a
+// single log line of the form "LEVEL: message".
+type lineWriter struct{}
+
+// Write implements the io.Writer interface.
+func (lineWriter) Write(buf []byte) (int, error) {
+	line := strings.TrimSuffix(string(buf), "\n")
+	level, msg, ok := strings.Cut(line, ": ")
+	if !ok || level == "" || strings.ToUpper(level) != level {
+		level, msg = "INFO", line
+	}
+	writeJSON(level, msg, nil)
+	return len(buf), nil
+}
@@ -0,0 +1,58 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package logging
+
+import (
+	"bytes"
+	stdlog "log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	output = &buf
+	now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	Setup("json")
+	defer func() {
+		output = os.Stderr
+		now = time.Now
+		jsonMode = false
+		logg.SetLogger(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+	}()
+
+	logg.Info("plain message with %d%% coverage", 100)
+	logg.Error("multi-line\nmessage")
+	Info(Fields{"login_name": "jane"}, "user %s logged in", "jane")
+	Error(Fields{"dn": "uid=jane,ou=users,dc=example,dc=org", "message": "ignored"}, "cannot update LDAP object")
+	ForwardLines(strings.NewReader("first line\n\n  second line  \n"), Fields{"source": "slapd"})
+
+	expected := []string{
+		`{"level":"info","message":"plain message with 100% coverage","time":"2024-01-02T03:04:05Z"}`,
+		`{"level":"error","message":"multi-line\\nmessage","time":"2024-01-02T03:04:05Z"}`,
+		`{"level":"info","login_name":"jane","message":"user jane logged in","time":"2024-01-02T03:04:05Z"}`,
+		`{"dn":"uid=jane,ou=users,dc=example,dc=org","level":"error","message":"cannot update LDAP object","time":"2024-01-02T03:04:05Z"}`,
+		`{"level":"info","message":"first line","source":"slapd","time":"2024-01-02T03:04:05Z"}`,
+		`{"level":"info","message":"second line","source":"slapd","time":"2024-01-02T03:04:05Z"}`,
+	}
+	assert.DeepEqual(t, "log output", strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"), expected)
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logg.SetLogger(stdlog.New(&buf, "", 0))
+	Setup("text")
+	defer logg.SetLogger(stdlog.New(os.Stderr, "", stdlog.LstdFlags))
+
+	Info(Fields{"source": "slapd", "dn": "cn=foo"}, "100% done")
+	assert.DeepEqual(t, "log output", buf.String(), "INFO: 100% done dn=\"cn=foo\" source=\"slapd\"\n")
+}
@@ -0,0 +1,194 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+var subjects = map[Event]string{
+	PasswordChanged: "Your password was changed",
+	SSHKeyAdded:     "An SSH key was added to your account",
+	NewDevice:       "New sign-in to your account",
+	SeedFight:       "Changes keep getting reverted by the seed",
+}
+
+var elevationSubjects = map[core.ElevationEventKind]string{
+	core.ElevationRequested: "Temporary group membership requested",
+	core.ElevationApproved:  "Temporary group membership approved",
+	core.ElevationDenied:    "Temporary group membership not granted",
+	core.ElevationCompleted: "Temporary group membership ended",
+}
+
+var elevationSummaries = map[core.ElevationEventKind]string{
+	core.ElevationRequested: "temporary membership in a group was requested, and needs to be approved:",
+	core.ElevationApproved:  "a temporary group membership was approved, and is now in effect:",
+	core.ElevationDenied:    "a request for temporary group membership was not granted:",
+	core.ElevationCompleted: "a temporary group membership has ended:",
+}
+
+var bodyTemplate = template.Must(template.New("body").Funcs(template.FuncMap{
+	"summary": func(kind core.ElevationEventKind) string { return elevationSummaries[kind] },
+}).Parse(`Hello {{.GivenName}},
+
+{{ if eq .Event "password_changed" -}}
+the password of your account "{{.LoginName}}" was changed on {{.Time.Format "2006-01-02 15:04 MST"}}.
+{{- else if eq .Event "ssh_key_added" -}}
+the following SSH public key was added to your account "{{.LoginName}}" on {{.Time.Format "2006-01-02 15:04 MST"}}:
+
+    {{.SSHKey}}
+{{- else if eq .Event "new_device" -}}
+your account "{{.LoginName}}" was used to sign in from a new device on {{.Time.Format "2006-01-02 15:04 MST"}}:
+
+    Device: {{.Login.DeviceName}}
+    IP address: {{.Login.RemoteAddr}}
+{{- else if eq .Event "elevation" -}}
+{{ summary .ElevationKind }}
+
+    User: {{.Elevation.LoginName}}
+    Group: {{.Elevation.GroupName}}
+    {{ if .Elevation.ExtendsID }}Extension{{ else }}Duration{{ end }}: {{.Elevation.Hours}} hour(s)
+    Justification: {{.Elevation.Justification}}
+    Requested by: {{.Elevation.RequestedBy}}
+{{- if eq .ElevationKind "approved" }}
+    Expires at: {{.Elevation.ExpiresAt.Format "2006-01-02 15:04 MST"}}
+{{- else if .Elevation.EndReason }}
+    Outcome: {{.Elevation.EndReason}}
+{{- end }}
+{{- else if eq .Event "seed_fight" -}}
+the seed had to revert changes to the following object {{.SeedFight.Corrections}} times within {{.SeedFight.Window}}:
+
+    Object: {{.SeedFight.Object.Type}} "{{.SeedFight.Object.Name}}"
+    Last correction: {{.SeedFight.LastCorrection}}
+    Last changed by: {{ or .SeedFight.LastCorrection.Actor "unknown" }}
+
+Something (e.g. a script or another admin) is probably fighting against the
+seed. Changes to seeded fields need to be made in the seed file instead.
+{{- end }}
+{{ if .Login.ConfirmationURL }}
+If you signed in yourself, please confirm the new device by visiting the
+following link. Until then, no changes can be made from that device.
+
+    {{.Login.ConfirmationURL}}
+
+If you did not sign in yourself, do not visit this link, and please contact
+your administrator immediately, since someone else knows your password.
+{{ else if eq .Event "elevation" }}
+All pending and active elevations are listed on the "Elevations" page in Portunus.
+{{ else if eq .Event "seed_fight" }}
+All recent corrections are listed on the "Seed corrections" page in Portunus.
+{{ else }}
+If you made this change yourself, you can ignore this message. Otherwise,
+please contact your administrator immediately, since someone else might have
+access to your account.
+{{ end }}
+--
+This message was sent automatically by Portunus.
+`))
+
+// Renders the full email (headers and body) for the given notification.
+func renderMessage(from string, notif notification) ([]byte, error) {
+	//the address comes from the database; make sure that it cannot inject headers
+	to, err := mail.ParseAddress(notif.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email address %q: %w", notif.Address, err)
+	}
+	var body bytes.Buffer
+	err = bodyTemplate.Execute(&body, notif)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := subjects[notif.Event]
+	if notif.Event == Elevation {
+		subject = elevationSubjects[notif.ElevationKind]
+	}
+	headers := []string{
+		"From: " + from,
+		"To: " + to.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + notif.Time.Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+	}
+	msg := strings.Join(headers, "\n") + "\n\n" + body.String()
+	return []byte(strings.ReplaceAll(msg, "\n", "\r\n")), nil
+}
+
+// Delivers a message through the configured SMTP server. STARTTLS is used if
+// the server offers it.
+func (c Config) sendMail(to string, msg []byte) error {
+	addr := net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort))
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	//a hanging mail server shall not hold up the delivery of later notifications forever
+	err = conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, c.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: c.SMTPHost, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return err
+		}
+	}
+	if c.SMTPUser != "" {
+		err = client.Auth(smtp.PlainAuth("", c.SMTPUser, c.SMTPPassword, c.SMTPHost))
+		if err != nil {
+			return err
+		}
+	}
+
+	fromAddr, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %w", c.From, err)
+	}
+	err = client.Mail(fromAddr.Address)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
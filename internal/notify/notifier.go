@@ -0,0 +1,380 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package notify sends emails to users when security-relevant changes are made
+// to their accounts, so that account takeovers are noticed quickly.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// Event identifies a kind of account change that users can be notified about.
+type Event string
+
+const (
+	// PasswordChanged is the Event for when the password of an existing user is changed.
+	PasswordChanged Event = "password_changed"
+	// SSHKeyAdded is the Event for when an SSH public key is added to a user.
+	SSHKeyAdded Event = "ssh_key_added"
+	// NewDevice is the Event for when a user logs into the web GUI from a device
+	// that was not recognized.
+	NewDevice Event = "new_device"
+	// Elevation is the Event for when a temporary elevation into a group is
+	// requested, approved, denied or ended. Unlike the other events, this is
+	// sent to the elevated user, the requester and all approvers.
+	Elevation Event = "elevation"
+	// SeedFight is the Event for when the seed had to revert changes to the
+	// same object so often that something is probably fighting against the
+	// seed. This is sent to all users with admin access to Portunus.
+	SeedFight Event = "seed_fight"
+)
+
+var allEvents = []Event{PasswordChanged, SSHKeyAdded, NewDevice, Elevation, SeedFight}
+
+// How many notifications can be waiting for delivery. When the mail server is
+// unreachable for a long time, further notifications are dropped instead of
+// piling up indefinitely.
+const queueSize = 100
+
+// Config contains everything that is needed to send notifications.
+type Config struct {
+	SMTPHost     string         //from PORTUNUS_SERVER_SMTP_HOST
+	SMTPPort     int            //from PORTUNUS_SERVER_SMTP_PORT
+	SMTPUser     string         //from PORTUNUS_SERVER_SMTP_USER
+	SMTPPassword string         //from PORTUNUS_SERVER_SMTP_PASSWORD
+	From         string         //from PORTUNUS_SERVER_SMTP_FROM
+	Events       map[Event]bool //from PORTUNUS_SERVER_NOTIFICATION_EVENTS
+}
+
+// ReadConfigFromEnvironment builds a Config from the respective environment
+// variables. If PORTUNUS_SERVER_SMTP_HOST is not set, notifications are
+// disabled and nil is returned.
+func ReadConfigFromEnvironment() (*Config, error) {
+	host := os.Getenv("PORTUNUS_SERVER_SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	cfg := Config{
+		SMTPHost:     host,
+		SMTPUser:     os.Getenv("PORTUNUS_SERVER_SMTP_USER"),
+		SMTPPassword: os.Getenv("PORTUNUS_SERVER_SMTP_PASSWORD"),
+		From:         os.Getenv("PORTUNUS_SERVER_SMTP_FROM"),
+	}
+	if cfg.From == "" {
+		return nil, errors.New("PORTUNUS_SERVER_SMTP_FROM must be set when PORTUNUS_SERVER_SMTP_HOST is set")
+	}
+	_, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("malformed value for PORTUNUS_SERVER_SMTP_FROM: %w", err)
+	}
+
+	cfg.SMTPPort, err = strconv.Atoi(osext.GetenvOrDefault("PORTUNUS_SERVER_SMTP_PORT", "587"))
+	if err != nil {
+		return nil, fmt.Errorf("malformed value for PORTUNUS_SERVER_SMTP_PORT: %w", err)
+	}
+	cfg.Events, err = ParseEvents(osext.GetenvOrDefault("PORTUNUS_SERVER_NOTIFICATION_EVENTS", "password_changed,ssh_key_added,new_device,elevation,seed_fight"))
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ParseEvents parses a comma-separated list of event types.
+func ParseEvents(input string) (map[Event]bool, error) {
+	result := make(map[Event]bool)
+	for _, field := range strings.Split(input, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		isKnown := false
+		for _, event := range allEvents {
+			if Event(field) == event {
+				isKnown = true
+			}
+		}
+		if !isKnown {
+			return nil, fmt.Errorf("malformed value for PORTUNUS_SERVER_NOTIFICATION_EVENTS: unknown event type %q", field)
+		}
+		result[Event(field)] = true
+	}
+	return result, nil
+}
+
+// Notifier observes changes to the Portunus database and sends notification
+// emails to the affected users.
+type Notifier struct {
+	cfg   Config
+	queue chan notification
+	//The last database that we have seen. This is only accessed by the
+	//listener, which is never invoked concurrently.
+	lastDB *core.Database
+	//These are replaced in unit tests.
+	send        func(to string, msg []byte) error
+	retryDelays []time.Duration
+	now         func() time.Time
+}
+
+// A notification that is waiting for delivery.
+type notification struct {
+	Event     Event
+	LoginName string
+	GivenName string
+	Address   string
+	Time      time.Time
+	SSHKey    string       //only for SSHKeyAdded
+	Login     LoginDetails //only for NewDevice
+	//only for Elevation
+	ElevationKind core.ElevationEventKind
+	Elevation     core.Elevation
+	SeedFight     core.SeedFight //only for SeedFight
+}
+
+// LoginDetails describes a login from a new device.
+type LoginDetails struct {
+	DeviceName string //e.g. "Firefox on Linux"
+	RemoteAddr string
+	//If not empty, the device needs to be confirmed by visiting this URL.
+	ConfirmationURL string
+}
+
+// NewNotifier initializes a Notifier.
+func NewNotifier(cfg Config) *Notifier {
+	n := &Notifier{
+		cfg:         cfg,
+		queue:       make(chan notification, queueSize),
+		retryDelays: []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute},
+		now:         time.Now,
+	}
+	n.send = cfg.sendMail
+	return n
+}
+
+// Run listens for changes to the Portunus database and delivers the resulting
+// notifications until `ctx` expires. Delivery happens asynchronously, so
+// database updates are never blocked or failed by slow or broken mail servers.
+func (n *Notifier) Run(ctx context.Context, nexus core.Nexus) {
+	nexus.AddListener(ctx, n.handleDatabase)
+	n.processQueue(ctx)
+}
+
+func (n *Notifier) processQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notif := <-n.queue:
+			n.deliver(ctx, notif)
+		}
+	}
+}
+
+func (n *Notifier) handleDatabase(db core.Database) {
+	//the first database that we see is the initial load (or the current state
+	//when we start listening), which does not contain any changes
+	if n.lastDB == nil {
+		n.lastDB = &db
+		return
+	}
+	oldDB := *n.lastDB
+	n.lastDB = &db
+
+	for _, notif := range n.collectNotifications(oldDB, db) {
+		n.enqueue(notif)
+	}
+}
+
+// NotifyNewDevice notifies the given user about a login from a new device.
+// This is called by the frontend, since logins do not show up in the
+// database. Delivery happens asynchronously, same as for all other events.
+//
+// If a confirmation URL is given, the notification is sent even if the
+// NewDevice event is not enabled, since the user cannot confirm the device
+// otherwise.
+func (n *Notifier) NotifyNewDevice(user core.User, login LoginDetails) {
+	if !n.cfg.Events[NewDevice] && login.ConfirmationURL == "" {
+		return
+	}
+	if user.EMailAddress == "" {
+		logg.Debug("not sending notifications to user %q because they do not have an email address", user.LoginName)
+		return
+	}
+	n.enqueue(notification{
+		Event:     NewDevice,
+		LoginName: user.LoginName,
+		GivenName: user.GivenName,
+		Address:   user.EMailAddress,
+		Time:      n.now(),
+		Login:     login,
+	})
+}
+
+// NotifyElevation notifies all recipients of the given event. This is called
+// by the core.ElevationManager, since most elevation events do not change the
+// database.
+func (n *Notifier) NotifyElevation(event core.ElevationEvent) {
+	if !n.cfg.Events[Elevation] {
+		return
+	}
+	for _, user := range event.Recipients {
+		if user.EMailAddress == "" {
+			logg.Debug("not sending notifications to user %q because they do not have an email address", user.LoginName)
+			continue
+		}
+		n.enqueue(notification{
+			Event:         Elevation,
+			LoginName:     user.LoginName,
+			GivenName:     user.GivenName,
+			Address:       user.EMailAddress,
+			Time:          n.now(),
+			ElevationKind: event.Kind,
+			Elevation:     event.Elevation,
+		})
+	}
+}
+
+// NotifySeedFight notifies all recipients of the given fight. This is called
+// by the core.SeedCorrectionTracker, since seed corrections leave the database
+// unchanged.
+func (n *Notifier) NotifySeedFight(fight core.SeedFight) {
+	if !n.cfg.Events[SeedFight] {
+		return
+	}
+	for _, user := range fight.Recipients {
+		if user.EMailAddress == "" {
+			logg.Debug("not sending notifications to user %q because they do not have an email address", user.LoginName)
+			continue
+		}
+		n.enqueue(notification{
+			Event:     SeedFight,
+			LoginName: user.LoginName,
+			GivenName: user.GivenName,
+			Address:   user.EMailAddress,
+			Time:      n.now(),
+			SeedFight: fight,
+		})
+	}
+}
+
+func (n *Notifier) enqueue(notif notification) {
+	select {
+	case n.queue <- notif:
+	default:
+		logg.Error("dropping %s notification for user %q because too many notifications are waiting for delivery", notif.Event, notif.LoginName)
+	}
+}
+
+// Finds all changes between the two databases that users shall be notified about.
+func (n *Notifier) collectNotifications(oldDB, newDB core.Database) (result []notification) {
+	now := n.now()
+	for _, change := range core.DiffDatabases(oldDB, newDB) {
+		//newly created users do not need to be told that they have a password
+		if change.Type != "user" || change.Kind != core.ObjectModified {
+			continue
+		}
+		user, exists := newDB.Users.Find(func(u core.User) bool { return u.LoginName == change.Key })
+		if !exists {
+			continue
+		}
+
+		var notifs []notification
+		for _, field := range change.Fields {
+			switch field.Path {
+			case "password":
+				//an initial password being set (e.g. when accepting an invitation) is not a change
+				if n.cfg.Events[PasswordChanged] && field.OldValue != `""` {
+					notifs = append(notifs, notification{Event: PasswordChanged})
+				}
+			case "ssh_public_keys":
+				if n.cfg.Events[SSHKeyAdded] {
+					for _, key := range addedSSHPublicKeys(field.OldValue, field.NewValue) {
+						notifs = append(notifs, notification{Event: SSHKeyAdded, SSHKey: key})
+					}
+				}
+			}
+		}
+		if len(notifs) == 0 {
+			continue
+		}
+		if user.EMailAddress == "" {
+			logg.Debug("not sending notifications to user %q because they do not have an email address", user.LoginName)
+			continue
+		}
+		for _, notif := range notifs {
+			notif.LoginName = user.LoginName
+			notif.GivenName = user.GivenName
+			notif.Address = user.EMailAddress
+			notif.Time = now
+			result = append(result, notif)
+		}
+	}
+	return result
+}
+
+// Takes two JSON-encoded lists of SSH public keys (as found in
+// core.FieldChange) and returns all keys that only appear in the second one.
+// Changes to the metadata of existing keys are ignored.
+func addedSSHPublicKeys(oldValue, newValue string) (result []string) {
+	var oldList, newList []core.SSHKey
+	//a field that does not exist on one side has an empty value there
+	if oldValue != "" {
+		_ = json.Unmarshal([]byte(oldValue), &oldList)
+	}
+	if newValue != "" {
+		_ = json.Unmarshal([]byte(newValue), &newList)
+	}
+
+	isOld := make(map[string]bool, len(oldList))
+	for _, entry := range oldList {
+		isOld[entry.Key] = true
+	}
+	for _, entry := range newList {
+		if !isOld[entry.Key] {
+			result = append(result, entry.Key)
+		}
+	}
+	return result
+}
+
+func (n *Notifier) deliver(ctx context.Context, notif notification) {
+	msg, err := renderMessage(n.cfg.From, notif)
+	if err != nil {
+		logg.Error("cannot render %s notification for user %q: %s", notif.Event, notif.LoginName, err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := n.send(notif.Address, msg)
+		if err == nil {
+			logg.Info("sent %s notification to user %q", notif.Event, notif.LoginName)
+			return
+		}
+		if attempt >= len(n.retryDelays) {
+			logg.Error("giving up on sending %s notification to user %q: %s", notif.Event, notif.LoginName, err.Error())
+			return
+		}
+		logg.Error("cannot send %s notification to user %q (will retry): %s", notif.Event, notif.LoginName, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(n.retryDelays[attempt]):
+		}
+	}
+}
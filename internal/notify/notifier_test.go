@@ -0,0 +1,366 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+const newSSHKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG9BEla4w3y4Rs648Twr/pBm8L1lxUtZc6jG3fC0KKUY mallory@evil"
+
+func TestParseEvents(t *testing.T) {
+	events, err := ParseEvents("password_changed, ssh_key_added,")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "events", events, map[Event]bool{PasswordChanged: true, SSHKeyAdded: true})
+
+	_, err = ParseEvents("password_changed,totp_reset")
+	assert.DeepEqual(t, "error for unknown event", err.Error(),
+		`malformed value for PORTUNUS_SERVER_NOTIFICATION_EVENTS: unknown event type "totp_reset"`)
+}
+
+// A mail server double that fails the first delivery attempt for each
+// recipient, to exercise the retry logic.
+type mailSenderDouble struct {
+	mutex      sync.Mutex
+	hasFailed  map[string]bool
+	deliveries map[string][]string
+	delivered  chan struct{}
+}
+
+func (d *mailSenderDouble) Send(to string, msg []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.hasFailed[to] {
+		d.hasFailed[to] = true
+		return errors.New("421 service not available")
+	}
+	d.deliveries[to] = append(d.deliveries[to], string(msg))
+	d.delivered <- struct{}{}
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", EMailAddress: "jane@example.org", PasswordHash: "x"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", EMailAddress: "john@example.org", PasswordHash: "x", SSHPublicKeys: []core.SSHKey{{Key: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO9eJnuOMkHmHC+X48YkjiFA4pGPGlfHlcemJcOAojuW john@old"}}},
+			{LoginName: "jim", GivenName: "Jim", FamilyName: "Doe", PasswordHash: "x"},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	sender := &mailSenderDouble{
+		hasFailed:  make(map[string]bool),
+		deliveries: make(map[string][]string),
+		delivered:  make(chan struct{}, 10),
+	}
+	cfg := Config{From: "Portunus <portunus@example.org>", Events: map[Event]bool{PasswordChanged: true, SSHKeyAdded: true}}
+	notifier := NewNotifier(cfg)
+	notifier.send = sender.Send
+	notifier.retryDelays = []time.Duration{time.Millisecond}
+	notifier.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//this is what Run() does, but we need to be sure that the listener has
+	//observed the initial database before making changes
+	nexus.AddListener(ctx, notifier.handleDatabase)
+	go notifier.processQueue(ctx)
+
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet {
+		for idx, user := range db.Users {
+			switch user.LoginName {
+			case "jane":
+				//notified: password change
+				db.Users[idx].PasswordHash = "y"
+			case "john":
+				//notified: new SSH key (but not the existing one, even though it was hidden), but not the irrelevant change
+				user.SSHPublicKeys[0].Hidden = true
+				db.Users[idx].SSHPublicKeys = append(user.SSHPublicKeys, core.SSHKey{Key: newSSHKey, Comment: "laptop"})
+				db.Users[idx].GivenName = "Johnny"
+			case "jim":
+				//not notified: user without email address
+				db.Users[idx].PasswordHash = "y"
+			}
+		}
+		//not notified: new users
+		db.Users = append(db.Users, core.User{LoginName: "joe", GivenName: "Joe", FamilyName: "Doe", EMailAddress: "joe@example.org", PasswordHash: "x"})
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	for range []int{1, 2} {
+		select {
+		case <-sender.delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout while waiting for notifications")
+		}
+	}
+	cancel()
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	assert.DeepEqual(t, "recipients", len(sender.deliveries), 2)
+	assert.DeepEqual(t, "mail to jane", sender.deliveries["jane@example.org"], []string{strings.ReplaceAll(strings.TrimPrefix(`
+From: Portunus <portunus@example.org>
+To: <jane@example.org>
+Subject: Your password was changed
+Date: Fri, 01 Mar 2024 12:00:00 +0000
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+Hello Jane,
+
+the password of your account "jane" was changed on 2024-03-01 12:00 UTC.
+
+If you made this change yourself, you can ignore this message. Otherwise,
+please contact your administrator immediately, since someone else might have
+access to your account.
+
+--
+This message was sent automatically by Portunus.
+`, "\n"), "\n", "\r\n")})
+
+	johnMails := sender.deliveries["john@example.org"]
+	assert.DeepEqual(t, "number of mails to john", len(johnMails), 1)
+	if !strings.Contains(johnMails[0], "\r\n    "+newSSHKey+"\r\n") {
+		t.Errorf("mail to john does not contain the new SSH key: %s", johnMails[0])
+	}
+}
+
+func expectNoErrors(t *testing.T, errs errext.ErrorSet) {
+	t.Helper()
+	for _, err := range errs {
+		t.Error(err.Error())
+	}
+}
+
+func TestNotifyNewDevice(t *testing.T) {
+	sender := &mailSenderDouble{
+		hasFailed:  map[string]bool{"jane@example.org": true, "john@example.org": true},
+		deliveries: make(map[string][]string),
+		delivered:  make(chan struct{}, 10),
+	}
+	jane := core.User{LoginName: "jane", GivenName: "Jane", EMailAddress: "jane@example.org"}
+	john := core.User{LoginName: "john", GivenName: "John", EMailAddress: "john@example.org"}
+	jim := core.User{LoginName: "jim", GivenName: "Jim"}
+	login := LoginDetails{DeviceName: "Firefox on Linux", RemoteAddr: "192.0.2.1:43210"}
+
+	//with the event disabled, only logins that need to be confirmed are notified
+	notifier := NewNotifier(Config{From: "Portunus <portunus@example.org>", Events: map[Event]bool{PasswordChanged: true}})
+	notifier.send = sender.Send
+	notifier.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	notifier.NotifyNewDevice(jane, login)
+	loginWithConfirmation := login
+	loginWithConfirmation.ConfirmationURL = "https://portunus.example.org/device-confirmation/abc123"
+	notifier.NotifyNewDevice(john, loginWithConfirmation)
+
+	//with the event enabled, all logins are notified (except for users without email address)
+	notifier.cfg.Events[NewDevice] = true
+	notifier.NotifyNewDevice(jane, login)
+	notifier.NotifyNewDevice(jim, login)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.processQueue(ctx)
+	for range []int{1, 2} {
+		select {
+		case <-sender.delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout while waiting for notifications")
+		}
+	}
+	cancel()
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	assert.DeepEqual(t, "recipients", len(sender.deliveries), 2)
+	assert.DeepEqual(t, "mail to jane", sender.deliveries["jane@example.org"], []string{strings.ReplaceAll(strings.TrimPrefix(`
+From: Portunus <portunus@example.org>
+To: <jane@example.org>
+Subject: New sign-in to your account
+Date: Fri, 01 Mar 2024 12:00:00 +0000
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+Hello Jane,
+
+your account "jane" was used to sign in from a new device on 2024-03-01 12:00 UTC:
+
+    Device: Firefox on Linux
+    IP address: 192.0.2.1:43210
+
+If you made this change yourself, you can ignore this message. Otherwise,
+please contact your administrator immediately, since someone else might have
+access to your account.
+
+--
+This message was sent automatically by Portunus.
+`, "\n"), "\n", "\r\n")})
+
+	johnMails := sender.deliveries["john@example.org"]
+	assert.DeepEqual(t, "number of mails to john", len(johnMails), 1)
+	if !strings.Contains(johnMails[0], "\r\n    "+loginWithConfirmation.ConfirmationURL+"\r\n") {
+		t.Errorf("mail to john does not contain the confirmation URL: %s", johnMails[0])
+	}
+}
+
+func TestNotifyElevation(t *testing.T) {
+	sender := &mailSenderDouble{
+		hasFailed:  map[string]bool{"jane@example.org": true, "alice@example.org": true},
+		deliveries: make(map[string][]string),
+		delivered:  make(chan struct{}, 10),
+	}
+	notifier := NewNotifier(Config{From: "Portunus <portunus@example.org>", Events: map[Event]bool{Elevation: true}})
+	notifier.send = sender.Send
+	notifier.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	//all recipients with an email address are notified
+	notifier.NotifyElevation(core.ElevationEvent{
+		Kind: core.ElevationApproved,
+		Elevation: core.Elevation{
+			LoginName:     "jane",
+			GroupName:     "oncall",
+			Hours:         4,
+			Justification: "incident #42",
+			RequestedBy:   "jane",
+			ApprovedBy:    []string{"alice"},
+			State:         core.ElevationActive,
+			ExpiresAt:     time.Date(2024, 3, 1, 16, 0, 0, 0, time.UTC),
+		},
+		Actor: "alice",
+		Recipients: []core.User{
+			{LoginName: "alice", GivenName: "Alice", EMailAddress: "alice@example.org"},
+			{LoginName: "bob", GivenName: "Bob"},
+			{LoginName: "jane", GivenName: "Jane", EMailAddress: "jane@example.org"},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.processQueue(ctx)
+	for range []int{1, 2} {
+		select {
+		case <-sender.delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout while waiting for notifications")
+		}
+	}
+	cancel()
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	assert.DeepEqual(t, "recipients", len(sender.deliveries), 2)
+	assert.DeepEqual(t, "mail to jane", sender.deliveries["jane@example.org"], []string{strings.ReplaceAll(strings.TrimPrefix(`
+From: Portunus <portunus@example.org>
+To: <jane@example.org>
+Subject: Temporary group membership approved
+Date: Fri, 01 Mar 2024 12:00:00 +0000
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+Hello Jane,
+
+a temporary group membership was approved, and is now in effect:
+
+    User: jane
+    Group: oncall
+    Duration: 4 hour(s)
+    Justification: incident #42
+    Requested by: jane
+    Expires at: 2024-03-01 16:00 UTC
+
+All pending and active elevations are listed on the "Elevations" page in Portunus.
+
+--
+This message was sent automatically by Portunus.
+`, "\n"), "\n", "\r\n")})
+	assert.DeepEqual(t, "number of mails to alice", len(sender.deliveries["alice@example.org"]), 1)
+}
+
+func TestNotifySeedFight(t *testing.T) {
+	sender := &mailSenderDouble{
+		hasFailed:  map[string]bool{"alice@example.org": true},
+		deliveries: make(map[string][]string),
+		delivered:  make(chan struct{}, 10),
+	}
+	notifier := NewNotifier(Config{From: "Portunus <portunus@example.org>", Events: map[Event]bool{SeedFight: true}})
+	notifier.send = sender.Send
+	notifier.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	object := core.ObjectRef{Type: "user", Name: "jane"}
+	notifier.NotifySeedFight(core.SeedFight{
+		Object:      object,
+		Corrections: 6,
+		Window:      time.Hour,
+		LastCorrection: core.SeedCorrection{
+			Object: object,
+			Field:  "email",
+			Actor:  "cronjob",
+			Time:   time.Date(2024, 3, 1, 11, 59, 0, 0, time.UTC),
+		},
+		Recipients: []core.User{
+			{LoginName: "alice", GivenName: "Alice", EMailAddress: "alice@example.org"},
+			{LoginName: "bob", GivenName: "Bob"},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.processQueue(ctx)
+	select {
+	case <-sender.delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for notifications")
+	}
+	cancel()
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	assert.DeepEqual(t, "recipients", len(sender.deliveries), 1)
+	assert.DeepEqual(t, "mail to alice", sender.deliveries["alice@example.org"], []string{strings.ReplaceAll(strings.TrimPrefix(`
+From: Portunus <portunus@example.org>
+To: <alice@example.org>
+Subject: Changes keep getting reverted by the seed
+Date: Fri, 01 Mar 2024 12:00:00 +0000
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+Hello Alice,
+
+the seed had to revert changes to the following object 6 times within 1h0m0s:
+
+    Object: user "jane"
+    Last correction: seed reverted field "email" on user "jane"
+    Last changed by: cronjob
+
+Something (e.g. a script or another admin) is probably fighting against the
+seed. Changes to seeded fields need to be made in the seed file instead.
+
+All recent corrections are listed on the "Seed corrections" page in Portunus.
+
+--
+This message was sent automatically by Portunus.
+`, "\n"), "\n", "\r\n")})
+}
@@ -0,0 +1,117 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package oidc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// Config contains the configuration for the OpenID Connect provider.
+type Config struct {
+	//The issuer URL, e.g. "https://portunus.example.com". All endpoints are
+	//located below this URL.
+	Issuer  string
+	Clients []Client
+}
+
+// Client is a relying party that is allowed to authenticate users through
+// Portunus. Clients are registered statically in the file referenced by
+// PORTUNUS_SERVER_OIDC_CLIENTS.
+type Client struct {
+	ID string `json:"id"`
+	//Public clients (e.g. single-page apps) do not have a secret. Since PKCE is
+	//required for all clients, they can still use the authorization code flow.
+	Secret       core.StringSeed `json:"secret"`
+	RedirectURIs []string        `json:"redirect_uris"`
+}
+
+// ReadConfigFromEnvironment reads the configuration for the OpenID Connect
+// provider from the environment. If the provider is not enabled (i.e.
+// PORTUNUS_SERVER_OIDC_ISSUER is not set), nil is returned.
+func ReadConfigFromEnvironment() (*Config, error) {
+	issuer := os.Getenv("PORTUNUS_SERVER_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientsPath := os.Getenv("PORTUNUS_SERVER_OIDC_CLIENTS")
+	if clientsPath == "" {
+		return nil, errors.New("PORTUNUS_SERVER_OIDC_CLIENTS must be set when PORTUNUS_SERVER_OIDC_ISSUER is set")
+	}
+	buf, err := os.ReadFile(clientsPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{Issuer: strings.TrimSuffix(issuer, "/")}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", clientsPath, err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg Config) validate() error {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("malformed value for PORTUNUS_SERVER_OIDC_ISSUER: %q (expected an URL like \"https://portunus.example.com\")", cfg.Issuer)
+	}
+
+	isClientID := make(map[string]bool)
+	for idx, client := range cfg.Clients {
+		if client.ID == "" {
+			return fmt.Errorf("OIDC client #%d has no ID", idx+1)
+		}
+		if isClientID[client.ID] {
+			return fmt.Errorf("OIDC client ID %q is used more than once", client.ID)
+		}
+		isClientID[client.ID] = true
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("OIDC client %q has no redirect URIs", client.ID)
+		}
+		for _, uri := range client.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return fmt.Errorf("OIDC client %q has malformed redirect URI %q (expected an absolute URL without fragment)", client.ID, uri)
+			}
+		}
+	}
+	return nil
+}
+
+// Finds the client with the given ID.
+func (cfg Config) findClient(id string) (Client, bool) {
+	for _, client := range cfg.Clients {
+		if client.ID == id {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
+
+// Returns whether the given redirect URI is registered for this client. As
+// required by the OAuth 2.0 Security BCP, this uses exact string matching.
+func (c Client) hasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+// The size of newly generated signing keys, in bits.
+const signingKeySize = 2048
+
+// LoadOrGenerateSigningKey reads the RSA key that ID tokens are signed with
+// from the given path. If the file does not exist yet, a new key is generated
+// and written to it, so that tokens stay verifiable across restarts.
+func LoadOrGenerateSigningKey(path string) (*rsa.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("while reading %s: expected a PEM block of type \"PRIVATE KEY\"", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %w", path, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("while reading %s: expected an RSA key", path)
+		}
+		return rsaKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	logging.Info(nil, "generating new OIDC signing key")
+	key, err := rsa.GenerateKey(rand.Reader, signingKeySize)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return key, os.WriteFile(path, buf, 0600)
+}
+
+// Returns the key ID under which the given key is published in the JWKS.
+func keyIDOf(key *rsa.PublicKey) string {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey(key))
+	return base64.RawURLEncoding.EncodeToString(hash[:8])
+}
+
+// jsonWebKey is a public key in the format of RFC 7517.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+func renderJSONWebKey(key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     keyIDOf(key),
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// Renders and signs a JWT with the given claims, using the RS256 algorithm.
+func signJWT(key *rsa.PrivateKey, claims any) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyIDOf(&key.PublicKey)}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	hash := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
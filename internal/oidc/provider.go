@@ -0,0 +1,439 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package oidc
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/logging"
+)
+
+const (
+	//Authorization codes are redeemed by the relying party right after the
+	//redirect, so they do not need to live long.
+	codeLifetime = time.Minute
+	//Access tokens are only good for the userinfo endpoint. There are no
+	//refresh tokens yet, so relying parties need to send the user through
+	///oidc/authorize again after this time.
+	tokenLifetime = time.Hour
+)
+
+// Provider is an OpenID Connect provider that implements the authorization
+// code flow with PKCE for the users in the Nexus. The authorization endpoint
+// needs the login session of the user, so it is implemented in the frontend
+// package on top of ParseAuthorizationRequest() and IssueCode(). All other
+// endpoints are served by the methods of this type.
+type Provider struct {
+	cfg   Config
+	key   *rsa.PrivateKey
+	nexus core.Nexus
+
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex        sync.Mutex
+	codes        map[string]authorizationCode
+	accessTokens map[string]accessToken
+}
+
+type authorizationCode struct {
+	Request   AuthorizationRequest
+	LoginName string
+	ExpiresAt time.Time
+}
+
+type accessToken struct {
+	ClientID  string
+	LoginName string
+	ExpiresAt time.Time
+}
+
+// NewProvider initializes a Provider. The given key is used to sign ID tokens
+// (see LoadOrGenerateSigningKey).
+func NewProvider(cfg Config, key *rsa.PrivateKey, nexus core.Nexus) *Provider {
+	return &Provider{
+		cfg:          cfg,
+		key:          key,
+		nexus:        nexus,
+		codes:        make(map[string]authorizationCode),
+		accessTokens: make(map[string]accessToken),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// authorization endpoint
+
+// AuthorizationRequest is a validated request to the authorization endpoint.
+type AuthorizationRequest struct {
+	ClientID      string
+	RedirectURI   string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+// AuthorizationError is returned by ParseAuthorizationRequest().
+type AuthorizationError struct {
+	//One of the error codes from RFC 6749, section 4.1.2.1.
+	Code        string
+	Description string
+	//If empty, the client or redirect URI could not be verified, so the error
+	//must be shown to the user instead of being sent to the relying party.
+	RedirectURI string
+	State       string
+}
+
+// Error implements the builtin/error interface.
+func (e AuthorizationError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// RedirectURL returns the URL that reports this error to the relying party.
+func (e AuthorizationError) RedirectURL() string {
+	return buildRedirectURL(e.RedirectURI, url.Values{
+		"error":             {e.Code},
+		"error_description": {e.Description},
+	}, e.State)
+}
+
+// ParseAuthorizationRequest validates the query parameters of a request to
+// the authorization endpoint. Errors are of type AuthorizationError.
+func (p *Provider) ParseAuthorizationRequest(query url.Values) (AuthorizationRequest, error) {
+	fail := func(code, description string) (AuthorizationRequest, error) {
+		return AuthorizationRequest{}, AuthorizationError{Code: code, Description: description}
+	}
+
+	client, exists := p.cfg.findClient(query.Get("client_id"))
+	if !exists {
+		return fail("invalid_request", "unknown client_id")
+	}
+	req := AuthorizationRequest{
+		ClientID:      client.ID,
+		RedirectURI:   query.Get("redirect_uri"),
+		State:         query.Get("state"),
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: query.Get("code_challenge"),
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.hasRedirectURI(req.RedirectURI) {
+		return fail("invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	//from here on, errors can be reported to the relying party
+	fail = func(code, description string) (AuthorizationRequest, error) {
+		return AuthorizationRequest{}, AuthorizationError{code, description, req.RedirectURI, req.State}
+	}
+	switch {
+	case query.Get("response_type") != "code":
+		return fail("unsupported_response_type", `only response_type "code" is supported`)
+	case !hasScope(query.Get("scope"), "openid"):
+		return fail("invalid_scope", `scope must include "openid"`)
+	case req.CodeChallenge == "" || query.Get("code_challenge_method") != "S256":
+		return fail("invalid_request", `PKCE with code_challenge_method "S256" is required`)
+	}
+	return req, nil
+}
+
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueCode generates an authorization code for the given request on behalf
+// of the given user, and returns the URL that the user shall be redirected to.
+func (p *Provider) IssueCode(req AuthorizationRequest, loginName string) string {
+	code := generateToken()
+	now := time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for c, info := range p.codes {
+		if now.After(info.ExpiresAt) {
+			delete(p.codes, c)
+		}
+	}
+	p.codes[code] = authorizationCode{req, loginName, now.Add(codeLifetime)}
+
+	logging.Info(logging.Fields{"login_name": loginName, "client_id": req.ClientID}, "issued OIDC authorization code")
+	return buildRedirectURL(req.RedirectURI, url.Values{"code": {code}}, req.State)
+}
+
+func buildRedirectURL(redirectURI string, query url.Values, state string) string {
+	if state != "" {
+		query.Set("state", state)
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		//cannot happen since redirect URIs are validated in Config.validate()
+		panic(err.Error())
+	}
+	//parameters from the registered redirect URI are retained
+	q := u.Query()
+	for key, values := range query {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// token endpoint
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+// Claims contains the claims about a user that appear in ID tokens and in
+// responses from the userinfo endpoint.
+type Claims struct {
+	Subject           string   `json:"sub"`
+	Name              string   `json:"name"`
+	GivenName         string   `json:"given_name,omitempty"`
+	FamilyName        string   `json:"family_name,omitempty"`
+	PreferredUsername string   `json:"preferred_username"`
+	EMailAddress      string   `json:"email,omitempty"`
+	Groups            []string `json:"groups"`
+}
+
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce,omitempty"`
+	Claims
+}
+
+// ServeToken handles POST /oidc/token. Since the relying party calls this
+// endpoint directly, it must be exempt from CSRF protection.
+func (p *Provider) ServeToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	err := r.ParseForm()
+	if err != nil {
+		respondWithTokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		respondWithTokenError(w, http.StatusBadRequest, "unsupported_grant_type", `only grant_type "authorization_code" is supported`)
+		return
+	}
+
+	//authenticate the client (public clients only need to send their ID)
+	clientID, clientSecret, hasBasicAuth := r.BasicAuth()
+	if hasBasicAuth {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	client, exists := p.cfg.findClient(clientID)
+	if !exists || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.Secret)) != 1 {
+		logging.Info(logging.Fields{"client_id": clientID, "remote_addr": core.ClientIPOf(r)}, "OIDC client authentication failed")
+		respondWithTokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	//codes can only be redeemed once, even if the redemption fails
+	p.mutex.Lock()
+	code, exists := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+	now := time.Now()
+	switch {
+	case !exists || now.After(code.ExpiresAt) || code.Request.ClientID != client.ID:
+		respondWithTokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired authorization code")
+		return
+	case r.PostForm.Get("redirect_uri") != code.Request.RedirectURI:
+		respondWithTokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	case !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.Request.CodeChallenge):
+		respondWithTokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+
+	//the user may have been deleted or may have expired since the code was issued
+	claims, ok := p.findClaims(code.LoginName, now)
+	if !ok {
+		respondWithTokenError(w, http.StatusBadRequest, "invalid_grant", "user account does not exist anymore")
+		return
+	}
+	idToken, err := signJWT(p.key, idTokenClaims{
+		Issuer:    p.cfg.Issuer,
+		Audience:  client.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenLifetime).Unix(),
+		Nonce:     code.Request.Nonce,
+		Claims:    claims,
+	})
+	if err != nil {
+		respondWithTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	token := generateToken()
+	p.mutex.Lock()
+	for t, info := range p.accessTokens {
+		if now.After(info.ExpiresAt) {
+			delete(p.accessTokens, t)
+		}
+	}
+	p.accessTokens[token] = accessToken{client.ID, code.LoginName, now.Add(tokenLifetime)}
+	p.mutex.Unlock()
+
+	logging.Info(logging.Fields{"login_name": code.LoginName, "client_id": client.ID}, "issued OIDC tokens")
+	respondWithJSON(w, http.StatusOK, tokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(tokenLifetime / time.Second),
+		IDToken:     idToken,
+	})
+}
+
+// Checks a PKCE code verifier against the challenge from the authorization
+// request, as per RFC 7636, section 4.6.
+func verifyCodeChallenge(verifier, challenge string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func respondWithTokenError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="portunus"`)
+	}
+	respondWithJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// userinfo endpoint
+
+// ServeUserInfo handles GET and POST /oidc/userinfo.
+func (p *Provider) ServeUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	now := time.Now()
+
+	p.mutex.Lock()
+	info, exists := p.accessTokens[token]
+	p.mutex.Unlock()
+
+	var claims Claims
+	ok := exists && !now.After(info.ExpiresAt)
+	if ok {
+		claims, ok = p.findClaims(info.LoginName, now)
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		respondWithJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, claims)
+}
+
+// Collects the claims for the given user. False is returned if the user does
+// not exist (anymore) or has expired.
+func (p *Provider) findClaims(loginName string, now time.Time) (Claims, bool) {
+	user, exists := p.nexus.FindUser(func(u core.User) bool { return u.LoginName == loginName })
+	if !exists || user.IsExpiredAt(now) {
+		return Claims{}, false
+	}
+	groupNames := make([]string, len(user.GroupMemberships))
+	for idx, group := range user.GroupMemberships {
+		groupNames[idx] = group.Name
+	}
+	return Claims{
+		Subject:           user.ID,
+		Name:              user.FullName(),
+		GivenName:         user.GivenName,
+		FamilyName:        user.FamilyName,
+		PreferredUsername: user.LoginName,
+		EMailAddress:      user.EMailAddress,
+		Groups:            groupNames,
+	}, true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// discovery
+
+type discoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// ServeDiscovery handles GET /.well-known/openid-configuration.
+func (p *Provider) ServeDiscovery(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, discoveryDocument{
+		Issuer:                            p.cfg.Issuer,
+		AuthorizationEndpoint:             p.cfg.Issuer + "/oidc/authorize",
+		TokenEndpoint:                     p.cfg.Issuer + "/oidc/token",
+		UserinfoEndpoint:                  p.cfg.Issuer + "/oidc/userinfo",
+		JWKSURI:                           p.cfg.Issuer + "/oidc/jwks",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   []string{"openid", "profile", "email", "groups"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "name", "given_name", "family_name", "preferred_username", "email", "groups"},
+	})
+}
+
+// ServeJWKS handles GET /oidc/jwks.
+func (p *Provider) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string][]jsonWebKey{
+		"keys": {renderJSONWebKey(&p.key.PublicKey)},
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helper functions
+
+func generateToken() string {
+	return hex.EncodeToString(core.GenerateRandomKey(32))
+}
+
+func respondWithJSON(w http.ResponseWriter, status int, data any) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(buf, '\n'))
+}
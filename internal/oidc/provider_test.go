@@ -0,0 +1,219 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/must"
+)
+
+func setupProvider(t *testing.T) *Provider {
+	t.Helper()
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{ID: "3f2a9c1e7b6d4e0f8a5c2b1d9e7f6a4c", LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", EMailAddress: "jane@example.org", PasswordHash: "x"},
+		}
+		db.Groups = []core.Group{
+			{Name: "wiki-editors", LongName: "Wiki Editors", MemberLoginNames: core.GroupMemberNames{"jane": true}},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	cfg := Config{
+		Issuer: "https://portunus.example.org",
+		Clients: []Client{
+			{ID: "wiki", Secret: "swordfish", RedirectURIs: []string{"https://wiki.example.org/callback"}},
+			{ID: "spa", RedirectURIs: []string{"https://app.example.org/a", "https://app.example.org/b?x=1"}},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the key is persisted, so the second call must return the same key
+	keyPath := filepath.Join(t.TempDir(), "oidc-signing-key.pem")
+	key := must.Return(LoadOrGenerateSigningKey(keyPath))
+	assert.DeepEqual(t, "reloaded key", must.Return(LoadOrGenerateSigningKey(keyPath)).Equal(key), true)
+	return NewProvider(cfg, key, nexus)
+}
+
+func TestAuthorizationRequestErrors(t *testing.T) {
+	p := setupProvider(t)
+	valid := url.Values{
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.example.org/b?x=1"},
+		"response_type":         {"code"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"code_challenge":        {"abc"},
+		"code_challenge_method": {"S256"},
+	}
+	testCases := []struct {
+		Key, Value  string
+		Code        string
+		RedirectURL string
+	}{
+		{"client_id", "unknown", "invalid_request", ""},
+		{"redirect_uri", "https://evil.example.com/", "invalid_request", ""},
+		{"response_type", "token", "unsupported_response_type", "https://app.example.org/b?error=unsupported_response_type&error_description=only+response_type+%22code%22+is+supported&state=xyz&x=1"},
+		{"scope", "email", "invalid_scope", "https://app.example.org/b?error=invalid_scope&error_description=scope+must+include+%22openid%22&state=xyz&x=1"},
+		{"code_challenge_method", "plain", "invalid_request", "https://app.example.org/b?error=invalid_request&error_description=PKCE+with+code_challenge_method+%22S256%22+is+required&state=xyz&x=1"},
+	}
+	for _, tc := range testCases {
+		query := url.Values{}
+		for k, v := range valid {
+			query[k] = v
+		}
+		query.Set(tc.Key, tc.Value)
+		_, err := p.ParseAuthorizationRequest(query)
+		aerr, ok := err.(AuthorizationError)
+		if !ok {
+			t.Errorf("expected AuthorizationError for %s=%q, but got %#v", tc.Key, tc.Value, err)
+			continue
+		}
+		assert.DeepEqual(t, "error code for "+tc.Key, aerr.Code, tc.Code)
+		if tc.RedirectURL == "" {
+			assert.DeepEqual(t, "redirect URI for "+tc.Key, aerr.RedirectURI, "")
+		} else {
+			assert.DeepEqual(t, "redirect URL for "+tc.Key, aerr.RedirectURL(), tc.RedirectURL)
+		}
+	}
+
+	//the redirect URI may be omitted only if there is just one
+	req, err := p.ParseAuthorizationRequest(url.Values{
+		"client_id":             {"wiki"},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {"abc"},
+		"code_challenge_method": {"S256"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "default redirect URI", req.RedirectURI, "https://wiki.example.org/callback")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	p := setupProvider(t)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challengeHash := sha256.Sum256([]byte(verifier))
+
+	req, err := p.ParseAuthorizationRequest(url.Values{
+		"client_id":             {"wiki"},
+		"redirect_uri":          {"https://wiki.example.org/callback"},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile email groups"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challengeHash[:])},
+		"code_challenge_method": {"S256"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	redirectURL := must.Return(url.Parse(p.IssueCode(req, "jane")))
+	assert.DeepEqual(t, "redirect target", redirectURL.Host+redirectURL.Path, "wiki.example.org/callback")
+	assert.DeepEqual(t, "state", redirectURL.Query().Get("state"), "xyz")
+	code := redirectURL.Query().Get("code")
+
+	redeem := func(clientSecret, codeVerifier string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://wiki.example.org/callback"},
+			"code_verifier": {codeVerifier},
+		}
+		r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("wiki", clientSecret)
+		w := httptest.NewRecorder()
+		p.ServeToken(w, r)
+		return w
+	}
+
+	//a wrong client secret does not consume the code, but a wrong verifier does
+	assert.DeepEqual(t, "status with wrong secret", redeem("tuna", verifier).Code, http.StatusUnauthorized)
+	w := redeem("swordfish", verifier)
+	assert.DeepEqual(t, "status of token request", w.Code, http.StatusOK)
+	assert.DeepEqual(t, "status of repeated token request", redeem("swordfish", verifier).Code, http.StatusBadRequest)
+
+	var resp tokenResponse
+	must.Succeed(json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.DeepEqual(t, "token type", resp.TokenType, "Bearer")
+
+	var claims idTokenClaims
+	verifyJWT(t, &p.key.PublicKey, resp.IDToken, &claims)
+	expectedClaims := Claims{
+		Subject:           "3f2a9c1e7b6d4e0f8a5c2b1d9e7f6a4c",
+		Name:              "Jane Doe",
+		GivenName:         "Jane",
+		FamilyName:        "Doe",
+		PreferredUsername: "jane",
+		EMailAddress:      "jane@example.org",
+		Groups:            []string{"wiki-editors"},
+	}
+	assert.DeepEqual(t, "ID token claims", claims.Claims, expectedClaims)
+	assert.DeepEqual(t, "ID token issuer", claims.Issuer, "https://portunus.example.org")
+	assert.DeepEqual(t, "ID token audience", claims.Audience, "wiki")
+	assert.DeepEqual(t, "ID token nonce", claims.Nonce, "n-0S6_WzA2Mj")
+
+	//the access token works on the userinfo endpoint
+	r := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	w = httptest.NewRecorder()
+	p.ServeUserInfo(w, r)
+	assert.DeepEqual(t, "status of userinfo request", w.Code, http.StatusOK)
+	var userinfo Claims
+	must.Succeed(json.Unmarshal(w.Body.Bytes(), &userinfo))
+	assert.DeepEqual(t, "userinfo", userinfo, expectedClaims)
+
+	r = httptest.NewRequest(http.MethodGet, "/oidc/userinfo", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+resp.AccessToken+"x")
+	w = httptest.NewRecorder()
+	p.ServeUserInfo(w, r)
+	assert.DeepEqual(t, "status of userinfo request with wrong token", w.Code, http.StatusUnauthorized)
+
+	//a code redeemed with the wrong verifier cannot be retried
+	code = must.Return(url.Parse(p.IssueCode(req, "jane"))).Query().Get("code")
+	assert.DeepEqual(t, "status with wrong verifier", redeem("swordfish", verifier+"x").Code, http.StatusBadRequest)
+	assert.DeepEqual(t, "status with correct verifier afterwards", redeem("swordfish", verifier).Code, http.StatusBadRequest)
+}
+
+// Checks the signature of a JWT created by signJWT() and unmarshals its claims.
+func verifyJWT(t *testing.T, key *rsa.PublicKey, token string, claims any) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT: %q", token)
+	}
+	var header map[string]string
+	must.Succeed(json.Unmarshal(must.Return(base64.RawURLEncoding.DecodeString(parts[0])), &header))
+	assert.DeepEqual(t, "JWT header", header, map[string]string{"alg": "RS256", "typ": "JWT", "kid": renderJSONWebKey(key).KeyID})
+
+	signature := must.Return(base64.RawURLEncoding.DecodeString(parts[2]))
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	must.Succeed(rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature))
+	must.Succeed(json.Unmarshal(must.Return(base64.RawURLEncoding.DecodeString(parts[1])), claims))
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// ActivityLog is a core.ActivityLog that persists group membership changes
+// into its own file in the state directory, separately from the database. For
+// each group, only the most recent changes are kept.
+type ActivityLog struct {
+	path  string
+	limit int //per group
+	//The mutex guards access to all fields listed below it.
+	mutex   sync.RWMutex
+	changes []core.MembershipChange //oldest first
+}
+
+// persistedActivityLog is what gets persisted into the activity log file.
+type persistedActivityLog struct {
+	MembershipChanges []core.MembershipChange `json:"membership_changes"`
+}
+
+// NewActivityLog loads the activity log from the given path. If the file does
+// not exist yet, an empty activity log is returned.
+func NewActivityLog(path string, limit int) (*ActivityLog, error) {
+	l := &ActivityLog{path: path, limit: limit}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+
+	var pal persistedActivityLog
+	err = json.Unmarshal(buf, &pal)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse activity log in %s: %w", path, err)
+	}
+	l.changes = pal.MembershipChanges
+	//the limit might have been lowered since the file was written
+	l.truncate()
+	return l, nil
+}
+
+// Record adds the given changes to the activity log. This is intended to be
+// used as a callback for core.Nexus.AddActivityListener(). Errors while
+// writing the file are logged, but not fatal: The changes are still held in
+// memory, and will be written together with the next batch.
+func (l *ActivityLog) Record(changes []core.MembershipChange) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.changes = append(l.changes, changes...)
+	l.truncate()
+	err := l.write()
+	if err != nil {
+		logg.Error("cannot write activity log to %s: %s", l.path, err.Error())
+	}
+}
+
+// ListForGroup implements the core.ActivityLog interface.
+func (l *ActivityLog) ListForGroup(groupName string) []core.MembershipChange {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	var result []core.MembershipChange
+	for idx := len(l.changes) - 1; idx >= 0; idx-- {
+		if l.changes[idx].GroupName == groupName {
+			result = append(result, l.changes[idx])
+		}
+	}
+	return result
+}
+
+// Drops the oldest changes for each group that has more than `l.limit` changes.
+func (l *ActivityLog) truncate() {
+	countByGroup := make(map[string]int)
+	isKept := make([]bool, len(l.changes))
+	for idx := len(l.changes) - 1; idx >= 0; idx-- {
+		groupName := l.changes[idx].GroupName
+		countByGroup[groupName]++
+		isKept[idx] = countByGroup[groupName] <= l.limit
+	}
+
+	kept := l.changes[:0]
+	for idx, change := range l.changes {
+		if isKept[idx] {
+			kept = append(kept, change)
+		}
+	}
+	l.changes = kept
+}
+
+func (l *ActivityLog) write() error {
+	buf, err := json.MarshalIndent(persistedActivityLog{l.changes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	//write atomically, same as for the database file
+	tmpPath := filepath.Join(
+		filepath.Dir(l.path),
+		fmt.Sprintf(".%s.%d", filepath.Base(l.path), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, buf, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
@@ -0,0 +1,64 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestActivityLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "activity.json")
+	activityLog := must.Return(NewActivityLog(path, 2))
+	assert.DeepEqual(t, "initial contents", len(activityLog.ListForGroup("staff")), 0)
+
+	baseTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	change := func(minutes int, groupName, loginName string, kind core.MembershipChangeKind) core.MembershipChange {
+		return core.MembershipChange{
+			GroupName: groupName,
+			LoginName: loginName,
+			Kind:      kind,
+			Actor:     "admin",
+			Time:      baseTime.Add(time.Duration(minutes) * time.Minute),
+		}
+	}
+	activityLog.Record([]core.MembershipChange{
+		change(1, "staff", "jane", core.MemberAdded),
+		change(1, "admins", "jane", core.MemberAdded),
+	})
+	activityLog.Record([]core.MembershipChange{
+		change(2, "staff", "john", core.MemberAdded),
+	})
+	//with a limit of 2 per group, this pushes out the oldest change of "staff", but not the one of "admins"
+	activityLog.Record([]core.MembershipChange{
+		change(3, "staff", "jane", core.MemberRemoved),
+	})
+
+	expectedStaff := []core.MembershipChange{
+		change(3, "staff", "jane", core.MemberRemoved),
+		change(2, "staff", "john", core.MemberAdded),
+	}
+	expectedAdmins := []core.MembershipChange{
+		change(1, "admins", "jane", core.MemberAdded),
+	}
+	assert.DeepEqual(t, "changes for staff", activityLog.ListForGroup("staff"), expectedStaff)
+	assert.DeepEqual(t, "changes for admins", activityLog.ListForGroup("admins"), expectedAdmins)
+
+	//contents survive reloading from disk
+	activityLog = must.Return(NewActivityLog(path, 2))
+	assert.DeepEqual(t, "changes for staff after reload", activityLog.ListForGroup("staff"), expectedStaff)
+	assert.DeepEqual(t, "changes for admins after reload", activityLog.ListForGroup("admins"), expectedAdmins)
+
+	//when the limit is lowered, old entries get dropped on load
+	activityLog = must.Return(NewActivityLog(path, 1))
+	assert.DeepEqual(t, "changes for staff with lower limit", activityLog.ListForGroup("staff"), expectedStaff[:1])
+}
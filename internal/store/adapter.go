@@ -10,196 +10,318 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
 )
 
-// Adapter translates between the Portunus database and the disk store.
+// Adapter translates between the Portunus database and the Store.
 type Adapter struct {
-	//NOTE: No mutex here. All FS access is done by the goroutine that calls
+	//NOTE: No mutex here. All store access is done by the goroutine that calls
 	//Run(), so we don't have any concurrency to deal with.
-	nexus     core.Nexus
-	storePath string
-	//This contains the known contents of the store file. We maintain this to
-	//avoid useless roundtrip writes from disk -> nexus -> disk.
-	diskState []byte
+	nexus core.Nexus
+	store Store
+	//This contains the database as it was last loaded from or saved into the
+	//store. It is used as the base when merging external edits.
+	stored core.Database
 	//This is set when we signal ErrDatabaseNeedsInitialization to the nexus, to
 	//instruct Run() to wait for the response before continuing.
 	initPending bool
+	//If writing the database failed, this contains the database that still
+	//needs to be written. Writes are retried every `writeRetryInterval`.
+	pendingWrite       *core.Database
+	writeRetryInterval time.Duration
+	//These are the only fields that are accessed from other goroutines.
+	health    core.HealthStatus
+	conflicts core.MergeConflictQueue
 }
 
 // NewAdapter initializes an Adapter instance.
-func NewAdapter(nexus core.Nexus, storePath string) *Adapter {
-	return &Adapter{nexus: nexus, storePath: storePath}
+func NewAdapter(nexus core.Nexus, store Store) *Adapter {
+	a := &Adapter{nexus: nexus, store: store, writeRetryInterval: 10 * time.Second}
+	a.health.Report(errors.New("database has not been loaded from the store yet"))
+	return a
 }
 
-// Run listens for and propagates changes to the Portunus database and the disk
-// store until `ctx` expires. An error is returned if any write into the LDAP
-// database fails.
+// CheckHealth implements the core.HealthCheck interface.
+func (a *Adapter) CheckHealth() error {
+	return a.health.CheckHealth()
+}
+
+// MergeConflicts returns the queue of conflicts that were found while merging
+// external edits of the store into the in-memory database.
+func (a *Adapter) MergeConflicts() *core.MergeConflictQueue {
+	return &a.conflicts
+}
+
+// Run listens for and propagates changes to the Portunus database and the
+// store until `ctx` expires. An error is returned if watching the store fails.
 func (a *Adapter) Run(ctx context.Context) error {
 	//first read initializes the internal database from the pre-existing store
-	//file (or marks that initialization is required)
-	errs := a.nexus.Update(a.updateNexusByLoadingFromDisk, nil)
+	//(or marks that initialization is required)
+	errs := a.nexus.Update(a.updateNexusByLoadingFromStore, &core.UpdateOptions{SystemInternal: true})
 	if !errs.IsEmpty() {
-		return fmt.Errorf("while loading database from disk store: %s", errs.Join(", "))
+		return fmt.Errorf("while loading database from %s: %s", a.store.String(), errs.Join(", "))
+	}
+	if !a.initPending {
+		a.health.Report(nil)
 	}
 
-	//we need to be able to explicitly cancel the nexus listener to avoid it
-	//deadlocking on `writeChan` not being listened to anymore
+	//we need to be able to explicitly cancel the nexus listener to stop it from
+	//filling the mailbox after we're gone
 	ctxListen, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	//writes get sent to us from whatever goroutine the nexus update is running on
-	writeChan := make(chan core.Database, 1)
-	a.nexus.AddListener(ctxListen, func(db core.Database) {
-		writeChan <- db
-	})
+	//(including our own goroutine when merging external edits, so this must not block)
+	mailbox := newDatabaseMailbox()
+	a.nexus.AddListener(ctxListen, mailbox.Put)
 
 	//if we instructed the nexus to perform first-time initialization, we need to
 	//collect the respective update immediately; otherwise the file watcher setup
-	//will fail on ENOENT
+	//in FileStore will fail on ENOENT
 	if a.initPending {
 		select {
 		case <-ctx.Done():
 			return nil
-		case db := <-writeChan:
-			err := a.writeDatabase(db)
+		case <-mailbox.Ready:
+			db, _ := mailbox.Take()
+			err := a.store.Save(db)
 			if err != nil {
-				return err
+				return fmt.Errorf("cannot write database to %s: %w", a.store.String(), err)
 			}
+			logg.Info("wrote database revision %d to %s", db.Revision, a.store.String())
+			a.stored = db
+			a.health.Report(nil)
 		}
 	}
 
-	//for further reads, we need a file watcher
-	watcher, err := NewWatcher(a.storePath)
-	if err != nil {
-		return err
-	}
+	//for further reads, we need to watch the store
+	changes, watchErrs := a.store.Watch(ctxListen)
+	retryTicker := time.NewTicker(a.writeRetryInterval)
+	defer retryTicker.Stop()
 
-LOOP:
 	for {
 		select {
 		case <-ctx.Done():
-			break LOOP
-		case err := <-watcher.Backend.Errors:
-			return fmt.Errorf("error while watching %s for changes: %w", a.storePath, err)
-		case <-watcher.Backend.Events:
-			//wait for whatever is updating the file to complete
-			time.Sleep(25 * time.Millisecond)
-
-			//load updated version of database from file
-			errs := a.nexus.Update(a.updateNexusByLoadingFromDisk, nil)
-			if !errs.IsEmpty() {
-				return fmt.Errorf("while loading database from disk store: %s", errs.Join(", "))
-			}
-
-			//recreate the watcher (the original file might be gone if it was updated
-			//by an atomic rename like we do in writeStoreFile())
-			err = watcher.WhileSuspended(func() error { return nil })
-			if err != nil {
-				return err
+			return nil
+		case err := <-watchErrs:
+			return err
+		case theirs := <-changes:
+			a.mergeExternalEdit(theirs)
+		case <-mailbox.Ready:
+			db, ok := mailbox.Take()
+			if ok {
+				a.writeDatabase(db)
 			}
-		case db := <-writeChan:
-			//stop the watch while writing, to avoid picking up our own change
-			err = watcher.WhileSuspended(func() error {
-				return a.writeDatabase(db)
-			})
-			if err != nil {
-				return err
+		case <-retryTicker.C:
+			if a.pendingWrite != nil {
+				a.writeDatabase(*a.pendingWrite)
 			}
 		}
 	}
+}
+
+// Errors while writing the database are not fatal. The write will be retried
+// later, and the problem is reported through CheckHealth() in the meantime.
+//
+// Updates that do not change the contents of the store are not written. This
+// happens when an external edit is merged into the nexus: The nexus assigns a
+// new revision, but the store already has these contents. That revision is
+// persisted along with the next actual change.
+func (a *Adapter) writeDatabase(db core.Database) {
+	if a.isAlreadyStored(db) {
+		a.pendingWrite = nil
+		a.health.Report(nil)
+		return
+	}
+	err := a.store.Save(db)
+	if err == nil {
+		logg.Info("wrote database revision %d to %s", db.Revision, a.store.String())
+		a.stored = db
+		a.pendingWrite = nil
+		a.health.Report(nil)
+	} else {
+		err = fmt.Errorf("cannot write database to %s: %w", a.store.String(), err)
+		logg.Error("%s (will retry revision %d in %s)", err.Error(), db.Revision, a.writeRetryInterval)
+		a.pendingWrite = &db
+		a.health.Report(err)
+	}
+}
 
-	return watcher.Close()
+// Returns whether the store already has the contents of the given database,
+// regardless of its revision. The comparison is done on the rendered form
+// since the loaded database has not been normalized by the nexus.
+func (a *Adapter) isAlreadyStored(db core.Database) bool {
+	db.Revision, db.UpdatedAt = a.stored.Revision, a.stored.UpdatedAt
+	ours, err := RenderDatabase(db)
+	if err != nil {
+		return false
+	}
+	stored, err := RenderDatabase(a.stored)
+	return err == nil && bytes.Equal(ours, stored)
+}
+
+// Handles an edit of the store by someone other than us. If the in-memory
+// database has changes that were not written yet, both sides are merged using
+// the last known store contents as a base. Conflicts are reported in
+// a.conflicts.
+//
+// Problems with the edited database are logged, but never fatal. The in-memory
+// database is kept as it is in this case, and will overwrite the store on the
+// next write.
+func (a *Adapter) mergeExternalEdit(theirs core.Database) {
+	base := a.stored
+	var conflicts []core.MergeConflict
+	errs := a.nexus.Update(func(db *core.Database) (errs errext.ErrorSet) {
+		merged, mergeConflicts, err := core.MergeDatabases(base, *db, theirs)
+		if err != nil {
+			errs.Add(err)
+			return
+		}
+		*db = merged
+		conflicts = mergeConflicts
+		return
+	}, &core.UpdateOptions{SystemInternal: true})
+	if !errs.IsEmpty() {
+		logg.Error("ignoring external edit of %s: %s", a.store.String(), errs.Join(", "))
+		return
+	}
+	a.stored = theirs
+	revision, _ := a.nexus.Revision()
+	logg.Info("merged external edit of %s into database revision %d", a.store.String(), revision)
+
+	for _, c := range conflicts {
+		logg.Error("conflict while merging external edit of %s: %s (keeping the in-memory value)", a.store.String(), c.String())
+	}
+	a.conflicts.Add(conflicts, time.Now())
 }
 
 // persistedDatabase is a variant of type Database. This is what gets
 // persisted into the database file.
 type persistedDatabase struct {
-	Users         []core.User  `json:"users"`
-	Groups        []core.Group `json:"groups"`
-	SchemaVersion uint         `json:"schema_version"`
+	Users         []core.User        `json:"users"`
+	Groups        []core.Group       `json:"groups"`
+	ServiceUsers  []core.ServiceUser `json:"service_users,omitempty"`
+	DeletedUsers  []core.DeletedUser `json:"deleted_users,omitempty"`
+	Revision      uint64             `json:"revision,omitempty"`
+	UpdatedAt     *time.Time         `json:"updated_at,omitempty"`
+	SchemaVersion uint               `json:"schema_version"`
 }
 
-func (a *Adapter) updateNexusByLoadingFromDisk(db *core.Database) (errs errext.ErrorSet) {
-	errs.Add(a.updateNexusByLoadingFromDiskImpl(db))
+func (a *Adapter) updateNexusByLoadingFromStore(db *core.Database) (errs errext.ErrorSet) {
+	errs.Add(a.updateNexusByLoadingFromStoreImpl(db))
 	return
 }
 
-func (a *Adapter) updateNexusByLoadingFromDiskImpl(db *core.Database) error {
+func (a *Adapter) updateNexusByLoadingFromStoreImpl(db *core.Database) error {
 	a.initPending = false
-	buf, err := a.readStoreFile()
+	loaded, err := a.store.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			a.initPending = true
 			return core.ErrDatabaseNeedsInitialization
 		}
 		return err
 	}
+	*db = loaded
+	a.stored = loaded
+	return nil
+}
 
+// ParseDatabase decodes the contents of a database file.
+func ParseDatabase(buf []byte) (core.Database, error) {
 	var pdb persistedDatabase
-	err = json.Unmarshal(buf, &pdb)
+	err := json.Unmarshal(buf, &pdb)
 	if err != nil {
-		return fmt.Errorf("cannot parse DB: %w", err)
+		return core.Database{}, fmt.Errorf("cannot parse DB: %w", err)
 	}
 
 	if pdb.SchemaVersion != 1 {
-		return fmt.Errorf("found DB with schema version %d, but this Portunus only understands schema version 1", pdb.SchemaVersion)
+		return core.Database{}, fmt.Errorf("found DB with schema version %d, but this Portunus only understands schema version 1", pdb.SchemaVersion)
 	}
 
-	db.Users = pdb.Users
-	db.Groups = pdb.Groups
-	return nil
+	db := core.Database{Users: pdb.Users, Groups: pdb.Groups, ServiceUsers: pdb.ServiceUsers, DeletedUsers: pdb.DeletedUsers, Revision: pdb.Revision}
+	if pdb.UpdatedAt != nil {
+		db.UpdatedAt = *pdb.UpdatedAt
+	}
+	return db, nil
 }
 
-func (a *Adapter) writeDatabase(db core.Database) error {
+// RenderDatabase encodes the given Database in the format of the database
+// file. This is the inverse of ParseDatabase. The result is normalized, so
+// databases with the same contents always render into the same bytes.
+func RenderDatabase(db core.Database) ([]byte, error) {
+	db = db.Cloned()
+	db.Normalize()
+	//The order of SSH public keys has no meaning in LDAP. This is not done in
+	//Normalize() because validation errors refer to keys by their line number
+	//in the order in which they were entered.
+	for _, u := range db.Users {
+		sort.Slice(u.SSHPublicKeys, func(i, j int) bool {
+			return u.SSHPublicKeys[i].Key < u.SSHPublicKeys[j].Key
+		})
+	}
 	pdb := persistedDatabase{
 		Users:         db.Users,
 		Groups:        db.Groups,
+		ServiceUsers:  db.ServiceUsers,
+		DeletedUsers:  db.DeletedUsers,
+		Revision:      db.Revision,
 		SchemaVersion: 1,
 	}
+	if !db.UpdatedAt.IsZero() {
+		updatedAt := db.UpdatedAt.UTC()
+		pdb.UpdatedAt = &updatedAt
+	}
 	buf, err := json.MarshalIndent(pdb, "", "  ")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	buf = append(buf, '\n') //follow the Unix convention of having a NL at the end of the file
-	return a.writeStoreFile(buf)
+	return append(buf, '\n'), nil //follow the Unix convention of having a NL at the end of the file
 }
 
-func (a *Adapter) readStoreFile() ([]byte, error) {
-	buf, err := os.ReadFile(a.storePath)
-	if err == nil {
-		//remember the contents that were read to avoid a useless rewrite after
-		//roundtrip into our own listener
-		a.diskState = buf
-	}
-	return buf, err
+// databaseMailbox receives databases from a nexus listener. Put() never
+// blocks: A newer database replaces an older one that was not taken yet,
+// since only the most recent state needs to be written.
+type databaseMailbox struct {
+	//Ready receives a value whenever Put() was called.
+	Ready chan struct{}
+	mutex sync.Mutex
+	db    *core.Database
 }
 
-func (a *Adapter) writeStoreFile(buf []byte) error {
-	if bytes.Equal(buf, a.diskState) {
-		//avoid pointless writes
-		return nil
-	}
+func newDatabaseMailbox() *databaseMailbox {
+	return &databaseMailbox{Ready: make(chan struct{}, 1)}
+}
 
-	tmpPath := filepath.Join(
-		filepath.Dir(a.storePath),
-		fmt.Sprintf(".%s.%d", filepath.Base(a.storePath), os.Getpid()),
-	)
-	err := os.WriteFile(tmpPath, buf, 0666)
-	if err != nil {
-		return err
-	}
-	err = os.Rename(tmpPath, a.storePath)
-	if err != nil {
-		return err
+// Put places a database in the mailbox.
+func (m *databaseMailbox) Put(db core.Database) {
+	m.mutex.Lock()
+	m.db = &db
+	m.mutex.Unlock()
+	select {
+	case m.Ready <- struct{}{}:
+	default:
+		//a notification is already pending
 	}
+}
 
-	a.diskState = buf
-	return nil
+// Take removes the database from the mailbox, if any.
+func (m *databaseMailbox) Take() (core.Database, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.db == nil {
+		return core.Database{}, false
+	}
+	db := *m.db
+	m.db = nil
+	return db, true
 }
@@ -9,6 +9,8 @@ package store
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,7 +36,8 @@ var (
 			LongName:         "Nobody in here.",
 			MemberLoginNames: core.GroupMemberNames{},
 		}},
-		Users: []core.User{},
+		Users:        []core.User{},
+		ServiceUsers: []core.ServiceUser{},
 	}
 
 	//go:embed fixtures/db2.json
@@ -45,7 +48,8 @@ var (
 			LongName:         "Still empty.",
 			MemberLoginNames: core.GroupMemberNames{},
 		}},
-		Users: []core.User{},
+		Users:        []core.User{},
+		ServiceUsers: []core.ServiceUser{},
 	}
 
 	//go:embed fixtures/db-autoinit.json
@@ -60,11 +64,13 @@ var (
 			},
 		}},
 		Users: []core.User{{
+			ID:           "<variable>",
 			LoginName:    "admin",
 			GivenName:    "Initial",
 			FamilyName:   "Administrator",
 			PasswordHash: "<variable>",
 		}},
+		ServiceUsers: []core.ServiceUser{},
 	}
 )
 
@@ -82,12 +88,12 @@ func TestReadExistingStore(t *testing.T) {
 
 	//when the adapter loads those contents, verify that they decode into the expected DB contents
 	nexus.AddListener(ctx, func(actualDB core.Database) {
-		assert.DeepEqual(t, "database contents after load", actualDB, db1Contents)
+		assert.DeepEqual(t, "database contents after load", withoutRevision(actualDB), db1Contents)
 		cancel() //make adapter.Run() return
 	})
 
 	//let the adapter load those contents
-	adapter := NewAdapter(nexus, storePath)
+	adapter := NewAdapter(nexus, NewFileStore(storePath))
 	test.ExpectNoError(t, adapter.Run(ctx))
 }
 
@@ -114,9 +120,9 @@ func TestReadSideloadedStore(t *testing.T) {
 		updateCount++
 		switch updateCount {
 		case 1:
-			assert.DeepEqual(t, "database contents after initial load", actualDB, db1Contents)
+			assert.DeepEqual(t, "database contents after initial load", withoutRevision(actualDB), db1Contents)
 		case 2:
-			assert.DeepEqual(t, "database contents after sideload", actualDB, db2Contents)
+			assert.DeepEqual(t, "database contents after sideload", withoutRevision(actualDB), db2Contents)
 			cancel() //make adapter.Run() return
 		default:
 			t.Error("too many updates")
@@ -128,7 +134,7 @@ func TestReadSideloadedStore(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		adapter := NewAdapter(nexus, storePath)
+		adapter := NewAdapter(nexus, NewFileStore(storePath))
 		test.ExpectNoError(t, adapter.Run(ctx))
 	}()
 
@@ -167,7 +173,7 @@ func TestWriteStore(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		adapter := NewAdapter(nexus, storePath)
+		adapter := NewAdapter(nexus, NewFileStore(storePath))
 		test.ExpectNoError(t, adapter.Run(ctx))
 	}()
 
@@ -188,9 +194,62 @@ func TestWriteStore(t *testing.T) {
 	//...shut it down and check that it wrote the right data into the store
 	cancel()
 	wg.Wait()
+	contents, revision := readStoreFile(t, storePath)
+	assert.DeepEqual(t, "database contents after write", contents, db2Representation)
+	assert.DeepEqual(t, "database revision after write", revision, uint64(2))
+}
+
+func TestWriteStoreFailure(t *testing.T) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dirPath, storePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	test.ExpectNoError(t, os.WriteFile(storePath, []byte(db1Representation), 0666))
+
+	adapter := NewAdapter(nexus, NewFileStore(storePath))
+	adapter.writeRetryInterval = 20 * time.Millisecond
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+
+	//after the initial load, the adapter reports as healthy
+	time.Sleep(25 * time.Millisecond)
+	test.ExpectNoError(t, adapter.CheckHealth())
+
+	//block the path of the temporary file that the adapter writes into
+	tmpPath := filepath.Join(dirPath, fmt.Sprintf(".database.json.%d", os.Getpid()))
+	test.ExpectNoError(t, os.Mkdir(tmpPath, 0777))
+
+	//a failed write does not make the adapter exit, but it reports as unhealthy
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		*db = db2Contents.Cloned()
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+	time.Sleep(25 * time.Millisecond)
+	if adapter.CheckHealth() == nil {
+		t.Error("expected adapter to report a write error, but it reports as healthy")
+	}
 	buf, err := os.ReadFile(storePath)
 	test.ExpectNoError(t, err)
-	assert.DeepEqual(t, "database contents after write", string(buf), db2Representation)
+	assert.DeepEqual(t, "database contents after failed write", string(buf), db1Representation)
+
+	//once the obstacle is removed, the write is retried and succeeds
+	test.ExpectNoError(t, os.Remove(tmpPath))
+	time.Sleep(50 * time.Millisecond)
+	test.ExpectNoError(t, adapter.CheckHealth())
+	contents, revision := readStoreFile(t, storePath)
+	assert.DeepEqual(t, "database contents after retried write", contents, db2Representation)
+	assert.DeepEqual(t, "database revision after retried write", revision, uint64(2))
+
+	cancel()
+	wg.Wait()
 }
 
 func TestInitializeMissingStore(t *testing.T) {
@@ -205,19 +264,21 @@ func TestInitializeMissingStore(t *testing.T) {
 	//when the adapter starts up and finds no store...
 	var wg1 sync.WaitGroup
 	wg1.Add(1)
-	var realPasswordHash string
+	var realPasswordHash, realUserID string
 	nexus.AddListener(ctx, func(actualDB core.Database) {
 		//...the nexus will auto-initialize a DB with an initial admin account
 		for idx := range actualDB.Users {
 			realPasswordHash = actualDB.Users[idx].PasswordHash
 			actualDB.Users[idx].PasswordHash = "<variable>"
+			realUserID = actualDB.Users[idx].ID
+			actualDB.Users[idx].ID = "<variable>"
 		}
-		assert.DeepEqual(t, "database contents after load", actualDB, autoinitDBContents)
+		assert.DeepEqual(t, "database contents after load", withoutRevision(actualDB), autoinitDBContents)
 		wg1.Done()
 	})
 
 	//let the adapter fulfil this promise
-	adapter := NewAdapter(nexus, storePath)
+	adapter := NewAdapter(nexus, NewFileStore(storePath))
 	var wg2 sync.WaitGroup
 	wg2.Add(1)
 	go func() {
@@ -233,10 +294,11 @@ func TestInitializeMissingStore(t *testing.T) {
 	wg2.Wait()
 
 	//check that the newly initialized DB was written correctly
-	buf, err := os.ReadFile(storePath)
-	test.ExpectNoError(t, err)
-	repr := strings.Replace(string(buf), realPasswordHash, "<variable>", 1)
+	contents, revision := readStoreFile(t, storePath)
+	repr := strings.Replace(contents, realPasswordHash, "<variable>", 1)
+	repr = strings.Replace(repr, realUserID, "<variable>", 1)
 	assert.DeepEqual(t, "database contents after write", repr, autoinitDBRepresentation)
+	assert.DeepEqual(t, "database revision after write", revision, uint64(1))
 }
 
 func setupTempDir(t *testing.T) (dirPath, storePath string) {
@@ -244,3 +306,197 @@ func setupTempDir(t *testing.T) (dirPath, storePath string) {
 	test.ExpectNoError(t, err)
 	return dirPath, filepath.Join(dirPath, "database.json")
 }
+
+func TestMalformedSideloadedStore(t *testing.T) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dirPath, storePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	test.ExpectNoError(t, os.WriteFile(storePath, []byte(db1Representation), 0666))
+
+	adapter := NewAdapter(nexus, NewFileStore(storePath))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+	time.Sleep(25 * time.Millisecond)
+
+	//sideloading a broken file or a database that does not validate...
+	for _, contents := range []string{`{"users":[`, `{"users":[{"login_name":""}],"groups":[],"schema_version":1}`} {
+		test.ExpectNoError(t, os.WriteFile(storePath, []byte(contents), 0666))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	//...does not make the adapter exit, and does not change the in-memory database
+	assert.DeepEqual(t, "groups after broken sideload", nexus.ListGroups(), []core.Group(db1Contents.Groups))
+	assert.DeepEqual(t, "users after broken sideload", len(nexus.ListUsers()), 0)
+
+	//the next in-memory change replaces the broken file
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		*db = db2Contents.Cloned()
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+	time.Sleep(25 * time.Millisecond)
+	contents, revision := readStoreFile(t, storePath)
+	assert.DeepEqual(t, "database contents after write", contents, db2Representation)
+	assert.DeepEqual(t, "database revision after write", revision, uint64(2))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestMergeSideloadedStoreWithPendingWrite(t *testing.T) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dirPath, storePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	baseContents := core.Database{
+		Groups: []core.Group{
+			{Name: "nobody", LongName: "Nobody in here.", MemberLoginNames: core.GroupMemberNames{}},
+			{Name: "somebody", LongName: "Somebody in here.", MemberLoginNames: core.GroupMemberNames{}},
+		},
+		Users: []core.User{},
+	}
+	test.ExpectNoError(t, os.WriteFile(storePath, renderDatabase(t, baseContents), 0666))
+
+	adapter := NewAdapter(nexus, NewFileStore(storePath))
+	adapter.writeRetryInterval = time.Hour //we do not want the pending write to be retried during this test
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+	time.Sleep(25 * time.Millisecond)
+
+	//make an in-memory change that cannot be written to disk
+	tmpPath := filepath.Join(dirPath, fmt.Sprintf(".database.json.%d", os.Getpid()))
+	test.ExpectNoError(t, os.Mkdir(tmpPath, 0777))
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].LongName = "Changed in memory."
+		db.Groups[1].LongName = "Also changed in memory."
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+	time.Sleep(25 * time.Millisecond)
+	test.ExpectNoError(t, os.Remove(tmpPath))
+
+	//meanwhile, the file is edited on disk, with one conflicting and one non-conflicting change
+	theirContents := baseContents.Cloned()
+	theirContents.Groups[0].PosixGID = pointerTo(core.PosixID(1000))
+	theirContents.Groups[1].LongName = "Changed on disk."
+	test.ExpectNoError(t, os.WriteFile(storePath, renderDatabase(t, theirContents), 0666))
+	time.Sleep(100 * time.Millisecond)
+
+	//both changes are merged...
+	expectedContents := baseContents.Cloned()
+	expectedContents.Groups[0].LongName = "Changed in memory."
+	expectedContents.Groups[0].PosixGID = pointerTo(core.PosixID(1000))
+	expectedContents.Groups[1].LongName = "Also changed in memory."
+	assert.DeepEqual(t, "groups after merge", nexus.ListGroups(), []core.Group(expectedContents.Groups))
+
+	//...and written back to disk
+	//(revision 2 was the in-memory change that could not be written)
+	contents, revision := readStoreFile(t, storePath)
+	assert.DeepEqual(t, "database contents after merge", contents, string(renderDatabase(t, expectedContents)))
+	assert.DeepEqual(t, "database revision after merge", revision, uint64(3))
+
+	//the conflict is reported
+	var conflicts []core.MergeConflict
+	for _, c := range adapter.MergeConflicts().List() {
+		conflicts = append(conflicts, c.MergeConflict)
+	}
+	assert.DeepEqual(t, "merge conflicts", conflicts, []core.MergeConflict{{
+		Type:       "group",
+		Key:        "somebody",
+		Path:       "long_name",
+		BaseValue:  `"Somebody in here."`,
+		OurValue:   `"Also changed in memory."`,
+		TheirValue: `"Changed on disk."`,
+	}})
+
+	cancel()
+	wg.Wait()
+}
+
+func renderDatabase(t *testing.T, db core.Database) []byte {
+	t.Helper()
+	buf, err := json.MarshalIndent(persistedDatabase{Users: db.Users, Groups: db.Groups, ServiceUsers: db.ServiceUsers, SchemaVersion: 1}, "", "  ")
+	test.ExpectNoError(t, err)
+	return append(buf, '\n')
+}
+
+// Reads the database file written by the adapter. The contents are rendered
+// without the revision, so that they can be compared with the fixtures.
+func readStoreFile(t *testing.T, storePath string) (contents string, revision uint64) {
+	t.Helper()
+	buf, err := os.ReadFile(storePath)
+	test.ExpectNoError(t, err)
+	db, err := ParseDatabase(buf)
+	test.ExpectNoError(t, err)
+	if db.Revision > 0 && db.UpdatedAt.IsZero() {
+		t.Errorf("expected database revision %d to have a timestamp", db.Revision)
+	}
+	return string(renderDatabase(t, db)), db.Revision
+}
+
+// The Nexus assigns a new revision on each update, which is not interesting
+// for most tests.
+func withoutRevision(db core.Database) core.Database {
+	db.Revision = 0
+	db.UpdatedAt = time.Time{}
+	return db
+}
+
+func pointerTo[T any](value T) *T {
+	return &value
+}
+
+//go:embed fixtures/db-canonical.json
+var canonicalDBRepresentation string
+
+func TestRenderDatabaseIsCanonical(t *testing.T) {
+	//rendering a parsed database file yields the same file
+	db, err := ParseDatabase([]byte(canonicalDBRepresentation))
+	test.ExpectNoError(t, err)
+	buf, err := RenderDatabase(db)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "database contents after round trip", string(buf), canonicalDBRepresentation)
+
+	//the order of users, groups, service users and SSH public keys does not
+	//matter for the rendered result
+	reverse := func(count int, swap func(i, j int)) {
+		for i, j := 0, count-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	reverse(len(db.Users), func(i, j int) { db.Users[i], db.Users[j] = db.Users[j], db.Users[i] })
+	reverse(len(db.Groups), func(i, j int) { db.Groups[i], db.Groups[j] = db.Groups[j], db.Groups[i] })
+	for _, u := range db.Users {
+		keys := u.SSHPublicKeys
+		reverse(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	}
+	db.ServiceUsers = append(db.ServiceUsers, core.ServiceUser{Name: "gitea", PasswordHash: "{CRYPT}$6$foo$quux"})
+	reverse(len(db.ServiceUsers), func(i, j int) { db.ServiceUsers[i], db.ServiceUsers[j] = db.ServiceUsers[j], db.ServiceUsers[i] })
+	buf, err = RenderDatabase(db)
+	test.ExpectNoError(t, err)
+	expected := strings.Replace(canonicalDBRepresentation, `
+  "service_users": [
+    {`, `
+  "service_users": [
+    {
+      "name": "gitea",
+      "password": "{CRYPT}$6$foo$quux"
+    },
+    {`, 1)
+	assert.DeepEqual(t, "database contents after shuffling", string(buf), expected)
+}
@@ -0,0 +1,232 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// How many devices are remembered for each user. When a user logs in on
+// another device, the least recently used device is forgotten.
+const maxDevicesPerUser = 20
+
+// DeviceStore is a core.DeviceStore that persists devices into its own file in
+// the state directory, separately from the database. Devices that have not
+// been used within the retention period are forgotten.
+type DeviceStore struct {
+	path      string
+	retention time.Duration
+	now       func() time.Time //can be swapped in tests
+	//The mutex guards access to all fields listed below it.
+	mutex   sync.Mutex
+	devices []core.Device
+}
+
+// persistedDeviceStore is what gets persisted into the device store file.
+type persistedDeviceStore struct {
+	Devices []core.Device `json:"devices"`
+}
+
+// NewDeviceStore loads the device store from the given path. If the file does
+// not exist yet, an empty device store is returned.
+func NewDeviceStore(path string, retention time.Duration) (*DeviceStore, error) {
+	s := &DeviceStore{path: path, retention: retention, now: time.Now}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	var pds persistedDeviceStore
+	err = json.Unmarshal(buf, &pds)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse device store in %s: %w", path, err)
+	}
+	s.devices = pds.Devices
+	return s, nil
+}
+
+// RecordLogin implements the core.DeviceStore interface.
+func (s *DeviceStore) RecordLogin(loginName, deviceID, name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	defer s.write()
+
+	//this is a convenient time to forget devices that have not been used in a long time
+	now := s.now()
+	s.filter(func(d core.Device) bool { return now.Before(d.LastSeenAt.Add(s.retention)) })
+
+	for idx, d := range s.devices {
+		if d.LoginName == loginName && d.ID == deviceID {
+			s.devices[idx].LastSeenAt = now
+			return false
+		}
+	}
+	s.devices = append(s.devices, core.Device{
+		ID:         deviceID,
+		LoginName:  loginName,
+		Name:       name,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	})
+
+	//enforce maxDevicesPerUser by forgetting the least recently used devices
+	var devicesOfUser []core.Device
+	for _, d := range s.devices {
+		if d.LoginName == loginName {
+			devicesOfUser = append(devicesOfUser, d)
+		}
+	}
+	if len(devicesOfUser) > maxDevicesPerUser {
+		sortDevices(devicesOfUser)
+		isForgotten := make(map[string]bool)
+		for _, d := range devicesOfUser[maxDevicesPerUser:] {
+			isForgotten[d.ID] = true
+		}
+		s.filter(func(d core.Device) bool { return d.LoginName != loginName || !isForgotten[d.ID] })
+	}
+	return true
+}
+
+// RequireConfirmation implements the core.DeviceStore interface.
+func (s *DeviceStore) RequireConfirmation(loginName, deviceID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := hex.EncodeToString(core.GenerateRandomKey(32))
+	for idx, d := range s.devices {
+		if d.LoginName == loginName && d.ID == deviceID {
+			s.devices[idx].ConfirmationTokenHash = hashConfirmationToken(token)
+		}
+	}
+	s.write()
+	return token
+}
+
+// ConfirmDevice implements the core.DeviceStore interface.
+func (s *DeviceStore) ConfirmDevice(token string) (core.Device, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tokenHash := hashConfirmationToken(token)
+	for idx, d := range s.devices {
+		if d.ConfirmationTokenHash != "" && subtle.ConstantTimeCompare([]byte(tokenHash), []byte(d.ConfirmationTokenHash)) == 1 {
+			s.devices[idx].ConfirmationTokenHash = ""
+			s.write()
+			return s.devices[idx], true
+		}
+	}
+	return core.Device{}, false
+}
+
+// FindDevice implements the core.DeviceStore interface.
+func (s *DeviceStore) FindDevice(loginName, deviceID string) (core.Device, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, d := range s.devices {
+		if d.LoginName == loginName && d.ID == deviceID {
+			return d, true
+		}
+	}
+	return core.Device{}, false
+}
+
+// ListDevicesOfUser implements the core.DeviceStore interface.
+func (s *DeviceStore) ListDevicesOfUser(loginName string) []core.Device {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []core.Device
+	for _, d := range s.devices {
+		if d.LoginName == loginName {
+			result = append(result, d)
+		}
+	}
+	sortDevices(result)
+	return result
+}
+
+// DeleteDevice implements the core.DeviceStore interface.
+func (s *DeviceStore) DeleteDevice(loginName, deviceID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.filter(func(d core.Device) bool { return d.LoginName != loginName || d.ID != deviceID })
+	s.write()
+}
+
+// DeleteDevicesOfUnknownUsers implements the core.DeviceStore interface.
+func (s *DeviceStore) DeleteDevicesOfUnknownUsers(knownLoginNames map[string]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := len(s.devices)
+	s.filter(func(d core.Device) bool { return knownLoginNames[d.LoginName] })
+	if len(s.devices) != count {
+		s.write()
+	}
+}
+
+// Removes all devices for which the predicate returns false.
+func (s *DeviceStore) filter(predicate func(core.Device) bool) {
+	kept := s.devices[:0]
+	for _, d := range s.devices {
+		if predicate(d) {
+			kept = append(kept, d)
+		}
+	}
+	s.devices = kept
+}
+
+// Errors while writing the file are logged, but not fatal: The devices are
+// still held in memory, and will be written together with the next change.
+func (s *DeviceStore) write() {
+	buf, err := json.MarshalIndent(persistedDeviceStore{s.devices}, "", "  ")
+	if err == nil {
+		buf = append(buf, '\n')
+		//write atomically, same as for the database file; unlike the activity
+		//log, this file is only readable by us since it contains confirmation tokens
+		tmpPath := filepath.Join(
+			filepath.Dir(s.path),
+			fmt.Sprintf(".%s.%d", filepath.Base(s.path), os.Getpid()),
+		)
+		err = os.WriteFile(tmpPath, buf, 0600)
+		if err == nil {
+			err = os.Rename(tmpPath, s.path)
+		}
+	}
+	if err != nil {
+		logg.Error("cannot write device store to %s: %s", s.path, err.Error())
+	}
+}
+
+// Sorts devices by last use, most recent first.
+func sortDevices(devices []core.Device) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].LastSeenAt.After(devices[j].LastSeenAt)
+	})
+}
+
+func hashConfirmationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,96 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestDeviceStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	devices := must.Return(NewDeviceStore(path, 24*time.Hour))
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	devices.now = func() time.Time { return now }
+
+	//a device is only new on the first login
+	assert.DeepEqual(t, "first login on laptop", devices.RecordLogin("jane", "laptop", "Firefox on Linux"), true)
+	now = now.Add(time.Hour)
+	assert.DeepEqual(t, "second login on laptop", devices.RecordLogin("jane", "laptop", "Firefox on Linux"), false)
+	//devices are recognized separately for each user
+	assert.DeepEqual(t, "first login of john on laptop", devices.RecordLogin("john", "laptop", "Firefox on Linux"), true)
+	now = now.Add(time.Hour)
+	assert.DeepEqual(t, "first login on phone", devices.RecordLogin("jane", "phone", "Safari on iOS"), true)
+
+	janeDevices := devices.ListDevicesOfUser("jane")
+	assert.DeepEqual(t, "number of devices", len(janeDevices), 2)
+	assert.DeepEqual(t, "most recently used device", janeDevices[0].ID, "phone")
+	assert.DeepEqual(t, "last use of laptop", janeDevices[1].LastSeenAt, now.Add(-time.Hour))
+	assert.DeepEqual(t, "first use of laptop", janeDevices[1].CreatedAt, now.Add(-2*time.Hour))
+
+	//confirmation tokens can only be used once
+	token := devices.RequireConfirmation("jane", "phone")
+	device, _ := devices.FindDevice("jane", "phone")
+	assert.DeepEqual(t, "phone is confirmed before confirmation", device.IsConfirmed(), false)
+	_, ok := devices.ConfirmDevice("wrong")
+	assert.DeepEqual(t, "confirming with wrong token", ok, false)
+	device, ok = devices.ConfirmDevice(token)
+	assert.DeepEqual(t, "confirming with correct token", ok, true)
+	assert.DeepEqual(t, "phone is confirmed after confirmation", device.IsConfirmed(), true)
+	_, ok = devices.ConfirmDevice(token)
+	assert.DeepEqual(t, "confirming again", ok, false)
+
+	//contents survive reloading from disk
+	devices = must.Return(NewDeviceStore(path, 24*time.Hour))
+	devices.now = func() time.Time { return now }
+	assert.DeepEqual(t, "devices after reload", devices.ListDevicesOfUser("jane"), janeDevices)
+
+	//a forgotten device is new again on the next login
+	devices.DeleteDevice("jane", "laptop")
+	_, exists := devices.FindDevice("jane", "laptop")
+	assert.DeepEqual(t, "laptop exists after deletion", exists, false)
+	_, exists = devices.FindDevice("john", "laptop")
+	assert.DeepEqual(t, "laptop of john exists after deletion", exists, true)
+	assert.DeepEqual(t, "login on laptop after deletion", devices.RecordLogin("jane", "laptop", "Firefox on Linux"), true)
+
+	//devices of deleted users are forgotten
+	devices.DeleteDevicesOfUnknownUsers(map[string]bool{"jane": true})
+	assert.DeepEqual(t, "devices of john", len(devices.ListDevicesOfUser("john")), 0)
+	assert.DeepEqual(t, "devices of jane", len(devices.ListDevicesOfUser("jane")), 2)
+}
+
+func TestDeviceStoreExpiry(t *testing.T) {
+	devices := must.Return(NewDeviceStore(filepath.Join(t.TempDir(), "devices.json"), 24*time.Hour))
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	devices.now = func() time.Time { return now }
+
+	devices.RecordLogin("jane", "laptop", "Firefox on Linux")
+	devices.RecordLogin("jane", "phone", "Safari on iOS")
+	now = now.Add(23 * time.Hour)
+	devices.RecordLogin("jane", "phone", "Safari on iOS")
+
+	//the laptop has not been used within the retention period, so it is new again
+	now = now.Add(2 * time.Hour)
+	assert.DeepEqual(t, "login on phone after retention period", devices.RecordLogin("jane", "phone", "Safari on iOS"), false)
+	assert.DeepEqual(t, "login on laptop after retention period", devices.RecordLogin("jane", "laptop", "Firefox on Linux"), true)
+
+	//only the most recently used devices are remembered
+	for idx := 0; idx < maxDevicesPerUser; idx++ {
+		now = now.Add(time.Minute)
+		devices.RecordLogin("jane", fmt.Sprintf("device%d", idx), "Unknown browser")
+	}
+	assert.DeepEqual(t, "number of devices", len(devices.ListDevicesOfUser("jane")), maxDevicesPerUser)
+	_, exists := devices.FindDevice("jane", "phone")
+	assert.DeepEqual(t, "phone exists", exists, false)
+	_, exists = devices.FindDevice("jane", "device0")
+	assert.DeepEqual(t, "device0 exists", exists, true)
+}
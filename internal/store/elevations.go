@@ -0,0 +1,103 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// ElevationStore is a core.ElevationStore that persists elevations into its
+// own file in the state directory, separately from the database. Ended
+// elevations are kept as an audit trail.
+type ElevationStore struct {
+	path string
+	//The mutex guards access to all fields listed below it.
+	mutex      sync.Mutex
+	elevations []core.Elevation
+}
+
+// persistedElevationStore is what gets persisted into the elevation store file.
+type persistedElevationStore struct {
+	Elevations []core.Elevation `json:"elevations"`
+}
+
+// NewElevationStore loads the elevation store from the given path. If the
+// file does not exist yet, an empty elevation store is returned.
+func NewElevationStore(path string) (*ElevationStore, error) {
+	s := &ElevationStore{path: path}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	var pes persistedElevationStore
+	err = json.Unmarshal(buf, &pes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse elevation store in %s: %w", path, err)
+	}
+	s.elevations = pes.Elevations
+	return s, nil
+}
+
+// ListElevations implements the core.ElevationStore interface.
+func (s *ElevationStore) ListElevations() []core.Elevation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return cloneElevations(s.elevations)
+}
+
+// UpdateElevations implements the core.ElevationStore interface.
+//
+// Unlike with the device store, errors while writing the file are returned
+// instead of only being logged: Elevations grant permissions, so their state
+// on disk must never lag behind the group memberships in the database.
+func (s *ElevationStore) UpdateElevations(action func([]core.Elevation) ([]core.Elevation, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elevations, err := action(cloneElevations(s.elevations))
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(persistedElevationStore{elevations}, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	//write atomically, same as for the database file
+	tmpPath := filepath.Join(
+		filepath.Dir(s.path),
+		fmt.Sprintf(".%s.%d", filepath.Base(s.path), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, buf, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write elevation store to %s: %w", s.path, err)
+	}
+	s.elevations = elevations
+	return nil
+}
+
+func cloneElevations(elevations []core.Elevation) []core.Elevation {
+	result := make([]core.Elevation, len(elevations))
+	for idx, e := range elevations {
+		e.ApprovedBy = append([]string(nil), e.ApprovedBy...)
+		result[idx] = e
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestElevationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "elevations.json")
+	elevations := must.Return(NewElevationStore(path))
+	assert.DeepEqual(t, "initial elevations", len(elevations.ListElevations()), 0)
+
+	e := core.Elevation{
+		ID:            "abc",
+		LoginName:     "jane",
+		GroupName:     "oncall",
+		Hours:         2,
+		Justification: "incident #42",
+		RequestedBy:   "jane",
+		RequestedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ApprovedBy:    []string{"alice"},
+		State:         core.ElevationActive,
+		ExpiresAt:     time.Date(2024, 1, 2, 5, 4, 5, 0, time.UTC),
+	}
+	must.Succeed(elevations.UpdateElevations(func(list []core.Elevation) ([]core.Elevation, error) {
+		return append(list, e), nil
+	}))
+	assert.DeepEqual(t, "elevations after update", elevations.ListElevations(), []core.Elevation{e})
+
+	//a failed update does not change anything, even if the action modified its input
+	err := elevations.UpdateElevations(func(list []core.Elevation) ([]core.Elevation, error) {
+		list[0].State = core.ElevationEnded
+		list[0].ApprovedBy[0] = "mallory"
+		return list, errors.New("failed")
+	})
+	assert.DeepEqual(t, "error from failed update", err.Error(), "failed")
+	assert.DeepEqual(t, "elevations after failed update", elevations.ListElevations(), []core.Elevation{e})
+
+	//contents survive reloading from disk
+	elevations = must.Return(NewElevationStore(path))
+	assert.DeepEqual(t, "elevations after reload", elevations.ListElevations(), []core.Elevation{e})
+}
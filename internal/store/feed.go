@@ -0,0 +1,79 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// FeedSyncStore is a core.FeedSyncStore that persists the state of the feed
+// sync into its own file in the state directory, separately from the
+// database.
+type FeedSyncStore struct {
+	path string
+	//The mutex guards access to all fields listed below it.
+	mutex sync.Mutex
+	state core.FeedSyncState
+}
+
+// NewFeedSyncStore loads the feed sync state from the given path. If the file
+// does not exist yet, an empty state is returned.
+func NewFeedSyncStore(path string) (*FeedSyncStore, error) {
+	s := &FeedSyncStore{path: path}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, &s.state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse feed sync state in %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// LoadFeedSyncState implements the core.FeedSyncStore interface.
+func (s *FeedSyncStore) LoadFeedSyncState() core.FeedSyncState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// SaveFeedSyncState implements the core.FeedSyncStore interface.
+func (s *FeedSyncStore) SaveFeedSyncState(state core.FeedSyncState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	//write atomically, same as for the database file
+	tmpPath := filepath.Join(
+		filepath.Dir(s.path),
+		fmt.Sprintf(".%s.%d", filepath.Base(s.path), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, buf, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write feed sync state to %s: %w", s.path, err)
+	}
+	s.state = state
+	return nil
+}
@@ -0,0 +1,42 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/must"
+)
+
+func TestFeedSyncStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed-sync.json")
+	s := must.Return(NewFeedSyncStore(path))
+	assert.DeepEqual(t, "initial state", s.LoadFeedSyncState(), core.FeedSyncState{})
+
+	state := core.FeedSyncState{
+		Paused:   true,
+		ETag:     `"v1"`,
+		Checksum: "abcdef",
+		Reports: []core.FeedSyncReport{{
+			StartedAt:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			FinishedAt: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+			Created:    []string{"jane"},
+			RowErrors:  []core.FeedRowError{{Line: 3, MatchKey: "E42", Message: "column \"Last Name\" is empty"}},
+			Departures: []string{"john"},
+		}},
+	}
+	must.Succeed(s.SaveFeedSyncState(state))
+	assert.DeepEqual(t, "state after save", s.LoadFeedSyncState(), state)
+
+	//contents survive reloading from disk
+	s = must.Return(NewFeedSyncStore(path))
+	assert.DeepEqual(t, "state after reload", s.LoadFeedSyncState(), state)
+}
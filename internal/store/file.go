@@ -0,0 +1,173 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// FileStore is a Store that keeps the database in a JSON file. This is the
+// default Store. The file can be edited by hand while Portunus is running.
+type FileStore struct {
+	path string
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex sync.Mutex
+	//This contains the known contents of the store file. We maintain this to
+	//avoid useless roundtrip writes from disk -> nexus -> disk, and to
+	//recognize our own writes when the watcher reports them.
+	diskState []byte
+}
+
+// NewFileStore initializes a FileStore for the file at the given path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// String implements the Store interface.
+func (s *FileStore) String() string {
+	return s.path
+}
+
+// Load implements the Store interface.
+func (s *FileStore) Load() (core.Database, error) {
+	buf, err := os.ReadFile(s.path)
+	if err != nil {
+		return core.Database{}, err
+	}
+
+	s.mutex.Lock()
+	s.diskState = buf
+	s.mutex.Unlock()
+	return ParseDatabase(buf)
+}
+
+// Save implements the Store interface.
+func (s *FileStore) Save(db core.Database) error {
+	buf, err := RenderDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if bytes.Equal(buf, s.diskState) {
+		//avoid pointless writes
+		return nil
+	}
+
+	tmpPath := filepath.Join(
+		filepath.Dir(s.path),
+		fmt.Sprintf(".%s.%d", filepath.Base(s.path), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, buf, 0666)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.diskState = buf
+	return nil
+}
+
+// Watch implements the Store interface.
+func (s *FileStore) Watch(ctx context.Context) (<-chan core.Database, <-chan error) {
+	changes := make(chan core.Database)
+	errs := make(chan error, 1)
+
+	go func() {
+		watcher, err := NewWatcher(s.path)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer func() {
+			if watcher.Backend != nil {
+				_ = watcher.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Backend.Errors:
+				errs <- fmt.Errorf("error while watching %s for changes: %w", s.path, err)
+				return
+			case <-watcher.Backend.Events:
+				//wait for whatever is updating the file to complete
+				time.Sleep(25 * time.Millisecond)
+				db, ok := s.readExternalEdit()
+
+				//recreate the watcher (the original file might be gone if it was updated
+				//by an atomic rename like we do in Save())
+				err = watcher.WhileSuspended(func() error { return nil })
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if ok {
+					select {
+					case changes <- db:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return changes, errs
+}
+
+// Reads the store file after the watcher reported a change. Returns false if
+// the file did not change (e.g. because we are seeing our own write), or if
+// it cannot be read or parsed.
+func (s *FileStore) readExternalEdit() (core.Database, bool) {
+	buf, err := os.ReadFile(s.path)
+	if err != nil {
+		logg.Error("cannot read %s after it was edited: %s", s.path, err.Error())
+		return core.Database{}, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if bytes.Equal(buf, s.diskState) {
+		return core.Database{}, false
+	}
+	s.diskState = buf
+
+	db, err := ParseDatabase(buf)
+	if err != nil {
+		logg.Error("ignoring external edit of %s: %s", s.path, err.Error())
+		return core.Database{}, false
+	}
+	return db, true
+}
+
+// ReadDatabase reads the database file at the given path without setting up
+// an Adapter. If the file does not exist, the returned error matches
+// os.ErrNotExist.
+func ReadDatabase(storePath string) (core.Database, error) {
+	buf, err := os.ReadFile(storePath)
+	if err != nil {
+		return core.Database{}, err
+	}
+	return ParseDatabase(buf)
+}
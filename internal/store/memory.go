@@ -0,0 +1,88 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// MemoryStore is a Store that keeps the database in memory. It is intended
+// for tests that want to run an Adapter (and everything that hangs off the
+// nexus) without touching the filesystem.
+type MemoryStore struct {
+	edits chan core.Database
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex sync.Mutex
+	db    *core.Database //nil if nothing was saved yet
+	saves int
+}
+
+// NewMemoryStore initializes a MemoryStore. If `db` is nil, the store starts
+// out empty, so the Adapter will ask the nexus to initialize the database.
+func NewMemoryStore(db *core.Database) *MemoryStore {
+	s := &MemoryStore{edits: make(chan core.Database)}
+	if db != nil {
+		cloned := db.Cloned()
+		s.db = &cloned
+	}
+	return s
+}
+
+// String implements the Store interface.
+func (s *MemoryStore) String() string {
+	return fmt.Sprintf("<memory store %p>", s)
+}
+
+// Load implements the Store interface.
+func (s *MemoryStore) Load() (core.Database, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.db == nil {
+		return core.Database{}, os.ErrNotExist
+	}
+	return s.db.Cloned(), nil
+}
+
+// Save implements the Store interface.
+func (s *MemoryStore) Save(db core.Database) error {
+	cloned := db.Cloned()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.db = &cloned
+	s.saves++
+	return nil
+}
+
+// Watch implements the Store interface. The only changes reported are those
+// that are made through Edit().
+func (s *MemoryStore) Watch(ctx context.Context) (<-chan core.Database, <-chan error) {
+	return s.edits, make(chan error)
+}
+
+// Edit replaces the contents of the store, and reports the change to the
+// Adapter like an admin editing the store by hand would. This blocks until
+// the Adapter has picked up the change, so an Adapter must be running.
+func (s *MemoryStore) Edit(db core.Database) {
+	cloned := db.Cloned()
+	s.mutex.Lock()
+	s.db = &cloned
+	s.mutex.Unlock()
+	s.edits <- db.Cloned()
+}
+
+// SaveCount returns how often Save() was called. This allows tests to check
+// that an Adapter does not write the database needlessly.
+func (s *MemoryStore) SaveCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves
+}
@@ -0,0 +1,63 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestMemoryStore(t *testing.T) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//before starting, there are already contents in the store
+	s := NewMemoryStore(&db1Contents)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, NewAdapter(nexus, s).Run(ctx))
+	}()
+	time.Sleep(25 * time.Millisecond)
+	loadedRevision, _ := nexus.Revision()
+	assert.DeepEqual(t, "database revision after load", loadedRevision, uint64(1))
+
+	//changes in the nexus are written into the store
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		*db = db2Contents.Cloned()
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+	time.Sleep(25 * time.Millisecond)
+	stored, err := s.Load()
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "database contents after write", withoutRevision(stored), db2Contents)
+	assert.DeepEqual(t, "database revision after write", stored.Revision, uint64(2))
+	assert.DeepEqual(t, "number of writes", s.SaveCount(), 1)
+
+	//edits of the store are merged into the nexus without being written back
+	edited := stored.Cloned()
+	edited.Groups[0].LongName = "Edited behind our back."
+	s.Edit(edited)
+	time.Sleep(25 * time.Millisecond)
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "nobody" })
+	assert.DeepEqual(t, "group after external edit", group.LongName, "Edited behind our back.")
+	assert.DeepEqual(t, "number of writes after external edit", s.SaveCount(), 1)
+
+	cancel()
+	wg.Wait()
+}
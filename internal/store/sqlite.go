@@ -0,0 +1,209 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+	_ "modernc.org/sqlite" //registers the "sqlite" driver with database/sql
+)
+
+// Every write into the SQLiteStore adds a new row, so the table doubles as a
+// history of all previous database states.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS revisions (
+	revision   INTEGER PRIMARY KEY AUTOINCREMENT,
+	written_at INTEGER NOT NULL, -- UNIX timestamp
+	contents   TEXT NOT NULL     -- same format as database.json
+)`
+
+// SQLiteStore is a Store that keeps the database in an SQLite database. Each
+// write adds a new revision, and the latest revision is the current database.
+type SQLiteStore struct {
+	path string
+	db   *sql.DB
+	//How often Watch() checks for revisions written by someone else.
+	pollInterval time.Duration
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex sync.Mutex
+	//The revision that was last loaded or saved by us, and its contents. We
+	//maintain this to avoid useless writes, and to recognize our own writes in
+	//Watch().
+	lastRevision int64
+	lastContents []byte
+}
+
+// NewSQLiteStore opens the SQLite database at the given path, creating it if
+// necessary.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	return openSQLiteStore(path, false)
+}
+
+func openSQLiteStore(path string, readOnly bool) (*SQLiteStore, error) {
+	dsn := "file:" + path
+	if readOnly {
+		//SQLite does not report a missing file in a way that matches os.ErrNotExist
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		dsn += "?mode=ro"
+	}
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	//with only one connection, the pragmas below apply to all queries
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`PRAGMA busy_timeout = 5000`)
+	if err == nil && !readOnly {
+		_, err = db.Exec(sqliteSchema)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot initialize %s: %w", path, err)
+	}
+
+	return &SQLiteStore{path: path, db: db, pollInterval: time.Second}, nil
+}
+
+// Close closes the underlying database connection.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// String implements the Store interface.
+func (s *SQLiteStore) String() string {
+	return s.path
+}
+
+// Load implements the Store interface.
+func (s *SQLiteStore) Load() (core.Database, error) {
+	revision, buf, err := s.readLatestRevision()
+	if err != nil {
+		return core.Database{}, err
+	}
+
+	s.mutex.Lock()
+	s.lastRevision = revision
+	s.lastContents = buf
+	s.mutex.Unlock()
+	return ParseDatabase(buf)
+}
+
+func (s *SQLiteStore) readLatestRevision() (int64, []byte, error) {
+	var (
+		revision int64
+		contents string
+	)
+	err := s.db.QueryRow(`SELECT revision, contents FROM revisions ORDER BY revision DESC LIMIT 1`).Scan(&revision, &contents)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, fmt.Errorf("%s does not contain any revisions yet: %w", s.path, os.ErrNotExist)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot read latest revision from %s: %w", s.path, err)
+	}
+	return revision, []byte(contents), nil
+}
+
+// Save implements the Store interface.
+func (s *SQLiteStore) Save(db core.Database) error {
+	buf, err := RenderDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if bytes.Equal(buf, s.lastContents) {
+		//avoid pointless writes
+		return nil
+	}
+
+	result, err := s.db.Exec(`INSERT INTO revisions (written_at, contents) VALUES (?, ?)`,
+		time.Now().Unix(), string(buf))
+	if err != nil {
+		return err
+	}
+	revision, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	s.lastRevision = revision
+	s.lastContents = buf
+	return nil
+}
+
+// Watch implements the Store interface.
+func (s *SQLiteStore) Watch(ctx context.Context) (<-chan core.Database, <-chan error) {
+	changes := make(chan core.Database)
+	errs := make(chan error, 1)
+
+	go func() {
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				db, ok := s.readExternalEdit()
+				if !ok {
+					continue
+				}
+				select {
+				case changes <- db:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return changes, errs
+}
+
+// Checks for a revision that was written by someone else. Returns false if
+// there is none, or if it cannot be read or parsed. Since the database might
+// just be locked by another writer, read errors are logged, but not fatal.
+func (s *SQLiteStore) readExternalEdit() (core.Database, bool) {
+	revision, buf, err := s.readLatestRevision()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logg.Error(err.Error())
+		}
+		return core.Database{}, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if revision <= s.lastRevision {
+		return core.Database{}, false
+	}
+	s.lastRevision = revision
+	if bytes.Equal(buf, s.lastContents) {
+		return core.Database{}, false
+	}
+	s.lastContents = buf
+
+	db, err := ParseDatabase(buf)
+	if err != nil {
+		logg.Error("ignoring external edit of %s (revision %d): %s", s.path, revision, err.Error())
+		return core.Database{}, false
+	}
+	return db, true
+}
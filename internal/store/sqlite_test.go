@@ -0,0 +1,152 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSQLiteStoreRevisions(t *testing.T) {
+	dirPath, _ := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	s, err := NewSQLiteStore(filepath.Join(dirPath, "database.sqlite"))
+	test.ExpectNoError(t, err)
+	defer s.Close()
+
+	//an empty store reports os.ErrNotExist, like a missing database file
+	_, err = s.Load()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist from empty store, but got %v", err)
+	}
+
+	//each distinct write adds a revision, but unchanged contents are not written again
+	db1 := mustParseDatabase(t, db1Representation)
+	db2 := mustParseDatabase(t, db2Representation)
+	test.ExpectNoError(t, s.Save(db1))
+	test.ExpectNoError(t, s.Save(db1))
+	test.ExpectNoError(t, s.Save(db2))
+	expectRevisionContents(t, s, db1Representation, db2Representation)
+
+	//Load returns the latest revision
+	loaded, err := s.Load()
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "database contents after load", string(renderDatabase(t, loaded)), db2Representation)
+}
+
+func TestSQLiteStoreSideload(t *testing.T) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dirPath, _ := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	storePath := filepath.Join(dirPath, "database.sqlite")
+
+	//before starting, there are already contents in the database store
+	s, err := NewSQLiteStore(storePath)
+	test.ExpectNoError(t, err)
+	defer s.Close()
+	s.pollInterval = 10 * time.Millisecond
+	test.ExpectNoError(t, s.Save(mustParseDatabase(t, db1Representation)))
+
+	updateCount := 0
+	nexus.AddListener(ctx, func(actualDB core.Database) {
+		updateCount++
+		switch updateCount {
+		case 1:
+			assert.DeepEqual(t, "database contents after initial load", withoutRevision(actualDB), db1Contents)
+		case 2:
+			assert.DeepEqual(t, "database contents after sideload", withoutRevision(actualDB), db2Contents)
+			cancel() //make adapter.Run() return
+		default:
+			t.Error("too many updates")
+		}
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		adapter := NewAdapter(nexus, s)
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+
+	//let the adapter finish its startup, then sideload a new revision through
+	//a separate connection (like an admin using the sqlite3 CLI would)
+	time.Sleep(25 * time.Millisecond)
+	other, err := NewSQLiteStore(storePath)
+	test.ExpectNoError(t, err)
+	defer other.Close()
+	test.ExpectNoError(t, other.Save(mustParseDatabase(t, db2Representation)))
+
+	//the listener above should cancel() after this change, so the adapter should shutdown
+	wg.Wait()
+
+	//verify that the adapter did not write any further revisions
+	expectRevisionContents(t, s, db1Representation, db2Representation)
+}
+
+func TestMigrateFileStore(t *testing.T) {
+	dirPath, filePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	test.ExpectNoError(t, os.WriteFile(filePath, []byte(db1Representation), 0666))
+
+	s, err := NewSQLiteStore(filepath.Join(dirPath, "database.sqlite"))
+	test.ExpectNoError(t, err)
+	defer s.Close()
+
+	//the database file gets imported into the empty store, then renamed
+	test.ExpectNoError(t, MigrateFileStore(filePath, s))
+	expectRevisionContents(t, s, db1Representation)
+	_, err = os.Stat(filePath)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %s to be gone after migration, but Stat() returned %v", filePath, err)
+	}
+	buf, err := os.ReadFile(filePath + ".migrated")
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "contents of migrated database file", string(buf), db1Representation)
+
+	//once the store has contents, another database file is not imported
+	test.ExpectNoError(t, os.WriteFile(filePath, []byte(db2Representation), 0666))
+	test.ExpectNoError(t, MigrateFileStore(filePath, s))
+	expectRevisionContents(t, s, db1Representation)
+	_, err = os.Stat(filePath)
+	test.ExpectNoError(t, err)
+}
+
+func expectRevisionContents(t *testing.T, s *SQLiteStore, expected ...string) {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT contents FROM revisions ORDER BY revision`)
+	test.ExpectNoError(t, err)
+	defer rows.Close()
+	var actual []string
+	for rows.Next() {
+		var contents string
+		test.ExpectNoError(t, rows.Scan(&contents))
+		actual = append(actual, contents)
+	}
+	test.ExpectNoError(t, rows.Err())
+	assert.DeepEqual(t, "revision contents", actual, expected)
+}
+
+func mustParseDatabase(t *testing.T, repr string) core.Database {
+	t.Helper()
+	db, err := ParseDatabase([]byte(repr))
+	test.ExpectNoError(t, err)
+	return db
+}
@@ -0,0 +1,139 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// Store is a place where the Portunus database is persisted. The Adapter
+// takes care of moving data between the Store and the nexus.
+type Store interface {
+	// String returns a human-readable description of where the store is
+	// located, for use in log messages.
+	String() string
+	// Load reads the database from the store. If nothing was saved into the
+	// store yet, the returned error matches os.ErrNotExist.
+	Load() (core.Database, error)
+	// Save writes the given database into the store. Implementations may skip
+	// the write if the store already contains the same database.
+	Save(db core.Database) error
+	// Watch reports changes to the store that were made by someone other than
+	// this Store instance (e.g. by an admin editing the store by hand) until
+	// `ctx` expires. Changes that cannot be decoded are logged and skipped. If
+	// watching fails irrecoverably, an error is sent into the second channel.
+	Watch(ctx context.Context) (<-chan core.Database, <-chan error)
+}
+
+// NewStoreFromEnvironment opens the Store selected by PORTUNUS_SERVER_STORE
+// within PORTUNUS_SERVER_STATE_DIR. When the SQLite store is selected, an
+// existing database.json is migrated into it.
+func NewStoreFromEnvironment() (Store, error) {
+	kind, filePath, sqlitePath, err := storePathsFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	if kind == "json" {
+		return NewFileStore(filePath), nil
+	}
+
+	s, err := NewSQLiteStore(sqlitePath)
+	if err != nil {
+		return nil, err
+	}
+	err = MigrateFileStore(filePath, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadDatabaseFromEnvironment reads the database from the Store selected by
+// PORTUNUS_SERVER_STORE without setting up an Adapter. Unlike
+// NewStoreFromEnvironment, this never creates or migrates anything. This is
+// used by commands that inspect the database offline. If no database exists
+// yet, the returned error matches os.ErrNotExist.
+func ReadDatabaseFromEnvironment() (core.Database, error) {
+	kind, filePath, sqlitePath, err := storePathsFromEnvironment()
+	if err != nil {
+		return core.Database{}, err
+	}
+	if kind == "json" {
+		return ReadDatabase(filePath)
+	}
+
+	s, err := openSQLiteStore(sqlitePath, true)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			//the database file (if any) will be migrated on the next startup
+			return ReadDatabase(filePath)
+		}
+		return core.Database{}, err
+	}
+	defer s.Close()
+	db, err := s.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		return ReadDatabase(filePath)
+	}
+	return db, err
+}
+
+func storePathsFromEnvironment() (kind, filePath, sqlitePath string, err error) {
+	stateDir := osext.MustGetenv("PORTUNUS_SERVER_STATE_DIR")
+	filePath = filepath.Join(stateDir, "database.json")
+	sqlitePath = filepath.Join(stateDir, "database.sqlite")
+
+	kind = osext.GetenvOrDefault("PORTUNUS_SERVER_STORE", "json")
+	if kind != "json" && kind != "sqlite" {
+		err = fmt.Errorf(`malformed value for PORTUNUS_SERVER_STORE: %q (expected "json" or "sqlite")`, kind)
+	}
+	return
+}
+
+// MigrateFileStore moves the database from the database file at `filePath`
+// into the given Store, unless the Store already contains a database. After a
+// successful migration, the database file is renamed by appending
+// ".migrated" to its name, so that the migration only happens once.
+func MigrateFileStore(filePath string, target Store) error {
+	_, err := target.Load()
+	switch {
+	case err == nil:
+		if _, err := os.Stat(filePath); err == nil {
+			logg.Info("ignoring %s because %s already contains a database", filePath, target.String())
+		}
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	db, err := ReadDatabase(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil //nothing to migrate (this is a fresh installation)
+		}
+		return fmt.Errorf("cannot migrate %s into %s: %w", filePath, target.String(), err)
+	}
+	err = target.Save(db)
+	if err != nil {
+		return fmt.Errorf("cannot migrate %s into %s: %w", filePath, target.String(), err)
+	}
+	err = os.Rename(filePath, filePath+".migrated")
+	if err != nil {
+		return err
+	}
+
+	logg.Info("migrated database from %s into %s (the old file was renamed to %s.migrated)", filePath, target.String(), filePath)
+	return nil
+}
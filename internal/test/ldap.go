@@ -7,9 +7,12 @@
 package test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 
 	goldap "github.com/go-ldap/ldap/v3"
@@ -17,12 +20,18 @@ import (
 
 // LDAPConnectionDouble is a test double for the ldap.Connection interface.
 // It will only accept requests that are sent while a call to its Expect()
-// method is in progress.
+// method is in progress. It may be used from multiple goroutines at once.
 type LDAPConnectionDouble struct {
+	mutex                  sync.Mutex
 	dnSuffix               string
 	expectedAddRequests    []goldap.AddRequest
 	expectedModifyRequests []goldap.ModifyRequest
+	expectedMoveRequests   []goldap.ModifyDNRequest
 	expectedDeleteRequests []goldap.DelRequest
+	expectedSearchResults  []*goldap.SearchResult
+	isDisconnected         bool
+	//ReconnectCount counts how often Reconnect() was called.
+	ReconnectCount int
 }
 
 // NewLDAPConnectionDouble builds an LDAPConnectionDouble.
@@ -35,21 +44,82 @@ func (d *LDAPConnectionDouble) DNSuffix() string {
 	return d.dnSuffix
 }
 
+var errConnectionLost = goldap.NewError(goldap.ErrorNetwork, errors.New("ldap: connection closed"))
+
 // Add implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Add(req goldap.AddRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.isDisconnected {
+		return errConnectionLost
+	}
 	return removeIfExpected[goldap.AddRequest](&d.expectedAddRequests, normalizeAddRequest(req))
 }
 
 // Modify implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Modify(req goldap.ModifyRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.isDisconnected {
+		return errConnectionLost
+	}
 	return removeIfExpected[goldap.ModifyRequest](&d.expectedModifyRequests, normalizeModifyRequest(req))
 }
 
+// ModifyDN implements the ldap.Connection interface.
+func (d *LDAPConnectionDouble) ModifyDN(req goldap.ModifyDNRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.isDisconnected {
+		return errConnectionLost
+	}
+	return removeIfExpected[goldap.ModifyDNRequest](&d.expectedMoveRequests, req)
+}
+
 // Delete implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Delete(req goldap.DelRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.isDisconnected {
+		return errConnectionLost
+	}
 	return removeIfExpected[goldap.DelRequest](&d.expectedDeleteRequests, req)
 }
 
+// Search implements the ldap.Connection interface. Since the double does not
+// hold any actual LDAP objects, each search returns the next result that was
+// enqueued with ExpectSearch, regardless of the request.
+func (d *LDAPConnectionDouble) Search(req goldap.SearchRequest) (*goldap.SearchResult, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.isDisconnected {
+		return nil, errConnectionLost
+	}
+	if len(d.expectedSearchResults) == 0 {
+		return nil, fmt.Errorf("unexpected LDAP request:\n\t%#v", req)
+	}
+	result := d.expectedSearchResults[0]
+	d.expectedSearchResults = d.expectedSearchResults[1:]
+	return result, nil
+}
+
+// Reconnect implements the ldap.Connection interface.
+func (d *LDAPConnectionDouble) Reconnect(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.isDisconnected = false
+	d.ReconnectCount++
+	return nil
+}
+
+// SimulateConnectionLoss makes all requests fail with a network error until
+// Reconnect() is called.
+func (d *LDAPConnectionDouble) SimulateConnectionLoss() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.isDisconnected = true
+}
+
 func removeIfExpected[R any](pool *[]R, req R) error {
 	for idx := range *pool {
 		if reflect.DeepEqual((*pool)[idx], req) {
@@ -64,26 +134,50 @@ func removeIfExpected[R any](pool *[]R, req R) error {
 // ExpectAdd records that we expect an AddRequest to be executed via this
 // double after this call returns.
 func (d *LDAPConnectionDouble) ExpectAdd(req goldap.AddRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.expectedAddRequests = append(d.expectedAddRequests, normalizeAddRequest(req))
 }
 
 // ExpectModify records that we expect an ModifyRequest to be executed via this
 // double after this call returns.
 func (d *LDAPConnectionDouble) ExpectModify(req goldap.ModifyRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.expectedModifyRequests = append(d.expectedModifyRequests, normalizeModifyRequest(req))
 }
 
+// ExpectModifyDN records that we expect a ModifyDNRequest to be executed via
+// this double after this call returns.
+func (d *LDAPConnectionDouble) ExpectModifyDN(req goldap.ModifyDNRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.expectedMoveRequests = append(d.expectedMoveRequests, req)
+}
+
 // ExpectDelete records that we expect an DeleteRequest to be executed via this
 // double after this call returns.
 func (d *LDAPConnectionDouble) ExpectDelete(req goldap.DelRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.expectedDeleteRequests = append(d.expectedDeleteRequests, req)
 }
 
+// ExpectSearch records that we expect a SearchRequest to be executed via this
+// double after this call returns. The request will yield the given entries.
+func (d *LDAPConnectionDouble) ExpectSearch(entries ...*goldap.Entry) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.expectedSearchResults = append(d.expectedSearchResults, &goldap.SearchResult{Entries: entries})
+}
+
 // CheckAllExecuted fails the test if any of the expected requests that were
-// enqueued with ExpectAdd, ExpectModify or ExpectDelete were not sent before
-// this call.
+// enqueued with ExpectAdd, ExpectModify, ExpectModifyDN, ExpectDelete or
+// ExpectSearch were not sent before this call.
 func (d *LDAPConnectionDouble) CheckAllExecuted(t *testing.T) {
 	t.Helper()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	for _, req := range d.expectedAddRequests {
 		t.Errorf("did not observe as expected:\n\t%#v", req)
 	}
@@ -92,10 +186,18 @@ func (d *LDAPConnectionDouble) CheckAllExecuted(t *testing.T) {
 		t.Errorf("did not observe as expected:\n\t%#v", req)
 	}
 	d.expectedModifyRequests = nil
+	for _, req := range d.expectedMoveRequests {
+		t.Errorf("did not observe as expected:\n\t%#v", req)
+	}
+	d.expectedMoveRequests = nil
 	for _, req := range d.expectedDeleteRequests {
 		t.Errorf("did not observe as expected:\n\t%#v", req)
 	}
 	d.expectedDeleteRequests = nil
+	for _, result := range d.expectedSearchResults {
+		t.Errorf("did not observe search as expected (result was supposed to contain %d entries)", len(result.Entries))
+	}
+	d.expectedSearchResults = nil
 }
 
 func normalizeAddRequest(req goldap.AddRequest) goldap.AddRequest {
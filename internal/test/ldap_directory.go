@@ -0,0 +1,281 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// FakeLDAPDirectory is a stateful implementation of the ldap.Connection
+// interface. Unlike LDAPConnectionDouble, it does not check individual
+// requests, but holds the LDAP objects in memory and applies all writes to
+// them. Like a real LDAP server, it only accepts new objects below existing
+// ones, and only deletes or moves objects that do not have children. This allows to check the final state of the LDAP database after a
+// complex sequence of syncs. All write requests are also recorded, and can be
+// inspected with TakeRequests(). It may be used from multiple goroutines at
+// once.
+type FakeLDAPDirectory struct {
+	dnSuffix string
+	//If set, this is called after each write (while no other write is in
+	//progress). This must be set before the directory is used.
+	AfterWrite func(writeCount int)
+	//The mutex guards access to all fields listed below it in this struct.
+	mutex      sync.Mutex
+	entries    map[string]map[string][]string //key = DN, then attribute type
+	writeCount int
+	requests   FakeLDAPRequests
+	rejections map[string]uint16 //key = DN, value = LDAP result code
+}
+
+// FakeLDAPRequests contains the write requests that were received by a
+// FakeLDAPDirectory, in the order in which they were received.
+type FakeLDAPRequests struct {
+	Add      []goldap.AddRequest
+	Modify   []goldap.ModifyRequest
+	ModifyDN []goldap.ModifyDNRequest
+	Delete   []goldap.DelRequest
+}
+
+// NewFakeLDAPDirectory builds an empty FakeLDAPDirectory.
+func NewFakeLDAPDirectory(dnSuffix string) *FakeLDAPDirectory {
+	return &FakeLDAPDirectory{
+		dnSuffix: dnSuffix,
+		entries:  make(map[string]map[string][]string),
+	}
+}
+
+// DNSuffix implements the ldap.Connection interface.
+func (d *FakeLDAPDirectory) DNSuffix() string {
+	return d.dnSuffix
+}
+
+// Add implements the ldap.Connection interface.
+func (d *FakeLDAPDirectory) Add(req goldap.AddRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkRejection(req.DN); err != nil {
+		return err
+	}
+	if _, exists := d.entries[req.DN]; exists {
+		return goldap.NewError(goldap.LDAPResultEntryAlreadyExists, fmt.Errorf("%s already exists", req.DN))
+	}
+	if err := d.checkParentExists(req.DN); err != nil {
+		return err
+	}
+	attrs := make(map[string][]string, len(req.Attributes))
+	for _, attr := range req.Attributes {
+		attrs[attr.Type] = attr.Vals
+	}
+	d.entries[req.DN] = attrs
+	d.requests.Add = append(d.requests.Add, normalizeAddRequest(req))
+	d.recordWrite()
+	return nil
+}
+
+// Modify implements the ldap.Connection interface.
+func (d *FakeLDAPDirectory) Modify(req goldap.ModifyRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkRejection(req.DN); err != nil {
+		return err
+	}
+	attrs, exists := d.entries[req.DN]
+	if !exists {
+		return goldap.NewError(goldap.LDAPResultNoSuchObject, fmt.Errorf("%s does not exist", req.DN))
+	}
+	for _, change := range req.Changes {
+		switch change.Operation {
+		case goldap.ReplaceAttribute:
+			attrs[change.Modification.Type] = change.Modification.Vals
+		case goldap.DeleteAttribute:
+			delete(attrs, change.Modification.Type)
+		default:
+			return fmt.Errorf("unexpected change operation %d", change.Operation)
+		}
+	}
+	d.requests.Modify = append(d.requests.Modify, normalizeModifyRequest(req))
+	d.recordWrite()
+	return nil
+}
+
+// Delete implements the ldap.Connection interface.
+func (d *FakeLDAPDirectory) Delete(req goldap.DelRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkRejection(req.DN); err != nil {
+		return err
+	}
+	if _, exists := d.entries[req.DN]; !exists {
+		return goldap.NewError(goldap.LDAPResultNoSuchObject, fmt.Errorf("%s does not exist", req.DN))
+	}
+	if err := d.checkIsLeaf(req.DN); err != nil {
+		return err
+	}
+	delete(d.entries, req.DN)
+	d.requests.Delete = append(d.requests.Delete, req)
+	d.recordWrite()
+	return nil
+}
+
+// ModifyDN implements the ldap.Connection interface. Only moves that keep the
+// RDN (i.e. only change the parent object) are supported.
+func (d *FakeLDAPDirectory) ModifyDN(req goldap.ModifyDNRequest) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkRejection(req.DN); err != nil {
+		return err
+	}
+	attrs, exists := d.entries[req.DN]
+	if !exists {
+		return goldap.NewError(goldap.LDAPResultNoSuchObject, fmt.Errorf("%s does not exist", req.DN))
+	}
+	if rdn, _ := splitDN(req.DN); rdn != req.NewRDN {
+		return fmt.Errorf("unexpected change of RDN from %s to %s", rdn, req.NewRDN)
+	}
+	newDN := req.NewRDN + "," + req.NewSuperior
+	if _, exists := d.entries[newDN]; exists {
+		return goldap.NewError(goldap.LDAPResultEntryAlreadyExists, fmt.Errorf("%s already exists", newDN))
+	}
+	if err := d.checkParentExists(newDN); err != nil {
+		return err
+	}
+	if err := d.checkIsLeaf(req.DN); err != nil {
+		return err
+	}
+	delete(d.entries, req.DN)
+	d.entries[newDN] = attrs
+	d.requests.ModifyDN = append(d.requests.ModifyDN, req)
+	d.recordWrite()
+	return nil
+}
+
+// Splits a DN into its first RDN and the DN of its parent object.
+func splitDN(dn string) (rdn, parentDN string) {
+	for idx := 0; idx < len(dn); idx++ {
+		switch dn[idx] {
+		case '\\':
+			idx++ //skip escaped character
+		case ',':
+			return dn[:idx], dn[idx+1:]
+		}
+	}
+	return dn, ""
+}
+
+func (d *FakeLDAPDirectory) checkParentExists(dn string) error {
+	if dn == d.dnSuffix {
+		return nil
+	}
+	_, parentDN := splitDN(dn)
+	if _, exists := d.entries[parentDN]; !exists {
+		return goldap.NewError(goldap.LDAPResultNoSuchObject, fmt.Errorf("parent object %s does not exist", parentDN))
+	}
+	return nil
+}
+
+func (d *FakeLDAPDirectory) checkIsLeaf(dn string) error {
+	for otherDN := range d.entries {
+		if _, parentDN := splitDN(otherDN); parentDN == dn {
+			return goldap.NewError(goldap.LDAPResultNotAllowedOnNonLeaf, fmt.Errorf("%s has children", dn))
+		}
+	}
+	return nil
+}
+
+// RejectWrites makes all subsequent writes to the object with the given DN
+// fail with the given LDAP result code, like when slapd refuses an object
+// because of a schema violation. With a result code of 0, writes to the object
+// succeed again.
+func (d *FakeLDAPDirectory) RejectWrites(dn string, resultCode uint16) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.rejections == nil {
+		d.rejections = make(map[string]uint16)
+	}
+	if resultCode == 0 {
+		delete(d.rejections, dn)
+	} else {
+		d.rejections[dn] = resultCode
+	}
+}
+
+func (d *FakeLDAPDirectory) checkRejection(dn string) error {
+	resultCode, exists := d.rejections[dn]
+	if !exists {
+		return nil
+	}
+	return goldap.NewError(resultCode, fmt.Errorf("write to %s rejected", dn))
+}
+
+func (d *FakeLDAPDirectory) recordWrite() {
+	d.writeCount++
+	if d.AfterWrite != nil {
+		d.AfterWrite(d.writeCount)
+	}
+}
+
+// Search implements the ldap.Connection interface. The request is not
+// evaluated: All objects in the directory are returned.
+func (d *FakeLDAPDirectory) Search(req goldap.SearchRequest) (*goldap.SearchResult, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var result goldap.SearchResult
+	for dn, attrs := range d.entries {
+		result.Entries = append(result.Entries, goldap.NewEntry(dn, attrs))
+	}
+	return &result, nil
+}
+
+// Reconnect implements the ldap.Connection interface.
+func (d *FakeLDAPDirectory) Reconnect(ctx context.Context) error {
+	return nil
+}
+
+// Put creates or replaces an object in the directory without recording a
+// request. This can be used to set up the directory contents that the LDAP
+// server has before a test starts.
+func (d *FakeLDAPDirectory) Put(dn string, attrs map[string][]string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.entries[dn] = attrs
+}
+
+// Clear removes all objects from the directory without recording requests,
+// like when slapd is restarted and comes back empty.
+func (d *FakeLDAPDirectory) Clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.entries = make(map[string]map[string][]string)
+}
+
+// Entries returns a copy of all objects in the directory.
+func (d *FakeLDAPDirectory) Entries() map[string]map[string][]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := make(map[string]map[string][]string, len(d.entries))
+	for dn, attrs := range d.entries {
+		result[dn] = make(map[string][]string, len(attrs))
+		for key, values := range attrs {
+			result[dn][key] = append([]string(nil), values...)
+		}
+	}
+	return result
+}
+
+// TakeRequests returns all write requests that were received since the
+// previous call to TakeRequests(), or since the directory was created.
+func (d *FakeLDAPDirectory) TakeRequests() FakeLDAPRequests {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := d.requests
+	d.requests = FakeLDAPRequests{}
+	return result
+}